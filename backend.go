@@ -28,3 +28,28 @@ type Backend interface {
 	// SendEvent sends event to the backend.
 	SendEvent(context.Context, *Event) error
 }
+
+// RawTimerBackend is an optional interface for a Backend which uses the raw samples of timers, in Timer.Values and
+// Timer.SampledCount, rather than the statistics calculated from them.  When every backend uses raw samples, the
+// aggregator does not calculate timer statistics, and timers are passed to the backends as received.
+type RawTimerBackend interface {
+	// RawTimers returns true if the backend only uses the raw samples of timers.
+	RawTimers() bool
+}
+
+// TagLimitBackend is an optional interface for a Backend which rejects metrics with too many tags.  The limit is used
+// for the backend unless it is configured in its `tag-limit` section.
+type TagLimitBackend interface {
+	// MaxTags returns the maximum number of tags the backend accepts with each metric, or 0 if there is no limit.
+	MaxTags() int
+}
+
+// RawTimersOnly returns true if there is at least one backend, and every backend only uses the raw samples of timers.
+func RawTimersOnly(backends []Backend) bool {
+	for _, b := range backends {
+		if rb, ok := b.(RawTimerBackend); !ok || !rb.RawTimers() {
+			return false
+		}
+	}
+	return len(backends) > 0
+}
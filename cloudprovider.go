@@ -60,4 +60,34 @@ type CacheOptions struct {
 	CacheEvictAfterIdlePeriod time.Duration
 	CacheTTL                  time.Duration
 	CacheNegativeTTL          time.Duration
+	// CacheNegativeTTLMax is the longest the negative TTL of an IP is extended to by consecutive failed lookups, each
+	// of which multiplies it by CacheNegativeTTLMultiplier.  The counter is reset by the first successful lookup.  0,
+	// or a value no greater than CacheNegativeTTL, means failed lookups are always cached for CacheNegativeTTL.
+	CacheNegativeTTLMax time.Duration
+	// CacheNegativeTTLMultiplier is what the negative TTL of an IP is multiplied by for each consecutive failed lookup
+	// after the first, up to CacheNegativeTTLMax.  A value no greater than 1 means there is no backoff.
+	CacheNegativeTTLMultiplier float64
+	// CacheMaxLifetime is how long an instance is used for since it was last looked up successfully, even if it is
+	// still in use and failed refreshes fall back to it.  0 means there is no limit.
+	CacheMaxLifetime time.Duration
+	// CacheMaxSize is the most entries the cache holds.  When a new IP would exceed it, the least recently accessed
+	// entry is evicted first, preferring failed lookups over instances.  Pinned entries are never evicted.  0 means
+	// there is no limit, other than CacheEvictAfterIdlePeriod.
+	CacheMaxSize int
+	// ValidateInstanceID replaces a cached instance outright when a refresh finds the IP belongs to an instance with
+	// another ID, rather than treating it as a refresh of the old instance.
+	ValidateInstanceID bool
+	// MaxConcurrentLookups is the number of lookups which can call the cloud provider at once, within the budget of
+	// the rate limiter.  0 is treated as 1, which makes lookups one at a time.
+	MaxConcurrentLookups int
+	// LookupRetries is the number of times the IPs a lookup fails to find are looked up again when it returns an error,
+	// before they are cached negatively.  Each retry waits for LookupRetryBackoff, doubled for each retry after the
+	// first, and for the rate limiter.  A lookup which finds no instance without an error is not retried.
+	LookupRetries int
+	// LookupRetryBackoff is how long the first retry of a failed lookup waits.
+	LookupRetryBackoff time.Duration
+	// PinnedInstances are IPs whose instances are never evicted, expired, or refreshed.  An IP with an instance is
+	// pinned to it from the start, and an IP with a nil instance is looked up until it's found, then pinned to the
+	// instance found.
+	PinnedInstances map[Source]*Instance
 }
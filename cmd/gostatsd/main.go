@@ -4,11 +4,13 @@ import (
 	"context"
 	_ "expvar"
 	"fmt"
+	"math"
 	"math/rand"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strconv"
 	"syscall"
 	"time"
@@ -39,6 +41,8 @@ const (
 	ParamConfigPath = "config-path"
 	// ParamVersion makes program output its version.
 	ParamVersion = "version"
+	// ParamPipelines is the list of pipelines, each configured in a pipeline.<name> block.
+	ParamPipelines = "pipelines"
 )
 
 func main() {
@@ -61,7 +65,7 @@ func main() {
 
 func run(v *viper.Viper) error {
 	logrus.Info("Starting server")
-	s, err := constructServer(v)
+	servers, err := constructServers(v)
 	if err != nil {
 		return err
 	}
@@ -76,44 +80,151 @@ func run(v *viper.Viper) error {
 	ctx, cancelFunc := context.WithCancel(context.Background())
 	defer cancelFunc()
 	cancelOnInterrupt(ctx, cancelFunc)
+	reloadOnHangup(ctx, servers)
 
-	if err := s.Run(ctx); err != nil && err != context.Canceled {
+	if err := runServers(ctx, servers); err != nil && err != context.Canceled {
 		return fmt.Errorf("server error: %v", err)
 	}
 	return nil
 }
 
+// runServers runs the servers until the context is done, or one of them stops, which stops the others.  It returns
+// the error of the first server to fail, if any.
+func runServers(ctx context.Context, servers []*statsd.Server) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	errs := make(chan error, len(servers))
+	for _, s := range servers {
+		s := s
+		go func() {
+			err := s.Run(ctx)
+			cancel()
+			errs <- err
+		}()
+	}
+	var firstErr error
+	for range servers {
+		if err := <-errs; firstErr == nil && err != context.Canceled {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// constructServers creates a server for each pipeline, or a single server if there are no pipelines.  Each pipeline
+// is an independent server in the same process, with its own listener, aggregation, and backends.
+func constructServers(v *viper.Viper) ([]*statsd.Server, error) {
+	pipelineNames := v.GetStringSlice(ParamPipelines)
+	if len(pipelineNames) == 0 {
+		s, err := constructServer(v)
+		if err != nil {
+			return nil, err
+		}
+		return []*statsd.Server{s}, nil
+	}
+
+	servers := make([]*statsd.Server, 0, len(pipelineNames))
+	addresses := make(map[string]string, len(pipelineNames))
+	stateFiles := make(map[string]string, len(pipelineNames))
+	walFiles := make(map[string]string, len(pipelineNames))
+	for _, pipelineName := range pipelineNames {
+		pv, err := newPipelineViper(v, pipelineName)
+		if err != nil {
+			return nil, err
+		}
+		addr := pv.GetString(gostatsd.ParamMetricsAddr)
+		if other, ok := addresses[addr]; ok {
+			return nil, fmt.Errorf("pipelines %s and %s both listen on %s", other, pipelineName, addr)
+		}
+		addresses[addr] = pipelineName
+		if stateFile := pv.GetString(gostatsd.ParamStateFile); stateFile != "" {
+			if other, ok := stateFiles[stateFile]; ok {
+				return nil, fmt.Errorf("pipelines %s and %s both save their state to %s", other, pipelineName, stateFile)
+			}
+			stateFiles[stateFile] = pipelineName
+		}
+		for _, walFile := range pv.GetStringMapString("write-ahead-log") {
+			if other, ok := walFiles[walFile]; ok && other != pipelineName {
+				return nil, fmt.Errorf("pipelines %s and %s both use the write-ahead log %s", other, pipelineName, walFile)
+			}
+			walFiles[walFile] = pipelineName
+		}
+		s, err := constructServer(pv)
+		if err != nil {
+			return nil, fmt.Errorf("pipeline %s: %v", pipelineName, err)
+		}
+		servers = append(servers, s)
+		logrus.Infof("Loaded pipeline %s listening on %s", pipelineName, addr)
+	}
+	return servers, nil
+}
+
+// newPipelineViper returns the configuration of a pipeline, which is the top level configuration overridden by the
+// pipeline.<name> block.  HTTP servers are not inherited, as their addresses would conflict, so a pipeline only runs
+// the HTTP servers set in its own block.  The internal metrics of the pipeline are tagged with its name.
+func newPipelineViper(v *viper.Viper, pipelineName string) (*viper.Viper, error) {
+	vPipeline := v.Sub("pipeline." + pipelineName)
+	if vPipeline == nil {
+		return nil, fmt.Errorf("pipeline %s has no pipeline.%s block", pipelineName, pipelineName)
+	}
+
+	settings := v.AllSettings()
+	delete(settings, ParamPipelines)
+	delete(settings, "pipeline")
+	delete(settings, "http-servers")
+
+	pv := viper.New()
+	if err := pv.MergeConfigMap(settings); err != nil {
+		return nil, err
+	}
+	if err := pv.MergeConfigMap(vPipeline.AllSettings()); err != nil {
+		return nil, fmt.Errorf("pipeline %s: %v", pipelineName, err)
+	}
+	pv.Set(gostatsd.ParamInternalTags, append(pv.GetStringSlice(gostatsd.ParamInternalTags), "pipeline:"+pipelineName))
+	return pv, nil
+}
+
 func constructServer(v *viper.Viper) (*statsd.Server, error) {
+	return constructServerWithPool(v, transport.NewTransportPool(logrus.StandardLogger(), v))
+}
+
+// constructServerWithPool is constructServer with the HTTP client pool provided, so tests can point the backends at
+// their own servers.
+func constructServerWithPool(v *viper.Viper, pool *transport.TransportPool) (*statsd.Server, error) {
 	var runnables []gostatsd.Runnable
 	// Logger
 	logger := logrus.StandardLogger()
 
-	// HTTP client pool
-	pool := transport.NewTransportPool(logger, v)
-
 	// Cached instances
 	var cachedInstances gostatsd.CachedInstances
 	cloudProviderName := v.GetString(gostatsd.ParamCloudProvider)
 	if cloudProviderName == "" {
 		logger.Info("No cloud provider specified")
 	} else {
-		var err error
-		// See if requested cloud provider is a native CachedInstances implementation
-		cachedInstances, err = cachedinstances.Get(logger, cloudProviderName, v, Version)
-		switch err {
-		case nil:
-		case cachedinstances.ErrUnknownProvider:
-			// See if requested cloud provider is a CloudProvider implementation
-			cloudProvider, err := cloudproviders.Get(logger, cloudProviderName, v, Version)
-			if err != nil {
-				return nil, err
-			}
-			runnables = gostatsd.MaybeAppendRunnable(runnables, cloudProvider)
-			cachedInstances = newCachedInstancesFromViper(logger, cloudProvider, v)
+		failurePolicy := v.GetString(gostatsd.ParamCloudProviderFailurePolicy)
+		switch failurePolicy {
+		case "", gostatsd.CloudProviderFailurePolicyFail, gostatsd.CloudProviderFailurePolicyContinue:
 		default:
+			return nil, fmt.Errorf("invalid %s %q", gostatsd.ParamCloudProviderFailurePolicy, failurePolicy)
+		}
+		if failurePolicy == gostatsd.CloudProviderFailurePolicyContinue && v.GetBool(gostatsd.ParamDropUnresolvedSources) {
+			// Without a cloud provider no source is resolved, but nothing would be dropped either
+			return nil, fmt.Errorf("%s can't be %s when %s is set", gostatsd.ParamCloudProviderFailurePolicy,
+				gostatsd.CloudProviderFailurePolicyContinue, gostatsd.ParamDropUnresolvedSources)
+		}
+		var cloudRunnables []gostatsd.Runnable
+		var err error
+		cachedInstances, cloudRunnables, err = newCachedInstances(logger, cloudProviderName, v)
+		switch {
+		case err == nil:
+			runnables = append(runnables, cloudRunnables...)
+		case err == cloudproviders.ErrUnknownProvider || failurePolicy != gostatsd.CloudProviderFailurePolicyContinue:
+			// An unknown name is a typo rather than a broken provider, so is always fatal
 			return nil, err
+		default:
+			logger.WithError(err).Errorf("Cloud provider %s failed to initialise, running without it", cloudProviderName)
 		}
-		runnables = gostatsd.MaybeAppendRunnable(runnables, cachedInstances)
 	}
 	// Backends
 	backendNames := v.GetStringSlice(gostatsd.ParamBackends)
@@ -126,6 +237,13 @@ func constructServer(v *viper.Viper) (*statsd.Server, error) {
 		backendsList = append(backendsList, backend)
 		runnables = gostatsd.MaybeAppendRunnable(runnables, backend)
 	}
+	if len(backendsList) == 0 && v.GetString(gostatsd.ParamServerMode) == "standalone" {
+		// Everything would be aggregated and then discarded
+		if !v.GetBool(gostatsd.ParamAllowNoBackends) {
+			return nil, fmt.Errorf("no backends configured, set %s to run without backends", gostatsd.ParamAllowNoBackends)
+		}
+		logger.Warn("No backends configured, all metrics will be discarded")
+	}
 	// Percentiles
 	pt, err := getPercentiles(v.GetStringSlice(gostatsd.ParamPercentThreshold))
 	if err != nil {
@@ -151,6 +269,7 @@ func constructServer(v *viper.Viper) (*statsd.Server, error) {
 		ExpiryIntervalGauge:   v.GetDuration(gostatsd.ParamExpiryIntervalGauge),
 		ExpiryIntervalSet:     v.GetDuration(gostatsd.ParamExpiryIntervalSet),
 		ExpiryIntervalTimer:   v.GetDuration(gostatsd.ParamExpiryIntervalTimer),
+		ExpiryMinLifetime:     v.GetDuration(gostatsd.ParamExpiryMinLifetime),
 		FlushInterval:         v.GetDuration(gostatsd.ParamFlushInterval),
 		FlushOffset:           v.GetDuration(gostatsd.ParamFlushOffset),
 		FlushAligned:          v.GetBool(gostatsd.ParamFlushAligned),
@@ -163,6 +282,7 @@ func constructServer(v *viper.Viper) (*statsd.Server, error) {
 		EstimatedTags:         v.GetInt(gostatsd.ParamEstimatedTags),
 		MetricsAddr:           v.GetString(gostatsd.ParamMetricsAddr),
 		Namespace:             v.GetString(gostatsd.ParamNamespace),
+		NamespaceSeparator:    v.GetString(gostatsd.ParamNamespaceSeparator),
 		StatserType:           v.GetString(gostatsd.ParamStatserType),
 		PercentThreshold:      pt,
 		HeartbeatEnabled:      v.GetBool(gostatsd.ParamHeartbeatEnabled),
@@ -177,8 +297,61 @@ func constructServer(v *viper.Viper) (*statsd.Server, error) {
 		DisabledSubTypes:          gostatsd.DisabledSubMetrics(v),
 		BadLineRateLimitPerSecond: rate.Limit(v.GetFloat64(gostatsd.ParamBadLinesPerMinute) / 60.0),
 		HistogramLimit:            v.GetUint32(gostatsd.ParamTimerHistogramLimit),
-		Viper:                     v,
-		TransportPool:             pool,
+		ReaderPauseHighWatermark:  v.GetInt(gostatsd.ParamReaderPauseHighWatermark),
+		ReaderPauseLowWatermark:   v.GetInt(gostatsd.ParamReaderPauseLowWatermark),
+		MaxNameLength:             v.GetInt(gostatsd.ParamMaxNameLength),
+		NameLengthPolicy:          v.GetString(gostatsd.ParamNameLengthPolicy),
+		PercentileAlgorithm:       v.GetString(gostatsd.ParamPercentileAlgorithm),
+		InternalFlushInterval:     v.GetDuration(gostatsd.ParamInternalFlushInterval),
+		TTLTag:                    v.GetString(gostatsd.ParamTTLTag),
+		FlushOffsetFromHostname:   v.GetBool(gostatsd.ParamFlushOffsetFromHostname),
+		MetricTypeTag:             v.GetString(gostatsd.ParamMetricTypeTag),
+		HostnameFallback:          v.GetString(gostatsd.ParamHostnameFallback),
+		HostnameFallbackValue:     v.GetString(gostatsd.ParamHostnameFallbackValue),
+		CounterSplit:              v.GetBool(gostatsd.ParamCounterSplit),
+		CounterTotalSuffix:        v.GetString(gostatsd.ParamCounterTotalSuffix),
+		CounterRateSuffix:         v.GetString(gostatsd.ParamCounterRateSuffix),
+		TimerMinMaxGauges:         v.GetBool(gostatsd.ParamTimerMinMaxGauges),
+		TimerMinGaugeSuffix:       v.GetString(gostatsd.ParamTimerMinGaugeSuffix),
+		TimerMaxGaugeSuffix:       v.GetString(gostatsd.ParamTimerMaxGaugeSuffix),
+		StrictParsing:             v.GetBool(gostatsd.ParamStrictParsing),
+		AggregateAcrossHosts:      v.GetBool(gostatsd.ParamAggregateAcrossHosts),
+		HostTagKeys:               v.GetStringSlice(gostatsd.ParamHostTagKeys),
+		PerSourceMetrics:          v.GetStringSlice(gostatsd.ParamPerSourceMetrics),
+		PercentileNameTemplate:    v.GetString(gostatsd.ParamPercentileNameTemplate),
+		SourceIPStrategy:          v.GetString(gostatsd.ParamSourceIPStrategy),
+		SourceIPTag:               v.GetString(gostatsd.ParamSourceIPTag),
+		InternalBackends:          v.GetStringSlice(gostatsd.ParamInternalBackends),
+		FlushSequenceEnabled:      v.GetBool(gostatsd.ParamFlushSequenceEnabled),
+		RequiredTagKeys:           v.GetStringSlice(gostatsd.ParamRequiredTagKeys),
+		RequiredTagsPolicy:        v.GetString(gostatsd.ParamRequiredTagsPolicy),
+		RequiredTagsDefaultValue:  v.GetString(gostatsd.ParamRequiredTagsDefaultValue),
+		NonFinitePolicy:           v.GetString(gostatsd.ParamNonFinitePolicy),
+		EmptyTagValuePolicy:       v.GetString(gostatsd.ParamEmptyTagValuePolicy),
+		TagKeyNormalizations:      v.GetStringSlice(gostatsd.ParamTagKeyNormalizations),
+		TagValueNormalizations:    v.GetStringSlice(gostatsd.ParamTagValueNormalizations),
+		ExpvarInternalMetrics:     v.GetBool(gostatsd.ParamExpvarInternalMetrics),
+		StateFile:                 v.GetString(gostatsd.ParamStateFile),
+		MaintenanceBackends:       v.GetStringSlice(gostatsd.ParamMaintenanceBackends),
+		MaintenanceBufferFlushes:  v.GetInt(gostatsd.ParamMaintenanceBufferFlushes),
+		WriteAheadLogMaxSize:      v.GetInt64(gostatsd.ParamWriteAheadLogMaxSize),
+		DropUnresolvedSources:     v.GetBool(gostatsd.ParamDropUnresolvedSources),
+		CloudDrainTimeout:         v.GetDuration(gostatsd.ParamCloudDrainTimeout),
+		SeriesCounts:              v.GetBool(gostatsd.ParamSeriesCounts),
+		SeriesCountsTop:           v.GetInt(gostatsd.ParamSeriesCountsTop),
+		FlushEvents:               v.GetBool(gostatsd.ParamFlushEvents),
+		FlushEventsNamespace:      v.GetString(gostatsd.ParamFlushEventsNamespace),
+		MemoryEvictionThreshold:   v.GetUint64(gostatsd.ParamMemoryEvictionThreshold),
+		MemoryEvictionRatio:       v.GetFloat64(gostatsd.ParamMemoryEvictionRatio),
+		PrometheusInternalMetrics: v.GetBool(gostatsd.ParamPrometheusInternalMetrics),
+		BuildInfo: gostatsd.BuildInfo{
+			Version:   Version,
+			GitCommit: GitCommit,
+			BuildDate: BuildDate,
+		},
+		BuildInfoEnabled: v.GetBool(gostatsd.ParamBuildInfoEnabled),
+		Viper:            v,
+		TransportPool:    pool,
 	}, nil
 }
 
@@ -189,6 +362,9 @@ func getPercentiles(s []string) ([]float64, error) {
 		if err != nil {
 			return nil, err
 		}
+		if pt == 0 || math.IsNaN(pt) || math.Abs(pt) > 100 {
+			return nil, fmt.Errorf("invalid %s %q, must be between -100 and 100, and not 0", gostatsd.ParamPercentThreshold, sPercentThreshold)
+		}
 		percentThresholds[i] = pt
 	}
 	return percentThresholds, nil
@@ -207,6 +383,94 @@ func cancelOnInterrupt(ctx context.Context, f context.CancelFunc) {
 	}()
 }
 
+// reloadOnHangup reloads the percentiles and maintenance backends of the servers from the configuration each time
+// SIGHUP is received.
+func reloadOnHangup(ctx context.Context, servers []*statsd.Server) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(c)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-c:
+				logrus.Info("Reloading configuration")
+				v, _, err := setupConfiguration()
+				if err == nil {
+					err = reloadConfiguration(ctx, v, servers)
+				}
+				if err != nil {
+					logrus.Errorf("Failed to reload configuration: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+// reloadConfiguration applies the percent-threshold, timer overrides, and maintenance-backends in the configuration
+// to the servers, which are the servers created by constructServers from an earlier version of the configuration.
+// Nothing is applied unless the configuration of every server is valid.
+func reloadConfiguration(ctx context.Context, v *viper.Viper, servers []*statsd.Server) error {
+	vipers := []*viper.Viper{v}
+	if pipelineNames := v.GetStringSlice(ParamPipelines); len(pipelineNames) > 0 {
+		vipers = vipers[:0]
+		for _, pipelineName := range pipelineNames {
+			pv, err := newPipelineViper(v, pipelineName)
+			if err != nil {
+				return err
+			}
+			vipers = append(vipers, pv)
+		}
+	}
+	if len(vipers) != len(servers) {
+		return fmt.Errorf("pipelines can't be changed without a restart")
+	}
+
+	percentThresholds := make([][]float64, len(servers))
+	timerOverrides := make([][]*statsd.TimerOverride, len(servers))
+	maintenanceBackends := make([][]string, len(servers))
+	for i, sv := range vipers {
+		var err error
+		if percentThresholds[i], err = getPercentiles(sv.GetStringSlice(gostatsd.ParamPercentThreshold)); err != nil {
+			return err
+		}
+		if timerOverrides[i], err = statsd.NewTimerOverridesFromViper(sv); err != nil {
+			return err
+		}
+		maintenanceBackends[i] = sv.GetStringSlice(gostatsd.ParamMaintenanceBackends)
+		if err = checkBackendNames(servers[i].Backends, maintenanceBackends[i]); err != nil {
+			return err
+		}
+	}
+	for i, s := range servers {
+		if err := s.ReloadPercentiles(ctx, percentThresholds[i], timerOverrides[i]); err != nil {
+			return err
+		}
+		if err := s.SetMaintenanceBackends(maintenanceBackends[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkBackendNames returns an error if any of the names is not one of the backends.
+func checkBackendNames(backends []gostatsd.Backend, names []string) error {
+	for _, name := range names {
+		found := false
+		for _, backend := range backends {
+			if backend.Name() == name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("unknown backend %q", name)
+		}
+	}
+	return nil
+}
+
 func setupConfiguration() (*viper.Viper, bool, error) {
 	v := viper.New()
 	defer setupLogger(v) // Apply logging configuration in case of early exit
@@ -220,7 +484,7 @@ func setupConfiguration() (*viper.Viper, bool, error) {
 	cmd.Bool(ParamVerbose, false, "Verbose")
 	cmd.Bool(ParamJSON, false, "Log in JSON format")
 	cmd.String(ParamProfile, "", "Enable profiler endpoint on the specified address and port")
-	cmd.String(ParamConfigPath, "", "Path to the configuration file")
+	cmd.String(ParamConfigPath, "", "Path to the configuration file, or a directory of configuration files")
 
 	gostatsd.AddFlags(cmd)
 
@@ -236,8 +500,7 @@ func setupConfiguration() (*viper.Viper, bool, error) {
 
 	configPath := v.GetString(ParamConfigPath)
 	if configPath != "" {
-		v.SetConfigFile(configPath)
-		if err := v.ReadInConfig(); err != nil {
+		if err := readConfig(v, configPath); err != nil {
 			return nil, false, err
 		}
 	}
@@ -245,6 +508,36 @@ func setupConfiguration() (*viper.Viper, bool, error) {
 	return v, version, nil
 }
 
+// readConfig reads the configuration file at configPath.  If configPath is a directory, every .toml, .yaml, and .yml
+// file in it is merged in lexical order instead, so later files override earlier ones.  Flags and environment
+// variables override them all.
+func readConfig(v *viper.Viper, configPath string) error {
+	info, err := os.Stat(configPath)
+	if err != nil || !info.IsDir() {
+		v.SetConfigFile(configPath)
+		return v.ReadInConfig()
+	}
+	entries, err := os.ReadDir(configPath) // Sorted by name
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		switch filepath.Ext(entry.Name()) {
+		case ".toml", ".yaml", ".yml":
+		default:
+			continue
+		}
+		v.SetConfigFile(filepath.Join(configPath, entry.Name()))
+		if err := v.MergeInConfig(); err != nil {
+			return fmt.Errorf("%s: %v", entry.Name(), err)
+		}
+	}
+	return nil
+}
+
 func setupLogger(v *viper.Viper) {
 	if v.GetBool(ParamVerbose) {
 		logrus.SetLevel(logrus.DebugLevel)
@@ -254,6 +547,28 @@ func setupLogger(v *viper.Viper) {
 	}
 }
 
+// newCachedInstances initialises the named cloud provider, returning it as a cached instances along with everything
+// which needs to be run for it.
+func newCachedInstances(logger logrus.FieldLogger, cloudProviderName string, v *viper.Viper) (gostatsd.CachedInstances, []gostatsd.Runnable, error) {
+	var runnables []gostatsd.Runnable
+	// See if requested cloud provider is a native CachedInstances implementation
+	cachedInstances, err := cachedinstances.Get(logger, cloudProviderName, v, Version)
+	switch err {
+	case nil:
+	case cachedinstances.ErrUnknownProvider:
+		// See if requested cloud provider is a CloudProvider implementation
+		cloudProvider, err := cloudproviders.Get(logger, cloudProviderName, v, Version)
+		if err != nil {
+			return nil, nil, err
+		}
+		runnables = gostatsd.MaybeAppendRunnable(runnables, cloudProvider)
+		cachedInstances = newCachedInstancesFromViper(logger, cloudProvider, v)
+	default:
+		return nil, nil, err
+	}
+	return cachedInstances, gostatsd.MaybeAppendRunnable(runnables, cachedInstances), nil
+}
+
 // newCachedInstancesFromViper initialises a new cached instances.
 func newCachedInstancesFromViper(logger logrus.FieldLogger, cloudProvider gostatsd.CloudProvider, v *viper.Viper) gostatsd.CachedInstances {
 	// Set the defaults in Viper based on the cloud provider values before we manipulate things
@@ -261,16 +576,54 @@ func newCachedInstancesFromViper(logger logrus.FieldLogger, cloudProvider gostat
 	v.SetDefault(gostatsd.ParamCacheEvictAfterIdlePeriod, gostatsd.DefaultCacheEvictAfterIdlePeriod)
 	v.SetDefault(gostatsd.ParamCacheTTL, gostatsd.DefaultCacheTTL)
 	v.SetDefault(gostatsd.ParamCacheNegativeTTL, gostatsd.DefaultCacheNegativeTTL)
+	v.SetDefault(gostatsd.ParamCacheNegativeTTLMax, gostatsd.DefaultCacheNegativeTTLMax)
+	v.SetDefault(gostatsd.ParamCacheNegativeTTLMultiplier, gostatsd.DefaultCacheNegativeTTLMultiplier)
+	v.SetDefault(gostatsd.ParamCacheMaxLifetime, gostatsd.DefaultCacheMaxLifetime)
+	v.SetDefault(gostatsd.ParamCacheMaxSize, gostatsd.DefaultCacheMaxSize)
+	v.SetDefault(gostatsd.ParamCacheValidateInstanceID, gostatsd.DefaultCacheValidateInstanceID)
 	v.SetDefault(gostatsd.ParamMaxCloudRequests, gostatsd.DefaultMaxCloudRequests)
 	v.SetDefault(gostatsd.ParamBurstCloudRequests, gostatsd.DefaultBurstCloudRequests)
+	v.SetDefault(gostatsd.ParamMaxConcurrentCloudRequests, gostatsd.DefaultMaxConcurrentCloudRequests)
+	v.SetDefault(gostatsd.ParamCloudLookupRetries, gostatsd.DefaultCloudLookupRetries)
+	v.SetDefault(gostatsd.ParamCloudLookupRetryBackoff, gostatsd.DefaultCloudLookupRetryBackoff)
 
 	// Set the used values based on the defaults merged with any overrides
 	cacheOptions := gostatsd.CacheOptions{
-		CacheRefreshPeriod:        v.GetDuration(gostatsd.ParamCacheRefreshPeriod),
-		CacheEvictAfterIdlePeriod: v.GetDuration(gostatsd.ParamCacheEvictAfterIdlePeriod),
-		CacheTTL:                  v.GetDuration(gostatsd.ParamCacheTTL),
-		CacheNegativeTTL:          v.GetDuration(gostatsd.ParamCacheNegativeTTL),
+		CacheRefreshPeriod:         v.GetDuration(gostatsd.ParamCacheRefreshPeriod),
+		CacheEvictAfterIdlePeriod:  v.GetDuration(gostatsd.ParamCacheEvictAfterIdlePeriod),
+		CacheTTL:                   v.GetDuration(gostatsd.ParamCacheTTL),
+		CacheNegativeTTL:           v.GetDuration(gostatsd.ParamCacheNegativeTTL),
+		CacheNegativeTTLMax:        v.GetDuration(gostatsd.ParamCacheNegativeTTLMax),
+		CacheNegativeTTLMultiplier: v.GetFloat64(gostatsd.ParamCacheNegativeTTLMultiplier),
+		CacheMaxLifetime:           v.GetDuration(gostatsd.ParamCacheMaxLifetime),
+		CacheMaxSize:               v.GetInt(gostatsd.ParamCacheMaxSize),
+		ValidateInstanceID:         v.GetBool(gostatsd.ParamCacheValidateInstanceID),
+		MaxConcurrentLookups:       v.GetInt(gostatsd.ParamMaxConcurrentCloudRequests),
+		LookupRetries:              v.GetInt(gostatsd.ParamCloudLookupRetries),
+		LookupRetryBackoff:         v.GetDuration(gostatsd.ParamCloudLookupRetryBackoff),
+		PinnedInstances:            pinnedInstances(v),
 	}
 	limiter := rate.NewLimiter(rate.Limit(v.GetInt(gostatsd.ParamMaxCloudRequests)), v.GetInt(gostatsd.ParamBurstCloudRequests))
 	return cloudprovider.NewCachedCloudProvider(logger, limiter, cloudProvider, cacheOptions)
 }
+
+// pinnedInstances returns the instances of the IPs in cloud-cache-pinned, with their tags.  An IP without tags has no
+// instance, so it's looked up until it's found, and pinned to the instance found.
+func pinnedInstances(v *viper.Viper) map[gostatsd.Source]*gostatsd.Instance {
+	pinned := v.GetStringMapStringSlice(gostatsd.ParamCachePinned)
+	if len(pinned) == 0 {
+		return nil
+	}
+	instances := make(map[gostatsd.Source]*gostatsd.Instance, len(pinned))
+	for ip, tags := range pinned {
+		if len(tags) == 0 {
+			instances[gostatsd.Source(ip)] = nil
+			continue
+		}
+		instances[gostatsd.Source(ip)] = &gostatsd.Instance{
+			ID:   gostatsd.Source(ip),
+			Tags: tags,
+		}
+	}
+	return instances
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/transport"
+)
+
+func newNoBackendsViper(serverMode string) *viper.Viper {
+	v := viper.New()
+	v.Set(gostatsd.ParamBackends, []string{})
+	v.Set(gostatsd.ParamServerMode, serverMode)
+	return v
+}
+
+func TestConstructServerNoBackends(t *testing.T) {
+	t.Parallel()
+	_, err := constructServer(newNoBackendsViper("standalone"))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), gostatsd.ParamAllowNoBackends)
+}
+
+func TestConstructServerAllowNoBackends(t *testing.T) {
+	t.Parallel()
+	v := newNoBackendsViper("standalone")
+	v.Set(gostatsd.ParamAllowNoBackends, true)
+	s, err := constructServer(v)
+	require.NoError(t, err)
+	assert.Empty(t, s.Backends)
+
+	// Forwarders send metrics upstream, so don't need backends
+	_, err = constructServer(newNoBackendsViper("forwarder"))
+	require.NoError(t, err)
+}
+
+func TestConstructServerWithPool(t *testing.T) {
+	t.Parallel()
+	var requests uint64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddUint64(&requests, 1)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer ts.Close()
+
+	v := viper.New()
+	v.Set(gostatsd.ParamBackends, []string{"datadog"})
+	v.Set("datadog.api_endpoint", ts.URL)
+	v.Set("datadog.api_key", "key")
+	pool := transport.NewTransportPool(logrus.New(), viper.New())
+
+	s, err := constructServerWithPool(v, pool)
+	require.NoError(t, err)
+	assert.Same(t, pool, s.TransportPool)
+	require.Len(t, s.Backends, 1)
+
+	mm := gostatsd.NewMetricMap()
+	mm.Counters["c"] = map[string]gostatsd.Counter{"": gostatsd.NewCounter(1, 1, "", nil)}
+	errs := make(chan []error, 1)
+	s.Backends[0].SendMetricsAsync(context.Background(), mm, func(e []error) {
+		errs <- e
+	})
+	for _, err := range <-errs {
+		require.NoError(t, err)
+	}
+	assert.NotZero(t, atomic.LoadUint64(&requests))
+}
+
+func TestReadConfigDirectory(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	files := map[string]string{
+		"10-base.toml":    "flush-interval = '10s'\nnamespace = 'base'\ndefault-tags = 'env:base'\n[statsdaemon]\naddress = 'base:8125'\ndisable-tags = true\n",
+		"20-env.yaml":     "namespace: env\nstatsdaemon:\n  address: env:8125\n",
+		"30-local.toml":   "namespace = 'local'\n",
+		"README.md":       "namespace = 'ignored'\n",
+		"40-dir.toml/x":   "namespace = 'ignored'\n",
+		"05-early.yml":    "namespace: early\nmax-readers: 2\n",
+		"99-not-toml.txt": "namespace = 'ignored'\n",
+	}
+	for name, content := range files {
+		require.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644))
+	}
+
+	v := viper.New()
+	fs := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	fs.String(gostatsd.ParamDefaultTags, "", "")
+	require.NoError(t, v.BindPFlags(fs))
+	require.NoError(t, fs.Parse([]string{"--" + gostatsd.ParamDefaultTags + "=env:flag"}))
+	require.NoError(t, readConfig(v, dir))
+
+	// Later files override earlier ones, and nested settings are merged
+	assert.Equal(t, "local", v.GetString(gostatsd.ParamNamespace))
+	assert.Equal(t, 2, v.GetInt(gostatsd.ParamMaxReaders))
+	assert.Equal(t, 10*time.Second, v.GetDuration(gostatsd.ParamFlushInterval))
+	assert.Equal(t, "env:8125", v.GetString("statsdaemon.address"))
+	assert.True(t, v.GetBool("statsdaemon.disable-tags"))
+	// Flags override every file
+	assert.Equal(t, "env:flag", v.GetString(gostatsd.ParamDefaultTags))
+
+	// A single file is still read on its own
+	v = viper.New()
+	require.NoError(t, readConfig(v, filepath.Join(dir, "20-env.yaml")))
+	assert.Equal(t, "env", v.GetString(gostatsd.ParamNamespace))
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "50-bad.toml"), []byte("namespace = "), 0o644))
+	err := readConfig(viper.New(), dir)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "50-bad.toml")
+}
+
+func newFailingCloudProviderViper(failurePolicy string) *viper.Viper {
+	v := newNoBackendsViper("forwarder")
+	v.Set(gostatsd.ParamCloudProvider, "aws")
+	v.Set("aws.client_timeout", "-1s") // Fails to initialise
+	v.Set(gostatsd.ParamCloudProviderFailurePolicy, failurePolicy)
+	return v
+}
+
+func TestConstructServerCloudProviderFailurePolicy(t *testing.T) {
+	t.Parallel()
+	_, err := constructServer(newFailingCloudProviderViper(gostatsd.CloudProviderFailurePolicyFail))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "client timeout")
+
+	// The server runs without enrichment
+	s, err := constructServer(newFailingCloudProviderViper(gostatsd.CloudProviderFailurePolicyContinue))
+	require.NoError(t, err)
+	assert.Nil(t, s.CachedInstances)
+	assert.Empty(t, s.Runnables)
+
+	// An unknown provider is always fatal
+	v := newFailingCloudProviderViper(gostatsd.CloudProviderFailurePolicyContinue)
+	v.Set(gostatsd.ParamCloudProvider, "unknown")
+	_, err = constructServer(v)
+	require.Error(t, err)
+
+	_, err = constructServer(newFailingCloudProviderViper("ignore"))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), gostatsd.ParamCloudProviderFailurePolicy)
+
+	// Running without a cloud provider would pass on the sources which should be dropped
+	v = newFailingCloudProviderViper(gostatsd.CloudProviderFailurePolicyContinue)
+	v.Set(gostatsd.ParamDropUnresolvedSources, true)
+	_, err = constructServer(v)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), gostatsd.ParamDropUnresolvedSources)
+}
+
+func newPipelinesViper() *viper.Viper {
+	v := viper.New()
+	v.Set(gostatsd.ParamBackends, []string{"null"})
+	v.Set(gostatsd.ParamServerMode, "standalone")
+	v.Set(gostatsd.ParamNamespace, "shared")
+	v.Set(gostatsd.ParamPercentThreshold, []string{"90"})
+	v.Set("http-servers", []string{"web"})
+	v.Set(ParamPipelines, []string{"billing", "infra"})
+	v.Set("pipeline.billing.metrics-addr", ":8125")
+	v.Set("pipeline.billing.namespace", "billing")
+	v.Set("pipeline.billing.default-tags", []string{"team:billing"})
+	v.Set("pipeline.billing.percent-threshold", []string{"50", "99"})
+	v.Set("pipeline.billing.internal-tags", []string{"env:prod"})
+	v.Set("pipeline.infra.metrics-addr", ":9125")
+	v.Set("pipeline.infra.backends", []string{"stdout"})
+	return v
+}
+
+func TestConstructServersPipelines(t *testing.T) {
+	t.Parallel()
+	servers, err := constructServers(newPipelinesViper())
+	require.NoError(t, err)
+	require.Len(t, servers, 2)
+
+	billing, infra := servers[0], servers[1]
+	assert.Equal(t, ":8125", billing.MetricsAddr)
+	assert.Equal(t, "billing", billing.Namespace)
+	assert.Equal(t, gostatsd.Tags{"team:billing"}, billing.DefaultTags)
+	assert.Equal(t, []float64{50, 99}, billing.PercentThreshold)
+	assert.Equal(t, gostatsd.Tags{"env:prod", "pipeline:billing"}, billing.InternalTags)
+	require.Len(t, billing.Backends, 1)
+	assert.Equal(t, "null", billing.Backends[0].Name())
+
+	// Settings which a pipeline doesn't override are inherited
+	assert.Equal(t, ":9125", infra.MetricsAddr)
+	assert.Equal(t, "shared", infra.Namespace)
+	assert.Equal(t, []float64{90}, infra.PercentThreshold)
+	assert.Equal(t, gostatsd.Tags{"pipeline:infra"}, infra.InternalTags)
+	require.Len(t, infra.Backends, 1)
+	assert.Equal(t, "stdout", infra.Backends[0].Name())
+
+	// Each pipeline has its own configuration, without the pipelines or the HTTP servers
+	assert.NotSame(t, billing.Viper, infra.Viper)
+	for _, s := range servers {
+		assert.Empty(t, s.Viper.GetStringSlice(ParamPipelines))
+		assert.Empty(t, s.Viper.GetStringSlice("http-servers"))
+	}
+}
+
+func TestConstructServersPipelineErrors(t *testing.T) {
+	t.Parallel()
+	v := newPipelinesViper()
+	v.Set("pipeline.infra.metrics-addr", ":8125")
+	_, err := constructServers(v)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "both listen on :8125")
+
+	v = newPipelinesViper()
+	v.Set(gostatsd.ParamStateFile, "/var/lib/gostatsd/state")
+	_, err = constructServers(v)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "both save their state to /var/lib/gostatsd/state")
+
+	v = newPipelinesViper()
+	v.Set("write-ahead-log.null", "/var/lib/gostatsd/null.wal")
+	v.Set("pipeline.infra.write-ahead-log.stdout", "/var/lib/gostatsd/null.wal")
+	_, err = constructServers(v)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "both use the write-ahead log /var/lib/gostatsd/null.wal")
+
+	v = newPipelinesViper()
+	v.Set(ParamPipelines, []string{"billing", "missing"})
+	_, err = constructServers(v)
+	require.Error(t, err)
+
+	v = newPipelinesViper()
+	v.Set("pipeline.infra.backends", []string{"unknown"})
+	_, err = constructServers(v)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "pipeline infra")
+}
+
+func TestReloadPercentiles(t *testing.T) {
+	t.Parallel()
+	servers, err := constructServers(newPipelinesViper())
+	require.NoError(t, err)
+
+	v := newPipelinesViper()
+	v.Set("pipeline.billing.percent-threshold", []string{"75"})
+	require.NoError(t, reloadConfiguration(context.Background(), v, servers))
+
+	v = newPipelinesViper()
+	v.Set("pipeline.billing.percent-threshold", []string{"150"})
+	require.Error(t, reloadConfiguration(context.Background(), v, servers))
+
+	v = newPipelinesViper()
+	v.Set(ParamPipelines, []string{"billing"})
+	require.Error(t, reloadConfiguration(context.Background(), v, servers))
+}
+
+func TestReloadMaintenanceBackends(t *testing.T) {
+	t.Parallel()
+	servers, err := constructServers(newPipelinesViper())
+	require.NoError(t, err)
+
+	v := newPipelinesViper()
+	v.Set("pipeline.infra.maintenance-backends", []string{"stdout"})
+	require.NoError(t, reloadConfiguration(context.Background(), v, servers))
+
+	v = newPipelinesViper()
+	v.Set("pipeline.infra.maintenance-backends", []string{"null"})
+	err = reloadConfiguration(context.Background(), v, servers)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `unknown backend "null"`)
+}
+
+func TestGetPercentiles(t *testing.T) {
+	t.Parallel()
+	pt, err := getPercentiles([]string{"90", "-10", "99.9", "99.99", "100", "-100"})
+	require.NoError(t, err)
+	assert.Equal(t, []float64{90, -10, 99.9, 99.99, 100, -100}, pt)
+
+	for _, invalid := range []string{"x", "101", "-150", "NaN", "0", "-0", "100.01"} {
+		_, err = getPercentiles([]string{invalid})
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestPinnedInstances(t *testing.T) {
+	t.Parallel()
+	assert.Nil(t, pinnedInstances(viper.New()))
+
+	v := viper.New()
+	v.SetConfigType("toml")
+	require.NoError(t, v.ReadConfig(strings.NewReader(`
+[cloud-cache-pinned]
+'10.0.0.1' = ['service:db', 'role:primary']
+'10.0.0.2' = []
+`)))
+	assert.Equal(t, map[gostatsd.Source]*gostatsd.Instance{
+		"10.0.0.1": {ID: "10.0.0.1", Tags: gostatsd.Tags{"service:db", "role:primary"}},
+		"10.0.0.2": nil,
+	}, pinnedInstances(v))
+}
+
+func TestConstructServersWithoutPipelines(t *testing.T) {
+	t.Parallel()
+	v := newNoBackendsViper("forwarder")
+	servers, err := constructServers(v)
+	require.NoError(t, err)
+	require.Len(t, servers, 1)
+	assert.Same(t, v, servers[0].Viper)
+}
+
+// capturingBackend records the names of the counters it is sent.
+type capturingBackend struct {
+	mu       sync.Mutex
+	counters map[string]float64
+}
+
+func (cb *capturingBackend) Name() string {
+	return "capturing"
+}
+
+func (cb *capturingBackend) SendMetricsAsync(ctx context.Context, mm *gostatsd.MetricMap, callback gostatsd.SendCallback) {
+	cb.mu.Lock()
+	mm.Counters.Each(func(name, tagsKey string, c gostatsd.Counter) {
+		cb.counters[name] += float64(c.Value)
+	})
+	cb.mu.Unlock()
+	callback(nil)
+}
+
+func (cb *capturingBackend) SendEvent(ctx context.Context, e *gostatsd.Event) error {
+	return nil
+}
+
+func (cb *capturingBackend) get() map[string]float64 {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	result := make(map[string]float64, len(cb.counters))
+	for name, value := range cb.counters {
+		result[name] = value
+	}
+	return result
+}
+
+func TestRunServersPipelinesAreIsolated(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	v := newPipelinesViper()
+	fs := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	gostatsd.AddFlags(fs)
+	require.NoError(t, v.BindPFlags(fs))
+	v.Set(gostatsd.ParamFlushInterval, "10ms")
+	v.Set("pipeline.billing.metrics-addr", filepath.Join(dir, "billing.sock"))
+	v.Set("pipeline.infra.metrics-addr", filepath.Join(dir, "infra.sock"))
+	servers, err := constructServers(v)
+	require.NoError(t, err)
+	backends := make([]*capturingBackend, len(servers))
+	for i, s := range servers {
+		backends[i] = &capturingBackend{counters: map[string]float64{}}
+		s.Backends = []gostatsd.Backend{backends[i]}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- runServers(ctx, servers)
+	}()
+
+	send := func(name, line string) {
+		require.Eventually(t, func() bool {
+			conn, err := net.Dial("unixgram", filepath.Join(dir, name))
+			if err != nil {
+				return false // Not listening yet
+			}
+			defer conn.Close()
+			_, err = conn.Write([]byte(line))
+			return err == nil
+		}, 5*time.Second, 10*time.Millisecond)
+	}
+	send("billing.sock", "invoices:1|c")
+	send("infra.sock", "disk:2|c")
+
+	require.Eventually(t, func() bool {
+		return backends[0].get()["billing.invoices"] == 1 && backends[1].get()["shared.disk"] == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	cancel()
+	require.NoError(t, <-done)
+
+	for name := range backends[0].get() {
+		assert.NotContains(t, name, "disk")
+	}
+	for name := range backends[1].get() {
+		assert.NotContains(t, name, "invoices")
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/jessevdk/go-flags"
+)
+
+type commandOptions struct {
+	File    string `short:"f" long:"file" required:"true" description:"Capture file to write or read"`
+	Capture struct {
+		Address  string        `short:"a" long:"address"  default:":8125" description:"Address to listen for metrics on"`
+		Duration time.Duration `short:"d" long:"duration"                 description:"How long to capture for, 0 captures until interrupted"`
+		Count    uint64        `short:"c" long:"count"                    description:"Number of datagrams to capture, 0 is unlimited"`
+	} `command:"capture" description:"Capture received datagrams to a file"`
+	Replay struct {
+		Address string  `short:"a" long:"address" default:"127.0.0.1:8125" description:"Address to send metrics"`
+		Speed   float64 `short:"s" long:"speed"   default:"1"              description:"Replay speed multiplier, 0 replays as fast as possible"`
+	} `command:"replay" description:"Replay datagrams from a file"`
+}
+
+func parseArgs(args []string) (string, commandOptions) {
+	var opts commandOptions
+	parser := flags.NewParser(&opts, flags.HelpFlag|flags.PassDoubleDash)
+	parser.LongDescription = "" + // because gofmt
+		"Captures statsd datagrams received on a UDP address to a file, and replays them\n" +
+		"to a target address, preserving the time between datagrams, scaled by the speed."
+
+	positional, err := parser.ParseArgs(args)
+	if err != nil {
+		if !isHelp(err) {
+			parser.WriteHelp(os.Stderr)
+			_, _ = fmt.Fprintf(os.Stderr, "\n\nerror parsing command line: %v\n", err)
+			os.Exit(1)
+		}
+		parser.WriteHelp(os.Stdout)
+		os.Exit(0)
+	}
+
+	if len(positional) != 0 {
+		parser.WriteHelp(os.Stderr)
+		_, _ = fmt.Fprintf(os.Stderr, "\n\nno positional arguments allowed\n")
+		os.Exit(1)
+	}
+
+	if opts.Replay.Speed < 0 {
+		parser.WriteHelp(os.Stderr)
+		_, _ = fmt.Fprintf(os.Stderr, "\n\nspeed must not be negative\n")
+		os.Exit(1)
+	}
+	return parser.Active.Name, opts
+}
+
+// isHelp is a helper to test the error from ParseArgs() to determine if the help message was written.  It is safe to
+// call without first checking that error is nil.
+func isHelp(err error) bool {
+	flagError, ok := err.(*flags.Error)
+	return ok && flagError.Type == flags.ErrHelp
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/atlassian/gostatsd/internal/lexer"
+	"github.com/atlassian/gostatsd/internal/pool"
+)
+
+// captureStats counts what was captured.
+type captureStats struct {
+	datagrams uint64
+	lines     uint64
+	badLines  uint64
+}
+
+// capture reads datagrams from conn and writes them to cw, until count datagrams have been captured, or the context
+// is done.  A count of 0 is unlimited.  Each line is validated with the same lexer as the server, and invalid lines
+// are logged and counted, but still captured, so the replay matches what was received.
+func capture(ctx context.Context, conn net.PacketConn, cw *captureWriter, count uint64) (captureStats, error) {
+	var stats captureStats
+	l := &lexer.Lexer{
+		MetricPool: pool.NewMetricPool(0),
+	}
+	buf := make([]byte, maxDatagramSize)
+	scratch := make([]byte, maxDatagramSize)
+
+	go func() {
+		// Unblock ReadFrom when the context is done
+		<-ctx.Done()
+		_ = conn.SetReadDeadline(time.Now())
+	}()
+
+	for count == 0 || stats.datagrams < count {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return stats, nil
+			}
+			return stats, err
+		}
+		datagram := buf[:n]
+		for _, line := range bytes.Split(datagram, []byte{'\n'}) {
+			if len(line) == 0 {
+				continue
+			}
+			stats.lines++
+			// The lexer modifies its input, so validate a copy
+			if _, _, err := l.Run(append(scratch[:0], line...), ""); err != nil {
+				stats.badLines++
+				log.Debugf("Invalid line %q from %s: %v", line, addr, err)
+			}
+		}
+		if err := cw.write(time.Now(), datagram); err != nil {
+			return stats, err
+		}
+		stats.datagrams++
+	}
+	return stats, nil
+}
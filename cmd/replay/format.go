@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// A capture file starts with captureMagic, followed by a record for each datagram.  Each record is the time since the
+// capture started in nanoseconds as a big endian uint64, the length of the datagram as a big endian uint32, and the
+// datagram itself.
+const captureMagic = "gostatsd-capture-v1\n"
+
+// maxDatagramSize is the largest datagram which can be received over UDP.
+const maxDatagramSize = 0xffff
+
+// captureWriter writes datagrams to a capture file.
+type captureWriter struct {
+	w     *bufio.Writer
+	start time.Time
+}
+
+// newCaptureWriter writes the capture file header to w, and returns a captureWriter which records the time of each
+// datagram relative to start.
+func newCaptureWriter(w io.Writer, start time.Time) (*captureWriter, error) {
+	cw := &captureWriter{
+		w:     bufio.NewWriter(w),
+		start: start,
+	}
+	if _, err := cw.w.WriteString(captureMagic); err != nil {
+		return nil, err
+	}
+	return cw, nil
+}
+
+// write writes a datagram received at the given time.
+func (cw *captureWriter) write(at time.Time, datagram []byte) error {
+	var header [12]byte
+	binary.BigEndian.PutUint64(header[:8], uint64(at.Sub(cw.start)))
+	binary.BigEndian.PutUint32(header[8:], uint32(len(datagram)))
+	if _, err := cw.w.Write(header[:]); err != nil {
+		return err
+	}
+	_, err := cw.w.Write(datagram)
+	return err
+}
+
+// flush writes any buffered records to the underlying writer.
+func (cw *captureWriter) flush() error {
+	return cw.w.Flush()
+}
+
+// captureReader reads datagrams from a capture file.
+type captureReader struct {
+	r *bufio.Reader
+}
+
+// newCaptureReader reads and validates the capture file header from r.
+func newCaptureReader(r io.Reader) (*captureReader, error) {
+	cr := &captureReader{
+		r: bufio.NewReader(r),
+	}
+	magic := make([]byte, len(captureMagic))
+	if _, err := io.ReadFull(cr.r, magic); err != nil || string(magic) != captureMagic {
+		return nil, errors.New("not a capture file")
+	}
+	return cr, nil
+}
+
+// next returns the next datagram, and the time it was received relative to the start of the capture.  It returns
+// io.EOF when there are no more datagrams.
+func (cr *captureReader) next() (time.Duration, []byte, error) {
+	var header [12]byte
+	if _, err := io.ReadFull(cr.r, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return 0, nil, errors.New("truncated record header")
+		}
+		return 0, nil, err
+	}
+	offset := time.Duration(binary.BigEndian.Uint64(header[:8]))
+	length := binary.BigEndian.Uint32(header[8:])
+	if length > maxDatagramSize {
+		return 0, nil, fmt.Errorf("invalid datagram length %d", length)
+	}
+	datagram := make([]byte, length)
+	if _, err := io.ReadFull(cr.r, datagram); err != nil {
+		return 0, nil, errors.New("truncated datagram")
+	}
+	return offset, datagram, nil
+}
@@ -0,0 +1,87 @@
+// Command replay captures statsd traffic to a file, and replays it against a server for load testing.
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func main() {
+	command, opts := parseArgs(os.Args[1:])
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	var err error
+	switch command {
+	case "capture":
+		err = runCapture(ctx, opts)
+	case "replay":
+		err = runReplay(ctx, opts)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func runCapture(ctx context.Context, opts commandOptions) error {
+	if opts.Capture.Duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Capture.Duration)
+		defer cancel()
+	}
+
+	conn, err := net.ListenPacket("udp", opts.Capture.Address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	f, err := os.Create(opts.File)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	cw, err := newCaptureWriter(f, time.Now())
+	if err != nil {
+		return err
+	}
+	log.Infof("Capturing datagrams on %s to %s", conn.LocalAddr(), opts.File)
+	stats, err := capture(ctx, conn, cw, opts.Capture.Count)
+	if flushErr := cw.flush(); err == nil {
+		err = flushErr
+	}
+	log.Infof("Captured %d datagrams, with %d lines, of which %d were invalid", stats.datagrams, stats.lines, stats.badLines)
+	return err
+}
+
+func runReplay(ctx context.Context, opts commandOptions) error {
+	f, err := os.Open(opts.File)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	cr, err := newCaptureReader(f)
+	if err != nil {
+		return err
+	}
+
+	conn, err := net.DialTimeout("udp", opts.Replay.Address, 1*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	log.Infof("Replaying %s to %s at %vx speed", opts.File, opts.Replay.Address, opts.Replay.Speed)
+	sent, err := replay(ctx, cr, conn, opts.Replay.Speed)
+	log.Infof("Replayed %d datagrams", sent)
+	return err
+}
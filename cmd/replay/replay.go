@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"time"
+)
+
+// replay sends each datagram from cr to conn, preserving the time between datagrams divided by speed.  A speed of 0
+// sends the datagrams as fast as possible.  It returns the number of datagrams sent.
+func replay(ctx context.Context, cr *captureReader, conn net.Conn, speed float64) (uint64, error) {
+	var sent uint64
+	start := time.Now()
+
+	for {
+		offset, datagram, err := cr.next()
+		if err == io.EOF {
+			return sent, nil
+		}
+		if err != nil {
+			return sent, err
+		}
+
+		if speed > 0 {
+			if wait := time.Until(start.Add(time.Duration(float64(offset) / speed))); wait > 0 {
+				select {
+				case <-ctx.Done():
+					return sent, ctx.Err()
+				case <-time.After(wait):
+				}
+			}
+		} else if ctx.Err() != nil {
+			return sent, ctx.Err()
+		}
+
+		if _, err := conn.Write(datagram); err != nil {
+			return sent, err
+		}
+		sent++
+	}
+}
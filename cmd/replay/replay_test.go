@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCaptureReplay(t *testing.T) {
+	t.Parallel()
+	datagrams := []string{
+		"a.counter:1|c|#tag:value\nb.gauge:2|g",
+		"c.timer:3.5|ms|@0.1\nnot a metric\n",
+		"_e{5,4}:title|text|#tag",
+	}
+
+	// Capture
+	captureConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer captureConn.Close()
+
+	var file bytes.Buffer
+	cw, err := newCaptureWriter(&file, time.Now())
+	require.NoError(t, err)
+
+	type result struct {
+		stats captureStats
+		err   error
+	}
+	done := make(chan result)
+	go func() {
+		stats, err := capture(context.Background(), captureConn, cw, uint64(len(datagrams)))
+		done <- result{stats, err}
+	}()
+
+	sender, err := net.Dial("udp", captureConn.LocalAddr().String())
+	require.NoError(t, err)
+	defer sender.Close()
+	for _, datagram := range datagrams {
+		_, err := sender.Write([]byte(datagram))
+		require.NoError(t, err)
+	}
+
+	select {
+	case r := <-done:
+		require.NoError(t, r.err)
+		assert.Equal(t, captureStats{datagrams: 3, lines: 5, badLines: 1}, r.stats)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out capturing")
+	}
+	require.NoError(t, cw.flush())
+
+	// Replay
+	targetConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer targetConn.Close()
+
+	cr, err := newCaptureReader(&file)
+	require.NoError(t, err)
+	replayConn, err := net.Dial("udp", targetConn.LocalAddr().String())
+	require.NoError(t, err)
+	defer replayConn.Close()
+
+	sent, err := replay(context.Background(), cr, replayConn, 0)
+	require.NoError(t, err)
+	assert.EqualValues(t, len(datagrams), sent)
+
+	require.NoError(t, targetConn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	buf := make([]byte, maxDatagramSize)
+	for _, expected := range datagrams {
+		n, _, err := targetConn.ReadFrom(buf)
+		require.NoError(t, err)
+		assert.Equal(t, expected, string(buf[:n]))
+	}
+}
+
+func TestReplaySpeed(t *testing.T) {
+	t.Parallel()
+	var file bytes.Buffer
+	start := time.Now()
+	cw, err := newCaptureWriter(&file, start)
+	require.NoError(t, err)
+	require.NoError(t, cw.write(start, []byte("a:1|c")))
+	require.NoError(t, cw.write(start.Add(400*time.Millisecond), []byte("a:2|c")))
+	require.NoError(t, cw.flush())
+
+	target, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer target.Close()
+	conn, err := net.Dial("udp", target.LocalAddr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	cr, err := newCaptureReader(&file)
+	require.NoError(t, err)
+	before := time.Now()
+	sent, err := replay(context.Background(), cr, conn, 4)
+	require.NoError(t, err)
+	assert.EqualValues(t, 2, sent)
+	elapsed := time.Since(before)
+	assert.GreaterOrEqual(t, elapsed, 100*time.Millisecond)
+	assert.Less(t, elapsed, 400*time.Millisecond)
+}
+
+func TestCaptureReaderInvalid(t *testing.T) {
+	t.Parallel()
+	_, err := newCaptureReader(bytes.NewBufferString("not a capture file"))
+	require.Error(t, err)
+
+	cr, err := newCaptureReader(bytes.NewBufferString(captureMagic + "\x00\x00"))
+	require.NoError(t, err)
+	_, _, err = cr.next()
+	require.Error(t, err)
+
+	cr, err = newCaptureReader(bytes.NewBufferString(captureMagic + "\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x05ab"))
+	require.NoError(t, err)
+	_, _, err = cr.next()
+	require.Error(t, err)
+}
@@ -1,12 +1,19 @@
 package gostatsd
 
+import "time"
+
 // Counter is used for storing aggregated values for counters.
 type Counter struct {
-	PerSecond float64  // The calculated per second rate
-	Value     int64    // The numeric value of the metric
-	Timestamp Nanotime // Last time value was updated
-	Source    Source   // Source of the metric
-	Tags      Tags     // The tags for the counter
+	PerSecond float64       // The calculated per second rate
+	Value     int64         // The numeric value of the metric
+	Timestamp Nanotime      // Last time value was updated
+	Source    Source        // Source of the metric
+	Tags      Tags          // The tags for the counter
+	Expiry    time.Duration // Overrides the expiry interval for counters, if not 0
+	FirstSeen Nanotime      // When the series was first aggregated, set by the aggregator
+	// SampleRate is the effective sampling rate of the values which were scaled up to Value, or 0 if they weren't
+	// sampled.  When values with different rates are aggregated, it's weighted by their scaled values.
+	SampleRate float64
 }
 
 // NewCounter initialises a new counter.
@@ -14,6 +21,38 @@ func NewCounter(timestamp Nanotime, value int64, source Source, tags Tags) Count
 	return Counter{Value: value, Timestamp: timestamp, Source: source, Tags: tags.Copy()}
 }
 
+// UnscaledValue returns the value of the counter before it was scaled up by its sampling rate, and the effective
+// sampling rate, which is 1 if it wasn't sampled.  Relays can send the value with the rate, rather than Value.
+func (c *Counter) UnscaledValue() (value float64, rate float64) {
+	rate = c.effectiveSampleRate()
+	return float64(c.Value) * rate, rate
+}
+
+func (c *Counter) effectiveSampleRate() float64 {
+	if c.SampleRate == 0 {
+		return 1
+	}
+	return c.SampleRate
+}
+
+// MergeSampleRate merges the sampling rate of from into c, and must be called before their values are added.  The
+// result is 0 if neither was sampled, or if the merged rate is not a valid rate.
+func (c *Counter) MergeSampleRate(from *Counter) {
+	if c.SampleRate == 0 && from.SampleRate == 0 {
+		return
+	}
+	total := c.Value + from.Value
+	if total == 0 {
+		c.SampleRate = 0
+		return
+	}
+	rate := (float64(c.Value)*c.effectiveSampleRate() + float64(from.Value)*from.effectiveSampleRate()) / float64(total)
+	if rate <= 0 || rate >= 1 {
+		rate = 0
+	}
+	c.SampleRate = rate
+}
+
 func (c *Counter) AddTagsSetSource(additionalTags Tags, newSource Source) {
 	c.Tags = c.Tags.Concat(additionalTags)
 	c.Source = newSource
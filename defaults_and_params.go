@@ -33,6 +33,30 @@ var DefaultTags = Tags{}
 // DefaultInternalTags is the default list of additional tags on internal metrics
 var DefaultInternalTags = Tags{}
 
+// DefaultHostTagKeys is the default list of tag keys which identify a host, removed by aggregate-across-hosts
+var DefaultHostTagKeys = []string{"host"}
+
+// DefaultPerSourceMetrics is the default list of metrics which aggregate-across-hosts also keeps per source
+var DefaultPerSourceMetrics = []string{}
+
+// DefaultInternalBackends is the default list of backends' names which internal metrics are isolated to, empty to
+// send internal metrics to every backend
+var DefaultInternalBackends = []string{}
+
+// DefaultMaintenanceBackends is the default list of backends' names which are in maintenance mode, and not sent
+// flushes
+var DefaultMaintenanceBackends = []string{}
+
+// DefaultRequiredTagKeys is the default list of tag keys which every metric must have, empty to not check tags
+var DefaultRequiredTagKeys = []string{}
+
+// DefaultTagKeyNormalizations is the default list of normalizations applied to tag keys, empty to not normalize keys
+var DefaultTagKeyNormalizations = []string{}
+
+// DefaultTagValueNormalizations is the default list of normalizations applied to tag values, empty to not normalize
+// values
+var DefaultTagValueNormalizations = []string{}
+
 const (
 	// StatserInternal is the name used to indicate the use of the internal statser.
 	StatserInternal = "internal"
@@ -49,14 +73,24 @@ const (
 	DefaultMaxCloudRequests = 10
 	// DefaultBurstCloudRequests is the burst number of cloud provider requests per second.
 	DefaultBurstCloudRequests = DefaultMaxCloudRequests + 5
+	// DefaultMaxConcurrentCloudRequests is the default number of cloud provider requests made at once.
+	DefaultMaxConcurrentCloudRequests = 1
+	// DefaultCloudLookupRetries is the default number of retries of a failed cloud provider lookup, 0 for none.
+	DefaultCloudLookupRetries = 0
+	// DefaultCloudLookupRetryBackoff is the default wait before the first retry of a failed cloud provider lookup.
+	DefaultCloudLookupRetryBackoff = 100 * time.Millisecond
 	// DefaultExpiryInterval is the default expiry interval for metrics.
 	DefaultExpiryInterval = 5 * time.Minute
+	// DefaultExpiryMinLifetime is the default minimum time a series is kept after it is first seen.
+	DefaultExpiryMinLifetime = 0
 	// DefaultFlushInterval is the default metrics flush interval.
 	DefaultFlushInterval = 1 * time.Second
 	// DefaultFlushOffset is the default metrics flush interval offset when alignment is enabled
 	DefaultFlushOffset = 0
 	// DefaultFlushOffset is the default for whether metric flushing should be aligned
 	DefaultFlushAligned = false
+	// DefaultFlushOffsetFromHostname is the default for whether the flush offset is derived from the hostname
+	DefaultFlushOffsetFromHostname = false
 	// DefaultIgnoreHost is the default value for whether the source should be used as the host
 	DefaultIgnoreHost = false
 	// DefaultMetricsAddr is the default address on which to listen for metrics.
@@ -73,12 +107,28 @@ const (
 	DefaultCacheTTL = 30 * time.Minute
 	// DefaultCacheNegativeTTL is the default cache TTL for failed lookups (errors or when instance was not found).
 	DefaultCacheNegativeTTL = 1 * time.Minute
+	// DefaultCacheNegativeTTLMax is the default maximum cache TTL for consecutive failed lookups, 0 for no backoff.
+	DefaultCacheNegativeTTLMax = time.Duration(0)
+	// DefaultCacheNegativeTTLMultiplier is the default multiplier of the cache TTL for each consecutive failed lookup.
+	DefaultCacheNegativeTTLMultiplier = 2.0
+	// DefaultCacheMaxLifetime is the default maximum lifetime of a cached instance, 0 for no limit.
+	DefaultCacheMaxLifetime = time.Duration(0)
+	// DefaultCacheMaxSize is the default maximum number of entries in the cache, 0 for no limit.
+	DefaultCacheMaxSize = 0
+	// DefaultCacheValidateInstanceID is the default setting for replacing cached instances whose ID changes.
+	DefaultCacheValidateInstanceID = false
+	// DefaultNamespaceSeparator is the default separator between the namespace and the metric name
+	DefaultNamespaceSeparator = "."
 	// DefaultInternalNamespace is the default internal namespace
 	DefaultInternalNamespace = "statsd"
 	// DefaultHeartbeatEnabled is the default heartbeat enabled flag
 	DefaultHeartbeatEnabled = false
 	// DefaultReceiveBatchSize is the number of datagrams to read in each receive batch
 	DefaultReceiveBatchSize = 50
+	// DefaultReaderPauseHighWatermark is the default aggregator queue length at which readers pause, 0 to disable
+	DefaultReaderPauseHighWatermark = 0
+	// DefaultReaderPauseLowWatermark is the default aggregator queue length at which paused readers resume
+	DefaultReaderPauseLowWatermark = 0
 	// DefaultEstimatedTags is the estimated number of expected tags on an individual metric submitted externally
 	DefaultEstimatedTags = 4
 	// DefaultConnPerReader is the default for whether to create a connection per reader
@@ -93,6 +143,155 @@ const (
 	DefaultTimerHistogramLimit = math.MaxUint32
 	// DefaultLogRawMetric is the default value for whether to log the metrics received from network
 	DefaultLogRawMetric = false
+	// DefaultMaxNameLength is the default maximum length of a metric name, 0 for unlimited
+	DefaultMaxNameLength = 0
+	// DefaultNameLengthPolicy is the default action for metric names longer than the maximum
+	DefaultNameLengthPolicy = NameLengthPolicyDrop
+	// DefaultPercentileAlgorithm is the default algorithm used to calculate timer percentiles
+	DefaultPercentileAlgorithm = PercentileAlgorithmSort
+	// DefaultInternalFlushInterval is the default internal metrics flush interval, 0 to use the flush interval
+	DefaultInternalFlushInterval = 0
+	// DefaultTTLTag is the default name of the tag which overrides the expiry interval of a series, empty to disable
+	DefaultTTLTag = ""
+	// DefaultAllowNoBackends is the default for whether the server may run in standalone mode without backends
+	DefaultAllowNoBackends = false
+	// DefaultMetricTypeTag is the default key of the tag added with the type of each flushed metric, empty to disable
+	DefaultMetricTypeTag = ""
+	// DefaultHostnameFallback is the default hostname used when the hostname is empty
+	DefaultHostnameFallback = HostnameFallbackOS
+	// DefaultCounterSplit is the default for whether counters are emitted as separate total and rate gauges
+	DefaultCounterSplit = false
+	// DefaultCounterTotalSuffix is the default suffix of the total of a split counter
+	DefaultCounterTotalSuffix = "count"
+	// DefaultCounterRateSuffix is the default suffix of the per second rate of a split counter
+	DefaultCounterRateSuffix = "rate"
+	// DefaultTimerMinMaxGauges is the default for whether timer min and max are also emitted as gauges
+	DefaultTimerMinMaxGauges = false
+	// DefaultTimerMinGaugeSuffix is the default suffix of the gauge of a timer's min
+	DefaultTimerMinGaugeSuffix = "min"
+	// DefaultTimerMaxGaugeSuffix is the default suffix of the gauge of a timer's max
+	DefaultTimerMaxGaugeSuffix = "max"
+	// DefaultStrictParsing is the default for whether lines with surrounding whitespace, and empty lines, are rejected
+	DefaultStrictParsing = false
+	// DefaultAggregateAcrossHosts is the default for whether the same metric from every host is aggregated in to one series
+	DefaultAggregateAcrossHosts = false
+	// DefaultPercentileNameTemplate is the default template for the names of timer percentile sub-metrics
+	DefaultPercentileNameTemplate = "{stat}_{pct}"
+	// DefaultSourceIPStrategy is the default strategy for determining the source IP of metrics and events
+	DefaultSourceIPStrategy = SourceIPStrategyPeer
+	// DefaultSourceIPTag is the default key of the tag which overrides the source IP
+	DefaultSourceIPTag = "_host_ip"
+	// DefaultFlushSequenceEnabled is the default for whether the flush sequence number is emitted
+	DefaultFlushSequenceEnabled = false
+	// DefaultRequiredTagsPolicy is the default policy for metrics missing required tags
+	DefaultRequiredTagsPolicy = RequiredTagsPolicyDrop
+	// DefaultRequiredTagsDefaultValue is the default value of required tags added to annotated metrics
+	DefaultRequiredTagsDefaultValue = "unknown"
+	// DefaultEmptyTagValuePolicy is the default policy for tags with an empty value
+	DefaultEmptyTagValuePolicy = EmptyTagValuePolicyKeep
+	// DefaultNonFinitePolicy is the default policy for metrics with NaN or infinite values
+	DefaultNonFinitePolicy = NonFinitePolicyReject
+	// DefaultExpvarInternalMetrics is the default for whether internal metrics are published with expvar
+	DefaultExpvarInternalMetrics = false
+	// DefaultStateFile is the default file the aggregator state is saved to on shutdown, empty to not save it
+	DefaultStateFile = ""
+	// DefaultMaintenanceBufferFlushes is the default number of flushes buffered for a backend in maintenance mode
+	DefaultMaintenanceBufferFlushes = 0
+	// DefaultWriteAheadLogMaxSize is the default maximum size in bytes of the write-ahead log of each backend
+	DefaultWriteAheadLogMaxSize = 64 * 1024 * 1024
+	// DefaultDropUnresolvedSources is the default for whether metrics and events from sources the cloud provider can't resolve are dropped
+	DefaultDropUnresolvedSources = false
+	// DefaultCloudDrainTimeout is the default for how long metrics and events awaiting a cloud provider lookup are dispatched for on shutdown
+	DefaultCloudDrainTimeout = 1 * time.Second
+	// DefaultSeriesCounts is the default for whether the number of series of each metric is emitted every flush
+	DefaultSeriesCounts = false
+	// DefaultSeriesCountsTop is the default number of metrics with the most series which series counts are emitted for, 0 for every metric
+	DefaultSeriesCountsTop = 0
+	// DefaultFlushEvents is the default for whether an event summarising each flush is sent to the backends
+	DefaultFlushEvents = false
+	// DefaultFlushEventsNamespace is the default namespace of the title of flush events
+	DefaultFlushEventsNamespace = "gostatsd"
+	// DefaultMemoryEvictionThreshold is the default heap size in bytes above which the aggregators evict series, 0 to never evict them
+	DefaultMemoryEvictionThreshold = 0
+	// DefaultMemoryEvictionRatio is the default share of each aggregator's series evicted every flush while over the memory eviction threshold
+	DefaultMemoryEvictionRatio = 0.1
+	// DefaultCloudProviderFailurePolicy is the default policy for a cloud provider which fails to initialise
+	DefaultCloudProviderFailurePolicy = CloudProviderFailurePolicyFail
+	// DefaultPrometheusInternalMetrics is the default for whether internal metrics are published in the Prometheus format
+	DefaultPrometheusInternalMetrics = false
+	// DefaultBuildInfoEnabled is the default for whether the build info metric is emitted
+	DefaultBuildInfoEnabled = false
+)
+
+const (
+	// NameLengthPolicyDrop is the name used to indicate metrics with long names are dropped.
+	NameLengthPolicyDrop = "drop"
+	// NameLengthPolicyTruncate is the name used to indicate long metric names are truncated.
+	NameLengthPolicyTruncate = "truncate"
+)
+
+const (
+	// PercentileAlgorithmSort is the name used to indicate timer values are sorted to calculate percentiles.
+	PercentileAlgorithmSort = "sort"
+	// PercentileAlgorithmSelect is the name used to indicate timer percentiles are found with a selection algorithm.
+	PercentileAlgorithmSelect = "select"
+)
+
+const (
+	// HostnameFallbackOS is the name used to indicate the OS hostname is used when the hostname is empty.
+	HostnameFallbackOS = "os"
+	// HostnameFallbackFixed is the name used to indicate a fixed value is used when the hostname is empty.
+	HostnameFallbackFixed = "fixed"
+	// HostnameFallbackOmit is the name used to indicate no hostname is used when the hostname is empty.
+	HostnameFallbackOmit = "omit"
+)
+
+const (
+	// SourceIPStrategyPeer is the name used to indicate the source IP is the address a datagram is received from.
+	SourceIPStrategyPeer = "peer"
+	// SourceIPStrategyTag is the name used to indicate the source IP is from a tag, if it is present.
+	SourceIPStrategyTag = "tag"
+)
+
+const (
+	// RequiredTagsPolicyDrop is the name used to indicate metrics missing required tags are dropped.
+	RequiredTagsPolicyDrop = "drop"
+	// RequiredTagsPolicyAnnotate is the name used to indicate metrics missing required tags are annotated.
+	RequiredTagsPolicyAnnotate = "annotate"
+)
+
+const (
+	// EmptyTagValuePolicyKeep is the name used to indicate tags with an empty value, such as `env:`, are kept as they are.
+	EmptyTagValuePolicyKeep = "keep"
+	// EmptyTagValuePolicyDrop is the name used to indicate tags with an empty value are removed.
+	EmptyTagValuePolicyDrop = "drop"
+	// EmptyTagValuePolicyKeyOnly is the name used to indicate tags with an empty value are converted to a tag of just the key, such as `env`.
+	EmptyTagValuePolicyKeyOnly = "key-only"
+)
+
+const (
+	// NonFinitePolicyReject is the name used to indicate metrics with infinite values are rejected as bad lines.
+	NonFinitePolicyReject = "reject"
+	// NonFinitePolicyClamp is the name used to indicate infinite values are clamped to the largest finite value.
+	NonFinitePolicyClamp = "clamp"
+	// NonFinitePolicyPass is the name used to indicate infinite values are passed through unchanged.
+	NonFinitePolicyPass = "pass"
+)
+
+const (
+	// CloudProviderFailurePolicyFail is the name used to indicate the server fails to start if the cloud provider fails to initialise.
+	CloudProviderFailurePolicyFail = "fail"
+	// CloudProviderFailurePolicyContinue is the name used to indicate the server runs without a cloud provider if it fails to initialise.
+	CloudProviderFailurePolicyContinue = "continue"
+)
+
+const (
+	// TagNormalizationLowercase is the name used to indicate tag keys or values are lowercased.
+	TagNormalizationLowercase = "lowercase"
+	// TagNormalizationTrim is the name used to indicate surrounding whitespace is trimmed from tag keys or values.
+	TagNormalizationTrim = "trim"
+	// TagNormalizationNFC is the name used to indicate tag keys or values are converted to Unicode normalization form C.
+	TagNormalizationNFC = "nfc"
 )
 
 const (
@@ -104,6 +303,12 @@ const (
 	ParamMaxCloudRequests = "max-cloud-requests"
 	// ParamBurstCloudRequests is the name of parameter with burst number of cloud provider requests per second.
 	ParamBurstCloudRequests = "burst-cloud-requests"
+	// ParamMaxConcurrentCloudRequests is the name of parameter with the number of cloud provider requests made at once.
+	ParamMaxConcurrentCloudRequests = "max-concurrent-cloud-requests"
+	// ParamCloudLookupRetries is the name of parameter with the number of retries of a failed cloud provider lookup.
+	ParamCloudLookupRetries = "cloud-lookup-retries"
+	// ParamCloudLookupRetryBackoff is the name of parameter with the wait before the first retry of a failed cloud provider lookup.
+	ParamCloudLookupRetryBackoff = "cloud-lookup-retry-backoff"
 	// ParamDefaultTags is the name of parameter with the list of additional tags.
 	ParamDefaultTags = "default-tags"
 	// ParamInternalTags is the name of parameter with the list of tags for internal metrics.
@@ -120,12 +325,16 @@ const (
 	ParamExpiryIntervalSet = "expiry-interval-set"
 	// ParamExpiryIntervalTimer is the name of parameter with overrides timer expiry interval for metrics.
 	ParamExpiryIntervalTimer = "expiry-interval-timer"
+	// ParamExpiryMinLifetime is the name of parameter with the minimum time a series is kept after it is first seen.
+	ParamExpiryMinLifetime = "expiry-min-lifetime"
 	// ParamFlushInterval is the name of parameter with metrics flush interval.
 	ParamFlushInterval = "flush-interval"
 	// ParamFlushInterval is the name of parameter with metrics flush interval alignment.
 	ParamFlushOffset = "flush-offset"
 	// ParamFlushInterval is the name of parameter with metrics flush interval alignment enable state.
 	ParamFlushAligned = "flush-aligned"
+	// ParamFlushOffsetFromHostname is the name of parameter indicating if the flush offset is derived from the hostname.
+	ParamFlushOffsetFromHostname = "flush-offset-from-hostname"
 	// ParamIgnoreHost is the name of parameter indicating if the source should be used as the host
 	ParamIgnoreHost = "ignore-host"
 	// ParamMaxReaders is the name of parameter with number of socket readers.
@@ -148,10 +357,25 @@ const (
 	ParamCacheTTL = "cloud-cache-ttl"
 	// ParamCacheNegativeTTL is the name of parameter with cache TTL for failed lookups (errors or when instance was not found).
 	ParamCacheNegativeTTL = "cloud-cache-negative-ttl"
+	// ParamCacheNegativeTTLMax is the name of parameter with the maximum cache TTL for consecutive failed lookups.
+	ParamCacheNegativeTTLMax = "cloud-cache-negative-ttl-max"
+	// ParamCacheNegativeTTLMultiplier is the name of parameter with the multiplier of the cache TTL for each consecutive failed lookup.
+	ParamCacheNegativeTTLMultiplier = "cloud-cache-negative-ttl-multiplier"
+	// ParamCacheMaxLifetime is the name of parameter with the maximum lifetime of a cached instance.
+	ParamCacheMaxLifetime = "cloud-cache-max-lifetime"
+	// ParamCacheMaxSize is the name of parameter with the maximum number of entries in the cache.
+	ParamCacheMaxSize = "cloud-cache-max-size"
+	// ParamCacheValidateInstanceID is the name of parameter with whether cached instances whose ID changes are replaced.
+	ParamCacheValidateInstanceID = "cloud-cache-validate-instance-id"
+	// ParamCachePinned is the name of parameter with the IPs whose cloud cache entries are pinned, and their tags.  It
+	// can only be set in a config file.
+	ParamCachePinned = "cloud-cache-pinned"
 	// ParamMetricsAddr is the name of parameter with address on which to listen for metrics.
 	ParamMetricsAddr = "metrics-addr"
 	// ParamNamespace is the name of parameter with namespace for all metrics.
 	ParamNamespace = "namespace"
+	// ParamNamespaceSeparator is the name of parameter with the separator between the namespace and the metric name.
+	ParamNamespaceSeparator = "namespace-separator"
 	// ParamStatserType is the name of parameter with type of statser.
 	ParamStatserType = "statser-type"
 	// ParamPercentThreshold is the name of parameter with list of applied percentiles.
@@ -160,6 +384,10 @@ const (
 	ParamHeartbeatEnabled = "heartbeat-enabled"
 	// ParamReceiveBatchSize is the name of the parameter with the number of datagrams to read in each receive batch
 	ParamReceiveBatchSize = "receive-batch-size"
+	// ParamReaderPauseHighWatermark is the name of the parameter with the aggregator queue length at which readers pause
+	ParamReaderPauseHighWatermark = "reader-pause-high-watermark"
+	// ParamReaderPauseLowWatermark is the name of the parameter with the aggregator queue length at which readers resume
+	ParamReaderPauseLowWatermark = "reader-pause-low-watermark"
 	// ParamConnPerReader is the name of the parameter indicating whether to create a connection per reader
 	ParamConnPerReader = "conn-per-reader"
 	// ParamBadLineRateLimitPerMinute is the name of the parameter indicating how many bad lines can be logged per minute
@@ -172,6 +400,100 @@ const (
 	ParamTimerHistogramLimit = "timer-histogram-limit"
 	// ParamLogRawMetric enables custom metrics to be printed to stdout
 	ParamLogRawMetric = "log-raw-metric"
+	// ParamMaxNameLength is the name of parameter with the maximum length of a metric name
+	ParamMaxNameLength = "max-name-length"
+	// ParamNameLengthPolicy is the name of parameter with the action for metric names longer than the maximum
+	ParamNameLengthPolicy = "name-length-policy"
+	// ParamPercentileAlgorithm is the name of parameter with the algorithm used to calculate timer percentiles
+	ParamPercentileAlgorithm = "percentile-algorithm"
+	// ParamInternalFlushInterval is the name of parameter with the internal metrics flush interval
+	ParamInternalFlushInterval = "internal-flush-interval"
+	// ParamTTLTag is the name of parameter with the name of the tag which overrides the expiry interval of a series
+	ParamTTLTag = "ttl-tag"
+	// ParamAllowNoBackends is the name of parameter which allows the server to run in standalone mode without backends
+	ParamAllowNoBackends = "allow-no-backends"
+	// ParamMetricTypeTag is the name of parameter with the key of the tag added with the type of each flushed metric
+	ParamMetricTypeTag = "metric-type-tag"
+	// ParamHostnameFallback is the name of parameter with what is used when the hostname is empty
+	ParamHostnameFallback = "hostname-fallback"
+	// ParamHostnameFallbackValue is the name of parameter with the hostname used by the fixed hostname fallback
+	ParamHostnameFallbackValue = "hostname-fallback-value"
+	// ParamCounterSplit is the name of parameter indicating if counters are emitted as separate total and rate gauges
+	ParamCounterSplit = "counter-split"
+	// ParamCounterTotalSuffix is the name of parameter with the suffix of the total of a split counter
+	ParamCounterTotalSuffix = "counter-total-suffix"
+	// ParamCounterRateSuffix is the name of parameter with the suffix of the per second rate of a split counter
+	ParamCounterRateSuffix = "counter-rate-suffix"
+	// ParamTimerMinMaxGauges is the name of parameter indicating if timer min and max are also emitted as gauges
+	ParamTimerMinMaxGauges = "timer-min-max-gauges"
+	// ParamTimerMinGaugeSuffix is the name of parameter with the suffix of the gauge of a timer's min
+	ParamTimerMinGaugeSuffix = "timer-min-gauge-suffix"
+	// ParamTimerMaxGaugeSuffix is the name of parameter with the suffix of the gauge of a timer's max
+	ParamTimerMaxGaugeSuffix = "timer-max-gauge-suffix"
+	// ParamStrictParsing is the name of parameter indicating if lines with surrounding whitespace, and empty lines, are rejected
+	ParamStrictParsing = "strict-parsing"
+	// ParamAggregateAcrossHosts is the name of parameter indicating if the same metric from every host is aggregated in to one series
+	ParamAggregateAcrossHosts = "aggregate-across-hosts"
+	// ParamHostTagKeys is the name of parameter with the list of tag keys which identify a host
+	ParamHostTagKeys = "host-tag-keys"
+	// ParamPerSourceMetrics is the name of parameter with the list of metrics which aggregate-across-hosts also keeps per source
+	ParamPerSourceMetrics = "per-source-metrics"
+	// ParamPercentileNameTemplate is the name of parameter with the template for the names of timer percentile sub-metrics
+	ParamPercentileNameTemplate = "percentile-name-template"
+	// ParamSourceIPStrategy is the name of parameter with the strategy for determining the source IP of metrics and events
+	ParamSourceIPStrategy = "source-ip-strategy"
+	// ParamSourceIPTag is the name of parameter with the key of the tag which overrides the source IP
+	ParamSourceIPTag = "source-ip-tag"
+	// ParamInternalBackends is the name of parameter with the backends which receive internal metrics, instead of other metrics
+	ParamInternalBackends = "internal-backends"
+	// ParamFlushSequenceEnabled is the name of the parameter indicating if the flush sequence number is emitted
+	ParamFlushSequenceEnabled = "flush-sequence-enabled"
+	// ParamRequiredTagKeys is the name of parameter with the list of tag keys which every metric must have
+	ParamRequiredTagKeys = "required-tag-keys"
+	// ParamRequiredTagsPolicy is the name of parameter with the policy for metrics missing required tags
+	ParamRequiredTagsPolicy = "required-tags-policy"
+	// ParamRequiredTagsDefaultValue is the name of parameter with the value of required tags added to annotated metrics
+	ParamRequiredTagsDefaultValue = "required-tags-default-value"
+	// ParamEmptyTagValuePolicy is the name of parameter with the policy for tags with an empty value
+	ParamEmptyTagValuePolicy = "empty-tag-value-policy"
+	// ParamNonFinitePolicy is the name of parameter with the policy for metrics with NaN or infinite values
+	ParamNonFinitePolicy = "non-finite-policy"
+	// ParamTagKeyNormalizations is the name of parameter with the list of normalizations applied to tag keys
+	ParamTagKeyNormalizations = "tag-key-normalizations"
+	// ParamTagValueNormalizations is the name of parameter with the list of normalizations applied to tag values
+	ParamTagValueNormalizations = "tag-value-normalizations"
+	// ParamExpvarInternalMetrics is the name of the parameter indicating if internal metrics are published with expvar
+	ParamExpvarInternalMetrics = "expvar-internal-metrics"
+	// ParamStateFile is the name of the parameter with the file the aggregator state is saved to and restored from
+	ParamStateFile = "state-file"
+	// ParamMaintenanceBackends is the name of the parameter with the backends which are in maintenance mode
+	ParamMaintenanceBackends = "maintenance-backends"
+	// ParamMaintenanceBufferFlushes is the name of the parameter with the number of flushes buffered for a backend in maintenance mode
+	ParamMaintenanceBufferFlushes = "maintenance-buffer-flushes"
+	// ParamWriteAheadLogMaxSize is the name of the parameter with the maximum size in bytes of the write-ahead log of each backend
+	ParamWriteAheadLogMaxSize = "write-ahead-log-max-size"
+	// ParamDropUnresolvedSources is the name of the parameter indicating if metrics and events from sources the cloud provider can't resolve are dropped
+	ParamDropUnresolvedSources = "drop-unresolved-sources"
+	// ParamCloudDrainTimeout is the name of the parameter with how long metrics and events awaiting a cloud provider lookup are dispatched for on shutdown
+	ParamCloudDrainTimeout = "cloud-drain-timeout"
+	// ParamSeriesCounts is the name of the parameter indicating if the number of series of each metric is emitted every flush
+	ParamSeriesCounts = "series-counts"
+	// ParamSeriesCountsTop is the name of the parameter with the number of metrics with the most series which series counts are emitted for
+	ParamSeriesCountsTop = "series-counts-top"
+	// ParamFlushEvents is the name of the parameter indicating if an event summarising each flush is sent to the backends
+	ParamFlushEvents = "flush-events"
+	// ParamFlushEventsNamespace is the name of the parameter with the namespace of the title of flush events
+	ParamFlushEventsNamespace = "flush-events-namespace"
+	// ParamMemoryEvictionThreshold is the name of the parameter with the heap size in bytes above which the aggregators evict series
+	ParamMemoryEvictionThreshold = "memory-eviction-threshold"
+	// ParamMemoryEvictionRatio is the name of the parameter with the share of each aggregator's series evicted every flush while over the memory eviction threshold
+	ParamMemoryEvictionRatio = "memory-eviction-ratio"
+	// ParamCloudProviderFailurePolicy is the name of the parameter with the policy for a cloud provider which fails to initialise
+	ParamCloudProviderFailurePolicy = "cloud-provider-failure-policy"
+	// ParamPrometheusInternalMetrics is the name of the parameter indicating if internal metrics are published in the Prometheus format
+	ParamPrometheusInternalMetrics = "prometheus-internal-metrics"
+	// ParamBuildInfoEnabled is the name of the parameter indicating if the build info metric is emitted
+	ParamBuildInfoEnabled = "build-info-enabled"
 )
 
 // AddFlags adds flags to the specified FlagSet.
@@ -182,9 +504,11 @@ func AddFlags(fs *pflag.FlagSet) {
 	fs.Duration(ParamExpiryIntervalGauge, DefaultExpiryInterval, "Overrides "+ParamExpiryInterval+" for gauges")
 	fs.Duration(ParamExpiryIntervalSet, DefaultExpiryInterval, "Overrides "+ParamExpiryInterval+" for sets")
 	fs.Duration(ParamExpiryIntervalTimer, DefaultExpiryInterval, "Overrides "+ParamExpiryInterval+" for timers")
+	fs.Duration(ParamExpiryMinLifetime, DefaultExpiryMinLifetime, "Minimum time a new series is kept before it can expire")
 	fs.Duration(ParamFlushInterval, DefaultFlushInterval, "How often to flush metrics to the backends")
 	fs.Duration(ParamFlushOffset, DefaultFlushOffset, "Flush offset to use when flush alignment is enabled")
 	fs.Bool(ParamFlushAligned, DefaultFlushAligned, "Enable aligned flush interval")
+	fs.Bool(ParamFlushOffsetFromHostname, DefaultFlushOffsetFromHostname, "Derive the flush offset from a hash of the hostname, instead of flush-offset")
 	fs.Bool(ParamIgnoreHost, DefaultIgnoreHost, "Ignore the source for populating the hostname field of metrics")
 	fs.Int(ParamMaxReaders, DefaultMaxReaders, "Maximum number of socket readers")
 	fs.Int(ParamMaxParsers, DefaultMaxParsers, "Maximum number of workers to parse datagrams into metrics")
@@ -196,11 +520,20 @@ func AddFlags(fs *pflag.FlagSet) {
 	fs.Duration(ParamCacheEvictAfterIdlePeriod, DefaultCacheEvictAfterIdlePeriod, "Idle cloud cache eviction period")
 	fs.Duration(ParamCacheTTL, DefaultCacheTTL, "Cloud cache TTL for successful lookups")
 	fs.Duration(ParamCacheNegativeTTL, DefaultCacheNegativeTTL, "Cloud cache TTL for failed lookups")
+	fs.Duration(ParamCacheNegativeTTLMax, DefaultCacheNegativeTTLMax, "Maximum cloud cache TTL for consecutive failed lookups of an IP, 0 for no backoff")
+	fs.Float64(ParamCacheNegativeTTLMultiplier, DefaultCacheNegativeTTLMultiplier, "Multiplier of the cloud cache TTL for each consecutive failed lookup of an IP, up to the maximum")
+	fs.Duration(ParamCacheMaxLifetime, DefaultCacheMaxLifetime, "Maximum time a cloud cache entry is used for since it was last looked up successfully, 0 for no limit")
+	fs.Int(ParamCacheMaxSize, DefaultCacheMaxSize, "Maximum number of entries in the cloud cache, the least recently accessed are evicted beyond it, 0 for no limit")
+	fs.Bool(ParamCacheValidateInstanceID, DefaultCacheValidateInstanceID, "Replace cloud cache entries whose instance ID changes, as the IP has been reused")
 	fs.String(ParamMetricsAddr, DefaultMetricsAddr, "Address on which to listen for metrics")
 	fs.String(ParamNamespace, "", "Namespace all metrics")
+	fs.String(ParamNamespaceSeparator, DefaultNamespaceSeparator, "Separator between the namespace and the metric name")
 	fs.String(ParamBackends, strings.Join(DefaultBackends, " "), "Space separated list of backends")
 	fs.Int(ParamMaxCloudRequests, DefaultMaxCloudRequests, "Maximum number of cloud provider requests per second")
 	fs.Int(ParamBurstCloudRequests, DefaultBurstCloudRequests, "Burst number of cloud provider requests per second")
+	fs.Int(ParamMaxConcurrentCloudRequests, DefaultMaxConcurrentCloudRequests, "Maximum number of cloud provider requests made at once")
+	fs.Int(ParamCloudLookupRetries, DefaultCloudLookupRetries, "Number of times a failed cloud provider lookup is retried before it is cached as failed")
+	fs.Duration(ParamCloudLookupRetryBackoff, DefaultCloudLookupRetryBackoff, "Wait before the first retry of a failed cloud provider lookup, doubled for each retry after")
 	fs.String(ParamDefaultTags, strings.Join(DefaultTags, " "), "Space separated list of tags to add to all metrics")
 	fs.String(ParamInternalTags, strings.Join(DefaultInternalTags, " "), "Space separated list of tags to add to internal metrics")
 	fs.String(ParamInternalNamespace, DefaultInternalNamespace, "Namespace for internal metrics, may be \"\"")
@@ -208,11 +541,60 @@ func AddFlags(fs *pflag.FlagSet) {
 	fs.String(ParamPercentThreshold, strings.Join(toStringSlice(DefaultPercentThreshold), " "), "Space separated list of percentiles")
 	fs.Bool(ParamHeartbeatEnabled, DefaultHeartbeatEnabled, "Enables heartbeat")
 	fs.Int(ParamReceiveBatchSize, DefaultReceiveBatchSize, "The number of datagrams to read in each receive batch")
+	fs.Int(ParamReaderPauseHighWatermark, DefaultReaderPauseHighWatermark, "Aggregator queue length at which socket readers pause (0 to disable)")
+	fs.Int(ParamReaderPauseLowWatermark, DefaultReaderPauseLowWatermark, "Aggregator queue length at which paused socket readers resume")
 	fs.Bool(ParamConnPerReader, DefaultConnPerReader, "Create a separate connection per reader (requires system support for reusing addresses)")
 	fs.String(ParamServerMode, DefaultServerMode, "The server mode to run in")
 	fs.String(ParamHostname, getHost(), "overrides the hostname of the server")
 	fs.Uint32(ParamTimerHistogramLimit, DefaultTimerHistogramLimit, "upper limit of timer histogram buckets (MaxUint32 by default)")
 	fs.Bool(ParamLogRawMetric, DefaultLogRawMetric, "Print metrics received from network to stdout in JSON format")
+	fs.Int(ParamMaxNameLength, DefaultMaxNameLength, "Maximum length of a metric name, including the namespace (0 for unlimited)")
+	fs.String(ParamNameLengthPolicy, DefaultNameLengthPolicy, "Action for metric names longer than the maximum, drop|truncate")
+	fs.String(ParamPercentileAlgorithm, DefaultPercentileAlgorithm, "Algorithm used to calculate timer percentiles, sort|select")
+	fs.Duration(ParamInternalFlushInterval, DefaultInternalFlushInterval, "How often to flush internal metrics to the backends (0 to use flush-interval)")
+	fs.Bool(ParamAllowNoBackends, DefaultAllowNoBackends, "Allow running in standalone mode without backends, discarding all metrics")
+	fs.String(ParamTTLTag, DefaultTTLTag, "Name of the tag which overrides the expiry interval of a series, such as _ttl (empty to disable)")
+	fs.String(ParamMetricTypeTag, DefaultMetricTypeTag, "Key of the tag added with the type of each flushed metric, such as metric_type (empty to disable)")
+	fs.String(ParamHostnameFallback, DefaultHostnameFallback, "What to use when the hostname is empty, os|fixed|omit")
+	fs.String(ParamHostnameFallbackValue, "", "Hostname to use when the hostname is empty and "+ParamHostnameFallback+" is fixed")
+	fs.Bool(ParamCounterSplit, DefaultCounterSplit, "Emit counters as separate total and per second rate gauges, with distinct names")
+	fs.String(ParamCounterTotalSuffix, DefaultCounterTotalSuffix, "Suffix of the total of a split counter")
+	fs.String(ParamCounterRateSuffix, DefaultCounterRateSuffix, "Suffix of the per second rate of a split counter")
+	fs.Bool(ParamTimerMinMaxGauges, DefaultTimerMinMaxGauges, "Also emit the min and max of timers as gauges, with distinct names")
+	fs.String(ParamTimerMinGaugeSuffix, DefaultTimerMinGaugeSuffix, "Suffix of the gauge of a timer's min")
+	fs.String(ParamTimerMaxGaugeSuffix, DefaultTimerMaxGaugeSuffix, "Suffix of the gauge of a timer's max")
+	fs.Bool(ParamStrictParsing, DefaultStrictParsing, "Reject lines with surrounding whitespace and CRLF line endings, and count empty lines as bad lines")
+	fs.Bool(ParamAggregateAcrossHosts, DefaultAggregateAcrossHosts, "Remove the source and host tags from metrics, so the same metric from every host is aggregated in to one series")
+	fs.String(ParamHostTagKeys, strings.Join(DefaultHostTagKeys, " "), "Space separated list of tag keys which identify a host, removed by aggregate-across-hosts")
+	fs.String(ParamPerSourceMetrics, strings.Join(DefaultPerSourceMetrics, " "), "Space separated list of metrics which aggregate-across-hosts also keeps per source")
+	fs.String(ParamPercentileNameTemplate, DefaultPercentileNameTemplate, "Template for the names of timer percentile sub-metrics, containing {stat} and {pct}")
+	fs.String(ParamSourceIPStrategy, DefaultSourceIPStrategy, "Strategy for determining the source IP of metrics and events, peer|tag")
+	fs.String(ParamSourceIPTag, DefaultSourceIPTag, "Key of the tag which overrides the source IP, if source-ip-strategy is tag")
+	fs.String(ParamInternalBackends, strings.Join(DefaultInternalBackends, " "), "Space separated list of backends which receive internal metrics, and no other metrics (empty to send internal metrics to every backend)")
+	fs.Bool(ParamFlushSequenceEnabled, DefaultFlushSequenceEnabled, "Emits the number of flushes since the server started, to detect missed flushes and restarts")
+	fs.String(ParamRequiredTagKeys, strings.Join(DefaultRequiredTagKeys, " "), "Space separated list of tag keys which every metric must have (empty to not check tags)")
+	fs.String(ParamRequiredTagsPolicy, DefaultRequiredTagsPolicy, "Policy for metrics missing required tags, drop|annotate")
+	fs.String(ParamRequiredTagsDefaultValue, DefaultRequiredTagsDefaultValue, "Value of the required tags added to metrics missing them, if required-tags-policy is annotate")
+	fs.String(ParamEmptyTagValuePolicy, DefaultEmptyTagValuePolicy, "Policy for tags with an empty value, such as env:, keep|drop|key-only")
+	fs.String(ParamNonFinitePolicy, DefaultNonFinitePolicy, "Policy for gauges and timers with infinite values, reject|clamp|pass")
+	fs.String(ParamTagKeyNormalizations, strings.Join(DefaultTagKeyNormalizations, " "), "Space separated list of normalizations applied to tag keys, from lowercase|trim|nfc (empty to not normalize keys)")
+	fs.String(ParamTagValueNormalizations, strings.Join(DefaultTagValueNormalizations, " "), "Space separated list of normalizations applied to tag values, from lowercase|trim|nfc (empty to not normalize values)")
+	fs.Bool(ParamExpvarInternalMetrics, DefaultExpvarInternalMetrics, "Publishes the latest internal metrics with expvar, under the gostatsd variable")
+	fs.String(ParamStateFile, DefaultStateFile, "File to save the aggregator state to on shutdown, and restore it from on startup (empty to not save it)")
+	fs.String(ParamMaintenanceBackends, strings.Join(DefaultMaintenanceBackends, " "), "Space separated list of backends in maintenance mode, which flushes are not sent to, reloaded on SIGHUP")
+	fs.Int(ParamMaintenanceBufferFlushes, DefaultMaintenanceBufferFlushes, "Number of flushes buffered for a backend in maintenance mode, sent when it leaves maintenance mode (0 to drop them)")
+	fs.Int64(ParamWriteAheadLogMaxSize, DefaultWriteAheadLogMaxSize, "Maximum size in bytes of the write-ahead log of each backend with one, the oldest undelivered flushes are dropped beyond it")
+	fs.Bool(ParamDropUnresolvedSources, DefaultDropUnresolvedSources, "Drop metrics and events from sources the cloud provider can't resolve to an instance, rather than passing them on unenriched")
+	fs.Duration(ParamCloudDrainTimeout, DefaultCloudDrainTimeout, "How long metrics and events awaiting a cloud provider lookup are dispatched unenriched for on shutdown, 0 to discard them")
+	fs.Bool(ParamSeriesCounts, DefaultSeriesCounts, "Emit the number of series of each metric held by the aggregators every flush")
+	fs.Int(ParamSeriesCountsTop, DefaultSeriesCountsTop, "Only emit the series counts of this many metrics with the most series (0 for every metric)")
+	fs.Bool(ParamFlushEvents, DefaultFlushEvents, "Send an event summarising each flush to the backends")
+	fs.String(ParamFlushEventsNamespace, DefaultFlushEventsNamespace, "Namespace of the title of flush events")
+	fs.Uint64(ParamMemoryEvictionThreshold, DefaultMemoryEvictionThreshold, "Heap size in bytes above which the aggregators evict their least recently updated series every flush (0 to never evict them)")
+	fs.Float64(ParamMemoryEvictionRatio, DefaultMemoryEvictionRatio, "Share of each aggregator's series evicted every flush while over the memory eviction threshold")
+	fs.String(ParamCloudProviderFailurePolicy, DefaultCloudProviderFailurePolicy, "Policy for a cloud provider which fails to initialise, fail|continue (continue runs without enrichment)")
+	fs.Bool(ParamPrometheusInternalMetrics, DefaultPrometheusInternalMetrics, "Publishes the latest internal metrics in the Prometheus format, on the internal metrics endpoint of the HTTP servers")
+	fs.Bool(ParamBuildInfoEnabled, DefaultBuildInfoEnabled, "Emits a gostatsd.build_info gauge every flush interval, tagged by version, commit, and build_date")
 }
 
 func minInt(a, b int) int {
@@ -1,11 +1,15 @@
 package gostatsd
 
+import "time"
+
 // Gauge is used for storing aggregated values for gauges.
 type Gauge struct {
-	Value     float64  // The numeric value of the metric
-	Timestamp Nanotime // Last time value was updated
-	Source    Source   // Source of the metric
-	Tags      Tags     // The tags for the gauge
+	Value     float64       // The numeric value of the metric
+	Timestamp Nanotime      // Last time value was updated
+	Source    Source        // Source of the metric
+	Tags      Tags          // The tags for the gauge
+	Expiry    time.Duration // Overrides the expiry interval for gauges, if not 0
+	FirstSeen Nanotime      // When the series was first aggregated, set by the aggregator
 }
 
 // NewGauge initialises a new gauge.
@@ -0,0 +1,118 @@
+// Package azure authenticates with Azure, for the backends and cloud providers which use Azure APIs.
+package azure
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+)
+
+const (
+	// DefaultAuthorityHost is the Microsoft identity platform endpoint of the public cloud.
+	DefaultAuthorityHost = "https://login.microsoftonline.com"
+	// MetadataURL is the address of the Azure Instance Metadata Service.
+	MetadataURL = "http://169.254.169.254/metadata"
+	// maxMetadataResponseSize is the maximum response size read from the metadata service.
+	maxMetadataResponseSize = 64 * 1024
+)
+
+// NewTokenSource returns a source of tokens for resource, such as https://monitoring.azure.com/.  If clientSecret is
+// set, the tokens are for the service principal clientID of tenantID, from authorityHost.  Otherwise they are for the
+// managed identity of the instance, from the Instance Metadata Service, which is the user assigned identity clientID
+// if it's set.  client is used to fetch tokens.
+func NewTokenSource(client *http.Client, resource, authorityHost, tenantID, clientID, clientSecret string) (oauth2.TokenSource, error) {
+	if clientSecret == "" {
+		return oauth2.ReuseTokenSource(nil, &ManagedIdentityTokenSource{
+			Client:      client,
+			MetadataURL: MetadataURL,
+			Resource:    resource,
+			ClientID:    clientID,
+		}), nil
+	}
+	if tenantID == "" || clientID == "" {
+		return nil, fmt.Errorf("tenant-id and client-id are required with client-secret")
+	}
+	cfg := &clientcredentials.Config{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		TokenURL:     fmt.Sprintf("%s/%s/oauth2/v2.0/token", strings.TrimSuffix(authorityHost, "/"), url.PathEscape(tenantID)),
+		Scopes:       []string{resource + ".default"},
+		AuthStyle:    oauth2.AuthStyleInParams,
+	}
+	return cfg.TokenSource(context.WithValue(context.Background(), oauth2.HTTPClient, client)), nil
+}
+
+// ManagedIdentityTokenSource fetches tokens for the managed identity of the instance from the Instance Metadata
+// Service.
+type ManagedIdentityTokenSource struct {
+	Client      *http.Client
+	MetadataURL string
+	Resource    string
+	ClientID    string // The client ID of a user assigned identity, may be empty
+}
+
+func (mts *ManagedIdentityTokenSource) Token() (*oauth2.Token, error) {
+	params := url.Values{
+		"api-version": {"2018-02-01"},
+		"resource":    {mts.Resource},
+	}
+	if mts.ClientID != "" {
+		params.Set("client_id", mts.ClientID)
+	}
+	body, err := GetMetadata(mts.Client, mts.MetadataURL+"/identity/oauth2/token?"+params.Encode())
+	if err != nil {
+		return nil, err
+	}
+	// expires_in is a string in responses from the metadata service, json.Number accepts it either way
+	var token struct {
+		AccessToken string      `json:"access_token"`
+		ExpiresIn   json.Number `json:"expires_in"`
+		TokenType   string      `json:"token_type"`
+	}
+	if err := json.Unmarshal(body, &token); err != nil {
+		return nil, fmt.Errorf("invalid token from the metadata service: %v", err)
+	}
+	if token.AccessToken == "" {
+		return nil, fmt.Errorf("no access token from the metadata service")
+	}
+	expiresIn, err := token.ExpiresIn.Int64()
+	if err != nil {
+		return nil, fmt.Errorf("invalid token expiry from the metadata service: %v", err)
+	}
+	return &oauth2.Token{
+		AccessToken: token.AccessToken,
+		TokenType:   token.TokenType,
+		Expiry:      time.Now().Add(time.Duration(expiresIn) * time.Second),
+	}, nil
+}
+
+// GetMetadata reads url from the Instance Metadata Service.
+func GetMetadata(client *http.Client, url string) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Metadata", "true")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("metadata service request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxMetadataResponseSize))
+	if err != nil {
+		return nil, fmt.Errorf("metadata service request failed: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("metadata service responded with status %d", resp.StatusCode)
+	}
+	return body, nil
+}
@@ -0,0 +1,58 @@
+package azure
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testResource = "https://monitoring.azure.com/"
+
+func TestManagedIdentityCredentials(t *testing.T) {
+	t.Parallel()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata") != "true" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		assert.Equal(t, "/metadata/identity/oauth2/token", r.URL.Path)
+		assert.Equal(t, testResource, r.URL.Query().Get("resource"))
+		assert.Equal(t, "2018-02-01", r.URL.Query().Get("api-version"))
+		assert.Equal(t, "user-assigned", r.URL.Query().Get("client_id"))
+		_, _ = w.Write([]byte(`{"access_token":"token123","expires_in":"3599","token_type":"Bearer"}`))
+	}))
+	defer ts.Close()
+
+	mts := &ManagedIdentityTokenSource{Client: ts.Client(), MetadataURL: ts.URL + "/metadata", Resource: testResource, ClientID: "user-assigned"}
+	token, err := mts.Token()
+	require.NoError(t, err)
+	assert.Equal(t, "token123", token.AccessToken)
+	assert.True(t, token.Valid())
+}
+
+func TestServicePrincipalCredentials(t *testing.T) {
+	t.Parallel()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/my-tenant/oauth2/v2.0/token", r.URL.Path)
+		assert.NoError(t, r.ParseForm())
+		assert.Equal(t, "client_credentials", r.PostForm.Get("grant_type"))
+		assert.Equal(t, "my-client", r.PostForm.Get("client_id"))
+		assert.Equal(t, "my-secret", r.PostForm.Get("client_secret"))
+		assert.Equal(t, testResource+".default", r.PostForm.Get("scope"))
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"access_token":"token456","expires_in":3599,"token_type":"Bearer"}`))
+	}))
+	defer ts.Close()
+
+	tokenSource, err := NewTokenSource(ts.Client(), testResource, ts.URL+"/", "my-tenant", "my-client", "my-secret")
+	require.NoError(t, err)
+	token, err := tokenSource.Token()
+	require.NoError(t, err)
+	assert.Equal(t, "token456", token.AccessToken)
+
+	_, err = NewTokenSource(ts.Client(), testResource, ts.URL, "", "my-client", "my-secret")
+	require.Error(t, err)
+}
@@ -4,7 +4,9 @@ import (
 	"bytes"
 	"errors"
 	"math"
+	"sort"
 	"strconv"
+	"strings"
 
 	"github.com/atlassian/gostatsd"
 	"github.com/atlassian/gostatsd/internal/pool"
@@ -21,9 +23,10 @@ type Lexer struct {
 	m             *gostatsd.Metric
 	e             *gostatsd.Event
 	tags          gostatsd.Tags
-	namespace     string
+	prefix        string // Prefixed to metric names, the namespace and its separator
 	err           error
 	sampling      float64
+	buckets       bool
 
 	MetricPool *pool.MetricPool
 }
@@ -41,9 +44,12 @@ var (
 	errInvalidAttributes     = errors.New("invalid event attributes")
 	errOverflow              = errors.New("overflow")
 	errNotEnoughData         = errors.New("not enough data")
-	errNaN                   = errors.New("invalid value NaN")
+	errInvalidBuckets        = errors.New("invalid histogram buckets")
 )
 
+// ErrNaN is returned for a metric with a NaN value, which is never valid.
+var ErrNaN = errors.New("invalid value NaN")
+
 var escapedNewline = []byte("\\n")
 var newline = []byte("\n")
 
@@ -69,7 +75,7 @@ func (l *Lexer) reset() {
 	// l.len = 0           // re-initialized by Run
 	// l.eventTitleLen = 0 // re-initialized by lexDatadogSpecial before lexEventBody
 	// l.eventTextLen = 0  // re-initialized by lexDatadogSpecial before lexEventBody
-	// l.namespace = ""    // re-initialized by Run
+	// l.prefix = ""       // re-initialized by Run
 	// l.sampling = 1      // re-initialized by Run
 
 	l.start = 0
@@ -78,12 +84,15 @@ func (l *Lexer) reset() {
 	l.e = nil
 	l.tags = nil
 	l.err = nil
+	l.buckets = false
 }
 
-func (l *Lexer) Run(input []byte, namespace string) (*gostatsd.Metric, *gostatsd.Event, error) {
+// Run lexes a single line of input, prefixing the name of a metric with prefix, which includes the separator after the
+// namespace, such as `stats.`.
+func (l *Lexer) Run(input []byte, prefix string) (*gostatsd.Metric, *gostatsd.Event, error) {
 	l.reset()
 	l.input = input
-	l.namespace = namespace
+	l.prefix = prefix
 	l.len = uint32(len(l.input))
 	l.sampling = float64(1)
 
@@ -95,13 +104,20 @@ func (l *Lexer) Run(input []byte, namespace string) (*gostatsd.Metric, *gostatsd
 	}
 	if l.m != nil {
 		l.m.Rate = l.sampling
-		if l.m.Type != gostatsd.SET {
+		if l.buckets {
+			buckets, err := parseBuckets(l.m.StringValue, l.sampling)
+			if err != nil {
+				return nil, nil, err
+			}
+			l.m.Buckets = buckets
+			l.m.StringValue = ""
+		} else if l.m.Type != gostatsd.SET {
 			v, err := strconv.ParseFloat(l.m.StringValue, 64)
 			if err != nil {
 				return nil, nil, err
 			}
 			if math.IsNaN(v) {
-				return nil, nil, errNaN
+				return nil, nil, ErrNaN
 			}
 			l.m.Value = v
 			l.m.StringValue = ""
@@ -113,6 +129,46 @@ func (l *Lexer) Run(input []byte, namespace string) (*gostatsd.Metric, *gostatsd
 	return l.m, l.e, nil
 }
 
+// parseBuckets parses the bucket counts of a pre-aggregated histogram, such as `0.1=5,0.5=12,+Inf=20`, scaled by the
+// sampling rate.  Each count is of the values less than or equal to its threshold, so the counts must not decrease as
+// the threshold increases, and the +Inf bucket, which counts every value, is required.
+func parseBuckets(value string, sampling float64) (map[gostatsd.HistogramThreshold]int, error) {
+	buckets := map[gostatsd.HistogramThreshold]int{}
+	for _, bucket := range strings.Split(value, ",") {
+		i := strings.IndexByte(bucket, '=')
+		if i < 0 {
+			return nil, errInvalidBuckets
+		}
+		threshold, err := strconv.ParseFloat(bucket[:i], 64)
+		if err != nil || math.IsNaN(threshold) || math.IsInf(threshold, -1) {
+			return nil, errInvalidBuckets
+		}
+		count, err := strconv.ParseUint(bucket[i+1:], 10, 32)
+		if err != nil {
+			return nil, errInvalidBuckets
+		}
+		if _, ok := buckets[gostatsd.HistogramThreshold(threshold)]; ok {
+			return nil, errInvalidBuckets
+		}
+		buckets[gostatsd.HistogramThreshold(threshold)] = int(math.Round(float64(count) / sampling))
+	}
+	if _, ok := buckets[gostatsd.HistogramThreshold(math.Inf(1))]; !ok {
+		return nil, errInvalidBuckets
+	}
+
+	thresholds := make([]float64, 0, len(buckets))
+	for threshold := range buckets {
+		thresholds = append(thresholds, float64(threshold))
+	}
+	sort.Float64s(thresholds)
+	for i := 1; i < len(thresholds); i++ {
+		if buckets[gostatsd.HistogramThreshold(thresholds[i])] < buckets[gostatsd.HistogramThreshold(thresholds[i-1])] {
+			return nil, errInvalidBuckets
+		}
+	}
+	return buckets, nil
+}
+
 type stateFn func(*Lexer) stateFn
 
 // check the first byte for special Datadog type.
@@ -343,8 +399,8 @@ func lexKey(l *Lexer) stateFn {
 		return nil
 	}
 	l.m.Name = string(l.input[l.start : l.pos-1])
-	if l.namespace != "" {
-		l.m.Name = l.namespace + "." + l.m.Name
+	if l.prefix != "" {
+		l.m.Name = l.prefix + l.m.Name
 	}
 	l.start = l.pos
 	return lexValueSep
@@ -395,6 +451,11 @@ func lexType(l *Lexer) stateFn {
 		l.start = l.pos
 		l.m.Type = gostatsd.TIMER
 		return lexTypeSep
+	case 'b':
+		l.start = l.pos
+		l.m.Type = gostatsd.TIMER
+		l.buckets = true
+		return lexTypeSep
 	case 's':
 		l.m.Type = gostatsd.SET
 		l.start = l.pos
@@ -1,6 +1,7 @@
 package lexer
 
 import (
+	"math"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -44,6 +45,37 @@ func TestMetricsLexer(t *testing.T) {
 	compareMetric(t, tests, "")
 }
 
+func TestBucketsLexer(t *testing.T) {
+	t.Parallel()
+	inf := gostatsd.HistogramThreshold(math.Inf(1))
+	tests := map[string]gostatsd.Metric{
+		"lat:0.1=5,0.5=12,+Inf=20|b": {Name: "lat", Type: gostatsd.TIMER, Rate: 1.0, Buckets: map[gostatsd.HistogramThreshold]int{0.1: 5, 0.5: 12, inf: 20}},
+		"lat:inf=3|b|#foo":           {Name: "lat", Type: gostatsd.TIMER, Rate: 1.0, Tags: gostatsd.Tags{"foo"}, Buckets: map[gostatsd.HistogramThreshold]int{inf: 3}},
+		"lat:-1=0,Inf=3,10=2|b|@0.5": {Name: "lat", Type: gostatsd.TIMER, Rate: 0.5, Buckets: map[gostatsd.HistogramThreshold]int{-1: 0, 10: 4, inf: 6}},
+	}
+	compareMetric(t, tests, "")
+
+	failing := []string{
+		"lat:10|b",               // not a bucket
+		"lat:10=1|b",             // no +Inf bucket
+		"lat:10=5,+Inf=4|b",      // decreasing count
+		"lat:10=1,10=1,+Inf=4|b", // repeated threshold
+		"lat:NaN=1,+Inf=4|b",
+		"lat:-Inf=1,+Inf=4|b",
+		"lat:10=-1,+Inf=4|b",
+		"lat:10=x,+Inf=4|b",
+		"lat:|b",
+	}
+	for _, tc := range failing {
+		tc := tc
+		t.Run(tc, func(t *testing.T) {
+			t.Parallel()
+			result, _, err := parseLine([]byte(tc), "")
+			assert.Error(t, err, result)
+		})
+	}
+}
+
 func TestInvalidMetricsLexer(t *testing.T) {
 	t.Parallel()
 	failing := []string{"fOO|bar:bazkk", "foo.bar.baz:1|q", "NaN.should.be:NaN|g"}
@@ -63,7 +95,7 @@ func TestInvalidMetricsLexer(t *testing.T) {
 		"uniq.usr:joe|s":  {Name: "stats.uniq.usr", StringValue: "joe", Type: gostatsd.SET, Rate: 1.0},
 	}
 
-	compareMetric(t, tests, "stats")
+	compareMetric(t, tests, "stats.")
 }
 
 func TestEventsLexer(t *testing.T) {
@@ -55,11 +55,12 @@ func TestConsolidation(t *testing.T) {
 	}
 	expected[1].Counters["foo"] = map[string]Counter{
 		"": {
-			PerSecond: 0,
-			Value:     30,
-			Timestamp: 20,
-			Source:    "",
-			Tags:      nil,
+			PerSecond:  0,
+			Value:      30,
+			Timestamp:  20,
+			Source:     "",
+			Tags:       nil,
+			SampleRate: 0.1,
 		},
 	}
 
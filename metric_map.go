@@ -3,9 +3,12 @@ package gostatsd
 import (
 	"bytes"
 	"fmt"
+	"math"
 	"strings"
 
 	"github.com/sirupsen/logrus"
+
+	"github.com/atlassian/gostatsd/pkg/tdigest"
 )
 
 // MetricMap is used for storing aggregated or consolidated Metric values.
@@ -68,7 +71,11 @@ func (mm *MetricMap) MergeCounter(metricName string, tagsKey string, counterFrom
 			if counterInto.Timestamp < counterFrom.Timestamp {
 				counterInto.Timestamp = counterFrom.Timestamp
 			}
+			counterInto.MergeSampleRate(&counterFrom)
 			counterInto.Value += counterFrom.Value
+			if counterFrom.Expiry != 0 {
+				counterInto.Expiry = counterFrom.Expiry
+			}
 		} else {
 			counterInto = counterFrom
 		}
@@ -89,6 +96,9 @@ func (mm *MetricMap) MergeGauge(metricName string, tagsKey string, gaugeFrom Gau
 				gaugeInto.Timestamp = gaugeFrom.Timestamp
 				gaugeInto.Value = gaugeFrom.Value
 			}
+			if gaugeFrom.Expiry != 0 {
+				gaugeInto.Expiry = gaugeFrom.Expiry
+			}
 		} else {
 			gaugeInto = gaugeFrom
 		}
@@ -111,6 +121,9 @@ func (mm *MetricMap) MergeSet(metricName string, tagsKey string, setFrom Set) {
 			for setValue := range setFrom.Values {
 				setInto.Values[setValue] = struct{}{}
 			}
+			if setFrom.Expiry != 0 {
+				setInto.Expiry = setFrom.Expiry
+			}
 		} else {
 			setInto = setFrom
 		}
@@ -132,6 +145,15 @@ func (mm *MetricMap) MergeTimer(metricName string, tagsKey string, timerFrom Tim
 			}
 			timerInto.Values = append(timerInto.Values, timerFrom.Values...)
 			timerInto.SampledCount += timerFrom.SampledCount
+			if timerFrom.Digest != nil {
+				timerInto.Digest = mergeDigests(timerInto.Digest, timerFrom.Digest)
+			}
+			if timerFrom.Buckets != nil {
+				timerInto.Buckets = mergeBuckets(timerInto.Buckets, timerFrom.Buckets)
+			}
+			if timerFrom.Expiry != 0 {
+				timerInto.Expiry = timerFrom.Expiry
+			}
 		} else {
 			timerInto = timerFrom
 		}
@@ -143,6 +165,61 @@ func (mm *MetricMap) MergeTimer(metricName string, tagsKey string, timerFrom Tim
 	}
 }
 
+// mergeDigests returns a new digest containing both into and from, as either may be shared with another MetricMap.
+func mergeDigests(into, from *tdigest.TDigest) *tdigest.TDigest {
+	if into == nil {
+		return from.Clone()
+	}
+	merged := into.Clone()
+	merged.Merge(from)
+	return merged
+}
+
+// DropNaN removes NaN gauges and timer values from mm in place, so a single NaN can't poison the aggregates of a
+// series, and returns the number removed.  The parser rejects NaN, so it is only needed for metrics received from
+// elsewhere, such as forwarders.
+func (mm *MetricMap) DropNaN() int {
+	dropped := 0
+	for metricName, gauges := range mm.Gauges {
+		for tagsKey, g := range gauges {
+			if math.IsNaN(g.Value) {
+				delete(gauges, tagsKey)
+				dropped++
+			}
+		}
+		if len(gauges) == 0 {
+			delete(mm.Gauges, metricName)
+		}
+	}
+	for metricName, timers := range mm.Timers {
+		for tagsKey, t := range timers {
+			values := t.Values[:0]
+			for _, v := range t.Values {
+				if !math.IsNaN(v) {
+					values = append(values, v)
+				}
+			}
+			removed := len(t.Values) - len(values)
+			if removed == 0 {
+				continue
+			}
+			dropped += removed
+			if len(values) == 0 && t.Digest == nil && t.Buckets == nil {
+				delete(timers, tagsKey)
+				continue
+			}
+			// The values of a series share its sample rate, so each is the same share of the sampled count
+			t.SampledCount -= t.SampledCount * float64(removed) / float64(len(t.Values))
+			t.Values = values
+			timers[tagsKey] = t
+		}
+		if len(timers) == 0 {
+			delete(mm.Timers, metricName)
+		}
+	}
+	return dropped
+}
+
 func (mm *MetricMap) IsEmpty() bool {
 	return len(mm.Counters)+len(mm.Timers)+len(mm.Sets)+len(mm.Gauges) == 0
 }
@@ -273,21 +350,35 @@ func (mm *MetricMap) receiveCounter(m *Metric, tagsKey string) {
 	if ok {
 		c, ok := v[tagsKey]
 		if ok {
+			if m.Rate != 1 || c.SampleRate != 0 {
+				c.MergeSampleRate(&Counter{Value: value, SampleRate: sampleRate(m.Rate)})
+			}
 			c.Value += value
 			if m.Timestamp > c.Timestamp {
 				c.Timestamp = m.Timestamp
 			}
 		} else {
 			c = NewCounter(m.Timestamp, value, m.Source, m.Tags)
+			c.SampleRate = sampleRate(m.Rate)
 		}
 		v[tagsKey] = c
 	} else {
+		c := NewCounter(m.Timestamp, value, m.Source, m.Tags)
+		c.SampleRate = sampleRate(m.Rate)
 		mm.Counters[m.Name] = map[string]Counter{
-			tagsKey: NewCounter(m.Timestamp, value, m.Source, m.Tags),
+			tagsKey: c,
 		}
 	}
 }
 
+// sampleRate returns the SampleRate of a counter received with rate.
+func sampleRate(rate float64) float64 {
+	if rate <= 0 || rate >= 1 {
+		return 0
+	}
+	return rate
+}
+
 func (mm *MetricMap) receiveGauge(m *Metric, tagsKey string) {
 	v, ok := mm.Gauges[m.Name]
 	if ok {
@@ -309,6 +400,10 @@ func (mm *MetricMap) receiveGauge(m *Metric, tagsKey string) {
 }
 
 func (mm *MetricMap) receiveTimer(m *Metric, tagsKey string) {
+	if m.Buckets != nil {
+		mm.receiveBuckets(m, tagsKey)
+		return
+	}
 	v, ok := mm.Timers[m.Name]
 	if ok {
 		t, ok := v[tagsKey]
@@ -333,6 +428,26 @@ func (mm *MetricMap) receiveTimer(m *Metric, tagsKey string) {
 	}
 }
 
+// receiveBuckets merges the buckets of a pre-aggregated histogram in to its timer.
+func (mm *MetricMap) receiveBuckets(m *Metric, tagsKey string) {
+	v, ok := mm.Timers[m.Name]
+	if !ok {
+		v = map[string]Timer{}
+		mm.Timers[m.Name] = v
+	}
+	t, ok := v[tagsKey]
+	if ok {
+		t.Buckets = mergeBuckets(t.Buckets, m.Buckets)
+		if m.Timestamp > t.Timestamp {
+			t.Timestamp = m.Timestamp
+		}
+	} else {
+		t = NewTimer(m.Timestamp, nil, m.Source, m.Tags)
+		t.Buckets = m.Buckets
+	}
+	v[tagsKey] = t
+}
+
 func (mm *MetricMap) receiveSet(m *Metric, tagsKey string) {
 	v, ok := mm.Sets[m.Name]
 	if ok {
@@ -1,11 +1,14 @@
 package gostatsd
 
 import (
+	"math"
 	"sort"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+
+	"github.com/atlassian/gostatsd/pkg/tdigest"
 )
 
 func metricsFixtures() []*Metric {
@@ -58,7 +61,7 @@ func TestReceive(t *testing.T) {
 			"baz,foo:bar": {Value: 55, Timestamp: 10, Tags: Tags{"baz", "foo:bar"}},
 		},
 		"counter_sampling": map[string]Counter{
-			"": {Value: 28, Timestamp: 10},
+			"": {Value: 28, Timestamp: 10, SampleRate: 0.25},
 		},
 	}
 	assrt.Equal(expectedCounters, mm.Counters)
@@ -226,8 +229,9 @@ func TestMetricMapMerge(t *testing.T) {
 	expected.Counters = Counters{
 		"TestMetricMapMerge.counter": map[string]Counter{
 			"": {
-				Value:     10 + (20 / 0.1),
-				Timestamp: 20,
+				Value:      10 + (20 / 0.1),
+				Timestamp:  20,
+				SampleRate: (10 + 20) / (10 + (20 / 0.1)), // The values as received over the scaled values
 			},
 		},
 	}
@@ -403,3 +407,81 @@ func TestMetricMapSplitByTags(t *testing.T) {
 	mms = mmOriginal.SplitByTags([]string{"t:", "v:"})
 	require.Equal(t, len(mms), 4)
 }
+
+func TestMetricMapMergeDigests(t *testing.T) {
+	newDigestMap := func(values ...float64) *MetricMap {
+		td := tdigest.New(tdigest.DefaultCompression)
+		for _, v := range values {
+			td.Add(v)
+		}
+		mm := NewMetricMap()
+		mm.Timers["timer"] = map[string]Timer{"": {Digest: td, SampledCount: float64(len(values))}}
+		return mm
+	}
+	m1 := newDigestMap(1, 2, 3)
+	m2 := newDigestMap(4, 5)
+	m3 := NewMetricMap()
+	m3.Receive(&Metric{Name: "timer", Value: 6, Rate: 1, Type: TIMER})
+
+	merged := NewMetricMap()
+	merged.Merge(m1)
+	merged.Merge(m2)
+	merged.Merge(m3)
+
+	timer := merged.Timers["timer"][""]
+	require.EqualValues(t, 6, timer.SampledCount)
+	require.EqualValues(t, 5, timer.Digest.Count())
+	require.EqualValues(t, 15, timer.Digest.Sum())
+	require.Equal(t, []float64{6}, timer.Values)
+
+	// The source digests are not modified
+	require.EqualValues(t, 3, m1.Timers["timer"][""].Digest.Count())
+	require.EqualValues(t, 2, m2.Timers["timer"][""].Digest.Count())
+}
+
+func TestMetricMapMergeBuckets(t *testing.T) {
+	inf := HistogramThreshold(math.Inf(1))
+	m1 := NewMetricMap()
+	m1.Receive(&Metric{Name: "timer", Rate: 1, Type: TIMER, Buckets: map[HistogramThreshold]int{1: 1, 5: 2, inf: 3}})
+	m1.Receive(&Metric{Name: "timer", Rate: 1, Type: TIMER, Buckets: map[HistogramThreshold]int{1: 2, 5: 2, inf: 2}})
+	require.Equal(t, map[HistogramThreshold]int{1: 3, 5: 4, inf: 5}, m1.Timers["timer"][""].Buckets)
+	require.Empty(t, m1.Timers["timer"][""].Values)
+
+	// Only the thresholds of both layouts are kept
+	m2 := NewMetricMap()
+	m2.Receive(&Metric{Name: "timer", Rate: 1, Type: TIMER, Buckets: map[HistogramThreshold]int{5: 1, 10: 1, inf: 1}})
+	merged := NewMetricMap()
+	merged.Merge(m1)
+	merged.Merge(m2)
+	require.Equal(t, map[HistogramThreshold]int{5: 5, inf: 6}, merged.Timers["timer"][""].Buckets)
+
+	// Empty buckets are replaced by any layout
+	m3 := NewMetricMap()
+	m3.Timers["timer"] = map[string]Timer{"": {Buckets: map[HistogramThreshold]int{2: 0, inf: 0}}}
+	m3.Merge(m2)
+	require.Equal(t, map[HistogramThreshold]int{5: 1, 10: 1, inf: 1}, m3.Timers["timer"][""].Buckets)
+
+	// The source buckets are not modified
+	require.Equal(t, map[HistogramThreshold]int{1: 3, 5: 4, inf: 5}, m1.Timers["timer"][""].Buckets)
+	require.Equal(t, map[HistogramThreshold]int{5: 1, 10: 1, inf: 1}, m2.Timers["timer"][""].Buckets)
+}
+
+func TestMetricMapDropNaN(t *testing.T) {
+	t.Parallel()
+	mm := NewMetricMap()
+	mm.Gauges["g"] = map[string]Gauge{"": NewGauge(2, math.NaN(), "", nil), "a:b": NewGauge(2, 5, "", Tags{"a:b"})}
+	mm.Timers["t"] = map[string]Timer{"": NewTimer(2, []float64{math.NaN(), 5, math.NaN(), 7}, "", nil)}
+	mm.Timers["nan"] = map[string]Timer{"": NewTimer(2, []float64{math.NaN()}, "", nil)}
+	mm.Counters["c"] = map[string]Counter{"": NewCounter(2, 1, "", nil)}
+
+	// NaN values are dropped, and the valid values of the same series are kept
+	assert.Equal(t, 4, mm.DropNaN())
+	assert.Equal(t, map[string]Gauge{"a:b": NewGauge(2, 5, "", Tags{"a:b"})}, mm.Gauges["g"])
+	timer := mm.Timers["t"][""]
+	assert.Equal(t, []float64{5, 7}, timer.Values)
+	assert.EqualValues(t, 2, timer.SampledCount)
+	assert.NotContains(t, mm.Timers, "nan")
+	assert.EqualValues(t, 1, mm.Counters["c"][""].Value)
+
+	assert.Zero(t, mm.DropNaN())
+}
@@ -3,6 +3,7 @@ package gostatsd
 import (
 	"fmt"
 	"hash/adler32"
+	"strings"
 )
 
 // MetricType is an enumeration of all the possible types of Metric.
@@ -51,6 +52,9 @@ type Metric struct {
 	Timestamp Nanotime   // Most accurate known timestamp of this metric
 	Type      MetricType // The type of metric
 	DoneFunc  func()     // Returns the metric to the pool. May be nil. Call Metric.Done(), not this.
+
+	// Buckets is the cumulative count of each bucket of a pre-aggregated histogram, which is a timer with no Value.
+	Buckets map[HistogramThreshold]int
 }
 
 // Reset is used to reset a metric to as clean state, called on re-use from the pool.
@@ -64,6 +68,7 @@ func (m *Metric) Reset() {
 	m.Source = ""
 	m.Timestamp = 0
 	m.Type = 0
+	m.Buckets = nil
 }
 
 func Bucket(metricName string, source string, max int) int {
@@ -91,6 +96,15 @@ func (m *Metric) FormatTagsKey() string {
 	return m.TagsKey
 }
 
+// NamespacePrefix returns what is prefixed to metric names to put them in namespace, which is namespace followed by
+// separator, unless namespace already ends with it.  It is empty if namespace is.
+func NamespacePrefix(namespace, separator string) string {
+	if namespace == "" || strings.HasSuffix(namespace, separator) {
+		return namespace
+	}
+	return namespace + separator
+}
+
 func FormatTagsKey(source Source, tags Tags) string {
 	t := tags.SortedString()
 	if source == "" {
@@ -20,6 +20,7 @@ func TestMetricReset(t *testing.T) {
 		123,
 		COUNTER,
 		nil,
+		map[HistogramThreshold]int{1: 2},
 	}
 	m.Reset()
 	// Tags needs to be an empty slice, not a nil slice, because half the reason
@@ -28,6 +29,24 @@ func TestMetricReset(t *testing.T) {
 	require.EqualValues(t, &Metric{Tags: Tags{}, Rate: 1}, m)
 }
 
+func TestNamespacePrefix(t *testing.T) {
+	t.Parallel()
+	for _, tc := range []struct {
+		namespace, separator, expected string
+	}{
+		{"", ".", ""},
+		{"app", ".", "app."},
+		{"app", "/", "app/"},
+		{"app", "_", "app_"},
+		// A namespace which already ends with the separator isn't separated again
+		{"app.", ".", "app."},
+		{"app/", "/", "app/"},
+		{"app.", "/", "app./"},
+	} {
+		require.Equal(t, tc.expected, NamespacePrefix(tc.namespace, tc.separator), "%q %q", tc.namespace, tc.separator)
+	}
+}
+
 func TestMetricString(t *testing.T) {
 	types := []MetricType{COUNTER, TIMER, SET, GAUGE, 42}
 	names := []string{"counter", "timer", "set", "gauge", "unknown"}
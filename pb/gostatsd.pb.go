@@ -63,7 +63,7 @@ func (x EventV2_EventPriority) Number() protoreflect.EnumNumber {
 
 // Deprecated: Use EventV2_EventPriority.Descriptor instead.
 func (EventV2_EventPriority) EnumDescriptor() ([]byte, []int) {
-	return file_pb_gostatsd_proto_rawDescGZIP(), []int{9, 0}
+	return file_pb_gostatsd_proto_rawDescGZIP(), []int{10, 0}
 }
 
 type EventV2_AlertType int32
@@ -115,7 +115,7 @@ func (x EventV2_AlertType) Number() protoreflect.EnumNumber {
 
 // Deprecated: Use EventV2_AlertType.Descriptor instead.
 func (EventV2_AlertType) EnumDescriptor() ([]byte, []int) {
-	return file_pb_gostatsd_proto_rawDescGZIP(), []int{9, 1}
+	return file_pb_gostatsd_proto_rawDescGZIP(), []int{10, 1}
 }
 
 type RawMessageV2 struct {
@@ -571,10 +571,13 @@ type RawTimerV2 struct {
 	sizeCache     protoimpl.SizeCache
 	unknownFields protoimpl.UnknownFields
 
-	Tags        []string  `protobuf:"bytes,1,rep,name=Tags,proto3" json:"Tags,omitempty"`
-	Hostname    string    `protobuf:"bytes,2,opt,name=Hostname,proto3" json:"Hostname,omitempty"`
-	SampleCount float64   `protobuf:"fixed64,3,opt,name=SampleCount,proto3" json:"SampleCount,omitempty"`
-	Values      []float64 `protobuf:"fixed64,4,rep,packed,name=Values,proto3" json:"Values,omitempty"`
+	Tags             []string   `protobuf:"bytes,1,rep,name=Tags,proto3" json:"Tags,omitempty"`
+	Hostname         string     `protobuf:"bytes,2,opt,name=Hostname,proto3" json:"Hostname,omitempty"`
+	SampleCount      float64    `protobuf:"fixed64,3,opt,name=SampleCount,proto3" json:"SampleCount,omitempty"`
+	Values           []float64  `protobuf:"fixed64,4,rep,packed,name=Values,proto3" json:"Values,omitempty"`
+	Digest           *TDigestV2 `protobuf:"bytes,5,opt,name=Digest,proto3" json:"Digest,omitempty"`                              // set instead of Values when the forwarder sends timer digests
+	BucketThresholds []float64  `protobuf:"fixed64,6,rep,packed,name=BucketThresholds,proto3" json:"BucketThresholds,omitempty"` // the buckets of a pre-aggregated histogram
+	BucketCounts     []int64    `protobuf:"varint,7,rep,packed,name=BucketCounts,proto3" json:"BucketCounts,omitempty"`
 }
 
 func (x *RawTimerV2) Reset() {
@@ -637,6 +640,122 @@ func (x *RawTimerV2) GetValues() []float64 {
 	return nil
 }
 
+func (x *RawTimerV2) GetDigest() *TDigestV2 {
+	if x != nil {
+		return x.Digest
+	}
+	return nil
+}
+
+func (x *RawTimerV2) GetBucketThresholds() []float64 {
+	if x != nil {
+		return x.BucketThresholds
+	}
+	return nil
+}
+
+func (x *RawTimerV2) GetBucketCounts() []int64 {
+	if x != nil {
+		return x.BucketCounts
+	}
+	return nil
+}
+
+type TDigestV2 struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Compression float64   `protobuf:"fixed64,1,opt,name=Compression,proto3" json:"Compression,omitempty"`
+	Min         float64   `protobuf:"fixed64,2,opt,name=Min,proto3" json:"Min,omitempty"`
+	Max         float64   `protobuf:"fixed64,3,opt,name=Max,proto3" json:"Max,omitempty"`
+	Sum         float64   `protobuf:"fixed64,4,opt,name=Sum,proto3" json:"Sum,omitempty"`
+	SumSquares  float64   `protobuf:"fixed64,5,opt,name=SumSquares,proto3" json:"SumSquares,omitempty"`
+	Means       []float64 `protobuf:"fixed64,6,rep,packed,name=Means,proto3" json:"Means,omitempty"` // the centroids, sorted by mean
+	Weights     []float64 `protobuf:"fixed64,7,rep,packed,name=Weights,proto3" json:"Weights,omitempty"`
+}
+
+func (x *TDigestV2) Reset() {
+	*x = TDigestV2{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_pb_gostatsd_proto_msgTypes[9]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *TDigestV2) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*TDigestV2) ProtoMessage() {}
+
+func (x *TDigestV2) ProtoReflect() protoreflect.Message {
+	mi := &file_pb_gostatsd_proto_msgTypes[9]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use TDigestV2.ProtoReflect.Descriptor instead.
+func (*TDigestV2) Descriptor() ([]byte, []int) {
+	return file_pb_gostatsd_proto_rawDescGZIP(), []int{9}
+}
+
+func (x *TDigestV2) GetCompression() float64 {
+	if x != nil {
+		return x.Compression
+	}
+	return 0
+}
+
+func (x *TDigestV2) GetMin() float64 {
+	if x != nil {
+		return x.Min
+	}
+	return 0
+}
+
+func (x *TDigestV2) GetMax() float64 {
+	if x != nil {
+		return x.Max
+	}
+	return 0
+}
+
+func (x *TDigestV2) GetSum() float64 {
+	if x != nil {
+		return x.Sum
+	}
+	return 0
+}
+
+func (x *TDigestV2) GetSumSquares() float64 {
+	if x != nil {
+		return x.SumSquares
+	}
+	return 0
+}
+
+func (x *TDigestV2) GetMeans() []float64 {
+	if x != nil {
+		return x.Means
+	}
+	return nil
+}
+
+func (x *TDigestV2) GetWeights() []float64 {
+	if x != nil {
+		return x.Weights
+	}
+	return nil
+}
+
 type EventV2 struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
@@ -657,7 +776,7 @@ type EventV2 struct {
 func (x *EventV2) Reset() {
 	*x = EventV2{}
 	if protoimpl.UnsafeEnabled {
-		mi := &file_pb_gostatsd_proto_msgTypes[9]
+		mi := &file_pb_gostatsd_proto_msgTypes[10]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		ms.StoreMessageInfo(mi)
 	}
@@ -670,7 +789,7 @@ func (x *EventV2) String() string {
 func (*EventV2) ProtoMessage() {}
 
 func (x *EventV2) ProtoReflect() protoreflect.Message {
-	mi := &file_pb_gostatsd_proto_msgTypes[9]
+	mi := &file_pb_gostatsd_proto_msgTypes[10]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -683,7 +802,7 @@ func (x *EventV2) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use EventV2.ProtoReflect.Descriptor instead.
 func (*EventV2) Descriptor() ([]byte, []int) {
-	return file_pb_gostatsd_proto_rawDescGZIP(), []int{9}
+	return file_pb_gostatsd_proto_rawDescGZIP(), []int{10}
 }
 
 func (x *EventV2) GetTitle() string {
@@ -845,44 +964,63 @@ var file_pb_gostatsd_proto_rawDesc = []byte{
 	0x0a, 0x08, 0x48, 0x6f, 0x73, 0x74, 0x6e, 0x61, 0x6d, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09,
 	0x52, 0x08, 0x48, 0x6f, 0x73, 0x74, 0x6e, 0x61, 0x6d, 0x65, 0x12, 0x16, 0x0a, 0x06, 0x56, 0x61,
 	0x6c, 0x75, 0x65, 0x73, 0x18, 0x03, 0x20, 0x03, 0x28, 0x09, 0x52, 0x06, 0x56, 0x61, 0x6c, 0x75,
-	0x65, 0x73, 0x22, 0x76, 0x0a, 0x0a, 0x52, 0x61, 0x77, 0x54, 0x69, 0x6d, 0x65, 0x72, 0x56, 0x32,
-	0x12, 0x12, 0x0a, 0x04, 0x54, 0x61, 0x67, 0x73, 0x18, 0x01, 0x20, 0x03, 0x28, 0x09, 0x52, 0x04,
-	0x54, 0x61, 0x67, 0x73, 0x12, 0x1a, 0x0a, 0x08, 0x48, 0x6f, 0x73, 0x74, 0x6e, 0x61, 0x6d, 0x65,
-	0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x08, 0x48, 0x6f, 0x73, 0x74, 0x6e, 0x61, 0x6d, 0x65,
-	0x12, 0x20, 0x0a, 0x0b, 0x53, 0x61, 0x6d, 0x70, 0x6c, 0x65, 0x43, 0x6f, 0x75, 0x6e, 0x74, 0x18,
-	0x03, 0x20, 0x01, 0x28, 0x01, 0x52, 0x0b, 0x53, 0x61, 0x6d, 0x70, 0x6c, 0x65, 0x43, 0x6f, 0x75,
-	0x6e, 0x74, 0x12, 0x16, 0x0a, 0x06, 0x56, 0x61, 0x6c, 0x75, 0x65, 0x73, 0x18, 0x04, 0x20, 0x03,
-	0x28, 0x01, 0x52, 0x06, 0x56, 0x61, 0x6c, 0x75, 0x65, 0x73, 0x22, 0xb7, 0x03, 0x0a, 0x07, 0x45,
-	0x76, 0x65, 0x6e, 0x74, 0x56, 0x32, 0x12, 0x14, 0x0a, 0x05, 0x54, 0x69, 0x74, 0x6c, 0x65, 0x18,
-	0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x05, 0x54, 0x69, 0x74, 0x6c, 0x65, 0x12, 0x12, 0x0a, 0x04,
-	0x54, 0x65, 0x78, 0x74, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x04, 0x54, 0x65, 0x78, 0x74,
-	0x12, 0x22, 0x0a, 0x0c, 0x44, 0x61, 0x74, 0x65, 0x48, 0x61, 0x70, 0x70, 0x65, 0x6e, 0x65, 0x64,
-	0x18, 0x03, 0x20, 0x01, 0x28, 0x03, 0x52, 0x0c, 0x44, 0x61, 0x74, 0x65, 0x48, 0x61, 0x70, 0x70,
-	0x65, 0x6e, 0x65, 0x64, 0x12, 0x1a, 0x0a, 0x08, 0x48, 0x6f, 0x73, 0x74, 0x6e, 0x61, 0x6d, 0x65,
-	0x18, 0x04, 0x20, 0x01, 0x28, 0x09, 0x52, 0x08, 0x48, 0x6f, 0x73, 0x74, 0x6e, 0x61, 0x6d, 0x65,
-	0x12, 0x26, 0x0a, 0x0e, 0x41, 0x67, 0x67, 0x72, 0x65, 0x67, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x4b,
-	0x65, 0x79, 0x18, 0x05, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0e, 0x41, 0x67, 0x67, 0x72, 0x65, 0x67,
-	0x61, 0x74, 0x69, 0x6f, 0x6e, 0x4b, 0x65, 0x79, 0x12, 0x26, 0x0a, 0x0e, 0x53, 0x6f, 0x75, 0x72,
-	0x63, 0x65, 0x54, 0x79, 0x70, 0x65, 0x4e, 0x61, 0x6d, 0x65, 0x18, 0x06, 0x20, 0x01, 0x28, 0x09,
-	0x52, 0x0e, 0x53, 0x6f, 0x75, 0x72, 0x63, 0x65, 0x54, 0x79, 0x70, 0x65, 0x4e, 0x61, 0x6d, 0x65,
-	0x12, 0x12, 0x0a, 0x04, 0x54, 0x61, 0x67, 0x73, 0x18, 0x07, 0x20, 0x03, 0x28, 0x09, 0x52, 0x04,
-	0x54, 0x61, 0x67, 0x73, 0x12, 0x1a, 0x0a, 0x08, 0x53, 0x6f, 0x75, 0x72, 0x63, 0x65, 0x49, 0x50,
-	0x18, 0x08, 0x20, 0x01, 0x28, 0x09, 0x52, 0x08, 0x53, 0x6f, 0x75, 0x72, 0x63, 0x65, 0x49, 0x50,
-	0x12, 0x35, 0x0a, 0x08, 0x50, 0x72, 0x69, 0x6f, 0x72, 0x69, 0x74, 0x79, 0x18, 0x09, 0x20, 0x01,
-	0x28, 0x0e, 0x32, 0x19, 0x2e, 0x70, 0x62, 0x2e, 0x45, 0x76, 0x65, 0x6e, 0x74, 0x56, 0x32, 0x2e,
-	0x45, 0x76, 0x65, 0x6e, 0x74, 0x50, 0x72, 0x69, 0x6f, 0x72, 0x69, 0x74, 0x79, 0x52, 0x08, 0x50,
-	0x72, 0x69, 0x6f, 0x72, 0x69, 0x74, 0x79, 0x12, 0x29, 0x0a, 0x04, 0x54, 0x79, 0x70, 0x65, 0x18,
-	0x0a, 0x20, 0x01, 0x28, 0x0e, 0x32, 0x15, 0x2e, 0x70, 0x62, 0x2e, 0x45, 0x76, 0x65, 0x6e, 0x74,
-	0x56, 0x32, 0x2e, 0x41, 0x6c, 0x65, 0x72, 0x74, 0x54, 0x79, 0x70, 0x65, 0x52, 0x04, 0x54, 0x79,
-	0x70, 0x65, 0x22, 0x24, 0x0a, 0x0d, 0x45, 0x76, 0x65, 0x6e, 0x74, 0x50, 0x72, 0x69, 0x6f, 0x72,
-	0x69, 0x74, 0x79, 0x12, 0x0a, 0x0a, 0x06, 0x4e, 0x6f, 0x72, 0x6d, 0x61, 0x6c, 0x10, 0x00, 0x12,
-	0x07, 0x0a, 0x03, 0x4c, 0x6f, 0x77, 0x10, 0x01, 0x22, 0x3a, 0x0a, 0x09, 0x41, 0x6c, 0x65, 0x72,
-	0x74, 0x54, 0x79, 0x70, 0x65, 0x12, 0x08, 0x0a, 0x04, 0x49, 0x6e, 0x66, 0x6f, 0x10, 0x00, 0x12,
-	0x0b, 0x0a, 0x07, 0x57, 0x61, 0x72, 0x6e, 0x69, 0x6e, 0x67, 0x10, 0x01, 0x12, 0x09, 0x0a, 0x05,
-	0x45, 0x72, 0x72, 0x6f, 0x72, 0x10, 0x02, 0x12, 0x0b, 0x0a, 0x07, 0x53, 0x75, 0x63, 0x63, 0x65,
-	0x73, 0x73, 0x10, 0x03, 0x42, 0x22, 0x5a, 0x20, 0x67, 0x69, 0x74, 0x68, 0x75, 0x62, 0x2e, 0x63,
-	0x6f, 0x6d, 0x2f, 0x61, 0x74, 0x6c, 0x61, 0x73, 0x73, 0x69, 0x61, 0x6e, 0x2f, 0x67, 0x6f, 0x73,
-	0x74, 0x61, 0x74, 0x73, 0x64, 0x2f, 0x70, 0x62, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
+	0x65, 0x73, 0x22, 0xed, 0x01, 0x0a, 0x0a, 0x52, 0x61, 0x77, 0x54, 0x69, 0x6d, 0x65, 0x72, 0x56,
+	0x32, 0x12, 0x12, 0x0a, 0x04, 0x54, 0x61, 0x67, 0x73, 0x18, 0x01, 0x20, 0x03, 0x28, 0x09, 0x52,
+	0x04, 0x54, 0x61, 0x67, 0x73, 0x12, 0x1a, 0x0a, 0x08, 0x48, 0x6f, 0x73, 0x74, 0x6e, 0x61, 0x6d,
+	0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x08, 0x48, 0x6f, 0x73, 0x74, 0x6e, 0x61, 0x6d,
+	0x65, 0x12, 0x20, 0x0a, 0x0b, 0x53, 0x61, 0x6d, 0x70, 0x6c, 0x65, 0x43, 0x6f, 0x75, 0x6e, 0x74,
+	0x18, 0x03, 0x20, 0x01, 0x28, 0x01, 0x52, 0x0b, 0x53, 0x61, 0x6d, 0x70, 0x6c, 0x65, 0x43, 0x6f,
+	0x75, 0x6e, 0x74, 0x12, 0x16, 0x0a, 0x06, 0x56, 0x61, 0x6c, 0x75, 0x65, 0x73, 0x18, 0x04, 0x20,
+	0x03, 0x28, 0x01, 0x52, 0x06, 0x56, 0x61, 0x6c, 0x75, 0x65, 0x73, 0x12, 0x25, 0x0a, 0x06, 0x44,
+	0x69, 0x67, 0x65, 0x73, 0x74, 0x18, 0x05, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x0d, 0x2e, 0x70, 0x62,
+	0x2e, 0x54, 0x44, 0x69, 0x67, 0x65, 0x73, 0x74, 0x56, 0x32, 0x52, 0x06, 0x44, 0x69, 0x67, 0x65,
+	0x73, 0x74, 0x12, 0x2a, 0x0a, 0x10, 0x42, 0x75, 0x63, 0x6b, 0x65, 0x74, 0x54, 0x68, 0x72, 0x65,
+	0x73, 0x68, 0x6f, 0x6c, 0x64, 0x73, 0x18, 0x06, 0x20, 0x03, 0x28, 0x01, 0x52, 0x10, 0x42, 0x75,
+	0x63, 0x6b, 0x65, 0x74, 0x54, 0x68, 0x72, 0x65, 0x73, 0x68, 0x6f, 0x6c, 0x64, 0x73, 0x12, 0x22,
+	0x0a, 0x0c, 0x42, 0x75, 0x63, 0x6b, 0x65, 0x74, 0x43, 0x6f, 0x75, 0x6e, 0x74, 0x73, 0x18, 0x07,
+	0x20, 0x03, 0x28, 0x03, 0x52, 0x0c, 0x42, 0x75, 0x63, 0x6b, 0x65, 0x74, 0x43, 0x6f, 0x75, 0x6e,
+	0x74, 0x73, 0x22, 0xb3, 0x01, 0x0a, 0x09, 0x54, 0x44, 0x69, 0x67, 0x65, 0x73, 0x74, 0x56, 0x32,
+	0x12, 0x20, 0x0a, 0x0b, 0x43, 0x6f, 0x6d, 0x70, 0x72, 0x65, 0x73, 0x73, 0x69, 0x6f, 0x6e, 0x18,
+	0x01, 0x20, 0x01, 0x28, 0x01, 0x52, 0x0b, 0x43, 0x6f, 0x6d, 0x70, 0x72, 0x65, 0x73, 0x73, 0x69,
+	0x6f, 0x6e, 0x12, 0x10, 0x0a, 0x03, 0x4d, 0x69, 0x6e, 0x18, 0x02, 0x20, 0x01, 0x28, 0x01, 0x52,
+	0x03, 0x4d, 0x69, 0x6e, 0x12, 0x10, 0x0a, 0x03, 0x4d, 0x61, 0x78, 0x18, 0x03, 0x20, 0x01, 0x28,
+	0x01, 0x52, 0x03, 0x4d, 0x61, 0x78, 0x12, 0x10, 0x0a, 0x03, 0x53, 0x75, 0x6d, 0x18, 0x04, 0x20,
+	0x01, 0x28, 0x01, 0x52, 0x03, 0x53, 0x75, 0x6d, 0x12, 0x1e, 0x0a, 0x0a, 0x53, 0x75, 0x6d, 0x53,
+	0x71, 0x75, 0x61, 0x72, 0x65, 0x73, 0x18, 0x05, 0x20, 0x01, 0x28, 0x01, 0x52, 0x0a, 0x53, 0x75,
+	0x6d, 0x53, 0x71, 0x75, 0x61, 0x72, 0x65, 0x73, 0x12, 0x14, 0x0a, 0x05, 0x4d, 0x65, 0x61, 0x6e,
+	0x73, 0x18, 0x06, 0x20, 0x03, 0x28, 0x01, 0x52, 0x05, 0x4d, 0x65, 0x61, 0x6e, 0x73, 0x12, 0x18,
+	0x0a, 0x07, 0x57, 0x65, 0x69, 0x67, 0x68, 0x74, 0x73, 0x18, 0x07, 0x20, 0x03, 0x28, 0x01, 0x52,
+	0x07, 0x57, 0x65, 0x69, 0x67, 0x68, 0x74, 0x73, 0x22, 0xb7, 0x03, 0x0a, 0x07, 0x45, 0x76, 0x65,
+	0x6e, 0x74, 0x56, 0x32, 0x12, 0x14, 0x0a, 0x05, 0x54, 0x69, 0x74, 0x6c, 0x65, 0x18, 0x01, 0x20,
+	0x01, 0x28, 0x09, 0x52, 0x05, 0x54, 0x69, 0x74, 0x6c, 0x65, 0x12, 0x12, 0x0a, 0x04, 0x54, 0x65,
+	0x78, 0x74, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x04, 0x54, 0x65, 0x78, 0x74, 0x12, 0x22,
+	0x0a, 0x0c, 0x44, 0x61, 0x74, 0x65, 0x48, 0x61, 0x70, 0x70, 0x65, 0x6e, 0x65, 0x64, 0x18, 0x03,
+	0x20, 0x01, 0x28, 0x03, 0x52, 0x0c, 0x44, 0x61, 0x74, 0x65, 0x48, 0x61, 0x70, 0x70, 0x65, 0x6e,
+	0x65, 0x64, 0x12, 0x1a, 0x0a, 0x08, 0x48, 0x6f, 0x73, 0x74, 0x6e, 0x61, 0x6d, 0x65, 0x18, 0x04,
+	0x20, 0x01, 0x28, 0x09, 0x52, 0x08, 0x48, 0x6f, 0x73, 0x74, 0x6e, 0x61, 0x6d, 0x65, 0x12, 0x26,
+	0x0a, 0x0e, 0x41, 0x67, 0x67, 0x72, 0x65, 0x67, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x4b, 0x65, 0x79,
+	0x18, 0x05, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0e, 0x41, 0x67, 0x67, 0x72, 0x65, 0x67, 0x61, 0x74,
+	0x69, 0x6f, 0x6e, 0x4b, 0x65, 0x79, 0x12, 0x26, 0x0a, 0x0e, 0x53, 0x6f, 0x75, 0x72, 0x63, 0x65,
+	0x54, 0x79, 0x70, 0x65, 0x4e, 0x61, 0x6d, 0x65, 0x18, 0x06, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0e,
+	0x53, 0x6f, 0x75, 0x72, 0x63, 0x65, 0x54, 0x79, 0x70, 0x65, 0x4e, 0x61, 0x6d, 0x65, 0x12, 0x12,
+	0x0a, 0x04, 0x54, 0x61, 0x67, 0x73, 0x18, 0x07, 0x20, 0x03, 0x28, 0x09, 0x52, 0x04, 0x54, 0x61,
+	0x67, 0x73, 0x12, 0x1a, 0x0a, 0x08, 0x53, 0x6f, 0x75, 0x72, 0x63, 0x65, 0x49, 0x50, 0x18, 0x08,
+	0x20, 0x01, 0x28, 0x09, 0x52, 0x08, 0x53, 0x6f, 0x75, 0x72, 0x63, 0x65, 0x49, 0x50, 0x12, 0x35,
+	0x0a, 0x08, 0x50, 0x72, 0x69, 0x6f, 0x72, 0x69, 0x74, 0x79, 0x18, 0x09, 0x20, 0x01, 0x28, 0x0e,
+	0x32, 0x19, 0x2e, 0x70, 0x62, 0x2e, 0x45, 0x76, 0x65, 0x6e, 0x74, 0x56, 0x32, 0x2e, 0x45, 0x76,
+	0x65, 0x6e, 0x74, 0x50, 0x72, 0x69, 0x6f, 0x72, 0x69, 0x74, 0x79, 0x52, 0x08, 0x50, 0x72, 0x69,
+	0x6f, 0x72, 0x69, 0x74, 0x79, 0x12, 0x29, 0x0a, 0x04, 0x54, 0x79, 0x70, 0x65, 0x18, 0x0a, 0x20,
+	0x01, 0x28, 0x0e, 0x32, 0x15, 0x2e, 0x70, 0x62, 0x2e, 0x45, 0x76, 0x65, 0x6e, 0x74, 0x56, 0x32,
+	0x2e, 0x41, 0x6c, 0x65, 0x72, 0x74, 0x54, 0x79, 0x70, 0x65, 0x52, 0x04, 0x54, 0x79, 0x70, 0x65,
+	0x22, 0x24, 0x0a, 0x0d, 0x45, 0x76, 0x65, 0x6e, 0x74, 0x50, 0x72, 0x69, 0x6f, 0x72, 0x69, 0x74,
+	0x79, 0x12, 0x0a, 0x0a, 0x06, 0x4e, 0x6f, 0x72, 0x6d, 0x61, 0x6c, 0x10, 0x00, 0x12, 0x07, 0x0a,
+	0x03, 0x4c, 0x6f, 0x77, 0x10, 0x01, 0x22, 0x3a, 0x0a, 0x09, 0x41, 0x6c, 0x65, 0x72, 0x74, 0x54,
+	0x79, 0x70, 0x65, 0x12, 0x08, 0x0a, 0x04, 0x49, 0x6e, 0x66, 0x6f, 0x10, 0x00, 0x12, 0x0b, 0x0a,
+	0x07, 0x57, 0x61, 0x72, 0x6e, 0x69, 0x6e, 0x67, 0x10, 0x01, 0x12, 0x09, 0x0a, 0x05, 0x45, 0x72,
+	0x72, 0x6f, 0x72, 0x10, 0x02, 0x12, 0x0b, 0x0a, 0x07, 0x53, 0x75, 0x63, 0x63, 0x65, 0x73, 0x73,
+	0x10, 0x03, 0x42, 0x22, 0x5a, 0x20, 0x67, 0x69, 0x74, 0x68, 0x75, 0x62, 0x2e, 0x63, 0x6f, 0x6d,
+	0x2f, 0x61, 0x74, 0x6c, 0x61, 0x73, 0x73, 0x69, 0x61, 0x6e, 0x2f, 0x67, 0x6f, 0x73, 0x74, 0x61,
+	0x74, 0x73, 0x64, 0x2f, 0x70, 0x62, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
 }
 
 var (
@@ -898,7 +1036,7 @@ func file_pb_gostatsd_proto_rawDescGZIP() []byte {
 }
 
 var file_pb_gostatsd_proto_enumTypes = make([]protoimpl.EnumInfo, 2)
-var file_pb_gostatsd_proto_msgTypes = make([]protoimpl.MessageInfo, 18)
+var file_pb_gostatsd_proto_msgTypes = make([]protoimpl.MessageInfo, 19)
 var file_pb_gostatsd_proto_goTypes = []interface{}{
 	(EventV2_EventPriority)(0), // 0: pb.EventV2.EventPriority
 	(EventV2_AlertType)(0),     // 1: pb.EventV2.AlertType
@@ -911,40 +1049,42 @@ var file_pb_gostatsd_proto_goTypes = []interface{}{
 	(*RawGaugeV2)(nil),         // 8: pb.RawGaugeV2
 	(*RawSetV2)(nil),           // 9: pb.RawSetV2
 	(*RawTimerV2)(nil),         // 10: pb.RawTimerV2
-	(*EventV2)(nil),            // 11: pb.EventV2
-	nil,                        // 12: pb.RawMessageV2.CountersEntry
-	nil,                        // 13: pb.RawMessageV2.GaugesEntry
-	nil,                        // 14: pb.RawMessageV2.SetsEntry
-	nil,                        // 15: pb.RawMessageV2.TimersEntry
-	nil,                        // 16: pb.CounterTagV2.TagMapEntry
-	nil,                        // 17: pb.GaugeTagV2.TagMapEntry
-	nil,                        // 18: pb.SetTagV2.TagMapEntry
-	nil,                        // 19: pb.TimerTagV2.TagMapEntry
+	(*TDigestV2)(nil),          // 11: pb.TDigestV2
+	(*EventV2)(nil),            // 12: pb.EventV2
+	nil,                        // 13: pb.RawMessageV2.CountersEntry
+	nil,                        // 14: pb.RawMessageV2.GaugesEntry
+	nil,                        // 15: pb.RawMessageV2.SetsEntry
+	nil,                        // 16: pb.RawMessageV2.TimersEntry
+	nil,                        // 17: pb.CounterTagV2.TagMapEntry
+	nil,                        // 18: pb.GaugeTagV2.TagMapEntry
+	nil,                        // 19: pb.SetTagV2.TagMapEntry
+	nil,                        // 20: pb.TimerTagV2.TagMapEntry
 }
 var file_pb_gostatsd_proto_depIdxs = []int32{
-	12, // 0: pb.RawMessageV2.Counters:type_name -> pb.RawMessageV2.CountersEntry
-	13, // 1: pb.RawMessageV2.Gauges:type_name -> pb.RawMessageV2.GaugesEntry
-	14, // 2: pb.RawMessageV2.Sets:type_name -> pb.RawMessageV2.SetsEntry
-	15, // 3: pb.RawMessageV2.Timers:type_name -> pb.RawMessageV2.TimersEntry
-	16, // 4: pb.CounterTagV2.TagMap:type_name -> pb.CounterTagV2.TagMapEntry
-	17, // 5: pb.GaugeTagV2.TagMap:type_name -> pb.GaugeTagV2.TagMapEntry
-	18, // 6: pb.SetTagV2.TagMap:type_name -> pb.SetTagV2.TagMapEntry
-	19, // 7: pb.TimerTagV2.TagMap:type_name -> pb.TimerTagV2.TagMapEntry
-	0,  // 8: pb.EventV2.Priority:type_name -> pb.EventV2.EventPriority
-	1,  // 9: pb.EventV2.Type:type_name -> pb.EventV2.AlertType
-	3,  // 10: pb.RawMessageV2.CountersEntry.value:type_name -> pb.CounterTagV2
-	4,  // 11: pb.RawMessageV2.GaugesEntry.value:type_name -> pb.GaugeTagV2
-	5,  // 12: pb.RawMessageV2.SetsEntry.value:type_name -> pb.SetTagV2
-	6,  // 13: pb.RawMessageV2.TimersEntry.value:type_name -> pb.TimerTagV2
-	7,  // 14: pb.CounterTagV2.TagMapEntry.value:type_name -> pb.RawCounterV2
-	8,  // 15: pb.GaugeTagV2.TagMapEntry.value:type_name -> pb.RawGaugeV2
-	9,  // 16: pb.SetTagV2.TagMapEntry.value:type_name -> pb.RawSetV2
-	10, // 17: pb.TimerTagV2.TagMapEntry.value:type_name -> pb.RawTimerV2
-	18, // [18:18] is the sub-list for method output_type
-	18, // [18:18] is the sub-list for method input_type
-	18, // [18:18] is the sub-list for extension type_name
-	18, // [18:18] is the sub-list for extension extendee
-	0,  // [0:18] is the sub-list for field type_name
+	13, // 0: pb.RawMessageV2.Counters:type_name -> pb.RawMessageV2.CountersEntry
+	14, // 1: pb.RawMessageV2.Gauges:type_name -> pb.RawMessageV2.GaugesEntry
+	15, // 2: pb.RawMessageV2.Sets:type_name -> pb.RawMessageV2.SetsEntry
+	16, // 3: pb.RawMessageV2.Timers:type_name -> pb.RawMessageV2.TimersEntry
+	17, // 4: pb.CounterTagV2.TagMap:type_name -> pb.CounterTagV2.TagMapEntry
+	18, // 5: pb.GaugeTagV2.TagMap:type_name -> pb.GaugeTagV2.TagMapEntry
+	19, // 6: pb.SetTagV2.TagMap:type_name -> pb.SetTagV2.TagMapEntry
+	20, // 7: pb.TimerTagV2.TagMap:type_name -> pb.TimerTagV2.TagMapEntry
+	11, // 8: pb.RawTimerV2.Digest:type_name -> pb.TDigestV2
+	0,  // 9: pb.EventV2.Priority:type_name -> pb.EventV2.EventPriority
+	1,  // 10: pb.EventV2.Type:type_name -> pb.EventV2.AlertType
+	3,  // 11: pb.RawMessageV2.CountersEntry.value:type_name -> pb.CounterTagV2
+	4,  // 12: pb.RawMessageV2.GaugesEntry.value:type_name -> pb.GaugeTagV2
+	5,  // 13: pb.RawMessageV2.SetsEntry.value:type_name -> pb.SetTagV2
+	6,  // 14: pb.RawMessageV2.TimersEntry.value:type_name -> pb.TimerTagV2
+	7,  // 15: pb.CounterTagV2.TagMapEntry.value:type_name -> pb.RawCounterV2
+	8,  // 16: pb.GaugeTagV2.TagMapEntry.value:type_name -> pb.RawGaugeV2
+	9,  // 17: pb.SetTagV2.TagMapEntry.value:type_name -> pb.RawSetV2
+	10, // 18: pb.TimerTagV2.TagMapEntry.value:type_name -> pb.RawTimerV2
+	19, // [19:19] is the sub-list for method output_type
+	19, // [19:19] is the sub-list for method input_type
+	19, // [19:19] is the sub-list for extension type_name
+	19, // [19:19] is the sub-list for extension extendee
+	0,  // [0:19] is the sub-list for field type_name
 }
 
 func init() { file_pb_gostatsd_proto_init() }
@@ -1062,6 +1202,18 @@ func file_pb_gostatsd_proto_init() {
 			}
 		}
 		file_pb_gostatsd_proto_msgTypes[9].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*TDigestV2); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_pb_gostatsd_proto_msgTypes[10].Exporter = func(v interface{}, i int) interface{} {
 			switch v := v.(*EventV2); i {
 			case 0:
 				return &v.state
@@ -1080,7 +1232,7 @@ func file_pb_gostatsd_proto_init() {
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: file_pb_gostatsd_proto_rawDesc,
 			NumEnums:      2,
-			NumMessages:   18,
+			NumMessages:   19,
 			NumExtensions: 0,
 			NumServices:   0,
 		},
@@ -0,0 +1,352 @@
+package azuremonitor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/cenkalti/backoff"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/tilinna/clock"
+	"golang.org/x/oauth2"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/internal/azure"
+	"github.com/atlassian/gostatsd/internal/util"
+	"github.com/atlassian/gostatsd/pkg/stats"
+	"github.com/atlassian/gostatsd/pkg/transport"
+)
+
+const (
+	// BackendName is the name of this backend.
+	BackendName = "azuremonitor"
+	// monitoringResource is the resource tokens are requested for, to write custom metrics.
+	monitoringResource           = "https://monitoring.azure.com/"
+	defaultNamespace             = "gostatsd"
+	defaultMaxRequestElapsedTime = 15 * time.Second
+	// defaultSeriesPerBatch is the default number of series written in a single request, which keeps requests well
+	// below the maximum request size.
+	defaultSeriesPerBatch = 500
+	// maxDimensions is the maximum number of dimensions of a custom metric.
+	maxDimensions = 10
+	// maxNameLength is the maximum length of the name and namespace of a metric, and the names of dimensions.
+	maxNameLength           = 256
+	maxDimensionValueLength = 1024
+	// maxResponseSize is the maximum response size we are willing to read.
+	maxResponseSize = 1024
+)
+
+var (
+	// defaultMaxRequests is the number of parallel outgoing requests to Azure Monitor.
+	defaultMaxRequests = uint(2 * runtime.NumCPU())
+)
+
+// Client represents an Azure Monitor custom metrics client.
+type Client struct {
+	batchesCreated uint64            // Accumulated number of batches created
+	batchesDropped uint64            // Accumulated number of batches aborted (data loss)
+	batchesSent    uint64            // Accumulated number of batches successfully sent
+	seriesSent     uint64            // Accumulated number of series successfully sent
+	batchesRetried stats.ChangeGauge // Accumulated number of batches retried (first send is not a retry)
+
+	logger                logrus.FieldLogger
+	metricsURL            string
+	namespace             string
+	maxRequestElapsedTime time.Duration
+	retryClassifier       *transport.RetryClassifier
+	client                *http.Client
+	seriesPerBatch        uint
+	requestSem            chan struct{}
+
+	disabledSubtypes gostatsd.TimerSubtypes
+}
+
+// NewClientFromViper returns a new Azure Monitor client, authenticated with a service principal if client-secret is
+// set, and with the managed identity of the instance otherwise.
+func NewClientFromViper(v *viper.Viper, logger logrus.FieldLogger, pool *transport.TransportPool) (gostatsd.Backend, error) {
+	am := util.GetSubViper(v, "azuremonitor")
+	am.SetDefault("region", "")
+	am.SetDefault("resource-id", "")
+	am.SetDefault("api-endpoint", "")
+	am.SetDefault("namespace", defaultNamespace)
+	am.SetDefault("authority-host", azure.DefaultAuthorityHost)
+	am.SetDefault("tenant-id", "")
+	am.SetDefault("client-id", "")
+	am.SetDefault("client-secret", "")
+	am.SetDefault("series-per-batch", defaultSeriesPerBatch)
+	am.SetDefault("max-requests", defaultMaxRequests)
+	am.SetDefault("max-request-elapsed-time", defaultMaxRequestElapsedTime)
+	am.SetDefault("transport", "default")
+	am.SetDefault("fatal-status-codes", transport.DefaultFatalStatusCodes)
+
+	apiEndpoint := am.GetString("api-endpoint")
+	if apiEndpoint == "" {
+		region := am.GetString("region")
+		if region == "" {
+			return nil, fmt.Errorf("[%s] region or api-endpoint is required", BackendName)
+		}
+		apiEndpoint = fmt.Sprintf("https://%s.monitoring.azure.com", region)
+	}
+	retryClassifier, err := transport.NewRetryClassifier(am.GetIntSlice("fatal-status-codes"))
+	if err != nil {
+		return nil, fmt.Errorf("[%s] %v", BackendName, err)
+	}
+	httpClient, err := pool.Get(am.GetString("transport"))
+	if err != nil {
+		logger.WithError(err).Error("failed to create http client")
+		return nil, err
+	}
+	tokenSource, err := azure.NewTokenSource(
+		httpClient.Client,
+		monitoringResource,
+		am.GetString("authority-host"),
+		am.GetString("tenant-id"),
+		am.GetString("client-id"),
+		am.GetString("client-secret"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("[%s] %v", BackendName, err)
+	}
+
+	return NewClient(
+		apiEndpoint,
+		am.GetString("resource-id"),
+		am.GetString("namespace"),
+		am.GetInt("series-per-batch"),
+		uint(am.GetInt("max-requests")),
+		am.GetDuration("max-request-elapsed-time"),
+		retryClassifier,
+		gostatsd.DisabledSubMetrics(v),
+		tokenSource,
+		httpClient.Client,
+		logger,
+	)
+}
+
+// NewClient returns a new Azure Monitor client, which writes custom metrics of the resource resourceID in namespace
+// with tokens from tokenSource, using client.  Errors classified as fatal by retryClassifier are not retried.
+func NewClient(
+	apiEndpoint,
+	resourceID,
+	namespace string,
+	seriesPerBatch int,
+	maxRequests uint,
+	maxRequestElapsedTime time.Duration,
+	retryClassifier *transport.RetryClassifier,
+	disabled gostatsd.TimerSubtypes,
+	tokenSource oauth2.TokenSource,
+	client *http.Client,
+	logger logrus.FieldLogger,
+) (*Client, error) {
+	if apiEndpoint == "" {
+		return nil, fmt.Errorf("[%s] apiEndpoint is required", BackendName)
+	}
+	if !strings.HasPrefix(resourceID, "/") {
+		return nil, fmt.Errorf("[%s] resourceID is required, and must start with /", BackendName)
+	}
+	if namespace == "" || len(namespace) > maxNameLength {
+		return nil, fmt.Errorf("[%s] namespace must be between 1 and %d characters", BackendName, maxNameLength)
+	}
+	if seriesPerBatch <= 0 {
+		return nil, fmt.Errorf("[%s] seriesPerBatch must be positive", BackendName)
+	}
+	if maxRequests == 0 {
+		return nil, fmt.Errorf("[%s] maxRequests must be positive", BackendName)
+	}
+	if maxRequestElapsedTime <= 0 && maxRequestElapsedTime != -1 {
+		return nil, fmt.Errorf("[%s] maxRequestElapsedTime must be positive", BackendName)
+	}
+
+	logger.WithFields(logrus.Fields{
+		"api-endpoint":             apiEndpoint,
+		"resource-id":              resourceID,
+		"namespace":                namespace,
+		"max-request-elapsed-time": maxRequestElapsedTime,
+		"max-requests":             maxRequests,
+		"series-per-batch":         seriesPerBatch,
+	}).Info("created backend")
+
+	requestSem := make(chan struct{}, maxRequests)
+	for i := uint(0); i < maxRequests; i++ {
+		requestSem <- struct{}{}
+	}
+	return &Client{
+		logger:                logger,
+		metricsURL:            strings.TrimSuffix(apiEndpoint, "/") + strings.TrimSuffix(resourceID, "/") + "/metrics",
+		namespace:             namespace,
+		maxRequestElapsedTime: maxRequestElapsedTime,
+		retryClassifier:       retryClassifier,
+		client: &http.Client{
+			Transport: &oauth2.Transport{
+				Source: tokenSource,
+				Base:   client.Transport,
+			},
+			Timeout: client.Timeout,
+		},
+		seriesPerBatch:   uint(seriesPerBatch),
+		requestSem:       requestSem,
+		disabledSubtypes: disabled,
+	}, nil
+}
+
+// SendMetricsAsync flushes the metrics to Azure Monitor, preparing payload synchronously but doing the send
+// asynchronously.
+func (client *Client) SendMetricsAsync(ctx context.Context, metrics *gostatsd.MetricMap, cb gostatsd.SendCallback) {
+	counter := 0
+	results := make(chan error)
+
+	client.processMetrics(clock.FromContext(ctx).Now(), metrics, func(req *metricsRequest) {
+		atomic.AddUint64(&client.batchesCreated, 1)
+		go func() {
+			select {
+			case <-ctx.Done():
+				return
+			case <-client.requestSem:
+				defer func() {
+					client.requestSem <- struct{}{}
+				}()
+				err := client.postMetrics(ctx, req)
+
+				select {
+				case <-ctx.Done():
+				case results <- err:
+				}
+			}
+		}()
+		counter++
+	})
+	go func() {
+		errs := make([]error, 0, counter)
+	loop:
+		for c := 0; c < counter; c++ {
+			select {
+			case <-ctx.Done():
+				errs = append(errs, ctx.Err())
+				break loop
+			case err := <-results:
+				errs = append(errs, err)
+			}
+		}
+		cb(errs)
+	}()
+}
+
+func (client *Client) Run(ctx context.Context) {
+	statser := stats.FromContext(ctx).WithTags(gostatsd.Tags{"backend:" + BackendName})
+
+	flushed, unregister := statser.RegisterFlush()
+	defer unregister()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-flushed:
+			statser.Gauge("backend.created", float64(atomic.LoadUint64(&client.batchesCreated)), nil)
+			client.batchesRetried.SendIfChanged(statser, "backend.retried", nil)
+			statser.Gauge("backend.dropped", float64(atomic.LoadUint64(&client.batchesDropped)), nil)
+			statser.Gauge("backend.sent", float64(atomic.LoadUint64(&client.batchesSent)), nil)
+			statser.Gauge("backend.series.sent", float64(atomic.LoadUint64(&client.seriesSent)), nil)
+		}
+	}
+}
+
+// postMetrics writes a request, retrying until it succeeds, fails with a fatal error, or maxRequestElapsedTime
+// passes.
+func (client *Client) postMetrics(ctx context.Context, req *metricsRequest) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		atomic.AddUint64(&client.batchesDropped, 1)
+		return fmt.Errorf("[%s] unable to marshal metrics: %v", BackendName, err)
+	}
+
+	b := backoff.NewExponentialBackOff()
+	clck := clock.FromContext(ctx)
+	b.Clock = clck
+	b.Reset()
+	b.MaxElapsedTime = client.maxRequestElapsedTime
+	for {
+		if err = client.post(ctx, body); err == nil {
+			atomic.AddUint64(&client.batchesSent, 1)
+			atomic.AddUint64(&client.seriesSent, uint64(len(req.Data.BaseData.Series)))
+			return nil
+		}
+
+		if client.retryClassifier.IsFatal(err) {
+			atomic.AddUint64(&client.batchesDropped, 1)
+			client.logger.WithError(err).Error("failed to send, not retrying")
+			return fmt.Errorf("[%s] %v", BackendName, err)
+		}
+
+		next := b.NextBackOff()
+		if next == backoff.Stop {
+			atomic.AddUint64(&client.batchesDropped, 1)
+			return fmt.Errorf("[%s] %v", BackendName, err)
+		}
+
+		client.logger.WithFields(logrus.Fields{
+			"sleep": next,
+			"error": err,
+		}).Warn("failed to send")
+
+		timer := clck.NewTimer(next)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+
+		atomic.AddUint64(&client.batchesRetried.Cur, 1)
+	}
+}
+
+func (client *Client) post(ctx context.Context, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, client.metricsURL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("unable to create http.Request: %v", err)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error POSTing: %v", err)
+	}
+	defer resp.Body.Close()
+	respBody := io.LimitReader(resp.Body, maxResponseSize)
+	if resp.StatusCode < http.StatusOK || resp.StatusCode > http.StatusNoContent {
+		b, _ := ioutil.ReadAll(respBody)
+		client.logger.WithFields(logrus.Fields{
+			"status": resp.StatusCode,
+			"body":   string(b),
+		}).Info("request failed")
+		return &transport.StatusError{StatusCode: resp.StatusCode}
+	}
+	_, _ = io.Copy(ioutil.Discard, respBody)
+	return nil
+}
+
+// SendEvent is not supported, as Azure Monitor custom metrics have no events.
+func (client *Client) SendEvent(ctx context.Context, e *gostatsd.Event) error {
+	return nil
+}
+
+// Name returns the name of the backend.
+func (client *Client) Name() string {
+	return BackendName
+}
+
+// MaxTags returns the maximum number of tags of each metric, leaving room for the host dimension, as Azure Monitor
+// rejects custom metrics with too many dimensions.
+func (client *Client) MaxTags() int {
+	return maxDimensions - 1
+}
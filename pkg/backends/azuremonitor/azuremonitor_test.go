@@ -0,0 +1,104 @@
+package azuremonitor
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/transport"
+)
+
+func TestSendMetrics(t *testing.T) {
+	t.Parallel()
+	var requests, series uint32
+	mux := http.NewServeMux()
+	mux.HandleFunc(testResourceID+"/metrics", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.Equal(t, "Bearer token123", r.Header.Get("Authorization"))
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		var body metricsRequest
+		if !assert.NoError(t, json.NewDecoder(r.Body).Decode(&body)) {
+			return
+		}
+		atomic.AddUint32(&requests, 1)
+		atomic.AddUint32(&series, uint32(len(body.Data.BaseData.Series)))
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	client := newTestClient(t, ts.URL, 2)
+	mm := gostatsd.NewMetricMap()
+	mm.Counters["c"] = map[string]gostatsd.Counter{"": {Value: 5, PerSecond: 0.5}}
+	mm.Gauges["g"] = map[string]gostatsd.Gauge{
+		"k:1": {Value: 1, Tags: gostatsd.Tags{"k:1"}},
+		"k:2": {Value: 2, Tags: gostatsd.Tags{"k:2"}},
+	}
+	res := make(chan []error, 1)
+	client.SendMetricsAsync(context.Background(), mm, func(errs []error) {
+		res <- errs
+	})
+	errs := <-res
+	require.Len(t, errs, 3)
+	for _, err := range errs {
+		assert.NoError(t, err)
+	}
+	assert.EqualValues(t, 3, requests)
+	assert.EqualValues(t, 4, series)
+	assert.EqualValues(t, 4, client.seriesSent)
+}
+
+func TestSendMetricsRetries(t *testing.T) {
+	t.Parallel()
+	for status, expectedRequests := range map[int]uint32{
+		http.StatusServiceUnavailable: 2, // Retried
+		http.StatusBadRequest:         1, // Fatal
+	} {
+		var requests uint32
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if atomic.AddUint32(&requests, 1) == 1 {
+				w.WriteHeader(status)
+			}
+		}))
+
+		client := newTestClient(t, ts.URL, defaultSeriesPerBatch)
+		client.retryClassifier, _ = transport.NewRetryClassifier(transport.DefaultFatalStatusCodes)
+		mm := gostatsd.NewMetricMap()
+		mm.Gauges["g"] = map[string]gostatsd.Gauge{"": {Value: 1}}
+		res := make(chan []error, 1)
+		client.SendMetricsAsync(context.Background(), mm, func(errs []error) {
+			res <- errs
+		})
+		errs := <-res
+		ts.Close()
+		require.Len(t, errs, 1)
+		assert.Equal(t, status == http.StatusBadRequest, errs[0] != nil, "status %d", status)
+		assert.Equal(t, expectedRequests, requests, "status %d", status)
+	}
+}
+
+func TestNewClientValidation(t *testing.T) {
+	t.Parallel()
+	newClient := func(resourceID, namespace string, seriesPerBatch int) error {
+		_, err := NewClient("https://eastus.monitoring.azure.com", resourceID, namespace, seriesPerBatch, 1, time.Second, nil,
+			gostatsd.TimerSubtypes{}, oauth2.StaticTokenSource(&oauth2.Token{}), http.DefaultClient, logrus.New())
+		return err
+	}
+	require.NoError(t, newClient(testResourceID, defaultNamespace, 1))
+	require.Error(t, newClient("", defaultNamespace, 1))
+	require.Error(t, newClient("subscriptions/sub-1", defaultNamespace, 1))
+	require.Error(t, newClient(testResourceID, "", 1))
+	require.Error(t, newClient(testResourceID, defaultNamespace, 0))
+
+	client := newTestClient(t, "https://eastus.monitoring.azure.com/", defaultSeriesPerBatch)
+	assert.Equal(t, "https://eastus.monitoring.azure.com"+testResourceID+"/metrics", client.metricsURL)
+}
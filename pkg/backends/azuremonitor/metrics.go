@@ -0,0 +1,243 @@
+package azuremonitor
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/atlassian/gostatsd"
+)
+
+// metricsRequest is the body of a custom metrics request.  A request writes series of a single metric, and every
+// series has the same dimension names.
+type metricsRequest struct {
+	Time string      `json:"time"`
+	Data metricsData `json:"data"`
+}
+
+type metricsData struct {
+	BaseData baseData `json:"baseData"`
+}
+
+type baseData struct {
+	Metric    string    `json:"metric"`
+	Namespace string    `json:"namespace"`
+	DimNames  []string  `json:"dimNames,omitempty"`
+	Series    []*series `json:"series"`
+}
+
+type series struct {
+	DimValues []string `json:"dimValues,omitempty"`
+	Min       float64  `json:"min"`
+	Max       float64  `json:"max"`
+	Sum       float64  `json:"sum"`
+	Count     uint64   `json:"count"`
+}
+
+// singleValue returns a series of a single value.
+func singleValue(value float64) *series {
+	return &series{Min: value, Max: value, Sum: value, Count: 1}
+}
+
+// pendingRequest is a request which is being filled with series.
+type pendingRequest struct {
+	req       *metricsRequest
+	dimValues map[string]struct{} // The dimension values of every series in the request
+}
+
+// flush maps the metrics of a single flush to series, and groups them in to requests of at most seriesPerBatch series
+// of the same metric and dimension names.  A request is also ended early if the dimension values of a series are
+// repeated, which can happen if tags are only different before they're truncated, or differ by case.
+type flush struct {
+	client  *Client
+	time    string
+	pending map[string]*pendingRequest // By metric name and dimension names
+	cb      func(*metricsRequest)
+}
+
+// processMetrics maps every metric to series at now, and calls cb with each request.
+func (client *Client) processMetrics(now time.Time, metrics *gostatsd.MetricMap, cb func(*metricsRequest)) {
+	fl := &flush{
+		client:  client,
+		time:    now.UTC().Format(time.RFC3339),
+		pending: map[string]*pendingRequest{},
+		cb:      cb,
+	}
+
+	metrics.Counters.Each(func(key, tagsKey string, counter gostatsd.Counter) {
+		fl.add(key, singleValue(float64(counter.Value)), counter.Source, counter.Tags)
+		fl.add(key+".rate", singleValue(counter.PerSecond), counter.Source, counter.Tags)
+	})
+
+	metrics.Timers.Each(func(key, tagsKey string, timer gostatsd.Timer) {
+		if timer.Histogram != nil {
+			for histogramThreshold, count := range timer.Histogram {
+				bucketTag := "le:+Inf"
+				if !math.IsInf(float64(histogramThreshold), 1) {
+					bucketTag = "le:" + strconv.FormatFloat(float64(histogramThreshold), 'f', -1, 64)
+				}
+				// The bucket comes first, so it's kept if there are too many dimensions
+				fl.add(key+".histogram", singleValue(float64(count)), timer.Source, gostatsd.Tags{bucketTag}.Concat(timer.Tags))
+			}
+			return
+		}
+		// The lower, upper, count, and sum are the native min, max, count, and sum of the metric
+		if timer.Count > 0 {
+			fl.add(key, &series{Min: timer.Min, Max: timer.Max, Sum: timer.Sum, Count: uint64(timer.Count)}, timer.Source, timer.Tags)
+		}
+		disabled := timer.EffectiveDisabledSubtypes(client.disabledSubtypes)
+		if !disabled.CountPerSecond {
+			fl.add(key+".count_ps", singleValue(timer.PerSecond), timer.Source, timer.Tags)
+		}
+		if !disabled.Median {
+			fl.add(key+".median", singleValue(timer.Median), timer.Source, timer.Tags)
+		}
+		if !disabled.StdDev {
+			fl.add(key+".std", singleValue(timer.StdDev), timer.Source, timer.Tags)
+		}
+		if !disabled.SumSquares {
+			fl.add(key+".sum_squares", singleValue(timer.SumSquares), timer.Source, timer.Tags)
+		}
+		for _, pct := range timer.Percentiles {
+			fl.add(key+"."+pct.Str, singleValue(pct.Float), timer.Source, timer.Tags)
+		}
+	})
+
+	metrics.Gauges.Each(func(key, tagsKey string, g gostatsd.Gauge) {
+		fl.add(key, singleValue(g.Value), g.Source, g.Tags)
+	})
+
+	metrics.Sets.Each(func(key, tagsKey string, set gostatsd.Set) {
+		fl.add(key, singleValue(float64(len(set.Values))), set.Source, set.Tags)
+	})
+
+	fl.finish()
+}
+
+// add adds a series of the metric name.  Series with values which can't be represented in JSON are skipped.
+func (fl *flush) add(name string, s *series, source gostatsd.Source, tags gostatsd.Tags) {
+	for _, v := range [...]float64{s.Min, s.Max, s.Sum} {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return
+		}
+	}
+	name = truncate(name, maxNameLength)
+	dimNames, dimValues := dimensions(source, tags)
+	s.DimValues = dimValues
+
+	key := name + "\x00" + strings.Join(dimNames, "\x00")
+	valuesKey := strings.Join(dimValues, "\x00")
+	p := fl.pending[key]
+	if p != nil {
+		if _, ok := p.dimValues[valuesKey]; ok || len(p.req.Data.BaseData.Series) >= int(fl.client.seriesPerBatch) {
+			fl.cb(p.req)
+			p = nil
+		}
+	}
+	if p == nil {
+		p = &pendingRequest{
+			req: &metricsRequest{
+				Time: fl.time,
+				Data: metricsData{BaseData: baseData{
+					Metric:    name,
+					Namespace: fl.client.namespace,
+					DimNames:  dimNames,
+				}},
+			},
+			dimValues: map[string]struct{}{},
+		}
+		fl.pending[key] = p
+	}
+	p.req.Data.BaseData.Series = append(p.req.Data.BaseData.Series, s)
+	p.dimValues[valuesKey] = struct{}{}
+}
+
+// finish sends every pending request to the callback, in order of metric name and dimension names.
+func (fl *flush) finish() {
+	keys := make([]string, 0, len(fl.pending))
+	for key := range fl.pending {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fl.cb(fl.pending[key].req)
+	}
+	fl.pending = map[string]*pendingRequest{}
+}
+
+// dimensions returns the tags as dimension names and values, sorted by name, and the source as the `host` dimension,
+// unless there is a `host` tag.  Dimension names are case insensitive, so if a name is repeated in any case, the first
+// value is used.  A tag without a value has the value `true`.  Names and values are truncated to their maximum
+// lengths, and tags beyond the maximum number of dimensions are dropped, keeping room for the `host` dimension.
+func dimensions(source gostatsd.Source, tags gostatsd.Tags) ([]string, []string) {
+	addHost := source != "" && !hasHostTag(tags)
+	limit := maxDimensions
+	if addHost {
+		limit--
+	}
+	dims := make(map[string]string, len(tags)+1)
+	seen := make(map[string]struct{}, len(tags)+1)
+	for _, tag := range tags {
+		if len(dims) >= limit {
+			break
+		}
+		name, value := splitTag(tag)
+		name = truncate(name, maxNameLength)
+		if name == "" {
+			continue
+		}
+		lower := strings.ToLower(name)
+		if _, ok := seen[lower]; ok {
+			continue
+		}
+		seen[lower] = struct{}{}
+		dims[name] = truncate(value, maxDimensionValueLength)
+	}
+	if addHost {
+		dims["host"] = truncate(string(source), maxDimensionValueLength)
+	}
+	if len(dims) == 0 {
+		return nil, nil
+	}
+	names := make([]string, 0, len(dims))
+	for name := range dims {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	values := make([]string, len(names))
+	for i, name := range names {
+		values[i] = dims[name]
+	}
+	return names, values
+}
+
+func hasHostTag(tags gostatsd.Tags) bool {
+	for _, tag := range tags {
+		if name, _ := splitTag(tag); strings.EqualFold(name, "host") {
+			return true
+		}
+	}
+	return false
+}
+
+func splitTag(tag string) (string, string) {
+	if idx := strings.IndexByte(tag, ':'); idx >= 0 {
+		return tag[:idx], tag[idx+1:]
+	}
+	return tag, "true"
+}
+
+// truncate truncates s to at most maxLength bytes, without splitting a UTF-8 character.
+func truncate(s string, maxLength int) string {
+	if len(s) <= maxLength {
+		return s
+	}
+	end := maxLength
+	for end > 0 && !utf8.RuneStart(s[end]) {
+		end--
+	}
+	return s[:end]
+}
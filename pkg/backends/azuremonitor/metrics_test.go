@@ -0,0 +1,196 @@
+package azuremonitor
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+
+	"github.com/atlassian/gostatsd"
+)
+
+const testResourceID = "/subscriptions/sub-1/resourceGroups/rg-1/providers/Microsoft.Compute/virtualMachines/vm-1"
+
+func newTestClient(t *testing.T, apiEndpoint string, seriesPerBatch int) *Client {
+	client, err := NewClient(
+		apiEndpoint,
+		testResourceID,
+		defaultNamespace,
+		seriesPerBatch,
+		defaultMaxRequests,
+		time.Second,
+		nil,
+		gostatsd.TimerSubtypes{},
+		oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "token123"}),
+		http.DefaultClient,
+		logrus.New(),
+	)
+	require.NoError(t, err)
+	return client
+}
+
+func collectRequests(client *Client, mm *gostatsd.MetricMap) []*metricsRequest {
+	var reqs []*metricsRequest
+	client.processMetrics(time.Unix(1600000000, 500000000), mm, func(req *metricsRequest) {
+		reqs = append(reqs, req)
+	})
+	return reqs
+}
+
+func TestMetricsSerialization(t *testing.T) {
+	t.Parallel()
+	client := newTestClient(t, "https://eastus.monitoring.azure.com", defaultSeriesPerBatch)
+	mm := gostatsd.NewMetricMap()
+	mm.Gauges["api.queue-depth"] = map[string]gostatsd.Gauge{
+		"env:prod,canary":  {Value: 12.5, Source: "web-1", Tags: gostatsd.Tags{"env:prod", "canary"}},
+		"env:prod,canary2": {Value: 3, Source: "web-2", Tags: gostatsd.Tags{"env:prod", "canary"}},
+	}
+	timer := gostatsd.Timer{Count: 3, Min: 1, Max: 20, Sum: 28}
+	mm.Timers["api.latency"] = map[string]gostatsd.Timer{"": timer}
+	client.disabledSubtypes = gostatsd.TimerSubtypes{CountPerSecond: true, Median: true, StdDev: true, SumSquares: true}
+
+	reqs := collectRequests(client, mm)
+	require.Len(t, reqs, 2)
+
+	data, err := json.Marshal(reqs[0])
+	require.NoError(t, err)
+	assert.JSONEq(t, `{
+		"time": "2020-09-13T12:26:40Z",
+		"data": {
+			"baseData": {
+				"metric": "api.latency",
+				"namespace": "gostatsd",
+				"series": [{"min": 1, "max": 20, "sum": 28, "count": 3}]
+			}
+		}
+	}`, string(data))
+
+	// Series with the same dimension names are written in the same request
+	data, err = json.Marshal(reqs[1])
+	require.NoError(t, err)
+	var actual metricsRequest
+	require.NoError(t, json.Unmarshal(data, &actual))
+	assert.Equal(t, "api.queue-depth", actual.Data.BaseData.Metric)
+	assert.Equal(t, []string{"canary", "env", "host"}, actual.Data.BaseData.DimNames)
+	assert.ElementsMatch(t, []*series{
+		{DimValues: []string{"true", "prod", "web-1"}, Min: 12.5, Max: 12.5, Sum: 12.5, Count: 1},
+		{DimValues: []string{"true", "prod", "web-2"}, Min: 3, Max: 3, Sum: 3, Count: 1},
+	}, actual.Data.BaseData.Series)
+}
+
+func TestMetricsMapping(t *testing.T) {
+	t.Parallel()
+	client := newTestClient(t, "https://eastus.monitoring.azure.com", defaultSeriesPerBatch)
+	mm := gostatsd.NewMetricMap()
+	mm.Counters["c"] = map[string]gostatsd.Counter{"": {Value: 5, PerSecond: 0.5}}
+	timer := gostatsd.Timer{Count: 2, PerSecond: 0.2, Min: 1, Max: 3, Mean: 2, Median: 2, StdDev: 1, Sum: 4, SumSquares: 10}
+	timer.Percentiles.Set("upper_90", 3)
+	mm.Timers["t"] = map[string]gostatsd.Timer{"": timer}
+	mm.Timers["h"] = map[string]gostatsd.Timer{"": {Histogram: map[gostatsd.HistogramThreshold]int{10: 1, gostatsd.HistogramThreshold(math.Inf(1)): 2}}}
+	mm.Gauges["g"] = map[string]gostatsd.Gauge{"": {Value: 1}, "nan": {Value: math.NaN(), Tags: gostatsd.Tags{"nan"}}}
+	mm.Sets["s"] = map[string]gostatsd.Set{"": {Values: map[string]struct{}{"a": {}, "b": {}}}}
+
+	actual := map[string]series{}
+	for _, req := range collectRequests(client, mm) {
+		for _, s := range req.Data.BaseData.Series {
+			name := req.Data.BaseData.Metric
+			if len(s.DimValues) > 0 {
+				name += "{" + strings.Join(req.Data.BaseData.DimNames, ",") + "=" + strings.Join(s.DimValues, ",") + "}"
+			}
+			actual[name] = series{Min: s.Min, Max: s.Max, Sum: s.Sum, Count: s.Count}
+		}
+	}
+	single := func(v float64) series {
+		return series{Min: v, Max: v, Sum: v, Count: 1}
+	}
+	assert.Equal(t, map[string]series{
+		"c":                    single(5),
+		"c.rate":               single(0.5),
+		"t":                    {Min: 1, Max: 3, Sum: 4, Count: 2},
+		"t.count_ps":           single(0.2),
+		"t.median":             single(2),
+		"t.std":                single(1),
+		"t.sum_squares":        single(10),
+		"t.upper_90":           single(3),
+		"h.histogram{le=10}":   single(1),
+		"h.histogram{le=+Inf}": single(2),
+		"g":                    single(1), // NaN is skipped
+		"s":                    single(2),
+	}, actual)
+}
+
+func TestMetricsBatching(t *testing.T) {
+	t.Parallel()
+	client := newTestClient(t, "https://eastus.monitoring.azure.com", 2)
+	mm := gostatsd.NewMetricMap()
+	mm.Gauges["a"] = map[string]gostatsd.Gauge{
+		"k:1": {Value: 1, Tags: gostatsd.Tags{"k:1"}},
+		"k:2": {Value: 1, Tags: gostatsd.Tags{"k:2"}},
+		"k:3": {Value: 1, Tags: gostatsd.Tags{"k:3"}},
+		"":    {Value: 1}, // Other dimension names
+	}
+	mm.Gauges["b"] = map[string]gostatsd.Gauge{"k:1": {Value: 1, Tags: gostatsd.Tags{"k:1"}}}
+	reqs := collectRequests(client, mm)
+	counts := map[string][]int{}
+	for _, req := range reqs {
+		key := req.Data.BaseData.Metric + "[" + strings.Join(req.Data.BaseData.DimNames, ",") + "]"
+		counts[key] = append(counts[key], len(req.Data.BaseData.Series))
+	}
+	assert.Equal(t, map[string][]int{
+		"a[k]": {2, 1},
+		"a[]":  {1},
+		"b[k]": {1},
+	}, counts)
+
+	// Tags which are the same once truncated are written in separate requests
+	client = newTestClient(t, "https://eastus.monitoring.azure.com", defaultSeriesPerBatch)
+	long := strings.Repeat("v", maxDimensionValueLength)
+	mm = gostatsd.NewMetricMap()
+	mm.Gauges["a"] = map[string]gostatsd.Gauge{
+		"1": {Value: 1, Tags: gostatsd.Tags{"k:" + long + "1"}},
+		"2": {Value: 2, Tags: gostatsd.Tags{"k:" + long + "2"}},
+	}
+	reqs = collectRequests(client, mm)
+	require.Len(t, reqs, 2)
+	assert.Equal(t, reqs[0].Data.BaseData.Series[0].DimValues, reqs[1].Data.BaseData.Series[0].DimValues)
+}
+
+func TestDimensions(t *testing.T) {
+	t.Parallel()
+	names, values := dimensions("", nil)
+	assert.Nil(t, names)
+	assert.Nil(t, values)
+
+	names, values = dimensions("h", nil)
+	assert.Equal(t, []string{"host"}, names)
+	assert.Equal(t, []string{"h"}, values)
+
+	// A host tag takes precedence over the source, and the first value of a name in any case is used
+	names, values = dimensions("h", gostatsd.Tags{"Host:tagged", "Env:1", "env:2", ":empty"})
+	assert.Equal(t, []string{"Env", "Host"}, names)
+	assert.Equal(t, []string{"1", "tagged"}, values)
+
+	// Tags beyond the limit are dropped, keeping room for the host
+	var tags gostatsd.Tags
+	for i := 0; i < 12; i++ {
+		tags = append(tags, string(rune('a'+i))+":v")
+	}
+	names, _ = dimensions("h", tags)
+	assert.Len(t, names, maxDimensions)
+	assert.Contains(t, names, "host")
+	assert.Contains(t, names, "i")
+	assert.NotContains(t, names, "j")
+
+	long := strings.Repeat("é", maxDimensionValueLength)
+	names, values = dimensions("", gostatsd.Tags{strings.Repeat("k", 300) + ":" + long})
+	assert.Len(t, names[0], maxNameLength)
+	assert.Len(t, values[0], maxDimensionValueLength)
+	assert.True(t, strings.HasPrefix(long, values[0]))
+}
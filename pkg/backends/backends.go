@@ -7,12 +7,15 @@ import (
 	"github.com/spf13/viper"
 
 	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/backends/azuremonitor"
 	"github.com/atlassian/gostatsd/pkg/backends/cloudwatch"
 	"github.com/atlassian/gostatsd/pkg/backends/datadog"
 	"github.com/atlassian/gostatsd/pkg/backends/graphite"
 	"github.com/atlassian/gostatsd/pkg/backends/influxdb"
 	"github.com/atlassian/gostatsd/pkg/backends/newrelic"
 	"github.com/atlassian/gostatsd/pkg/backends/null"
+	"github.com/atlassian/gostatsd/pkg/backends/stackdriver"
+	"github.com/atlassian/gostatsd/pkg/backends/statsd"
 	"github.com/atlassian/gostatsd/pkg/backends/statsdaemon"
 	"github.com/atlassian/gostatsd/pkg/backends/stdout"
 	"github.com/atlassian/gostatsd/pkg/transport"
@@ -20,14 +23,17 @@ import (
 
 // All known backends.
 var backends = map[string]gostatsd.BackendFactory{
-	datadog.BackendName:     datadog.NewClientFromViper,
-	graphite.BackendName:    graphite.NewClientFromViper,
-	influxdb.BackendName:    influxdb.NewClientFromViper,
-	null.BackendName:        null.NewClientFromViper,
-	statsdaemon.BackendName: statsdaemon.NewClientFromViper,
-	stdout.BackendName:      stdout.NewClientFromViper,
-	cloudwatch.BackendName:  cloudwatch.NewClientFromViper,
-	newrelic.BackendName:    newrelic.NewClientFromViper,
+	datadog.BackendName:      datadog.NewClientFromViper,
+	graphite.BackendName:     graphite.NewClientFromViper,
+	influxdb.BackendName:     influxdb.NewClientFromViper,
+	null.BackendName:         null.NewClientFromViper,
+	statsd.BackendName:       statsd.NewClientFromViper,
+	statsdaemon.BackendName:  statsdaemon.NewClientFromViper,
+	stdout.BackendName:       stdout.NewClientFromViper,
+	cloudwatch.BackendName:   cloudwatch.NewClientFromViper,
+	newrelic.BackendName:     newrelic.NewClientFromViper,
+	stackdriver.BackendName:  stackdriver.NewClientFromViper,
+	azuremonitor.BackendName: azuremonitor.NewClientFromViper,
 }
 
 // GetBackend creates an instance of the named backend, or nil if
@@ -2,6 +2,7 @@ package cloudwatch
 
 import (
 	"context"
+	"fmt"
 	"math"
 	"strconv"
 	"strings"
@@ -34,6 +35,14 @@ type Client struct {
 	namespace  string
 
 	disabledSubtypes gostatsd.TimerSubtypes
+	unitRules        []unitRule
+	timerUnit        string // The unit of the values of timers which don't match a unitRule
+}
+
+// unitRule infers the unit of metrics with a name ending in suffix.
+type unitRule struct {
+	suffix string
+	unit   string
 }
 
 // NewClientFromViper constructs a Cloudwatch backend.
@@ -41,18 +50,31 @@ func NewClientFromViper(v *viper.Viper, logger logrus.FieldLogger, pool *transpo
 	g := util.GetSubViper(v, "cloudwatch")
 	g.SetDefault("namespace", "StatsD")
 	g.SetDefault("transport", "default")
+	g.SetDefault("unit-suffixes", []string{})
+	g.SetDefault("timer-unit", cloudwatch.StandardUnitMilliseconds)
 
 	return NewClient(
 		g.GetString("namespace"),
 		g.GetString("transport"),
+		g.GetStringSlice("unit-suffixes"),
+		g.GetString("timer-unit"),
 		gostatsd.DisabledSubMetrics(v),
 		logger,
 		pool,
 	)
 }
 
-// NewClient constructs a AWS Cloudwatch backend.
-func NewClient(namespace, transport string, disabled gostatsd.TimerSubtypes, logger logrus.FieldLogger, pool *transport.TransportPool) (*Client, error) {
+// NewClient constructs a AWS Cloudwatch backend.  Each of unitSuffixes is of the form `<suffix>=<unit>`, where unit is
+// a CloudWatch standard unit, and the first suffix which matches a metric name sets its unit.  The values of timers
+// which don't match are in timerUnit.
+func NewClient(namespace, transport string, unitSuffixes []string, timerUnit string, disabled gostatsd.TimerSubtypes, logger logrus.FieldLogger, pool *transport.TransportPool) (*Client, error) {
+	unitRules, err := newUnitRules(unitSuffixes)
+	if err != nil {
+		return nil, err
+	}
+	if !isStandardUnit(timerUnit) {
+		return nil, fmt.Errorf("invalid timer-unit %q, it is not a CloudWatch unit", timerUnit)
+	}
 	httpClient, err := pool.Get(transport)
 	if err != nil {
 		return nil, err
@@ -71,9 +93,58 @@ func NewClient(namespace, transport string, disabled gostatsd.TimerSubtypes, log
 		namespace:  namespace,
 
 		disabledSubtypes: disabled,
+		unitRules:        unitRules,
+		timerUnit:        timerUnit,
 	}, nil
 }
 
+func isStandardUnit(unit string) bool {
+	for _, standardUnit := range cloudwatch.StandardUnit_Values() {
+		if standardUnit == unit {
+			return true
+		}
+	}
+	return false
+}
+
+func newUnitRules(unitSuffixes []string) ([]unitRule, error) {
+	rules := make([]unitRule, 0, len(unitSuffixes))
+	for _, unitSuffix := range unitSuffixes {
+		idx := strings.LastIndexByte(unitSuffix, '=')
+		if idx <= 0 {
+			return nil, fmt.Errorf("invalid unit suffix %q, must be <suffix>=<unit>", unitSuffix)
+		}
+		rule := unitRule{suffix: unitSuffix[:idx], unit: unitSuffix[idx+1:]}
+		if !isStandardUnit(rule.unit) {
+			return nil, fmt.Errorf("invalid unit suffix %q, %q is not a CloudWatch unit", unitSuffix, rule.unit)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// inferUnit returns the unit of the first rule matching the metric name, or defaultUnit if none match.
+func (client *Client) inferUnit(name, defaultUnit string) string {
+	for _, rule := range client.unitRules {
+		if strings.HasSuffix(name, rule.suffix) {
+			return rule.unit
+		}
+	}
+	return defaultUnit
+}
+
+// rateUnit returns the unit of the per second rate of a counter in unit, or None if CloudWatch has no such unit.
+func rateUnit(unit string) string {
+	switch unit {
+	case cloudwatch.StandardUnitCount, cloudwatch.StandardUnitNone:
+		return cloudwatch.StandardUnitCountSecond
+	}
+	if perSecond := unit + "/Second"; isStandardUnit(perSecond) {
+		return perSecond
+	}
+	return cloudwatch.StandardUnitNone
+}
+
 func (client *Client) extractDimensions(tags gostatsd.Tags) (dimensions []*cloudwatch.Dimension) {
 	dimensions = []*cloudwatch.Dimension{}
 
@@ -107,8 +178,6 @@ func (client *Client) extractDimensions(tags gostatsd.Tags) (dimensions []*cloud
 }
 
 func (client *Client) buildMetricData(metrics *gostatsd.MetricMap) (metricData []*cloudwatch.MetricDatum) {
-	disabled := client.disabledSubtypes
-
 	metricData = []*cloudwatch.MetricDatum{}
 	now := time.Now()
 	prefix := ""
@@ -128,8 +197,9 @@ func (client *Client) buildMetricData(metrics *gostatsd.MetricMap) (metricData [
 
 	prefix = "stats.counter."
 	metrics.Counters.Each(func(key, tagsKey string, counter gostatsd.Counter) {
-		addMetricData(key+".count", "Count", float64(counter.Value), counter.Tags)
-		addMetricData(key+".per_second", "Count/Second", counter.PerSecond, counter.Tags)
+		unit := client.inferUnit(key, "Count")
+		addMetricData(key+".count", unit, float64(counter.Value), counter.Tags)
+		addMetricData(key+".per_second", rateUnit(unit), counter.PerSecond, counter.Tags)
 	})
 
 	prefix = "stats.timers."
@@ -144,11 +214,13 @@ func (client *Client) buildMetricData(metrics *gostatsd.MetricMap) (metricData [
 				addMetricData(key+".histogram", "Count", float64(count), newTags)
 			}
 		} else {
+			disabled := timer.EffectiveDisabledSubtypes(client.disabledSubtypes)
+			unit := client.inferUnit(key, client.timerUnit)
 			if !disabled.Lower {
-				addMetricData(key+".lower", "Milliseconds", timer.Min, timer.Tags)
+				addMetricData(key+".lower", unit, timer.Min, timer.Tags)
 			}
 			if !disabled.Upper {
-				addMetricData(key+".upper", "Milliseconds", timer.Max, timer.Tags)
+				addMetricData(key+".upper", unit, timer.Max, timer.Tags)
 			}
 			if !disabled.Count {
 				addMetricData(key+".count", "Count", float64(timer.Count), timer.Tags)
@@ -157,29 +229,29 @@ func (client *Client) buildMetricData(metrics *gostatsd.MetricMap) (metricData [
 				addMetricData(key+".count_ps", "Count/Second", timer.PerSecond, timer.Tags)
 			}
 			if !disabled.Mean {
-				addMetricData(key+".mean", "Milliseconds", timer.Mean, timer.Tags)
+				addMetricData(key+".mean", unit, timer.Mean, timer.Tags)
 			}
 			if !disabled.Median {
-				addMetricData(key+".median", "Milliseconds", timer.Median, timer.Tags)
+				addMetricData(key+".median", unit, timer.Median, timer.Tags)
 			}
 			if !disabled.StdDev {
-				addMetricData(key+".std", "Milliseconds", timer.StdDev, timer.Tags)
+				addMetricData(key+".std", unit, timer.StdDev, timer.Tags)
 			}
 			if !disabled.Sum {
-				addMetricData(key+".sum", "Milliseconds", timer.Sum, timer.Tags)
+				addMetricData(key+".sum", unit, timer.Sum, timer.Tags)
 			}
 			if !disabled.SumSquares {
-				addMetricData(key+".sum_squares", "Milliseconds", timer.SumSquares, timer.Tags)
+				addMetricData(key+".sum_squares", unit, timer.SumSquares, timer.Tags)
 			}
 			for _, pct := range timer.Percentiles {
-				addMetricData(key+"."+pct.Str, "Milliseconds", pct.Float, timer.Tags)
+				addMetricData(key+"."+pct.Str, unit, pct.Float, timer.Tags)
 			}
 		}
 	})
 
 	prefix = "stats.gauge."
 	metrics.Gauges.Each(func(key, tagsKey string, gauge gostatsd.Gauge) {
-		addMetricData(key, "None", gauge.Value, gauge.Tags)
+		addMetricData(key, client.inferUnit(key, "None"), gauge.Value, gauge.Tags)
 	})
 
 	prefix = "stats.set."
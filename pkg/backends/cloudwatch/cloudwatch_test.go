@@ -30,7 +30,7 @@ func TestSendMetrics(t *testing.T) {
 	t.Parallel()
 
 	p := transport.NewTransportPool(logrus.New(), viper.New())
-	cli, err := NewClient("ns", "default", gostatsd.TimerSubtypes{}, logrus.New(), p)
+	cli, err := NewClient("ns", "default", nil, "Milliseconds", gostatsd.TimerSubtypes{}, logrus.New(), p)
 	require.NoError(t, err)
 
 	expected := []struct {
@@ -87,7 +87,7 @@ func TestSendMetricDimensions(t *testing.T) {
 	t.Parallel()
 
 	p := transport.NewTransportPool(logrus.New(), viper.New())
-	cli, err := NewClient("ns", "default", gostatsd.TimerSubtypes{}, logrus.New(), p)
+	cli, err := NewClient("ns", "default", nil, "Milliseconds", gostatsd.TimerSubtypes{}, logrus.New(), p)
 	require.NoError(t, err)
 
 	metricMap := &gostatsd.MetricMap{
@@ -193,7 +193,7 @@ func TestSendHistogram(t *testing.T) {
 	t.Parallel()
 
 	p := transport.NewTransportPool(logrus.New(), viper.New())
-	cli, err := NewClient("ns", "default", gostatsd.TimerSubtypes{}, logrus.New(), p)
+	cli, err := NewClient("ns", "default", nil, "Milliseconds", gostatsd.TimerSubtypes{}, logrus.New(), p)
 	require.NoError(t, err)
 
 	metricMap := &gostatsd.MetricMap{
@@ -254,3 +254,66 @@ func findMetricDatum(input *cloudwatch.PutMetricDataInput, name string, dimenens
 	}
 	return nil
 }
+
+func TestInferUnits(t *testing.T) {
+	t.Parallel()
+
+	p := transport.NewTransportPool(logrus.New(), viper.New())
+	cli, err := NewClient("ns", "default", []string{
+		"_milliseconds=Milliseconds",
+		"_seconds=Seconds",
+		"_bytes=Bytes",
+		"_ms=Milliseconds",
+		"_pct=Percent",
+		"_requests_ms=Count", // Never used, the earlier _ms rule matches first
+	}, "Microseconds", gostatsd.TimerSubtypes{}, logrus.New(), p)
+	require.NoError(t, err)
+
+	mm := gostatsd.NewMetricMap()
+	for _, name := range []string{"uptime_seconds", "heap_bytes", "cpu_pct", "gc_pause_milliseconds", "lag_requests_ms", "queue"} {
+		mm.Gauges[name] = map[string]gostatsd.Gauge{"": {Value: 1}}
+	}
+	for _, name := range []string{"sent_bytes", "busy_seconds", "requests"} {
+		mm.Counters[name] = map[string]gostatsd.Counter{"": {Value: 1, PerSecond: 1}}
+	}
+	mm.Timers["latency_seconds"] = map[string]gostatsd.Timer{"": {Count: 1}}
+	mm.Timers["latency"] = map[string]gostatsd.Timer{"": {Count: 1}}
+
+	units := map[string]string{}
+	for _, datum := range cli.buildMetricData(mm) {
+		units[*datum.MetricName] = *datum.Unit
+	}
+	expected := map[string]string{
+		"stats.gauge.uptime_seconds":            "Seconds",
+		"stats.gauge.heap_bytes":                "Bytes",
+		"stats.gauge.cpu_pct":                   "Percent",
+		"stats.gauge.gc_pause_milliseconds":     "Milliseconds",
+		"stats.gauge.lag_requests_ms":           "Milliseconds",
+		"stats.gauge.queue":                     "None",
+		"stats.counter.sent_bytes.count":        "Bytes",
+		"stats.counter.sent_bytes.per_second":   "Bytes/Second",
+		"stats.counter.busy_seconds.count":      "Seconds",
+		"stats.counter.busy_seconds.per_second": "None",
+		"stats.counter.requests.count":          "Count",
+		"stats.counter.requests.per_second":     "Count/Second",
+		"stats.timers.latency_seconds.mean":     "Seconds",
+		"stats.timers.latency_seconds.count":    "Count",
+		"stats.timers.latency.upper":            "Microseconds",
+		"stats.timers.latency.count_ps":         "Count/Second",
+	}
+	for name, unit := range expected {
+		assert.Equal(t, unit, units[name], name)
+	}
+}
+
+func TestInvalidUnitSuffixes(t *testing.T) {
+	t.Parallel()
+
+	p := transport.NewTransportPool(logrus.New(), viper.New())
+	for _, unitSuffix := range []string{"_bytes", "=Bytes", "_bytes=bytes", "_seconds=Seconds/Second"} {
+		_, err := NewClient("ns", "default", []string{unitSuffix}, "Milliseconds", gostatsd.TimerSubtypes{}, logrus.New(), p)
+		assert.Error(t, err, unitSuffix)
+	}
+	_, err := NewClient("ns", "default", nil, "ms", gostatsd.TimerSubtypes{}, logrus.New(), p)
+	assert.Error(t, err)
+}
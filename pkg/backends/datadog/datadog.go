@@ -67,6 +67,7 @@ type Client struct {
 	apiEndpoint           string
 	userAgent             string
 	maxRequestElapsedTime time.Duration
+	retryClassifier       *transport.RetryClassifier
 	client                *http.Client
 	metricsPerBatch       uint
 	metricsBufferSem      chan *bytes.Buffer // Two in one - a semaphore and a buffer pool
@@ -184,32 +185,32 @@ func (d *Client) processMetrics(now float64, metrics *gostatsd.MetricMap, cb fun
 				fl.addMetricf(counter, float64(count), timer.Source, newTags, "%s.histogram", key)
 			}
 		} else {
-
-			if !d.disabledSubtypes.Lower {
+			disabled := timer.EffectiveDisabledSubtypes(d.disabledSubtypes)
+			if !disabled.Lower {
 				fl.addMetricf(gauge, timer.Min, timer.Source, timer.Tags, "%s.lower", key)
 			}
-			if !d.disabledSubtypes.Upper {
+			if !disabled.Upper {
 				fl.addMetricf(gauge, timer.Max, timer.Source, timer.Tags, "%s.upper", key)
 			}
-			if !d.disabledSubtypes.Count {
+			if !disabled.Count {
 				fl.addMetricf(gauge, float64(timer.Count), timer.Source, timer.Tags, "%s.count", key)
 			}
-			if !d.disabledSubtypes.CountPerSecond {
+			if !disabled.CountPerSecond {
 				fl.addMetricf(rate, timer.PerSecond, timer.Source, timer.Tags, "%s.count_ps", key)
 			}
-			if !d.disabledSubtypes.Mean {
+			if !disabled.Mean {
 				fl.addMetricf(gauge, timer.Mean, timer.Source, timer.Tags, "%s.mean", key)
 			}
-			if !d.disabledSubtypes.Median {
+			if !disabled.Median {
 				fl.addMetricf(gauge, timer.Median, timer.Source, timer.Tags, "%s.median", key)
 			}
-			if !d.disabledSubtypes.StdDev {
+			if !disabled.StdDev {
 				fl.addMetricf(gauge, timer.StdDev, timer.Source, timer.Tags, "%s.std", key)
 			}
-			if !d.disabledSubtypes.Sum {
+			if !disabled.Sum {
 				fl.addMetricf(gauge, timer.Sum, timer.Source, timer.Tags, "%s.sum", key)
 			}
-			if !d.disabledSubtypes.SumSquares {
+			if !disabled.SumSquares {
 				fl.addMetricf(gauge, timer.SumSquares, timer.Source, timer.Tags, "%s.sum_squares", key)
 			}
 			for _, pct := range timer.Percentiles {
@@ -287,6 +288,15 @@ func (d *Client) post(ctx context.Context, buffer *bytes.Buffer, path, typeOfPos
 			return nil
 		}
 
+		if d.retryClassifier.IsFatal(err) {
+			atomic.AddUint64(&d.batchesDropped, 1)
+			d.logger.WithFields(logrus.Fields{
+				"type":  typeOfPost,
+				"error": err,
+			}).Error("failed to send, not retrying")
+			return fmt.Errorf("[%s] %v", BackendName, err)
+		}
+
 		next := b.NextBackOff()
 		if next == backoff.Stop {
 			atomic.AddUint64(&d.batchesDropped, 1)
@@ -362,7 +372,7 @@ func (d *Client) constructPost(ctx context.Context, buffer *bytes.Buffer, path,
 				"status": resp.StatusCode,
 				"body":   string(b),
 			}).Info("request failed")
-			return fmt.Errorf("received bad status code %d", resp.StatusCode)
+			return &transport.StatusError{StatusCode: resp.StatusCode}
 		}
 		_, _ = io.Copy(ioutil.Discard, body)
 		return nil
@@ -386,6 +396,12 @@ func NewClientFromViper(v *viper.Viper, logger logrus.FieldLogger, pool *transpo
 	dd.SetDefault("max_requests", defaultMaxRequests)
 	dd.SetDefault("user-agent", defaultUserAgent)
 	dd.SetDefault("transport", "default")
+	dd.SetDefault("fatal-status-codes", transport.DefaultFatalStatusCodes)
+
+	retryClassifier, err := transport.NewRetryClassifier(dd.GetIntSlice("fatal-status-codes"))
+	if err != nil {
+		return nil, fmt.Errorf("[%s] %v", BackendName, err)
+	}
 
 	return NewClient(
 		dd.GetString("api_endpoint"),
@@ -397,13 +413,14 @@ func NewClientFromViper(v *viper.Viper, logger logrus.FieldLogger, pool *transpo
 		dd.GetBool("compress_payload"),
 		dd.GetDuration("max_request_elapsed_time"),
 		v.GetDuration("flush-interval"), // Main viper, not sub-viper
+		retryClassifier,
 		gostatsd.DisabledSubMetrics(v),
 		logger,
 		pool,
 	)
 }
 
-// NewClient returns a new Datadog API client.
+// NewClient returns a new Datadog API client.  Errors classified as fatal by retryClassifier are not retried.
 func NewClient(
 	apiEndpoint,
 	apiKey,
@@ -414,6 +431,7 @@ func NewClient(
 	compressPayload bool,
 	maxRequestElapsedTime,
 	flushInterval time.Duration,
+	retryClassifier *transport.RetryClassifier,
 	disabled gostatsd.TimerSubtypes,
 	logger logrus.FieldLogger,
 	pool *transport.TransportPool,
@@ -460,6 +478,7 @@ func NewClient(
 		apiEndpoint:           apiEndpoint,
 		userAgent:             userAgent,
 		maxRequestElapsedTime: maxRequestElapsedTime,
+		retryClassifier:       retryClassifier,
 		client:                httpClient.Client,
 		metricsPerBatch:       uint(metricsPerBatch),
 		metricsBufferSem:      metricsBufferSem,
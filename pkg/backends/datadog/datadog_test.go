@@ -57,7 +57,7 @@ func TestRetries(t *testing.T) {
 	v := viper.New()
 	v.Set("transport.default.client-timeout", 1*time.Second)
 	p := transport.NewTransportPool(logrus.New(), v)
-	client, err := NewClient(ts.URL, "apiKey123", "agent", "default", defaultMetricsPerBatch, defaultMaxRequests, true, 2*time.Second, 1*time.Second, gostatsd.TimerSubtypes{}, logrus.New(), p)
+	client, err := NewClient(ts.URL, "apiKey123", "agent", "default", defaultMetricsPerBatch, defaultMaxRequests, true, 2*time.Second, 1*time.Second, nil, gostatsd.TimerSubtypes{}, logrus.New(), p)
 	require.NoError(t, err)
 	res := make(chan []error, 1)
 	clck := clock.NewMock(time.Unix(0, 0))
@@ -75,6 +75,66 @@ func TestRetries(t *testing.T) {
 	ch <- struct{}{}
 }
 
+func TestRetryClassification(t *testing.T) {
+	t.Parallel()
+	for status, expectedRequests := range map[int]uint32{
+		http.StatusUnauthorized:       1, // Fatal, not retried
+		http.StatusForbidden:          1,
+		http.StatusServiceUnavailable: 2, // Retryable
+		http.StatusTooManyRequests:    2,
+	} {
+		var requestNum uint32
+		mux := http.NewServeMux()
+		mux.HandleFunc("/api/v1/series", func(w http.ResponseWriter, r *http.Request) {
+			defer r.Body.Close()
+			if atomic.AddUint32(&requestNum, 1) == 1 {
+				w.WriteHeader(status)
+			}
+		})
+		ts := httptest.NewServer(mux)
+
+		v := viper.New()
+		v.Set("transport.default.client-timeout", 1*time.Second)
+		p := transport.NewTransportPool(logrus.New(), v)
+		rc, err := transport.NewRetryClassifier(transport.DefaultFatalStatusCodes)
+		require.NoError(t, err)
+		client, err := NewClient(ts.URL, "apiKey123", "agent", "default", defaultMetricsPerBatch, defaultMaxRequests, true, 2*time.Second, 1*time.Second, rc, gostatsd.TimerSubtypes{}, logrus.New(), p)
+		require.NoError(t, err)
+		res := make(chan []error, 1)
+		clck := clock.NewMock(time.Unix(0, 0))
+		ctx := clock.Context(context.Background(), clck)
+		ch := make(chan struct{})
+		go advanceTime(clck, ch)
+		client.SendMetricsAsync(ctx, twoCounters(), func(errs []error) {
+			res <- errs
+		})
+		errs := <-res
+		ch <- struct{}{}
+		ts.Close()
+
+		require.Len(t, errs, 1, status)
+		if expectedRequests == 1 {
+			assert.Error(t, errs[0], status)
+			assert.EqualValues(t, 1, atomic.LoadUint64(&client.batchesDropped), status)
+		} else {
+			assert.NoError(t, errs[0], status)
+		}
+		assert.EqualValues(t, expectedRequests, atomic.LoadUint32(&requestNum), status)
+	}
+}
+
+func TestFatalStatusCodesFromViper(t *testing.T) {
+	t.Parallel()
+	v := viper.New()
+	v.Set("datadog.api_key", "apiKey123")
+	v.Set("datadog.fatal-status-codes", []int{500})
+	backend, err := NewClientFromViper(v, logrus.New(), transport.NewTransportPool(logrus.New(), v))
+	require.NoError(t, err)
+	client := backend.(*Client)
+	assert.True(t, client.retryClassifier.IsFatal(&transport.StatusError{StatusCode: http.StatusInternalServerError}))
+	assert.False(t, client.retryClassifier.IsFatal(&transport.StatusError{StatusCode: http.StatusUnauthorized}))
+}
+
 func TestSendMetricsInMultipleBatches(t *testing.T) {
 	t.Parallel()
 	var requestNum uint32
@@ -94,7 +154,7 @@ func TestSendMetricsInMultipleBatches(t *testing.T) {
 	v := viper.New()
 	v.Set("transport.default.client-timeout", 1*time.Second)
 	p := transport.NewTransportPool(logrus.New(), v)
-	client, err := NewClient(ts.URL, "apiKey123", "agent", "default", 1, defaultMaxRequests, true, 2*time.Second, 1*time.Second, gostatsd.TimerSubtypes{}, logrus.New(), p)
+	client, err := NewClient(ts.URL, "apiKey123", "agent", "default", 1, defaultMaxRequests, true, 2*time.Second, 1*time.Second, nil, gostatsd.TimerSubtypes{}, logrus.New(), p)
 	require.NoError(t, err)
 	res := make(chan []error, 1)
 	client.SendMetricsAsync(context.Background(), twoCounters(), func(errs []error) {
@@ -147,7 +207,7 @@ func TestSendMetrics(t *testing.T) {
 	v := viper.New()
 	v.Set("transport.default.client-timeout", 1*time.Second)
 	p := transport.NewTransportPool(logrus.New(), v)
-	cli, err := NewClient(ts.URL, "apiKey123", "agent", "default", 1000, defaultMaxRequests, true, 2*time.Second, 1100*time.Millisecond, gostatsd.TimerSubtypes{}, logrus.New(), p)
+	cli, err := NewClient(ts.URL, "apiKey123", "agent", "default", 1000, defaultMaxRequests, true, 2*time.Second, 1100*time.Millisecond, nil, gostatsd.TimerSubtypes{}, logrus.New(), p)
 	require.NoError(t, err)
 
 	c := clock.NewMock(time.Unix(100, 0))
@@ -265,7 +325,7 @@ func TestSendHistogram(t *testing.T) {
 	v := viper.New()
 	v.Set("transport.default.client-timeout", 1*time.Second)
 	p := transport.NewTransportPool(logrus.New(), v)
-	client, err := NewClient(ts.URL, "apiKey123", "agent", "default", 1000, defaultMaxRequests, true, 2*time.Second, 1100*time.Millisecond, gostatsd.TimerSubtypes{}, logrus.New(), p)
+	client, err := NewClient(ts.URL, "apiKey123", "agent", "default", 1000, defaultMaxRequests, true, 2*time.Second, 1100*time.Millisecond, nil, gostatsd.TimerSubtypes{}, logrus.New(), p)
 	require.NoError(t, err)
 	ctx := clock.Context(context.Background(), clock.NewMock(time.Unix(100, 0)))
 	res := make(chan []error, 1)
@@ -0,0 +1,209 @@
+// Package descriptors creates the metric descriptors of backends which need a descriptor to exist before a metric
+// can be written.  Descriptors are created the first time a metric is written, and remembered so they aren't created
+// again.
+package descriptors
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrAlreadyExists is returned by a Creator, optionally wrapped, if the descriptor already exists.  This happens when
+// another server creates it first, or the cache has evicted it, and is treated as a successful creation.
+var ErrAlreadyExists = errors.New("descriptor already exists")
+
+// Descriptor describes a metric.  Descriptors are identified by the Name and Kind.  A descriptor which is ensured
+// with labels it wasn't created with is created again with the union of the labels, which adds the new labels to it.
+type Descriptor struct {
+	Name   string   // The name of the metric, as the backend names it
+	Kind   string   // The kind of the metric, such as GAUGE, as the backend names it
+	Labels []string // The label keys of the metric
+}
+
+// Creator creates descriptors in a backend.
+type Creator interface {
+	// CreateDescriptor creates the descriptor, or returns ErrAlreadyExists if it already exists.
+	CreateDescriptor(ctx context.Context, d Descriptor) error
+}
+
+type key struct {
+	name string
+	kind string
+}
+
+// entry is a descriptor known to exist, with the labels it was created with.
+type entry struct {
+	key    key
+	labels []string // Sorted
+}
+
+// creation is a creation of a descriptor which is in progress, which every caller of Ensure for the descriptor waits
+// for, so a descriptor is only created once at a time.
+type creation struct {
+	done chan struct{}
+	err  error
+}
+
+// Cache remembers the descriptors which exist, and creates the descriptors which aren't known to exist with a
+// Creator.  It holds at most maxSize descriptors, evicting the least recently used.  A descriptor which failed to be
+// created is not remembered, so it's created again the next time it's needed.
+type Cache struct {
+	created uint64 // Accumulated number of descriptors created
+	existed uint64 // Accumulated number of descriptors which already existed when created
+	failed  uint64 // Accumulated number of descriptors which failed to be created
+	evicted uint64 // Accumulated number of descriptors evicted from the cache
+
+	creator Creator
+	maxSize int
+
+	mu        sync.Mutex
+	entries   map[key]*list.Element // Values of the elements are *entry
+	lru       *list.List            // Most recently used first
+	creations map[key]*creation
+}
+
+// NewCache creates a new Cache of at most maxSize descriptors, which creates descriptors with creator.
+func NewCache(creator Creator, maxSize int) (*Cache, error) {
+	if maxSize <= 0 {
+		return nil, fmt.Errorf("maxSize must be positive")
+	}
+	return &Cache{
+		creator:   creator,
+		maxSize:   maxSize,
+		entries:   map[key]*list.Element{},
+		lru:       list.New(),
+		creations: map[key]*creation{},
+	}, nil
+}
+
+// Ensure returns nil once the descriptor exists with at least the labels of d, creating it if it's not known to exist,
+// or creating it again with the union of its labels and the labels of d if it's known to exist without some of them.
+// If the descriptor is already being created, it waits for that creation first.
+func (c *Cache) Ensure(ctx context.Context, d Descriptor) error {
+	k := key{name: d.Name, kind: d.Kind}
+	for {
+		c.mu.Lock()
+		e, known := c.entries[k]
+		if known {
+			c.lru.MoveToFront(e)
+			if hasLabels(e.Value.(*entry).labels, d.Labels) {
+				c.mu.Unlock()
+				return nil
+			}
+		}
+		if cr, inProgress := c.creations[k]; inProgress {
+			c.mu.Unlock()
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-cr.done:
+				if cr.err != nil {
+					return cr.err
+				}
+			}
+			// The descriptor created may not have every label of d
+			continue
+		}
+		labels := d.Labels
+		if known {
+			labels = unionLabels(e.Value.(*entry).labels, d.Labels)
+		}
+		cr := &creation{done: make(chan struct{})}
+		c.creations[k] = cr
+		c.mu.Unlock()
+
+		return c.create(ctx, k, cr, Descriptor{Name: d.Name, Kind: d.Kind, Labels: labels})
+	}
+}
+
+// create creates d with the Creator, and remembers it with its labels if it was created.
+func (c *Cache) create(ctx context.Context, k key, cr *creation, d Descriptor) error {
+	err := c.creator.CreateDescriptor(ctx, d)
+	switch {
+	case err == nil:
+		atomic.AddUint64(&c.created, 1)
+	case errors.Is(err, ErrAlreadyExists):
+		atomic.AddUint64(&c.existed, 1)
+		err = nil
+	default:
+		atomic.AddUint64(&c.failed, 1)
+	}
+
+	c.mu.Lock()
+	delete(c.creations, k)
+	if err == nil {
+		c.add(k, sortedLabels(d.Labels))
+	}
+	c.mu.Unlock()
+	cr.err = err
+	close(cr.done)
+	return err
+}
+
+// add adds k with labels as the most recently used descriptor, evicting the least recently used if the cache is full.
+// Must be called with mu held.
+func (c *Cache) add(k key, labels []string) {
+	if e, ok := c.entries[k]; ok {
+		e.Value.(*entry).labels = labels
+		c.lru.MoveToFront(e)
+		return
+	}
+	c.entries[k] = c.lru.PushFront(&entry{key: k, labels: labels})
+	for c.lru.Len() > c.maxSize {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*entry).key)
+		atomic.AddUint64(&c.evicted, 1)
+	}
+}
+
+// hasLabels returns true if every label of want is in the sorted labels of have.
+func hasLabels(have, want []string) bool {
+	for _, label := range want {
+		i := sort.SearchStrings(have, label)
+		if i == len(have) || have[i] != label {
+			return false
+		}
+	}
+	return true
+}
+
+// unionLabels returns the sorted union of the labels of have and want.
+func unionLabels(have, want []string) []string {
+	union := make([]string, 0, len(have)+len(want))
+	union = append(union, have...)
+	return sortedLabels(append(union, want...))
+}
+
+// sortedLabels returns a sorted copy of labels, without duplicates.
+func sortedLabels(labels []string) []string {
+	sorted := make([]string, 0, len(labels))
+	sorted = append(sorted, labels...)
+	sort.Strings(sorted)
+	n := 0
+	for i, label := range sorted {
+		if i == 0 || label != sorted[n-1] {
+			sorted[n] = label
+			n++
+		}
+	}
+	return sorted[:n]
+}
+
+// Len returns the number of descriptors in the cache.
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+// Stats returns the accumulated number of descriptors created, which already existed, which failed to be created,
+// and which were evicted from the cache.
+func (c *Cache) Stats() (created, existed, failed, evicted uint64) {
+	return atomic.LoadUint64(&c.created), atomic.LoadUint64(&c.existed), atomic.LoadUint64(&c.failed), atomic.LoadUint64(&c.evicted)
+}
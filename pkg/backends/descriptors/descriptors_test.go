@@ -0,0 +1,187 @@
+package descriptors
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeCreator creates descriptors in memory, and returns ErrAlreadyExists for descriptors which already exist.
+type fakeCreator struct {
+	mu       sync.Mutex
+	existing map[string]Descriptor
+	calls    int
+	err      error         // Returned by every call if set
+	block    chan struct{} // Blocks every call until it's closed if set
+}
+
+func (fc *fakeCreator) CreateDescriptor(ctx context.Context, d Descriptor) error {
+	if fc.block != nil {
+		<-fc.block
+	}
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.calls++
+	if fc.err != nil {
+		return fc.err
+	}
+	// Like Cloud Monitoring, creating a descriptor again with new labels adds them
+	if existing, ok := fc.existing[d.Name+"/"+d.Kind]; ok && hasLabels(existing.Labels, d.Labels) {
+		return fmt.Errorf("[backend] %w", ErrAlreadyExists)
+	}
+	fc.existing[d.Name+"/"+d.Kind] = d
+	return nil
+}
+
+func (fc *fakeCreator) getCalls() int {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	return fc.calls
+}
+
+func TestCacheCreatesLazily(t *testing.T) {
+	t.Parallel()
+	fc := &fakeCreator{existing: map[string]Descriptor{}}
+	c, err := NewCache(fc, 10)
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	d := Descriptor{Name: "requests", Kind: "GAUGE", Labels: []string{"host"}}
+	require.NoError(t, c.Ensure(ctx, d))
+	require.NoError(t, c.Ensure(ctx, d))
+	// The labels are not part of the identity, a subset of the labels is already described
+	require.NoError(t, c.Ensure(ctx, Descriptor{Name: "requests", Kind: "GAUGE"}))
+	assert.Equal(t, 1, fc.calls)
+	assert.Equal(t, d, fc.existing["requests/GAUGE"])
+
+	// The same name with another kind is another descriptor
+	require.NoError(t, c.Ensure(ctx, Descriptor{Name: "requests", Kind: "CUMULATIVE"}))
+	assert.Equal(t, 2, fc.calls)
+	assert.Equal(t, 2, c.Len())
+
+	created, existed, failed, evicted := c.Stats()
+	assert.EqualValues(t, 2, created)
+	assert.Zero(t, existed)
+	assert.Zero(t, failed)
+	assert.Zero(t, evicted)
+}
+
+func TestCacheAddsLabels(t *testing.T) {
+	t.Parallel()
+	fc := &fakeCreator{existing: map[string]Descriptor{}}
+	c, err := NewCache(fc, 10)
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	require.NoError(t, c.Ensure(ctx, Descriptor{Name: "requests", Kind: "GAUGE", Labels: []string{"host"}}))
+	// A new label creates the descriptor again with the union of the labels
+	require.NoError(t, c.Ensure(ctx, Descriptor{Name: "requests", Kind: "GAUGE", Labels: []string{"env", "host"}}))
+	require.NoError(t, c.Ensure(ctx, Descriptor{Name: "requests", Kind: "GAUGE", Labels: []string{"team"}}))
+	assert.Equal(t, 3, fc.calls)
+	assert.Equal(t, []string{"env", "host", "team"}, fc.existing["requests/GAUGE"].Labels)
+
+	// Every label is now described
+	require.NoError(t, c.Ensure(ctx, Descriptor{Name: "requests", Kind: "GAUGE", Labels: []string{"team", "host"}}))
+	assert.Equal(t, 3, fc.calls)
+	assert.Equal(t, 1, c.Len())
+	created, _, _, _ := c.Stats()
+	assert.EqualValues(t, 3, created)
+}
+
+func TestCacheAlreadyExists(t *testing.T) {
+	t.Parallel()
+	// Created by another server
+	fc := &fakeCreator{existing: map[string]Descriptor{"requests/GAUGE": {}}}
+	c, err := NewCache(fc, 10)
+	require.NoError(t, err)
+
+	require.NoError(t, c.Ensure(context.Background(), Descriptor{Name: "requests", Kind: "GAUGE"}))
+	require.NoError(t, c.Ensure(context.Background(), Descriptor{Name: "requests", Kind: "GAUGE"}))
+	assert.Equal(t, 1, fc.calls)
+	created, existed, _, _ := c.Stats()
+	assert.Zero(t, created)
+	assert.EqualValues(t, 1, existed)
+}
+
+func TestCacheFailuresAreNotCached(t *testing.T) {
+	t.Parallel()
+	fc := &fakeCreator{existing: map[string]Descriptor{}, err: errors.New("quota exceeded")}
+	c, err := NewCache(fc, 10)
+	require.NoError(t, err)
+	d := Descriptor{Name: "requests", Kind: "GAUGE"}
+
+	require.Error(t, c.Ensure(context.Background(), d))
+	assert.Zero(t, c.Len())
+
+	fc.mu.Lock()
+	fc.err = nil
+	fc.mu.Unlock()
+	require.NoError(t, c.Ensure(context.Background(), d))
+	assert.Equal(t, 2, fc.calls)
+	_, _, failed, _ := c.Stats()
+	assert.EqualValues(t, 1, failed)
+}
+
+func TestCacheCoalescesCreations(t *testing.T) {
+	t.Parallel()
+	fc := &fakeCreator{existing: map[string]Descriptor{}, block: make(chan struct{})}
+	c, err := NewCache(fc, 10)
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 5)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- c.Ensure(context.Background(), Descriptor{Name: "requests", Kind: "GAUGE"})
+		}()
+	}
+	// Wait for the creation to start, every other call waits for it or finds the descriptor cached
+	require.Eventually(t, func() bool {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return len(c.creations) == 1
+	}, time.Second, time.Millisecond)
+	close(fc.block)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, 1, fc.getCalls())
+}
+
+func TestCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	t.Parallel()
+	fc := &fakeCreator{existing: map[string]Descriptor{}}
+	c, err := NewCache(fc, 2)
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	require.NoError(t, c.Ensure(ctx, Descriptor{Name: "a"}))
+	require.NoError(t, c.Ensure(ctx, Descriptor{Name: "b"}))
+	require.NoError(t, c.Ensure(ctx, Descriptor{Name: "a"})) // b is now the least recently used
+	require.NoError(t, c.Ensure(ctx, Descriptor{Name: "c"}))
+	assert.Equal(t, 2, c.Len())
+	assert.Equal(t, 3, fc.calls)
+
+	// a is still cached, b was evicted and is created again, which finds it already exists
+	require.NoError(t, c.Ensure(ctx, Descriptor{Name: "a"}))
+	assert.Equal(t, 3, fc.calls)
+	require.NoError(t, c.Ensure(ctx, Descriptor{Name: "b"}))
+	assert.Equal(t, 4, fc.calls)
+	created, existed, _, evicted := c.Stats()
+	assert.EqualValues(t, 3, created)
+	assert.EqualValues(t, 1, existed)
+	assert.EqualValues(t, 2, evicted)
+
+	_, err = NewCache(fc, 0)
+	require.Error(t, err)
+}
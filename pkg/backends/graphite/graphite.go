@@ -2,6 +2,7 @@ package graphite
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
 	"fmt"
 	"math"
@@ -44,6 +45,8 @@ const (
 	DefaultGlobalSuffix = ""
 	// DefaultMode controls whether to use legacy namespace, no tags, or tags
 	DefaultMode = "tags"
+	// DefaultCompress is the default for whether the payload of each flush is compressed with gzip.
+	DefaultCompress = false
 )
 
 const (
@@ -68,6 +71,8 @@ type Client struct {
 	globalSuffix     string
 	legacyNamespace  bool
 	enableTags       bool
+	compress         bool      // gzip the payload of each flush, for servers which decompress their input
+	gzipPool         sync.Pool // Reusable *gzip.Writer, as each allocates its compression state
 	disabledSubtypes gostatsd.TimerSubtypes
 }
 
@@ -78,6 +83,9 @@ func (client *Client) Run(ctx context.Context) {
 // SendMetricsAsync flushes the metrics to the Graphite server, preparing payload synchronously but doing the send asynchronously.
 func (client *Client) SendMetricsAsync(ctx context.Context, metrics *gostatsd.MetricMap, cb gostatsd.SendCallback) {
 	buf := client.preparePayload(metrics, time.Now())
+	if client.compress {
+		buf = client.compressPayload(buf)
+	}
 	sink := make(chan *bytes.Buffer, 1)
 	sink <- buf
 	close(sink)
@@ -89,6 +97,20 @@ func (client *Client) SendMetricsAsync(ctx context.Context, metrics *gostatsd.Me
 	}
 }
 
+// compressPayload returns a buffer with buf compressed as a complete gzip stream, and returns buf to the pool.  Each
+// flush is written to the connection as its own gzip member, so the server sees a multistream gzip input.
+func (client *Client) compressPayload(buf *bytes.Buffer) *bytes.Buffer {
+	compressed := client.sender.GetBuffer()
+	gz := client.gzipPool.Get().(*gzip.Writer)
+	gz.Reset(compressed)
+	// Writes to a bytes.Buffer never fail
+	_, _ = gz.Write(buf.Bytes())
+	_ = gz.Close()
+	client.gzipPool.Put(gz)
+	client.sender.PutBuffer(buf)
+	return compressed
+}
+
 // normalizeMetricName will:
 // - Replace:
 // -- whitespace with "_"
@@ -171,31 +193,32 @@ func (client *Client) preparePayload(metrics *gostatsd.MetricMap, ts time.Time)
 				_, _ = fmt.Fprintf(buf, "%s %d %d\n", client.prepareName(client.counterNamespace, key, "histogram", timer.Source, newTags), count, now)
 			}
 		} else {
-			if !client.disabledSubtypes.Lower {
+			disabled := timer.EffectiveDisabledSubtypes(client.disabledSubtypes)
+			if !disabled.Lower {
 				_, _ = fmt.Fprintf(buf, "%s %f %d\n", client.prepareName(client.timerNamespace, key, "lower", timer.Source, timer.Tags), timer.Min, now)
 			}
-			if !client.disabledSubtypes.Upper {
+			if !disabled.Upper {
 				_, _ = fmt.Fprintf(buf, "%s %f %d\n", client.prepareName(client.timerNamespace, key, "upper", timer.Source, timer.Tags), timer.Max, now)
 			}
-			if !client.disabledSubtypes.Count {
+			if !disabled.Count {
 				_, _ = fmt.Fprintf(buf, "%s %d %d\n", client.prepareName(client.timerNamespace, key, "count", timer.Source, timer.Tags), timer.Count, now)
 			}
-			if !client.disabledSubtypes.CountPerSecond {
+			if !disabled.CountPerSecond {
 				_, _ = fmt.Fprintf(buf, "%s %f %d\n", client.prepareName(client.timerNamespace, key, "count_ps", timer.Source, timer.Tags), timer.PerSecond, now)
 			}
-			if !client.disabledSubtypes.Mean {
+			if !disabled.Mean {
 				_, _ = fmt.Fprintf(buf, "%s %f %d\n", client.prepareName(client.timerNamespace, key, "mean", timer.Source, timer.Tags), timer.Mean, now)
 			}
-			if !client.disabledSubtypes.Median {
+			if !disabled.Median {
 				_, _ = fmt.Fprintf(buf, "%s %f %d\n", client.prepareName(client.timerNamespace, key, "median", timer.Source, timer.Tags), timer.Median, now)
 			}
-			if !client.disabledSubtypes.StdDev {
+			if !disabled.StdDev {
 				_, _ = fmt.Fprintf(buf, "%s %f %d\n", client.prepareName(client.timerNamespace, key, "std", timer.Source, timer.Tags), timer.StdDev, now)
 			}
-			if !client.disabledSubtypes.Sum {
+			if !disabled.Sum {
 				_, _ = fmt.Fprintf(buf, "%s %f %d\n", client.prepareName(client.timerNamespace, key, "sum", timer.Source, timer.Tags), timer.Sum, now)
 			}
-			if !client.disabledSubtypes.SumSquares {
+			if !disabled.SumSquares {
 				_, _ = fmt.Fprintf(buf, "%s %f %d\n", client.prepareName(client.timerNamespace, key, "sum_squares", timer.Source, timer.Tags), timer.SumSquares, now)
 			}
 			for _, pct := range timer.Percentiles {
@@ -235,6 +258,7 @@ func NewClientFromViper(v *viper.Viper, logger logrus.FieldLogger, pool *transpo
 	g.SetDefault("prefix_set", DefaultPrefixSet)
 	g.SetDefault("global_suffix", DefaultGlobalSuffix)
 	g.SetDefault("mode", DefaultMode)
+	g.SetDefault("compress", DefaultCompress)
 	return NewClient(
 		g.GetString("address"),
 		g.GetDuration("dial_timeout"),
@@ -246,6 +270,7 @@ func NewClientFromViper(v *viper.Viper, logger logrus.FieldLogger, pool *transpo
 		g.GetString("prefix_set"),
 		g.GetString("global_suffix"),
 		g.GetString("mode"),
+		g.GetBool("compress"),
 		gostatsd.DisabledSubMetrics(v),
 		logger,
 	)
@@ -263,6 +288,7 @@ func NewClient(
 	prefixSet string,
 	globalSuffix string,
 	mode string,
+	compress bool,
 	disabled gostatsd.TimerSubtypes,
 	logger logrus.FieldLogger,
 ) (*Client, error) {
@@ -323,6 +349,7 @@ func NewClient(
 		"sets-namespace":    setsNamespace,
 		"global-suffix":     globalSuffix,
 		"mode":              mode,
+		"compress":          compress,
 	}).Info("created backend")
 
 	return &Client{
@@ -348,6 +375,12 @@ func NewClient(
 		globalSuffix:     globalSuffix,
 		legacyNamespace:  legacyNamespace,
 		enableTags:       enableTags,
+		compress:         compress,
+		gzipPool: sync.Pool{
+			New: func() interface{} {
+				return gzip.NewWriter(nil)
+			},
+		},
 		disabledSubtypes: disabled,
 	}, nil
 }
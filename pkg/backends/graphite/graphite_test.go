@@ -1,6 +1,8 @@
 package graphite
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
 	"io"
 	"math"
@@ -42,7 +44,7 @@ func TestPreparePayloadLegacy(t *testing.T) {
 		"stats.timers.t1.count_90.gs 90.000000 1234\n" +
 		"stats.gauges.g1.gs 3.000000 1234\n" +
 		"stats.sets.users.gs 3 1234\n"
-	cl, err := NewClient("127.0.0.1:9", 1*time.Second, 1*time.Second, "ignored1", "ignored2", "ignored3", "ignored4", "ignored5", "gs", "legacy", gostatsd.TimerSubtypes{}, logrus.New())
+	cl, err := NewClient("127.0.0.1:9", 1*time.Second, 1*time.Second, "ignored1", "ignored2", "ignored3", "ignored4", "ignored5", "gs", "legacy", false, gostatsd.TimerSubtypes{}, logrus.New())
 	require.NoError(t, err)
 	b := cl.preparePayload(metrics, time.Unix(1234, 0))
 	expected = sortLines(expected)
@@ -73,7 +75,7 @@ func TestPreparePayloadBasic(t *testing.T) {
 		"gp.pt.t1.count_90.gs 90.000000 1234\n" +
 		"gp.pg.g1.gs 3.000000 1234\n" +
 		"gp.ps.users.gs 3 1234\n"
-	cl, err := NewClient("127.0.0.1:9", 1*time.Second, 1*time.Second, "gp", "pc", "pt", "pg", "ps", "gs", "basic", gostatsd.TimerSubtypes{}, logrus.New())
+	cl, err := NewClient("127.0.0.1:9", 1*time.Second, 1*time.Second, "gp", "pc", "pt", "pg", "ps", "gs", "basic", false, gostatsd.TimerSubtypes{}, logrus.New())
 	require.NoError(t, err)
 	b := cl.preparePayload(metrics, time.Unix(1234, 0))
 	expected = sortLines(expected)
@@ -104,7 +106,7 @@ func TestPreparePayloadTags(t *testing.T) {
 		"gp.pt.t1.count_90.gs 90.000000 1234\n" +
 		"gp.pg.g1.gs 3.000000 1234\n" +
 		"gp.ps.users.gs 3 1234\n"
-	cl, err := NewClient("127.0.0.1:9", 1*time.Second, 1*time.Second, "gp", "pc", "pt", "pg", "ps", "gs", "tags", gostatsd.TimerSubtypes{}, logrus.New())
+	cl, err := NewClient("127.0.0.1:9", 1*time.Second, 1*time.Second, "gp", "pc", "pt", "pg", "ps", "gs", "tags", false, gostatsd.TimerSubtypes{}, logrus.New())
 	require.NoError(t, err)
 	b := cl.preparePayload(metrics, time.Unix(1234, 0))
 	expected = sortLines(expected)
@@ -123,7 +125,7 @@ func TestPreparePayloadHistogram(t *testing.T) {
 			"gp.pc.t1.histogram.gs;le=60 19 1234\n" +
 			"gp.pc.t1.histogram.gs;le=+Inf 19 1234\n"
 
-	cl, err := NewClient("127.0.0.1:9", 1*time.Second, 1*time.Second, "gp", "pc", "pt", "pg", "ps", "gs", "tags", gostatsd.TimerSubtypes{}, logrus.New())
+	cl, err := NewClient("127.0.0.1:9", 1*time.Second, 1*time.Second, "gp", "pc", "pt", "pg", "ps", "gs", "tags", false, gostatsd.TimerSubtypes{}, logrus.New())
 	require.NoError(t, err)
 	b := cl.preparePayload(metrics, time.Unix(1234, 0))
 	expected = sortLines(expected)
@@ -131,19 +133,62 @@ func TestPreparePayloadHistogram(t *testing.T) {
 	require.Equal(t, expected, actual)
 }
 
+func TestPreparePayloadTimerDisabledSubtypes(t *testing.T) {
+	t.Parallel()
+	metrics := gostatsd.NewMetricMap()
+	timer := gostatsd.Timer{
+		Percentiles: gostatsd.Percentiles{gostatsd.Percentile{Float: 90, Str: "upper_95"}},
+		// Only the percentile is enabled, regardless of the backend settings
+		DisabledSubtypes: &gostatsd.TimerSubtypes{
+			Lower: true, Upper: true, Count: true, CountPerSecond: true, Mean: true,
+			Median: true, StdDev: true, Sum: true, SumSquares: true,
+		},
+	}
+	metrics.Timers["t1"] = map[string]gostatsd.Timer{"": timer}
+	expected := "gp.pt.t1.upper_95.gs 90.000000 1234\n"
+
+	cl, err := NewClient("127.0.0.1:9", 1*time.Second, 1*time.Second, "gp", "pc", "pt", "pg", "ps", "gs", "basic", false, gostatsd.TimerSubtypes{}, logrus.New())
+	require.NoError(t, err)
+	b := cl.preparePayload(metrics, time.Unix(1234, 0))
+	require.Equal(t, expected, b.String())
+}
+
 func sortLines(s string) string {
 	lines := strings.Split(s, "\n")
 	sort.Strings(lines)
 	return strings.Join(lines, "\n")
 }
 
+func TestCompressPayload(t *testing.T) {
+	t.Parallel()
+	cl, err := NewClient("127.0.0.1:9", 1*time.Second, 1*time.Second, "gp", "pc", "pt", "pg", "ps", "gs", "tags", true, gostatsd.TimerSubtypes{}, logrus.New())
+	require.NoError(t, err)
+	expected := cl.preparePayload(metricsWithTags(), time.Unix(1234, 0)).String()
+
+	// Each flush is a gzip member of its own, which are read back as one stream
+	var stream bytes.Buffer
+	for i := 0; i < 2; i++ {
+		buf := cl.sender.GetBuffer()
+		buf.WriteString(expected)
+		compressed := cl.compressPayload(buf)
+		assert.Less(t, compressed.Len(), len(expected))
+		stream.Write(compressed.Bytes())
+		cl.sender.PutBuffer(compressed)
+	}
+	gz, err := gzip.NewReader(&stream)
+	require.NoError(t, err)
+	decompressed, err := io.ReadAll(gz)
+	require.NoError(t, err)
+	assert.Equal(t, expected+expected, string(decompressed))
+}
+
 func TestSendMetricsAsync(t *testing.T) {
 	t.Parallel()
 	l, err := net.Listen("tcp", "localhost:0")
 	require.NoError(t, err)
 	defer l.Close()
 	addr := l.Addr().String()
-	c, err := NewClient(addr, 1*time.Second, 10*time.Second, "", "", "", "", "", "", "basic", gostatsd.TimerSubtypes{}, logrus.New())
+	c, err := NewClient(addr, 1*time.Second, 10*time.Second, "", "", "", "", "", "", "basic", false, gostatsd.TimerSubtypes{}, logrus.New())
 	require.NoError(t, err)
 
 	var acceptWg sync.WaitGroup
@@ -167,31 +167,32 @@ func (f *flush) addSet(name string, tags gostatsd.Tags, value uint64) {
 
 func (f *flush) addBaseTimer(name string, timer gostatsd.Timer) {
 	var sb strings.Builder
-	if !f.disabledSubtypes.Lower {
+	disabled := timer.EffectiveDisabledSubtypes(f.disabledSubtypes)
+	if !disabled.Lower {
 		sb.WriteString(fmt.Sprintf("lower=%g,", timer.Min))
 	}
-	if !f.disabledSubtypes.Upper {
+	if !disabled.Upper {
 		sb.WriteString(fmt.Sprintf("upper=%g,", timer.Max))
 	}
-	if !f.disabledSubtypes.Count {
+	if !disabled.Count {
 		sb.WriteString(fmt.Sprintf("count=%d,", timer.Count))
 	}
-	if !f.disabledSubtypes.CountPerSecond {
+	if !disabled.CountPerSecond {
 		sb.WriteString(fmt.Sprintf("rate=%g,", timer.PerSecond))
 	}
-	if !f.disabledSubtypes.Mean {
+	if !disabled.Mean {
 		sb.WriteString(fmt.Sprintf("mean=%g,", timer.Mean))
 	}
-	if !f.disabledSubtypes.Median {
+	if !disabled.Median {
 		sb.WriteString(fmt.Sprintf("median=%g,", timer.Median))
 	}
-	if !f.disabledSubtypes.StdDev {
+	if !disabled.StdDev {
 		sb.WriteString(fmt.Sprintf("stddev=%g,", timer.StdDev))
 	}
-	if !f.disabledSubtypes.Sum {
+	if !disabled.Sum {
 		sb.WriteString(fmt.Sprintf("sum=%g,", timer.Sum))
 	}
-	if !f.disabledSubtypes.SumSquares {
+	if !disabled.SumSquares {
 		sb.WriteString(fmt.Sprintf("sum_squares=%g,", timer.SumSquares))
 	}
 	for _, pct := range timer.Percentiles {
@@ -41,6 +41,7 @@ const (
 	paramApiEndpoint           = "api-endpoint"
 	paramCompressPayload       = "compress-payload"
 	paramCredentials           = "credentials"
+	paramFatalStatusCodes      = "fatal-status-codes"
 	paramMaxRequestElapsedTime = "max-request-elapsed-time"
 	paramMaxRequests           = "max-requests"
 	paramMetricsPerBatch       = "metrics-per-batch"
@@ -76,6 +77,7 @@ type Client struct {
 	url         string
 
 	maxRequestElapsedTime time.Duration
+	retryClassifier       *transport.RetryClassifier
 	client                *http.Client
 	metricsPerBatch       uint64
 	reqBufferSem          chan *bytes.Buffer // Two in one - a semaphore and a buffer pool
@@ -95,6 +97,7 @@ func NewClientFromViper(
 	influxViper.SetDefault(paramApiEndpoint, "")
 	influxViper.SetDefault(paramCompressPayload, true)
 	influxViper.SetDefault(paramCredentials, "")
+	influxViper.SetDefault(paramFatalStatusCodes, transport.DefaultFatalStatusCodes)
 	influxViper.SetDefault(paramMaxRequestElapsedTime, defaultMaxRequestElapsedTime)
 	influxViper.SetDefault(paramMaxRequests, defaultMaxRequests)
 	influxViper.SetDefault(paramMetricsPerBatch, defaultMetricsPerBatch)
@@ -105,12 +108,18 @@ func NewClientFromViper(
 		return nil, err
 	}
 
+	retryClassifier, err := transport.NewRetryClassifier(influxViper.GetIntSlice(paramFatalStatusCodes))
+	if err != nil {
+		return nil, fmt.Errorf("[%s] %s: %v", BackendName, paramFatalStatusCodes, err)
+	}
+
 	return NewClient(
 		influxViper.GetString(paramApiEndpoint),
 		influxViper.GetBool(paramCompressPayload),
 		influxViper.GetString(paramCredentials),
 		influxViper.GetUint(paramMaxRequests),
 		influxViper.GetDuration(paramMaxRequestElapsedTime),
+		retryClassifier,
 		influxViper.GetUint64(paramMetricsPerBatch),
 		influxViper.GetString(paramTransport),
 		cfg,
@@ -120,13 +129,14 @@ func NewClientFromViper(
 	)
 }
 
-// NewClient returns a new InfluxDB API client.
+// NewClient returns a new InfluxDB API client.  Errors classified as fatal by retryClassifier are not retried.
 func NewClient(
 	apiEndpoint string,
 	compressPayload bool,
 	credentials string,
 	maxRequests uint,
 	maxRequestElapsedTime time.Duration,
+	retryClassifier *transport.RetryClassifier,
 	metricsPerBatch uint64,
 	transport string,
 	cfg config,
@@ -193,6 +203,7 @@ func NewClient(
 		compressPayload:       compressPayload,
 		credentials:           credentials,
 		maxRequestElapsedTime: maxRequestElapsedTime,
+		retryClassifier:       retryClassifier,
 		metricsPerBatch:       metricsPerBatch,
 		client:                httpClient.Client,
 		reqBufferSem:          reqBufferSem,
@@ -436,6 +447,12 @@ func (idb *Client) post(ctx context.Context, buffer *bytes.Buffer) error {
 			return nil
 		}
 
+		if idb.retryClassifier.IsFatal(err) {
+			atomic.AddUint64(&idb.batchesDropped, 1)
+			idb.logger.WithError(err).Error("failed to send, not retrying")
+			return fmt.Errorf("[%s] %v", BackendName, err)
+		}
+
 		next := bo.NextBackOff()
 		if next == backoff.Stop {
 			atomic.AddUint64(&idb.batchesDropped, 1)
@@ -494,7 +511,7 @@ func (idb *Client) constructPost(ctx context.Context, buffer *bytes.Buffer) (fun
 				"status": resp.StatusCode,
 				"body":   string(b),
 			}).Info("request failed")
-			return fmt.Errorf("received bad status code %d", resp.StatusCode)
+			return &transport.StatusError{StatusCode: resp.StatusCode}
 		}
 		_, _ = io.Copy(ioutil.Discard, body)
 		return nil
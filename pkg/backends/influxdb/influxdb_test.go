@@ -101,6 +101,7 @@ func TestRetries(t *testing.T) {
 		"creds",
 		defaultMaxRequests,
 		defaultMaxRequestElapsedTime,
+		nil,
 		defaultMetricsPerBatch,
 		"default",
 		configV2{
@@ -128,6 +129,79 @@ func TestRetries(t *testing.T) {
 	assert.EqualValues(t, cap(cli.reqBufferSem), len(cli.reqBufferSem))
 }
 
+func TestRetryClassification(t *testing.T) {
+	t.Parallel()
+	for status, expectedRequests := range map[int]uint32{
+		http.StatusBadRequest:          1, // Fatal, not retried
+		http.StatusNotFound:            1,
+		http.StatusInternalServerError: 2, // Retryable
+		http.StatusServiceUnavailable:  2,
+	} {
+		var requestNum uint32
+		mux := http.NewServeMux()
+		mux.HandleFunc("/api/v2/write", func(w http.ResponseWriter, r *http.Request) {
+			defer r.Body.Close()
+			if atomic.AddUint32(&requestNum, 1) == 1 {
+				w.WriteHeader(status)
+			}
+		})
+		ts := httptest.NewServer(mux)
+
+		v := viper.New()
+		v.Set("transport.default.client-timeout", 1*time.Second)
+		p := transport.NewTransportPool(logrus.New(), v)
+		rc, err := transport.NewRetryClassifier(transport.DefaultFatalStatusCodes)
+		require.NoError(t, err)
+		cli, err := NewClient(
+			ts.URL,
+			true,
+			"creds",
+			defaultMaxRequests,
+			defaultMaxRequestElapsedTime,
+			rc,
+			defaultMetricsPerBatch,
+			"default",
+			configV2{
+				bucket: "bucket",
+				org:    "org",
+			},
+			gostatsd.TimerSubtypes{},
+			logrus.New(),
+			p,
+		)
+		require.NoError(t, err)
+
+		res := make(chan []error, 1)
+		ctx, cancel := fixtures.NewAdvancingClock(context.Background())
+		cli.SendMetricsAsync(ctx, twoCounters(), func(errs []error) {
+			res <- errs
+		})
+		errs := <-res
+		cancel()
+		ts.Close()
+
+		require.Len(t, errs, 1, status)
+		if expectedRequests == 1 {
+			assert.Error(t, errs[0], status)
+			assert.EqualValues(t, 1, atomic.LoadUint64(&cli.batchesDropped), status)
+		} else {
+			assert.NoError(t, errs[0], status)
+		}
+		assert.EqualValues(t, expectedRequests, atomic.LoadUint32(&requestNum), status)
+	}
+}
+
+func TestNewClientInvalidFatalStatusCodes(t *testing.T) {
+	t.Parallel()
+	v := viper.New()
+	v.Set("influxdb."+paramApiVersion, 1)
+	v.Set("influxdb."+paramDatabase, "test-db")
+	v.Set("influxdb."+paramApiEndpoint, "http://localhost")
+	v.Set("influxdb."+paramFatalStatusCodes, []int{401, 1000})
+	_, err := NewClientFromViper(v, logrus.New(), transport.NewTransportPool(logrus.New(), viper.New()))
+	require.Error(t, err)
+}
+
 func TestSendMetricsInMultipleBatches(t *testing.T) {
 	t.Parallel()
 	var requestNum uint32
@@ -153,6 +227,7 @@ func TestSendMetricsInMultipleBatches(t *testing.T) {
 		"creds",
 		defaultMaxRequests,
 		defaultMaxRequestElapsedTime,
+		nil,
 		1,
 		"default",
 		configV1{
@@ -220,6 +295,7 @@ func TestSendMetrics(t *testing.T) {
 		"creds",
 		defaultMaxRequests,
 		defaultMaxRequestElapsedTime,
+		nil,
 		defaultMetricsPerBatch,
 		"default",
 		configV1{
@@ -358,6 +434,7 @@ func TestSendHistogram(t *testing.T) {
 		"creds",
 		defaultMaxRequests,
 		defaultMaxRequestElapsedTime,
+		nil,
 		defaultMetricsPerBatch,
 		"default",
 		configV1{
@@ -457,6 +534,7 @@ func TestSendEvent(t *testing.T) {
 		"creds",
 		defaultMaxRequests,
 		defaultMaxRequestElapsedTime,
+		nil,
 		defaultMetricsPerBatch,
 		"default",
 		configV1{
@@ -43,6 +43,7 @@ func (f *flush) addMetric(n *Client, metricType string, value float64, persecond
 
 // addMetric adds a timer metric to the series.
 func (f *flush) addTimerMetric(n *Client, metricType string, timer gostatsd.Timer, tagsKey, name string) {
+	disabled := timer.EffectiveDisabledSubtypes(n.disabledSubtypes)
 	if n.flushType == flushTypeMetrics {
 		newTags := maybeAddSource(timer.Source, timer.Tags)
 
@@ -55,23 +56,23 @@ func (f *flush) addTimerMetric(n *Client, metricType string, timer gostatsd.Time
 			"max":   timer.Max,
 		}
 
-		if !n.disabledSubtypes.CountPerSecond {
+		if !disabled.CountPerSecond {
 			gaugeMetric := newDimensionalMetricSet(n, f, name+".per_second", "gauge", timer.PerSecond, newTags)
 			f.ts.Metrics = append(f.ts.Metrics, gaugeMetric)
 		}
-		if !n.disabledSubtypes.Mean {
+		if !disabled.Mean {
 			gaugeMetric := newDimensionalMetricSet(n, f, name+".mean", "gauge", timer.Mean, newTags)
 			f.ts.Metrics = append(f.ts.Metrics, gaugeMetric)
 		}
-		if !n.disabledSubtypes.Median {
+		if !disabled.Median {
 			gaugeMetric := newDimensionalMetricSet(n, f, name+".median", "gauge", timer.Median, newTags)
 			f.ts.Metrics = append(f.ts.Metrics, gaugeMetric)
 		}
-		if !n.disabledSubtypes.StdDev {
+		if !disabled.StdDev {
 			gaugeMetric := newDimensionalMetricSet(n, f, name+".std_dev", "gauge", timer.StdDev, newTags)
 			f.ts.Metrics = append(f.ts.Metrics, gaugeMetric)
 		}
-		if !n.disabledSubtypes.SumSquares {
+		if !disabled.SumSquares {
 			gaugeMetric := newDimensionalMetricSet(n, f, name+".sum_squares", "gauge", timer.SumSquares, newTags)
 			f.ts.Metrics = append(f.ts.Metrics, gaugeMetric)
 		}
@@ -97,31 +98,31 @@ func (f *flush) addTimerMetric(n *Client, metricType string, timer gostatsd.Time
 
 		timerMetric := newMetricSet(n, f, name, metricType, float64(timer.Count), newTags)
 
-		if !n.disabledSubtypes.Lower {
+		if !disabled.Lower {
 			timerMetric[n.timerMin] = timer.Min
 		}
-		if !n.disabledSubtypes.Upper {
+		if !disabled.Upper {
 			timerMetric[n.timerMax] = timer.Max
 		}
-		if !n.disabledSubtypes.Count {
+		if !disabled.Count {
 			timerMetric[n.timerCount] = float64(timer.Count)
 		}
-		if !n.disabledSubtypes.Sum {
+		if !disabled.Sum {
 			timerMetric[n.timerSum] = timer.Sum
 		}
-		if !n.disabledSubtypes.CountPerSecond {
+		if !disabled.CountPerSecond {
 			timerMetric[n.metricPerSecond] = timer.PerSecond
 		}
-		if !n.disabledSubtypes.Mean {
+		if !disabled.Mean {
 			timerMetric[n.timerMean] = timer.Mean
 		}
-		if !n.disabledSubtypes.Median {
+		if !disabled.Median {
 			timerMetric[n.timerMedian] = timer.Median
 		}
-		if !n.disabledSubtypes.StdDev {
+		if !disabled.StdDev {
 			timerMetric[n.timerStdDev] = timer.StdDev
 		}
-		if !n.disabledSubtypes.SumSquares {
+		if !disabled.SumSquares {
 			timerMetric[n.timerSumSquares] = timer.SumSquares
 		}
 		for _, pct := range timer.Percentiles {
@@ -53,6 +53,10 @@ var (
 	// defaultMaxRequests is the number of parallel outgoing requests to New Relic.  As this mixes both
 	// CPU (JSON encoding, TLS) and network bound operations, balancing may require some experimentation.
 	defaultMaxRequests = uint(2 * runtime.NumCPU())
+
+	// defaultFatalStatusCodes also has the status codes New Relic rejects a request with the wrong method or without a
+	// Content-Length with.
+	defaultFatalStatusCodes = append([]int{http.StatusMethodNotAllowed, http.StatusLengthRequired}, transport.DefaultFatalStatusCodes...)
 )
 
 // Client represents a New Relic client.
@@ -86,6 +90,7 @@ type Client struct {
 
 	userAgent             string
 	maxRequestElapsedTime time.Duration
+	retryClassifier       *transport.RetryClassifier
 	client                *http.Client
 	metricsPerBatch       uint
 	metricsBufferSem      chan *bytes.Buffer // Two in one - a semaphore and a buffer pool
@@ -329,6 +334,12 @@ func (n *Client) post(ctx context.Context, buffer *bytes.Buffer, data interface{
 			return nil
 		}
 
+		if n.retryClassifier.IsFatal(err) {
+			atomic.AddUint64(&n.batchesDropped, 1)
+			n.logger.WithError(err).Error("failed to send, not retrying")
+			return fmt.Errorf("[%s] %v", BackendName, err)
+		}
+
 		next = b.NextBackOff()
 		if next != backoff.Stop && errors.As(err, &retryAfterErr) {
 			next = time.Duration(math.Max(float64(next), float64(retryAfterErr.Duration)))
@@ -450,7 +461,7 @@ func (n *Client) postWrapper(ctx context.Context, json []byte, dataType string)
 				"body":    string(b),
 				"address": address,
 			}).Info("request failed")
-			return fmt.Errorf("received bad status code %d", resp.StatusCode)
+			return &transport.StatusError{StatusCode: resp.StatusCode}
 		}
 		_, _ = io.Copy(ioutil.Discard, body)
 		return nil
@@ -492,6 +503,7 @@ func NewClientFromViper(v *viper.Viper, logger logrus.FieldLogger, pool *transpo
 	nr.SetDefault("max-request-elapsed-time", defaultMaxRequestElapsedTime)
 	nr.SetDefault("max-requests", defaultMaxRequests)
 	nr.SetDefault("user-agent", defaultUserAgent)
+	nr.SetDefault("fatal-status-codes", defaultFatalStatusCodes)
 
 	// New Relic Config Defaults & Recommendations
 	v.SetDefault("statser-type", "null")
@@ -501,6 +513,11 @@ func NewClientFromViper(v *viper.Viper, logger logrus.FieldLogger, pool *transpo
 		logger.Info("internal metrics OFF, to enable set 'statser-type' to 'logging' or 'internal'")
 	}
 
+	retryClassifier, err := transport.NewRetryClassifier(nr.GetIntSlice("fatal-status-codes"))
+	if err != nil {
+		return nil, fmt.Errorf("[%s] %v", BackendName, err)
+	}
+
 	return NewClient(
 		nr.GetString("transport"),
 		nr.GetString("address"),
@@ -526,18 +543,19 @@ func NewClientFromViper(v *viper.Viper, logger logrus.FieldLogger, pool *transpo
 		uint(nr.GetInt("max-requests")),
 		nr.GetDuration("max-request-elapsed-time"),
 		v.GetDuration("flush-interval"), // Main viper, not sub-viper
+		retryClassifier,
 		gostatsd.DisabledSubMetrics(v),
 		logger,
 		pool,
 	)
 }
 
-// NewClient returns a new New Relic client.
+// NewClient returns a new New Relic client.  Errors classified as fatal by retryClassifier are not retried.
 func NewClient(transport, address, addressMetrics, eventType, flushType, apiKey, tagPrefix,
 	metricName, metricType, metricPerSecond, metricValue,
 	timerMin, timerMax, timerCount, timerMean, timerMedian, timerStdDev, timerSum, timerSumSquares,
 	userAgent string, metricsPerBatch int, maxRequests uint,
-	maxRequestElapsedTime, flushInterval time.Duration,
+	maxRequestElapsedTime, flushInterval time.Duration, retryClassifier *transport.RetryClassifier,
 	disabled gostatsd.TimerSubtypes, logger logrus.FieldLogger, pool *transport.TransportPool) (*Client, error) {
 
 	if metricsPerBatch <= 0 {
@@ -599,6 +617,7 @@ func NewClient(transport, address, addressMetrics, eventType, flushType, apiKey,
 		timerSumSquares:       timerSumSquares,
 		userAgent:             userAgent,
 		maxRequestElapsedTime: maxRequestElapsedTime,
+		retryClassifier:       retryClassifier,
 		client:                httpClient.Client,
 		metricsPerBatch:       uint(metricsPerBatch),
 		metricsBufferSem:      metricsBufferSem,
@@ -61,7 +61,7 @@ func TestRetries(t *testing.T) {
 	client, err := NewClient("default", ts.URL+"/v1/data", "", "GoStatsD", "", "", "", "metric_name", "metric_type",
 		"metric_per_second", "metric_value", "samples_min", "samples_max", "samples_count",
 		"samples_mean", "samples_median", "samples_std_dev", "samples_sum", "samples_sum_squares", "agent",
-		defaultMetricsPerBatch, defaultMaxRequests, 2*time.Second, 1*time.Second, gostatsd.TimerSubtypes{}, logrus.New(), p)
+		defaultMetricsPerBatch, defaultMaxRequests, 2*time.Second, 1*time.Second, nil, gostatsd.TimerSubtypes{}, logrus.New(), p)
 
 	require.NoError(t, err)
 	res := make(chan []error, 1)
@@ -147,7 +147,7 @@ func TestRetryAfter(t *testing.T) {
 			client, err := NewClient("default", ts.URL+"/v1/data", "", "GoStatsD", "", "", "", "metric_name", "metric_type",
 				"metric_per_second", "metric_value", "samples_min", "samples_max", "samples_count",
 				"samples_mean", "samples_median", "samples_std_dev", "samples_sum", "samples_sum_squares", "agent",
-				defaultMetricsPerBatch, defaultMaxRequests, tt.maxRequestElapsedTime, 1*time.Second, gostatsd.TimerSubtypes{}, logrus.New(), p)
+				defaultMetricsPerBatch, defaultMaxRequests, tt.maxRequestElapsedTime, 1*time.Second, nil, gostatsd.TimerSubtypes{}, logrus.New(), p)
 
 			require.NoError(t, err)
 			res := make(chan []error, 1)
@@ -169,6 +169,58 @@ func TestRetryAfter(t *testing.T) {
 	}
 }
 
+func TestRetryClassification(t *testing.T) {
+	t.Parallel()
+	for status, expectedRequests := range map[int]uint32{
+		http.StatusForbidden:       1, // Fatal, not retried
+		http.StatusLengthRequired:  1,
+		http.StatusBadGateway:      2, // Retryable
+		http.StatusTooManyRequests: 2, // Retryable even without Retry-After
+	} {
+		var requestNum uint32
+		mux := http.NewServeMux()
+		mux.HandleFunc("/v1/data", func(w http.ResponseWriter, r *http.Request) {
+			defer r.Body.Close()
+			if atomic.AddUint32(&requestNum, 1) == 1 {
+				w.WriteHeader(status)
+			}
+		})
+		ts := httptest.NewServer(mux)
+
+		v := viper.New()
+		v.SetDefault("transport.default.client-timeout", 1*time.Second)
+		p := transport.NewTransportPool(logrus.New(), v)
+		rc, err := transport.NewRetryClassifier(defaultFatalStatusCodes)
+		require.NoError(t, err)
+		client, err := NewClient("default", ts.URL+"/v1/data", "", "GoStatsD", "", "", "", "metric_name", "metric_type",
+			"metric_per_second", "metric_value", "samples_min", "samples_max", "samples_count",
+			"samples_mean", "samples_median", "samples_std_dev", "samples_sum", "samples_sum_squares", "agent",
+			defaultMetricsPerBatch, defaultMaxRequests, 2*time.Second, 1*time.Second, rc, gostatsd.TimerSubtypes{}, logrus.New(), p)
+		require.NoError(t, err)
+
+		res := make(chan []error, 1)
+		clck := clock.NewMock(time.Unix(0, 0))
+		ctx := clock.Context(context.Background(), clck)
+		ch := make(chan struct{})
+		go advanceTime(clck, ch)
+		client.SendMetricsAsync(ctx, twoCounters(), func(errs []error) {
+			res <- errs
+		})
+		errs := <-res
+		ch <- struct{}{}
+		ts.Close()
+
+		require.Len(t, errs, 1, status)
+		if expectedRequests == 1 {
+			assert.Error(t, errs[0], status)
+			assert.EqualValues(t, 1, atomic.LoadUint64(&client.batchesDropped), status)
+		} else {
+			assert.NoError(t, errs[0], status)
+		}
+		assert.EqualValues(t, expectedRequests, atomic.LoadUint32(&requestNum), status)
+	}
+}
+
 func TestSendMetricsInMultipleBatches(t *testing.T) {
 	t.Parallel()
 	var requestNum uint32
@@ -192,7 +244,7 @@ func TestSendMetricsInMultipleBatches(t *testing.T) {
 	client, err := NewClient("default", ts.URL+"/v1/data", "", "GoStatsD", "", "", "", "metric_name", "metric_type",
 		"metric_per_second", "metric_value", "samples_min", "samples_max", "samples_count",
 		"samples_mean", "samples_median", "samples_std_dev", "samples_sum", "samples_sum_squares", "agent",
-		1, defaultMaxRequests, 2*time.Second, 1*time.Second, gostatsd.TimerSubtypes{}, logrus.New(), p)
+		1, defaultMaxRequests, 2*time.Second, 1*time.Second, nil, gostatsd.TimerSubtypes{}, logrus.New(), p)
 	require.NoError(t, err)
 	res := make(chan []error, 1)
 	client.SendMetricsAsync(context.Background(), twoCounters(), func(errs []error) {
@@ -281,7 +333,7 @@ func TestSendMetrics(t *testing.T) {
 			client, err := NewClient("default", ts.URL+"/v1/data", ts.URL+"/metric/v1", "GoStatsD", tt.flushType, tt.apiKey, "", "metric_name", "metric_type",
 				"metric_per_second", "metric_value", "samples_min", "samples_max", "samples_count",
 				"samples_mean", "samples_median", "samples_std_dev", "samples_sum", "samples_sum_squares", "agent",
-				defaultMetricsPerBatch, defaultMaxRequests, 2*time.Second, 1*time.Second, gostatsd.TimerSubtypes{}, logrus.New(), p)
+				defaultMetricsPerBatch, defaultMaxRequests, 2*time.Second, 1*time.Second, nil, gostatsd.TimerSubtypes{}, logrus.New(), p)
 
 			require.NoError(t, err)
 			res := make(chan []error, 1)
@@ -353,7 +405,7 @@ func TestSendMetricsWithHistogram(t *testing.T) {
 	client, err := NewClient("default", ts.URL+"/v1/data", "", "GoStatsD", "", "", "", "metric_name", "metric_type",
 		"metric_per_second", "metric_value", "samples_min", "samples_max", "samples_count",
 		"samples_mean", "samples_median", "samples_std_dev", "samples_sum", "samples_sum_squares", "agent",
-		defaultMetricsPerBatch, defaultMaxRequests, 2*time.Second, 1*time.Second, gostatsd.TimerSubtypes{}, logrus.New(), p)
+		defaultMetricsPerBatch, defaultMaxRequests, 2*time.Second, 1*time.Second, nil, gostatsd.TimerSubtypes{}, logrus.New(), p)
 
 	require.NoError(t, err)
 	res := make(chan []error, 1)
@@ -483,7 +535,7 @@ func TestEventFormatter(t *testing.T) {
 			client, err := NewClient("default", "v1/data", "", "GoStatsD", tt.name, "api-key", "", "metric_name", "metric_type",
 				"metric_per_second", "metric_value", "samples_min", "samples_max", "samples_count",
 				"samples_mean", "samples_median", "samples_std_dev", "samples_sum", "samples_sum_squares", "agent",
-				defaultMetricsPerBatch, defaultMaxRequests, 2*time.Second, 1*time.Second, gostatsd.TimerSubtypes{}, logrus.New(), p)
+				defaultMetricsPerBatch, defaultMaxRequests, 2*time.Second, 1*time.Second, nil, gostatsd.TimerSubtypes{}, logrus.New(), p)
 			require.NoError(t, err)
 
 			tags := []string{"tag_1:-infinity", "tag_2:infinity", "tag_3:+infinity", "tag_4:NaN"}
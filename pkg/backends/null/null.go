@@ -2,19 +2,27 @@ package null
 
 import (
 	"context"
+	"sync/atomic"
 
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 
 	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/stats"
 	"github.com/atlassian/gostatsd/pkg/transport"
 )
 
 // BackendName is the name of this backend.
 const BackendName = "null"
 
-// Client represents a discarding backend.
-type Client struct{}
+// Client represents a discarding backend.  It counts what it would have sent, which is emitted as internal metrics,
+// so it can be used to load test the full flush path without a real backend.
+type Client struct {
+	batchesSent uint64 // Accessed atomically
+	seriesSent  uint64 // Accessed atomically
+	valuesSent  uint64 // Accessed atomically
+	eventsSent  uint64 // Accessed atomically
+}
 
 // NewClientFromViper constructs a GraphiteClient object by connecting to an address.
 func NewClientFromViper(v *viper.Viper, logger logrus.FieldLogger, pool *transport.TransportPool) (gostatsd.Backend, error) {
@@ -26,17 +34,59 @@ func NewClient() (*Client, error) {
 	return &Client{}, nil
 }
 
-// SendMetricsAsync discards the metrics in a MetricsMap.
-func (Client) SendMetricsAsync(ctx context.Context, metrics *gostatsd.MetricMap, cb gostatsd.SendCallback) {
+// Run emits the counts of what would have been sent.
+func (c *Client) Run(ctx context.Context) {
+	statser := stats.FromContext(ctx).WithTags(gostatsd.Tags{"backend:null"})
+
+	flushed, unregister := statser.RegisterFlush()
+	defer unregister()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-flushed:
+			statser.Gauge("backend.sent", float64(atomic.LoadUint64(&c.batchesSent)), nil)
+			statser.Gauge("backend.series.sent", float64(atomic.LoadUint64(&c.seriesSent)), nil)
+			statser.Gauge("backend.values.sent", float64(atomic.LoadUint64(&c.valuesSent)), nil)
+			statser.Gauge("backend.events.sent", float64(atomic.LoadUint64(&c.eventsSent)), nil)
+		}
+	}
+}
+
+// SendMetricsAsync discards the metrics in a MetricsMap, counting the series and values in it.  Each timer value and
+// set member is counted as a value, along with each counter and gauge.
+func (c *Client) SendMetricsAsync(ctx context.Context, metrics *gostatsd.MetricMap, cb gostatsd.SendCallback) {
+	var series, values uint64
+	metrics.Counters.Each(func(key, tagsKey string, counter gostatsd.Counter) {
+		series++
+		values++
+	})
+	metrics.Gauges.Each(func(key, tagsKey string, gauge gostatsd.Gauge) {
+		series++
+		values++
+	})
+	metrics.Sets.Each(func(key, tagsKey string, set gostatsd.Set) {
+		series++
+		values += uint64(len(set.Values))
+	})
+	metrics.Timers.Each(func(key, tagsKey string, timer gostatsd.Timer) {
+		series++
+		values += uint64(len(timer.Values))
+	})
+	atomic.AddUint64(&c.batchesSent, 1)
+	atomic.AddUint64(&c.seriesSent, series)
+	atomic.AddUint64(&c.valuesSent, values)
 	cb(nil)
 }
 
-// SendEvent discards events.
-func (Client) SendEvent(ctx context.Context, e *gostatsd.Event) error {
+// SendEvent discards events, counting them.
+func (c *Client) SendEvent(ctx context.Context, e *gostatsd.Event) error {
+	atomic.AddUint64(&c.eventsSent, 1)
 	return nil
 }
 
 // Name returns the name of the backend.
-func (Client) Name() string {
+func (c *Client) Name() string {
 	return BackendName
 }
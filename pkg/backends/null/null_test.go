@@ -0,0 +1,41 @@
+package null
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/atlassian/gostatsd"
+)
+
+func TestSendMetricsAsyncCounts(t *testing.T) {
+	t.Parallel()
+	c, err := NewClient()
+	require.NoError(t, err)
+
+	mm := gostatsd.NewMetricMap()
+	mm.Receive(&gostatsd.Metric{Name: "c", Value: 1, Rate: 1, Type: gostatsd.COUNTER})
+	mm.Receive(&gostatsd.Metric{Name: "g", Value: 1, Rate: 1, Type: gostatsd.GAUGE})
+	mm.Receive(&gostatsd.Metric{Name: "s", StringValue: "a", Rate: 1, Type: gostatsd.SET})
+	mm.Receive(&gostatsd.Metric{Name: "s", StringValue: "b", Rate: 1, Type: gostatsd.SET})
+	mm.Receive(&gostatsd.Metric{Name: "t", Value: 1, Rate: 1, Type: gostatsd.TIMER})
+	mm.Receive(&gostatsd.Metric{Name: "t", Value: 2, Rate: 1, Type: gostatsd.TIMER})
+	mm.Receive(&gostatsd.Metric{Name: "t", Value: 3, Rate: 1, Tags: gostatsd.Tags{"a"}, Type: gostatsd.TIMER})
+
+	var calls int
+	for i := 0; i < 2; i++ {
+		c.SendMetricsAsync(context.Background(), mm, func(errs []error) {
+			calls++
+			assert.Empty(t, errs)
+		})
+	}
+	require.NoError(t, c.SendEvent(context.Background(), &gostatsd.Event{}))
+
+	assert.Equal(t, 2, calls)
+	assert.EqualValues(t, 2, c.batchesSent)
+	assert.EqualValues(t, 2*5, c.seriesSent)
+	assert.EqualValues(t, 2*7, c.valuesSent)
+	assert.EqualValues(t, 1, c.eventsSent)
+}
@@ -0,0 +1,37 @@
+package stackdriver
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+// monitoringWriteScope is the OAuth scope needed to write time series.
+const monitoringWriteScope = "https://www.googleapis.com/auth/monitoring.write"
+
+// findDefaultCredentials returns the credentials in credentialsFile if it's not empty, otherwise it finds the
+// Application Default Credentials the same way as the Google Cloud client libraries.  client is used to fetch tokens
+// for credentials from a file.
+func findDefaultCredentials(client *http.Client, credentialsFile string) (*google.Credentials, error) {
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, client)
+	if credentialsFile == "" {
+		creds, err := google.FindDefaultCredentials(ctx, monitoringWriteScope)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find credentials: %v", err)
+		}
+		return creds, nil
+	}
+	data, err := ioutil.ReadFile(credentialsFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read credentials: %v", err)
+	}
+	creds, err := google.CredentialsFromJSON(ctx, data, monitoringWriteScope)
+	if err != nil {
+		return nil, fmt.Errorf("invalid credentials in %s: %v", credentialsFile, err)
+	}
+	return creds, nil
+}
@@ -0,0 +1,98 @@
+package stackdriver
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetadataCredentials(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata-Flavor") != "Google" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/computeMetadata/v1/instance/service-accounts/default/token":
+			assert.Equal(t, monitoringWriteScope, r.URL.Query().Get("scopes"))
+			_, _ = w.Write([]byte(`{"access_token":"token123","expires_in":3600,"token_type":"Bearer"}`))
+		case "/computeMetadata/v1/project/project-id":
+			_, _ = w.Write([]byte("my-project"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+	t.Setenv("GCE_METADATA_HOST", strings.TrimPrefix(ts.URL, "http://"))
+	t.Setenv("GOOGLE_APPLICATION_CREDENTIALS", "")
+	t.Setenv("HOME", t.TempDir()) // So there are no gcloud credentials
+
+	creds, err := findDefaultCredentials(ts.Client(), "")
+	require.NoError(t, err)
+	assert.Equal(t, "my-project", creds.ProjectID)
+	token, err := creds.TokenSource.Token()
+	require.NoError(t, err)
+	assert.Equal(t, "token123", token.AccessToken)
+	assert.True(t, token.Valid())
+}
+
+func TestServiceAccountCredentials(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.NoError(t, r.ParseForm())
+		assert.Equal(t, "urn:ietf:params:oauth:grant-type:jwt-bearer", r.PostForm.Get("grant_type"))
+		assert.NotEmpty(t, r.PostForm.Get("assertion"))
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"access_token":"token456","expires_in":3600,"token_type":"Bearer"}`))
+	}))
+	defer ts.Close()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	data, err := json.Marshal(map[string]string{
+		"type":         "service_account",
+		"project_id":   "sa-project",
+		"client_email": "gostatsd@sa-project.iam.gserviceaccount.com",
+		"private_key":  string(keyPEM),
+		"token_uri":    ts.URL,
+	})
+	require.NoError(t, err)
+	credentialsFile := filepath.Join(t.TempDir(), "credentials.json")
+	require.NoError(t, os.WriteFile(credentialsFile, data, 0600))
+	t.Setenv("GOOGLE_APPLICATION_CREDENTIALS", credentialsFile)
+
+	creds, err := findDefaultCredentials(ts.Client(), "")
+	require.NoError(t, err)
+	assert.Equal(t, "sa-project", creds.ProjectID)
+	token, err := creds.TokenSource.Token()
+	require.NoError(t, err)
+	assert.Equal(t, "token456", token.AccessToken)
+
+	// The credentials file takes precedence over the environment
+	t.Setenv("GOOGLE_APPLICATION_CREDENTIALS", filepath.Join(t.TempDir(), "missing.json"))
+	creds, err = findDefaultCredentials(ts.Client(), credentialsFile)
+	require.NoError(t, err)
+	assert.Equal(t, "sa-project", creds.ProjectID)
+}
+
+func TestInvalidCredentials(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	invalidFile := filepath.Join(dir, "invalid.json")
+	require.NoError(t, os.WriteFile(invalidFile, []byte(`{`), 0600))
+	_, err := findDefaultCredentials(http.DefaultClient, invalidFile)
+	require.Error(t, err)
+	_, err = findDefaultCredentials(http.DefaultClient, filepath.Join(dir, "missing.json"))
+	require.Error(t, err)
+}
@@ -0,0 +1,495 @@
+package stackdriver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"runtime"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/cenkalti/backoff"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/tilinna/clock"
+	"golang.org/x/oauth2"
+	"golang.org/x/time/rate"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/internal/util"
+	"github.com/atlassian/gostatsd/pkg/backends/descriptors"
+	"github.com/atlassian/gostatsd/pkg/stats"
+	"github.com/atlassian/gostatsd/pkg/transport"
+)
+
+const (
+	apiURL = "https://monitoring.googleapis.com"
+	// BackendName is the name of this backend.
+	BackendName                  = "stackdriver"
+	defaultMetricPrefix          = "custom.googleapis.com/statsd/"
+	defaultResourceType          = "global"
+	defaultMaxRequestElapsedTime = 15 * time.Second
+	// defaultRequestsPerSecond is the default rate of write requests, which is shared by every server writing to the
+	// project, so it's well below the per project quota.
+	defaultRequestsPerSecond = 20
+	// maxTimeSeriesPerRequest is the maximum number of time series the API accepts in a single write request.
+	maxTimeSeriesPerRequest = 200
+	// maxLabels is the maximum number of labels of a custom metric.
+	maxLabels           = 30
+	maxLabelKeyLength   = 100
+	maxLabelValueLength = 1024
+	// maxResponseSize is the maximum response size we are willing to read.
+	maxResponseSize = 1024
+	// defaultDescriptorCacheSize is the default number of metric descriptors remembered as created.
+	defaultDescriptorCacheSize = 10000
+)
+
+var (
+	// defaultMaxRequests is the number of parallel outgoing requests to Cloud Monitoring.
+	defaultMaxRequests = uint(2 * runtime.NumCPU())
+
+	// requiredResourceLabels are the labels of the monitored resource types which can be used for custom metrics.
+	// The project_id label is set to the project if it's not configured.
+	requiredResourceLabels = map[string][]string{
+		"global":        {"project_id"},
+		"generic_node":  {"project_id", "location", "namespace", "node_id"},
+		"generic_task":  {"project_id", "location", "namespace", "job", "task_id"},
+		"gce_instance":  {"project_id", "instance_id", "zone"},
+		"k8s_container": {"project_id", "location", "cluster_name", "namespace_name", "pod_name", "container_name"},
+		"k8s_node":      {"project_id", "location", "cluster_name", "node_name"},
+		"k8s_pod":       {"project_id", "location", "cluster_name", "namespace_name", "pod_name"},
+	}
+)
+
+// Client represents a Google Cloud Monitoring client.
+type Client struct {
+	batchesCreated uint64            // Accumulated number of batches created
+	batchesDropped uint64            // Accumulated number of batches aborted (data loss)
+	batchesSent    uint64            // Accumulated number of batches successfully sent
+	seriesSent     uint64            // Accumulated number of series successfully sent
+	batchesRetried stats.ChangeGauge // Accumulated number of batches retried (first send is not a retry)
+
+	logger                logrus.FieldLogger
+	projectURL            string
+	metricPrefix          string
+	resource              monitoredResource
+	maxRequestElapsedTime time.Duration
+	retryClassifier       *transport.RetryClassifier
+	client                *http.Client
+	metricsPerBatch       uint
+	requestSem            chan struct{}
+	limiter               *rate.Limiter
+	descriptors           *descriptors.Cache // Creates the metric descriptors before they're written, may be nil
+
+	disabledSubtypes gostatsd.TimerSubtypes
+}
+
+// NewClientFromViper returns a new Google Cloud Monitoring client, authenticated with the Application Default
+// Credentials.
+func NewClientFromViper(v *viper.Viper, logger logrus.FieldLogger, pool *transport.TransportPool) (gostatsd.Backend, error) {
+	sd := util.GetSubViper(v, "stackdriver")
+	sd.SetDefault("api-endpoint", apiURL)
+	sd.SetDefault("project-id", "")
+	sd.SetDefault("credentials-file", "")
+	sd.SetDefault("metric-prefix", defaultMetricPrefix)
+	sd.SetDefault("resource-type", defaultResourceType)
+	sd.SetDefault("resource-labels", map[string]string{})
+	sd.SetDefault("metrics-per-batch", maxTimeSeriesPerRequest)
+	sd.SetDefault("max-requests", defaultMaxRequests)
+	sd.SetDefault("requests-per-second", defaultRequestsPerSecond)
+	sd.SetDefault("max-request-elapsed-time", defaultMaxRequestElapsedTime)
+	sd.SetDefault("transport", "default")
+	sd.SetDefault("fatal-status-codes", transport.DefaultFatalStatusCodes)
+	sd.SetDefault("create-descriptors", false)
+	sd.SetDefault("descriptor-cache-size", defaultDescriptorCacheSize)
+
+	retryClassifier, err := transport.NewRetryClassifier(sd.GetIntSlice("fatal-status-codes"))
+	if err != nil {
+		return nil, fmt.Errorf("[%s] %v", BackendName, err)
+	}
+	httpClient, err := pool.Get(sd.GetString("transport"))
+	if err != nil {
+		logger.WithError(err).Error("failed to create http client")
+		return nil, err
+	}
+	creds, err := findDefaultCredentials(httpClient.Client, sd.GetString("credentials-file"))
+	if err != nil {
+		return nil, fmt.Errorf("[%s] %v", BackendName, err)
+	}
+	projectID := sd.GetString("project-id")
+	if projectID == "" {
+		projectID = creds.ProjectID
+	}
+	if projectID == "" {
+		return nil, fmt.Errorf("[%s] project-id is not set, and the credentials have no project", BackendName)
+	}
+
+	return NewClient(
+		sd.GetString("api-endpoint"),
+		projectID,
+		sd.GetString("metric-prefix"),
+		sd.GetString("resource-type"),
+		sd.GetStringMapString("resource-labels"),
+		sd.GetInt("metrics-per-batch"),
+		uint(sd.GetInt("max-requests")),
+		sd.GetFloat64("requests-per-second"),
+		sd.GetDuration("max-request-elapsed-time"),
+		sd.GetBool("create-descriptors"),
+		sd.GetInt("descriptor-cache-size"),
+		retryClassifier,
+		gostatsd.DisabledSubMetrics(v),
+		creds.TokenSource,
+		httpClient.Client,
+		logger,
+	)
+}
+
+// NewClient returns a new Google Cloud Monitoring client, which writes to the project with tokens from tokenSource,
+// using client.  Every time series is written for the monitored resource of resourceType, with resourceLabels.  If
+// createDescriptors is true, the descriptor of each metric is created before it's first written, and up to
+// descriptorCacheSize descriptors are remembered.  Errors classified as fatal by retryClassifier are not retried.
+func NewClient(
+	apiEndpoint,
+	projectID,
+	metricPrefix,
+	resourceType string,
+	resourceLabels map[string]string,
+	metricsPerBatch int,
+	maxRequests uint,
+	requestsPerSecond float64,
+	maxRequestElapsedTime time.Duration,
+	createDescriptors bool,
+	descriptorCacheSize int,
+	retryClassifier *transport.RetryClassifier,
+	disabled gostatsd.TimerSubtypes,
+	tokenSource oauth2.TokenSource,
+	client *http.Client,
+	logger logrus.FieldLogger,
+) (*Client, error) {
+	if apiEndpoint == "" {
+		return nil, fmt.Errorf("[%s] apiEndpoint is required", BackendName)
+	}
+	if projectID == "" {
+		return nil, fmt.Errorf("[%s] projectID is required", BackendName)
+	}
+	if metricPrefix == "" {
+		return nil, fmt.Errorf("[%s] metricPrefix is required", BackendName)
+	}
+	if metricsPerBatch <= 0 || metricsPerBatch > maxTimeSeriesPerRequest {
+		return nil, fmt.Errorf("[%s] metricsPerBatch must be between 1 and %d", BackendName, maxTimeSeriesPerRequest)
+	}
+	if maxRequests == 0 {
+		return nil, fmt.Errorf("[%s] maxRequests must be positive", BackendName)
+	}
+	if requestsPerSecond <= 0 {
+		return nil, fmt.Errorf("[%s] requestsPerSecond must be positive", BackendName)
+	}
+	if maxRequestElapsedTime <= 0 && maxRequestElapsedTime != -1 {
+		return nil, fmt.Errorf("[%s] maxRequestElapsedTime must be positive", BackendName)
+	}
+	resource, err := newMonitoredResource(resourceType, resourceLabels, projectID)
+	if err != nil {
+		return nil, fmt.Errorf("[%s] %v", BackendName, err)
+	}
+
+	logger.WithFields(logrus.Fields{
+		"project-id":               projectID,
+		"resource-type":            resourceType,
+		"max-request-elapsed-time": maxRequestElapsedTime,
+		"max-requests":             maxRequests,
+		"requests-per-second":      requestsPerSecond,
+		"metrics-per-batch":        metricsPerBatch,
+		"create-descriptors":       createDescriptors,
+	}).Info("created backend")
+
+	requestSem := make(chan struct{}, maxRequests)
+	for i := uint(0); i < maxRequests; i++ {
+		requestSem <- struct{}{}
+	}
+	c := &Client{
+		logger:                logger,
+		projectURL:            fmt.Sprintf("%s/v3/projects/%s", apiEndpoint, projectID),
+		metricPrefix:          metricPrefix,
+		resource:              resource,
+		maxRequestElapsedTime: maxRequestElapsedTime,
+		retryClassifier:       retryClassifier,
+		client: &http.Client{
+			Transport: &oauth2.Transport{
+				Source: tokenSource,
+				Base:   client.Transport,
+			},
+			Timeout: client.Timeout,
+		},
+		metricsPerBatch:  uint(metricsPerBatch),
+		requestSem:       requestSem,
+		limiter:          rate.NewLimiter(rate.Limit(requestsPerSecond), 1),
+		disabledSubtypes: disabled,
+	}
+	if createDescriptors {
+		if c.descriptors, err = descriptors.NewCache(c, descriptorCacheSize); err != nil {
+			return nil, fmt.Errorf("[%s] descriptorCacheSize: %v", BackendName, err)
+		}
+	}
+	return c, nil
+}
+
+// newMonitoredResource returns the monitored resource of resourceType with labels, and validates that the labels
+// required by the resource type are set.  The project_id label is set to projectID if it's not set.
+func newMonitoredResource(resourceType string, labels map[string]string, projectID string) (monitoredResource, error) {
+	resource := monitoredResource{
+		Type:   resourceType,
+		Labels: make(map[string]string, len(labels)+1),
+	}
+	for k, v := range labels {
+		resource.Labels[k] = v
+	}
+	if resource.Labels["project_id"] == "" {
+		resource.Labels["project_id"] = projectID
+	}
+	required, ok := requiredResourceLabels[resourceType]
+	if !ok {
+		known := make([]string, 0, len(requiredResourceLabels))
+		for t := range requiredResourceLabels {
+			known = append(known, t)
+		}
+		sort.Strings(known)
+		return monitoredResource{}, fmt.Errorf("unsupported resource-type %q, must be one of %v", resourceType, known)
+	}
+	for _, label := range required {
+		if resource.Labels[label] == "" {
+			return monitoredResource{}, fmt.Errorf("resource-type %s requires the %s label in resource-labels", resourceType, label)
+		}
+	}
+	return resource, nil
+}
+
+// SendMetricsAsync flushes the metrics to Cloud Monitoring, preparing payload synchronously but doing the send
+// asynchronously.
+func (client *Client) SendMetricsAsync(ctx context.Context, metrics *gostatsd.MetricMap, cb gostatsd.SendCallback) {
+	counter := 0
+	results := make(chan error)
+
+	var batches [][]*timeSeries
+	client.processMetrics(clock.FromContext(ctx).Now(), metrics, func(batch []*timeSeries) {
+		batches = append(batches, batch)
+	})
+	// The descriptors have the labels of every time series of the flush, not just the labels of the first written
+	var flushDescriptors map[string]descriptors.Descriptor
+	if client.descriptors != nil {
+		flushDescriptors = metricDescriptorsOf(batches)
+	}
+	for _, batch := range batches {
+		batch := batch
+		atomic.AddUint64(&client.batchesCreated, 1)
+		go func() {
+			select {
+			case <-ctx.Done():
+				return
+			case <-client.requestSem:
+				defer func() {
+					client.requestSem <- struct{}{}
+				}()
+				err := client.sendBatch(ctx, batch, flushDescriptors)
+
+				select {
+				case <-ctx.Done():
+				case results <- err:
+				}
+			}
+		}()
+		counter++
+	}
+	go func() {
+		errs := make([]error, 0, counter)
+	loop:
+		for c := 0; c < counter; c++ {
+			select {
+			case <-ctx.Done():
+				errs = append(errs, ctx.Err())
+				break loop
+			case err := <-results:
+				errs = append(errs, err)
+			}
+		}
+		cb(errs)
+	}()
+}
+
+func (client *Client) Run(ctx context.Context) {
+	statser := stats.FromContext(ctx).WithTags(gostatsd.Tags{"backend:" + BackendName})
+
+	flushed, unregister := statser.RegisterFlush()
+	defer unregister()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-flushed:
+			statser.Gauge("backend.created", float64(atomic.LoadUint64(&client.batchesCreated)), nil)
+			client.batchesRetried.SendIfChanged(statser, "backend.retried", nil)
+			statser.Gauge("backend.dropped", float64(atomic.LoadUint64(&client.batchesDropped)), nil)
+			statser.Gauge("backend.sent", float64(atomic.LoadUint64(&client.batchesSent)), nil)
+			statser.Gauge("backend.series.sent", float64(atomic.LoadUint64(&client.seriesSent)), nil)
+			if client.descriptors != nil {
+				created, existed, failed, evicted := client.descriptors.Stats()
+				statser.Gauge("backend.descriptors.created", float64(created), nil)
+				statser.Gauge("backend.descriptors.existed", float64(existed), nil)
+				statser.Gauge("backend.descriptors.failed", float64(failed), nil)
+				statser.Gauge("backend.descriptors.evicted", float64(evicted), nil)
+				statser.Gauge("backend.descriptors.cached", float64(client.descriptors.Len()), nil)
+			}
+		}
+	}
+}
+
+// sendBatch writes a batch of time series, after ensuring their descriptors in flushDescriptors exist if descriptors
+// are created.  Time series whose descriptor couldn't be created are not written.
+func (client *Client) sendBatch(ctx context.Context, batch []*timeSeries, flushDescriptors map[string]descriptors.Descriptor) error {
+	if client.descriptors == nil {
+		return client.postTimeSeries(ctx, batch)
+	}
+	var descriptorErr error
+	described := make([]*timeSeries, 0, len(batch))
+	for _, ts := range batch {
+		if err := client.descriptors.Ensure(ctx, flushDescriptors[descriptorKey(ts)]); err != nil {
+			if descriptorErr == nil {
+				descriptorErr = fmt.Errorf("[%s] failed to create descriptor of %s: %v", BackendName, ts.Metric.Type, err)
+			}
+			continue
+		}
+		described = append(described, ts)
+	}
+	if len(described) > 0 {
+		if err := client.postTimeSeries(ctx, described); err != nil {
+			return err
+		}
+	}
+	return descriptorErr
+}
+
+// postTimeSeries writes a batch of time series, retrying until it succeeds, fails with a fatal error, or
+// maxRequestElapsedTime passes.  Every attempt waits for the rate limiter.
+func (client *Client) postTimeSeries(ctx context.Context, batch []*timeSeries) error {
+	body, err := json.Marshal(&createTimeSeriesRequest{TimeSeries: batch})
+	if err != nil {
+		atomic.AddUint64(&client.batchesDropped, 1)
+		return fmt.Errorf("[%s] unable to marshal time series: %v", BackendName, err)
+	}
+
+	b := backoff.NewExponentialBackOff()
+	clck := clock.FromContext(ctx)
+	b.Clock = clck
+	b.Reset()
+	b.MaxElapsedTime = client.maxRequestElapsedTime
+	for {
+		if err = client.limiter.Wait(ctx); err != nil {
+			return err
+		}
+		if err = client.post(ctx, client.projectURL+"/timeSeries", body); err == nil {
+			atomic.AddUint64(&client.batchesSent, 1)
+			atomic.AddUint64(&client.seriesSent, uint64(len(batch)))
+			return nil
+		}
+
+		if client.retryClassifier.IsFatal(err) {
+			atomic.AddUint64(&client.batchesDropped, 1)
+			client.logger.WithError(err).Error("failed to send, not retrying")
+			return fmt.Errorf("[%s] %v", BackendName, err)
+		}
+
+		next := b.NextBackOff()
+		if next == backoff.Stop {
+			atomic.AddUint64(&client.batchesDropped, 1)
+			return fmt.Errorf("[%s] %v", BackendName, err)
+		}
+
+		client.logger.WithFields(logrus.Fields{
+			"sleep": next,
+			"error": err,
+		}).Warn("failed to send")
+
+		timer := clck.NewTimer(next)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+
+		atomic.AddUint64(&client.batchesRetried.Cur, 1)
+	}
+}
+
+// CreateDescriptor creates a metric descriptor, or returns descriptors.ErrAlreadyExists if it already exists.
+func (client *Client) CreateDescriptor(ctx context.Context, d descriptors.Descriptor) error {
+	md := &metricDescriptor{
+		Type:        d.Name,
+		MetricKind:  d.Kind,
+		ValueType:   valueTypeDouble,
+		Description: "Created by gostatsd",
+	}
+	for _, label := range d.Labels {
+		md.Labels = append(md.Labels, labelDescriptor{Key: label, ValueType: "STRING"})
+	}
+	body, err := json.Marshal(md)
+	if err != nil {
+		return err
+	}
+	if err = client.limiter.Wait(ctx); err != nil {
+		return err
+	}
+	err = client.post(ctx, client.projectURL+"/metricDescriptors", body)
+	var statusErr *transport.StatusError
+	if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusConflict {
+		return descriptors.ErrAlreadyExists
+	}
+	return err
+}
+
+func (client *Client) post(ctx context.Context, url string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("unable to create http.Request: %v", err)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error POSTing: %v", err)
+	}
+	defer resp.Body.Close()
+	respBody := io.LimitReader(resp.Body, maxResponseSize)
+	if resp.StatusCode < http.StatusOK || resp.StatusCode > http.StatusNoContent {
+		b, _ := ioutil.ReadAll(respBody)
+		client.logger.WithFields(logrus.Fields{
+			"status": resp.StatusCode,
+			"body":   string(b),
+		}).Info("request failed")
+		return &transport.StatusError{StatusCode: resp.StatusCode}
+	}
+	_, _ = io.Copy(ioutil.Discard, respBody)
+	return nil
+}
+
+// SendEvent is not supported, as Cloud Monitoring has no events.
+func (client *Client) SendEvent(ctx context.Context, e *gostatsd.Event) error {
+	return nil
+}
+
+// Name returns the name of the backend.
+func (client *Client) Name() string {
+	return BackendName
+}
+
+// MaxTags returns the maximum number of tags of each metric, leaving room for the host label, as Cloud Monitoring
+// rejects custom metrics with too many labels.
+func (client *Client) MaxTags() int {
+	return maxLabels - 1
+}
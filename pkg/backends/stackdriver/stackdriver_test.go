@@ -0,0 +1,177 @@
+package stackdriver
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/backends/descriptors"
+	"github.com/atlassian/gostatsd/pkg/transport"
+)
+
+func TestSendMetrics(t *testing.T) {
+	t.Parallel()
+	var requests, series uint32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v3/projects/my-project/timeSeries", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.Equal(t, "Bearer token123", r.Header.Get("Authorization"))
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		var body createTimeSeriesRequest
+		if !assert.NoError(t, json.NewDecoder(r.Body).Decode(&body)) {
+			return
+		}
+		atomic.AddUint32(&requests, 1)
+		atomic.AddUint32(&series, uint32(len(body.TimeSeries)))
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	client := newTestClient(t, ts.URL, 2)
+	mm := gostatsd.NewMetricMap()
+	mm.Counters["c"] = map[string]gostatsd.Counter{"": {Value: 5, PerSecond: 0.5}}
+	mm.Gauges["g"] = map[string]gostatsd.Gauge{"": {Value: 1}}
+	res := make(chan []error, 1)
+	client.SendMetricsAsync(context.Background(), mm, func(errs []error) {
+		res <- errs
+	})
+	errs := <-res
+	require.Len(t, errs, 2)
+	for _, err := range errs {
+		assert.NoError(t, err)
+	}
+	assert.EqualValues(t, 2, requests)
+	assert.EqualValues(t, 3, series)
+	assert.EqualValues(t, 3, client.seriesSent)
+}
+
+func TestSendMetricsRetries(t *testing.T) {
+	t.Parallel()
+	for status, expectedRequests := range map[int]uint32{
+		http.StatusServiceUnavailable: 2, // Retried
+		http.StatusBadRequest:         1, // Fatal
+	} {
+		var requests uint32
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if atomic.AddUint32(&requests, 1) == 1 {
+				w.WriteHeader(status)
+			}
+		}))
+
+		client := newTestClient(t, ts.URL, maxTimeSeriesPerRequest)
+		client.retryClassifier, _ = transport.NewRetryClassifier(transport.DefaultFatalStatusCodes)
+		mm := gostatsd.NewMetricMap()
+		mm.Gauges["g"] = map[string]gostatsd.Gauge{"": {Value: 1}}
+		res := make(chan []error, 1)
+		client.SendMetricsAsync(context.Background(), mm, func(errs []error) {
+			res <- errs
+		})
+		errs := <-res
+		ts.Close()
+		require.Len(t, errs, 1)
+		assert.Equal(t, status == http.StatusBadRequest, errs[0] != nil, "status %d", status)
+		assert.Equal(t, expectedRequests, requests, "status %d", status)
+	}
+}
+
+func TestSendMetricsCreatesDescriptors(t *testing.T) {
+	t.Parallel()
+	var descriptorRequests uint32
+	var series uint32
+	var mu sync.Mutex
+	var gLabels []labelDescriptor
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v3/projects/my-project/metricDescriptors", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddUint32(&descriptorRequests, 1)
+		var md metricDescriptor
+		if !assert.NoError(t, json.NewDecoder(r.Body).Decode(&md)) {
+			return
+		}
+		assert.Equal(t, metricKindGauge, md.MetricKind)
+		assert.Equal(t, valueTypeDouble, md.ValueType)
+		switch md.Type {
+		case defaultMetricPrefix + "existing":
+			w.WriteHeader(http.StatusConflict)
+		case defaultMetricPrefix + "g":
+			mu.Lock()
+			gLabels = md.Labels
+			mu.Unlock()
+		case defaultMetricPrefix + "rejected":
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	})
+	mux.HandleFunc("/v3/projects/my-project/timeSeries", func(w http.ResponseWriter, r *http.Request) {
+		var body createTimeSeriesRequest
+		if !assert.NoError(t, json.NewDecoder(r.Body).Decode(&body)) {
+			return
+		}
+		atomic.AddUint32(&series, uint32(len(body.TimeSeries)))
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	client := newTestClient(t, ts.URL, maxTimeSeriesPerRequest)
+	client.descriptors, _ = descriptors.NewCache(client, 10)
+	mm := gostatsd.NewMetricMap()
+	mm.Gauges["g"] = map[string]gostatsd.Gauge{
+		"env:prod": {Value: 1, Source: "web-1", Tags: gostatsd.Tags{"env:prod"}},
+		"team:a":   {Value: 1, Tags: gostatsd.Tags{"team:a"}},
+	}
+	mm.Gauges["existing"] = map[string]gostatsd.Gauge{"": {Value: 1}}
+	mm.Gauges["rejected"] = map[string]gostatsd.Gauge{"": {Value: 1}}
+	send := func() []error {
+		res := make(chan []error, 1)
+		client.SendMetricsAsync(context.Background(), mm, func(errs []error) {
+			res <- errs
+		})
+		return <-res
+	}
+
+	getLabels := func() []labelDescriptor {
+		mu.Lock()
+		defer mu.Unlock()
+		return gLabels
+	}
+
+	// The time series whose descriptor is rejected is not written, and the descriptor has the labels of every time
+	// series of the flush
+	errs := send()
+	require.Len(t, errs, 1)
+	require.Error(t, errs[0])
+	assert.EqualValues(t, 3, descriptorRequests)
+	assert.EqualValues(t, 3, series)
+	assert.Equal(t, []labelDescriptor{
+		{Key: "env", ValueType: "STRING"},
+		{Key: "host", ValueType: "STRING"},
+		{Key: "team", ValueType: "STRING"},
+	}, getLabels())
+
+	// Only the rejected descriptor is created again
+	send()
+	assert.EqualValues(t, 4, descriptorRequests)
+	assert.EqualValues(t, 6, series)
+	created, existed, failed, _ := client.descriptors.Stats()
+	assert.EqualValues(t, 1, created)
+	assert.EqualValues(t, 1, existed)
+	assert.EqualValues(t, 2, failed)
+
+	// A new label creates the descriptor again with every label
+	delete(mm.Gauges, "rejected")
+	mm.Gauges["g"]["region:us"] = gostatsd.Gauge{Value: 1, Tags: gostatsd.Tags{"region:us"}}
+	require.Equal(t, []error{nil}, send())
+	assert.EqualValues(t, 5, descriptorRequests)
+	assert.Equal(t, []labelDescriptor{
+		{Key: "env", ValueType: "STRING"},
+		{Key: "host", ValueType: "STRING"},
+		{Key: "region", ValueType: "STRING"},
+		{Key: "team", ValueType: "STRING"},
+	}, getLabels())
+}
@@ -0,0 +1,316 @@
+package stackdriver
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/backends/descriptors"
+)
+
+const (
+	metricKindGauge = "GAUGE"
+	valueTypeDouble = "DOUBLE"
+)
+
+// createTimeSeriesRequest is the body of a projects.timeSeries.create request.
+type createTimeSeriesRequest struct {
+	TimeSeries []*timeSeries `json:"timeSeries"`
+}
+
+type timeSeries struct {
+	Metric     metric            `json:"metric"`
+	Resource   monitoredResource `json:"resource"`
+	MetricKind string            `json:"metricKind"`
+	ValueType  string            `json:"valueType"`
+	Points     []point           `json:"points"`
+}
+
+type metric struct {
+	Type   string            `json:"type"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+type monitoredResource struct {
+	Type   string            `json:"type"`
+	Labels map[string]string `json:"labels"`
+}
+
+type point struct {
+	Interval timeInterval `json:"interval"`
+	Value    typedValue   `json:"value"`
+}
+
+type timeInterval struct {
+	EndTime string `json:"endTime"`
+}
+
+type typedValue struct {
+	DoubleValue float64 `json:"doubleValue"`
+}
+
+// metricDescriptor is the body of a projects.metricDescriptors.create request.
+type metricDescriptor struct {
+	Type        string            `json:"type"`
+	MetricKind  string            `json:"metricKind"`
+	ValueType   string            `json:"valueType"`
+	Labels      []labelDescriptor `json:"labels,omitempty"`
+	Description string            `json:"description,omitempty"`
+}
+
+type labelDescriptor struct {
+	Key       string `json:"key"`
+	ValueType string `json:"valueType"`
+}
+
+// descriptorKey returns the key of the descriptor of the metric of ts in the result of metricDescriptorsOf.
+func descriptorKey(ts *timeSeries) string {
+	return ts.Metric.Type + "/" + ts.MetricKind
+}
+
+// metricDescriptorsOf returns the descriptor of every metric in batches, by descriptorKey, with the union of the labels
+// of the time series of the metric.
+func metricDescriptorsOf(batches [][]*timeSeries) map[string]descriptors.Descriptor {
+	labels := map[string]map[string]struct{}{}
+	result := map[string]descriptors.Descriptor{}
+	for _, batch := range batches {
+		for _, ts := range batch {
+			k := descriptorKey(ts)
+			if _, ok := result[k]; !ok {
+				result[k] = descriptors.Descriptor{Name: ts.Metric.Type, Kind: ts.MetricKind}
+				labels[k] = map[string]struct{}{}
+			}
+			for label := range ts.Metric.Labels {
+				labels[k][label] = struct{}{}
+			}
+		}
+	}
+	for k, d := range result {
+		d.Labels = make([]string, 0, len(labels[k]))
+		for label := range labels[k] {
+			d.Labels = append(d.Labels, label)
+		}
+		sort.Strings(d.Labels)
+		result[k] = d
+	}
+	return result
+}
+
+// flush maps the metrics of a single flush to time series, and splits them in to batches of at most metricsPerBatch
+// time series.  The API rejects a request which writes the same time series twice, so a batch is also ended early if
+// a time series is repeated, which can happen if tags are only different before they're sanitized.
+type flush struct {
+	client    *Client
+	endTime   string
+	batch     []*timeSeries
+	batchKeys map[string]struct{}
+	cb        func([]*timeSeries)
+}
+
+// processMetrics maps every metric to time series at now, and calls cb with each batch.
+func (client *Client) processMetrics(now time.Time, metrics *gostatsd.MetricMap, cb func([]*timeSeries)) {
+	fl := &flush{
+		client:  client,
+		endTime: now.UTC().Format(time.RFC3339Nano),
+		cb:      cb,
+	}
+
+	metrics.Counters.Each(func(key, tagsKey string, counter gostatsd.Counter) {
+		fl.add(key+".count", float64(counter.Value), counter.Source, counter.Tags)
+		fl.add(key+".rate", counter.PerSecond, counter.Source, counter.Tags)
+	})
+
+	metrics.Timers.Each(func(key, tagsKey string, timer gostatsd.Timer) {
+		if timer.Histogram != nil {
+			for histogramThreshold, count := range timer.Histogram {
+				bucketTag := "le:+Inf"
+				if !math.IsInf(float64(histogramThreshold), 1) {
+					bucketTag = "le:" + strconv.FormatFloat(float64(histogramThreshold), 'f', -1, 64)
+				}
+				fl.add(key+".histogram", float64(count), timer.Source, timer.Tags.Concat(gostatsd.Tags{bucketTag}))
+			}
+			return
+		}
+		disabled := timer.EffectiveDisabledSubtypes(client.disabledSubtypes)
+		if !disabled.Lower {
+			fl.add(key+".lower", timer.Min, timer.Source, timer.Tags)
+		}
+		if !disabled.Upper {
+			fl.add(key+".upper", timer.Max, timer.Source, timer.Tags)
+		}
+		if !disabled.Count {
+			fl.add(key+".count", float64(timer.Count), timer.Source, timer.Tags)
+		}
+		if !disabled.CountPerSecond {
+			fl.add(key+".count_ps", timer.PerSecond, timer.Source, timer.Tags)
+		}
+		if !disabled.Mean {
+			fl.add(key+".mean", timer.Mean, timer.Source, timer.Tags)
+		}
+		if !disabled.Median {
+			fl.add(key+".median", timer.Median, timer.Source, timer.Tags)
+		}
+		if !disabled.StdDev {
+			fl.add(key+".std", timer.StdDev, timer.Source, timer.Tags)
+		}
+		if !disabled.Sum {
+			fl.add(key+".sum", timer.Sum, timer.Source, timer.Tags)
+		}
+		if !disabled.SumSquares {
+			fl.add(key+".sum_squares", timer.SumSquares, timer.Source, timer.Tags)
+		}
+		for _, pct := range timer.Percentiles {
+			fl.add(key+"."+pct.Str, pct.Float, timer.Source, timer.Tags)
+		}
+	})
+
+	metrics.Gauges.Each(func(key, tagsKey string, g gostatsd.Gauge) {
+		fl.add(key, g.Value, g.Source, g.Tags)
+	})
+
+	metrics.Sets.Each(func(key, tagsKey string, set gostatsd.Set) {
+		fl.add(key, float64(len(set.Values)), set.Source, set.Tags)
+	})
+
+	fl.finish()
+}
+
+// add adds a time series with a single point.  Values which can't be represented in JSON are skipped.
+func (fl *flush) add(name string, value float64, source gostatsd.Source, tags gostatsd.Tags) {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return
+	}
+	ts := &timeSeries{
+		Metric: metric{
+			Type:   fl.client.metricType(name),
+			Labels: metricLabels(source, tags),
+		},
+		Resource:   fl.client.resource,
+		MetricKind: metricKindGauge,
+		ValueType:  valueTypeDouble,
+		Points: []point{{
+			Interval: timeInterval{EndTime: fl.endTime},
+			Value:    typedValue{DoubleValue: value},
+		}},
+	}
+	key := timeSeriesKey(ts)
+	if _, ok := fl.batchKeys[key]; ok || len(fl.batch) >= int(fl.client.metricsPerBatch) {
+		fl.finish()
+	}
+	if fl.batchKeys == nil {
+		fl.batch = make([]*timeSeries, 0, fl.client.metricsPerBatch)
+		fl.batchKeys = make(map[string]struct{}, fl.client.metricsPerBatch)
+	}
+	fl.batch = append(fl.batch, ts)
+	fl.batchKeys[key] = struct{}{}
+}
+
+// finish sends the current batch to the callback, if it's not empty.
+func (fl *flush) finish() {
+	if len(fl.batch) > 0 {
+		fl.cb(fl.batch)
+	}
+	fl.batch = nil
+	fl.batchKeys = nil
+}
+
+// timeSeriesKey identifies a time series by its metric type and labels, as the resource is the same for every time
+// series.
+func timeSeriesKey(ts *timeSeries) string {
+	keys := make([]string, 0, len(ts.Metric.Labels))
+	for k := range ts.Metric.Labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var sb strings.Builder
+	sb.WriteString(ts.Metric.Type)
+	for _, k := range keys {
+		sb.WriteByte(0)
+		sb.WriteString(k)
+		sb.WriteByte(0)
+		sb.WriteString(ts.Metric.Labels[k])
+	}
+	return sb.String()
+}
+
+// metricType returns the metric type of a metric name.  Each `.` separated part of the name becomes part of the path
+// of the metric type, and any other character which isn't a letter, digit, or `_` is replaced by `_`, so
+// `api.requests-total` is `custom.googleapis.com/statsd/api/requests_total` with the default prefix.
+func (client *Client) metricType(name string) string {
+	var sb strings.Builder
+	sb.Grow(len(client.metricPrefix) + len(name))
+	sb.WriteString(client.metricPrefix)
+	for _, c := range name {
+		switch {
+		case c == '.':
+			sb.WriteByte('/')
+		case isLabelChar(c) || c >= 'A' && c <= 'Z':
+			sb.WriteRune(c)
+		default:
+			sb.WriteByte('_')
+		}
+	}
+	return sb.String()
+}
+
+// metricLabels returns the tags as metric labels, and the source as the `host` label, unless there is a `host` tag.
+// Label keys are lowercased, and any character which isn't a lowercase letter, digit, or `_` is replaced by `_`.
+// Keys which don't start with a letter are prefixed with `tag_`.  A tag without a value has the value `true`, and
+// values are truncated to the maximum length of a label value.  If a key is repeated, the first value is used.
+func metricLabels(source gostatsd.Source, tags gostatsd.Tags) map[string]string {
+	if len(tags) == 0 && source == "" {
+		return nil
+	}
+	labels := make(map[string]string, len(tags)+1)
+	for _, tag := range tags {
+		key, value := tag, "true"
+		if idx := strings.IndexByte(tag, ':'); idx >= 0 {
+			key, value = tag[:idx], tag[idx+1:]
+		}
+		key = labelKey(key)
+		if _, ok := labels[key]; ok {
+			continue
+		}
+		labels[key] = truncateLabelValue(value)
+	}
+	if _, ok := labels["host"]; !ok && source != "" {
+		labels["host"] = truncateLabelValue(string(source))
+	}
+	return labels
+}
+
+func labelKey(key string) string {
+	sanitized := []byte(strings.ToLower(key))
+	for i, c := range sanitized {
+		if !isLabelChar(rune(c)) {
+			sanitized[i] = '_'
+		}
+	}
+	if len(sanitized) == 0 || sanitized[0] < 'a' || sanitized[0] > 'z' {
+		sanitized = append([]byte("tag_"), sanitized...)
+	}
+	if len(sanitized) > maxLabelKeyLength {
+		sanitized = sanitized[:maxLabelKeyLength]
+	}
+	return string(sanitized)
+}
+
+func isLabelChar(c rune) bool {
+	return c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '_'
+}
+
+// truncateLabelValue truncates value to the maximum length of a label value, without splitting a UTF-8 character.
+func truncateLabelValue(value string) string {
+	if len(value) <= maxLabelValueLength {
+		return value
+	}
+	end := maxLabelValueLength
+	for end > 0 && !utf8.RuneStart(value[end]) {
+		end--
+	}
+	return value[:end]
+}
@@ -0,0 +1,180 @@
+package stackdriver
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+
+	"github.com/atlassian/gostatsd"
+)
+
+func newTestClient(t *testing.T, apiEndpoint string, metricsPerBatch int) *Client {
+	client, err := NewClient(
+		apiEndpoint,
+		"my-project",
+		defaultMetricPrefix,
+		"generic_node",
+		map[string]string{"location": "us-east1", "namespace": "web", "node_id": "node-1"},
+		metricsPerBatch,
+		defaultMaxRequests,
+		1000,
+		time.Second,
+		false,
+		0,
+		nil,
+		gostatsd.TimerSubtypes{},
+		oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "token123"}),
+		http.DefaultClient,
+		logrus.New(),
+	)
+	require.NoError(t, err)
+	return client
+}
+
+func collectBatches(client *Client, mm *gostatsd.MetricMap) [][]*timeSeries {
+	var batches [][]*timeSeries
+	client.processMetrics(time.Unix(1600000000, 500000000), mm, func(batch []*timeSeries) {
+		batches = append(batches, batch)
+	})
+	return batches
+}
+
+func TestTimeSeriesSerialization(t *testing.T) {
+	t.Parallel()
+	client := newTestClient(t, apiURL, maxTimeSeriesPerRequest)
+	mm := gostatsd.NewMetricMap()
+	mm.Gauges["api.queue-depth"] = map[string]gostatsd.Gauge{
+		"": {Value: 12.5, Source: "web-1", Tags: gostatsd.Tags{"Env:prod", "canary", "1st:yes"}},
+	}
+	batches := collectBatches(client, mm)
+	require.Len(t, batches, 1)
+
+	data, err := json.Marshal(&createTimeSeriesRequest{TimeSeries: batches[0]})
+	require.NoError(t, err)
+	assert.JSONEq(t, `{
+		"timeSeries": [{
+			"metric": {
+				"type": "custom.googleapis.com/statsd/api/queue_depth",
+				"labels": {"env": "prod", "canary": "true", "tag_1st": "yes", "host": "web-1"}
+			},
+			"resource": {
+				"type": "generic_node",
+				"labels": {"project_id": "my-project", "location": "us-east1", "namespace": "web", "node_id": "node-1"}
+			},
+			"metricKind": "GAUGE",
+			"valueType": "DOUBLE",
+			"points": [{
+				"interval": {"endTime": "2020-09-13T12:26:40.5Z"},
+				"value": {"doubleValue": 12.5}
+			}]
+		}]
+	}`, string(data))
+}
+
+func TestTimeSeriesMapping(t *testing.T) {
+	t.Parallel()
+	client := newTestClient(t, apiURL, maxTimeSeriesPerRequest)
+	mm := gostatsd.NewMetricMap()
+	mm.Counters["c"] = map[string]gostatsd.Counter{"": {Value: 5, PerSecond: 0.5}}
+	timer := gostatsd.Timer{Count: 2, PerSecond: 0.2, Min: 1, Max: 3, Mean: 2, Median: 2, StdDev: 1, Sum: 4, SumSquares: 10}
+	timer.Percentiles.Set("upper_90", 3)
+	mm.Timers["t"] = map[string]gostatsd.Timer{"": timer}
+	mm.Timers["h"] = map[string]gostatsd.Timer{"": {Histogram: map[gostatsd.HistogramThreshold]int{10: 1, gostatsd.HistogramThreshold(math.Inf(1)): 2}}}
+	mm.Gauges["g"] = map[string]gostatsd.Gauge{"": {Value: 1}, "nan": {Value: math.NaN(), Tags: gostatsd.Tags{"nan"}}}
+	mm.Sets["s"] = map[string]gostatsd.Set{"": {Values: map[string]struct{}{"a": {}, "b": {}}}}
+
+	batches := collectBatches(client, mm)
+	require.Len(t, batches, 1)
+	actual := map[string]float64{}
+	for _, ts := range batches[0] {
+		name := strings.TrimPrefix(ts.Metric.Type, defaultMetricPrefix)
+		if le, ok := ts.Metric.Labels["le"]; ok {
+			name += "{le=" + le + "}"
+		}
+		actual[name] = ts.Points[0].Value.DoubleValue
+		assert.Equal(t, metricKindGauge, ts.MetricKind)
+		assert.Equal(t, valueTypeDouble, ts.ValueType)
+	}
+	assert.Equal(t, map[string]float64{
+		"c/count":              5,
+		"c/rate":               0.5,
+		"t/lower":              1,
+		"t/upper":              3,
+		"t/count":              2,
+		"t/count_ps":           0.2,
+		"t/mean":               2,
+		"t/median":             2,
+		"t/std":                1,
+		"t/sum":                4,
+		"t/sum_squares":        10,
+		"t/upper_90":           3,
+		"h/histogram{le=10}":   1,
+		"h/histogram{le=+Inf}": 2,
+		"g":                    1, // NaN is skipped
+		"s":                    2,
+	}, actual)
+}
+
+func TestTimeSeriesBatching(t *testing.T) {
+	t.Parallel()
+	client := newTestClient(t, apiURL, 2)
+	mm := gostatsd.NewMetricMap()
+	mm.Gauges["a"] = map[string]gostatsd.Gauge{"": {Value: 1}}
+	mm.Gauges["b"] = map[string]gostatsd.Gauge{"": {Value: 1}}
+	mm.Gauges["c"] = map[string]gostatsd.Gauge{"": {Value: 1}}
+	batches := collectBatches(client, mm)
+	require.Len(t, batches, 2)
+	assert.Len(t, batches[0], 2)
+	assert.Len(t, batches[1], 1)
+
+	// Tags which are the same once sanitized are written in separate requests
+	client = newTestClient(t, apiURL, maxTimeSeriesPerRequest)
+	mm = gostatsd.NewMetricMap()
+	mm.Gauges["a"] = map[string]gostatsd.Gauge{
+		"Key:v": {Value: 1, Tags: gostatsd.Tags{"Key:v"}},
+		"key:v": {Value: 2, Tags: gostatsd.Tags{"key:v"}},
+	}
+	batches = collectBatches(client, mm)
+	require.Len(t, batches, 2)
+	assert.Equal(t, batches[0][0].Metric, batches[1][0].Metric)
+}
+
+func TestMetricLabels(t *testing.T) {
+	t.Parallel()
+	assert.Nil(t, metricLabels("", nil))
+	assert.Equal(t, map[string]string{"host": "h"}, metricLabels("h", nil))
+	// A host tag takes precedence over the source, and the first value of a key is used
+	assert.Equal(t, map[string]string{"host": "tagged", "a_b": "1"}, metricLabels("h", gostatsd.Tags{"host:tagged", "A.B:1", "a-b:2"}))
+
+	long := strings.Repeat("é", maxLabelValueLength)
+	labels := metricLabels("", gostatsd.Tags{strings.Repeat("k", 200) + ":" + long})
+	for k, v := range labels {
+		assert.Len(t, k, maxLabelKeyLength)
+		assert.Len(t, v, maxLabelValueLength)
+		assert.True(t, strings.HasPrefix(long, v))
+	}
+}
+
+func TestMonitoredResource(t *testing.T) {
+	t.Parallel()
+	resource, err := newMonitoredResource("global", nil, "my-project")
+	require.NoError(t, err)
+	assert.Equal(t, monitoredResource{Type: "global", Labels: map[string]string{"project_id": "my-project"}}, resource)
+
+	resource, err = newMonitoredResource("global", map[string]string{"project_id": "other"}, "my-project")
+	require.NoError(t, err)
+	assert.Equal(t, "other", resource.Labels["project_id"])
+
+	_, err = newMonitoredResource("generic_node", map[string]string{"location": "us-east1"}, "my-project")
+	require.Error(t, err)
+	_, err = newMonitoredResource("aws_ec2_instance", nil, "my-project")
+	require.Error(t, err)
+}
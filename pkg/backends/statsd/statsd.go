@@ -0,0 +1,322 @@
+package statsd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/internal/util"
+	"github.com/atlassian/gostatsd/pkg/backends/sender"
+	"github.com/atlassian/gostatsd/pkg/transport"
+)
+
+const (
+	// BackendName is the name of this backend.
+	BackendName = "statsd"
+	// DefaultNetwork is the default network metrics are sent over.
+	DefaultNetwork = "udp"
+	// DefaultDialTimeout is the default net.Dial timeout.
+	DefaultDialTimeout = 5 * time.Second
+	// DefaultWriteTimeout is the default socket write timeout.
+	DefaultWriteTimeout = 30 * time.Second
+	// DefaultUDPPacketSize is the default maximum size of a UDP datagram, which fits an Ethernet MTU.
+	DefaultUDPPacketSize = 1432
+	// DefaultTCPPacketSize is the default maximum size of a write over TCP.
+	DefaultTCPPacketSize = 1 * 1024 * 1024
+	// sendChannelSize specifies the size of the buffer of a channel between caller goroutine, producing buffers, and the
+	// goroutine that writes them to the socket.
+	sendChannelSize = 1000
+	// maxConcurrentSends is the number of max concurrent SendMetricsAsync calls that can actually make progress.
+	// More calls will block. The current implementation uses maximum 1 call.
+	maxConcurrentSends = 10
+)
+
+// Client is an object that is used to send aggregated metrics to a statsd server, as counters and gauges.
+type Client struct {
+	packetSize       int
+	disableTags      bool
+	disabledSubtypes gostatsd.TimerSubtypes
+	sender           sender.Sender
+}
+
+// overflowHandler is invoked when a packet is full.  It should return a new buffer to be used for the rest of the
+// work, or stop if no more packets should be prepared.
+type overflowHandler func(*bytes.Buffer) (buf *bytes.Buffer, stop bool)
+
+// packer writes lines in to packets of at most packetSize bytes, without splitting a line across packets.  A line
+// which is longer than packetSize is sent in a packet by itself.
+type packer struct {
+	buf        *bytes.Buffer
+	line       []byte
+	packetSize int
+	handler    overflowHandler
+	stopped    bool
+}
+
+func (p *packer) flush() {
+	if p.buf.Len() == 0 || p.stopped {
+		return
+	}
+	buf, stop := p.handler(p.buf)
+	if stop {
+		p.stopped = true
+		return
+	}
+	p.buf = buf
+}
+
+// write adds the line in p.line to the current packet, starting a new packet if it doesn't fit.
+func (p *packer) write() {
+	if p.stopped {
+		return
+	}
+	if p.buf.Len()+len(p.line) > p.packetSize {
+		p.flush()
+		if p.stopped {
+			return
+		}
+	}
+	p.buf.Write(p.line)
+}
+
+func (client *Client) Run(ctx context.Context) {
+	client.sender.Run(ctx)
+}
+
+// SendMetricsAsync flushes the metrics to the statsd server, preparing payload synchronously but doing the send asynchronously.
+func (client *Client) SendMetricsAsync(ctx context.Context, metrics *gostatsd.MetricMap, cb gostatsd.SendCallback) {
+	sink := make(chan *bytes.Buffer, sendChannelSize)
+	select {
+	case <-ctx.Done():
+		cb([]error{ctx.Err()})
+		return
+	case client.sender.Sink <- sender.Stream{Ctx: ctx, Cb: cb, Buf: sink}:
+	}
+	defer close(sink)
+	buf := client.processMetrics(metrics, client.sender.GetBuffer(), func(buf *bytes.Buffer) (*bytes.Buffer, bool) {
+		select {
+		case <-ctx.Done():
+			return nil, true
+		case sink <- buf:
+			return client.sender.GetBuffer(), false
+		}
+	})
+	if buf != nil {
+		client.sender.PutBuffer(buf)
+	}
+}
+
+// processMetrics serializes the metrics in to packets, starting with buf, and passes each full packet to handler.
+// It returns the buffer which was not passed to handler, or nil if handler stopped processing.
+func (client *Client) processMetrics(metrics *gostatsd.MetricMap, buf *bytes.Buffer, handler overflowHandler) *bytes.Buffer {
+	p := &packer{
+		buf:        buf,
+		packetSize: client.packetSize,
+		handler:    handler,
+	}
+	metrics.Counters.Each(func(key, tagsKey string, counter gostatsd.Counter) {
+		client.writeLine(p, key, "", strconv.FormatInt(counter.Value, 10), "c", counter.Tags)
+	})
+	metrics.Gauges.Each(func(key, tagsKey string, gauge gostatsd.Gauge) {
+		client.writeGauge(p, key, "", gauge.Value, gauge.Tags)
+	})
+	metrics.Timers.Each(func(key, tagsKey string, timer gostatsd.Timer) {
+		if timer.Histogram != nil {
+			for histogramThreshold, count := range timer.Histogram {
+				bucketTag := "le:+Inf"
+				if !math.IsInf(float64(histogramThreshold), 1) {
+					bucketTag = "le:" + strconv.FormatFloat(float64(histogramThreshold), 'f', -1, 64)
+				}
+				newTags := timer.Tags.Concat(gostatsd.Tags{bucketTag})
+				client.writeGauge(p, key, "histogram", float64(count), newTags)
+			}
+			return
+		}
+		disabled := timer.EffectiveDisabledSubtypes(client.disabledSubtypes)
+		if !disabled.Lower {
+			client.writeGauge(p, key, "lower", timer.Min, timer.Tags)
+		}
+		if !disabled.Upper {
+			client.writeGauge(p, key, "upper", timer.Max, timer.Tags)
+		}
+		if !disabled.Count {
+			client.writeGauge(p, key, "count", float64(timer.Count), timer.Tags)
+		}
+		if !disabled.CountPerSecond {
+			client.writeGauge(p, key, "count_ps", timer.PerSecond, timer.Tags)
+		}
+		if !disabled.Mean {
+			client.writeGauge(p, key, "mean", timer.Mean, timer.Tags)
+		}
+		if !disabled.Median {
+			client.writeGauge(p, key, "median", timer.Median, timer.Tags)
+		}
+		if !disabled.StdDev {
+			client.writeGauge(p, key, "std", timer.StdDev, timer.Tags)
+		}
+		if !disabled.Sum {
+			client.writeGauge(p, key, "sum", timer.Sum, timer.Tags)
+		}
+		if !disabled.SumSquares {
+			client.writeGauge(p, key, "sum_squares", timer.SumSquares, timer.Tags)
+		}
+		for _, pct := range timer.Percentiles {
+			client.writeGauge(p, key, pct.Str, pct.Float, timer.Tags)
+		}
+	})
+	metrics.Sets.Each(func(key, tagsKey string, set gostatsd.Set) {
+		client.writeGauge(p, key, "", float64(len(set.Values)), set.Tags)
+	})
+	p.flush()
+	if p.stopped {
+		return nil
+	}
+	return p.buf
+}
+
+// writeGauge writes a gauge line.  A gauge with a leading sign is a relative change in the statsd protocol, so a
+// negative gauge is first set to 0 in the same packet, and then decremented.
+func (client *Client) writeGauge(p *packer, name, suffix string, value float64, tags gostatsd.Tags) {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return
+	}
+	if value < 0 {
+		p.line = client.appendLine(p.line[:0], name, suffix, "0", "g", tags)
+		p.line = client.appendLine(p.line, name, suffix, strconv.FormatFloat(value, 'f', -1, 64), "g", tags)
+		p.write()
+		return
+	}
+	client.writeLine(p, name, suffix, strconv.FormatFloat(value, 'f', -1, 64), "g", tags)
+}
+
+func (client *Client) writeLine(p *packer, name, suffix, value, metricType string, tags gostatsd.Tags) {
+	p.line = client.appendLine(p.line[:0], name, suffix, value, metricType, tags)
+	p.write()
+}
+
+// appendLine appends a line in the statsd protocol to line, with tags in the DogStatsD format.
+func (client *Client) appendLine(line []byte, name, suffix, value, metricType string, tags gostatsd.Tags) []byte {
+	line = append(line, name...)
+	if suffix != "" {
+		line = append(line, '.')
+		line = append(line, suffix...)
+	}
+	line = append(line, ':')
+	line = append(line, value...)
+	line = append(line, '|')
+	line = append(line, metricType...)
+	if len(tags) > 0 && !client.disableTags {
+		line = append(line, "|#"...)
+		for i, tag := range tags {
+			if i > 0 {
+				line = append(line, ',')
+			}
+			line = append(line, tag...)
+		}
+	}
+	return append(line, '\n')
+}
+
+// SendEvent discards events.
+func (client *Client) SendEvent(ctx context.Context, e *gostatsd.Event) error {
+	return nil
+}
+
+// Name returns the name of the backend.
+func (client *Client) Name() string {
+	return BackendName
+}
+
+// NewClient constructs a new statsd backend client.  A packetSize of 0 uses the default for the network.
+func NewClient(
+	address string,
+	network string,
+	dialTimeout time.Duration,
+	writeTimeout time.Duration,
+	packetSize int,
+	disableTags bool,
+	disabled gostatsd.TimerSubtypes,
+	logger logrus.FieldLogger,
+) (*Client, error) {
+	if address == "" {
+		return nil, fmt.Errorf("[%s] address is required", BackendName)
+	}
+	if dialTimeout <= 0 {
+		return nil, fmt.Errorf("[%s] dialTimeout should be positive", BackendName)
+	}
+	if writeTimeout < 0 {
+		return nil, fmt.Errorf("[%s] writeTimeout should be non-negative", BackendName)
+	}
+	if packetSize < 0 {
+		return nil, fmt.Errorf("[%s] packetSize should be non-negative", BackendName)
+	}
+	switch network {
+	case "udp":
+		if packetSize == 0 {
+			packetSize = DefaultUDPPacketSize
+		}
+	case "tcp":
+		if packetSize == 0 {
+			packetSize = DefaultTCPPacketSize
+		}
+	default:
+		return nil, fmt.Errorf("[%s] network must be one of 'udp' or 'tcp'", BackendName)
+	}
+	logger.WithFields(logrus.Fields{
+		"address":       address,
+		"network":       network,
+		"dial-timeout":  dialTimeout,
+		"write-timeout": writeTimeout,
+		"packet-size":   packetSize,
+	}).Info("created backend")
+
+	return &Client{
+		packetSize:       packetSize,
+		disableTags:      disableTags,
+		disabledSubtypes: disabled,
+		sender: sender.Sender{
+			Logger: logger,
+			ConnFactory: func() (net.Conn, error) {
+				return net.DialTimeout(network, address, dialTimeout)
+			},
+			Sink: make(chan sender.Stream, maxConcurrentSends),
+			BufPool: sync.Pool{
+				New: func() interface{} {
+					buf := new(bytes.Buffer)
+					buf.Grow(packetSize)
+					return buf
+				},
+			},
+			WriteTimeout: writeTimeout,
+		},
+	}, nil
+}
+
+// NewClientFromViper constructs a statsd client using configuration provided by Viper.
+func NewClientFromViper(v *viper.Viper, logger logrus.FieldLogger, pool *transport.TransportPool) (gostatsd.Backend, error) {
+	g := util.GetSubViper(v, "statsd")
+	g.SetDefault("network", DefaultNetwork)
+	g.SetDefault("dial_timeout", DefaultDialTimeout)
+	g.SetDefault("write_timeout", DefaultWriteTimeout)
+	g.SetDefault("packet_size", 0)
+	g.SetDefault("disable_tags", false)
+	return NewClient(
+		g.GetString("address"),
+		g.GetString("network"),
+		g.GetDuration("dial_timeout"),
+		g.GetDuration("write_timeout"),
+		g.GetInt("packet_size"),
+		g.GetBool("disable_tags"),
+		gostatsd.DisabledSubMetrics(v),
+		logger,
+	)
+}
@@ -0,0 +1,232 @@
+package statsd
+
+import (
+	"bytes"
+	"context"
+	"math"
+	"net"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/atlassian/gostatsd"
+)
+
+func newTestClient(t *testing.T, packetSize int, disableTags bool, disabled gostatsd.TimerSubtypes) *Client {
+	c, err := NewClient("localhost:8125", "udp", 1*time.Second, 1*time.Second, packetSize, disableTags, disabled, logrus.New())
+	require.NoError(t, err)
+	return c
+}
+
+// collectPackets returns every packet the client prepares for mm, and checks the final buffer is returned.
+func collectPackets(t *testing.T, c *Client, mm *gostatsd.MetricMap) []string {
+	var packets []string
+	buf := c.processMetrics(mm, new(bytes.Buffer), func(buf *bytes.Buffer) (*bytes.Buffer, bool) {
+		packets = append(packets, buf.String())
+		return new(bytes.Buffer), false
+	})
+	require.NotNil(t, buf)
+	assert.Zero(t, buf.Len())
+	return packets
+}
+
+func sortedLines(packets []string) []string {
+	var lines []string
+	for _, packet := range packets {
+		lines = append(lines, strings.Split(strings.TrimSuffix(packet, "\n"), "\n")...)
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+func TestProcessMetricsCounter(t *testing.T) {
+	t.Parallel()
+	mm := gostatsd.NewMetricMap()
+	mm.Counters["c"] = map[string]gostatsd.Counter{
+		"":    {Value: 5, PerSecond: 0.5},
+		"a:b": {Value: 7, PerSecond: 0.7, Tags: gostatsd.Tags{"a:b", "c"}},
+	}
+	packets := collectPackets(t, newTestClient(t, 0, false, gostatsd.TimerSubtypes{}), mm)
+	assert.Equal(t, []string{"c:5|c", "c:7|c|#a:b,c"}, sortedLines(packets))
+}
+
+func TestProcessMetricsGauge(t *testing.T) {
+	t.Parallel()
+	mm := gostatsd.NewMetricMap()
+	mm.Gauges["g"] = map[string]gostatsd.Gauge{"": {Value: 1.25}}
+	mm.Gauges["nan"] = map[string]gostatsd.Gauge{"": {Value: math.NaN()}}
+	packets := collectPackets(t, newTestClient(t, 0, false, gostatsd.TimerSubtypes{}), mm)
+	assert.Equal(t, []string{"g:1.25|g\n"}, packets)
+}
+
+func TestProcessMetricsNegativeGauge(t *testing.T) {
+	t.Parallel()
+	mm := gostatsd.NewMetricMap()
+	mm.Gauges["g"] = map[string]gostatsd.Gauge{"a:b": {Value: -3, Tags: gostatsd.Tags{"a:b"}}}
+	packets := collectPackets(t, newTestClient(t, 0, false, gostatsd.TimerSubtypes{}), mm)
+	assert.Equal(t, []string{"g:0|g|#a:b\ng:-3|g|#a:b\n"}, packets)
+}
+
+func TestProcessMetricsTimer(t *testing.T) {
+	t.Parallel()
+	mm := gostatsd.NewMetricMap()
+	mm.Timers["t"] = map[string]gostatsd.Timer{"": {
+		Values:      []float64{10, 20},
+		Min:         10,
+		Max:         20,
+		Count:       2,
+		PerSecond:   0.2,
+		Mean:        15,
+		Median:      15,
+		StdDev:      5,
+		Sum:         30,
+		SumSquares:  500,
+		Percentiles: gostatsd.Percentiles{{Float: 20, Str: "upper_90"}},
+	}}
+	packets := collectPackets(t, newTestClient(t, 0, false, gostatsd.TimerSubtypes{}), mm)
+	expected := []string{
+		"t.count:2|g",
+		"t.count_ps:0.2|g",
+		"t.lower:10|g",
+		"t.mean:15|g",
+		"t.median:15|g",
+		"t.std:5|g",
+		"t.sum:30|g",
+		"t.sum_squares:500|g",
+		"t.upper:20|g",
+		"t.upper_90:20|g",
+	}
+	assert.Equal(t, expected, sortedLines(packets))
+}
+
+func TestProcessMetricsTimerDisabledSubtypes(t *testing.T) {
+	t.Parallel()
+	mm := gostatsd.NewMetricMap()
+	mm.Timers["t"] = map[string]gostatsd.Timer{"": {Values: []float64{10}, Min: 10, Max: 10, Count: 1}}
+	disabled := gostatsd.TimerSubtypes{
+		CountPerSecond: true,
+		Mean:           true,
+		Median:         true,
+		StdDev:         true,
+		Sum:            true,
+		SumSquares:     true,
+		Upper:          true,
+	}
+	packets := collectPackets(t, newTestClient(t, 0, false, disabled), mm)
+	assert.Equal(t, []string{"t.count:1|g", "t.lower:10|g"}, sortedLines(packets))
+}
+
+func TestProcessMetricsHistogram(t *testing.T) {
+	t.Parallel()
+	mm := gostatsd.NewMetricMap()
+	mm.Timers["t"] = map[string]gostatsd.Timer{"gsd_histogram:20": {
+		Values: []float64{10},
+		Tags:   gostatsd.Tags{"gsd_histogram:20"},
+		Histogram: map[gostatsd.HistogramThreshold]int{
+			20:                                       1,
+			gostatsd.HistogramThreshold(math.Inf(1)): 1,
+		},
+	}}
+	packets := collectPackets(t, newTestClient(t, 0, false, gostatsd.TimerSubtypes{}), mm)
+	expected := []string{
+		"t.histogram:1|g|#gsd_histogram:20,le:+Inf",
+		"t.histogram:1|g|#gsd_histogram:20,le:20",
+	}
+	assert.Equal(t, expected, sortedLines(packets))
+}
+
+func TestProcessMetricsSet(t *testing.T) {
+	t.Parallel()
+	mm := gostatsd.NewMetricMap()
+	mm.Sets["s"] = map[string]gostatsd.Set{"a:b": {
+		Values: map[string]struct{}{"x": {}, "y": {}, "z": {}},
+		Tags:   gostatsd.Tags{"a:b"},
+	}}
+	packets := collectPackets(t, newTestClient(t, 0, true, gostatsd.TimerSubtypes{}), mm)
+	assert.Equal(t, []string{"s:3|g\n"}, packets)
+}
+
+func TestProcessMetricsPacketSize(t *testing.T) {
+	t.Parallel()
+	mm := gostatsd.NewMetricMap()
+	for _, name := range []string{"aaaa", "bbbb", "cccc", "dddd", "eeee"} {
+		mm.Counters[name] = map[string]gostatsd.Counter{"": {Value: 1}}
+	}
+	mm.Counters[strings.Repeat("l", 30)] = map[string]gostatsd.Counter{"": {Value: 1}}
+	mm.Gauges["g"] = map[string]gostatsd.Gauge{"": {Value: -1}}
+
+	// Each short counter is 9 bytes, so at most two fit in a packet
+	packets := collectPackets(t, newTestClient(t, 20, false, gostatsd.TimerSubtypes{}), mm)
+	for _, packet := range packets {
+		require.True(t, strings.HasSuffix(packet, "\n"))
+		if strings.HasPrefix(packet, "lll") {
+			// A line which doesn't fit is sent by itself
+			assert.Equal(t, strings.Repeat("l", 30)+":1|c\n", packet)
+		} else {
+			assert.LessOrEqual(t, len(packet), 20, packet)
+		}
+	}
+	assert.Contains(t, packets, "g:0|g\ng:-1|g\n")
+	assert.Len(t, sortedLines(packets), 8)
+}
+
+func TestProcessMetricsStop(t *testing.T) {
+	t.Parallel()
+	mm := gostatsd.NewMetricMap()
+	for _, name := range []string{"aaaa", "bbbb", "cccc"} {
+		mm.Counters[name] = map[string]gostatsd.Counter{"": {Value: 1}}
+	}
+	calls := 0
+	buf := newTestClient(t, 10, false, gostatsd.TimerSubtypes{}).processMetrics(mm, new(bytes.Buffer), func(buf *bytes.Buffer) (*bytes.Buffer, bool) {
+		calls++
+		return nil, true
+	})
+	assert.Nil(t, buf)
+	assert.Equal(t, 1, calls)
+}
+
+func TestNewClientErrors(t *testing.T) {
+	t.Parallel()
+	_, err := NewClient("", "udp", time.Second, time.Second, 0, false, gostatsd.TimerSubtypes{}, logrus.New())
+	assert.Error(t, err)
+	_, err = NewClient("localhost:8125", "unix", time.Second, time.Second, 0, false, gostatsd.TimerSubtypes{}, logrus.New())
+	assert.Error(t, err)
+	_, err = NewClient("localhost:8125", "udp", time.Second, time.Second, -1, false, gostatsd.TimerSubtypes{}, logrus.New())
+	assert.Error(t, err)
+
+	c, err := NewClient("localhost:8125", "tcp", time.Second, time.Second, 0, false, gostatsd.TimerSubtypes{}, logrus.New())
+	require.NoError(t, err)
+	assert.Equal(t, DefaultTCPPacketSize, c.packetSize)
+}
+
+func TestSendMetricsAsyncUDP(t *testing.T) {
+	t.Parallel()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	c, err := NewClient(conn.LocalAddr().String(), "udp", time.Second, time.Second, 0, false, gostatsd.TimerSubtypes{}, logrus.New())
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.Run(ctx)
+
+	mm := gostatsd.NewMetricMap()
+	mm.Counters["c"] = map[string]gostatsd.Counter{"": {Value: 5}}
+	errs := make(chan []error, 1)
+	c.SendMetricsAsync(ctx, mm, func(e []error) {
+		errs <- e
+	})
+	assert.Empty(t, <-errs)
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	b := make([]byte, DefaultUDPPacketSize)
+	n, _, err := conn.ReadFrom(b)
+	require.NoError(t, err)
+	assert.Equal(t, "c:5|c\n", string(b[:n]))
+}
@@ -39,9 +39,10 @@ const (
 
 // Client is an object that is used to send messages to a statsd server's UDP or TCP interface.
 type Client struct {
-	packetSize  int
-	disableTags bool
-	sender      sender.Sender
+	packetSize          int
+	disableTags         bool
+	preserveSampleRates bool // Send counters and timers with their sampling rate, rather than scaled up
+	sender              sender.Sender
 }
 
 // overflowHandler is invoked when accumulated packed size has reached it's limit.
@@ -110,13 +111,33 @@ func (client *Client) processMetrics(metrics *gostatsd.MetricMap, handler overfl
 	}
 	metrics.Counters.Each(func(key, tagsKey string, counter gostatsd.Counter) {
 		// do not send statsd stats as they will be recalculated on the master instead
-		if !strings.HasPrefix(key, "statsd.") {
-			writeLine("%s:%d|c", key, tagsKey, counter.Value)
+		if strings.HasPrefix(key, "statsd.") {
+			return
 		}
+		if client.preserveSampleRates {
+			if value, rate := counter.UnscaledValue(); rate < 1 {
+				writeLine("%s:%s|c"+sampleRateSuffix(rate), key, tagsKey, strconv.FormatFloat(value, 'f', -1, 64))
+				return
+			}
+		}
+		writeLine("%s:%d|c", key, tagsKey, counter.Value)
 	})
 	metrics.Timers.Each(func(key, tagsKey string, timer gostatsd.Timer) {
+		format := "%s:%f|ms"
+		if client.preserveSampleRates && timer.SampledCount > 0 {
+			if rate := float64(len(timer.Values)) / timer.SampledCount; rate < 1 {
+				format += sampleRateSuffix(rate)
+			}
+		}
 		for _, tr := range timer.Values {
-			writeLine("%s:%f|ms", key, tagsKey, tr)
+			writeLine(format, key, tagsKey, tr)
+		}
+		if len(timer.Values) == 0 && timer.Digest != nil {
+			// A timer forwarded as a t-digest has no values, so each centroid is sent as its mean, with the sample
+			// rate of its weight, so the receiving server counts every sample in it.
+			for _, c := range timer.Digest.Centroids() {
+				writeLine("%s:%f|ms"+sampleRateSuffix(1/c.Weight), key, tagsKey, c.Mean)
+			}
 		}
 	})
 	metrics.Gauges.Each(func(key, tagsKey string, gauge gostatsd.Gauge) {
@@ -135,6 +156,11 @@ func (client *Client) processMetrics(metrics *gostatsd.MetricMap, handler overfl
 	}
 }
 
+// sampleRateSuffix returns the suffix of a line for a sampling rate.
+func sampleRateSuffix(rate float64) string {
+	return "|@" + strconv.FormatFloat(rate, 'g', 6, 64)
+}
+
 // SendEvent sends events to the statsd master server.
 func (client *Client) SendEvent(ctx context.Context, e *gostatsd.Event) error {
 	conn, err := client.sender.ConnFactory()
@@ -196,8 +222,9 @@ func constructEventMessage(e *gostatsd.Event) *bytes.Buffer {
 	return &buf
 }
 
-// NewClient constructs a new statsd backend client.
-func NewClient(address string, dialTimeout, writeTimeout time.Duration, disableTags, tcpTransport bool, tlsConfig *tls.Config, logger logrus.FieldLogger) (*Client, error) {
+// NewClient constructs a new statsd backend client.  If preserveSampleRates is true, sampled counters and timers are
+// sent with their sampling rate, rather than scaled up.
+func NewClient(address string, dialTimeout, writeTimeout time.Duration, disableTags, tcpTransport, preserveSampleRates bool, tlsConfig *tls.Config, logger logrus.FieldLogger) (*Client, error) {
 	if address == "" {
 		return nil, fmt.Errorf("[%s] address is required", BackendName)
 	}
@@ -208,9 +235,10 @@ func NewClient(address string, dialTimeout, writeTimeout time.Duration, disableT
 		return nil, fmt.Errorf("[%s] writeTimeout should be non-negative", BackendName)
 	}
 	logger.WithFields(logrus.Fields{
-		"address":       address,
-		"dial-timeout":  dialTimeout,
-		"write-timeout": writeTimeout,
+		"address":               address,
+		"dial-timeout":          dialTimeout,
+		"write-timeout":         writeTimeout,
+		"preserve-sample-rates": preserveSampleRates,
 	}).Info("created backend")
 
 	var packetSize int
@@ -239,8 +267,9 @@ func NewClient(address string, dialTimeout, writeTimeout time.Duration, disableT
 		}
 	}
 	return &Client{
-		packetSize:  packetSize,
-		disableTags: disableTags,
+		packetSize:          packetSize,
+		disableTags:         disableTags,
+		preserveSampleRates: preserveSampleRates,
 		sender: sender.Sender{
 			Logger:      logger,
 			ConnFactory: connFactory,
@@ -265,6 +294,7 @@ func NewClientFromViper(v *viper.Viper, logger logrus.FieldLogger, pool *transpo
 	g.SetDefault("disable_tags", false)
 	g.SetDefault("tcp_transport", false)
 	g.SetDefault("tls_transport", false)
+	g.SetDefault("preserve_sample_rates", false)
 	maybeTLSConfig, err := getTLSConfiguration(
 		g.GetString("tls_ca_path"),
 		g.GetString("tls_cert_path"),
@@ -279,6 +309,7 @@ func NewClientFromViper(v *viper.Viper, logger logrus.FieldLogger, pool *transpo
 		g.GetDuration("write_timeout"),
 		g.GetBool("disable_tags"),
 		g.GetBool("tcp_transport"),
+		g.GetBool("preserve_sample_rates"),
 		maybeTLSConfig,
 		logger,
 	)
@@ -288,3 +319,8 @@ func NewClientFromViper(v *viper.Viper, logger logrus.FieldLogger, pool *transpo
 func (client *Client) Name() string {
 	return BackendName
 }
+
+// RawTimers returns true, as timers are sent as the raw samples to be aggregated by the receiving server.
+func (client *Client) RawTimers() bool {
+	return true
+}
@@ -13,6 +13,7 @@ import (
 	"github.com/stretchr/testify/require"
 
 	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/tdigest"
 )
 
 var longName = strings.Repeat("t", maxUDPPacketSize-5)
@@ -26,7 +27,7 @@ var m = gostatsd.MetricMap{
 
 func TestProcessMetricsRecover(t *testing.T) {
 	t.Parallel()
-	c, err := NewClient("localhost:8125", 1*time.Second, 1*time.Second, false, false, nil, logrus.New())
+	c, err := NewClient("localhost:8125", 1*time.Second, 1*time.Second, false, false, false, nil, logrus.New())
 	require.NoError(t, err)
 	c.processMetrics(&m, func(buf *bytes.Buffer) (*bytes.Buffer, bool) {
 		return nil, true
@@ -35,7 +36,7 @@ func TestProcessMetricsRecover(t *testing.T) {
 
 func TestProcessMetricsPanic(t *testing.T) {
 	t.Parallel()
-	c, err := NewClient("localhost:8125", 1*time.Second, 1*time.Second, false, false, nil, logrus.New())
+	c, err := NewClient("localhost:8125", 1*time.Second, 1*time.Second, false, false, false, nil, logrus.New())
 	require.NoError(t, err)
 	expectedErr := errors.New("ABC some error")
 	defer func() {
@@ -78,7 +79,7 @@ func TestProcessMetrics(t *testing.T) {
 		val := val
 		t.Run(fmt.Sprintf("disableTags: %t", val.disableTags), func(t *testing.T) {
 			t.Parallel()
-			c, err := NewClient("localhost:8125", 1*time.Second, 1*time.Second, val.disableTags, false, nil, logrus.New())
+			c, err := NewClient("localhost:8125", 1*time.Second, 1*time.Second, val.disableTags, false, false, nil, logrus.New())
 			require.NoError(t, err)
 			c.processMetrics(&gaugeMetic, func(buf *bytes.Buffer) (*bytes.Buffer, bool) {
 				assert.EqualValues(t, val.expectedValue, buf.String())
@@ -87,3 +88,55 @@ func TestProcessMetrics(t *testing.T) {
 		})
 	}
 }
+
+func TestProcessMetricsSampleRates(t *testing.T) {
+	t.Parallel()
+	mm := gostatsd.NewMetricMap()
+	mm.Receive(&gostatsd.Metric{Name: "counter", Type: gostatsd.COUNTER, Value: 5, Rate: 0.1, Tags: gostatsd.Tags{"tag1"}, TagsKey: "tag1"})
+	mm.Receive(&gostatsd.Metric{Name: "timer", Type: gostatsd.TIMER, Value: 2, Rate: 0.1})
+	mm.Receive(&gostatsd.Metric{Name: "unsampled", Type: gostatsd.COUNTER, Value: 3, Rate: 1})
+	input := []struct {
+		preserveSampleRates bool
+		expectedLines       []string
+	}{
+		{
+			preserveSampleRates: false,
+			expectedLines:       []string{"counter:50|c|#tag1", "timer:2.000000|ms", "unsampled:3|c"},
+		},
+		{
+			preserveSampleRates: true,
+			expectedLines:       []string{"counter:5|c|@0.1|#tag1", "timer:2.000000|ms|@0.1", "unsampled:3|c"},
+		},
+	}
+	for _, val := range input {
+		val := val
+		t.Run(fmt.Sprintf("preserveSampleRates: %t", val.preserveSampleRates), func(t *testing.T) {
+			t.Parallel()
+			c, err := NewClient("localhost:8125", 1*time.Second, 1*time.Second, false, false, val.preserveSampleRates, nil, logrus.New())
+			require.NoError(t, err)
+			var lines []string
+			c.processMetrics(mm, func(buf *bytes.Buffer) (*bytes.Buffer, bool) {
+				lines = append(lines, strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")...)
+				return new(bytes.Buffer), false
+			})
+			assert.ElementsMatch(t, val.expectedLines, lines)
+		})
+	}
+}
+
+func TestProcessMetricsDigestTimers(t *testing.T) {
+	t.Parallel()
+	td, err := tdigest.FromCentroids(tdigest.DefaultCompression, 1, 5, 7, 27, []tdigest.Centroid{{Mean: 1, Weight: 2}, {Mean: 5, Weight: 1}})
+	require.NoError(t, err)
+	mm := gostatsd.NewMetricMap()
+	mm.Timers["timer"] = map[string]gostatsd.Timer{"": {Digest: td, SampledCount: 3}}
+
+	c, err := NewClient("localhost:8125", 1*time.Second, 1*time.Second, false, false, false, nil, logrus.New())
+	require.NoError(t, err)
+	var lines []string
+	c.processMetrics(mm, func(buf *bytes.Buffer) (*bytes.Buffer, bool) {
+		lines = append(lines, strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")...)
+		return new(bytes.Buffer), false
+	})
+	assert.ElementsMatch(t, []string{"timer:1.000000|ms|@0.5", "timer:5.000000|ms|@1"}, lines)
+}
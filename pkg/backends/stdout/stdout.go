@@ -93,6 +93,7 @@ func preparePayload(metrics *gostatsd.MetricMap, disabled *gostatsd.TimerSubtype
 				fmt.Fprintf(buf, "stats.timers.%s.histogram.%s %d %d\n", nk, bucketTag, count, now) // #nosec
 			}
 		} else {
+			disabled := timer.EffectiveDisabledSubtypes(*disabled)
 			if !disabled.Lower {
 				fmt.Fprintf(buf, "stats.timers.%s.lower %f %d\n", nk, timer.Min, now) // #nosec
 			}
@@ -16,7 +16,7 @@ import (
 )
 
 func NewCachedCloudProvider(logger logrus.FieldLogger, limiter *rate.Limiter, cloudProvider gostatsd.CloudProvider, cacheOpts gostatsd.CacheOptions) *CachedCloudProvider {
-	return &CachedCloudProvider{
+	ccp := &CachedCloudProvider{
 		logger:         logger,
 		limiter:        limiter,
 		cloudProvider:  cloudProvider,
@@ -25,7 +25,28 @@ func NewCachedCloudProvider(logger logrus.FieldLogger, limiter *rate.Limiter, cl
 		infoSinkSource: make(chan gostatsd.InstanceInfo),
 		emitChan:       make(chan stats.Statser),
 		cache:          make(map[gostatsd.Source]*instanceHolder),
+		evictionQueue:  newEvictionQueue(),
+		lookups:        make(map[gostatsd.Source]struct{}),
+		toPin:          make(map[gostatsd.Source]struct{}),
 	}
+	now := time.Now()
+	for ip, instance := range cacheOpts.PinnedInstances {
+		if instance == nil {
+			// Pinned once it's found
+			ccp.toPin[ip] = struct{}{}
+			ccp.lookup(ip)
+			continue
+		}
+		ccp.cache[ip] = &instanceHolder{
+			lastAccessNano: now.UnixNano(),
+			resolved:       now,
+			instance:       instance,
+			pinned:         true,
+		}
+		ccp.statsCachePositive++
+		ccp.statsCachePinned++
+	}
+	return ccp
 }
 
 type CachedCloudProvider struct {
@@ -34,6 +55,13 @@ type CachedCloudProvider struct {
 	statsCacheRefreshNegative uint64 // Cumulative number of negative refreshes (ie, a refresh which failed and used old data)
 	statsCachePositive        uint64 // Absolute number of positive entries in cache
 	statsCacheNegative        uint64 // Absolute number of negative entries in cache
+	statsLookupsCoalesced     uint64 // Cumulative number of lookups which weren't made, as the IP was already being looked up
+	statsCacheLifetimeExpired uint64 // Cumulative number of entries expired because they passed the max lifetime
+	statsCacheInstanceChanged uint64 // Cumulative number of entries replaced because the ID of the instance changed
+	statsCachePinned          uint64 // Absolute number of pinned entries in cache
+	statsCacheBackoff         uint64 // Absolute number of entries whose negative TTL is extended by consecutive failures
+	statsCacheSize            uint64 // Absolute number of entries in cache, sampled every refresh
+	statsCacheForcedEvictions uint64 // Cumulative number of entries evicted because the cache was full
 
 	logger         logrus.FieldLogger
 	limiter        *rate.Limiter
@@ -41,6 +69,8 @@ type CachedCloudProvider struct {
 	cacheOpts      gostatsd.CacheOptions
 	ipSinkSource   chan gostatsd.Source
 	infoSinkSource chan gostatsd.InstanceInfo
+	// lookupDispatcher is set by Run, and may only be used by it
+	lookupDispatcher *cloudProviderLookupDispatcher
 
 	// emitChan triggers a write of all the current stats when it is given a Statser
 	emitChan     chan stats.Statser
@@ -48,6 +78,13 @@ type CachedCloudProvider struct {
 	cache        map[gostatsd.Source]*instanceHolder
 	toLookupIPs  []gostatsd.Source
 	toReturnInfo []gostatsd.InstanceInfo
+	// lookups has the IPs which are waiting to be looked up, or being looked up, so each IP is only looked up once at a
+	// time, whether it is a refresh or a new IP.
+	lookups map[gostatsd.Source]struct{}
+	// toPin has the pinned IPs without an instance, which are pinned to the first instance found for them.
+	toPin map[gostatsd.Source]struct{}
+	// evictionQueue has the unpinned entries of cache, in the order they're evicted when it's full.
+	evictionQueue *evictionQueue
 }
 
 func (ccp *CachedCloudProvider) Run(ctx context.Context) {
@@ -62,14 +99,21 @@ func (ccp *CachedCloudProvider) Run(ctx context.Context) {
 	// this goroutine needs to populate/update the cache so an intermediate InstanceInfo channel is used below that allows
 	// to intercept, update the cache and then push the information through to the cache consumer.
 	ownInfoSource := make(chan gostatsd.InstanceInfo)
-	ld := cloudProviderLookupDispatcher{
+	// Likewise, an intermediate IP channel allows IPs which are already being looked up to be skipped.
+	ownIPSink := make(chan gostatsd.Source)
+	ld := &cloudProviderLookupDispatcher{
 		logger:        ccp.logger,
 		limiter:       ccp.limiter,
 		cloudProvider: ccp.cloudProvider,
-		ipSource:      ccp.ipSinkSource, // our sink is their source
-		infoSink:      ownInfoSource,    // their sink is our source
+		maxLookups:    ccp.cacheOpts.MaxConcurrentLookups,
+		retries:       ccp.cacheOpts.LookupRetries,
+		retryBackoff:  ccp.cacheOpts.LookupRetryBackoff,
+		ipSource:      ownIPSink,     // our sink is their source
+		infoSink:      ownInfoSource, // their sink is our source
 	}
 
+	ccp.lookupDispatcher = ld
+
 	defer wg.Wait() // Wait for cloudProviderLookupDispatcher to stop
 
 	ctx, cancel := context.WithCancel(ctx)
@@ -85,6 +129,21 @@ func (ccp *CachedCloudProvider) Run(ctx context.Context) {
 	// When we mutate the cache, we hold the exclusive (write) lock to avoid concurrent reads.
 	// When we read from the cache from other goroutines in the Peek() method, we obtain the read lock.
 	for {
+		// Anything queued before Run starts, such as pinned IPs to look up, is sent on the first iteration
+		if toLookupC == nil && len(ccp.toLookupIPs) > 0 {
+			last := len(ccp.toLookupIPs) - 1
+			toLookupIP = ccp.toLookupIPs[last]
+			ccp.toLookupIPs[last] = gostatsd.UnknownSource // enable GC
+			ccp.toLookupIPs = ccp.toLookupIPs[:last]
+			toLookupC = ownIPSink
+		}
+		if toReturnInfoC == nil && len(ccp.toReturnInfo) > 0 {
+			last := len(ccp.toReturnInfo) - 1
+			toReturnInfo = ccp.toReturnInfo[last]
+			ccp.toReturnInfo[last] = gostatsd.InstanceInfo{} // enable GC
+			ccp.toReturnInfo = ccp.toReturnInfo[:last]
+			toReturnInfoC = ccp.infoSinkSource
+		}
 		select {
 		case <-ctx.Done():
 			return
@@ -94,6 +153,8 @@ func (ccp *CachedCloudProvider) Run(ctx context.Context) {
 		case toReturnInfoC <- toReturnInfo:
 			toReturnInfo = gostatsd.InstanceInfo{} // enable GC
 			toReturnInfoC = nil                    // info has been sent; if there is nothing to send, the case is disabled
+		case ip := <-ccp.ipSinkSource:
+			ccp.lookup(ip)
 		case info := <-ownInfoSource:
 			ccp.handleInstanceInfo(info)
 		case t := <-refreshTicker.C:
@@ -101,20 +162,6 @@ func (ccp *CachedCloudProvider) Run(ctx context.Context) {
 		case statser := <-ccp.emitChan:
 			ccp.emit(statser)
 		}
-		if toLookupC == nil && len(ccp.toLookupIPs) > 0 {
-			last := len(ccp.toLookupIPs) - 1
-			toLookupIP = ccp.toLookupIPs[last]
-			ccp.toLookupIPs[last] = gostatsd.UnknownSource // enable GC
-			ccp.toLookupIPs = ccp.toLookupIPs[:last]
-			toLookupC = ccp.ipSinkSource
-		}
-		if toReturnInfoC == nil && len(ccp.toReturnInfo) > 0 {
-			last := len(ccp.toReturnInfo) - 1
-			toReturnInfo = ccp.toReturnInfo[last]
-			ccp.toReturnInfo[last] = gostatsd.InstanceInfo{} // enable GC
-			ccp.toReturnInfo = ccp.toReturnInfo[:last]
-			toReturnInfoC = ccp.infoSinkSource
-		}
 	}
 }
 
@@ -176,52 +223,141 @@ func (ccp *CachedCloudProvider) emit(statser stats.Statser) {
 	statser.Gauge("cloudprovider.cache_negative", float64(ccp.statsCacheNegative), nil)
 	statser.Gauge("cloudprovider.cache_refresh_positive", float64(ccp.statsCacheRefreshPositive), nil)
 	statser.Gauge("cloudprovider.cache_refresh_negative", float64(ccp.statsCacheRefreshNegative), nil)
+	statser.Gauge("cloudprovider.lookups_coalesced", float64(ccp.statsLookupsCoalesced), nil)
+	statser.Gauge("cloudprovider.cache_lifetime_expired", float64(ccp.statsCacheLifetimeExpired), nil)
+	statser.Gauge("cloudprovider.cache_instance_changed", float64(ccp.statsCacheInstanceChanged), nil)
+	statser.Gauge("cloudprovider.cache_pinned", float64(ccp.statsCachePinned), nil)
+	statser.Gauge("cloudprovider.cache_negative_backoff", float64(ccp.statsCacheBackoff), nil)
+	statser.Gauge("cloudprovider.cache_size", float64(ccp.statsCacheSize), nil)
+	statser.Gauge("cloudprovider.cache_forced_evictions", float64(ccp.statsCacheForcedEvictions), nil)
+	if ccp.lookupDispatcher != nil {
+		ccp.lookupDispatcher.emit(statser)
+	}
+}
+
+// lookup queues ip to be looked up, unless it is already being looked up, in which case the result of that lookup is
+// used instead.
+func (ccp *CachedCloudProvider) lookup(ip gostatsd.Source) {
+	if _, ok := ccp.lookups[ip]; ok {
+		ccp.statsLookupsCoalesced++
+		return
+	}
+	ccp.lookups[ip] = struct{}{}
+	ccp.toLookupIPs = append(ccp.toLookupIPs, ip)
 }
 
 func (ccp *CachedCloudProvider) doRefresh(t time.Time) {
 	var toDelete []gostatsd.Source
 	now := t.UnixNano()
 	idleNano := ccp.cacheOpts.CacheEvictAfterIdlePeriod.Nanoseconds()
+	maxLifetime := ccp.cacheOpts.CacheMaxLifetime
 
 	for ip, holder := range ccp.cache {
-		if now-holder.lastAccess() > idleNano {
-			// Entry was not used recently, remove it.
+		if holder.pinned {
+			continue
+		}
+		idle := now-holder.lastAccess() > idleNano
+		// An instance which has passed its max lifetime may belong to an IP which has been reused, so it's removed and
+		// looked up again, without falling back to it if the lookup fails.
+		pastLifetime := !idle && maxLifetime > 0 && holder.instance != nil && t.Sub(holder.resolved) > maxLifetime
+		if idle || pastLifetime {
+			// Entry was not used recently, or is too old to trust, remove it.
 			toDelete = append(toDelete, ip)
 			if holder.instance == nil {
 				ccp.statsCacheNegative--
 			} else {
 				ccp.statsCachePositive--
 			}
+			if holder.backoff {
+				ccp.statsCacheBackoff--
+			}
+			if pastLifetime {
+				ccp.statsCacheLifetimeExpired++
+				ccp.lookup(ip)
+			}
 		} else if t.After(holder.expires) {
 			// Entry needs a refresh.
-			ccp.toLookupIPs = append(ccp.toLookupIPs, ip)
+			ccp.lookup(ip)
 		}
 	}
 
 	if len(toDelete) > 0 {
 		ccp.rw.Lock()
-		defer ccp.rw.Unlock()
 		for _, ip := range toDelete {
 			delete(ccp.cache, ip)
+			ccp.evictionQueue.remove(ip)
+		}
+		ccp.rw.Unlock()
+	}
+	ccp.statsCacheSize = uint64(len(ccp.cache))
+
+	// Pinned IPs which haven't been found are looked up until they are, even if nothing is sent from them
+	for ip := range ccp.toPin {
+		_, cached := ccp.cache[ip]
+		_, inFlight := ccp.lookups[ip]
+		if !cached && !inFlight {
+			ccp.lookup(ip)
 		}
 	}
 }
 
 func (ccp *CachedCloudProvider) handleInstanceInfo(info gostatsd.InstanceInfo) {
+	delete(ccp.lookups, info.IP)
+	currentHolder := ccp.cache[info.IP]
+	if currentHolder != nil && currentHolder.pinned {
+		// A pinned instance is never replaced, and is returned for any lookup of its IP
+		info.Instance = currentHolder.instance
+		ccp.toReturnInfo = append(ccp.toReturnInfo, info)
+		return
+	}
 	var ttl time.Duration
+	failures := 0
 	if info.Instance == nil {
-		ttl = ccp.cacheOpts.CacheNegativeTTL
+		if currentHolder != nil {
+			failures = currentHolder.failures
+		}
+		failures++
+		ttl = ccp.negativeTTL(failures)
 	} else {
 		ttl = ccp.cacheOpts.CacheTTL
 	}
 	now := time.Now()
 	newHolder := &instanceHolder{
 		expires:  now.Add(ttl),
+		resolved: now,
 		instance: info.Instance,
+		failures: failures,
+		backoff:  failures > 0 && ttl > ccp.cacheOpts.CacheNegativeTTL,
 	}
-	currentHolder := ccp.cache[info.IP]
-	if currentHolder == nil {
-		// Not in cache, count it
+	if currentHolder != nil && currentHolder.backoff {
+		ccp.statsCacheBackoff--
+	}
+	if newHolder.backoff {
+		ccp.statsCacheBackoff++
+	}
+	if _, ok := ccp.toPin[info.IP]; ok && info.Instance != nil {
+		ccp.logger.WithFields(logrus.Fields{
+			"ip":       info.IP,
+			"instance": info.Instance.ID,
+		}).Info("Pinned instance")
+		delete(ccp.toPin, info.IP)
+		newHolder.pinned = true
+		ccp.statsCachePinned++
+	}
+	if currentHolder != nil && ccp.cacheOpts.ValidateInstanceID && instanceChanged(currentHolder.instance, info.Instance) {
+		// The IP has been reused by another instance, so nothing is kept from the entry of the old instance.  The new
+		// instance may have been launched so recently that it doesn't have all its tags yet, so it's refreshed sooner.
+		ccp.logger.WithFields(logrus.Fields{
+			"ip":           info.IP,
+			"old-instance": currentHolder.instance.ID,
+			"new-instance": info.Instance.ID,
+		}).Info("IP has been reused by another instance, replacing cached instance")
+		ccp.statsCacheInstanceChanged++
+		newHolder.expires = now.Add(ccp.cacheOpts.CacheNegativeTTL)
+		newHolder.lastAccessNano = now.UnixNano()
+	} else if currentHolder == nil {
+		// Not in cache, make room for it and count it
+		ccp.evictForInsert()
 		if info.Instance == nil {
 			ccp.statsCacheNegative++
 		} else {
@@ -234,6 +370,7 @@ func (ccp *CachedCloudProvider) handleInstanceInfo(info gostatsd.InstanceInfo) {
 		if info.Instance == nil {
 			// Use the old instance if there was a lookup error.
 			newHolder.instance = currentHolder.instance
+			newHolder.resolved = currentHolder.resolved
 			ccp.statsCacheRefreshNegative++
 		} else {
 			if currentHolder.instance == nil && newHolder.instance != nil {
@@ -247,13 +384,72 @@ func (ccp *CachedCloudProvider) handleInstanceInfo(info gostatsd.InstanceInfo) {
 	ccp.rw.Lock()
 	ccp.cache[info.IP] = newHolder
 	ccp.rw.Unlock()
+	if newHolder.pinned {
+		ccp.evictionQueue.remove(info.IP)
+	} else {
+		ccp.evictionQueue.set(info.IP, newHolder)
+	}
 	ccp.toReturnInfo = append(ccp.toReturnInfo, info)
 }
 
+// evictForInsert evicts entries until there is room for a new entry within CacheMaxSize.  The least recently accessed
+// failed lookup is evicted first, then the least recently accessed instance, so the instances of sources which are
+// still sending are kept over sources which can't be resolved.  Pinned entries are never evicted, so the cache can
+// exceed CacheMaxSize if they fill it.
+func (ccp *CachedCloudProvider) evictForInsert() {
+	maxSize := ccp.cacheOpts.CacheMaxSize
+	for maxSize > 0 && len(ccp.cache) >= maxSize {
+		victimIP, ok := ccp.evictionQueue.pop(ccp.cache)
+		if !ok {
+			return
+		}
+		victim := ccp.cache[victimIP]
+		if victim.instance == nil {
+			ccp.statsCacheNegative--
+		} else {
+			ccp.statsCachePositive--
+		}
+		if victim.backoff {
+			ccp.statsCacheBackoff--
+		}
+		ccp.statsCacheForcedEvictions++
+		ccp.rw.Lock()
+		delete(ccp.cache, victimIP)
+		ccp.rw.Unlock()
+	}
+}
+
+// negativeTTL returns how long a failed lookup is cached for, after the given number of consecutive failed lookups of
+// the IP.  The negative TTL is multiplied for each failure after the first, up to the max.
+func (ccp *CachedCloudProvider) negativeTTL(failures int) time.Duration {
+	ttl := ccp.cacheOpts.CacheNegativeTTL
+	maxTTL := ccp.cacheOpts.CacheNegativeTTLMax
+	multiplier := ccp.cacheOpts.CacheNegativeTTLMultiplier
+	if maxTTL <= ttl || multiplier <= 1 {
+		return ttl
+	}
+	for i := 1; i < failures && ttl < maxTTL; i++ {
+		ttl = time.Duration(float64(ttl) * multiplier)
+	}
+	if ttl > maxTTL {
+		ttl = maxTTL
+	}
+	return ttl
+}
+
+// instanceChanged returns true if both instances have an ID, and they're different.
+func instanceChanged(previous, current *gostatsd.Instance) bool {
+	return previous != nil && current != nil && previous.ID != "" && current.ID != "" && previous.ID != current.ID
+}
+
 type instanceHolder struct {
 	lastAccessNano int64
 	expires        time.Time          // When this record expires.
+	resolved       time.Time          // When the instance was looked up, not updated by refreshes which fall back to it
 	instance       *gostatsd.Instance // Can be nil if the lookup resulted in an error or instance was not found
+	pinned         bool               // Never evicted, expired, or refreshed
+	failures       int                // The number of consecutive failed lookups, 0 once a lookup succeeds
+	backoff        bool               // The negative TTL is extended by consecutive failed lookups
 }
 
 func (ih *instanceHolder) updateAccess() {
@@ -0,0 +1,106 @@
+package cloudprovider
+
+import (
+	"container/heap"
+
+	"github.com/atlassian/gostatsd"
+)
+
+// evictionQueue orders the unpinned entries of the cache by when they're evicted from a full cache: failed lookups
+// first, then the least recently accessed.  The access times are updated by Peek without the queue knowing, but they
+// only ever increase, so they're updated lazily, when an entry reaches the front of the queue with an old access time.
+// It may only be used by the CachedCloudProvider.Run goroutine.
+type evictionQueue struct {
+	entries map[gostatsd.Source]*evictionEntry
+	heap    evictionHeap
+}
+
+type evictionEntry struct {
+	ip         gostatsd.Source
+	failed     bool  // The lookup failed, so the entry has no instance
+	lastAccess int64 // The access time when the entry was last ordered, which may be older than the holder's
+	index      int   // The index of the entry in the heap
+}
+
+func newEvictionQueue() *evictionQueue {
+	return &evictionQueue{
+		entries: make(map[gostatsd.Source]*evictionEntry),
+	}
+}
+
+// set adds or updates the entry of ip with holder, which must not be pinned.
+func (eq *evictionQueue) set(ip gostatsd.Source, holder *instanceHolder) {
+	e, ok := eq.entries[ip]
+	if !ok {
+		e = &evictionEntry{ip: ip}
+		eq.entries[ip] = e
+	}
+	e.failed = holder.instance == nil
+	e.lastAccess = holder.lastAccess()
+	if ok {
+		heap.Fix(&eq.heap, e.index)
+	} else {
+		heap.Push(&eq.heap, e)
+	}
+}
+
+// remove removes the entry of ip, if it has one.
+func (eq *evictionQueue) remove(ip gostatsd.Source) {
+	if e, ok := eq.entries[ip]; ok {
+		heap.Remove(&eq.heap, e.index)
+		delete(eq.entries, ip)
+	}
+}
+
+// pop removes and returns the IP of the entry which is evicted first, given the current holders in cache, or false if
+// the queue is empty.
+func (eq *evictionQueue) pop(cache map[gostatsd.Source]*instanceHolder) (gostatsd.Source, bool) {
+	for len(eq.heap) > 0 {
+		e := eq.heap[0]
+		if lastAccess := cache[e.ip].lastAccess(); lastAccess != e.lastAccess {
+			// Accessed since it was ordered, so it may no longer be first
+			e.lastAccess = lastAccess
+			heap.Fix(&eq.heap, 0)
+			continue
+		}
+		heap.Pop(&eq.heap)
+		delete(eq.entries, e.ip)
+		return e.ip, true
+	}
+	return gostatsd.UnknownSource, false
+}
+
+// evictionHeap implements heap.Interface for the entries of an evictionQueue.
+type evictionHeap []*evictionEntry
+
+func (h evictionHeap) Len() int {
+	return len(h)
+}
+
+func (h evictionHeap) Less(i, j int) bool {
+	if h[i].failed != h[j].failed {
+		return h[i].failed
+	}
+	return h[i].lastAccess < h[j].lastAccess
+}
+
+func (h evictionHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *evictionHeap) Push(x interface{}) {
+	e := x.(*evictionEntry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *evictionHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	e := old[n-1]
+	old[n-1] = nil // enable GC
+	*h = old[:n-1]
+	return e
+}
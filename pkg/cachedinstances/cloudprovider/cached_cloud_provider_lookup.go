@@ -2,30 +2,52 @@ package cloudprovider
 
 import (
 	"context"
+	"sync"
 	"time"
 
 	"github.com/sirupsen/logrus"
 	"golang.org/x/time/rate"
 
 	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/stats"
 )
 
 const (
 	batchDuration = 10 * time.Millisecond
+	// maxLimiterWaits is the most limiter waits timed between emits, so they don't grow without bound if they aren't
+	// emitted.  The rest are still counted.
+	maxLimiterWaits = 1000
 )
 
 type cloudProviderLookupDispatcher struct {
 	logger        logrus.FieldLogger
 	limiter       *rate.Limiter
 	cloudProvider gostatsd.CloudProvider
+	maxLookups    int // The number of lookups which can run at once, 0 is treated as 1
+	retries       int // The number of times the IPs not found by a failed lookup are looked up again
+	retryBackoff  time.Duration
 	ipSource      <-chan gostatsd.Source
 	infoSink      chan<- gostatsd.InstanceInfo
+
+	statsMu           sync.Mutex      // Protects the stats, which are written by the lookups, and read by emit
+	statsLimiterWaits uint64          // Number of lookups which waited for the limiter since the last emit
+	statsLimiterTimes []time.Duration // How long each of those lookups waited
 }
 
 func (ld *cloudProviderLookupDispatcher) run(ctx context.Context) {
 	maxLookupIPs := ld.cloudProvider.MaxInstancesBatch()
 	ips := make([]gostatsd.Source, 0, maxLookupIPs)
 	var c <-chan time.Time
+
+	// Each lookup runs in its own goroutine, which holds a slot of lookupSem until it's done.
+	maxLookups := ld.maxLookups
+	if maxLookups <= 0 {
+		maxLookups = 1
+	}
+	lookupSem := make(chan struct{}, maxLookups)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
 	for {
 		select {
 		case <-ctx.Done():
@@ -43,7 +65,13 @@ func (ld *cloudProviderLookupDispatcher) run(ctx context.Context) {
 		}
 		c = nil
 
-		if err := ld.limiter.Wait(ctx); err != nil {
+		// Wait for a free slot before the limiter, so a token isn't taken until the lookup can run
+		select {
+		case <-ctx.Done():
+			return
+		case lookupSem <- struct{}{}:
+		}
+		if err := ld.waitLimiter(ctx); err != nil {
 			if err != context.Canceled && err != context.DeadlineExceeded {
 				// This could be an error caused by context signaling done.
 				// Or something nasty but it is very unlikely.
@@ -51,7 +79,14 @@ func (ld *cloudProviderLookupDispatcher) run(ctx context.Context) {
 			}
 			return
 		}
-		ld.doLookup(ctx, ips)
+		lookupIPs := make([]gostatsd.Source, len(ips))
+		copy(lookupIPs, ips)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-lookupSem }()
+			ld.doLookup(ctx, lookupIPs)
+		}()
 		for i := range ips { // cleanup pointers for GC
 			ips[i] = gostatsd.UnknownSource
 		}
@@ -59,12 +94,48 @@ func (ld *cloudProviderLookupDispatcher) run(ctx context.Context) {
 	}
 }
 
+// doLookup looks up a batch of IPs, and sends the result of each IP on its own.  The provider may return a partial
+// batch, with instances for only some of the IPs, whether or not it also returns an error.  The IPs with an instance
+// are cached positively, and the IPs without one negatively, so a failure part way through a batch doesn't discard
+// the instances already found, or count the whole batch as found.  If the lookup fails, the IPs without an instance
+// are retried first, so a transient error doesn't leave them unresolved for the negative TTL.
 func (ld *cloudProviderLookupDispatcher) doLookup(ctx context.Context, ips []gostatsd.Source) {
-	// instances may contain partial result even if err != nil
 	instances, err := ld.cloudProvider.Instance(ctx, ips...)
+	backoff := ld.retryBackoff
+	for retry := 0; err != nil && retry < ld.retries; retry++ {
+		var missing []gostatsd.Source
+		for _, ip := range ips {
+			if instances[ip] == nil {
+				missing = append(missing, ip)
+			}
+		}
+		ld.logger.Debugf("Error retrieving instance details from cloud provider, retrying %d of %d IPs: %v", len(missing), len(ips), err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if ld.waitLimiter(ctx) != nil {
+			break // The results so far are still sent, so the IPs aren't left waiting for a lookup
+		}
+		var retried map[gostatsd.Source]*gostatsd.Instance
+		retried, err = ld.cloudProvider.Instance(ctx, missing...)
+		if instances == nil {
+			instances = make(map[gostatsd.Source]*gostatsd.Instance, len(ips))
+		}
+		for ip, instance := range retried {
+			instances[ip] = instance
+		}
+	}
 	if err != nil {
-		// Something bad happened, but process what we have still
-		ld.logger.Infof("Error retrieving instance details from cloud provider: %v", err)
+		found := 0
+		for _, ip := range ips {
+			if instances[ip] != nil {
+				found++
+			}
+		}
+		ld.logger.Infof("Error retrieving instance details from cloud provider, found %d of %d IPs: %v", found, len(ips), err)
 	}
 	for _, ip := range ips {
 		res := gostatsd.InstanceInfo{
@@ -78,3 +149,35 @@ func (ld *cloudProviderLookupDispatcher) doLookup(ctx context.Context, ips []gos
 		}
 	}
 }
+
+// waitLimiter waits until the limiter allows a lookup, recording how long it waited.  A lookup which is allowed
+// straight away isn't timed.
+func (ld *cloudProviderLookupDispatcher) waitLimiter(ctx context.Context) error {
+	if ld.limiter.Allow() {
+		return nil
+	}
+	start := time.Now()
+	if err := ld.limiter.Wait(ctx); err != nil {
+		return err
+	}
+	waited := time.Since(start)
+	ld.statsMu.Lock()
+	defer ld.statsMu.Unlock()
+	ld.statsLimiterWaits++
+	if len(ld.statsLimiterTimes) < maxLimiterWaits {
+		ld.statsLimiterTimes = append(ld.statsLimiterTimes, waited)
+	}
+	return nil
+}
+
+// emit sends the limiter waits since the last emit.
+func (ld *cloudProviderLookupDispatcher) emit(statser stats.Statser) {
+	ld.statsMu.Lock()
+	waits, times := ld.statsLimiterWaits, ld.statsLimiterTimes
+	ld.statsLimiterWaits, ld.statsLimiterTimes = 0, nil
+	ld.statsMu.Unlock()
+	statser.Count("cloudprovider.limiter_waits", float64(waits), nil)
+	for _, d := range times {
+		statser.TimingDuration("cloudprovider.limiter_wait_time", d, nil)
+	}
+}
@@ -2,6 +2,9 @@ package cloudprovider
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"sync"
 	"testing"
 	"time"
 
@@ -9,10 +12,12 @@ import (
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"github.com/tilinna/clock"
 	"golang.org/x/time/rate"
 
 	"github.com/atlassian/gostatsd"
 	"github.com/atlassian/gostatsd/pkg/cloudproviders/fakeprovider"
+	"github.com/atlassian/gostatsd/pkg/stats"
 )
 
 func TestCachedCloudProviderExpirationAndRefresh(t *testing.T) {
@@ -66,3 +71,614 @@ func TestCachedCloudProviderExpirationAndRefresh(t *testing.T) {
 	assert.GreaterOrEqual(t, len(fp.IPs()), 2) // Ensure it does at least 1 lookup + 1 refresh
 	assert.Zero(t, len(ci.cache))              // Ensure it eventually expired
 }
+
+// blockingProvider blocks lookups until it is released.
+type blockingProvider struct {
+	fakeprovider.IP
+	release chan struct{}
+}
+
+func (bp *blockingProvider) Instance(ctx context.Context, ips ...gostatsd.Source) (map[gostatsd.Source]*gostatsd.Instance, error) {
+	select {
+	case <-bp.release:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return bp.IP.Instance(ctx, ips...)
+}
+
+// gaugeStatser sends the value of a gauge to a channel.
+type gaugeStatser struct {
+	stats.NullStatser
+	name  string
+	value chan float64
+}
+
+func (gs *gaugeStatser) Gauge(name string, value float64, tags gostatsd.Tags) {
+	if name == gs.name {
+		gs.value <- value
+	}
+}
+
+func TestCachedCloudProviderCoalescesLookups(t *testing.T) {
+	t.Parallel()
+	bp := &blockingProvider{release: make(chan struct{})}
+	ci := NewCachedCloudProvider(logrus.StandardLogger(), rate.NewLimiter(rate.Inf, 1), bp, gostatsd.CacheOptions{
+		CacheRefreshPeriod:        time.Minute,
+		CacheEvictAfterIdlePeriod: 24 * time.Hour,
+		CacheTTL:                  time.Second,
+		CacheNegativeTTL:          time.Second,
+	})
+	// The mock clock is ahead of the real clock, so cached entries always need a refresh
+	clck := clock.NewMock(time.Now().Add(time.Hour))
+	ctx, cancel := context.WithCancel(clock.Context(context.Background(), clck))
+	var wg wait.Group
+	defer wg.Wait()
+	defer cancel()
+	wg.StartWithContext(ctx, ci.Run)
+
+	coalesced := func() float64 {
+		statser := &gaugeStatser{name: "cloudprovider.lookups_coalesced", value: make(chan float64, 1)}
+		ci.emitChan <- statser
+		return <-statser.value
+	}
+
+	const ip gostatsd.Source = "1.2.3.4"
+	for i := 0; i < 10; i++ {
+		ci.IpSink() <- ip
+	}
+	assert.EqualValues(t, 9, coalesced())
+	bp.release <- struct{}{}
+	info := <-ci.InfoSource()
+	assert.Equal(t, ip, info.IP)
+
+	// A refresh, and a miss while it is in flight, share one lookup
+	clck.Add(time.Minute)
+	ci.IpSink() <- ip
+	clck.Add(time.Minute)
+	require.Eventually(t, func() bool {
+		return coalesced() == 11
+	}, 5*time.Second, time.Millisecond)
+	bp.release <- struct{}{}
+	<-ci.InfoSource()
+
+	assert.Equal(t, []gostatsd.Source{ip, ip}, bp.IPs())
+	assert.EqualValues(t, 2, bp.Invocations())
+}
+
+func TestCachedCloudProviderMaxLifetime(t *testing.T) {
+	t.Parallel()
+	ci := NewCachedCloudProvider(logrus.StandardLogger(), rate.NewLimiter(rate.Inf, 1), &fakeprovider.IP{}, gostatsd.CacheOptions{
+		CacheRefreshPeriod:        time.Minute,
+		CacheEvictAfterIdlePeriod: 24 * time.Hour,
+		CacheTTL:                  time.Minute,
+		CacheNegativeTTL:          time.Minute,
+		CacheMaxLifetime:          time.Hour,
+	})
+	const ip gostatsd.Source = "1.2.3.4"
+	instance := &gostatsd.Instance{ID: "i-old"}
+	start := time.Now()
+
+	ci.handleInstanceInfo(gostatsd.InstanceInfo{IP: ip, Instance: instance})
+	// Refreshes keep failing, and fall back to the old instance while it's accessed
+	for i := 1; i <= 3; i++ {
+		ci.doRefresh(start.Add(time.Duration(i) * 15 * time.Minute))
+		require.Equal(t, []gostatsd.Source{ip}, ci.toLookupIPs)
+		ci.toLookupIPs = nil
+		ci.handleInstanceInfo(gostatsd.InstanceInfo{IP: ip})
+		cached, ok := ci.Peek(ip)
+		require.True(t, ok)
+		require.Equal(t, instance, cached)
+	}
+	assert.EqualValues(t, 3, ci.statsCacheRefreshNegative)
+
+	// Past the max lifetime the entry is removed and looked up again
+	ci.doRefresh(start.Add(time.Hour + time.Minute))
+	_, ok := ci.Peek(ip)
+	assert.False(t, ok)
+	require.Equal(t, []gostatsd.Source{ip}, ci.toLookupIPs)
+	assert.EqualValues(t, 1, ci.statsCacheLifetimeExpired)
+	assert.Zero(t, ci.statsCachePositive)
+
+	// A failed lookup doesn't fall back to the old instance
+	ci.handleInstanceInfo(gostatsd.InstanceInfo{IP: ip})
+	cached, ok := ci.Peek(ip)
+	assert.True(t, ok)
+	assert.Nil(t, cached)
+	assert.EqualValues(t, 1, ci.statsCacheNegative)
+}
+
+func TestCachedCloudProviderInstanceIDChanges(t *testing.T) {
+	t.Parallel()
+	for _, validate := range []bool{false, true} {
+		ci := NewCachedCloudProvider(logrus.StandardLogger(), rate.NewLimiter(rate.Inf, 1), &fakeprovider.IP{}, gostatsd.CacheOptions{
+			CacheRefreshPeriod:        time.Minute,
+			CacheEvictAfterIdlePeriod: 24 * time.Hour,
+			CacheTTL:                  time.Hour,
+			CacheNegativeTTL:          time.Minute,
+			ValidateInstanceID:        validate,
+		})
+		const ip gostatsd.Source = "1.2.3.4"
+		old := &gostatsd.Instance{ID: "i-old", Tags: gostatsd.Tags{"service:terminated"}}
+		replacement := &gostatsd.Instance{ID: "i-new", Tags: gostatsd.Tags{"service:new-owner"}}
+
+		ci.handleInstanceInfo(gostatsd.InstanceInfo{IP: ip, Instance: old})
+		// The same instance is a refresh
+		ci.handleInstanceInfo(gostatsd.InstanceInfo{IP: ip, Instance: &gostatsd.Instance{ID: "i-old", Tags: gostatsd.Tags{"service:terminated"}}})
+		assert.EqualValues(t, 1, ci.statsCacheRefreshPositive)
+		// The IP is reused by another instance
+		ci.handleInstanceInfo(gostatsd.InstanceInfo{IP: ip, Instance: replacement})
+
+		cached, ok := ci.Peek(ip)
+		require.True(t, ok)
+		assert.Equal(t, replacement, cached)
+		assert.EqualValues(t, 1, ci.statsCachePositive)
+		holder := ci.cache[ip]
+		if validate {
+			assert.EqualValues(t, 1, ci.statsCacheInstanceChanged)
+			assert.EqualValues(t, 1, ci.statsCacheRefreshPositive)
+			// Refreshed sooner, in case the new instance doesn't have all its tags yet
+			assert.WithinDuration(t, time.Now().Add(time.Minute), holder.expires, 10*time.Second)
+		} else {
+			assert.Zero(t, ci.statsCacheInstanceChanged)
+			assert.EqualValues(t, 2, ci.statsCacheRefreshPositive)
+			assert.WithinDuration(t, time.Now().Add(time.Hour), holder.expires, 10*time.Second)
+		}
+	}
+}
+
+func TestCachedCloudProviderPinnedInstances(t *testing.T) {
+	t.Parallel()
+	const (
+		staticIP   gostatsd.Source = "10.0.0.1"
+		resolvedIP gostatsd.Source = "10.0.0.2"
+	)
+	static := &gostatsd.Instance{ID: "db-1", Tags: gostatsd.Tags{"service:db"}}
+	ci := NewCachedCloudProvider(logrus.StandardLogger(), rate.NewLimiter(rate.Inf, 1), &fakeprovider.IP{}, gostatsd.CacheOptions{
+		CacheRefreshPeriod:        time.Minute,
+		CacheEvictAfterIdlePeriod: time.Hour,
+		CacheTTL:                  time.Minute,
+		CacheNegativeTTL:          time.Minute,
+		CacheMaxLifetime:          2 * time.Hour,
+		PinnedInstances:           map[gostatsd.Source]*gostatsd.Instance{staticIP: static, resolvedIP: nil},
+	})
+	// The static instance is cached from the start, and the other IP is looked up
+	cached, ok := ci.Peek(staticIP)
+	require.True(t, ok)
+	assert.Equal(t, static, cached)
+	require.Equal(t, []gostatsd.Source{resolvedIP}, ci.toLookupIPs)
+	ci.toLookupIPs = nil
+
+	// Until the lookup succeeds, it's cached like any other IP, and looked up again even once it's evicted
+	start := time.Now()
+	ci.handleInstanceInfo(gostatsd.InstanceInfo{IP: resolvedIP})
+	ci.doRefresh(start.Add(2 * time.Hour))
+	_, ok = ci.Peek(resolvedIP)
+	assert.False(t, ok)
+	require.Equal(t, []gostatsd.Source{resolvedIP}, ci.toLookupIPs)
+	ci.toLookupIPs = nil
+	resolved := &gostatsd.Instance{ID: "db-2", Tags: gostatsd.Tags{"service:db"}}
+	ci.handleInstanceInfo(gostatsd.InstanceInfo{IP: resolvedIP, Instance: resolved})
+	assert.EqualValues(t, 2, ci.statsCachePinned)
+
+	// Pinned entries survive idle eviction, TTL expiry, and the max lifetime, and are never refreshed
+	for i := 1; i <= 5; i++ {
+		ci.doRefresh(start.Add(time.Duration(i) * 24 * time.Hour))
+		assert.Empty(t, ci.toLookupIPs)
+	}
+	// A lookup of a pinned IP, such as one already in flight, doesn't replace it
+	ci.handleInstanceInfo(gostatsd.InstanceInfo{IP: resolvedIP, Instance: &gostatsd.Instance{ID: "db-3"}})
+	ci.handleInstanceInfo(gostatsd.InstanceInfo{IP: staticIP})
+	assert.Equal(t, []gostatsd.InstanceInfo{{IP: resolvedIP, Instance: resolved}, {IP: staticIP, Instance: static}}, ci.toReturnInfo[2:])
+
+	for ip, expected := range map[gostatsd.Source]*gostatsd.Instance{staticIP: static, resolvedIP: resolved} {
+		cached, ok := ci.Peek(ip)
+		require.True(t, ok)
+		assert.Equal(t, expected, cached)
+	}
+	assert.EqualValues(t, 2, ci.statsCachePositive)
+	assert.Zero(t, ci.statsCacheLifetimeExpired)
+}
+
+func TestCachedCloudProviderNegativeTTLBackoff(t *testing.T) {
+	t.Parallel()
+	ci := NewCachedCloudProvider(logrus.StandardLogger(), rate.NewLimiter(rate.Inf, 1), &fakeprovider.IP{}, gostatsd.CacheOptions{
+		CacheRefreshPeriod:         time.Minute,
+		CacheEvictAfterIdlePeriod:  24 * time.Hour,
+		CacheTTL:                   time.Hour,
+		CacheNegativeTTL:           time.Minute,
+		CacheNegativeTTLMax:        5 * time.Minute,
+		CacheNegativeTTLMultiplier: 2,
+	})
+	const ip gostatsd.Source = "1.2.3.4"
+
+	// Each consecutive failure doubles the negative TTL, up to the max
+	for _, expected := range []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 5 * time.Minute, 5 * time.Minute} {
+		ci.handleInstanceInfo(gostatsd.InstanceInfo{IP: ip})
+		assert.WithinDuration(t, time.Now().Add(expected), ci.cache[ip].expires, 10*time.Second)
+	}
+	assert.Equal(t, 5, ci.cache[ip].failures)
+	assert.EqualValues(t, 1, ci.statsCacheBackoff)
+	assert.EqualValues(t, 1, ci.statsCacheNegative)
+
+	// The first success resets it
+	ci.handleInstanceInfo(gostatsd.InstanceInfo{IP: ip, Instance: &gostatsd.Instance{ID: "i-1"}})
+	assert.Zero(t, ci.cache[ip].failures)
+	assert.Zero(t, ci.statsCacheBackoff)
+	ci.handleInstanceInfo(gostatsd.InstanceInfo{IP: ip})
+	assert.WithinDuration(t, time.Now().Add(time.Minute), ci.cache[ip].expires, 10*time.Second)
+	ci.handleInstanceInfo(gostatsd.InstanceInfo{IP: ip})
+	assert.EqualValues(t, 1, ci.statsCacheBackoff)
+
+	// Evicted entries are no longer counted
+	assert.Zero(t, ci.statsCacheSize)
+	ci.doRefresh(time.Now())
+	assert.EqualValues(t, 1, ci.statsCacheSize)
+	ci.doRefresh(time.Now().Add(48 * time.Hour))
+	assert.Zero(t, ci.statsCacheBackoff)
+	assert.Zero(t, ci.statsCacheSize)
+
+	// There is no backoff without a max
+	ci.cacheOpts.CacheNegativeTTLMax = 0
+	assert.Equal(t, time.Minute, ci.negativeTTL(10))
+}
+
+func TestCachedCloudProviderMaxSize(t *testing.T) {
+	t.Parallel()
+	const pinnedIP gostatsd.Source = "10.0.0.1"
+	ci := NewCachedCloudProvider(logrus.StandardLogger(), rate.NewLimiter(rate.Inf, 1), &fakeprovider.IP{}, gostatsd.CacheOptions{
+		CacheRefreshPeriod:        time.Minute,
+		CacheEvictAfterIdlePeriod: time.Hour,
+		CacheTTL:                  time.Minute,
+		CacheNegativeTTL:          time.Minute,
+		CacheMaxSize:              3,
+		PinnedInstances:           map[gostatsd.Source]*gostatsd.Instance{pinnedIP: {ID: "db-1"}},
+	})
+	ci.cache[pinnedIP].lastAccessNano = 0
+	ci.handleInstanceInfo(gostatsd.InstanceInfo{IP: "1.1.1.1", Instance: &gostatsd.Instance{ID: "i-1"}})
+	ci.handleInstanceInfo(gostatsd.InstanceInfo{IP: "2.2.2.2"})
+	ci.cache["1.1.1.1"].lastAccessNano = 1
+
+	// A refresh of a cached IP doesn't evict anything
+	ci.handleInstanceInfo(gostatsd.InstanceInfo{IP: "2.2.2.2"})
+	assert.Len(t, ci.cache, 3)
+	assert.Zero(t, ci.statsCacheForcedEvictions)
+
+	// A failed lookup is evicted before an instance, even if it was accessed more recently
+	ci.handleInstanceInfo(gostatsd.InstanceInfo{IP: "3.3.3.3", Instance: &gostatsd.Instance{ID: "i-3"}})
+	assert.NotContains(t, ci.cache, gostatsd.Source("2.2.2.2"))
+	assert.Len(t, ci.cache, 3)
+	assert.Zero(t, ci.statsCacheNegative)
+
+	// Then the least recently accessed instance, but never a pinned one
+	ci.handleInstanceInfo(gostatsd.InstanceInfo{IP: "4.4.4.4", Instance: &gostatsd.Instance{ID: "i-4"}})
+	assert.NotContains(t, ci.cache, gostatsd.Source("1.1.1.1"))
+	assert.Contains(t, ci.cache, pinnedIP)
+	assert.Contains(t, ci.cache, gostatsd.Source("3.3.3.3"))
+	assert.Contains(t, ci.cache, gostatsd.Source("4.4.4.4"))
+	assert.EqualValues(t, 3, ci.statsCachePositive)
+	assert.EqualValues(t, 2, ci.statsCacheForcedEvictions)
+
+	// Idle eviction isn't counted as forced
+	ci.doRefresh(time.Now().Add(2 * time.Hour))
+	assert.Len(t, ci.cache, 1)
+	assert.EqualValues(t, 2, ci.statsCacheForcedEvictions)
+}
+
+func TestCachedCloudProviderMaxSizeAccessed(t *testing.T) {
+	t.Parallel()
+	ci := NewCachedCloudProvider(logrus.StandardLogger(), rate.NewLimiter(rate.Inf, 1), &fakeprovider.IP{}, gostatsd.CacheOptions{
+		CacheRefreshPeriod:        time.Minute,
+		CacheEvictAfterIdlePeriod: time.Hour,
+		CacheTTL:                  time.Minute,
+		CacheNegativeTTL:          time.Minute,
+		CacheMaxSize:              3,
+	})
+	ips := []gostatsd.Source{"1.1.1.1", "2.2.2.2", "3.3.3.3", "4.4.4.4", "5.5.5.5"}
+	for _, ip := range ips[:3] {
+		ci.handleInstanceInfo(gostatsd.InstanceInfo{IP: ip, Instance: &gostatsd.Instance{ID: "i-" + ip}})
+		time.Sleep(time.Millisecond)
+	}
+
+	// Accessing the oldest entry keeps it, the next oldest is evicted instead
+	_, ok := ci.Peek("1.1.1.1")
+	require.True(t, ok)
+	ci.handleInstanceInfo(gostatsd.InstanceInfo{IP: ips[3], Instance: &gostatsd.Instance{ID: "i-4"}})
+	assert.Contains(t, ci.cache, gostatsd.Source("1.1.1.1"))
+	assert.NotContains(t, ci.cache, gostatsd.Source("2.2.2.2"))
+
+	// The queue is kept in step with the cache when entries are removed
+	ci.doRefresh(time.Now().Add(2 * time.Hour))
+	assert.Empty(t, ci.cache)
+	assert.Empty(t, ci.evictionQueue.entries)
+	ci.handleInstanceInfo(gostatsd.InstanceInfo{IP: ips[4], Instance: &gostatsd.Instance{ID: "i-5"}})
+	assert.Len(t, ci.evictionQueue.heap, 1)
+	assert.EqualValues(t, 1, ci.statsCacheForcedEvictions)
+}
+
+// partialProvider finds the IPs in found, and fails the rest of the batch.
+type partialProvider struct {
+	fakeprovider.IP
+	found map[gostatsd.Source]bool
+}
+
+func (pp *partialProvider) Instance(ctx context.Context, ips ...gostatsd.Source) (map[gostatsd.Source]*gostatsd.Instance, error) {
+	instances, _ := pp.IP.Instance(ctx, ips...)
+	for ip := range instances {
+		if !pp.found[ip] {
+			delete(instances, ip)
+		}
+	}
+	return instances, errors.New("throttled part way through the batch")
+}
+
+func TestCachedCloudProviderPartialBatch(t *testing.T) {
+	t.Parallel()
+	pp := &partialProvider{found: map[gostatsd.Source]bool{"10.0.0.1": true, "10.0.0.3": true}}
+	ci := NewCachedCloudProvider(logrus.StandardLogger(), rate.NewLimiter(rate.Inf, 1), pp, gostatsd.CacheOptions{
+		CacheRefreshPeriod:        time.Minute,
+		CacheEvictAfterIdlePeriod: time.Hour,
+		CacheTTL:                  time.Hour,
+		CacheNegativeTTL:          time.Minute,
+	})
+	ips := []gostatsd.Source{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4"}
+	infoSink := make(chan gostatsd.InstanceInfo, len(ips))
+	ld := &cloudProviderLookupDispatcher{
+		logger:        logrus.StandardLogger(),
+		cloudProvider: pp,
+		infoSink:      infoSink,
+	}
+	ld.doLookup(context.Background(), ips)
+	require.EqualValues(t, 1, pp.Invocations())
+	require.Len(t, infoSink, len(ips))
+	for range ips {
+		ci.handleInstanceInfo(<-infoSink)
+	}
+
+	// Each IP is cached on its own, positively if it was found, and negatively if it wasn't
+	for _, ip := range ips {
+		cached, ok := ci.Peek(ip)
+		require.True(t, ok, ip)
+		if pp.found[ip] {
+			assert.Equal(t, &gostatsd.Instance{ID: "i-" + ip}, cached, ip)
+			assert.WithinDuration(t, time.Now().Add(time.Hour), ci.cache[ip].expires, 10*time.Second, ip)
+		} else {
+			assert.Nil(t, cached, ip)
+			assert.WithinDuration(t, time.Now().Add(time.Minute), ci.cache[ip].expires, 10*time.Second, ip)
+		}
+	}
+	assert.EqualValues(t, 2, ci.statsCachePositive)
+	assert.EqualValues(t, 2, ci.statsCacheNegative)
+	assert.Len(t, ci.toReturnInfo, len(ips))
+}
+
+// flakyProvider fails the first lookups, and then succeeds.
+type flakyProvider struct {
+	fakeprovider.IP
+	failures int
+}
+
+func (fp *flakyProvider) Instance(ctx context.Context, ips ...gostatsd.Source) (map[gostatsd.Source]*gostatsd.Instance, error) {
+	instances, _ := fp.IP.Instance(ctx, ips...)
+	if fp.failures > 0 {
+		fp.failures--
+		return nil, errors.New("transient error")
+	}
+	return instances, nil
+}
+
+func TestCachedCloudProviderLookupRetries(t *testing.T) {
+	t.Parallel()
+	fp := &flakyProvider{failures: 1}
+	ci := NewCachedCloudProvider(logrus.StandardLogger(), rate.NewLimiter(rate.Inf, 1), fp, gostatsd.CacheOptions{
+		CacheRefreshPeriod:        time.Minute,
+		CacheEvictAfterIdlePeriod: time.Hour,
+		CacheTTL:                  time.Hour,
+		CacheNegativeTTL:          time.Minute,
+	})
+	ips := []gostatsd.Source{"10.0.0.1", "10.0.0.2"}
+	infoSink := make(chan gostatsd.InstanceInfo, len(ips))
+	ld := &cloudProviderLookupDispatcher{
+		logger:        logrus.StandardLogger(),
+		limiter:       rate.NewLimiter(rate.Inf, 1),
+		cloudProvider: fp,
+		retries:       2,
+		retryBackoff:  time.Millisecond,
+		infoSink:      infoSink,
+	}
+	ld.doLookup(context.Background(), ips)
+	require.EqualValues(t, 2, fp.Invocations())
+	require.Len(t, infoSink, len(ips))
+	for range ips {
+		ci.handleInstanceInfo(<-infoSink)
+	}
+
+	// The IPs are cached positively, without being cached negatively first
+	for _, ip := range ips {
+		cached, ok := ci.Peek(ip)
+		require.True(t, ok, ip)
+		assert.Equal(t, &gostatsd.Instance{ID: "i-" + ip}, cached, ip)
+		assert.WithinDuration(t, time.Now().Add(time.Hour), ci.cache[ip].expires, 10*time.Second, ip)
+	}
+	assert.EqualValues(t, 2, ci.statsCachePositive)
+	assert.Zero(t, ci.statsCacheNegative)
+
+	// The retries are rate limited, so a limiter which allows no more lookups stops them
+	fp = &flakyProvider{failures: 1}
+	ld.cloudProvider = fp
+	ld.limiter = rate.NewLimiter(rate.Every(time.Hour), 0)
+	ld.doLookup(context.Background(), ips)
+	require.EqualValues(t, 1, fp.Invocations())
+	require.Len(t, infoSink, len(ips))
+	for range ips {
+		assert.Nil(t, (<-infoSink).Instance)
+	}
+}
+
+// concurrentProvider looks up one IP at a time, counting the lookups in progress, which are blocked until release is
+// closed.
+type concurrentProvider struct {
+	fakeprovider.IP
+	release chan struct{}
+
+	mu          sync.Mutex
+	inFlight    int
+	maxInFlight int
+}
+
+func (cp *concurrentProvider) MaxInstancesBatch() int {
+	return 1
+}
+
+func (cp *concurrentProvider) Instance(ctx context.Context, ips ...gostatsd.Source) (map[gostatsd.Source]*gostatsd.Instance, error) {
+	cp.mu.Lock()
+	cp.inFlight++
+	if cp.inFlight > cp.maxInFlight {
+		cp.maxInFlight = cp.inFlight
+	}
+	cp.mu.Unlock()
+	defer func() {
+		cp.mu.Lock()
+		cp.inFlight--
+		cp.mu.Unlock()
+	}()
+	select {
+	case <-cp.release:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return cp.IP.Instance(ctx, ips...)
+}
+
+func (cp *concurrentProvider) getInFlight() (int, int) {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	return cp.inFlight, cp.maxInFlight
+}
+
+// startLookupDispatcher runs a lookup dispatcher, and sends it n IPs.
+func startLookupDispatcher(ctx context.Context, wg *wait.Group, ld *cloudProviderLookupDispatcher, n int) {
+	ipSource := make(chan gostatsd.Source)
+	ld.logger = logrus.StandardLogger()
+	ld.ipSource = ipSource
+	wg.StartWithContext(ctx, ld.run)
+	wg.Start(func() {
+		for i := 0; i < n; i++ {
+			select {
+			case <-ctx.Done():
+				return
+			case ipSource <- gostatsd.Source(fmt.Sprintf("10.0.0.%d", i)):
+			}
+		}
+	})
+}
+
+func TestLookupDispatcherConcurrency(t *testing.T) {
+	t.Parallel()
+	cp := &concurrentProvider{release: make(chan struct{})}
+	infoSink := make(chan gostatsd.InstanceInfo)
+	ld := &cloudProviderLookupDispatcher{
+		limiter:       rate.NewLimiter(rate.Inf, 1),
+		cloudProvider: cp,
+		maxLookups:    3,
+		infoSink:      infoSink,
+	}
+	var wg wait.Group
+	defer wg.Wait()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	startLookupDispatcher(ctx, &wg, ld, 10)
+
+	require.Eventually(t, func() bool {
+		inFlight, _ := cp.getInFlight()
+		return inFlight == 3
+	}, 5*time.Second, time.Millisecond)
+	time.Sleep(20 * time.Millisecond) // No other lookup starts
+	_, maxInFlight := cp.getInFlight()
+	assert.Equal(t, 3, maxInFlight)
+
+	close(cp.release)
+	for i := 0; i < 10; i++ {
+		<-infoSink
+	}
+	_, maxInFlight = cp.getInFlight()
+	assert.Equal(t, 3, maxInFlight)
+	assert.Len(t, cp.IPs(), 10)
+}
+
+func TestLookupDispatcherConcurrencyIsRateLimited(t *testing.T) {
+	t.Parallel()
+	cp := &concurrentProvider{release: make(chan struct{})}
+	close(cp.release)
+	infoSink := make(chan gostatsd.InstanceInfo)
+	ld := &cloudProviderLookupDispatcher{
+		// A burst of 2 lookups, and no more for the rest of the test
+		limiter:       rate.NewLimiter(rate.Every(time.Hour), 2),
+		cloudProvider: cp,
+		maxLookups:    5,
+		infoSink:      infoSink,
+	}
+	var wg wait.Group
+	defer wg.Wait()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	startLookupDispatcher(ctx, &wg, ld, 5)
+
+	<-infoSink
+	<-infoSink
+	select {
+	case info := <-infoSink:
+		assert.Failf(t, "unexpected lookup", "lookup of %s was not rate limited", info.IP)
+	case <-time.After(50 * time.Millisecond):
+	}
+	assert.EqualValues(t, 2, cp.Invocations())
+}
+
+// limiterStatser records the limiter waits emitted.
+type limiterStatser struct {
+	stats.NullStatser
+	waits float64
+	times []time.Duration
+}
+
+func (ls *limiterStatser) Count(name string, amount float64, tags gostatsd.Tags) {
+	if name == "cloudprovider.limiter_waits" {
+		ls.waits += amount
+	}
+}
+
+func (ls *limiterStatser) TimingDuration(name string, d time.Duration, tags gostatsd.Tags) {
+	if name == "cloudprovider.limiter_wait_time" {
+		ls.times = append(ls.times, d)
+	}
+}
+
+func TestLookupDispatcherLimiterWaits(t *testing.T) {
+	t.Parallel()
+	ld := &cloudProviderLookupDispatcher{
+		limiter: rate.NewLimiter(rate.Every(10*time.Millisecond), 1),
+	}
+	ctx := context.Background()
+
+	// A lookup which is allowed straight away doesn't wait
+	require.NoError(t, ld.waitLimiter(ctx))
+	statser := &limiterStatser{}
+	ld.emit(statser)
+	assert.Zero(t, statser.waits)
+	assert.Empty(t, statser.times)
+
+	require.NoError(t, ld.waitLimiter(ctx))
+	require.NoError(t, ld.waitLimiter(ctx))
+	ld.emit(statser)
+	assert.EqualValues(t, 2, statser.waits)
+	require.Len(t, statser.times, 2)
+	for _, d := range statser.times {
+		assert.Greater(t, d, time.Duration(0))
+	}
+
+	// The waits are reset by each emit
+	statser = &limiterStatser{}
+	ld.emit(statser)
+	assert.Zero(t, statser.waits)
+	assert.Empty(t, statser.times)
+}
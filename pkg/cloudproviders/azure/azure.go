@@ -0,0 +1,362 @@
+package azure
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"golang.org/x/oauth2"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/internal/azure"
+	"github.com/atlassian/gostatsd/internal/util"
+	"github.com/atlassian/gostatsd/pkg/stats"
+)
+
+const (
+	// ProviderName is the name of Azure cloud provider.
+	ProviderName                   = "azure"
+	defaultResourceManagerEndpoint = "https://management.azure.com"
+	defaultClientTimeout           = 9 * time.Second
+	defaultMaxInstancesBatch       = 32
+	resourceGraphAPIVersion        = "2021-03-01"
+	// maxResponseSize is the maximum response size read from Resource Graph.
+	maxResponseSize = 16 * 1024 * 1024
+)
+
+// instanceQuery finds the virtual machines, and the virtual machines of scale sets, with any of the private IPs of
+// the query, by the IP configurations of their network interfaces.  The network interfaces and virtual machines of
+// scale sets are only in the ComputeResources table.
+const instanceQuery = `union
+	(Resources | where type =~ 'microsoft.network/networkinterfaces'),
+	(ComputeResources | where type =~ 'microsoft.compute/virtualmachinescalesets/virtualmachines/networkinterfaces')
+| mv-expand ipConfiguration = properties.ipConfigurations
+| extend ip = tostring(ipConfiguration.properties.privateIPAddress)
+| where ip in (%s)
+| project ip, vmId = tolower(tostring(properties.virtualMachine.id))
+| join kind=inner (
+	union
+		(Resources | where type =~ 'microsoft.compute/virtualmachines'),
+		(ComputeResources | where type =~ 'microsoft.compute/virtualmachinescalesets/virtualmachines')
+	| project vmId = tolower(id), id, vmUniqueId = tostring(properties.vmId), resourceGroup, location, tags
+) on vmId
+| project ip, id, vmUniqueId, resourceGroup, location, tags`
+
+// Provider represents an Azure provider, which looks up virtual machines with Azure Resource Graph.
+type Provider struct {
+	queryCount     uint64 // The cumulative number of Resource Graph queries
+	queryInstances uint64 // The cumulative number of IPs which have been looked up by queries
+	queryPages     uint64 // The cumulative number of pages of query results
+	queryErrors    uint64 // The cumulative number of failed queries
+	queryFound     uint64 // The cumulative number of instances found by queries
+
+	logger logrus.FieldLogger
+
+	client           *http.Client
+	resourceGraphURL string
+	subscriptions    []string
+	MaxInstances     int
+}
+
+func (p *Provider) EstimatedTags() int {
+	return 10 + 3 // 10 for VM tags, 1 each for the region, resource group, and scale set
+}
+
+// RunMetricsContext pulls a Statser from the Context and invokes RunMetrics.
+func (p *Provider) RunMetricsContext(ctx context.Context) {
+	p.RunMetrics(ctx, stats.FromContext(ctx))
+}
+
+func (p *Provider) RunMetrics(ctx context.Context, statser stats.Statser) {
+	flushed, unregister := statser.RegisterFlush()
+	defer unregister()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-flushed:
+			// These are namespaced not tagged because they're very specific
+			statser.Gauge("cloudprovider.azure.querycount", float64(atomic.LoadUint64(&p.queryCount)), nil)
+			statser.Gauge("cloudprovider.azure.queryinstances", float64(atomic.LoadUint64(&p.queryInstances)), nil)
+			statser.Gauge("cloudprovider.azure.querypages", float64(atomic.LoadUint64(&p.queryPages)), nil)
+			statser.Gauge("cloudprovider.azure.queryerrors", float64(atomic.LoadUint64(&p.queryErrors)), nil)
+			statser.Gauge("cloudprovider.azure.queryfound", float64(atomic.LoadUint64(&p.queryFound)), nil)
+		}
+	}
+}
+
+// resourceGraphRequest is the body of a Resource Graph query.
+type resourceGraphRequest struct {
+	Subscriptions []string             `json:"subscriptions"`
+	Query         string               `json:"query"`
+	Options       resourceGraphOptions `json:"options"`
+}
+
+type resourceGraphOptions struct {
+	ResultFormat string `json:"resultFormat"`
+	SkipToken    string `json:"$skipToken,omitempty"`
+}
+
+type resourceGraphResponse struct {
+	SkipToken string        `json:"$skipToken"`
+	Data      []instanceRow `json:"data"`
+}
+
+// instanceRow is a row of the results of instanceQuery.
+type instanceRow struct {
+	IP            string            `json:"ip"`
+	ID            string            `json:"id"`         // The resource ID of the VM
+	VMID          string            `json:"vmUniqueId"` // The unique ID of the VM, which Azure assigns when it's created
+	ResourceGroup string            `json:"resourceGroup"`
+	Location      string            `json:"location"`
+	Tags          map[string]string `json:"tags"`
+}
+
+// Instance returns instances details from Azure.
+// ip -> nil pointer if instance was not found.
+// map is returned even in case of errors because it may contain partial data.
+func (p *Provider) Instance(ctx context.Context, IP ...gostatsd.Source) (map[gostatsd.Source]*gostatsd.Instance, error) {
+	instances := make(map[gostatsd.Source]*gostatsd.Instance, len(IP))
+	quoted := make([]string, 0, len(IP))
+	for _, ip := range IP {
+		instances[ip] = nil // initialize map. Used for lookups to see if info for IP was requested
+		// Only valid IPs are looked up, which also keeps anything but an IP out of the query
+		if net.ParseIP(string(ip)) == nil {
+			p.logger.WithField("ip", ip).Debug("Not looking up invalid IP")
+			continue
+		}
+		quoted = append(quoted, "'"+string(ip)+"'")
+	}
+	if len(quoted) == 0 {
+		return instances, nil
+	}
+
+	atomic.AddUint64(&p.queryCount, 1)
+	atomic.AddUint64(&p.queryInstances, uint64(len(quoted)))
+	instancesFound := uint64(0)
+	pages := uint64(0)
+
+	p.logger.WithField("ips", IP).Debug("Looking up instances")
+	req := &resourceGraphRequest{
+		Subscriptions: p.subscriptions,
+		Query:         fmt.Sprintf(instanceQuery, strings.Join(quoted, ", ")),
+		Options:       resourceGraphOptions{ResultFormat: "objectArray"},
+	}
+	var err error
+	for {
+		var resp *resourceGraphResponse
+		if resp, err = p.query(ctx, req); err != nil {
+			break
+		}
+		pages++
+		for _, row := range resp.Data {
+			ip := gostatsd.Source(row.IP)
+			if _, ok := instances[ip]; !ok {
+				p.logger.Warnf("Azure returned unexpected VM: %#v", row)
+				continue
+			}
+			instancesFound++
+			instances[ip] = row.instance()
+			p.logger.WithFields(logrus.Fields{
+				"instance": row.ID,
+				"ip":       ip,
+				"tags":     instances[ip].Tags,
+			}).Debug("Added tags")
+		}
+		if resp.SkipToken == "" {
+			break
+		}
+		req.Options.SkipToken = resp.SkipToken
+	}
+
+	for ip, instance := range instances {
+		if instance == nil {
+			p.logger.WithField("ip", ip).Debug("No results looking up instance")
+		}
+	}
+
+	atomic.AddUint64(&p.queryPages, pages)
+	atomic.AddUint64(&p.queryFound, instancesFound)
+
+	if err != nil {
+		atomic.AddUint64(&p.queryErrors, 1)
+		return instances, fmt.Errorf("error querying Azure Resource Graph: %v", err)
+	}
+	return instances, nil
+}
+
+// instance returns the instance of the VM of the row, identified by the unique ID of the VM, or its resource ID if
+// it has none, with its tags, region, and resource group,
+// and the scale set of VMs in a scale set.
+func (row *instanceRow) instance() *gostatsd.Instance {
+	keys := make([]string, 0, len(row.Tags))
+	for k := range row.Tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	tags := make(gostatsd.Tags, 0, len(row.Tags)+3)
+	for _, k := range keys {
+		tags = append(tags, gostatsd.NormalizeTagKey(k)+":"+row.Tags[k])
+	}
+	tags = append(tags, "region:"+row.Location, "resource_group:"+row.ResourceGroup)
+	if scaleSet := scaleSetOf(row.ID); scaleSet != "" {
+		tags = append(tags, "scale_set:"+scaleSet)
+	}
+	id := row.VMID
+	if id == "" {
+		id = row.ID
+	}
+	return &gostatsd.Instance{
+		ID:   gostatsd.Source(id),
+		Tags: tags,
+	}
+}
+
+// scaleSetOf returns the name of the scale set of a VM from its resource ID, which is of the form
+// /subscriptions/<id>/resourceGroups/<group>/providers/Microsoft.Compute/virtualMachineScaleSets/<name>/virtualMachines/<id>
+// for VMs in a scale set, or an empty string for other VMs.
+func scaleSetOf(id string) string {
+	parts := strings.Split(id, "/")
+	for i := 0; i+1 < len(parts); i++ {
+		if strings.EqualFold(parts[i], "virtualMachineScaleSets") {
+			return parts[i+1]
+		}
+	}
+	return ""
+}
+
+// query runs a Resource Graph query, and returns a page of its results.
+func (p *Provider) query(ctx context.Context, rgReq *resourceGraphRequest) (*resourceGraphResponse, error) {
+	body, err := json.Marshal(rgReq)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, p.resourceGraphURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		// Authentication failures and throttling are reported here, and every IP of the query is negatively cached
+		return nil, fmt.Errorf("status %d: %s", resp.StatusCode, respBody)
+	}
+	var rgResp resourceGraphResponse
+	if err := json.Unmarshal(respBody, &rgResp); err != nil {
+		return nil, fmt.Errorf("invalid response: %v", err)
+	}
+	return &rgResp, nil
+}
+
+// MaxInstancesBatch returns maximum number of instances that could be requested via the Instance method.
+func (p *Provider) MaxInstancesBatch() int {
+	return p.MaxInstances
+}
+
+// Name returns the name of the provider.
+func (p *Provider) Name() string {
+	return ProviderName
+}
+
+// NewProviderFromViper returns a new azure provider.
+func NewProviderFromViper(v *viper.Viper, logger logrus.FieldLogger, _ string) (gostatsd.CloudProvider, error) {
+	a := util.GetSubViper(v, "azure")
+	a.SetDefault("subscriptions", []string{})
+	a.SetDefault("resource-manager-endpoint", defaultResourceManagerEndpoint)
+	a.SetDefault("authority-host", azure.DefaultAuthorityHost)
+	a.SetDefault("tenant-id", "")
+	a.SetDefault("client-id", "")
+	a.SetDefault("client-secret", "")
+	a.SetDefault("client-timeout", defaultClientTimeout)
+	a.SetDefault("max-instances-batch", defaultMaxInstancesBatch)
+	httpTimeout := a.GetDuration("client-timeout")
+	if httpTimeout <= 0 {
+		return nil, errors.New("client timeout must be positive")
+	}
+	maxInstances := a.GetInt("max-instances-batch")
+	if maxInstances <= 0 {
+		return nil, errors.New("max number of instances per batch must be positive")
+	}
+
+	client := &http.Client{
+		Transport: http.DefaultTransport,
+		Timeout:   httpTimeout,
+	}
+	subscriptions := a.GetStringSlice("subscriptions")
+	if len(subscriptions) == 0 {
+		subscription, err := instanceSubscription(client, azure.MetadataURL)
+		if err != nil {
+			return nil, fmt.Errorf("subscriptions are not set, and could not be read from the metadata service: %v", err)
+		}
+		subscriptions = []string{subscription}
+	}
+	resourceManagerEndpoint := strings.TrimSuffix(a.GetString("resource-manager-endpoint"), "/")
+	tokenSource, err := azure.NewTokenSource(
+		client,
+		resourceManagerEndpoint+"/",
+		a.GetString("authority-host"),
+		a.GetString("tenant-id"),
+		a.GetString("client-id"),
+		a.GetString("client-secret"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return newProvider(logger, client, tokenSource, resourceManagerEndpoint, subscriptions, maxInstances), nil
+}
+
+// newProvider returns a new azure provider, which queries the subscriptions with tokens from tokenSource, using
+// client.
+func newProvider(
+	logger logrus.FieldLogger,
+	client *http.Client,
+	tokenSource oauth2.TokenSource,
+	resourceManagerEndpoint string,
+	subscriptions []string,
+	maxInstances int,
+) *Provider {
+	return &Provider{
+		logger: logger,
+		client: &http.Client{
+			Transport: &oauth2.Transport{
+				Source: tokenSource,
+				Base:   client.Transport,
+			},
+			Timeout: client.Timeout,
+		},
+		resourceGraphURL: resourceManagerEndpoint + "/providers/Microsoft.ResourceGraph/resources?api-version=" + resourceGraphAPIVersion,
+		subscriptions:    subscriptions,
+		MaxInstances:     maxInstances,
+	}
+}
+
+// instanceSubscription returns the subscription of the instance from the Instance Metadata Service.
+func instanceSubscription(client *http.Client, metadataURL string) (string, error) {
+	body, err := azure.GetMetadata(client, metadataURL+"/instance/compute/subscriptionId?api-version=2021-02-01&format=text")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(body)), nil
+}
@@ -0,0 +1,134 @@
+package azure
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/internal/azure"
+)
+
+const (
+	vmID     = "/subscriptions/sub-1/resourceGroups/web-rg/providers/Microsoft.Compute/virtualMachines/web-1"
+	vmssVMID = "/subscriptions/sub-1/resourceGroups/batch-rg/providers/Microsoft.Compute/virtualMachineScaleSets/batch/virtualMachines/3"
+)
+
+// newFakeAzure returns a server which fakes the Instance Metadata Service under /metadata, and Resource Graph, which
+// responds with status if it's set.  The rows are returned in two pages.
+func newFakeAzure(t *testing.T, status int, queries *uint32) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metadata/identity/oauth2/token", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "true", r.Header.Get("Metadata"))
+		assert.Equal(t, "https://management.azure.com/", r.URL.Query().Get("resource"))
+		_, _ = w.Write([]byte(`{"access_token":"token123","expires_in":"3599","token_type":"Bearer"}`))
+	})
+	mux.HandleFunc("/metadata/instance/compute/subscriptionId", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "true", r.Header.Get("Metadata"))
+		_, _ = w.Write([]byte("sub-1\n"))
+	})
+	mux.HandleFunc("/providers/Microsoft.ResourceGraph/resources", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddUint32(queries, 1)
+		assert.Equal(t, resourceGraphAPIVersion, r.URL.Query().Get("api-version"))
+		assert.Equal(t, "Bearer token123", r.Header.Get("Authorization"))
+		if status != 0 {
+			w.WriteHeader(status)
+			_, _ = w.Write([]byte(`{"error":{"code":"RateLimiting"}}`))
+			return
+		}
+		var req resourceGraphRequest
+		if !assert.NoError(t, json.NewDecoder(r.Body).Decode(&req)) {
+			return
+		}
+		assert.Equal(t, []string{"sub-1"}, req.Subscriptions)
+		assert.Equal(t, "objectArray", req.Options.ResultFormat)
+		assert.Contains(t, req.Query, "where ip in ('10.0.0.4', '10.0.0.5', '10.0.0.6')")
+		if req.Options.SkipToken == "" {
+			_, _ = w.Write([]byte(`{"$skipToken":"page2","data":[
+				{"ip":"10.0.0.4","id":"` + vmID + `","vmUniqueId":"5c2b4e6a-1f3d-4c8e-9a7b-2d6e8f0a1b3c","resourceGroup":"web-rg","location":"eastus","tags":{"env":"prod","Team":"web"}}
+			]}`))
+			return
+		}
+		assert.Equal(t, "page2", req.Options.SkipToken)
+		_, _ = w.Write([]byte(`{"data":[
+			{"ip":"10.0.0.5","id":"` + vmssVMID + `","vmUniqueId":"","resourceGroup":"batch-rg","location":"westus","tags":null}
+		]}`))
+	})
+	return httptest.NewServer(mux)
+}
+
+func newTestProvider(t *testing.T, ts *httptest.Server) *Provider {
+	subscription, err := instanceSubscription(ts.Client(), ts.URL+"/metadata")
+	require.NoError(t, err)
+	tokenSource := &azure.ManagedIdentityTokenSource{
+		Client:      ts.Client(),
+		MetadataURL: ts.URL + "/metadata",
+		Resource:    defaultResourceManagerEndpoint + "/",
+	}
+	return newProvider(logrus.New(), ts.Client(), tokenSource, ts.URL, []string{subscription}, defaultMaxInstancesBatch)
+}
+
+func TestInstance(t *testing.T) {
+	t.Parallel()
+	var queries uint32
+	ts := newFakeAzure(t, 0, &queries)
+	defer ts.Close()
+	p := newTestProvider(t, ts)
+
+	instances, err := p.Instance(context.Background(), "10.0.0.4", "10.0.0.5", "10.0.0.6", "not-an-ip' or 1 == 1")
+	require.NoError(t, err)
+	assert.Equal(t, map[gostatsd.Source]*gostatsd.Instance{
+		"10.0.0.4": {
+			ID:   "5c2b4e6a-1f3d-4c8e-9a7b-2d6e8f0a1b3c",
+			Tags: gostatsd.Tags{"Team:web", "env:prod", "region:eastus", "resource_group:web-rg"},
+		},
+		"10.0.0.5": {
+			ID:   vmssVMID, // Without a unique ID
+			Tags: gostatsd.Tags{"region:westus", "resource_group:batch-rg", "scale_set:batch"},
+		},
+		"10.0.0.6":             nil,
+		"not-an-ip' or 1 == 1": nil,
+	}, instances)
+	assert.EqualValues(t, 2, queries)
+	assert.EqualValues(t, 2, p.queryPages)
+	assert.EqualValues(t, 2, p.queryFound)
+
+	// Nothing is queried without a valid IP
+	instances, err = p.Instance(context.Background(), "")
+	require.NoError(t, err)
+	assert.Equal(t, map[gostatsd.Source]*gostatsd.Instance{"": nil}, instances)
+	assert.EqualValues(t, 2, queries)
+}
+
+func TestInstanceErrors(t *testing.T) {
+	t.Parallel()
+	for _, status := range []int{http.StatusForbidden, http.StatusTooManyRequests} {
+		var queries uint32
+		ts := newFakeAzure(t, status, &queries)
+		p := newTestProvider(t, ts)
+
+		// Every IP is returned without an instance, so they are negatively cached
+		instances, err := p.Instance(context.Background(), "10.0.0.4", "10.0.0.5", "10.0.0.6")
+		ts.Close()
+		require.Error(t, err, "status %d", status)
+		assert.True(t, strings.Contains(err.Error(), "RateLimiting"), "status %d", status)
+		assert.Equal(t, map[gostatsd.Source]*gostatsd.Instance{"10.0.0.4": nil, "10.0.0.5": nil, "10.0.0.6": nil}, instances)
+		assert.EqualValues(t, 1, p.queryErrors)
+	}
+}
+
+func TestScaleSetOf(t *testing.T) {
+	t.Parallel()
+	assert.Equal(t, "batch", scaleSetOf(vmssVMID))
+	assert.Equal(t, "batch", scaleSetOf(strings.ToLower(vmssVMID)))
+	assert.Empty(t, scaleSetOf(vmID))
+	assert.Empty(t, scaleSetOf(""))
+}
@@ -8,12 +8,14 @@ import (
 
 	"github.com/atlassian/gostatsd"
 	"github.com/atlassian/gostatsd/pkg/cloudproviders/aws"
+	"github.com/atlassian/gostatsd/pkg/cloudproviders/azure"
 )
 
 var (
 	// All registered cloud providers.
 	providers = map[string]gostatsd.CloudProviderFactory{
-		aws.ProviderName: aws.NewProviderFromViper,
+		aws.ProviderName:   aws.NewProviderFromViper,
+		azure.ProviderName: azure.NewProviderFromViper,
 	}
 
 	ErrUnknownProvider = errors.New("unknown cloud provider")
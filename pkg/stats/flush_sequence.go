@@ -0,0 +1,44 @@
+package stats
+
+import (
+	"context"
+
+	"github.com/atlassian/gostatsd"
+)
+
+// FlushSequencer sends a gauge with the number of flushes since it started, so gaps in the sequence show missed
+// flushes, and a decrease shows a restart.  The sequence starts at 1 and is not persisted.
+type FlushSequencer struct {
+	metricName string
+	tags       gostatsd.Tags
+	sequence   uint64
+}
+
+// NewFlushSequencer creates a new FlushSequencer
+func NewFlushSequencer(metricName string, tags gostatsd.Tags) *FlushSequencer {
+	return &FlushSequencer{
+		metricName: metricName,
+		tags:       tags,
+	}
+}
+
+// Run will run a FlushSequencer in the background until the supplied context is closed.
+func (fs *FlushSequencer) Run(ctx context.Context) {
+	statser := FromContext(ctx).WithTags(fs.tags)
+	flushed, unregister := statser.RegisterFlush()
+	defer unregister()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-flushed:
+			fs.emit(statser)
+		}
+	}
+}
+
+func (fs *FlushSequencer) emit(statser Statser) {
+	fs.sequence++
+	statser.Gauge(fs.metricName, float64(fs.sequence), nil)
+}
@@ -0,0 +1,79 @@
+package stats
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/atlassian/gostatsd"
+)
+
+// gaugeRecordingStatser records the values of gauges, and notifies registered targets of flushes.
+type gaugeRecordingStatser struct {
+	countingStatser
+	fn flushNotifier
+
+	mu     sync.Mutex
+	values []float64
+}
+
+func (grs *gaugeRecordingStatser) NotifyFlush(ctx context.Context, d time.Duration) {
+	grs.fn.NotifyFlush(ctx, d)
+}
+
+func (grs *gaugeRecordingStatser) RegisterFlush() (<-chan time.Duration, func()) {
+	return grs.fn.RegisterFlush()
+}
+
+func (grs *gaugeRecordingStatser) Gauge(name string, value float64, tags gostatsd.Tags) {
+	grs.mu.Lock()
+	defer grs.mu.Unlock()
+	grs.values = append(grs.values, value)
+}
+
+func (grs *gaugeRecordingStatser) WithTags(tags gostatsd.Tags) Statser {
+	return grs
+}
+
+func (grs *gaugeRecordingStatser) recorded() []float64 {
+	grs.mu.Lock()
+	defer grs.mu.Unlock()
+	return append([]float64(nil), grs.values...)
+}
+
+func TestFlushSequencerIncrementsPerFlush(t *testing.T) {
+	t.Parallel()
+	statser := &gaugeRecordingStatser{}
+	fs := NewFlushSequencer("flusher.sequence", nil)
+	for i := 0; i < 5; i++ {
+		fs.emit(statser)
+	}
+	assert.Equal(t, []float64{1, 2, 3, 4, 5}, statser.recorded())
+}
+
+func TestFlushSequencerRun(t *testing.T) {
+	t.Parallel()
+	statser := &gaugeRecordingStatser{}
+	ctx, cancel := context.WithCancel(NewContext(context.Background(), statser))
+	defer cancel()
+
+	fs := NewFlushSequencer("flusher.sequence", nil)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		fs.Run(ctx)
+	}()
+
+	// Notifications are dropped while the sequencer is busy, and dropped flushes are not counted
+	require.Eventually(t, func() bool {
+		statser.NotifyFlush(ctx, time.Second)
+		return len(statser.recorded()) >= 3
+	}, time.Second, time.Millisecond)
+	cancel()
+	<-done
+	assert.Equal(t, []float64{1, 2, 3}, statser.recorded()[:3])
+}
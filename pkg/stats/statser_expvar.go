@@ -0,0 +1,105 @@
+package stats
+
+import (
+	"context"
+	"expvar"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+)
+
+// ExpvarStatser is a Statser which records metrics in an expvar.Map, and submits them to another Statser.  Each
+// metric is a variable named after the metric, followed by its sorted tags in braces if it has any.  Gauges and
+// timings are set to the latest value, and counts accumulate for the lifetime of the process.
+type ExpvarStatser struct {
+	statser Statser
+	tags    gostatsd.Tags
+	vars    *expvar.Map
+}
+
+// NewExpvarStatser creates a new Statser which records metrics with the additional tags in vars, and submits them
+// to statser.  The tags are not submitted, as statser is expected to add them itself.
+func NewExpvarStatser(statser Statser, tags gostatsd.Tags, vars *expvar.Map) *ExpvarStatser {
+	return &ExpvarStatser{
+		statser: statser,
+		tags:    tags,
+		vars:    vars,
+	}
+}
+
+func (es *ExpvarStatser) NotifyFlush(ctx context.Context, d time.Duration) {
+	es.statser.NotifyFlush(ctx, d)
+}
+
+func (es *ExpvarStatser) RegisterFlush() (<-chan time.Duration, func()) {
+	return es.statser.RegisterFlush()
+}
+
+// Gauge sends a gauge metric
+func (es *ExpvarStatser) Gauge(name string, value float64, tags gostatsd.Tags) {
+	es.set(name, value, tags)
+	es.statser.Gauge(name, value, tags)
+}
+
+// Count sends a counter metric
+func (es *ExpvarStatser) Count(name string, amount float64, tags gostatsd.Tags) {
+	es.vars.AddFloat(es.key(name, tags), amount)
+	es.statser.Count(name, amount, tags)
+}
+
+// Increment sends a counter metric with a value of 1
+func (es *ExpvarStatser) Increment(name string, tags gostatsd.Tags) {
+	es.vars.AddFloat(es.key(name, tags), 1)
+	es.statser.Increment(name, tags)
+}
+
+// TimingMS sends a timing metric from a millisecond value
+func (es *ExpvarStatser) TimingMS(name string, ms float64, tags gostatsd.Tags) {
+	es.set(name, ms, tags)
+	es.statser.TimingMS(name, ms, tags)
+}
+
+// TimingDuration sends a timing metric from a time.Duration
+func (es *ExpvarStatser) TimingDuration(name string, d time.Duration, tags gostatsd.Tags) {
+	es.set(name, float64(d)/float64(time.Millisecond), tags)
+	es.statser.TimingDuration(name, d, tags)
+}
+
+// NewTimer returns a new timer with time set to now
+func (es *ExpvarStatser) NewTimer(name string, tags gostatsd.Tags) *Timer {
+	return newTimer(es, name, tags)
+}
+
+// WithTags creates a new Statser with additional tags
+func (es *ExpvarStatser) WithTags(tags gostatsd.Tags) Statser {
+	return NewTaggedStatser(es, tags)
+}
+
+func (es *ExpvarStatser) Event(ctx context.Context, e *gostatsd.Event) {
+	es.statser.Event(ctx, e)
+}
+
+func (es *ExpvarStatser) WaitForEvents() {
+	es.statser.WaitForEvents()
+}
+
+// set sets the variable of the metric to value.
+func (es *ExpvarStatser) set(name string, value float64, tags gostatsd.Tags) {
+	key := es.key(name, tags)
+	// AddFloat creates the variable if it doesn't exist, without racing another goroutine creating it
+	es.vars.AddFloat(key, 0)
+	if f, ok := es.vars.Get(key).(*expvar.Float); ok {
+		f.Set(value)
+	}
+}
+
+// key returns the name of the variable of the metric.
+func (es *ExpvarStatser) key(name string, tags gostatsd.Tags) string {
+	if len(es.tags) > 0 {
+		tags = es.tags.Concat(tags)
+	}
+	if len(tags) == 0 {
+		return name
+	}
+	return name + "{" + tags.SortedString() + "}"
+}
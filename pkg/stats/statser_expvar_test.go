@@ -0,0 +1,54 @@
+package stats
+
+import (
+	"expvar"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/atlassian/gostatsd"
+)
+
+// expvarValue returns the value of the variable in vars, failing the test if it doesn't exist.
+func expvarValue(t *testing.T, vars *expvar.Map, key string) float64 {
+	v, ok := vars.Get(key).(*expvar.Float)
+	require.True(t, ok, "missing variable %s", key)
+	return v.Value()
+}
+
+func TestExpvarStatser(t *testing.T) {
+	t.Parallel()
+	cs := &countingStatser{}
+	vars := new(expvar.Map).Init()
+	es := NewExpvarStatser(cs, gostatsd.Tags{"pipeline:a"}, vars)
+
+	es.Gauge("aggregator.metrics_received", 5, gostatsd.Tags{"aggregator_id:1"})
+	es.Gauge("aggregator.metrics_received", 7, gostatsd.Tags{"aggregator_id:1"})
+	es.Count("parser.received_by_type", 3, gostatsd.Tags{"type:counter"})
+	es.Count("parser.received_by_type", 2, gostatsd.Tags{"type:counter"})
+	es.Increment("heartbeat", nil)
+	es.TimingDuration("flusher.total_time", 1500*time.Microsecond, nil)
+	es.WithTags(gostatsd.Tags{"backend:null"}).Gauge("backend.sent", 1, gostatsd.Tags{"result:success"})
+
+	assert.EqualValues(t, 7, expvarValue(t, vars, "aggregator.metrics_received{aggregator_id:1,pipeline:a}"))
+	assert.EqualValues(t, 5, expvarValue(t, vars, "parser.received_by_type{pipeline:a,type:counter}"))
+	assert.EqualValues(t, 1, expvarValue(t, vars, "heartbeat{pipeline:a}"))
+	assert.EqualValues(t, 1.5, expvarValue(t, vars, "flusher.total_time{pipeline:a}"))
+	assert.EqualValues(t, 1, expvarValue(t, vars, "backend.sent{backend:null,pipeline:a,result:success}"))
+
+	// Everything is submitted to the underlying Statser, without the tags
+	assert.EqualValues(t, 3, atomic.LoadUint64(&cs.gauges))
+	assert.EqualValues(t, 3, atomic.LoadUint64(&cs.counters))
+	assert.EqualValues(t, 1, atomic.LoadUint64(&cs.timers))
+}
+
+func TestExpvarStatserWithoutTags(t *testing.T) {
+	t.Parallel()
+	vars := new(expvar.Map).Init()
+	es := NewExpvarStatser(&countingStatser{}, nil, vars)
+	es.Gauge("parser.metrics_received", 2, nil)
+	assert.EqualValues(t, 2, expvarValue(t, vars, "parser.metrics_received"))
+}
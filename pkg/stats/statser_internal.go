@@ -18,25 +18,26 @@ import (
 type InternalStatser struct {
 	flushNotifier
 
-	tags      gostatsd.Tags
-	namespace string
-	hostname  gostatsd.Source
-	handler   gostatsd.PipelineHandler
+	tags     gostatsd.Tags
+	prefix   string // Prefixed to the names of metrics, the namespace and its separator
+	hostname gostatsd.Source
+	handler  gostatsd.PipelineHandler
 
 	consolidator *gostatsd.MetricConsolidator
 }
 
 // NewInternalStatser creates a new Statser which sends metrics to the
-// supplied InternalHandler.
-func NewInternalStatser(tags gostatsd.Tags, namespace string, hostname gostatsd.Source, handler gostatsd.PipelineHandler) *InternalStatser {
+// supplied InternalHandler.  The namespace, if not empty, is joined to the
+// name of every metric with the separator.
+func NewInternalStatser(tags gostatsd.Tags, namespace, separator string, hostname gostatsd.Source, handler gostatsd.PipelineHandler) *InternalStatser {
 	if hostname != gostatsd.UnknownSource {
 		tags = tags.Concat(gostatsd.Tags{"host:" + string(hostname)})
 	}
 	return &InternalStatser{
-		tags:      tags,
-		namespace: namespace,
-		hostname:  hostname,
-		handler:   handler,
+		tags:     tags,
+		prefix:   gostatsd.NamespacePrefix(namespace, separator),
+		hostname: hostname,
+		handler:  handler,
 		// We can't just use a MetricMap because everything
 		// that writes to it is on its own goroutine.
 		consolidator: gostatsd.NewMetricConsolidator(10, 0, nil),
@@ -116,9 +117,7 @@ func (is *InternalStatser) WithTags(tags gostatsd.Tags) Statser {
 
 func (is *InternalStatser) dispatchMetric(metric *gostatsd.Metric) {
 	// the metric is owned by this file, we can change it freely because we know its origins
-	if is.namespace != "" {
-		metric.Name = is.namespace + "." + metric.Name
-	}
+	metric.Name = is.prefix + metric.Name
 	metric.Tags = metric.Tags.Concat(is.tags)
 	is.consolidator.ReceiveMetrics([]*gostatsd.Metric{metric})
 }
@@ -0,0 +1,290 @@
+package stats
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tilinna/clock"
+
+	"github.com/atlassian/gostatsd"
+)
+
+// DefaultPrometheusRegistry is the registry internal metrics are published in for the Prometheus endpoint of the HTTP
+// servers.  It is shared by every Server in the process, so they must have different InternalTags to be told apart.
+var DefaultPrometheusRegistry = NewPrometheusRegistry()
+
+// PrometheusRegistry holds the latest value of metrics, and writes them in the Prometheus text exposition format.
+type PrometheusRegistry struct {
+	clock clock.Clock
+
+	mu      sync.Mutex
+	metrics map[string]*prometheusMetric // By sanitized name
+}
+
+type prometheusMetric struct {
+	metricType string // counter or gauge
+	series     map[string]*prometheusSeries
+}
+
+type prometheusSeries struct {
+	labels  string // Formatted as {key="value",...}, or empty if there are no labels
+	value   float64
+	expires time.Time // Zero if the series never expires
+}
+
+// NewPrometheusRegistry creates a new empty PrometheusRegistry.
+func NewPrometheusRegistry() *PrometheusRegistry {
+	return &PrometheusRegistry{
+		clock:   clock.Realtime(),
+		metrics: map[string]*prometheusMetric{},
+	}
+}
+
+// update applies f to the current value of the series of the metric, creating it with a value of 0 if it doesn't
+// exist, and expires it after ttl unless it is updated again.  A metric keeps the type it was first seen with.
+func (pr *PrometheusRegistry) update(metricType, name string, tags gostatsd.Tags, ttl time.Duration, f func(float64) float64) {
+	name = prometheusName(name)
+	labels := prometheusLabels(tags)
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	m, ok := pr.metrics[name]
+	if !ok {
+		m = &prometheusMetric{
+			metricType: metricType,
+			series:     map[string]*prometheusSeries{},
+		}
+		pr.metrics[name] = m
+	}
+	s, ok := m.series[labels]
+	if !ok {
+		s = &prometheusSeries{labels: labels}
+		m.series[labels] = s
+	}
+	s.value = f(s.value)
+	if ttl > 0 {
+		s.expires = pr.clock.Now().Add(ttl)
+	} else {
+		s.expires = time.Time{}
+	}
+}
+
+// expire removes the series which have expired, and the metrics which have no series left.  It must be called with
+// mu held.
+func (pr *PrometheusRegistry) expire() {
+	now := pr.clock.Now()
+	for name, m := range pr.metrics {
+		for labels, s := range m.series {
+			if !s.expires.IsZero() && !now.Before(s.expires) {
+				delete(m.series, labels)
+			}
+		}
+		if len(m.series) == 0 {
+			delete(pr.metrics, name)
+		}
+	}
+}
+
+// WriteTo writes every metric which hasn't expired in the Prometheus text exposition format, sorted by name and
+// labels.
+func (pr *PrometheusRegistry) WriteTo(w io.Writer) (int64, error) {
+	var sb strings.Builder
+	pr.mu.Lock()
+	pr.expire()
+	names := make([]string, 0, len(pr.metrics))
+	for name := range pr.metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		m := pr.metrics[name]
+		fmt.Fprintf(&sb, "# TYPE %s %s\n", name, m.metricType)
+		series := make([]string, 0, len(m.series))
+		for labels := range m.series {
+			series = append(series, labels)
+		}
+		sort.Strings(series)
+		for _, labels := range series {
+			sb.WriteString(name)
+			sb.WriteString(labels)
+			sb.WriteByte(' ')
+			sb.WriteString(prometheusValue(m.series[labels].value))
+			sb.WriteByte('\n')
+		}
+	}
+	pr.mu.Unlock()
+	n, err := io.WriteString(w, sb.String())
+	return int64(n), err
+}
+
+// ServeHTTP writes every metric in the Prometheus text exposition format.
+func (pr *PrometheusRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = pr.WriteTo(w)
+}
+
+// prometheusName returns name with every character which isn't valid in a Prometheus metric name replaced by `_`,
+// so `aggregator.metrics_received` becomes `aggregator_metrics_received`.
+func prometheusName(name string) string {
+	sanitized := []byte(name)
+	for i, c := range sanitized {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_' || c == ':' || c >= '0' && c <= '9' && i > 0) {
+			sanitized[i] = '_'
+		}
+	}
+	return string(sanitized)
+}
+
+// prometheusLabels returns the tags as Prometheus labels, sorted by key.  The label name is sanitized like a metric
+// name, without `:` which is reserved.  A tag without a value is a label with the value `true`.  If a key is repeated,
+// the first value is used, as a label can only have one value.
+func prometheusLabels(tags gostatsd.Tags) string {
+	if len(tags) == 0 {
+		return ""
+	}
+	type label struct{ key, value string }
+	labels := make([]label, 0, len(tags))
+	seen := make(map[string]struct{}, len(tags))
+	for _, tag := range tags {
+		key, value := tag, "true"
+		if idx := strings.IndexByte(tag, ':'); idx >= 0 {
+			key, value = tag[:idx], tag[idx+1:]
+		}
+		key = strings.ReplaceAll(prometheusName(key), ":", "_")
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+		labels = append(labels, label{key, value})
+	}
+	sort.Slice(labels, func(i, j int) bool {
+		return labels[i].key < labels[j].key
+	})
+	var sb strings.Builder
+	sb.WriteByte('{')
+	for i, l := range labels {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(l.key)
+		sb.WriteString(`="`)
+		sb.WriteString(prometheusLabelValueReplacer.Replace(l.value))
+		sb.WriteByte('"')
+	}
+	sb.WriteByte('}')
+	return sb.String()
+}
+
+var prometheusLabelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func prometheusValue(value float64) string {
+	switch {
+	case math.IsNaN(value):
+		return "NaN"
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// PrometheusStatser is a Statser which records metrics in a PrometheusRegistry, and submits them to another Statser.
+// Gauges and timings are gauges set to the latest value, with timings in milliseconds, and counts are counters which
+// accumulate until the series expires.
+type PrometheusStatser struct {
+	statser  Statser
+	tags     gostatsd.Tags
+	registry *PrometheusRegistry
+	ttl      time.Duration
+}
+
+// NewPrometheusStatser creates a new Statser which records metrics with the additional tags in registry, and submits
+// them to statser.  The tags are not submitted, as statser is expected to add them itself.  A series which isn't
+// updated for ttl is removed from the registry, so series which are no longer emitted don't accumulate.  A ttl of 0
+// keeps every series.
+func NewPrometheusStatser(statser Statser, tags gostatsd.Tags, registry *PrometheusRegistry, ttl time.Duration) *PrometheusStatser {
+	return &PrometheusStatser{
+		statser:  statser,
+		tags:     tags,
+		registry: registry,
+		ttl:      ttl,
+	}
+}
+
+func (ps *PrometheusStatser) NotifyFlush(ctx context.Context, d time.Duration) {
+	ps.statser.NotifyFlush(ctx, d)
+}
+
+func (ps *PrometheusStatser) RegisterFlush() (<-chan time.Duration, func()) {
+	return ps.statser.RegisterFlush()
+}
+
+// Gauge sends a gauge metric
+func (ps *PrometheusStatser) Gauge(name string, value float64, tags gostatsd.Tags) {
+	ps.set(name, value, tags)
+	ps.statser.Gauge(name, value, tags)
+}
+
+// Count sends a counter metric
+func (ps *PrometheusStatser) Count(name string, amount float64, tags gostatsd.Tags) {
+	ps.add(name, amount, tags)
+	ps.statser.Count(name, amount, tags)
+}
+
+// Increment sends a counter metric with a value of 1
+func (ps *PrometheusStatser) Increment(name string, tags gostatsd.Tags) {
+	ps.add(name, 1, tags)
+	ps.statser.Increment(name, tags)
+}
+
+// TimingMS sends a timing metric from a millisecond value
+func (ps *PrometheusStatser) TimingMS(name string, ms float64, tags gostatsd.Tags) {
+	ps.set(name, ms, tags)
+	ps.statser.TimingMS(name, ms, tags)
+}
+
+// TimingDuration sends a timing metric from a time.Duration
+func (ps *PrometheusStatser) TimingDuration(name string, d time.Duration, tags gostatsd.Tags) {
+	ps.set(name, float64(d)/float64(time.Millisecond), tags)
+	ps.statser.TimingDuration(name, d, tags)
+}
+
+// NewTimer returns a new timer with time set to now
+func (ps *PrometheusStatser) NewTimer(name string, tags gostatsd.Tags) *Timer {
+	return newTimer(ps, name, tags)
+}
+
+// WithTags creates a new Statser with additional tags
+func (ps *PrometheusStatser) WithTags(tags gostatsd.Tags) Statser {
+	return NewTaggedStatser(ps, tags)
+}
+
+func (ps *PrometheusStatser) Event(ctx context.Context, e *gostatsd.Event) {
+	ps.statser.Event(ctx, e)
+}
+
+func (ps *PrometheusStatser) WaitForEvents() {
+	ps.statser.WaitForEvents()
+}
+
+// set sets the gauge of the metric to value.
+func (ps *PrometheusStatser) set(name string, value float64, tags gostatsd.Tags) {
+	ps.registry.update("gauge", name, ps.tags.Concat(tags), ps.ttl, func(float64) float64 {
+		return value
+	})
+}
+
+// add adds amount to the counter of the metric.
+func (ps *PrometheusStatser) add(name string, amount float64, tags gostatsd.Tags) {
+	ps.registry.update("counter", name, ps.tags.Concat(tags), ps.ttl, func(current float64) float64 {
+		return current + amount
+	})
+}
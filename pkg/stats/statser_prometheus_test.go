@@ -0,0 +1,94 @@
+package stats
+
+import (
+	"math"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tilinna/clock"
+
+	"github.com/atlassian/gostatsd"
+)
+
+func TestPrometheusStatser(t *testing.T) {
+	t.Parallel()
+	cs := &countingStatser{}
+	registry := NewPrometheusRegistry()
+	ps := NewPrometheusStatser(cs, gostatsd.Tags{"pipeline:a"}, registry, 0)
+
+	ps.Gauge("aggregator.metrics_received", 5, gostatsd.Tags{"aggregator_id:1"})
+	ps.Gauge("aggregator.metrics_received", 7, gostatsd.Tags{"aggregator_id:1"})
+	ps.Gauge("aggregator.metrics_received", 2, gostatsd.Tags{"aggregator_id:2"})
+	ps.Count("parser.received_by_type", 3, gostatsd.Tags{"type:counter"})
+	ps.Count("parser.received_by_type", 2, gostatsd.Tags{"type:counter"})
+	ps.Increment("heartbeat", gostatsd.Tags{"version:\"1\"", "canary"})
+	ps.TimingDuration("flusher.total_time", 1500*time.Microsecond, nil)
+	ps.WithTags(gostatsd.Tags{"backend:null"}).Gauge("backend.sent", math.Inf(1), gostatsd.Tags{"result:success", "backend:other"})
+
+	var sb strings.Builder
+	_, err := registry.WriteTo(&sb)
+	require.NoError(t, err)
+	assert.Equal(t, `# TYPE aggregator_metrics_received gauge
+aggregator_metrics_received{aggregator_id="1",pipeline="a"} 7
+aggregator_metrics_received{aggregator_id="2",pipeline="a"} 2
+# TYPE backend_sent gauge
+backend_sent{backend="null",pipeline="a",result="success"} +Inf
+# TYPE flusher_total_time gauge
+flusher_total_time{pipeline="a"} 1.5
+# TYPE heartbeat counter
+heartbeat{canary="true",pipeline="a",version="\"1\""} 1
+# TYPE parser_received_by_type counter
+parser_received_by_type{pipeline="a",type="counter"} 5
+`, sb.String())
+
+	// Everything is submitted to the underlying Statser, without the tags
+	assert.EqualValues(t, 4, atomic.LoadUint64(&cs.gauges))
+	assert.EqualValues(t, 3, atomic.LoadUint64(&cs.counters))
+	assert.EqualValues(t, 1, atomic.LoadUint64(&cs.timers))
+}
+
+func TestPrometheusStatserExpiry(t *testing.T) {
+	t.Parallel()
+	registry := NewPrometheusRegistry()
+	mockClock := clock.NewMock(time.Unix(0, 0))
+	registry.clock = mockClock
+	ps := NewPrometheusStatser(NewNullStatser(), nil, registry, time.Minute)
+	write := func() string {
+		var sb strings.Builder
+		_, err := registry.WriteTo(&sb)
+		require.NoError(t, err)
+		return sb.String()
+	}
+
+	ps.Gauge("backend.sent", 1, gostatsd.Tags{"backend:old"})
+	ps.Count("backend.dropped", 2, gostatsd.Tags{"backend:old"})
+	mockClock.Add(30 * time.Second)
+	ps.Gauge("backend.sent", 3, gostatsd.Tags{"backend:new"})
+	assert.Equal(t, `# TYPE backend_dropped counter
+backend_dropped{backend="old"} 2
+# TYPE backend_sent gauge
+backend_sent{backend="new"} 3
+backend_sent{backend="old"} 1
+`, write())
+
+	// Series which aren't updated expire, along with metrics with no series left
+	mockClock.Add(30 * time.Second)
+	assert.Equal(t, `# TYPE backend_sent gauge
+backend_sent{backend="new"} 3
+`, write())
+
+	// An expired counter starts again from 0
+	ps.Count("backend.dropped", 1, gostatsd.Tags{"backend:old"})
+	assert.Contains(t, write(), `backend_dropped{backend="old"} 1`)
+}
+
+func TestPrometheusName(t *testing.T) {
+	t.Parallel()
+	assert.Equal(t, "cloudprovider_cache_hit", prometheusName("cloudprovider.cache-hit"))
+	assert.Equal(t, "_xx_metric", prometheusName("1xx.metric"))
+	assert.Equal(t, `{tag_key="v:w"}`, prometheusLabels(gostatsd.Tags{"tag.key:v:w"}))
+}
@@ -5,10 +5,12 @@ import (
 	"math"
 	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/atlassian/gostatsd"
 	"github.com/atlassian/gostatsd/pkg/stats"
+	"github.com/atlassian/gostatsd/pkg/tdigest"
 )
 
 // percentStruct is a cache of percentile names to avoid creating them for each timer.
@@ -21,9 +23,24 @@ type percentStruct struct {
 	lower      string
 }
 
+// newPercentStruct names the sub-metrics of a percentile.  Fractional percentiles have the `.` replaced with `_`, as
+// statsd does, so 99.9 is named `upper_99_9` rather than clashing with 99.
+func newPercentStruct(pct float64) percentStruct {
+	sPct := strings.Replace(strconv.FormatFloat(pct, 'f', -1, 64), ".", "_", 1)
+	return percentStruct{
+		count:      "count_" + sPct,
+		mean:       "mean_" + sPct,
+		sum:        "sum_" + sPct,
+		sumSquares: "sum_squares_" + sPct,
+		upper:      "upper_" + sPct,
+		lower:      "lower_" + sPct,
+	}
+}
+
 // MetricAggregator aggregates metrics.
 type MetricAggregator struct {
 	metricMapsReceived    uint64
+	forcedEvictions       uint64
 	expiryIntervalCounter time.Duration // How often to expire counters
 	expiryIntervalGauge   time.Duration // How often to expire gauges
 	expiryIntervalSet     time.Duration // How often to expire sets
@@ -33,6 +50,12 @@ type MetricAggregator struct {
 	statser               stats.Statser
 	disabledSubtypes      gostatsd.TimerSubtypes
 	histogramLimit        uint32
+	timerOverrides        []*TimerOverride
+	digestOverrides       bool            // A timer override folds the values of its timers in to a digest
+	selectPercentiles     bool            // Use a selection algorithm rather than sorting timer values
+	rawTimersOnly         bool            // Every backend uses raw timer samples, so statistics are not calculated
+	minLifetime           time.Duration   // How long a series is kept after it is first seen, regardless of expiry
+	memoryPressure        *memoryPressure // Evicts series while the heap is over a threshold, nil if disabled
 	metricMap             *gostatsd.MetricMap
 }
 
@@ -52,25 +75,46 @@ func NewMetricAggregator(
 		expiryIntervalSet:     expiryIntervalSet,
 		expiryIntervalTimer:   expiryIntervalTimer,
 
-		percentThresholds: make(map[float64]percentStruct, len(percentThresholds)),
+		percentThresholds: newPercentThresholds(percentThresholds),
 		now:               time.Now,
 		statser:           stats.NewNullStatser(), // Will probably be replaced via RunMetrics
 		metricMap:         gostatsd.NewMetricMap(),
 		disabledSubtypes:  disabled,
 		histogramLimit:    histogramLimit,
 	}
+	return &a
+}
+
+func newPercentThresholds(percentThresholds []float64) map[float64]percentStruct {
+	pcts := make(map[float64]percentStruct, len(percentThresholds))
 	for _, pct := range percentThresholds {
-		sPct := strconv.Itoa(int(pct))
-		a.percentThresholds[pct] = percentStruct{
-			count:      "count_" + sPct,
-			mean:       "mean_" + sPct,
-			sum:        "sum_" + sPct,
-			sumSquares: "sum_squares_" + sPct,
-			upper:      "upper_" + sPct,
-			lower:      "lower_" + sPct,
+		if pct == 0 {
+			continue // No values are ever in it
 		}
+		pcts[pct] = newPercentStruct(pct)
 	}
-	return &a
+	return pcts
+}
+
+// SetPercentiles replaces the percentiles and timer overrides, which are used from the next flush.  The timer values
+// already received are kept, so they are flushed with the new percentiles.
+func (a *MetricAggregator) SetPercentiles(percentThresholds []float64, timerOverrides []*TimerOverride) {
+	a.percentThresholds = newPercentThresholds(percentThresholds)
+	a.setTimerOverrides(timerOverrides)
+}
+
+func (a *MetricAggregator) setTimerOverrides(timerOverrides []*TimerOverride) {
+	a.timerOverrides = timerOverrides
+	a.digestOverrides = hasDigestOverride(timerOverrides)
+}
+
+func hasDigestOverride(timerOverrides []*TimerOverride) bool {
+	for _, to := range timerOverrides {
+		if to.digestCompression > 0 {
+			return true
+		}
+	}
+	return false
 }
 
 // round rounds a number to its nearest integer value.
@@ -82,6 +126,9 @@ func round(v float64) float64 {
 // Flush prepares the contents of a MetricAggregator for sending via the Sender.
 func (a *MetricAggregator) Flush(flushInterval time.Duration) {
 	a.statser.Gauge("aggregator.metricmaps_received", float64(a.metricMapsReceived), nil)
+	if a.memoryPressure != nil {
+		a.statser.Gauge("aggregator.forced_evictions", float64(a.forcedEvictions), nil)
+	}
 
 	flushInSeconds := float64(flushInterval) / float64(time.Second)
 
@@ -91,13 +138,51 @@ func (a *MetricAggregator) Flush(flushInterval time.Duration) {
 	})
 
 	a.metricMap.Timers.Each(func(key, tagsKey string, timer gostatsd.Timer) {
+		if timer.Buckets != nil {
+			timer.Histogram = preAggregatedHistogram(timer, a.histogramLimit)
+			timer.Count = timer.Histogram[gostatsd.HistogramThreshold(math.Inf(1))]
+			timer.PerSecond = float64(timer.Count) / flushInSeconds
+			a.metricMap.Timers[key][tagsKey] = timer
+			return
+		}
+
 		if hasHistogramTag(timer) {
 			timer.Histogram = latencyHistogram(timer, a.histogramLimit)
 			a.metricMap.Timers[key][tagsKey] = timer
 			return
 		}
 
-		if count := len(timer.Values); count > 0 {
+		to := a.timerOverride(key)
+		if to != nil && to.histogramThresholds != nil {
+			timer.Histogram = fixedHistogram(timer, to.histogramThresholds)
+			a.metricMap.Timers[key][tagsKey] = timer
+			return
+		}
+
+		if a.rawTimersOnly && timer.Digest == nil {
+			// Values are passed through as received, the backends only need the count
+			timer.Count = int(round(timer.SampledCount))
+			timer.PerSecond = timer.SampledCount / flushInSeconds
+			a.metricMap.Timers[key][tagsKey] = timer
+			return
+		}
+
+		percentThresholds := a.percentThresholds
+		disabledSubtypes := a.disabledSubtypes
+		timer.DisabledSubtypes = nil
+		if to != nil {
+			percentThresholds = to.percentThresholds
+			if !to.percentilesOnly {
+				disabledSubtypes = to.DisabledSubtypes
+				timer.DisabledSubtypes = &to.DisabledSubtypes
+			}
+		}
+
+		if timer.Digest != nil {
+			flushDigest(&timer, percentThresholds, disabledSubtypes, flushInSeconds)
+		} else if len(timer.Values) > 0 && a.selectPercentiles {
+			flushSelect(&timer, percentThresholds, disabledSubtypes, flushInSeconds)
+		} else if count := len(timer.Values); count > 0 {
 			sort.Float64s(timer.Values)
 			timer.Min = timer.Values[0]
 			timer.Max = timer.Values[count-1]
@@ -118,7 +203,7 @@ func (a *MetricAggregator) Flush(flushInterval time.Duration) {
 			var sum = timer.Min
 			var thresholdBoundary = timer.Max
 
-			for pct, pctStruct := range a.percentThresholds {
+			for pct, pctStruct := range percentThresholds {
 				numInThreshold := n
 				if n > 1 {
 					numInThreshold = int(round(math.Abs(pct) / 100 * count))
@@ -129,6 +214,11 @@ func (a *MetricAggregator) Flush(flushInterval time.Duration) {
 						thresholdBoundary = timer.Values[numInThreshold-1]
 						sum = cumulativeValues[numInThreshold-1]
 						sumSquares = cumulSumSquaresValues[numInThreshold-1]
+					} else if numInThreshold == n {
+						// Every value is in the threshold, there are none below it to subtract
+						thresholdBoundary = timer.Values[0]
+						sum = cumulativeValues[n-1]
+						sumSquares = cumulSumSquaresValues[n-1]
 					} else {
 						thresholdBoundary = timer.Values[n-numInThreshold]
 						sum = cumulativeValues[n-1] - cumulativeValues[n-numInThreshold-1]
@@ -137,27 +227,7 @@ func (a *MetricAggregator) Flush(flushInterval time.Duration) {
 					mean = sum / float64(numInThreshold)
 				}
 
-				if !a.disabledSubtypes.CountPct {
-					timer.Percentiles.Set(pctStruct.count, float64(numInThreshold))
-				}
-				if !a.disabledSubtypes.MeanPct {
-					timer.Percentiles.Set(pctStruct.mean, mean)
-				}
-				if !a.disabledSubtypes.SumPct {
-					timer.Percentiles.Set(pctStruct.sum, sum)
-				}
-				if !a.disabledSubtypes.SumSquaresPct {
-					timer.Percentiles.Set(pctStruct.sumSquares, sumSquares)
-				}
-				if pct > 0 {
-					if !a.disabledSubtypes.UpperPct {
-						timer.Percentiles.Set(pctStruct.upper, thresholdBoundary)
-					}
-				} else {
-					if !a.disabledSubtypes.LowerPct {
-						timer.Percentiles.Set(pctStruct.lower, thresholdBoundary)
-					}
-				}
+				setPercentiles(&timer, pct, pctStruct, disabledSubtypes, float64(numInThreshold), mean, sum, sumSquares, thresholdBoundary)
 			}
 
 			sum = cumulativeValues[n-1]
@@ -192,6 +262,79 @@ func (a *MetricAggregator) Flush(flushInterval time.Duration) {
 	})
 }
 
+// flushDigest calculates the timer statistics from its digest, which any values received directly are added to.
+// Percentile sub-metrics are estimated, everything else is exact.
+func flushDigest(timer *gostatsd.Timer, percentThresholds map[float64]percentStruct, disabledSubtypes gostatsd.TimerSubtypes, flushInSeconds float64) {
+	td := timer.Digest.Clone()
+	for _, v := range timer.Values {
+		td.Add(v)
+	}
+	timer.Digest = td
+
+	count := td.Count()
+	timer.Min = td.Min()
+	timer.Max = td.Max()
+	timer.Sum = td.Sum()
+	timer.SumSquares = td.SumSquares()
+	timer.Mean = timer.Sum / count
+	timer.StdDev = math.Sqrt(math.Max(timer.SumSquares/count-timer.Mean*timer.Mean, 0))
+	timer.Median = td.Quantile(0.5)
+
+	for pct, pctStruct := range percentThresholds {
+		q := math.Abs(pct) / 100
+		var numInThreshold, sum, sumSquares, thresholdBoundary float64
+		if pct > 0 {
+			numInThreshold, sum, sumSquares = td.Lowest(q)
+			thresholdBoundary = td.Quantile(q)
+		} else {
+			numInThreshold, sum, sumSquares = td.Highest(q)
+			thresholdBoundary = td.Quantile(1 - q)
+		}
+		if round(numInThreshold) == 0 {
+			continue
+		}
+		setPercentiles(timer, pct, pctStruct, disabledSubtypes, round(numInThreshold), sum/numInThreshold, sum, sumSquares, thresholdBoundary)
+	}
+
+	timer.Count = int(round(timer.SampledCount))
+	timer.PerSecond = timer.SampledCount / flushInSeconds
+}
+
+// setPercentiles sets the enabled sub-metrics of a single percentile.
+func setPercentiles(timer *gostatsd.Timer, pct float64, pctStruct percentStruct, disabledSubtypes gostatsd.TimerSubtypes, count, mean, sum, sumSquares, thresholdBoundary float64) {
+	if !disabledSubtypes.CountPct {
+		timer.Percentiles.Set(pctStruct.count, count)
+	}
+	if !disabledSubtypes.MeanPct {
+		timer.Percentiles.Set(pctStruct.mean, mean)
+	}
+	if !disabledSubtypes.SumPct {
+		timer.Percentiles.Set(pctStruct.sum, sum)
+	}
+	if !disabledSubtypes.SumSquaresPct {
+		timer.Percentiles.Set(pctStruct.sumSquares, sumSquares)
+	}
+	if pct > 0 {
+		if !disabledSubtypes.UpperPct {
+			timer.Percentiles.Set(pctStruct.upper, thresholdBoundary)
+		}
+	} else {
+		if !disabledSubtypes.LowerPct {
+			timer.Percentiles.Set(pctStruct.lower, thresholdBoundary)
+		}
+	}
+}
+
+// timerOverride returns the first TimerOverride which matches the timer, or nil if there is none.
+func (a *MetricAggregator) timerOverride(metricName string) *TimerOverride {
+	for _, to := range a.timerOverrides {
+		if to.matches(metricName) {
+			return to
+		}
+	}
+	return nil
+}
+
 func (a *MetricAggregator) RunMetrics(ctx context.Context, statser stats.Statser) {
 	a.statser = statser
 }
@@ -204,6 +347,32 @@ func isExpired(interval time.Duration, now, ts gostatsd.Nanotime) bool {
 	return interval != 0 && time.Duration(now-ts) > interval
 }
 
+// expiryInterval returns the expiry interval of a series, which is the interval for its type unless overridden.
+func expiryInterval(typeInterval, override time.Duration) time.Duration {
+	if override != 0 {
+		return override
+	}
+	return typeInterval
+}
+
+// isSeriesExpired indicates if a series has expired.  A series which has not been refreshed within its expiry interval
+// is kept until it is at least minLifetime old, unless persistence is disabled by a negative interval.
+func (a *MetricAggregator) isSeriesExpired(interval time.Duration, now, ts, firstSeen gostatsd.Nanotime) bool {
+	if !isExpired(interval, now, ts) {
+		return false
+	}
+	return interval < 0 || time.Duration(now-firstSeen) >= a.minLifetime
+}
+
+// firstSeen returns when a series was first seen, which is its timestamp the first time it is reset.  It is only
+// tracked if there is a minimum lifetime.
+func (a *MetricAggregator) firstSeen(firstSeen, timestamp gostatsd.Nanotime) gostatsd.Nanotime {
+	if firstSeen == 0 && a.minLifetime > 0 {
+		return timestamp
+	}
+	return firstSeen
+}
+
 func deleteMetric(key, tagsKey string, metrics gostatsd.AggregatedMetrics) {
 	metrics.DeleteChild(key, tagsKey)
 	if !metrics.HasChildren(key) {
@@ -211,55 +380,89 @@ func deleteMetric(key, tagsKey string, metrics gostatsd.AggregatedMetrics) {
 	}
 }
 
-// Reset clears the contents of a MetricAggregator.
+// Reset clears the contents of a MetricAggregator.  If the heap is over the memory eviction threshold, the least
+// recently updated series are evicted, and the sample buffers of the timers are released rather than reused.
 func (a *MetricAggregator) Reset() {
 	a.metricMapsReceived = 0
-	nowNano := gostatsd.Nanotime(a.now().UnixNano())
+	now := a.now()
+	nowNano := gostatsd.Nanotime(now.UnixNano())
+
+	timerValues := func(values []float64) []float64 {
+		return values[:0]
+	}
+	if a.memoryPressure != nil && a.memoryPressure.isOver(now) {
+		a.forcedEvictions += uint64(a.evictLeastRecentlyUpdated())
+		timerValues = func([]float64) []float64 {
+			return nil
+		}
+	}
 
 	a.metricMap.Counters.Each(func(key, tagsKey string, counter gostatsd.Counter) {
-		if isExpired(a.expiryIntervalCounter, nowNano, counter.Timestamp) {
+		counter.FirstSeen = a.firstSeen(counter.FirstSeen, counter.Timestamp)
+		if a.isSeriesExpired(expiryInterval(a.expiryIntervalCounter, counter.Expiry), nowNano, counter.Timestamp, counter.FirstSeen) {
 			deleteMetric(key, tagsKey, a.metricMap.Counters)
 		} else {
 			a.metricMap.Counters[key][tagsKey] = gostatsd.Counter{
 				Timestamp: counter.Timestamp,
 				Source:    counter.Source,
 				Tags:      counter.Tags,
+				Expiry:    counter.Expiry,
+				FirstSeen: counter.FirstSeen,
 			}
 		}
 	})
 
 	a.metricMap.Timers.Each(func(key, tagsKey string, timer gostatsd.Timer) {
-		if isExpired(a.expiryIntervalTimer, nowNano, timer.Timestamp) {
+		timer.FirstSeen = a.firstSeen(timer.FirstSeen, timer.Timestamp)
+		if a.isSeriesExpired(expiryInterval(a.expiryIntervalTimer, timer.Expiry), nowNano, timer.Timestamp, timer.FirstSeen) {
 			deleteMetric(key, tagsKey, a.metricMap.Timers)
 		} else {
-			if hasHistogramTag(timer) {
+			if timer.Buckets != nil {
+				a.metricMap.Timers[key][tagsKey] = gostatsd.Timer{
+					Timestamp: timer.Timestamp,
+					Source:    timer.Source,
+					Tags:      timer.Tags,
+					Values:    timerValues(timer.Values),
+					Buckets:   emptyBuckets(timer.Buckets),
+					Expiry:    timer.Expiry,
+					FirstSeen: timer.FirstSeen,
+				}
+			} else if hasHistogramTag(timer) {
 				a.metricMap.Timers[key][tagsKey] = gostatsd.Timer{
 					Timestamp: timer.Timestamp,
 					Source:    timer.Source,
 					Tags:      timer.Tags,
-					Values:    timer.Values[:0],
+					Values:    timerValues(timer.Values),
 					Histogram: emptyHistogram(timer, a.histogramLimit),
+					Expiry:    timer.Expiry,
+					FirstSeen: timer.FirstSeen,
 				}
 			} else {
 				a.metricMap.Timers[key][tagsKey] = gostatsd.Timer{
 					Timestamp: timer.Timestamp,
 					Source:    timer.Source,
 					Tags:      timer.Tags,
-					Values:    timer.Values[:0],
+					Values:    timerValues(timer.Values),
+					Expiry:    timer.Expiry,
+					FirstSeen: timer.FirstSeen,
 				}
 			}
 		}
 	})
 
 	a.metricMap.Gauges.Each(func(key, tagsKey string, gauge gostatsd.Gauge) {
-		if isExpired(a.expiryIntervalGauge, nowNano, gauge.Timestamp) {
+		gauge.FirstSeen = a.firstSeen(gauge.FirstSeen, gauge.Timestamp)
+		if a.isSeriesExpired(expiryInterval(a.expiryIntervalGauge, gauge.Expiry), nowNano, gauge.Timestamp, gauge.FirstSeen) {
 			deleteMetric(key, tagsKey, a.metricMap.Gauges)
+		} else {
+			// No reset for gauges, they keep the last value until expiration
+			a.metricMap.Gauges[key][tagsKey] = gauge
 		}
-		// No reset for gauges, they keep the last value until expiration
 	})
 
 	a.metricMap.Sets.Each(func(key, tagsKey string, set gostatsd.Set) {
-		if isExpired(a.expiryIntervalSet, nowNano, set.Timestamp) {
+		set.FirstSeen = a.firstSeen(set.FirstSeen, set.Timestamp)
+		if a.isSeriesExpired(expiryInterval(a.expiryIntervalSet, set.Expiry), nowNano, set.Timestamp, set.FirstSeen) {
 			deleteMetric(key, tagsKey, a.metricMap.Sets)
 		} else {
 			a.metricMap.Sets[key][tagsKey] = gostatsd.Set{
@@ -267,6 +470,8 @@ func (a *MetricAggregator) Reset() {
 				Timestamp: set.Timestamp,
 				Source:    set.Source,
 				Tags:      set.Tags,
+				Expiry:    set.Expiry,
+				FirstSeen: set.FirstSeen,
 			}
 		}
 	})
@@ -275,5 +480,58 @@ func (a *MetricAggregator) Reset() {
 // ReceiveMap takes a single metric map and will aggregate the values
 func (a *MetricAggregator) ReceiveMap(mm *gostatsd.MetricMap) {
 	a.metricMapsReceived++
-	a.metricMap.Merge(mm)
+	a.metricMap.Merge(a.digestTimers(mm))
+}
+
+// digestTimers returns the metric map with the values of the timers matched by a timer override with a
+// digest-compression folded in to a t-digest, so the memory they take is bounded no matter how many are received
+// before the flush.  Their percentiles are estimated from the digest.  The map is only copied if it has any such
+// timers.  If every backend uses the raw values, they are always kept.
+func (a *MetricAggregator) digestTimers(mm *gostatsd.MetricMap) *gostatsd.MetricMap {
+	if !a.digestOverrides || a.rawTimersOnly || !a.hasDigestedTimers(mm) {
+		return mm
+	}
+	mmNew := gostatsd.NewMetricMap()
+	mm.Counters.Each(mmNew.MergeCounter)
+	mm.Sets.Each(mmNew.MergeSet)
+	mm.Gauges.Each(mmNew.MergeGauge)
+	mm.Timers.Each(func(metricName, tagsKey string, t gostatsd.Timer) {
+		if compression := a.digestCompression(metricName, t); compression > 0 {
+			td := tdigest.New(compression)
+			for _, v := range t.Values {
+				td.Add(v)
+			}
+			if t.Digest != nil {
+				td.Merge(t.Digest)
+			}
+			t.Digest = td
+			t.Values = nil
+		}
+		mmNew.MergeTimer(metricName, tagsKey, t)
+	})
+	return mmNew
+}
+
+func (a *MetricAggregator) hasDigestedTimers(mm *gostatsd.MetricMap) bool {
+	for metricName, timers := range mm.Timers {
+		for _, t := range timers {
+			if a.digestCompression(metricName, t) > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// digestCompression returns the compression of the digest the values of the timer are folded in to as they are
+// received, or 0 if they are kept until the flush.  Timers with pre-aggregated buckets or a gsd_histogram tag keep
+// their values, as their histograms are exact.
+func (a *MetricAggregator) digestCompression(metricName string, t gostatsd.Timer) float64 {
+	if len(t.Values) == 0 || t.Buckets != nil || hasHistogramTag(t) {
+		return 0
+	}
+	if to := a.timerOverride(metricName); to != nil {
+		return to.digestCompression
+	}
+	return 0
 }
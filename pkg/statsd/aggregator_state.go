@@ -0,0 +1,234 @@
+package statsd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pb"
+	"github.com/atlassian/gostatsd/pkg/tdigest"
+)
+
+// aggregatorStateHeader starts every state file, and must be changed if the format of the state changes, so state
+// saved by another version is discarded rather than misread.
+const aggregatorStateHeader = "gostatsd aggregator state v1\n"
+
+var errIncompatibleState = errors.New("state was saved by an incompatible version")
+
+// restoreState merges the state saved by a previous run in to the Aggregators, and removes the state file, so the
+// state can't be restored twice.  It must be called before the workers start.  State which can't be read is discarded.
+func (bh *BackendHandler) restoreState() {
+	logger := logrus.WithField("state-file", bh.stateFile)
+	mm, err := loadAggregatorState(bh.stateFile)
+	if err != nil {
+		logger.WithError(err).Warn("Discarding aggregator state")
+		return
+	}
+	if mm == nil {
+		return
+	}
+	// The number of workers may have changed, so the state is split the same way as received metrics
+	for aggrIdx, mmSplit := range mm.Split(bh.numWorkers) {
+		if !mmSplit.IsEmpty() {
+			bh.workers[aggrIdx].aggr.ReceiveMap(mmSplit)
+		}
+	}
+	logger.Info("Restored aggregator state")
+}
+
+// saveState saves the metrics which have been aggregated, but not flushed, to the state file.  It must be called
+// after the workers finish.
+func (bh *BackendHandler) saveState() {
+	logger := logrus.WithField("state-file", bh.stateFile)
+	mm := gostatsd.NewMetricMap()
+	for _, w := range bh.workers {
+		w.aggr.Process(func(aggrMap *gostatsd.MetricMap) {
+			mm.Merge(unflushedMetrics(aggrMap))
+		})
+	}
+	if mm.IsEmpty() {
+		return
+	}
+	if err := saveAggregatorState(bh.stateFile, mm); err != nil {
+		logger.WithError(err).Error("Failed to save aggregator state")
+		return
+	}
+	logger.Info("Saved aggregator state")
+}
+
+// unflushedMetrics returns the series of mm which have received values since they were last reset.  Gauges keep
+// their value when they are reset, so they are always included.
+func unflushedMetrics(mm *gostatsd.MetricMap) *gostatsd.MetricMap {
+	mmNew := gostatsd.NewMetricMap()
+	mm.Counters.Each(func(metricName, tagsKey string, c gostatsd.Counter) {
+		if c.Value != 0 {
+			mmNew.MergeCounter(metricName, tagsKey, c)
+		}
+	})
+	mm.Gauges.Each(mmNew.MergeGauge)
+	mm.Timers.Each(func(metricName, tagsKey string, t gostatsd.Timer) {
+		if len(t.Values) > 0 || t.Digest != nil || t.Buckets[gostatsd.HistogramThreshold(math.Inf(1))] > 0 {
+			mmNew.MergeTimer(metricName, tagsKey, t)
+		}
+	})
+	mm.Sets.Each(func(metricName, tagsKey string, s gostatsd.Set) {
+		if len(s.Values) > 0 {
+			mmNew.MergeSet(metricName, tagsKey, s)
+		}
+	})
+	return mmNew
+}
+
+// saveAggregatorState writes mm to path, in the format the http forwarder sends metrics in.  The state is written to
+// a temporary file which replaces path, so a partially written state is never restored.
+func saveAggregatorState(path string, mm *gostatsd.MetricMap) error {
+	b, err := proto.Marshal(translateToProtobufV2(mm, 0))
+	if err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, append([]byte(aggregatorStateHeader), b...), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// loadAggregatorState reads the state saved to path and removes it.  It returns nil if there is no state.  The
+// restored series are updated at the time the state was saved, so they don't replace gauges received since.
+func loadAggregatorState(path string) (*gostatsd.MetricMap, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Remove(path); err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(b, []byte(aggregatorStateHeader)) {
+		return nil, errIncompatibleState
+	}
+	var msg pb.RawMessageV2
+	if err := proto.Unmarshal(b[len(aggregatorStateHeader):], &msg); err != nil {
+		return nil, err
+	}
+	mm, err := translateStateFromProtobufV2(&msg, gostatsd.Nanotime(info.ModTime().UnixNano()))
+	if err != nil {
+		return nil, err
+	}
+	mm.DropNaN()
+	return mm, nil
+}
+
+// translateStateFromProtobufV2 converts saved state back to a MetricMap, with every series updated at savedAt, or
+// returns an error if the state is invalid.
+func translateStateFromProtobufV2(pbMetricMap *pb.RawMessageV2, savedAt gostatsd.Nanotime) (*gostatsd.MetricMap, error) {
+	mm := gostatsd.NewMetricMap()
+
+	for metricName, tagMap := range pbMetricMap.Counters {
+		for tagsKey, counter := range tagMap.TagMap {
+			mm.MergeCounter(metricName, tagsKey, gostatsd.Counter{
+				Value:     counter.Value,
+				Timestamp: savedAt,
+				Source:    gostatsd.Source(counter.Hostname),
+				Tags:      counter.Tags,
+			})
+		}
+	}
+
+	for metricName, tagMap := range pbMetricMap.Gauges {
+		for tagsKey, gauge := range tagMap.TagMap {
+			mm.MergeGauge(metricName, tagsKey, gostatsd.Gauge{
+				Value:     gauge.Value,
+				Timestamp: savedAt,
+				Source:    gostatsd.Source(gauge.Hostname),
+				Tags:      gauge.Tags,
+			})
+		}
+	}
+
+	for metricName, tagMap := range pbMetricMap.Timers {
+		for tagsKey, timer := range tagMap.TagMap {
+			digest, err := translateDigestFromProtobufV2(timer.Digest)
+			if err != nil {
+				return nil, fmt.Errorf("timer %s: %v", metricName, err)
+			}
+			buckets, err := translateBucketsFromProtobufV2(timer.BucketThresholds, timer.BucketCounts)
+			if err != nil {
+				return nil, fmt.Errorf("timer %s: %v", metricName, err)
+			}
+			mm.MergeTimer(metricName, tagsKey, gostatsd.Timer{
+				Values:       timer.Values,
+				Digest:       digest,
+				Buckets:      buckets,
+				SampledCount: timer.SampleCount,
+				Timestamp:    savedAt,
+				Source:       gostatsd.Source(timer.Hostname),
+				Tags:         timer.Tags,
+			})
+		}
+	}
+
+	for metricName, tagMap := range pbMetricMap.Sets {
+		for tagsKey, set := range tagMap.TagMap {
+			values := make(map[string]struct{}, len(set.Values))
+			for _, value := range set.Values {
+				values[value] = struct{}{}
+			}
+			mm.MergeSet(metricName, tagsKey, gostatsd.Set{
+				Values:    values,
+				Timestamp: savedAt,
+				Source:    gostatsd.Source(set.Hostname),
+				Tags:      set.Tags,
+			})
+		}
+	}
+
+	return mm, nil
+}
+
+func translateDigestFromProtobufV2(pbDigest *pb.TDigestV2) (*tdigest.TDigest, error) {
+	if pbDigest == nil {
+		return nil, nil
+	}
+	if len(pbDigest.Means) != len(pbDigest.Weights) {
+		return nil, fmt.Errorf("digest has %d means and %d weights", len(pbDigest.Means), len(pbDigest.Weights))
+	}
+	centroids := make([]tdigest.Centroid, len(pbDigest.Means))
+	for i := range pbDigest.Means {
+		centroids[i] = tdigest.Centroid{Mean: pbDigest.Means[i], Weight: pbDigest.Weights[i]}
+	}
+	return tdigest.FromCentroids(pbDigest.Compression, pbDigest.Min, pbDigest.Max, pbDigest.Sum, pbDigest.SumSquares, centroids)
+}
+
+func translateBucketsFromProtobufV2(thresholds []float64, counts []int64) (map[gostatsd.HistogramThreshold]int, error) {
+	if len(thresholds) == 0 && len(counts) == 0 {
+		return nil, nil
+	}
+	if len(thresholds) != len(counts) {
+		return nil, fmt.Errorf("histogram has %d thresholds and %d counts", len(thresholds), len(counts))
+	}
+	buckets := make(map[gostatsd.HistogramThreshold]int, len(thresholds))
+	for i, threshold := range thresholds {
+		if math.IsNaN(threshold) || counts[i] < 0 {
+			return nil, fmt.Errorf("histogram has an invalid bucket %v=%d", threshold, counts[i])
+		}
+		buckets[gostatsd.HistogramThreshold(threshold)] = int(counts[i])
+	}
+	if _, ok := buckets[gostatsd.HistogramThreshold(math.Inf(1))]; !ok {
+		return nil, errors.New("histogram has no +Inf bucket")
+	}
+	return buckets, nil
+}
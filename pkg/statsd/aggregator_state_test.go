@@ -0,0 +1,149 @@
+package statsd
+
+import (
+	"context"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ash2k/stager/wait"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pb"
+)
+
+func newStateTestBackendHandler(stateFile string, numWorkers int) *BackendHandler {
+	bh := NewBackendHandler(nil, 0, numWorkers, 10, AggregatorFactoryFunc(func() Aggregator {
+		return NewMetricAggregator(nil, 0, 0, 0, 0, gostatsd.TimerSubtypes{}, math.MaxUint32)
+	}))
+	bh.stateFile = stateFile
+	return bh
+}
+
+func stateTestMetrics(value float64, setValue string) *gostatsd.MetricMap {
+	now := gostatsd.Nanotime(time.Now().UnixNano())
+	mm := gostatsd.NewMetricMap()
+	mm.Receive(&gostatsd.Metric{Name: "c", Type: gostatsd.COUNTER, Value: value, Rate: 1, Tags: gostatsd.Tags{"a:b"}, Timestamp: now})
+	mm.Receive(&gostatsd.Metric{Name: "g", Type: gostatsd.GAUGE, Value: value, Rate: 1, Timestamp: now})
+	mm.Receive(&gostatsd.Metric{Name: "t", Type: gostatsd.TIMER, Value: value, Rate: 1, Timestamp: now})
+	mm.Receive(&gostatsd.Metric{Name: "s", Type: gostatsd.SET, StringValue: setValue, Rate: 1, Timestamp: now})
+	buckets := map[gostatsd.HistogramThreshold]int{1: int(value), gostatsd.HistogramThreshold(math.Inf(1)): 2 * int(value)}
+	mm.Receive(&gostatsd.Metric{Name: "h", Type: gostatsd.TIMER, Buckets: buckets, Rate: 1, Timestamp: now})
+	return mm
+}
+
+// runStateTestBackendHandler runs bh, dispatches the metric maps, and returns the aggregated state once it stops.
+func runStateTestBackendHandler(t *testing.T, bh *BackendHandler, mms ...*gostatsd.MetricMap) *gostatsd.MetricMap {
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg wait.Group
+	wg.StartWithContext(ctx, bh.Run)
+	for _, mm := range mms {
+		bh.DispatchMetricMap(ctx, mm)
+	}
+	cancel()
+	wg.Wait()
+
+	// The workers have finished, so the aggregators can be read directly
+	state := gostatsd.NewMetricMap()
+	for _, w := range bh.workers {
+		w.aggr.Process(func(mm *gostatsd.MetricMap) {
+			state.Merge(unflushedMetrics(mm))
+		})
+	}
+	return state
+}
+
+func TestBackendHandlerRestoresState(t *testing.T) {
+	t.Parallel()
+	stateFile := filepath.Join(t.TempDir(), "state")
+
+	runStateTestBackendHandler(t, newStateTestBackendHandler(stateFile, 2), stateTestMetrics(1, "x"), stateTestMetrics(2, "y"))
+	require.FileExists(t, stateFile)
+
+	// Restart with a different number of workers
+	state := runStateTestBackendHandler(t, newStateTestBackendHandler(stateFile, 3), stateTestMetrics(3, "z"))
+
+	assert.EqualValues(t, 6, state.Counters["c"]["a:b"].Value)
+	assert.EqualValues(t, gostatsd.Tags{"a:b"}, state.Counters["c"]["a:b"].Tags)
+	assert.EqualValues(t, 3, state.Gauges["g"][""].Value)
+	assert.ElementsMatch(t, []float64{1, 2, 3}, state.Timers["t"][""].Values)
+	assert.EqualValues(t, 3, state.Timers["t"][""].SampledCount)
+	assert.Equal(t, map[string]struct{}{"x": {}, "y": {}, "z": {}}, state.Sets["s"][""].Values)
+	assert.Equal(t, map[gostatsd.HistogramThreshold]int{1: 6, gostatsd.HistogramThreshold(math.Inf(1)): 12}, state.Timers["h"][""].Buckets)
+}
+
+func TestBackendHandlerRestoresStateOnce(t *testing.T) {
+	t.Parallel()
+	stateFile := filepath.Join(t.TempDir(), "state")
+
+	runStateTestBackendHandler(t, newStateTestBackendHandler(stateFile, 1), stateTestMetrics(1, "x"))
+	bh := newStateTestBackendHandler(stateFile, 1)
+	bh.restoreState()
+	assert.NoFileExists(t, stateFile)
+
+	bh = newStateTestBackendHandler(stateFile, 1)
+	bh.restoreState()
+	bh.workers[0].aggr.Process(func(mm *gostatsd.MetricMap) {
+		assert.True(t, mm.IsEmpty())
+	})
+}
+
+func TestBackendHandlerDiscardsIncompatibleState(t *testing.T) {
+	t.Parallel()
+	stateFile := filepath.Join(t.TempDir(), "state")
+	require.NoError(t, ioutil.WriteFile(stateFile, []byte("gostatsd aggregator state v0\nsomething else"), 0600))
+
+	state := runStateTestBackendHandler(t, newStateTestBackendHandler(stateFile, 1), stateTestMetrics(1, "x"))
+	assert.EqualValues(t, 1, state.Counters["c"]["a:b"].Value)
+	assert.Len(t, state.Timers["t"][""].Values, 1)
+
+	// The incompatible state is removed, and replaced with the current state on shutdown
+	b, err := ioutil.ReadFile(stateFile)
+	require.NoError(t, err)
+	assert.Contains(t, string(b), aggregatorStateHeader)
+}
+
+func TestBackendHandlerDiscardsInvalidDigestState(t *testing.T) {
+	t.Parallel()
+	stateFile := filepath.Join(t.TempDir(), "state")
+	b, err := proto.Marshal(&pb.RawMessageV2{
+		Timers: map[string]*pb.TimerTagV2{
+			"t": {TagMap: map[string]*pb.RawTimerV2{"": {Digest: &pb.TDigestV2{Compression: 100, Means: []float64{math.NaN()}, Weights: []float64{1}}}}},
+		},
+	})
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(stateFile, append([]byte(aggregatorStateHeader), b...), 0600))
+
+	_, err = loadAggregatorState(stateFile)
+	require.Error(t, err)
+	assert.NoFileExists(t, stateFile)
+}
+
+func TestBackendHandlerSavesNothingWithoutState(t *testing.T) {
+	t.Parallel()
+	stateFile := filepath.Join(t.TempDir(), "state")
+
+	runStateTestBackendHandler(t, newStateTestBackendHandler(stateFile, 1))
+	_, err := os.Stat(stateFile)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestUnflushedMetricsSkipsResetSeries(t *testing.T) {
+	t.Parallel()
+	ma := NewMetricAggregator(nil, 0, 0, 0, 0, gostatsd.TimerSubtypes{}, math.MaxUint32)
+	ma.ReceiveMap(stateTestMetrics(1, "x"))
+	ma.Reset()
+	ma.Process(func(mm *gostatsd.MetricMap) {
+		unflushed := unflushedMetrics(mm)
+		assert.Empty(t, unflushed.Counters)
+		assert.Empty(t, unflushed.Timers)
+		assert.Empty(t, unflushed.Sets)
+		assert.EqualValues(t, 1, unflushed.Gauges["g"][""].Value)
+	})
+}
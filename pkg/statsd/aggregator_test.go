@@ -1,13 +1,20 @@
 package statsd
 
 import (
+	"fmt"
 	"math"
+	"math/rand"
+	"runtime"
+	"sort"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
 	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/tdigest"
 )
 
 func newFakeAggregator() *MetricAggregator {
@@ -492,3 +499,202 @@ func TestDisabledLower(t *testing.T) {
 		}
 	}
 }
+
+// newDigestMetricMap creates a MetricMap with a single timer, received as a digest of values.
+func newDigestMetricMap(name string, values ...float64) *gostatsd.MetricMap {
+	td := tdigest.New(tdigest.DefaultCompression)
+	for _, v := range values {
+		td.Add(v)
+	}
+	mm := gostatsd.NewMetricMap()
+	mm.Timers[name] = map[string]gostatsd.Timer{
+		"": {Digest: td, SampledCount: float64(len(values))},
+	}
+	return mm
+}
+
+func TestFlushMergedDigests(t *testing.T) {
+	t.Parallel()
+	r := rand.New(rand.NewSource(1))
+
+	// The central aggregator merges digests from each edge node, and is compared to an aggregator of the raw values
+	pcts := []float64{50, 90, 99, -10}
+	newAggregator := func() *MetricAggregator {
+		return NewMetricAggregator(pcts, 0, 0, 0, 0, gostatsd.TimerSubtypes{}, math.MaxUint32)
+	}
+	central := newAggregator()
+	raw := newAggregator()
+	var all []float64
+	for node := 0; node < 10; node++ {
+		values := make([]float64, 500*(node+1))
+		for i := range values {
+			values[i] = r.ExpFloat64() * 100
+		}
+		all = append(all, values...)
+		central.ReceiveMap(newDigestMetricMap("timer", values...))
+		rawMap := gostatsd.NewMetricMap()
+		rawMap.Timers["timer"] = map[string]gostatsd.Timer{"": gostatsd.NewTimerValues(values)}
+		raw.ReceiveMap(rawMap)
+	}
+	// Values received directly by the central node are included as well
+	direct := gostatsd.NewMetricMap()
+	direct.Receive(&gostatsd.Metric{Name: "timer", Value: 5000, Rate: 1, Type: gostatsd.TIMER})
+	all = append(all, 5000)
+	central.ReceiveMap(direct)
+	raw.ReceiveMap(direct)
+	sort.Float64s(all)
+
+	central.Flush(time.Second)
+	raw.Flush(time.Second)
+	actual := central.metricMap.Timers["timer"][""]
+	expected := raw.metricMap.Timers["timer"][""]
+
+	assert.Equal(t, expected.Count, actual.Count)
+	assert.Equal(t, expected.PerSecond, actual.PerSecond)
+	assert.Equal(t, expected.Min, actual.Min)
+	assert.Equal(t, expected.Max, actual.Max)
+	assert.EqualValues(t, 5000, actual.Max)
+	assert.InEpsilon(t, expected.Sum, actual.Sum, 1e-9)
+	assert.InEpsilon(t, expected.SumSquares, actual.SumSquares, 1e-9)
+	assert.InEpsilon(t, expected.Mean, actual.Mean, 1e-9)
+	assert.InEpsilon(t, expected.StdDev, actual.StdDev, 1e-6)
+	assert.InEpsilon(t, expected.Median, actual.Median, 0.01)
+
+	// Estimated percentiles are within 1% of the rank of the exact percentile
+	expectedPcts := map[string]float64{}
+	for _, pct := range expected.Percentiles {
+		expectedPcts[pct.Str] = pct.Float
+	}
+	require.Len(t, actual.Percentiles, len(expectedPcts))
+	for _, pct := range actual.Percentiles {
+		expectedPct, ok := expectedPcts[pct.Str]
+		require.True(t, ok, pct.Str)
+		switch {
+		case strings.HasPrefix(pct.Str, "upper_"), strings.HasPrefix(pct.Str, "lower_"):
+			rankActual := sort.SearchFloat64s(all, pct.Float)
+			rankExpected := sort.SearchFloat64s(all, expectedPct)
+			assert.InDelta(t, rankExpected, rankActual, 0.01*float64(len(all)), pct.Str)
+		case strings.HasPrefix(pct.Str, "count_"):
+			assert.InDelta(t, expectedPct, pct.Float, 1, pct.Str)
+		case strings.HasPrefix(pct.Str, "sum_squares_"):
+			// The spread of values within each centroid is lost
+			assert.InEpsilon(t, expectedPct, pct.Float, 0.1, pct.Str)
+		default:
+			assert.InEpsilon(t, expectedPct, pct.Float, 0.02, pct.Str)
+		}
+	}
+}
+
+func TestResetMinLifetime(t *testing.T) {
+	t.Parallel()
+	ma := NewMetricAggregator(nil, 10*time.Second, 10*time.Second, 10*time.Second, 10*time.Second, gostatsd.TimerSubtypes{}, math.MaxUint32)
+	ma.minLifetime = time.Minute
+	now := time.Now()
+	ma.now = func() time.Time { return now }
+	receive := func(name string) {
+		mm := gostatsd.NewMetricMap()
+		ts := gostatsd.Nanotime(now.UnixNano())
+		mm.Receive(&gostatsd.Metric{Name: name, Value: 1, Rate: 1, Type: gostatsd.COUNTER, Timestamp: ts})
+		mm.Receive(&gostatsd.Metric{Name: name, Value: 1, Rate: 1, Type: gostatsd.GAUGE, Timestamp: ts})
+		mm.Receive(&gostatsd.Metric{Name: name, StringValue: "x", Rate: 1, Type: gostatsd.SET, Timestamp: ts})
+		mm.Receive(&gostatsd.Metric{Name: name, Value: 1, Rate: 1, Type: gostatsd.TIMER, Timestamp: ts})
+		ma.ReceiveMap(mm)
+	}
+	assertPresent := func(name string, present bool) {
+		_, ok := ma.metricMap.Counters[name]
+		assert.Equal(t, present, ok, "counter %s", name)
+		_, ok = ma.metricMap.Gauges[name]
+		assert.Equal(t, present, ok, "gauge %s", name)
+		_, ok = ma.metricMap.Sets[name]
+		assert.Equal(t, present, ok, "set %s", name)
+		_, ok = ma.metricMap.Timers[name]
+		assert.Equal(t, present, ok, "timer %s", name)
+	}
+
+	receive("once")
+	ma.Reset()
+
+	// Past the expiry interval, but within the grace period
+	now = now.Add(50 * time.Second)
+	ma.Reset()
+	assertPresent("once", true)
+
+	// Past the grace period
+	now = now.Add(11 * time.Second)
+	receive("later")
+	ma.Reset()
+	assertPresent("once", false)
+	assertPresent("later", true)
+
+	// Older than the grace period, so only the expiry interval applies
+	now = now.Add(time.Minute)
+	receive("later")
+	ma.Reset()
+	now = now.Add(11 * time.Second)
+	ma.Reset()
+	assertPresent("later", false)
+}
+
+func TestResetMemoryPressure(t *testing.T) {
+	t.Parallel()
+	ma := newFakeAggregator()
+	now := time.Now()
+	ma.now = func() time.Time { return now }
+	var heapInuse uint64
+	var err error
+	ma.memoryPressure, err = newMemoryPressure(1000, 0.2)
+	require.NoError(t, err)
+	ma.memoryPressure.readMemStats = func(ms *runtime.MemStats) {
+		ms.HeapInuse = heapInuse
+	}
+	for i := 0; i < 10; i++ {
+		mm := gostatsd.NewMetricMap()
+		ts := gostatsd.Nanotime(now.Add(time.Duration(i-10) * time.Second).UnixNano())
+		mm.Receive(&gostatsd.Metric{Name: fmt.Sprintf("g%d", i), Value: 1, Rate: 1, Type: gostatsd.GAUGE, Timestamp: ts})
+		ma.ReceiveMap(mm)
+	}
+	mm := gostatsd.NewMetricMap()
+	mm.Receive(&gostatsd.Metric{Name: "t", Value: 1, Rate: 1, Type: gostatsd.TIMER, Timestamp: gostatsd.Nanotime(now.UnixNano())})
+	ma.ReceiveMap(mm)
+
+	// Under the threshold nothing is evicted, and timer buffers are reused
+	heapInuse = 1000
+	ma.Reset()
+	assert.Len(t, ma.metricMap.Gauges, 10)
+	assert.NotNil(t, ma.metricMap.Timers["t"][""].Values)
+	assert.Zero(t, ma.forcedEvictions)
+
+	// The heap is only sampled once a second
+	heapInuse = 1001
+	ma.Reset()
+	assert.Len(t, ma.metricMap.Gauges, 10)
+
+	// Over the threshold, the oldest 20% of the 11 series are evicted, rounded up
+	now = now.Add(time.Second)
+	ma.Reset()
+	assert.Len(t, ma.metricMap.Gauges, 7)
+	for _, name := range []string{"g0", "g1", "g2"} {
+		assert.NotContains(t, ma.metricMap.Gauges, name)
+	}
+	assert.Contains(t, ma.metricMap.Timers, "t")
+	assert.Nil(t, ma.metricMap.Timers["t"][""].Values)
+	assert.EqualValues(t, 3, ma.forcedEvictions)
+
+	// Eviction continues every flush until the heap is back under the threshold
+	now = now.Add(time.Second)
+	ma.Reset()
+	assert.Len(t, ma.metricMap.Gauges, 5)
+	assert.EqualValues(t, 5, ma.forcedEvictions)
+}
+
+func TestNewMemoryPressureRatio(t *testing.T) {
+	t.Parallel()
+	for _, ratio := range []float64{0.01, 0.5, 1} {
+		_, err := newMemoryPressure(1000, ratio)
+		assert.NoError(t, err, ratio)
+	}
+	for _, ratio := range []float64{-0.1, 0, 1.01, math.NaN(), math.Inf(1)} {
+		_, err := newMemoryPressure(1000, ratio)
+		assert.Error(t, err, ratio)
+	}
+}
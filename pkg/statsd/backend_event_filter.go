@@ -0,0 +1,98 @@
+package statsd
+
+import (
+	"context"
+	"math/rand"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"golang.org/x/time/rate"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/stats"
+)
+
+// BackendEventFilter selects the events which are sent to a single backend, and bounds the rate they are sent at, so
+// a flood of events doesn't overwhelm the backend.  It is the counterpart of a BackendFilter for events, which are
+// dispatched as they are received rather than at flush time.
+type BackendEventFilter struct {
+	MatchEvents   gostatsd.StringMatchList // Title must match, if the list is not empty
+	ExcludeEvents gostatsd.StringMatchList // Title must not match
+	SampleRate    float64                  // Fraction of events to send; 1 sends all of them
+
+	limiter *rate.Limiter // Bounds the rate of events sent, nil if unlimited
+	dropped uint64        // Accumulated number of events not sent, atomic
+}
+
+// NewBackendEventFilterFromViper creates a new BackendEventFilter given a *viper.Viper
+func NewBackendEventFilterFromViper(v *viper.Viper) *BackendEventFilter {
+	v.SetDefault("match-events", []string{})
+	v.SetDefault("exclude-events", []string{})
+	v.SetDefault("sample-rate", 1.0)
+	v.SetDefault("rate-limit", 0.0)
+	v.SetDefault("rate-limit-burst", 1)
+	bef := &BackendEventFilter{
+		MatchEvents:   toStringMatch(v.GetStringSlice("match-events")),
+		ExcludeEvents: toStringMatch(v.GetStringSlice("exclude-events")),
+		SampleRate:    v.GetFloat64("sample-rate"),
+	}
+	if limit := v.GetFloat64("rate-limit"); limit > 0 {
+		bef.limiter = rate.NewLimiter(rate.Limit(limit), v.GetInt("rate-limit-burst"))
+	}
+	return bef
+}
+
+// NewBackendEventFiltersFromViper creates a BackendEventFilter for each backend which has a
+// `backend-event-filter.<backend name>` section, keyed by the backend name.
+func NewBackendEventFiltersFromViper(v *viper.Viper, backends []gostatsd.Backend) map[string]*BackendEventFilter {
+	filters := map[string]*BackendEventFilter{}
+	for _, backend := range backends {
+		vFilter := v.Sub("backend-event-filter." + backend.Name())
+		if vFilter == nil {
+			continue
+		}
+		filters[backend.Name()] = NewBackendEventFilterFromViper(vFilter)
+		logrus.Infof("Loaded backend event filter for %v", backend.Name())
+	}
+	return filters
+}
+
+// Keep indicates if an event should be sent, and counts it as dropped if not.  Events which are not matched, or not
+// sampled, are not counted against the rate limit.  It is safe for concurrent use.
+func (bef *BackendEventFilter) Keep(e *gostatsd.Event) bool {
+	if len(bef.MatchEvents) > 0 && !bef.MatchEvents.MatchAny(e.Title) {
+		atomic.AddUint64(&bef.dropped, 1)
+		return false
+	}
+	if bef.ExcludeEvents.MatchAny(e.Title) {
+		atomic.AddUint64(&bef.dropped, 1)
+		return false
+	}
+	if bef.SampleRate < 1 && rand.Float64() >= bef.SampleRate {
+		atomic.AddUint64(&bef.dropped, 1)
+		return false
+	}
+	if bef.limiter != nil && !bef.limiter.Allow() {
+		atomic.AddUint64(&bef.dropped, 1)
+		return false
+	}
+	return true
+}
+
+// runBackendEventFilterMetrics emits the number of events dropped by each filter every flush, until the context is closed.
+func runBackendEventFilterMetrics(ctx context.Context, statser stats.Statser, filters map[string]*BackendEventFilter) {
+	flushed, unregister := statser.RegisterFlush()
+	defer unregister()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-flushed:
+			for name, bef := range filters {
+				statser.Gauge("backend.events.dropped", float64(atomic.LoadUint64(&bef.dropped)), gostatsd.Tags{"backend:" + name})
+			}
+		}
+	}
+}
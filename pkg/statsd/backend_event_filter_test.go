@@ -0,0 +1,93 @@
+package statsd
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/atlassian/gostatsd"
+)
+
+func TestBackendEventFiltersFromViper(t *testing.T) {
+	t.Parallel()
+	v := viper.New()
+	v.Set("backend-event-filter.pager.match-events", []string{"deploy*"})
+	v.Set("backend-event-filter.pager.exclude-events", []string{"deploy canary"})
+	v.Set("backend-event-filter.pager.sample-rate", 0.5)
+	v.Set("backend-event-filter.pager.rate-limit", 2)
+	v.Set("backend-event-filter.pager.rate-limit-burst", 5)
+
+	filters := NewBackendEventFiltersFromViper(v, []gostatsd.Backend{
+		&namedCapturingBackend{name: "pager"},
+		&namedCapturingBackend{name: "archive"},
+	})
+	require.Len(t, filters, 1)
+	bef := filters["pager"]
+	assert.Equal(t, gostatsd.StringMatchList{gostatsd.NewStringMatch("deploy*")}, bef.MatchEvents)
+	assert.Equal(t, gostatsd.StringMatchList{gostatsd.NewStringMatch("deploy canary")}, bef.ExcludeEvents)
+	assert.Equal(t, 0.5, bef.SampleRate)
+	require.NotNil(t, bef.limiter)
+	assert.EqualValues(t, 2, bef.limiter.Limit())
+	assert.Equal(t, 5, bef.limiter.Burst())
+
+	v = viper.New()
+	v.Set("backend-event-filter.pager.sample-rate", 1)
+	bef = NewBackendEventFiltersFromViper(v, []gostatsd.Backend{&namedCapturingBackend{name: "pager"}})["pager"]
+	assert.Nil(t, bef.limiter)
+	assert.Empty(t, bef.MatchEvents)
+}
+
+func TestBackendEventFilterKeep(t *testing.T) {
+	t.Parallel()
+	bef := &BackendEventFilter{
+		MatchEvents:   toStringMatch([]string{"deploy*"}),
+		ExcludeEvents: toStringMatch([]string{"deploy canary"}),
+		SampleRate:    1,
+	}
+	assert.True(t, bef.Keep(&gostatsd.Event{Title: "deploy web"}))
+	assert.False(t, bef.Keep(&gostatsd.Event{Title: "deploy canary"}))
+	assert.False(t, bef.Keep(&gostatsd.Event{Title: "alert"}))
+	assert.EqualValues(t, 2, atomic.LoadUint64(&bef.dropped))
+
+	bef = &BackendEventFilter{SampleRate: 0.25}
+	kept := 0
+	for i := 0; i < 10000; i++ {
+		if bef.Keep(&gostatsd.Event{Title: fmt.Sprintf("event %d", i)}) {
+			kept++
+		}
+	}
+	assert.InDelta(t, 2500, kept, 300)
+	assert.EqualValues(t, 10000-kept, atomic.LoadUint64(&bef.dropped))
+}
+
+func TestBackendHandlerEventFloodIsRateLimited(t *testing.T) {
+	t.Parallel()
+	limited := &namedCapturingBackend{name: "limited"}
+	unlimited := &namedCapturingBackend{name: "unlimited"}
+	v := viper.New()
+	v.Set("backend-event-filter.limited.rate-limit", 10)
+	v.Set("backend-event-filter.limited.rate-limit-burst", 5)
+	bh := NewBackendHandler([]gostatsd.Backend{limited, unlimited}, 100, 1, 10, newTestFactory())
+	bh.eventFilters = NewBackendEventFiltersFromViper(v, bh.backends)
+
+	const flood = 1000
+	start := time.Now()
+	for i := 0; i < flood; i++ {
+		bh.DispatchEvent(context.Background(), &gostatsd.Event{Title: fmt.Sprintf("incident %d", i)})
+	}
+	bh.WaitForEvents()
+	elapsed := time.Since(start)
+
+	// The burst, plus 10 per second for as long as the flood took
+	bound := 5 + int(10*elapsed.Seconds()) + 1
+	assert.LessOrEqual(t, len(limited.events), bound)
+	assert.GreaterOrEqual(t, len(limited.events), 5)
+	assert.Len(t, unlimited.events, flood)
+	assert.EqualValues(t, flood-len(limited.events), atomic.LoadUint64(&bh.eventFilters["limited"].dropped))
+}
@@ -0,0 +1,140 @@
+package statsd
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"github.com/atlassian/gostatsd"
+)
+
+// BackendFilter selects the subset of a flushed MetricMap which is sent to a single backend.  Unlike a Filter, it is
+// applied after aggregation, and only changes what a particular backend receives.
+type BackendFilter struct {
+	MatchMetrics   gostatsd.StringMatchList // Name must match, if the list is not empty
+	ExcludeMetrics gostatsd.StringMatchList // Name must not match
+	SampleRate     float64                  // Fraction of series to send; 1 sends all of them
+	SampleGroup    string                   // What series are sampled together by, one of the SampleGroup* values
+	SampleTags     []string                 // The tag keys series are sampled together by, for SampleGroupTags
+}
+
+const (
+	// SampleGroupSeries samples each series independently.
+	SampleGroupSeries = "series"
+	// SampleGroupName samples every series of a metric name together.
+	SampleGroupName = "name"
+	// SampleGroupTags samples every series with the same values of the SampleTags together, across metric names.
+	SampleGroupTags = "tags"
+)
+
+// NewBackendFilterFromViper creates a new BackendFilter given a *viper.Viper
+func NewBackendFilterFromViper(v *viper.Viper) (*BackendFilter, error) {
+	v.SetDefault("match-metrics", []string{})
+	v.SetDefault("exclude-metrics", []string{})
+	v.SetDefault("sample-rate", 1.0)
+	v.SetDefault("sample-group", SampleGroupSeries)
+	v.SetDefault("sample-tags", []string{})
+	bf := &BackendFilter{
+		MatchMetrics:   toStringMatch(v.GetStringSlice("match-metrics")),
+		ExcludeMetrics: toStringMatch(v.GetStringSlice("exclude-metrics")),
+		SampleRate:     v.GetFloat64("sample-rate"),
+		SampleGroup:    v.GetString("sample-group"),
+		SampleTags:     v.GetStringSlice("sample-tags"),
+	}
+	switch bf.SampleGroup {
+	case SampleGroupSeries, SampleGroupName:
+	case SampleGroupTags:
+		if len(bf.SampleTags) == 0 {
+			return nil, fmt.Errorf("sample-group %q requires sample-tags", SampleGroupTags)
+		}
+	default:
+		return nil, fmt.Errorf("invalid sample-group %q, must be %s, %s, or %s", bf.SampleGroup, SampleGroupSeries, SampleGroupName, SampleGroupTags)
+	}
+	return bf, nil
+}
+
+// NewBackendFiltersFromViper creates a BackendFilter for each backend which has a `backend-filter.<backend name>`
+// section, keyed by the backend name.
+func NewBackendFiltersFromViper(v *viper.Viper, backends []gostatsd.Backend) (map[string]*BackendFilter, error) {
+	filters := map[string]*BackendFilter{}
+	for _, backend := range backends {
+		vFilter := v.Sub("backend-filter." + backend.Name())
+		if vFilter == nil {
+			continue
+		}
+		filter, err := NewBackendFilterFromViper(vFilter)
+		if err != nil {
+			return nil, fmt.Errorf("backend-filter.%s: %v", backend.Name(), err)
+		}
+		filters[backend.Name()] = filter
+		logrus.Infof("Loaded backend filter for %v", backend.Name())
+	}
+	return filters, nil
+}
+
+// Apply returns a new MetricMap with only the series which should be sent to the backend.  The values themselves are
+// not copied, so the result must be treated as read only, the same as the input.
+func (bf *BackendFilter) Apply(mm *gostatsd.MetricMap) *gostatsd.MetricMap {
+	mmNew := gostatsd.NewMetricMap()
+	mm.Counters.Each(func(metricName, tagsKey string, c gostatsd.Counter) {
+		if bf.keep(metricName, tagsKey, c.Tags) {
+			mmNew.MergeCounter(metricName, tagsKey, c)
+		}
+	})
+	mm.Gauges.Each(func(metricName, tagsKey string, g gostatsd.Gauge) {
+		if bf.keep(metricName, tagsKey, g.Tags) {
+			mmNew.MergeGauge(metricName, tagsKey, g)
+		}
+	})
+	mm.Timers.Each(func(metricName, tagsKey string, t gostatsd.Timer) {
+		if bf.keep(metricName, tagsKey, t.Tags) {
+			mmNew.MergeTimer(metricName, tagsKey, t)
+		}
+	})
+	mm.Sets.Each(func(metricName, tagsKey string, s gostatsd.Set) {
+		if bf.keep(metricName, tagsKey, s.Tags) {
+			mmNew.MergeSet(metricName, tagsKey, s)
+		}
+	})
+	return mmNew
+}
+
+// keep indicates if a series should be sent.  Sampling is based on a hash of the series, or of the group it is
+// sampled with, so a given series is consistently sent or not sent on every flush, rather than flapping, and every
+// series of a group is sent or not sent together.
+func (bf *BackendFilter) keep(metricName, tagsKey string, tags gostatsd.Tags) bool {
+	if len(bf.MatchMetrics) > 0 && !bf.MatchMetrics.MatchAny(metricName) {
+		return false
+	}
+	if bf.ExcludeMetrics.MatchAny(metricName) {
+		return false
+	}
+	if bf.SampleRate >= 1 {
+		return true
+	}
+	h := fnv.New32a()
+	switch bf.SampleGroup {
+	case SampleGroupName:
+		_, _ = h.Write([]byte(metricName))
+	case SampleGroupTags:
+		// Series without a sample tag are sampled together with every series which doesn't have it
+		for _, key := range bf.SampleTags {
+			for _, tag := range tags {
+				if len(tag) > len(key) && tag[len(key)] == ':' && strings.HasPrefix(tag, key) {
+					_, _ = h.Write([]byte(tag))
+					break
+				}
+			}
+			_, _ = h.Write([]byte{0})
+		}
+	default:
+		_, _ = h.Write([]byte(metricName))
+		_, _ = h.Write([]byte{0})
+		_, _ = h.Write([]byte(tagsKey))
+	}
+	return float64(h.Sum32())/math.MaxUint32 < bf.SampleRate
+}
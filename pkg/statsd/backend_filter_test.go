@@ -0,0 +1,197 @@
+package statsd
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/atlassian/gostatsd"
+)
+
+type namedCapturingBackend struct {
+	name string
+
+	mu     sync.Mutex
+	maps   []*gostatsd.MetricMap
+	events []*gostatsd.Event
+}
+
+func (ncb *namedCapturingBackend) Name() string {
+	return ncb.name
+}
+
+func (ncb *namedCapturingBackend) SendMetricsAsync(ctx context.Context, mm *gostatsd.MetricMap, cb gostatsd.SendCallback) {
+	ncb.mu.Lock()
+	ncb.maps = append(ncb.maps, mm)
+	ncb.mu.Unlock()
+	cb(nil)
+}
+
+func (ncb *namedCapturingBackend) SendEvent(ctx context.Context, e *gostatsd.Event) error {
+	ncb.mu.Lock()
+	ncb.events = append(ncb.events, e)
+	ncb.mu.Unlock()
+	return nil
+}
+
+func newBackendFilterTestMap() *gostatsd.MetricMap {
+	mm := gostatsd.NewMetricMap()
+	mm.Counters["paid.requests"] = map[string]gostatsd.Counter{"": gostatsd.NewCounter(1, 5, "", nil)}
+	mm.Counters["other.requests"] = map[string]gostatsd.Counter{"": gostatsd.NewCounter(1, 5, "", nil)}
+	mm.Gauges["paid.queue"] = map[string]gostatsd.Gauge{"": gostatsd.NewGauge(1, 3, "", nil)}
+	mm.Timers["paid.latency"] = map[string]gostatsd.Timer{"": gostatsd.NewTimer(1, []float64{1}, "", nil)}
+	mm.Sets["paid.users"] = map[string]gostatsd.Set{"": gostatsd.NewSet(1, map[string]struct{}{"a": {}}, "", nil)}
+	return mm
+}
+
+func TestBackendFilterFromViper(t *testing.T) {
+	t.Parallel()
+	v := viper.New()
+	v.Set("backend-filter.expensive.match-metrics", []string{"paid.*"})
+	v.Set("backend-filter.expensive.exclude-metrics", []string{"paid.users"})
+	v.Set("backend-filter.expensive.sample-rate", 0.5)
+
+	filters, err := NewBackendFiltersFromViper(v, []gostatsd.Backend{
+		&namedCapturingBackend{name: "expensive"},
+		&namedCapturingBackend{name: "cheap"},
+	})
+	require.NoError(t, err)
+	require.Len(t, filters, 1)
+	f := filters["expensive"]
+	require.NotNil(t, f)
+	assert.Equal(t, gostatsd.StringMatchList{gostatsd.NewStringMatch("paid.*")}, f.MatchMetrics)
+	assert.Equal(t, gostatsd.StringMatchList{gostatsd.NewStringMatch("paid.users")}, f.ExcludeMetrics)
+	assert.Equal(t, 0.5, f.SampleRate)
+	assert.Equal(t, SampleGroupSeries, f.SampleGroup)
+}
+
+func TestBackendFilterFromViperSampleGroup(t *testing.T) {
+	t.Parallel()
+	backends := []gostatsd.Backend{&namedCapturingBackend{name: "expensive"}}
+
+	v := viper.New()
+	v.Set("backend-filter.expensive.sample-group", "tags")
+	_, err := NewBackendFiltersFromViper(v, backends)
+	require.Error(t, err)
+
+	v.Set("backend-filter.expensive.sample-tags", []string{"request"})
+	filters, err := NewBackendFiltersFromViper(v, backends)
+	require.NoError(t, err)
+	assert.Equal(t, SampleGroupTags, filters["expensive"].SampleGroup)
+	assert.Equal(t, []string{"request"}, filters["expensive"].SampleTags)
+
+	v.Set("backend-filter.expensive.sample-group", "metric")
+	_, err = NewBackendFiltersFromViper(v, backends)
+	require.Error(t, err)
+}
+
+func TestBackendFilterApplyMatch(t *testing.T) {
+	t.Parallel()
+	bf := &BackendFilter{
+		MatchMetrics:   toStringMatch([]string{"paid.*"}),
+		ExcludeMetrics: toStringMatch([]string{"paid.users"}),
+		SampleRate:     1,
+	}
+	mm := bf.Apply(newBackendFilterTestMap())
+
+	assert.Contains(t, mm.Counters, "paid.requests")
+	assert.NotContains(t, mm.Counters, "other.requests")
+	assert.Contains(t, mm.Gauges, "paid.queue")
+	assert.Contains(t, mm.Timers, "paid.latency")
+	assert.Empty(t, mm.Sets)
+}
+
+func TestBackendFilterSampleRate(t *testing.T) {
+	t.Parallel()
+	mm := gostatsd.NewMetricMap()
+	for i := 0; i < 1000; i++ {
+		mm.Counters[fmt.Sprintf("c.%d", i)] = map[string]gostatsd.Counter{"": gostatsd.NewCounter(1, 1, "", nil)}
+	}
+
+	none := (&BackendFilter{SampleRate: 0}).Apply(mm)
+	assert.Empty(t, none.Counters)
+
+	bf := &BackendFilter{SampleRate: 0.25}
+	sampled := bf.Apply(mm)
+	assert.InDelta(t, 250, len(sampled.Counters), 75)
+
+	// Sampling must be stable between flushes
+	assert.Equal(t, sampled, bf.Apply(mm))
+}
+
+func TestBackendFilterSampleGroupName(t *testing.T) {
+	t.Parallel()
+	mm := gostatsd.NewMetricMap()
+	for i := 0; i < 200; i++ {
+		name := fmt.Sprintf("t.%d", i)
+		for j := 0; j < 10; j++ {
+			tags := gostatsd.Tags{fmt.Sprintf("host:%d", j)}
+			mm.MergeTimer(name, tags.String(), gostatsd.NewTimer(1, []float64{1}, "", tags))
+		}
+	}
+
+	sampled := (&BackendFilter{SampleRate: 0.25, SampleGroup: SampleGroupName}).Apply(mm)
+	assert.InDelta(t, 50, len(sampled.Timers), 25)
+	// Every series of a sampled metric is sent
+	for name, series := range sampled.Timers {
+		assert.Len(t, series, 10, name)
+	}
+}
+
+func TestBackendFilterSampleGroupTags(t *testing.T) {
+	t.Parallel()
+	mm := gostatsd.NewMetricMap()
+	for i := 0; i < 200; i++ {
+		tags := gostatsd.Tags{fmt.Sprintf("endpoint:%d", i), fmt.Sprintf("host:%d", i%7)}
+		tagsKey := tags.String()
+		mm.MergeCounter("requests", tagsKey, gostatsd.NewCounter(1, 1, "", tags))
+		mm.MergeTimer("latency", tagsKey, gostatsd.NewTimer(1, []float64{1}, "", tags))
+		mm.MergeGauge("inflight", tagsKey, gostatsd.NewGauge(1, 1, "", tags))
+	}
+	// A series without the sample tag
+	mm.MergeCounter("requests", "host:1", gostatsd.NewCounter(1, 1, "", gostatsd.Tags{"host:1"}))
+
+	bf := &BackendFilter{SampleRate: 0.5, SampleGroup: SampleGroupTags, SampleTags: []string{"endpoint"}}
+	sampled := bf.Apply(mm)
+	assert.InDelta(t, 100, len(sampled.Timers["latency"]), 30)
+	// The counters, timers and gauges of an endpoint are sampled together, so their ratios are kept
+	for tagsKey := range mm.Timers["latency"] {
+		_, timerKept := sampled.Timers["latency"][tagsKey]
+		_, counterKept := sampled.Counters["requests"][tagsKey]
+		_, gaugeKept := sampled.Gauges["inflight"][tagsKey]
+		assert.Equal(t, timerKept, counterKept, tagsKey)
+		assert.Equal(t, timerKept, gaugeKept, tagsKey)
+	}
+	// Sampling must be stable between flushes
+	assert.Equal(t, sampled, bf.Apply(mm))
+}
+
+func TestFlusherAppliesBackendFilters(t *testing.T) {
+	t.Parallel()
+	cheap := &namedCapturingBackend{name: "cheap"}
+	expensive := &namedCapturingBackend{name: "expensive"}
+	filters := map[string]*BackendFilter{
+		"expensive": {
+			MatchMetrics: toStringMatch([]string{"paid.*"}),
+			SampleRate:   1,
+		},
+	}
+	fl := NewMetricFlusher(0, 0, false, nil, []gostatsd.Backend{cheap, expensive}, filters)
+
+	input := newBackendFilterTestMap()
+	var wg sync.WaitGroup
+	fl.sendMetricsAsync(context.Background(), &wg, input, nil)
+	wg.Wait()
+
+	require.Len(t, cheap.maps, 1)
+	require.Len(t, expensive.maps, 1)
+	assert.Equal(t, input, cheap.maps[0])
+	assert.Len(t, expensive.maps[0].Counters, 1)
+	assert.Contains(t, expensive.maps[0].Counters, "paid.requests")
+	assert.Len(t, expensive.maps[0].Sets, 1)
+}
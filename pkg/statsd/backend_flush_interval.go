@@ -0,0 +1,130 @@
+package statsd
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/spf13/viper"
+
+	"github.com/atlassian/gostatsd"
+)
+
+// backendGroup is the backends which are flushed at the same interval, by their own aggregators and flusher.
+type backendGroup struct {
+	flushInterval time.Duration
+	backends      []gostatsd.Backend
+}
+
+// newBackendGroupsFromViper groups the backends by the flush interval set for them in the `backend-flush-interval`
+// section, keyed by backend name.  Backends without one are flushed every flushInterval, and are the first group if
+// there are any, or if there are no backends.  The other groups are ordered by flush interval.
+func newBackendGroupsFromViper(v *viper.Viper, backends []gostatsd.Backend, flushInterval time.Duration) ([]backendGroup, error) {
+	if len(backends) == 0 {
+		return []backendGroup{{flushInterval: flushInterval}}, nil
+	}
+	byInterval := map[time.Duration][]gostatsd.Backend{}
+	for _, backend := range backends {
+		interval := flushInterval
+		key := "backend-flush-interval." + backend.Name()
+		if v.IsSet(key) {
+			interval = v.GetDuration(key)
+			if interval <= 0 {
+				return nil, fmt.Errorf("%s must be positive", key)
+			}
+		}
+		byInterval[interval] = append(byInterval[interval], backend)
+	}
+
+	groups := make([]backendGroup, 0, len(byInterval))
+	for interval, grouped := range byInterval {
+		groups = append(groups, backendGroup{flushInterval: interval, backends: grouped})
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		if (groups[i].flushInterval == flushInterval) != (groups[j].flushInterval == flushInterval) {
+			return groups[i].flushInterval == flushInterval
+		}
+		return groups[i].flushInterval < groups[j].flushInterval
+	})
+	return groups, nil
+}
+
+// groupStateFile returns the file the state of the group of backends flushed every groupInterval is saved to: stateFile
+// for the backends flushed every flushInterval, and stateFile suffixed with the interval for the others, such as
+// `state.1m0s`, so each group restores its own state.  It's empty if stateFile is.
+func groupStateFile(stateFile string, groupInterval, flushInterval time.Duration) string {
+	if stateFile == "" || groupInterval == flushInterval {
+		return stateFile
+	}
+	return stateFile + "." + groupInterval.String()
+}
+
+// multiSinkHandler passes every MetricMap and event to each of a number of sinks, so each group of backends is
+// aggregated from the same metrics.  Each sink aggregates its own copy of the values, as an aggregator merges the values
+// it receives in to its own.
+type multiSinkHandler struct {
+	sinks []gostatsd.PipelineHandler
+}
+
+// EstimatedTags returns a guess for how many tags to pre-allocate
+func (msh *multiSinkHandler) EstimatedTags() int {
+	return msh.sinks[0].EstimatedTags()
+}
+
+// DispatchMetricMap passes a copy of the MetricMap to every sink, except the last, which is passed the original.
+func (msh *multiSinkHandler) DispatchMetricMap(ctx context.Context, mm *gostatsd.MetricMap) {
+	last := len(msh.sinks) - 1
+	for _, sink := range msh.sinks[:last] {
+		sink.DispatchMetricMap(ctx, copyMetricMapValues(mm))
+	}
+	msh.sinks[last].DispatchMetricMap(ctx, mm)
+}
+
+// DispatchEvent passes the event to every sink, which each send it to their own backends.
+func (msh *multiSinkHandler) DispatchEvent(ctx context.Context, e *gostatsd.Event) {
+	for _, sink := range msh.sinks {
+		sink.DispatchEvent(ctx, e)
+	}
+}
+
+// WaitForEvents waits for all event-dispatching goroutines of every sink to finish.
+func (msh *multiSinkHandler) WaitForEvents() {
+	for _, sink := range msh.sinks {
+		sink.WaitForEvents()
+	}
+}
+
+// QueueLength returns the longest queue of any sink which reports one.
+func (msh *multiSinkHandler) QueueLength() int {
+	longest := 0
+	for _, sink := range msh.sinks {
+		if qlr, ok := sink.(queueLengthReporter); ok {
+			if length := qlr.QueueLength(); length > longest {
+				longest = length
+			}
+		}
+	}
+	return longest
+}
+
+// copyMetricMapValues returns a copy of mm which shares no timer values or set values with it, as they are modified
+// when they are merged in to.
+func copyMetricMapValues(mm *gostatsd.MetricMap) *gostatsd.MetricMap {
+	mmCopy := gostatsd.NewMetricMap()
+	mm.Counters.Each(mmCopy.MergeCounter)
+	mm.Gauges.Each(mmCopy.MergeGauge)
+	mm.Timers.Each(func(metricName, tagsKey string, t gostatsd.Timer) {
+		t.Values = append([]float64(nil), t.Values...)
+		mmCopy.MergeTimer(metricName, tagsKey, t)
+	})
+	mm.Sets.Each(func(metricName, tagsKey string, s gostatsd.Set) {
+		values := make(map[string]struct{}, len(s.Values))
+		for value := range s.Values {
+			values[value] = struct{}{}
+		}
+		s.Values = values
+		mmCopy.MergeSet(metricName, tagsKey, s)
+	})
+	return mmCopy
+}
@@ -0,0 +1,165 @@
+package statsd
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ash2k/stager/wait"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/atlassian/gostatsd"
+)
+
+func TestNewBackendGroupsFromViper(t *testing.T) {
+	t.Parallel()
+	cheap := &namedCapturingBackend{name: "cheap"}
+	expensive := &namedCapturingBackend{name: "expensive"}
+	archive := &namedCapturingBackend{name: "archive"}
+	other := &namedCapturingBackend{name: "other"}
+
+	v := viper.New()
+	v.Set("backend-flush-interval.expensive", "1m")
+	v.Set("backend-flush-interval.archive", "5m")
+	v.Set("backend-flush-interval.other", "10s") // The same as the flush interval
+	groups, err := newBackendGroupsFromViper(v, []gostatsd.Backend{archive, cheap, expensive, other}, 10*time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, []backendGroup{
+		{flushInterval: 10 * time.Second, backends: []gostatsd.Backend{cheap, other}},
+		{flushInterval: time.Minute, backends: []gostatsd.Backend{expensive}},
+		{flushInterval: 5 * time.Minute, backends: []gostatsd.Backend{archive}},
+	}, groups)
+
+	groups, err = newBackendGroupsFromViper(v, []gostatsd.Backend{archive, expensive}, 10*time.Second)
+	require.NoError(t, err)
+	require.Len(t, groups, 2)
+	assert.Equal(t, time.Minute, groups[0].flushInterval)
+
+	groups, err = newBackendGroupsFromViper(v, nil, 10*time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, []backendGroup{{flushInterval: 10 * time.Second}}, groups)
+
+	v.Set("backend-flush-interval.cheap", "0s")
+	_, err = newBackendGroupsFromViper(v, []gostatsd.Backend{cheap}, 10*time.Second)
+	require.Error(t, err)
+}
+
+func TestGroupStateFile(t *testing.T) {
+	t.Parallel()
+	assert.Equal(t, "/var/lib/gostatsd/state", groupStateFile("/var/lib/gostatsd/state", 10*time.Second, 10*time.Second))
+	assert.Equal(t, "/var/lib/gostatsd/state.1m0s", groupStateFile("/var/lib/gostatsd/state", time.Minute, 10*time.Second))
+	assert.Equal(t, "", groupStateFile("", time.Minute, 10*time.Second))
+}
+
+func TestMultiSinkHandlerCopiesValues(t *testing.T) {
+	t.Parallel()
+	first := &capturingHandler{}
+	second := &capturingHandler{}
+	msh := &multiSinkHandler{sinks: []gostatsd.PipelineHandler{first, second}}
+
+	mm := gostatsd.NewMetricMap()
+	mm.Receive(&gostatsd.Metric{Name: "c", Type: gostatsd.COUNTER, Value: 1, Rate: 1})
+	mm.Receive(&gostatsd.Metric{Name: "t", Type: gostatsd.TIMER, Value: 1, Rate: 1})
+	mm.Receive(&gostatsd.Metric{Name: "s", Type: gostatsd.SET, StringValue: "a", Rate: 1})
+	ctx := context.Background()
+	msh.DispatchMetricMap(ctx, mm)
+	msh.DispatchEvent(ctx, &gostatsd.Event{Title: "deploy"})
+
+	require.Len(t, first.mm, 1)
+	require.Len(t, second.mm, 1)
+	assert.Equal(t, mm, first.mm[0])
+	assert.Same(t, mm, second.mm[0])
+	assert.Len(t, first.e, 1)
+	assert.Len(t, second.e, 1)
+
+	// Values merged in to by one sink's aggregator must not change the other's
+	first.mm[0].Timers["t"][""].Values[0] = 2
+	first.mm[0].Sets["s"][""].Values["b"] = struct{}{}
+	assert.Equal(t, []float64{1}, mm.Timers["t"][""].Values)
+	assert.Len(t, mm.Sets["s"][""].Values, 1)
+}
+
+// counterCapturingBackend captures the non-zero values of a counter as they are sent, as the aggregator resets them
+// after the flush.
+type counterCapturingBackend struct {
+	namedCapturingBackend
+	counterName string
+
+	flushes  int
+	counters []gostatsd.Counter
+}
+
+func (ccb *counterCapturingBackend) SendMetricsAsync(ctx context.Context, mm *gostatsd.MetricMap, cb gostatsd.SendCallback) {
+	ccb.mu.Lock()
+	ccb.flushes++
+	for _, c := range mm.Counters[ccb.counterName] {
+		if c.Value != 0 {
+			ccb.counters = append(ccb.counters, c)
+		}
+	}
+	ccb.mu.Unlock()
+	cb(nil)
+}
+
+func (ccb *counterCapturingBackend) captured() ([]gostatsd.Counter, int) {
+	ccb.mu.Lock()
+	defer ccb.mu.Unlock()
+	return append([]gostatsd.Counter(nil), ccb.counters...), ccb.flushes
+}
+
+func TestStatsdBackendFlushIntervals(t *testing.T) {
+	t.Parallel()
+	cheap := &counterCapturingBackend{namedCapturingBackend: namedCapturingBackend{name: "cheap"}, counterName: "user.counter"}
+	expensive := &counterCapturingBackend{namedCapturingBackend: namedCapturingBackend{name: "expensive"}, counterName: "user.counter"}
+	v := viper.New()
+	v.Set("backend-flush-interval.expensive", "200ms")
+	s := Server{
+		Backends:            []gostatsd.Backend{cheap, expensive},
+		FlushInterval:       50 * time.Millisecond,
+		MaxReaders:          1,
+		MaxParsers:          1,
+		MaxWorkers:          1,
+		MaxQueueSize:        gostatsd.DefaultMaxQueueSize,
+		MaxConcurrentEvents: 2,
+		EstimatedTags:       1,
+		ReceiveBatchSize:    gostatsd.DefaultReceiveBatchSize,
+		ServerMode:          "standalone",
+		StatserType:         gostatsd.StatserNull,
+		Viper:               v,
+	}
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg wait.Group
+	wg.Start(func() {
+		_ = s.RunWithCustomSocket(ctx, func() (net.PacketConn, error) { return conn, nil })
+	})
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	require.NoError(t, err)
+	defer client.Close()
+	_, err = client.Write([]byte("user.counter:10|c"))
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		cheapCounters, _ := cheap.captured()
+		expensiveCounters, _ := expensive.captured()
+		return len(cheapCounters) > 0 && len(expensiveCounters) > 0
+	}, 5*time.Second, 10*time.Millisecond)
+	cancel()
+	wg.Wait()
+
+	// Both backends receive the same aggregate once, with the rate over their own flush interval
+	cheapCounters, cheapFlushes := cheap.captured()
+	expensiveCounters, expensiveFlushes := expensive.captured()
+	require.Len(t, cheapCounters, 1)
+	require.Len(t, expensiveCounters, 1)
+	assert.EqualValues(t, 10, cheapCounters[0].Value)
+	assert.EqualValues(t, 10, expensiveCounters[0].Value)
+	assert.Greater(t, cheapCounters[0].PerSecond, 2*expensiveCounters[0].PerSecond)
+	assert.Greater(t, cheapFlushes, expensiveFlushes)
+}
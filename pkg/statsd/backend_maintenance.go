@@ -0,0 +1,174 @@
+package statsd
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/stats"
+)
+
+// backendMaintenance tracks which backends are in maintenance mode.  Flushes are not sent to a backend in
+// maintenance mode, but buffered by each flusher, up to maxBufferedFlushes, and sent once it leaves maintenance mode.
+// It is shared by the flushers of a Server, and is safe for concurrent use.
+type backendMaintenance struct {
+	maxBufferedFlushes int
+
+	lock     sync.Mutex
+	backends map[string]*maintenanceState // Keyed by backend name, every backend which can be put in maintenance
+}
+
+type maintenanceState struct {
+	enabled bool
+	skipped uint64 // Number of flushes which were not sent when they happened
+	dropped uint64 // Number of flushes which were never sent
+}
+
+// newBackendMaintenance creates a backendMaintenance for the backends, with none of them in maintenance mode.
+func newBackendMaintenance(backends []gostatsd.Backend, maxBufferedFlushes int) *backendMaintenance {
+	bm := &backendMaintenance{
+		maxBufferedFlushes: maxBufferedFlushes,
+		backends:           make(map[string]*maintenanceState, len(backends)),
+	}
+	for _, backend := range backends {
+		bm.backends[backend.Name()] = &maintenanceState{}
+	}
+	return bm
+}
+
+// setBackends puts the named backends in maintenance mode, and takes every other backend out of it.  Nothing is
+// changed if any of the names is not a backend.
+func (bm *backendMaintenance) setBackends(names []string) error {
+	enabled := make(map[string]bool, len(names))
+	for _, name := range names {
+		if _, ok := bm.backends[name]; !ok {
+			return fmt.Errorf("unknown backend %q in maintenance backends", name)
+		}
+		enabled[name] = true
+	}
+	bm.lock.Lock()
+	defer bm.lock.Unlock()
+	for name, state := range bm.backends {
+		if state.enabled != enabled[name] {
+			logrus.WithField("backend", name).Infof("Backend maintenance mode set to %t", enabled[name])
+		}
+		state.enabled = enabled[name]
+	}
+	return nil
+}
+
+// inMaintenance returns true if the named backend is in maintenance mode.
+func (bm *backendMaintenance) inMaintenance(name string) bool {
+	bm.lock.Lock()
+	defer bm.lock.Unlock()
+	state, ok := bm.backends[name]
+	return ok && state.enabled
+}
+
+// count records that a flush was skipped and dropped flushes were discarded for the named backend.
+func (bm *backendMaintenance) count(name string, skipped, dropped uint64) {
+	bm.lock.Lock()
+	defer bm.lock.Unlock()
+	if state, ok := bm.backends[name]; ok {
+		state.skipped += skipped
+		state.dropped += dropped
+	}
+}
+
+// RunMetrics emits the number of skipped and dropped flushes of each backend, every time the Statser flushes.
+func (bm *backendMaintenance) RunMetrics(ctx context.Context, statser stats.Statser) {
+	flushed, unregister := statser.RegisterFlush()
+	defer unregister()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-flushed:
+			bm.lock.Lock()
+			for name, state := range bm.backends {
+				tags := gostatsd.Tags{"backend:" + name}
+				statser.Gauge("backend.maintenance.skipped", float64(state.skipped), tags)
+				statser.Gauge("backend.maintenance.dropped", float64(state.dropped), tags)
+			}
+			bm.lock.Unlock()
+		}
+	}
+}
+
+// RunMetricsContext pulls a Statser from the Context and invokes RunMetrics.
+func (bm *backendMaintenance) RunMetricsContext(ctx context.Context) {
+	bm.RunMetrics(ctx, stats.FromContext(ctx))
+}
+
+// maintenanceBuffer holds the flushes of a single flusher which were not sent to backends in maintenance mode.
+type maintenanceBuffer struct {
+	lock    sync.Mutex
+	flushes map[string][]*gostatsd.MetricMap // Keyed by backend name, oldest first
+}
+
+// startFlush is called at the start of every flush.  It returns the MetricMap to buffer the flush in for each backend
+// in maintenance mode, which is nil if the flush is dropped, and the flushes which were buffered for backends which
+// have left maintenance mode, so they can be sent.
+func (mb *maintenanceBuffer) startFlush(bm *backendMaintenance, backends []gostatsd.Backend) (map[string]*gostatsd.MetricMap, map[string][]*gostatsd.MetricMap) {
+	mb.lock.Lock()
+	defer mb.lock.Unlock()
+	var current map[string]*gostatsd.MetricMap
+	var resumed map[string][]*gostatsd.MetricMap
+	for _, backend := range backends {
+		name := backend.Name()
+		if !bm.inMaintenance(name) {
+			if buffered, ok := mb.flushes[name]; ok {
+				if resumed == nil {
+					resumed = map[string][]*gostatsd.MetricMap{}
+				}
+				resumed[name] = buffered
+				delete(mb.flushes, name)
+			}
+			continue
+		}
+		if current == nil {
+			current = map[string]*gostatsd.MetricMap{}
+		}
+		if bm.maxBufferedFlushes <= 0 {
+			current[name] = nil
+			bm.count(name, 1, 1)
+			continue
+		}
+		if mb.flushes == nil {
+			mb.flushes = map[string][]*gostatsd.MetricMap{}
+		}
+		buffered := append(mb.flushes[name], gostatsd.NewMetricMap())
+		var dropped uint64
+		if len(buffered) > bm.maxBufferedFlushes {
+			// Drop the oldest flush
+			dropped = 1
+			buffered[0] = nil
+			buffered = buffered[1:]
+		}
+		mb.flushes[name] = buffered
+		current[name] = buffered[len(buffered)-1]
+		bm.count(name, 1, dropped)
+	}
+	return current, resumed
+}
+
+// add copies mm in to the flush being buffered, which may be nil if the flush is dropped.
+func (mb *maintenanceBuffer) add(into, mm *gostatsd.MetricMap) {
+	if into == nil {
+		return
+	}
+	mb.lock.Lock()
+	defer mb.lock.Unlock()
+	mm.Counters.Each(into.MergeCounter)
+	mm.Gauges.Each(into.MergeGauge)
+	mm.Timers.Each(func(metricName, tagsKey string, t gostatsd.Timer) {
+		// The aggregator reuses the values for the next flush
+		t.Values = append([]float64(nil), t.Values...)
+		into.MergeTimer(metricName, tagsKey, t)
+	})
+	mm.Sets.Each(into.MergeSet)
+}
@@ -0,0 +1,90 @@
+package statsd
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/stats"
+)
+
+// flushMaintenanceTest receives a counter and a timer with value, and flushes them.
+func flushMaintenanceTest(f *MetricFlusher, aggr Aggregator, value float64) {
+	mm := gostatsd.NewMetricMap()
+	mm.Receive(&gostatsd.Metric{Name: "c", Type: gostatsd.COUNTER, Value: value, Rate: 1})
+	mm.Receive(&gostatsd.Metric{Name: "t", Type: gostatsd.TIMER, Value: value, Rate: 1})
+	aggr.ReceiveMap(mm)
+	f.flushData(context.Background(), time.Second, stats.NewNullStatser())
+}
+
+func TestFlusherBackendMaintenance(t *testing.T) {
+	t.Parallel()
+	active := &namedCapturingBackend{name: "active"}
+	maintained := &namedCapturingBackend{name: "maintained"}
+	backends := []gostatsd.Backend{active, maintained}
+	aggr := newFakeAggregator()
+
+	bm := newBackendMaintenance(backends, 2)
+	f := NewMetricFlusher(time.Second, 0, false, &singleAggregator{aggr: aggr}, backends, nil)
+	f.maintenance = bm
+
+	flushMaintenanceTest(f, aggr, 1)
+	require.NoError(t, bm.setBackends([]string{"maintained"}))
+	flushMaintenanceTest(f, aggr, 2)
+	flushMaintenanceTest(f, aggr, 3) // Buffered
+	flushMaintenanceTest(f, aggr, 4) // Buffered
+	assert.Len(t, active.maps, 4)
+	assert.Len(t, maintained.maps, 1)
+
+	require.NoError(t, bm.setBackends(nil))
+	flushMaintenanceTest(f, aggr, 5)
+	assert.Len(t, active.maps, 5)
+	require.Len(t, maintained.maps, 4)
+	// The buffered flushes are sent before the current flush, with copies of the values the aggregator has reused
+	for i, value := range []float64{3, 4} {
+		mm := maintained.maps[i+1]
+		assert.EqualValues(t, value, mm.Counters["c"][""].Value, value)
+		assert.Equal(t, []float64{value}, mm.Timers["t"][""].Values, value)
+	}
+
+	bm.lock.Lock()
+	defer bm.lock.Unlock()
+	assert.EqualValues(t, 3, bm.backends["maintained"].skipped)
+	assert.EqualValues(t, 1, bm.backends["maintained"].dropped)
+	assert.Zero(t, bm.backends["active"].skipped)
+}
+
+func TestFlusherBackendMaintenanceDrops(t *testing.T) {
+	t.Parallel()
+	maintained := &namedCapturingBackend{name: "maintained"}
+	backends := []gostatsd.Backend{maintained}
+	aggr := newFakeAggregator()
+
+	bm := newBackendMaintenance(backends, 0)
+	require.NoError(t, bm.setBackends([]string{"maintained"}))
+	f := NewMetricFlusher(time.Second, 0, false, &singleAggregator{aggr: aggr}, backends, nil)
+	f.maintenance = bm
+
+	flushMaintenanceTest(f, aggr, 1)
+	flushMaintenanceTest(f, aggr, 2)
+	require.NoError(t, bm.setBackends(nil))
+	flushMaintenanceTest(f, aggr, 3)
+	assert.Len(t, maintained.maps, 1)
+
+	bm.lock.Lock()
+	defer bm.lock.Unlock()
+	assert.EqualValues(t, 2, bm.backends["maintained"].skipped)
+	assert.EqualValues(t, 2, bm.backends["maintained"].dropped)
+}
+
+func TestBackendMaintenanceUnknownBackend(t *testing.T) {
+	t.Parallel()
+	bm := newBackendMaintenance([]gostatsd.Backend{&namedCapturingBackend{name: "a"}}, 1)
+	require.NoError(t, bm.setBackends([]string{"a"}))
+	require.Error(t, bm.setBackends([]string{"b"}))
+	assert.True(t, bm.inMaintenance("a"))
+}
@@ -0,0 +1,48 @@
+package statsd
+
+import (
+	"github.com/atlassian/gostatsd"
+)
+
+// counterSplitter replaces each counter with a gauge of its total, named `<name>.<totalSuffix>`, and a gauge of its
+// per second rate, named `<name>.<rateSuffix>`, so backends emit both under distinct names, rather than in whatever
+// form the backend uses for counters.
+type counterSplitter struct {
+	totalSuffix  string
+	rateSuffix   string
+	disableTotal bool
+	disableRate  bool
+}
+
+// split returns a copy of mm with the counters split, leaving mm unmodified.
+func (cs *counterSplitter) split(mm *gostatsd.MetricMap) *gostatsd.MetricMap {
+	mmNew := gostatsd.NewMetricMap()
+	mm.Gauges.Each(func(metricName, tagsKey string, g gostatsd.Gauge) {
+		mmNew.MergeGauge(metricName, tagsKey, g)
+	})
+	mm.Sets.Each(func(metricName, tagsKey string, s gostatsd.Set) {
+		mmNew.MergeSet(metricName, tagsKey, s)
+	})
+	mm.Timers.Each(func(metricName, tagsKey string, t gostatsd.Timer) {
+		mmNew.MergeTimer(metricName, tagsKey, t)
+	})
+	mm.Counters.Each(func(metricName, tagsKey string, c gostatsd.Counter) {
+		if !cs.disableTotal {
+			mmNew.MergeGauge(metricName+"."+cs.totalSuffix, tagsKey, counterGauge(c, float64(c.Value)))
+		}
+		if !cs.disableRate {
+			mmNew.MergeGauge(metricName+"."+cs.rateSuffix, tagsKey, counterGauge(c, c.PerSecond))
+		}
+	})
+	return mmNew
+}
+
+// counterGauge returns a gauge of the given value, for the same series as the counter.
+func counterGauge(c gostatsd.Counter, value float64) gostatsd.Gauge {
+	return gostatsd.Gauge{
+		Value:     value,
+		Timestamp: c.Timestamp,
+		Source:    c.Source,
+		Tags:      c.Tags,
+	}
+}
@@ -0,0 +1,80 @@
+package statsd
+
+import (
+	"context"
+	"math"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/atlassian/gostatsd"
+)
+
+func TestCounterSplitterFlush(t *testing.T) {
+	t.Parallel()
+	ma := NewMetricAggregator(nil, 0, 0, 0, 0, gostatsd.TimerSubtypes{}, math.MaxUint32)
+	mm := gostatsd.NewMetricMap()
+	mm.Receive(&gostatsd.Metric{Name: "requests", Value: 4, Type: gostatsd.COUNTER, Rate: 1, Tags: gostatsd.Tags{"env:prod"}, Source: "host"})
+	mm.Receive(&gostatsd.Metric{Name: "requests", Value: 3, Type: gostatsd.COUNTER, Rate: 0.5, Tags: gostatsd.Tags{"env:prod"}, Source: "host"})
+	mm.Receive(&gostatsd.Metric{Name: "temperature", Value: 20, Type: gostatsd.GAUGE, Rate: 1})
+	ma.ReceiveMap(mm)
+	ma.Flush(2 * time.Second)
+
+	backend := &namedCapturingBackend{name: "backend"}
+	fl := NewMetricFlusher(0, 0, false, nil, []gostatsd.Backend{backend}, nil)
+	fl.counterSplitter = &counterSplitter{totalSuffix: "count", rateSuffix: "rate"}
+	var wg sync.WaitGroup
+	ma.Process(func(m *gostatsd.MetricMap) {
+		fl.sendMetricsAsync(context.Background(), &wg, m, nil)
+	})
+	wg.Wait()
+
+	require.Len(t, backend.maps, 1)
+	sent := backend.maps[0]
+	assert.Empty(t, sent.Counters)
+	require.Len(t, sent.Gauges, 3)
+
+	tagsKey := gostatsd.FormatTagsKey("host", gostatsd.Tags{"env:prod"})
+	total := sent.Gauges["requests.count"][tagsKey]
+	assert.EqualValues(t, 10, total.Value)
+	assert.Equal(t, gostatsd.Tags{"env:prod"}, total.Tags)
+	assert.EqualValues(t, "host", total.Source)
+	rate := sent.Gauges["requests.rate"][tagsKey]
+	assert.EqualValues(t, 5, rate.Value)
+	assert.Equal(t, gostatsd.Tags{"env:prod"}, rate.Tags)
+	assert.EqualValues(t, 20, sent.Gauges["temperature"][""].Value)
+
+	// The aggregator still has the counter for the next flush
+	assert.EqualValues(t, 10, ma.metricMap.Counters["requests"][tagsKey].Value)
+}
+
+func TestCounterSplitterDisabled(t *testing.T) {
+	t.Parallel()
+	mm := gostatsd.NewMetricMap()
+	c := gostatsd.NewCounter(1, 10, "", nil)
+	c.PerSecond = 1
+	mm.Counters["requests"] = map[string]gostatsd.Counter{"": c}
+
+	cs := &counterSplitter{totalSuffix: "total", rateSuffix: "per_second", disableRate: true}
+	split := cs.split(mm)
+	assert.Len(t, split.Gauges, 1)
+	assert.EqualValues(t, 10, split.Gauges["requests.total"][""].Value)
+
+	cs = &counterSplitter{totalSuffix: "total", rateSuffix: "per_second", disableTotal: true}
+	split = cs.split(mm)
+	assert.Len(t, split.Gauges, 1)
+	assert.EqualValues(t, 1, split.Gauges["requests.per_second"][""].Value)
+}
+
+func TestCreateCounterSplitter(t *testing.T) {
+	t.Parallel()
+	s := &Server{CounterTotalSuffix: "count", CounterRateSuffix: "rate"}
+	assert.Nil(t, s.createCounterSplitter())
+
+	s.CounterSplit = true
+	s.DisabledSubTypes.CounterRate = true
+	assert.Equal(t, &counterSplitter{totalSuffix: "count", rateSuffix: "rate", disableRate: true}, s.createCounterSplitter())
+}
@@ -0,0 +1,184 @@
+package statsd
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"github.com/spf13/viper"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/stats"
+)
+
+// validateEmptyTagValuePolicy returns an error if policy is not one of the EmptyTagValuePolicy* values.
+func validateEmptyTagValuePolicy(policy string) error {
+	switch policy {
+	case gostatsd.EmptyTagValuePolicyKeep, gostatsd.EmptyTagValuePolicyDrop, gostatsd.EmptyTagValuePolicyKeyOnly:
+		return nil
+	default:
+		return fmt.Errorf("unknown empty tag value policy %q", policy)
+	}
+}
+
+// applyEmptyTagValuePolicy returns tags with the tags with an empty value, such as `env:`, dropped or converted to a
+// tag of just the key by the policy, and true if any of them changed.  The tags are copied only if they change, as
+// they may be shared with other metrics.
+func applyEmptyTagValuePolicy(policy string, tags gostatsd.Tags) (gostatsd.Tags, bool) {
+	if policy != gostatsd.EmptyTagValuePolicyDrop && policy != gostatsd.EmptyTagValuePolicyKeyOnly {
+		return tags, false
+	}
+	var result gostatsd.Tags
+	for i, tag := range tags {
+		idx := strings.IndexByte(tag, ':')
+		if idx < 0 || idx != len(tag)-1 {
+			if result != nil {
+				result = append(result, tag)
+			}
+			continue
+		}
+		if result == nil {
+			result = make(gostatsd.Tags, i, len(tags))
+			copy(result, tags[:i])
+		}
+		if policy == gostatsd.EmptyTagValuePolicyKeyOnly {
+			result = append(result, tag[:idx])
+		}
+	}
+	if result == nil {
+		return tags, false
+	}
+	// A key-only tag may already be in the tags
+	return uniqueTags(result, gostatsd.Tags{}), true
+}
+
+// emptyTagValues applies an empty tag value policy to the series flushed to a single backend, on top of the policy
+// applied to every metric when it's received, so one backend can drop the tags with empty values which it rejects.
+type emptyTagValues struct {
+	dropped uint64 // Series dropped since the last emit because another series has the same tags, accessed atomically
+
+	policy string
+}
+
+// newEmptyTagValuesFromViper creates an emptyTagValues for each backend with a policy in the `empty-tag-value-policies`
+// map, keyed by the backend name.  A backend whose policy is to keep the tags is left out, as it has nothing to do.
+func newEmptyTagValuesFromViper(v *viper.Viper, backends []gostatsd.Backend) (map[string]*emptyTagValues, error) {
+	policies := v.GetStringMapString("empty-tag-value-policies")
+	stages := map[string]*emptyTagValues{}
+	for _, backend := range backends {
+		policy, ok := policies[backend.Name()]
+		if !ok {
+			continue
+		}
+		if err := validateEmptyTagValuePolicy(policy); err != nil {
+			return nil, fmt.Errorf("backend %s: %v", backend.Name(), err)
+		}
+		if policy == gostatsd.EmptyTagValuePolicyKeep {
+			continue
+		}
+		stages[backend.Name()] = &emptyTagValues{
+			policy: policy,
+		}
+	}
+	return stages, nil
+}
+
+// series returns the tags key and tags of a series changed by the policy, or false if the series should be dropped
+// because exists reports the metric already has a series with the changed tags.
+func (etv *emptyTagValues) series(source gostatsd.Source, tags gostatsd.Tags, exists func(tagsKey string) bool) (string, gostatsd.Tags, bool) {
+	tagsKey := gostatsd.FormatTagsKey(source, tags)
+	if exists(tagsKey) {
+		// The aggregates of two series can't be combined, so only one of them is sent
+		atomic.AddUint64(&etv.dropped, 1)
+		return "", nil, false
+	}
+	return tagsKey, tags, true
+}
+
+// apply returns mm with the policy applied to the tags of every series.  If no series changes, mm is returned as is,
+// otherwise a new MetricMap is returned.  The values are not copied, so the result must be treated as read only, the
+// same as the input.  The series which don't change are added first, so a changed series which has the same tags as
+// another series of the metric is dropped rather than sent twice.
+func (etv *emptyTagValues) apply(mm *gostatsd.MetricMap) *gostatsd.MetricMap {
+	changes := false
+	changed := func(tags gostatsd.Tags) bool {
+		_, c := applyEmptyTagValuePolicy(etv.policy, tags)
+		return c
+	}
+	mm.Counters.Each(func(_, _ string, c gostatsd.Counter) { changes = changes || changed(c.Tags) })
+	mm.Gauges.Each(func(_, _ string, g gostatsd.Gauge) { changes = changes || changed(g.Tags) })
+	mm.Timers.Each(func(_, _ string, t gostatsd.Timer) { changes = changes || changed(t.Tags) })
+	mm.Sets.Each(func(_, _ string, s gostatsd.Set) { changes = changes || changed(s.Tags) })
+	if !changes {
+		return mm
+	}
+
+	mmNew := gostatsd.NewMetricMap()
+	mm.Counters.Each(func(metricName, tagsKey string, c gostatsd.Counter) {
+		if !changed(c.Tags) {
+			mmNew.MergeCounter(metricName, tagsKey, c)
+		}
+	})
+	mm.Counters.Each(func(metricName, tagsKey string, c gostatsd.Counter) {
+		tags, ok := applyEmptyTagValuePolicy(etv.policy, c.Tags)
+		if !ok {
+			return
+		}
+		exists := func(tagsKey string) bool { _, ok := mmNew.Counters[metricName][tagsKey]; return ok }
+		if tagsKey, c.Tags, ok = etv.series(c.Source, tags, exists); ok {
+			mmNew.MergeCounter(metricName, tagsKey, c)
+		}
+	})
+	mm.Gauges.Each(func(metricName, tagsKey string, g gostatsd.Gauge) {
+		if !changed(g.Tags) {
+			mmNew.MergeGauge(metricName, tagsKey, g)
+		}
+	})
+	mm.Gauges.Each(func(metricName, tagsKey string, g gostatsd.Gauge) {
+		tags, ok := applyEmptyTagValuePolicy(etv.policy, g.Tags)
+		if !ok {
+			return
+		}
+		exists := func(tagsKey string) bool { _, ok := mmNew.Gauges[metricName][tagsKey]; return ok }
+		if tagsKey, g.Tags, ok = etv.series(g.Source, tags, exists); ok {
+			mmNew.MergeGauge(metricName, tagsKey, g)
+		}
+	})
+	mm.Timers.Each(func(metricName, tagsKey string, t gostatsd.Timer) {
+		if !changed(t.Tags) {
+			mmNew.MergeTimer(metricName, tagsKey, t)
+		}
+	})
+	mm.Timers.Each(func(metricName, tagsKey string, t gostatsd.Timer) {
+		tags, ok := applyEmptyTagValuePolicy(etv.policy, t.Tags)
+		if !ok {
+			return
+		}
+		exists := func(tagsKey string) bool { _, ok := mmNew.Timers[metricName][tagsKey]; return ok }
+		if tagsKey, t.Tags, ok = etv.series(t.Source, tags, exists); ok {
+			mmNew.MergeTimer(metricName, tagsKey, t)
+		}
+	})
+	mm.Sets.Each(func(metricName, tagsKey string, s gostatsd.Set) {
+		if !changed(s.Tags) {
+			mmNew.MergeSet(metricName, tagsKey, s)
+		}
+	})
+	mm.Sets.Each(func(metricName, tagsKey string, s gostatsd.Set) {
+		tags, ok := applyEmptyTagValuePolicy(etv.policy, s.Tags)
+		if !ok {
+			return
+		}
+		exists := func(tagsKey string) bool { _, ok := mmNew.Sets[metricName][tagsKey]; return ok }
+		if tagsKey, s.Tags, ok = etv.series(s.Source, tags, exists); ok {
+			mmNew.MergeSet(metricName, tagsKey, s)
+		}
+	})
+	return mmNew
+}
+
+// emit emits the number of series dropped since the last emit.
+func (etv *emptyTagValues) emit(statser stats.Statser, backendName string) {
+	tags := gostatsd.Tags{"backend:" + backendName}
+	statser.Count("backend.empty_tag_value.dropped", float64(atomic.SwapUint64(&etv.dropped, 0)), tags)
+}
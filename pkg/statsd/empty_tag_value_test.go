@@ -0,0 +1,113 @@
+package statsd
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/stats"
+)
+
+func TestApplyEmptyTagValuePolicy(t *testing.T) {
+	t.Parallel()
+	tags := gostatsd.Tags{"env:", "host:a", "url:http://x", "team", "team:"}
+	unchanged, changed := applyEmptyTagValuePolicy(gostatsd.EmptyTagValuePolicyKeep, tags)
+	assert.False(t, changed)
+	assert.Equal(t, tags, unchanged)
+
+	dropped, changed := applyEmptyTagValuePolicy(gostatsd.EmptyTagValuePolicyDrop, tags)
+	assert.True(t, changed)
+	assert.ElementsMatch(t, gostatsd.Tags{"host:a", "url:http://x", "team"}, dropped)
+
+	// A key-only tag which is already in the tags isn't repeated
+	keyOnly, changed := applyEmptyTagValuePolicy(gostatsd.EmptyTagValuePolicyKeyOnly, tags)
+	assert.True(t, changed)
+	assert.ElementsMatch(t, gostatsd.Tags{"env", "host:a", "url:http://x", "team"}, keyOnly)
+
+	// The input isn't modified
+	assert.Equal(t, gostatsd.Tags{"env:", "host:a", "url:http://x", "team", "team:"}, tags)
+
+	_, changed = applyEmptyTagValuePolicy(gostatsd.EmptyTagValuePolicyDrop, gostatsd.Tags{"host:a", "a:b:"})
+	assert.False(t, changed)
+}
+
+func TestEmptyTagValuesFromViper(t *testing.T) {
+	t.Parallel()
+	backends := []gostatsd.Backend{
+		&namedCapturingBackend{name: "datadog"},
+		&namedCapturingBackend{name: "graphite"},
+		&namedCapturingBackend{name: "stdout"},
+	}
+	v := viper.New()
+	v.Set("empty-tag-value-policies", map[string]interface{}{
+		"datadog":  gostatsd.EmptyTagValuePolicyKeyOnly,
+		"graphite": gostatsd.EmptyTagValuePolicyKeep,
+	})
+	stages, err := newEmptyTagValuesFromViper(v, backends)
+	require.NoError(t, err)
+	require.Len(t, stages, 1)
+	assert.Equal(t, gostatsd.EmptyTagValuePolicyKeyOnly, stages["datadog"].policy)
+
+	v.Set("empty-tag-value-policies", map[string]interface{}{"stdout": "remove"})
+	_, err = newEmptyTagValuesFromViper(v, backends)
+	require.Error(t, err)
+}
+
+func TestEmptyTagValuesApply(t *testing.T) {
+	t.Parallel()
+	etv := &emptyTagValues{policy: gostatsd.EmptyTagValuePolicyDrop}
+	input := gostatsd.NewMetricMap()
+	input.Receive(&gostatsd.Metric{Type: gostatsd.COUNTER, Name: "c", Value: 1, Rate: 1, Tags: gostatsd.Tags{"env:", "host:a"}})
+	input.Receive(&gostatsd.Metric{Type: gostatsd.COUNTER, Name: "c", Value: 2, Rate: 1, Tags: gostatsd.Tags{"host:a"}})
+	input.Receive(&gostatsd.Metric{Type: gostatsd.GAUGE, Name: "g", Value: 1, Tags: gostatsd.Tags{"env:"}})
+	input.Receive(&gostatsd.Metric{Type: gostatsd.TIMER, Name: "t", Value: 1, Rate: 1, Tags: gostatsd.Tags{"env:prod"}})
+	input.Receive(&gostatsd.Metric{Type: gostatsd.SET, Name: "s", StringValue: "x", Rate: 1, Tags: gostatsd.Tags{"a:", "b:"}})
+	mm := etv.apply(input)
+
+	// The series which doesn't change is kept, rather than a changed series with the same tags
+	require.Len(t, mm.Counters["c"], 1)
+	assert.EqualValues(t, 2, mm.Counters["c"]["host:a"].Value)
+	assert.Equal(t, gostatsd.Tags{}, mm.Gauges["g"][""].Tags)
+	assert.Equal(t, gostatsd.Tags{"env:prod"}, mm.Timers["t"]["env:prod"].Tags)
+	assert.Equal(t, gostatsd.Tags{}, mm.Sets["s"][""].Tags)
+	assert.EqualValues(t, 1, etv.dropped)
+	// The input isn't modified
+	assert.Len(t, input.Counters["c"], 2)
+	assert.Equal(t, gostatsd.Tags{"env:"}, input.Gauges["g"]["env:"].Tags)
+
+	internal := &capturingHandler{}
+	statser := stats.NewInternalStatser(nil, "", "", gostatsd.UnknownSource, internal)
+	etv.emit(statser, "datadog")
+	statser.NotifyFlush(context.Background(), 0)
+	require.Len(t, internal.mm, 1)
+	assert.EqualValues(t, 1, internal.mm[0].Counters["backend.empty_tag_value.dropped"]["backend:datadog"].Value)
+
+	// Nothing to change
+	unchanged := gostatsd.NewMetricMap()
+	unchanged.Receive(&gostatsd.Metric{Type: gostatsd.GAUGE, Name: "g", Value: 1, Tags: gostatsd.Tags{"env:prod"}})
+	assert.Same(t, unchanged, etv.apply(unchanged))
+}
+
+func TestFlusherAppliesEmptyTagValues(t *testing.T) {
+	t.Parallel()
+	strict := &namedCapturingBackend{name: "strict"}
+	lenient := &namedCapturingBackend{name: "lenient"}
+	fl := NewMetricFlusher(0, 0, false, nil, []gostatsd.Backend{strict, lenient}, nil)
+	fl.emptyTagValues = map[string]*emptyTagValues{"strict": {policy: gostatsd.EmptyTagValuePolicyKeyOnly}}
+
+	input := gostatsd.NewMetricMap()
+	input.Receive(&gostatsd.Metric{Type: gostatsd.GAUGE, Name: "g", Value: 1, Tags: gostatsd.Tags{"env:"}})
+	var wg sync.WaitGroup
+	fl.sendMetricsAsync(context.Background(), &wg, input, nil)
+	wg.Wait()
+
+	require.Len(t, lenient.maps, 1)
+	assert.Same(t, input, lenient.maps[0])
+	require.Len(t, strict.maps, 1)
+	assert.Equal(t, gostatsd.Tags{"env"}, strict.maps[0].Gauges["g"]["env"].Tags)
+}
@@ -0,0 +1,36 @@
+package statsd_test
+
+import (
+	"context"
+	"strings"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/statsd"
+)
+
+// dropDebugHandler drops counters whose name starts with "debug.", and passes everything else on.
+type dropDebugHandler struct {
+	gostatsd.PipelineHandler // The next handler, which provides EstimatedTags, DispatchEvent, and WaitForEvents
+}
+
+func (h *dropDebugHandler) DispatchMetricMap(ctx context.Context, mm *gostatsd.MetricMap) {
+	for name := range mm.Counters {
+		if strings.HasPrefix(name, "debug.") {
+			delete(mm.Counters, name)
+		}
+	}
+	h.PipelineHandler.DispatchMetricMap(ctx, mm)
+}
+
+// This example inserts a custom handler in to the pipeline, which drops some counters before they are aggregated.
+func ExampleHandlerFactory() {
+	server := &statsd.Server{
+		Handlers: []statsd.HandlerFactory{
+			func(next gostatsd.PipelineHandler) gostatsd.PipelineHandler {
+				return &dropDebugHandler{PipelineHandler: next}
+			},
+		},
+		// Other configuration omitted
+	}
+	_ = server.Run(context.Background())
+}
@@ -0,0 +1,90 @@
+package statsd
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/stats"
+)
+
+// flushEventer summarises each flush in an event, which is sent to the backends along with the other events, as an
+// audit trail of flushes.  The results of every send to a backend are recorded as they complete, so a backend fails
+// the flush if any of its sends fail.
+type flushEventer struct {
+	title  string          // The title and aggregation key of the events, prefixed with the namespace
+	source gostatsd.Source // The hostname of the server
+
+	mu     sync.Mutex
+	sent   int             // The series delivered, counted once for each backend
+	failed map[string]bool // Keyed by the name of each backend sent to, true if a send failed
+}
+
+func newFlushEventer(namespace string, source gostatsd.Source) *flushEventer {
+	title := "flush_complete"
+	if namespace != "" {
+		title = namespace + "." + title
+	}
+	return &flushEventer{
+		title:  title,
+		source: source,
+	}
+}
+
+// record records the result of sending mm to a backend.
+func (fe *flushEventer) record(backendName string, mm *gostatsd.MetricMap, ok bool) {
+	fe.mu.Lock()
+	defer fe.mu.Unlock()
+	if fe.failed == nil {
+		fe.failed = map[string]bool{}
+	}
+	if ok {
+		fe.sent += countSeries(mm)
+	}
+	fe.failed[backendName] = fe.failed[backendName] || !ok
+}
+
+// send sends an event summarising the sends recorded since the last event, and starts recording again.
+func (fe *flushEventer) send(ctx context.Context, statser stats.Statser, flushInterval, duration time.Duration) {
+	fe.mu.Lock()
+	sent, failed := fe.sent, fe.failed
+	fe.sent, fe.failed = 0, nil
+	fe.mu.Unlock()
+
+	var succeededBackends, failedBackends []string
+	for backendName, backendFailed := range failed {
+		if backendFailed {
+			failedBackends = append(failedBackends, backendName)
+		} else {
+			succeededBackends = append(succeededBackends, backendName)
+		}
+	}
+	sort.Strings(succeededBackends)
+	sort.Strings(failedBackends)
+
+	alertType := gostatsd.AlertSuccess
+	if len(failedBackends) > 0 {
+		alertType = gostatsd.AlertWarning
+		if len(succeededBackends) == 0 {
+			alertType = gostatsd.AlertError
+		}
+	}
+	text := fmt.Sprintf("Flushed %d series to %d of %d backends in %s", sent, len(succeededBackends), len(failed), duration)
+	if len(failedBackends) > 0 {
+		text += "\nFailed backends: " + strings.Join(failedBackends, ", ")
+	}
+	statser.Event(ctx, &gostatsd.Event{
+		Title:          fe.title,
+		Text:           text,
+		DateHappened:   time.Now().Unix(),
+		AggregationKey: fe.title,
+		Tags:           gostatsd.Tags{"flush_interval:" + flushInterval.String()},
+		Source:         fe.source,
+		Priority:       gostatsd.PriLow,
+		AlertType:      alertType,
+	})
+}
@@ -0,0 +1,67 @@
+package statsd
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/stats"
+)
+
+func TestFlushEventSummarisesFlush(t *testing.T) {
+	t.Parallel()
+	aggr := newFakeAggregator()
+	mm := gostatsd.NewMetricMap()
+	mm.Receive(&gostatsd.Metric{Name: "requests", Type: gostatsd.COUNTER, Value: 5, Rate: 1, Tags: gostatsd.Tags{"a:b"}})
+	mm.Receive(&gostatsd.Metric{Name: "requests", Type: gostatsd.COUNTER, Value: 5, Rate: 1, Tags: gostatsd.Tags{"a:c"}})
+	mm.Receive(&gostatsd.Metric{Name: "queue", Type: gostatsd.GAUGE, Value: 3, Rate: 1})
+	aggr.ReceiveMap(mm)
+
+	backends := []gostatsd.Backend{
+		&namedCapturingBackend{name: "primary"},
+		&failingBackend{namedCapturingBackend{name: "secondary"}},
+		&namedCapturingBackend{name: "archive"},
+	}
+	f := NewMetricFlusher(time.Second, 0, false, &singleAggregator{aggr: aggr}, backends, nil)
+	f.flushEventer = newFlushEventer("pipeline", "host1")
+	internal := &capturingHandler{}
+	statser := stats.NewInternalStatser(nil, "", "", "host1", internal)
+	f.flushData(context.Background(), 10*time.Second, statser)
+
+	require.Len(t, internal.e, 1)
+	e := internal.e[0]
+	assert.Equal(t, "pipeline.flush_complete", e.Title)
+	assert.Equal(t, "pipeline.flush_complete", e.AggregationKey)
+	assert.Regexp(t, `^Flushed 6 series to 2 of 3 backends in [^\n]+\nFailed backends: secondary$`, e.Text)
+	assert.Equal(t, gostatsd.Tags{"flush_interval:10s"}, e.Tags)
+	assert.Equal(t, gostatsd.Source("host1"), e.Source)
+	assert.Equal(t, gostatsd.AlertWarning, e.AlertType)
+
+	// Every flush is summarised separately
+	f.flushData(context.Background(), 10*time.Second, statser)
+	require.Len(t, internal.e, 2)
+	assert.Regexp(t, `^Flushed 0 series to 2 of 3 backends in `, internal.e[1].Text)
+}
+
+func TestFlushEventAlertTypes(t *testing.T) {
+	t.Parallel()
+	internal := &capturingHandler{}
+	statser := stats.NewInternalStatser(nil, "", "", "", internal)
+	fe := newFlushEventer("", "")
+
+	fe.record("a", gostatsd.NewMetricMap(), true)
+	fe.send(context.Background(), statser, time.Second, time.Millisecond)
+	fe.record("a", gostatsd.NewMetricMap(), false)
+	fe.send(context.Background(), statser, time.Second, time.Millisecond)
+
+	require.Len(t, internal.e, 2)
+	assert.Equal(t, "flush_complete", internal.e[0].Title)
+	assert.Equal(t, gostatsd.AlertSuccess, internal.e[0].AlertType)
+	assert.Equal(t, "Flushed 0 series to 1 of 1 backends in 1ms", internal.e[0].Text)
+	assert.Equal(t, gostatsd.AlertError, internal.e[1].AlertType)
+	assert.Equal(t, "Flushed 0 series to 0 of 1 backends in 1ms\nFailed backends: a", internal.e[1].Text)
+}
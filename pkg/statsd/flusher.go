@@ -3,6 +3,7 @@ package statsd
 import (
 	"context"
 	"fmt"
+	"hash/fnv"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -20,24 +21,42 @@ type MetricFlusher struct {
 	// Counter fields below must be read/written only using atomic instructions.
 	// 64-bit fields must be the first fields in the struct to guarantee proper memory alignment.
 	// See https://golang.org/pkg/sync/atomic/#pkg-note-BUG
-	lastFlush      int64 // Last time the metrics where aggregated. Unix timestamp in nsec.
-	lastFlushError int64 // Time of the last flush error. Unix timestamp in nsec.
+	lastFlush      int64  // Last time the metrics where aggregated. Unix timestamp in nsec.
+	lastFlushError int64  // Time of the last flush error. Unix timestamp in nsec.
+	overruns       uint64 // Number of flushes which took longer than the flush interval.
 
 	flushInterval      time.Duration // How often to flush metrics to the sender
 	flushOffset        time.Duration // Offset for when to flush if alignment is enabled
 	flushAligned       bool          // Indicate if flush is aligned to the interval or not
 	aggregateProcesser AggregateProcesser
 	backends           []gostatsd.Backend
+	backendFilters     map[string]*BackendFilter   // Keyed by backend name, may be nil
+	skipNotify         bool                        // Don't notify the Statser of flushes, another flusher does
+	skipFlushStats     bool                        // Don't emit flush and aggregation timings
+	metricTypeTag      string                      // Tag key to add the metric type as, if not empty
+	counterSplitter    *counterSplitter            // Splits counters in to total and rate gauges, may be nil
+	timerGauges        *timerGauges                // Adds gauges of the min and max of timers, may be nil
+	seriesCounter      *seriesCounter              // Counts the series of each metric, may be nil
+	flushEventer       *flushEventer               // Sends an event summarising each flush, may be nil
+	percentileNamers   map[string]*percentileNamer // Keyed by backend name, may be nil
+	valueRounders      map[string]*valueRounder    // Keyed by backend name, may be nil
+	nameTransformers   map[string]*nameTransformer // Keyed by backend name, may be nil
+	emptyTagValues     map[string]*emptyTagValues  // Keyed by backend name, may be nil
+	tagLimiters        map[string]*tagLimiter      // Keyed by backend name, may be nil
+	maintenance        *backendMaintenance         // The backends in maintenance mode, may be nil
+	maintenanceBuffer  maintenanceBuffer           // The flushes not sent to backends in maintenance mode
+	writeAheadLogs     map[string]*writeAheadLog   // Keyed by backend name, may be nil
 }
 
 // NewMetricFlusher creates a new MetricFlusher with provided configuration.
-func NewMetricFlusher(flushInterval, flushOffset time.Duration, aligned bool, aggregateProcesser AggregateProcesser, backends []gostatsd.Backend) *MetricFlusher {
+func NewMetricFlusher(flushInterval, flushOffset time.Duration, aligned bool, aggregateProcesser AggregateProcesser, backends []gostatsd.Backend, backendFilters map[string]*BackendFilter) *MetricFlusher {
 	return &MetricFlusher{
 		flushInterval:      flushInterval,
 		flushOffset:        flushOffset,
 		flushAligned:       aligned,
 		aggregateProcesser: aggregateProcesser,
 		backends:           backends,
+		backendFilters:     backendFilters,
 	}
 }
 
@@ -52,6 +71,17 @@ func (f *MetricFlusher) makeTicker(ctx context.Context) (<-chan time.Time, func(
 	}
 }
 
+// hostnameFlushOffset derives a flush offset between 0 and the flush interval from a hash of the hostname, so each host
+// has a stable flush phase, and flushes are spread across hosts without configuring each of them.
+func hostnameFlushOffset(hostname string, flushInterval time.Duration) time.Duration {
+	if flushInterval <= 0 {
+		return 0
+	}
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(hostname))
+	return time.Duration(h.Sum64() % uint64(flushInterval))
+}
+
 // Run runs the MetricFlusher.
 func (f *MetricFlusher) Run(ctx context.Context) {
 	statser := stats.FromContext(ctx)
@@ -59,6 +89,16 @@ func (f *MetricFlusher) Run(ctx context.Context) {
 	ch, stop := f.makeTicker(ctx)
 	defer stop()
 
+	f.replayWriteAheadLogs(ctx)
+	defer func() {
+		// The logs may be shared with flushers of other backends
+		for _, backend := range f.backends {
+			if wal, ok := f.writeAheadLogs[backend.Name()]; ok {
+				wal.close()
+			}
+		}
+	}()
+
 	lastFlush := time.Now()
 	for {
 		select {
@@ -66,7 +106,9 @@ func (f *MetricFlusher) Run(ctx context.Context) {
 			return
 		case thisFlush := <-ch: // Time to flush to the backends
 			flushDelta := thisFlush.Sub(lastFlush)
-			statser.NotifyFlush(ctx, flushDelta)
+			if !f.skipNotify {
+				statser.NotifyFlush(ctx, flushDelta)
+			}
 			if f.aggregateProcesser != AggregateProcesser(nil) {
 				f.flushData(ctx, flushDelta, statser)
 			}
@@ -76,8 +118,19 @@ func (f *MetricFlusher) Run(ctx context.Context) {
 }
 
 func (f *MetricFlusher) flushData(ctx context.Context, flushInterval time.Duration, statser stats.Statser) {
+	backendStatser := statser
+	if f.skipFlushStats {
+		statser = stats.NewNullStatser()
+	}
 	var sendWg sync.WaitGroup
+	start := time.Now()
 	timerTotal := statser.NewTimer("flusher.total_time", nil)
+	var maintenance map[string]*gostatsd.MetricMap
+	if f.maintenance != nil {
+		var resumed map[string][]*gostatsd.MetricMap
+		maintenance, resumed = f.maintenanceBuffer.startFlush(f.maintenance, f.backends)
+		f.sendBufferedFlushes(ctx, &sendWg, resumed)
+	}
 	processWait := f.aggregateProcesser.Process(ctx, func(workerId int, aggr Aggregator) {
 		// This is in the flusher, but it's an aggregator action, so put it in that space.
 		tags := gostatsd.Tags{fmt.Sprintf("aggregator_id:%d", workerId)}
@@ -88,7 +141,10 @@ func (f *MetricFlusher) flushData(ctx context.Context, flushInterval time.Durati
 
 		timerProcess := statser.NewTimer("aggregator.process_time", tags)
 		aggr.Process(func(m *gostatsd.MetricMap) {
-			f.sendMetricsAsync(ctx, &sendWg, m)
+			if f.seriesCounter != nil {
+				f.seriesCounter.add(m)
+			}
+			f.sendMetricsAsync(ctx, &sendWg, m, maintenance)
 		})
 		timerProcess.SendGauge()
 
@@ -98,20 +154,138 @@ func (f *MetricFlusher) flushData(ctx context.Context, flushInterval time.Durati
 	})
 	processWait() // Wait for all workers to execute function
 	sendWg.Wait() // Wait for all backends to finish sending
+	duration := time.Since(start)
+	if duration > f.flushInterval {
+		// The next flush will be late, or skipped if the ticker has dropped it
+		atomic.AddUint64(&f.overruns, 1)
+	}
 	timerTotal.SendGauge()
+	statser.Gauge("flusher.overruns", float64(atomic.LoadUint64(&f.overruns)), nil)
+	if f.seriesCounter != nil {
+		f.seriesCounter.emit(statser)
+	}
+	if f.flushEventer != nil {
+		f.flushEventer.send(ctx, backendStatser, flushInterval, duration)
+	}
+	for _, backend := range f.backends {
+		if wal, ok := f.writeAheadLogs[backend.Name()]; ok {
+			pending, dropped := wal.stats()
+			tags := gostatsd.Tags{"backend:" + backend.Name()}
+			backendStatser.Gauge("backend.wal.pending", float64(pending), tags)
+			backendStatser.Gauge("backend.wal.dropped", float64(dropped), tags)
+		}
+		if stage, ok := f.emptyTagValues[backend.Name()]; ok {
+			stage.emit(backendStatser, backend.Name())
+		}
+		if limiter, ok := f.tagLimiters[backend.Name()]; ok {
+			limiter.emit(backendStatser, backend.Name())
+		}
+		if transformer, ok := f.nameTransformers[backend.Name()]; ok {
+			transformer.emit(backendStatser)
+		}
+	}
 }
 
-func (f *MetricFlusher) sendMetricsAsync(ctx context.Context, wg *sync.WaitGroup, m *gostatsd.MetricMap) {
-	wg.Add(len(f.backends))
+// sendMetricsAsync sends m to every backend, except the backends in maintenance, which it is buffered for instead.
+func (f *MetricFlusher) sendMetricsAsync(ctx context.Context, wg *sync.WaitGroup, m *gostatsd.MetricMap, maintenance map[string]*gostatsd.MetricMap) {
+	if f.counterSplitter != nil {
+		m = f.counterSplitter.split(m)
+	}
+	if f.timerGauges != nil {
+		m = f.timerGauges.add(m)
+	}
+	if f.metricTypeTag != "" {
+		m = addMetricTypeTags(m, f.metricTypeTag)
+	}
 	for _, backend := range f.backends {
-		backend.SendMetricsAsync(ctx, m, func(errs []error) {
-			defer wg.Done()
-			f.handleSendResult(errs)
-		})
+		mm := m
+		if filter, ok := f.backendFilters[backend.Name()]; ok {
+			mm = filter.Apply(m)
+		}
+		if namer, ok := f.percentileNamers[backend.Name()]; ok {
+			mm = namer.apply(mm)
+		}
+		if rounder, ok := f.valueRounders[backend.Name()]; ok {
+			mm = rounder.apply(mm)
+		}
+		if transformer, ok := f.nameTransformers[backend.Name()]; ok {
+			mm = transformer.apply(mm)
+		}
+		if stage, ok := f.emptyTagValues[backend.Name()]; ok {
+			mm = stage.apply(mm)
+		}
+		if limiter, ok := f.tagLimiters[backend.Name()]; ok {
+			mm = limiter.apply(mm)
+		}
+		if buffered, ok := maintenance[backend.Name()]; ok {
+			f.maintenanceBuffer.add(buffered, mm)
+			continue
+		}
+		f.sendToBackend(ctx, wg, backend, mm)
+	}
+}
+
+// sendToBackend sends mm to the backend, recording it in the backend's write-ahead log first, if it has one.
+func (f *MetricFlusher) sendToBackend(ctx context.Context, wg *sync.WaitGroup, backend gostatsd.Backend, mm *gostatsd.MetricMap) {
+	wal, logged := f.writeAheadLogs[backend.Name()]
+	var seq uint64
+	if logged {
+		var err error
+		if seq, err = wal.append(mm); err != nil {
+			logrus.WithError(err).WithField("backend", backend.Name()).Error("Failed to write flush to the write-ahead log")
+			logged = false
+		}
+	}
+	wg.Add(1)
+	backend.SendMetricsAsync(ctx, mm, func(errs []error) {
+		defer wg.Done()
+		ok := f.handleSendResult(errs)
+		if f.flushEventer != nil {
+			f.flushEventer.record(backend.Name(), mm, ok)
+		}
+		if ok && logged {
+			wal.delivered(seq)
+		}
+	})
+}
+
+// replayWriteAheadLogs sends the flushes which were not delivered before the server last stopped, without waiting
+// for them to be sent.
+func (f *MetricFlusher) replayWriteAheadLogs(ctx context.Context) {
+	for _, backend := range f.backends {
+		wal, ok := f.writeAheadLogs[backend.Name()]
+		if !ok {
+			continue
+		}
+		entries := wal.undelivered()
+		if len(entries) > 0 {
+			logrus.WithField("backend", backend.Name()).Infof("Replaying %d undelivered flushes", len(entries))
+		}
+		for _, entry := range entries {
+			entry := entry
+			backend.SendMetricsAsync(ctx, entry.mm, func(errs []error) {
+				if f.handleSendResult(errs) {
+					wal.delivered(entry.seq)
+				}
+			})
+		}
+	}
+}
+
+// sendBufferedFlushes sends the flushes buffered for backends which have left maintenance mode, oldest first.
+func (f *MetricFlusher) sendBufferedFlushes(ctx context.Context, wg *sync.WaitGroup, resumed map[string][]*gostatsd.MetricMap) {
+	for _, backend := range f.backends {
+		for _, mm := range resumed[backend.Name()] {
+			if mm.IsEmpty() {
+				continue
+			}
+			f.sendToBackend(ctx, wg, backend, mm)
+		}
 	}
 }
 
-func (f *MetricFlusher) handleSendResult(flushResults []error) {
+// handleSendResult records the result of sending to a backend, and returns true if it was sent without errors.
+func (f *MetricFlusher) handleSendResult(flushResults []error) bool {
 	timestampPointer := &f.lastFlush
 	for _, err := range flushResults {
 		if err != nil {
@@ -122,4 +296,5 @@ func (f *MetricFlusher) handleSendResult(flushResults []error) {
 		}
 	}
 	atomic.StoreInt64(timestampPointer, time.Now().UnixNano())
+	return timestampPointer == &f.lastFlush
 }
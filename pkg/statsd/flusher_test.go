@@ -1,9 +1,17 @@
 package statsd
 
 import (
+	"context"
 	"errors"
 	"strconv"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/stats"
 )
 
 func TestFlusherHandleSendResultNoErrors(t *testing.T) {
@@ -17,7 +25,7 @@ func TestFlusherHandleSendResultNoErrors(t *testing.T) {
 		errs := errs
 		t.Run(strconv.Itoa(pos), func(t *testing.T) {
 			t.Parallel()
-			fl := NewMetricFlusher(0, 0, false, nil, nil)
+			fl := NewMetricFlusher(0, 0, false, nil, nil, nil)
 			fl.handleSendResult(errs)
 
 			if fl.lastFlush == 0 || fl.lastFlushError != 0 {
@@ -39,7 +47,7 @@ func TestFlusherHandleSendResultError(t *testing.T) {
 		errs := errs
 		t.Run(strconv.Itoa(pos), func(t *testing.T) {
 			t.Parallel()
-			fl := NewMetricFlusher(0, 0, false, nil, nil)
+			fl := NewMetricFlusher(0, 0, false, nil, nil, nil)
 			fl.handleSendResult(errs)
 
 			if fl.lastFlushError == 0 || fl.lastFlush != 0 {
@@ -48,3 +56,61 @@ func TestFlusherHandleSendResultError(t *testing.T) {
 		})
 	}
 }
+
+// slowBackend takes delay to send each flush.
+type slowBackend struct {
+	namedCapturingBackend
+	delay time.Duration
+}
+
+func (sb *slowBackend) SendMetricsAsync(ctx context.Context, mm *gostatsd.MetricMap, cb gostatsd.SendCallback) {
+	go func() {
+		time.Sleep(sb.delay)
+		cb(nil)
+	}()
+}
+
+// singleAggregator is an AggregateProcesser for a single Aggregator.
+type singleAggregator struct {
+	aggr Aggregator
+}
+
+func (sa *singleAggregator) Process(ctx context.Context, fn DispatcherProcessFunc) gostatsd.Wait {
+	fn(0, sa.aggr)
+	return func() {}
+}
+
+func TestFlusherOverruns(t *testing.T) {
+	t.Parallel()
+	aggr := &singleAggregator{aggr: newFakeAggregator()}
+	ctx := context.Background()
+
+	fast := NewMetricFlusher(time.Second, 0, false, aggr, []gostatsd.Backend{&slowBackend{}}, nil)
+	fast.flushData(ctx, time.Second, stats.NewNullStatser())
+	assert.Zero(t, atomic.LoadUint64(&fast.overruns))
+
+	slow := NewMetricFlusher(10*time.Millisecond, 0, false, aggr, []gostatsd.Backend{&slowBackend{delay: 20 * time.Millisecond}}, nil)
+	slow.flushData(ctx, 10*time.Millisecond, stats.NewNullStatser())
+	slow.flushData(ctx, 10*time.Millisecond, stats.NewNullStatser())
+	assert.EqualValues(t, 2, atomic.LoadUint64(&slow.overruns))
+}
+
+func TestHostnameFlushOffset(t *testing.T) {
+	t.Parallel()
+	interval := 10 * time.Second
+	a := hostnameFlushOffset("host-a.example.com", interval)
+	b := hostnameFlushOffset("host-b.example.com", interval)
+	assert.NotEqual(t, a, b)
+	assert.Equal(t, a, hostnameFlushOffset("host-a.example.com", interval))
+	assert.Equal(t, b, hostnameFlushOffset("host-b.example.com", interval))
+	for _, offset := range []time.Duration{a, b} {
+		assert.GreaterOrEqual(t, offset, time.Duration(0))
+		assert.Less(t, offset, interval)
+	}
+	assert.Zero(t, hostnameFlushOffset("host-a.example.com", 0))
+
+	s := &Server{Hostname: "host-a.example.com", FlushOffset: time.Second}
+	assert.Equal(t, time.Second, s.flushOffset(interval))
+	s.FlushOffsetFromHostname = true
+	assert.Equal(t, a, s.flushOffset(interval))
+}
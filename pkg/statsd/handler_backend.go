@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ash2k/stager/wait"
@@ -31,7 +32,9 @@ func (f AggregatorFactoryFunc) Create() Aggregator {
 type BackendHandler struct {
 	eventWg          sync.WaitGroup
 	backends         []gostatsd.Backend
+	eventFilters     map[string]*BackendEventFilter // Keyed by backend name, may be nil
 	concurrentEvents chan struct{}
+	stateFile        string // The file the state of the Aggregators is saved to and restored from, if not empty
 
 	numWorkers int
 	workers    []*worker
@@ -60,14 +63,21 @@ func NewBackendHandler(backends []gostatsd.Backend, maxConcurrentEvents uint, nu
 	}
 }
 
-// Run runs the BackendHandler workers until the Context is closed.
+// Run runs the BackendHandler workers until the Context is closed.  If there is a state file, the state of the
+// Aggregators is restored from it before the workers start, and saved to it after they finish.
 func (bh *BackendHandler) Run(ctx context.Context) {
+	if bh.stateFile != "" {
+		bh.restoreState()
+	}
 	var wg wait.Group
 	defer func() {
 		for _, worker := range bh.workers {
 			close(worker.metricMapQueue) // Close channel to terminate worker
 		}
 		wg.Wait() // Wait for all workers to finish
+		if bh.stateFile != "" {
+			bh.saveState()
+		}
 	}()
 	for _, worker := range bh.workers {
 		wg.Start(worker.work)
@@ -121,6 +131,17 @@ func (bh *BackendHandler) EstimatedTags() int {
 	return 0
 }
 
+// QueueLength returns the number of MetricMaps queued for the busiest aggregator.
+func (bh *BackendHandler) QueueLength() int {
+	queueLength := 0
+	for _, w := range bh.workers {
+		if l := len(w.metricMapQueue); l > queueLength {
+			queueLength = l
+		}
+	}
+	return queueLength
+}
+
 // DispatchMetricMap splits a MetricMap in to per-aggregator buckets and distributes it.
 func (bh *BackendHandler) DispatchMetricMap(ctx context.Context, mm *gostatsd.MetricMap) {
 	maps := mm.Split(bh.numWorkers)
@@ -161,14 +182,38 @@ loop:
 	return wg.Wait
 }
 
+// percentileSetter is an Aggregator whose percentiles can be changed while it runs.
+type percentileSetter interface {
+	SetPercentiles(percentThresholds []float64, timerOverrides []*TimerOverride)
+}
+
+// SetPercentiles replaces the percentiles and timer overrides of every Aggregator, which are used from their next
+// flush.  They are set by the goroutines which own the Aggregators, between flushes, so no timer values are lost.  It
+// returns once every Aggregator has them, or an error if the context is done first.
+func (bh *BackendHandler) SetPercentiles(ctx context.Context, percentThresholds []float64, timerOverrides []*TimerOverride) error {
+	var set uint64
+	wait := bh.Process(ctx, func(workerId int, aggr Aggregator) {
+		if ps, ok := aggr.(percentileSetter); ok {
+			ps.SetPercentiles(percentThresholds, timerOverrides)
+		}
+		atomic.AddUint64(&set, 1)
+	})
+	wait()
+	if atomic.LoadUint64(&set) < uint64(bh.numWorkers) {
+		return ctx.Err()
+	}
+	return nil
+}
+
 func (bh *BackendHandler) DispatchEvent(ctx context.Context, e *gostatsd.Event) {
+	backends := bh.eventBackends(e)
 	eventsDispatched := 0
-	bh.eventWg.Add(len(bh.backends))
-	for _, backend := range bh.backends {
+	bh.eventWg.Add(len(backends))
+	for _, backend := range backends {
 		select {
 		case <-ctx.Done():
 			// Not all backends got the event, should decrement the wg counter
-			bh.eventWg.Add(eventsDispatched - len(bh.backends))
+			bh.eventWg.Add(eventsDispatched - len(backends))
 			return
 		case bh.concurrentEvents <- struct{}{}:
 			// Creates a new context for dispatching the event.
@@ -183,6 +228,20 @@ func (bh *BackendHandler) DispatchEvent(ctx context.Context, e *gostatsd.Event)
 	}
 }
 
+// eventBackends returns the backends which the event should be sent to, according to their event filters.
+func (bh *BackendHandler) eventBackends(e *gostatsd.Event) []gostatsd.Backend {
+	if len(bh.eventFilters) == 0 {
+		return bh.backends
+	}
+	backends := make([]gostatsd.Backend, 0, len(bh.backends))
+	for _, backend := range bh.backends {
+		if bef, ok := bh.eventFilters[backend.Name()]; !ok || bef.Keep(e) {
+			backends = append(backends, backend)
+		}
+	}
+	return backends
+}
+
 // WaitForEvents waits for all event-dispatching goroutines to finish.
 func (bh *BackendHandler) WaitForEvents() {
 	bh.eventWg.Wait()
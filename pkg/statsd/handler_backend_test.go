@@ -3,6 +3,7 @@ package statsd
 import (
 	"context"
 	"fmt"
+	"math"
 	"math/rand"
 	"sync"
 	"testing"
@@ -10,6 +11,7 @@ import (
 
 	"github.com/ash2k/stager/wait"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
 	"github.com/atlassian/gostatsd"
 	"github.com/atlassian/gostatsd/pkg/stats"
@@ -184,3 +186,77 @@ func TestBackendHandlerProcessTerminates(t *testing.T) {
 	waitFunc := h.Process(cancelledCtx, nil)
 	waitFunc()
 }
+
+func TestBackendHandlerSetPercentiles(t *testing.T) {
+	t.Parallel()
+	factory := &agrFactory{
+		percentThresholds:     []float64{90},
+		expiryIntervalCounter: time.Minute,
+		expiryIntervalGauge:   time.Minute,
+		expiryIntervalSet:     time.Minute,
+		expiryIntervalTimer:   time.Minute,
+		histogramLimit:        math.MaxUint32,
+	}
+	h := NewBackendHandler(nil, 0, 2, 0, factory)
+	var wgFinish wait.Group
+	defer wgFinish.Wait() // Deferred first, so it runs after the context is cancelled
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	wgFinish.StartWithContext(ctx, h.Run)
+
+	now := gostatsd.Nanotime(time.Now().UnixNano())
+	dispatch := func() {
+		mm := gostatsd.NewMetricMap()
+		for i := 1; i <= 10; i++ {
+			for _, name := range []string{"api.latency", "db.latency"} {
+				mm.Receive(&gostatsd.Metric{Name: name, Value: float64(i), Type: gostatsd.TIMER, Rate: 1, Timestamp: now})
+			}
+		}
+		h.DispatchMetricMap(ctx, mm)
+	}
+	flush := func() gostatsd.Timers {
+		var lock sync.Mutex
+		timers := gostatsd.Timers{}
+		h.Process(ctx, func(workerId int, aggr Aggregator) {
+			aggr.Flush(time.Second)
+			aggr.Process(func(mm *gostatsd.MetricMap) {
+				lock.Lock()
+				defer lock.Unlock()
+				mm.Timers.Each(func(metricName, tagsKey string, timer gostatsd.Timer) {
+					timers[metricName] = map[string]gostatsd.Timer{tagsKey: timer}
+				})
+			})
+			aggr.Reset()
+		})()
+		return timers
+	}
+	percentileNames := func(timer gostatsd.Timer) []string {
+		var names []string
+		for _, pct := range timer.Percentiles {
+			names = append(names, pct.Str)
+		}
+		return names
+	}
+
+	dispatch()
+	timers := flush()
+	assert.ElementsMatch(t, []string{"count_90", "mean_90", "sum_90", "sum_squares_90", "upper_90"}, percentileNames(timers["api.latency"][""]))
+
+	// Values received before the reload are flushed with the new percentiles
+	dispatch()
+	to, err := newPercentileOverride([]string{"50"})
+	require.NoError(t, err)
+	to.MatchMetrics = toStringMatch([]string{"db.*"})
+	require.NoError(t, h.SetPercentiles(ctx, []float64{99, -10}, []*TimerOverride{to}))
+	dispatch()
+	timers = flush()
+	api := timers["api.latency"][""]
+	assert.Equal(t, 20, api.Count)
+	assert.ElementsMatch(t, []string{
+		"count_99", "mean_99", "sum_99", "sum_squares_99", "upper_99",
+		"count_-10", "mean_-10", "sum_-10", "sum_squares_-10", "lower_-10",
+	}, percentileNames(api))
+	db := timers["db.latency"][""]
+	assert.Equal(t, 20, db.Count)
+	assert.ElementsMatch(t, []string{"count_50", "mean_50", "sum_50", "sum_squares_50", "upper_50"}, percentileNames(db))
+}
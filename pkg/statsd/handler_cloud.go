@@ -4,6 +4,7 @@ import (
 	"context"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/ash2k/stager/wait"
 
@@ -14,8 +15,12 @@ import (
 // CloudHandler enriches metrics and events with additional information fetched from cloud provider.
 type CloudHandler struct {
 	// These fields are accessed by any go routine, must use atomic ops
-	statsCacheHit  uint64 // Cumulative number of cache hits
-	statsCacheMiss uint64 // Cumulative number of cache misses
+	statsCacheHit          uint64 // Cumulative number of cache hits
+	statsCacheMiss         uint64 // Cumulative number of cache misses
+	statsLookupsDispatched uint64 // Cumulative number of IPs sent to the cached instances to be looked up
+
+	statsMetricsDropped uint64 // Cumulative number of metrics dropped from unresolved sources
+	statsEventsDropped  uint64 // Cumulative number of events dropped from unresolved sources
 
 	// All other stats fields may only be read or written by the main CloudHandler.Run goroutine
 	statsMetricHostsQueued uint64 // Absolute number of IPs waiting for a CP to respond for metrics
@@ -28,17 +33,36 @@ type CloudHandler struct {
 	incomingEvents  chan *gostatsd.Event
 
 	// emitChan triggers a write of all the current stats when it is given a Statser
-	emitChan        chan stats.Statser
-	awaitingEvents  map[gostatsd.Source][]*gostatsd.Event
-	awaitingMetrics map[gostatsd.Source]*gostatsd.MetricMap
-	toLookupIPs     []gostatsd.Source
-	wg              sync.WaitGroup
+	emitChan         chan stats.Statser
+	awaitingEvents   map[gostatsd.Source][]*gostatsd.Event
+	awaitingMetrics  map[gostatsd.Source]*gostatsd.MetricMap
+	toLookupIPs      []gostatsd.Source
+	toDispatchEvents []eventBatch // Resolved events waiting for a free event worker
+	wg               sync.WaitGroup
 
+	eventWorkers  int
 	estimatedTags int
+
+	// dropUnresolved drops metrics and events from sources which the cloud provider could not resolve to an instance,
+	// rather than passing them on unenriched.  Metrics and events awaiting a lookup are kept until it completes.
+	dropUnresolved bool
+	// drainTimeout is how long Run passes on the metrics and events still awaiting a lookup when it stops, without an
+	// instance, rather than discarding them.  0 discards them.
+	drainTimeout time.Duration
+}
+
+// eventBatch is the resolved events of a single source, with the instance to update them with.
+type eventBatch struct {
+	instance *gostatsd.Instance
+	events   []*gostatsd.Event
 }
 
-// NewCloudHandler initialises a new cloud handler.
-func NewCloudHandler(cachedInstances gostatsd.CachedInstances, handler gostatsd.PipelineHandler) *CloudHandler {
+// NewCloudHandler initialises a new cloud handler.  At most eventWorkers goroutines will be
+// dispatching resolved events at any point in time.
+func NewCloudHandler(cachedInstances gostatsd.CachedInstances, handler gostatsd.PipelineHandler, eventWorkers int) *CloudHandler {
+	if eventWorkers <= 0 {
+		eventWorkers = 1
+	}
 	return &CloudHandler{
 		cachedInstances: cachedInstances,
 		handler:         handler,
@@ -47,6 +71,7 @@ func NewCloudHandler(cachedInstances gostatsd.CachedInstances, handler gostatsd.
 		emitChan:        make(chan stats.Statser),
 		awaitingEvents:  make(map[gostatsd.Source][]*gostatsd.Event),
 		awaitingMetrics: make(map[gostatsd.Source]*gostatsd.MetricMap),
+		eventWorkers:    eventWorkers,
 		estimatedTags:   handler.EstimatedTags() + cachedInstances.EstimatedTags(),
 	}
 }
@@ -59,34 +84,46 @@ func (ch *CloudHandler) EstimatedTags() int {
 func (ch *CloudHandler) DispatchMetricMap(ctx context.Context, mm *gostatsd.MetricMap) {
 	mmToDispatch := gostatsd.NewMetricMap()
 	mmToHandle := gostatsd.NewMetricMap()
+	var dropped uint64
 	mm.Counters.Each(func(metricName string, tagsKey string, c gostatsd.Counter) {
-		if ch.updateTagsAndHostname(&c, c.Source) {
+		if cacheHit, resolved := ch.updateTagsAndHostname(&c, c.Source); !cacheHit {
+			mmToHandle.MergeCounter(metricName, tagsKey, c)
+		} else if resolved {
 			mmToDispatch.MergeCounter(metricName, gostatsd.FormatTagsKey(c.Source, c.Tags), c)
 		} else {
-			mmToHandle.MergeCounter(metricName, tagsKey, c)
+			dropped++
 		}
 	})
 	mm.Gauges.Each(func(metricName string, tagsKey string, g gostatsd.Gauge) {
-		if ch.updateTagsAndHostname(&g, g.Source) {
+		if cacheHit, resolved := ch.updateTagsAndHostname(&g, g.Source); !cacheHit {
+			mmToHandle.MergeGauge(metricName, tagsKey, g)
+		} else if resolved {
 			mmToDispatch.MergeGauge(metricName, gostatsd.FormatTagsKey(g.Source, g.Tags), g)
 		} else {
-			mmToHandle.MergeGauge(metricName, tagsKey, g)
+			dropped++
 		}
 	})
 	mm.Timers.Each(func(metricName string, tagsKey string, t gostatsd.Timer) {
-		if ch.updateTagsAndHostname(&t, t.Source) {
+		if cacheHit, resolved := ch.updateTagsAndHostname(&t, t.Source); !cacheHit {
+			mmToHandle.MergeTimer(metricName, tagsKey, t)
+		} else if resolved {
 			mmToDispatch.MergeTimer(metricName, gostatsd.FormatTagsKey(t.Source, t.Tags), t)
 		} else {
-			mmToHandle.MergeTimer(metricName, tagsKey, t)
+			dropped++
 		}
 	})
 	mm.Sets.Each(func(metricName string, tagsKey string, s gostatsd.Set) {
-		if ch.updateTagsAndHostname(&s, s.Source) {
+		if cacheHit, resolved := ch.updateTagsAndHostname(&s, s.Source); !cacheHit {
+			mmToHandle.MergeSet(metricName, tagsKey, s)
+		} else if resolved {
 			mmToDispatch.MergeSet(metricName, gostatsd.FormatTagsKey(s.Source, s.Tags), s)
 		} else {
-			mmToHandle.MergeSet(metricName, tagsKey, s)
+			dropped++
 		}
 	})
+	if dropped > 0 {
+		atomic.AddUint64(&ch.statsMetricsDropped, dropped)
+	}
 
 	if !mmToDispatch.IsEmpty() {
 		ch.handler.DispatchMetricMap(ctx, mmToDispatch)
@@ -101,8 +138,12 @@ func (ch *CloudHandler) DispatchMetricMap(ctx context.Context, mm *gostatsd.Metr
 }
 
 func (ch *CloudHandler) DispatchEvent(ctx context.Context, e *gostatsd.Event) {
-	if ch.updateTagsAndHostname(e, e.Source) {
-		ch.handler.DispatchEvent(ctx, e)
+	if cacheHit, resolved := ch.updateTagsAndHostname(e, e.Source); cacheHit {
+		if resolved {
+			ch.handler.DispatchEvent(ctx, e)
+		} else {
+			atomic.AddUint64(&ch.statsEventsDropped, 1)
+		}
 		return
 	}
 	ch.wg.Add(1) // Increment before sending to the channel
@@ -113,7 +154,7 @@ func (ch *CloudHandler) DispatchEvent(ctx context.Context, e *gostatsd.Event) {
 	}
 }
 
-// WaitForEvents waits for all event-dispatching goroutines to finish.
+// WaitForEvents waits for all events to be dispatched, including those queued for a free event worker.
 func (ch *CloudHandler) WaitForEvents() {
 	ch.wg.Wait()
 	ch.handler.WaitForEvents()
@@ -165,22 +206,48 @@ func (ch *CloudHandler) emit(statser stats.Statser) {
 	t = gostatsd.Tags{"type:event"}
 	statser.Gauge("cloudprovider.hosts_queued", float64(ch.statsEventHostsQueued), t)
 	statser.Gauge("cloudprovider.items_queued", float64(ch.statsEventItemsQueued), t)
+	statser.Gauge("cloudprovider.lookups_dispatched", float64(atomic.LoadUint64(&ch.statsLookupsDispatched)), nil)
+	statser.Gauge("cloudprovider.awaiting_sources", float64(len(ch.awaitingMetrics)), gostatsd.Tags{"type:metric"})
+	statser.Gauge("cloudprovider.awaiting_sources", float64(len(ch.awaitingEvents)), gostatsd.Tags{"type:event"})
+	if ch.dropUnresolved {
+		statser.Gauge("cloudprovider.unresolved_dropped", float64(atomic.LoadUint64(&ch.statsMetricsDropped)), gostatsd.Tags{"type:metric"})
+		statser.Gauge("cloudprovider.unresolved_dropped", float64(atomic.LoadUint64(&ch.statsEventsDropped)), gostatsd.Tags{"type:event"})
+	}
 }
 
 func (ch *CloudHandler) Run(ctx context.Context) {
+	var wg wait.Group
+	defer wg.Wait()
+	eventWorkC := make(chan eventBatch)
+	for i := 0; i < ch.eventWorkers; i++ {
+		wg.StartWithContext(ctx, func(ctx context.Context) {
+			ch.eventWorker(ctx, eventWorkC)
+		})
+	}
+
 	var (
-		toLookupC  chan<- gostatsd.Source
-		toLookupIP gostatsd.Source
+		toLookupC   chan<- gostatsd.Source
+		toLookupIP  gostatsd.Source
+		toDispatchC chan<- eventBatch
+		toDispatch  eventBatch
 	)
 	infoSource := ch.cachedInstances.InfoSource()
 	ipSink := ch.cachedInstances.IpSink()
 	for {
 		select {
 		case <-ctx.Done():
+			if toDispatchC != nil {
+				ch.toDispatchEvents = append([]eventBatch{toDispatch}, ch.toDispatchEvents...)
+			}
+			ch.drain()
 			return
 		case toLookupC <- toLookupIP:
+			atomic.AddUint64(&ch.statsLookupsDispatched, 1)
 			toLookupIP = gostatsd.UnknownSource // Enable GC
 			toLookupC = nil                     // ip has been sent; if there is nothing to send, will block
+		case toDispatchC <- toDispatch:
+			toDispatch = eventBatch{} // Enable GC
+			toDispatchC = nil         // batch has been handed to a worker; if there is nothing to send, will block
 		case info := <-infoSource:
 			ch.handleInstanceInfo(ctx, info)
 		case metrics := <-ch.incomingMetrics:
@@ -199,6 +266,51 @@ func (ch *CloudHandler) Run(ctx context.Context) {
 			ch.toLookupIPs = ch.toLookupIPs[:last]
 			toLookupC = ipSink
 		}
+		if toDispatchC == nil && len(ch.toDispatchEvents) > 0 {
+			toDispatch = ch.toDispatchEvents[0]
+			ch.toDispatchEvents[0] = eventBatch{} // Enable GC
+			ch.toDispatchEvents = ch.toDispatchEvents[1:]
+			toDispatchC = eventWorkC
+		}
+	}
+}
+
+// drain passes on everything still held when Run stops: the metrics and events awaiting a lookup, without an instance,
+// and the resolved events waiting for a free event worker, giving up after drainTimeout.  Without an instance, they are
+// dropped if dropUnresolved is set, as they would be if the lookup failed.
+func (ch *CloudHandler) drain() {
+	if ch.drainTimeout <= 0 || (len(ch.awaitingMetrics) == 0 && len(ch.awaitingEvents) == 0 && len(ch.toDispatchEvents) == 0) {
+		return
+	}
+	// Run's context is already done, so the next handler would discard everything dispatched with it
+	ctx, cancel := context.WithTimeout(context.Background(), ch.drainTimeout)
+	defer cancel()
+	for ip, mm := range ch.awaitingMetrics {
+		delete(ch.awaitingMetrics, ip)
+		ch.statsMetricHostsQueued--
+		ch.updateAndDispatchMetrics(ctx, nil, mm)
+	}
+	for _, batch := range ch.toDispatchEvents {
+		ch.updateAndDispatchEvents(ctx, batch.instance, batch.events)
+	}
+	ch.toDispatchEvents = nil
+	for ip, events := range ch.awaitingEvents {
+		delete(ch.awaitingEvents, ip)
+		ch.statsEventItemsQueued -= uint64(len(events))
+		ch.statsEventHostsQueued--
+		ch.updateAndDispatchEvents(ctx, nil, events)
+	}
+}
+
+// eventWorker dispatches the batches of resolved events it is given until ctx is done.
+func (ch *CloudHandler) eventWorker(ctx context.Context, batches <-chan eventBatch) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case batch := <-batches:
+			ch.updateAndDispatchEvents(ctx, batch.instance, batch.events)
+		}
 	}
 }
 
@@ -214,7 +326,8 @@ func (ch *CloudHandler) handleInstanceInfo(ctx context.Context, info gostatsd.In
 		delete(ch.awaitingEvents, info.IP)
 		ch.statsEventItemsQueued -= uint64(len(events))
 		ch.statsEventHostsQueued--
-		go ch.updateAndDispatchEvents(ctx, info.Instance, events)
+		// Events are handed to the bounded set of event workers by Run, rather than a goroutine each
+		ch.toDispatchEvents = append(ch.toDispatchEvents, eventBatch{instance: info.Instance, events: events})
 	}
 }
 
@@ -261,6 +374,10 @@ func (ch *CloudHandler) handleIncomingEvent(e *gostatsd.Event) {
 }
 
 func (ch *CloudHandler) updateAndDispatchMetrics(ctx context.Context, instance *gostatsd.Instance, mmIn *gostatsd.MetricMap) {
+	if ch.isDropped(instance) {
+		atomic.AddUint64(&ch.statsMetricsDropped, uint64(countSeries(mmIn)))
+		return
+	}
 	mmOut := gostatsd.NewMetricMap()
 	mmIn.Counters.Each(func(metricName string, tagsKey string, c gostatsd.Counter) {
 		updateInplace(&c, instance)
@@ -286,6 +403,11 @@ func (ch *CloudHandler) updateAndDispatchEvents(ctx context.Context, instance *g
 	defer func() {
 		ch.wg.Add(-dispatched)
 	}()
+	if ch.isDropped(instance) {
+		atomic.AddUint64(&ch.statsEventsDropped, uint64(len(events)))
+		dispatched = len(events)
+		return
+	}
 	for _, e := range events {
 		updateInplace(e, instance)
 		dispatched++
@@ -293,12 +415,24 @@ func (ch *CloudHandler) updateAndDispatchEvents(ctx context.Context, instance *g
 	}
 }
 
-func (ch *CloudHandler) updateTagsAndHostname(obj TagChanger, source gostatsd.Source) bool /*is a cache hit*/ {
+// updateTagsAndHostname updates obj with the cached instance of source, if there is one.  It returns whether source
+// was in the cache, and whether obj should be passed on, which is false if source is known to be unresolved, and they
+// are dropped.
+func (ch *CloudHandler) updateTagsAndHostname(obj TagChanger, source gostatsd.Source) (cacheHit, resolved bool) {
 	instance, cacheHit := ch.getInstance(source)
-	if cacheHit {
-		updateInplace(obj, instance)
+	if !cacheHit {
+		return false, false
 	}
-	return cacheHit
+	if source != gostatsd.UnknownSource && ch.isDropped(instance) {
+		return true, false
+	}
+	updateInplace(obj, instance)
+	return true, true
+}
+
+// isDropped returns whether metrics and events of a source which was looked up as instance are dropped.
+func (ch *CloudHandler) isDropped(instance *gostatsd.Instance) bool {
+	return ch.dropUnresolved && instance == nil
 }
 
 func (ch *CloudHandler) getInstance(ip gostatsd.Source) (*gostatsd.Instance, bool /*is a cache hit*/) {
@@ -314,6 +448,24 @@ func (ch *CloudHandler) getInstance(ip gostatsd.Source) (*gostatsd.Instance, boo
 	return instance, true
 }
 
+// countSeries returns the number of series of every type in mm.
+func countSeries(mm *gostatsd.MetricMap) int {
+	count := 0
+	for _, series := range mm.Counters {
+		count += len(series)
+	}
+	for _, series := range mm.Gauges {
+		count += len(series)
+	}
+	for _, series := range mm.Timers {
+		count += len(series)
+	}
+	for _, series := range mm.Sets {
+		count += len(series)
+	}
+	return count
+}
+
 func updateInplace(obj TagChanger, instance *gostatsd.Instance) {
 	if instance != nil { // It was a positive cache hit (successful lookup cache, not failed lookup cache)
 		obj.AddTagsSetSource(instance.Tags, instance.ID)
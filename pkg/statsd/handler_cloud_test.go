@@ -2,7 +2,10 @@ package statsd
 
 import (
 	"context"
+	"fmt"
 	"sort"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -17,6 +20,7 @@ import (
 	"github.com/atlassian/gostatsd/internal/fixtures"
 	"github.com/atlassian/gostatsd/pkg/cachedinstances/cloudprovider"
 	"github.com/atlassian/gostatsd/pkg/cloudproviders/fakeprovider"
+	"github.com/atlassian/gostatsd/pkg/stats"
 )
 
 // BenchmarkCloudHandlerDispatchMetricMap is a benchmark intended to (manually) test
@@ -30,7 +34,7 @@ func BenchmarkCloudHandlerDispatchMetricMap(b *testing.B) {
 		CacheTTL:                  500 * time.Millisecond,
 		CacheNegativeTTL:          500 * time.Millisecond,
 	})
-	ch := NewCloudHandler(ci, nh)
+	ch := NewCloudHandler(ci, nh, gostatsd.DefaultMaxConcurrentEvents)
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -68,7 +72,7 @@ func TestTransientInstanceFailure(t *testing.T) {
 		CacheTTL:                  1 * time.Millisecond,
 		CacheNegativeTTL:          1 * time.Millisecond,
 	})
-	ch := NewCloudHandler(ci, expecting)
+	ch := NewCloudHandler(ci, expecting, gostatsd.DefaultMaxConcurrentEvents)
 
 	// t+0: instance is queried, goes in cache
 	// t+50ms: instance refreshed (failure)
@@ -221,7 +225,7 @@ func doCheck(
 		CacheTTL:                  gostatsd.DefaultCacheTTL,
 		CacheNegativeTTL:          gostatsd.DefaultCacheNegativeTTL,
 	})
-	ch := NewCloudHandler(ci, expecting)
+	ch := NewCloudHandler(ci, expecting, gostatsd.DefaultMaxConcurrentEvents)
 
 	var wg wait.Group
 	defer wg.Wait()
@@ -307,3 +311,387 @@ type CountingProvider interface {
 	gostatsd.CloudProvider
 	Invocations() uint64
 }
+
+// TestCloudHandlerServerHostname checks that cloud enrichment takes precedence over the hostname used for internal
+// metrics and events, unless the hostname is omitted, as an unknown source is never looked up.
+// concurrencyTrackingHandler records the peak number of concurrent DispatchEvent calls,
+// each of which blocks until release is closed.
+type concurrencyTrackingHandler struct {
+	nopHandler
+	release    chan struct{}
+	inFlight   int64
+	peak       int64
+	dispatched int64
+}
+
+func (h *concurrencyTrackingHandler) DispatchEvent(ctx context.Context, e *gostatsd.Event) {
+	n := atomic.AddInt64(&h.inFlight, 1)
+	for {
+		peak := atomic.LoadInt64(&h.peak)
+		if n <= peak || atomic.CompareAndSwapInt64(&h.peak, peak, n) {
+			break
+		}
+	}
+	<-h.release
+	atomic.AddInt64(&h.inFlight, -1)
+	atomic.AddInt64(&h.dispatched, 1)
+}
+
+func TestCloudHandlerBoundsEventDispatch(t *testing.T) {
+	t.Parallel()
+	const (
+		workers = 2
+		events  = 20
+	)
+	th := &concurrencyTrackingHandler{release: make(chan struct{})}
+	ci := cloudprovider.NewCachedCloudProvider(logrus.StandardLogger(), rate.NewLimiter(100, 120), &fakeprovider.IP{}, gostatsd.CacheOptions{
+		CacheRefreshPeriod:        gostatsd.DefaultCacheRefreshPeriod,
+		CacheEvictAfterIdlePeriod: gostatsd.DefaultCacheEvictAfterIdlePeriod,
+		CacheTTL:                  gostatsd.DefaultCacheTTL,
+		CacheNegativeTTL:          gostatsd.DefaultCacheNegativeTTL,
+	})
+	ch := NewCloudHandler(ci, th, workers)
+
+	var wg wait.Group
+	defer wg.Wait()
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	wg.StartWithContext(ctx, ch.Run)
+	wg.StartWithContext(ctx, ci.Run)
+
+	// Every event has its own source, so each is resolved and dispatched separately
+	for i := 0; i < events; i++ {
+		ch.DispatchEvent(ctx, &gostatsd.Event{Title: "event", Source: gostatsd.Source(fmt.Sprintf("10.0.0.%d", i))})
+	}
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt64(&th.inFlight) == workers
+	}, 5*time.Second, time.Millisecond)
+
+	waited := make(chan struct{})
+	go func() {
+		ch.WaitForEvents()
+		close(waited)
+	}()
+	select {
+	case <-waited:
+		t.Fatal("WaitForEvents returned before the events were dispatched")
+	case <-time.After(50 * time.Millisecond):
+	}
+	assert.EqualValues(t, workers, atomic.LoadInt64(&th.peak))
+
+	close(th.release)
+	select {
+	case <-waited:
+	case <-time.After(5 * time.Second):
+		t.Fatal("WaitForEvents did not return")
+	}
+	assert.EqualValues(t, events, atomic.LoadInt64(&th.dispatched))
+	assert.EqualValues(t, workers, atomic.LoadInt64(&th.peak))
+}
+
+func TestCloudHandlerServerHostname(t *testing.T) {
+	t.Parallel()
+	osHostname := func() (string, error) { return "10.0.0.1", nil }
+	for fallback, expected := range map[string]gostatsd.Source{
+		gostatsd.HostnameFallbackOS:    "i-10.0.0.1",
+		gostatsd.HostnameFallbackFixed: "i-10.0.0.2",
+		gostatsd.HostnameFallbackOmit:  gostatsd.UnknownSource,
+	} {
+		hostname, err := resolveHostname("", fallback, "10.0.0.2", osHostname)
+		require.NoError(t, err)
+
+		fp := &fakeprovider.IP{}
+		expecting := &expectingHandler{}
+		ci := cloudprovider.NewCachedCloudProvider(logrus.StandardLogger(), rate.NewLimiter(100, 120), fp, gostatsd.CacheOptions{
+			CacheRefreshPeriod:        gostatsd.DefaultCacheRefreshPeriod,
+			CacheEvictAfterIdlePeriod: gostatsd.DefaultCacheEvictAfterIdlePeriod,
+			CacheTTL:                  gostatsd.DefaultCacheTTL,
+			CacheNegativeTTL:          gostatsd.DefaultCacheNegativeTTL,
+		})
+		ch := NewCloudHandler(ci, expecting, gostatsd.DefaultMaxConcurrentEvents)
+
+		var wg wait.Group
+		ctx, cancelFunc := context.WithCancel(context.Background())
+		wg.StartWithContext(ctx, ch.Run)
+		wg.StartWithContext(ctx, ci.Run)
+
+		expecting.Expect(1, 1)
+		mm := gostatsd.NewMetricMap()
+		mm.Receive(&gostatsd.Metric{Name: "internal", Value: 1, Rate: 1, Type: gostatsd.COUNTER, Source: hostname})
+		ch.DispatchMetricMap(ctx, mm)
+		ch.DispatchEvent(ctx, &gostatsd.Event{Title: "Gostatsd started", Source: hostname})
+		expecting.WaitAll()
+		cancelFunc()
+		wg.Wait()
+
+		metrics := gostatsd.MergeMaps(expecting.MetricMaps()).AsMetrics()
+		require.Len(t, metrics, 1)
+		assert.Equal(t, expected, metrics[0].Source, fallback)
+		require.Len(t, expecting.Events(), 1)
+		assert.Equal(t, expected, expecting.Events()[0].Source, fallback)
+	}
+}
+
+func TestCloudHandlerSourceIPStrategy(t *testing.T) {
+	t.Parallel()
+	datagram := []byte("tagged:1|c|#_host_ip:10.0.0.5,a:b\nuntagged:1|c|#a:b\n_e{1,1}:t|x|#_host_ip:10.0.0.6")
+	for sourceTag, expected := range map[string]struct {
+		sources map[string]gostatsd.Source
+		tags    gostatsd.Tags
+		maps    int // The cloud handler dispatches the metrics of each source separately
+	}{
+		"": { // peer
+			sources: map[string]gostatsd.Source{"tagged": "i-127.0.0.1", "untagged": "i-127.0.0.1", "event": "i-127.0.0.1"},
+			tags:    gostatsd.Tags{"_host_ip:10.0.0.5", "a:b"},
+			maps:    1,
+		},
+		"_host_ip": { // tag
+			sources: map[string]gostatsd.Source{"tagged": "i-10.0.0.5", "untagged": "i-127.0.0.1", "event": "i-10.0.0.6"},
+			tags:    gostatsd.Tags{"a:b"},
+			maps:    2,
+		},
+	} {
+		fp := &fakeprovider.IP{}
+		expecting := &expectingHandler{}
+		ci := cloudprovider.NewCachedCloudProvider(logrus.StandardLogger(), rate.NewLimiter(100, 120), fp, gostatsd.CacheOptions{
+			CacheRefreshPeriod:        gostatsd.DefaultCacheRefreshPeriod,
+			CacheEvictAfterIdlePeriod: gostatsd.DefaultCacheEvictAfterIdlePeriod,
+			CacheTTL:                  gostatsd.DefaultCacheTTL,
+			CacheNegativeTTL:          gostatsd.DefaultCacheNegativeTTL,
+		})
+		ch := NewCloudHandler(ci, expecting, gostatsd.DefaultMaxConcurrentEvents)
+		dp := NewDatagramParser(nil, "", false, 0, ch, rate.Limit(0), false, DatagramParserOptions{SourceTag: sourceTag}, logrus.New())
+
+		var wg wait.Group
+		ctx, cancelFunc := context.WithCancel(context.Background())
+		wg.StartWithContext(ctx, ch.Run)
+		wg.StartWithContext(ctx, ci.Run)
+
+		expecting.Expect(expected.maps, 1)
+		metrics, _, badLines := dp.handleDatagram(ctx, lex(), 0, fakeIP, append([]byte(nil), datagram...))
+		require.Zero(t, badLines)
+		mm := gostatsd.NewMetricMap()
+		for _, m := range metrics {
+			mm.Receive(m)
+		}
+		ch.DispatchMetricMap(ctx, mm)
+		expecting.WaitAll()
+		cancelFunc()
+		wg.Wait()
+
+		sources := map[string]gostatsd.Source{}
+		for _, m := range gostatsd.MergeMaps(expecting.MetricMaps()).AsMetrics() {
+			sources[m.Name] = m.Source
+			if m.Name == "tagged" {
+				assert.Equal(t, expected.tags, m.Tags[:len(expected.tags)], sourceTag) // Followed by the cloud tags
+			}
+		}
+		require.Len(t, expecting.Events(), 1)
+		sources["event"] = expecting.Events()[0].Source
+		assert.Equal(t, expected.sources, sources, sourceTag)
+	}
+}
+
+// partialProvider resolves only the sources in instances.
+type partialProvider struct {
+	instances map[gostatsd.Source]*gostatsd.Instance
+}
+
+func (pp *partialProvider) Name() string {
+	return "partial"
+}
+
+func (pp *partialProvider) EstimatedTags() int {
+	return 0
+}
+
+func (pp *partialProvider) MaxInstancesBatch() int {
+	return 16
+}
+
+func (pp *partialProvider) Instance(ctx context.Context, ips ...gostatsd.Source) (map[gostatsd.Source]*gostatsd.Instance, error) {
+	instances := make(map[gostatsd.Source]*gostatsd.Instance, len(ips))
+	for _, ip := range ips {
+		instances[ip] = pp.instances[ip]
+	}
+	return instances, nil
+}
+
+func TestCloudHandlerDropUnresolved(t *testing.T) {
+	t.Parallel()
+	pp := &partialProvider{instances: map[gostatsd.Source]*gostatsd.Instance{
+		"1.2.3.4": {ID: "i-1", Tags: gostatsd.Tags{"region:us-west-3"}},
+	}}
+	ci := cloudprovider.NewCachedCloudProvider(logrus.StandardLogger(), rate.NewLimiter(100, 120), pp, gostatsd.CacheOptions{
+		CacheRefreshPeriod:        gostatsd.DefaultCacheRefreshPeriod,
+		CacheEvictAfterIdlePeriod: gostatsd.DefaultCacheEvictAfterIdlePeriod,
+		CacheTTL:                  gostatsd.DefaultCacheTTL,
+		CacheNegativeTTL:          gostatsd.DefaultCacheNegativeTTL,
+	})
+	counting := &countingHandler{}
+	ch := NewCloudHandler(ci, counting, gostatsd.DefaultMaxConcurrentEvents)
+	ch.dropUnresolved = true
+
+	var wg wait.Group
+	defer wg.Wait()
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	wg.StartWithContext(ctx, ch.Run)
+	wg.StartWithContext(ctx, ci.Run)
+
+	dispatch := func() {
+		mm := gostatsd.NewMetricMap()
+		mm.Receive(&gostatsd.Metric{Name: "resolved", Value: 1, Rate: 1, Type: gostatsd.COUNTER, Source: "1.2.3.4"})
+		mm.Receive(&gostatsd.Metric{Name: "unresolved", Value: 1, Rate: 1, Type: gostatsd.COUNTER, Source: "9.9.9.9"})
+		mm.Receive(&gostatsd.Metric{Name: "unresolved", Value: 1, Rate: 1, Type: gostatsd.GAUGE, Source: "9.9.9.9"})
+		// Metrics without a source are never looked up, so are never dropped
+		mm.Receive(&gostatsd.Metric{Name: "internal", Value: 1, Rate: 1, Type: gostatsd.COUNTER})
+		ch.DispatchMetricMap(ctx, mm)
+		ch.DispatchEvent(ctx, &gostatsd.Event{Title: "resolved", Source: "1.2.3.4"})
+		ch.DispatchEvent(ctx, &gostatsd.Event{Title: "unresolved", Source: "9.9.9.9"})
+	}
+
+	metrics := func() []*gostatsd.Metric {
+		var ms []*gostatsd.Metric
+		for _, mm := range counting.MetricMaps() {
+			ms = append(ms, mm.AsMetrics()...)
+		}
+		return ms
+	}
+
+	// The first metrics and events wait for the lookup, the second are resolved from the cache
+	for i := 1; i <= 2; i++ {
+		dispatch()
+		require.Eventually(t, func() bool {
+			return len(metrics()) == 2*i && len(counting.Events()) == i &&
+				atomic.LoadUint64(&ch.statsMetricsDropped) == uint64(2*i) && atomic.LoadUint64(&ch.statsEventsDropped) == uint64(i)
+		}, 5*time.Second, time.Millisecond)
+	}
+	for _, m := range metrics() {
+		assert.NotEqual(t, "unresolved", m.Name)
+		if m.Name == "resolved" {
+			assert.EqualValues(t, "i-1", m.Source)
+		}
+	}
+	for _, e := range counting.Events() {
+		assert.Equal(t, "resolved", e.Title)
+	}
+	cancelFunc()
+	wg.Wait()
+	ch.WaitForEvents()
+}
+
+// pendingCachedInstances never has an instance cached, and never completes a lookup.
+type pendingCachedInstances struct {
+	ipSink chan gostatsd.Source
+}
+
+func (pci *pendingCachedInstances) Peek(ip gostatsd.Source) (*gostatsd.Instance, bool) {
+	return nil, false
+}
+
+func (pci *pendingCachedInstances) IpSink() chan<- gostatsd.Source {
+	return pci.ipSink
+}
+
+func (pci *pendingCachedInstances) InfoSource() <-chan gostatsd.InstanceInfo {
+	return nil
+}
+
+func (pci *pendingCachedInstances) EstimatedTags() int {
+	return 0
+}
+
+// gaugeMapStatser records the last value of each gauge, keyed by name and tags.
+type gaugeMapStatser struct {
+	stats.NullStatser
+	mu     sync.Mutex
+	gauges map[string]float64
+}
+
+func (gms *gaugeMapStatser) Gauge(name string, value float64, tags gostatsd.Tags) {
+	gms.mu.Lock()
+	defer gms.mu.Unlock()
+	gms.gauges[name+tags.String()] = value
+}
+
+func TestCloudHandlerEmitsLookupStats(t *testing.T) {
+	t.Parallel()
+	pci := &pendingCachedInstances{ipSink: make(chan gostatsd.Source, 10)}
+	ch := NewCloudHandler(pci, &nopHandler{}, gostatsd.DefaultMaxConcurrentEvents)
+
+	var wg wait.Group
+	defer wg.Wait()
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	wg.StartWithContext(ctx, ch.Run)
+
+	mm := gostatsd.NewMetricMap()
+	mm.Receive(&gostatsd.Metric{Name: "c", Value: 1, Rate: 1, Type: gostatsd.COUNTER, Source: "1.1.1.1"})
+	mm.Receive(&gostatsd.Metric{Name: "c", Value: 1, Rate: 1, Type: gostatsd.COUNTER, Source: "2.2.2.2"})
+	mm.Receive(&gostatsd.Metric{Name: "g", Value: 1, Rate: 1, Type: gostatsd.GAUGE, Source: "2.2.2.2"})
+	ch.DispatchMetricMap(ctx, mm)
+	ch.DispatchEvent(ctx, &gostatsd.Event{Title: "e", Source: "3.3.3.3"})
+	require.Eventually(t, func() bool {
+		return len(pci.ipSink) == 3
+	}, 5*time.Second, time.Millisecond)
+
+	statser := &gaugeMapStatser{gauges: map[string]float64{}}
+	ch.emitChan <- statser
+	// Run only takes the next Statser once it has finished emitting the last
+	ch.emitChan <- stats.NewNullStatser()
+	statser.mu.Lock()
+	defer statser.mu.Unlock()
+	assert.EqualValues(t, 3, statser.gauges["cloudprovider.lookups_dispatched"])
+	assert.EqualValues(t, 2, statser.gauges["cloudprovider.awaiting_sources"+gostatsd.Tags{"type:metric"}.String()])
+	assert.EqualValues(t, 1, statser.gauges["cloudprovider.awaiting_sources"+gostatsd.Tags{"type:event"}.String()])
+	assert.EqualValues(t, 4, statser.gauges["cloudprovider.cache_miss"])
+	assert.Zero(t, statser.gauges["cloudprovider.cache_hit"])
+}
+
+func TestCloudHandlerDrainsOnShutdown(t *testing.T) {
+	t.Parallel()
+	for _, drainTimeout := range []time.Duration{0, time.Second} {
+		pci := &pendingCachedInstances{ipSink: make(chan gostatsd.Source, 10)}
+		capturing := &capturingHandler{}
+		ch := NewCloudHandler(pci, capturing, gostatsd.DefaultMaxConcurrentEvents)
+		ch.drainTimeout = drainTimeout
+
+		var wg wait.Group
+		ctx, cancelFunc := context.WithCancel(context.Background())
+		wg.StartWithContext(ctx, ch.Run)
+
+		mm := gostatsd.NewMetricMap()
+		mm.Receive(&gostatsd.Metric{Name: "c", Value: 1, Rate: 1, Type: gostatsd.COUNTER, Source: "1.1.1.1"})
+		mm.Receive(&gostatsd.Metric{Name: "g", Value: 1, Rate: 1, Type: gostatsd.GAUGE, Source: "2.2.2.2"})
+		ch.DispatchMetricMap(ctx, mm)
+		ch.DispatchEvent(ctx, &gostatsd.Event{Title: "e", Source: "3.3.3.3"})
+		require.Eventually(t, func() bool {
+			return len(pci.ipSink) == 3
+		}, 5*time.Second, time.Millisecond)
+		cancelFunc()
+		wg.Wait()
+
+		if drainTimeout == 0 {
+			assert.Empty(t, capturing.mm)
+			assert.Empty(t, capturing.e)
+			continue
+		}
+		// Everything awaiting a lookup is passed on, unenriched, and the events are no longer waited for
+		ch.WaitForEvents()
+		drained := gostatsd.NewMetricMap()
+		for _, mm := range capturing.mm {
+			drained.Merge(mm)
+		}
+		assert.EqualValues(t, 2, countSeries(drained))
+		assert.Contains(t, drained.Counters["c"], gostatsd.FormatTagsKey("1.1.1.1", nil))
+		assert.Contains(t, drained.Gauges["g"], gostatsd.FormatTagsKey("2.2.2.2", nil))
+		require.Len(t, capturing.e, 1)
+		assert.Equal(t, "e", capturing.e[0].Title)
+		assert.Empty(t, ch.awaitingMetrics)
+		assert.Empty(t, ch.awaitingEvents)
+		assert.Zero(t, ch.statsMetricHostsQueued)
+		assert.Zero(t, ch.statsEventHostsQueued)
+		assert.Zero(t, ch.statsEventItemsQueued)
+	}
+}
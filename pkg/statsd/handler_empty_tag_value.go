@@ -0,0 +1,78 @@
+package statsd
+
+import (
+	"context"
+
+	"github.com/atlassian/gostatsd"
+)
+
+// EmptyTagValueHandler applies the empty tag value policy to the tags of metrics and events, dropping the tags with an
+// empty value, such as `env:`, or converting them to a tag of just the key, and merging the series which become the
+// same.  It's after the tag handler in the pipeline, so default tags with an empty value are handled too.
+type EmptyTagValueHandler struct {
+	handler gostatsd.PipelineHandler
+	policy  string // One of the EmptyTagValuePolicy* values
+}
+
+// NewEmptyTagValueHandler initialises a new handler which applies policy to the tags of metrics and events, before
+// passing them to the next handler.
+func NewEmptyTagValueHandler(handler gostatsd.PipelineHandler, policy string) *EmptyTagValueHandler {
+	return &EmptyTagValueHandler{
+		handler: handler,
+		policy:  policy,
+	}
+}
+
+// EstimatedTags returns a guess for how many tags to pre-allocate
+func (eth *EmptyTagValueHandler) EstimatedTags() int {
+	return eth.handler.EstimatedTags()
+}
+
+// DispatchMetricMap applies the policy to the tags of each metric in the map, merging the series which become the
+// same, and passes it to the next stage in the pipeline.
+func (eth *EmptyTagValueHandler) DispatchMetricMap(ctx context.Context, mm *gostatsd.MetricMap) {
+	mmNew := gostatsd.NewMetricMap()
+
+	mm.Counters.Each(func(metricName, tagsKey string, c gostatsd.Counter) {
+		tagsKey, c.Tags = eth.series(tagsKey, c.Source, c.Tags)
+		mmNew.MergeCounter(metricName, tagsKey, c)
+	})
+	mm.Gauges.Each(func(metricName, tagsKey string, g gostatsd.Gauge) {
+		tagsKey, g.Tags = eth.series(tagsKey, g.Source, g.Tags)
+		mmNew.MergeGauge(metricName, tagsKey, g)
+	})
+	mm.Timers.Each(func(metricName, tagsKey string, t gostatsd.Timer) {
+		tagsKey, t.Tags = eth.series(tagsKey, t.Source, t.Tags)
+		mmNew.MergeTimer(metricName, tagsKey, t)
+	})
+	mm.Sets.Each(func(metricName, tagsKey string, s gostatsd.Set) {
+		tagsKey, s.Tags = eth.series(tagsKey, s.Source, s.Tags)
+		mmNew.MergeSet(metricName, tagsKey, s)
+	})
+
+	if !mmNew.IsEmpty() {
+		eth.handler.DispatchMetricMap(ctx, mmNew)
+	}
+}
+
+// series returns the tags key and tags to send a series with.
+func (eth *EmptyTagValueHandler) series(tagsKey string, source gostatsd.Source, tags gostatsd.Tags) (string, gostatsd.Tags) {
+	tags, changed := applyEmptyTagValuePolicy(eth.policy, tags)
+	if !changed {
+		return tagsKey, tags
+	}
+	return gostatsd.FormatTagsKey(source, tags), tags
+}
+
+// DispatchEvent applies the policy to the tags of the event and passes it to the next stage in the pipeline.
+func (eth *EmptyTagValueHandler) DispatchEvent(ctx context.Context, e *gostatsd.Event) {
+	if tags, changed := applyEmptyTagValuePolicy(eth.policy, e.Tags); changed {
+		e.Tags = tags
+	}
+	eth.handler.DispatchEvent(ctx, e)
+}
+
+// WaitForEvents waits for all event-dispatching goroutines to finish.
+func (eth *EmptyTagValueHandler) WaitForEvents() {
+	eth.handler.WaitForEvents()
+}
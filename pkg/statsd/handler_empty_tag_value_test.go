@@ -0,0 +1,77 @@
+package statsd
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/atlassian/gostatsd"
+)
+
+func TestEmptyTagValueHandler(t *testing.T) {
+	t.Parallel()
+	for policy, expected := range map[string]map[string]gostatsd.Tags{
+		// Each form is a series of its own
+		gostatsd.EmptyTagValuePolicyKeep: {
+			"":            nil,
+			"env":         {"env"},
+			"env:,host:a": {"env:", "host:a"},
+			"env:":        {"env:"},
+		},
+		// A tag with an empty value is the same series as no tag
+		gostatsd.EmptyTagValuePolicyDrop: {
+			"":       nil,
+			"env":    {"env"},
+			"host:a": {"host:a"},
+		},
+		// A tag with an empty value is the same series as a tag of just the key
+		gostatsd.EmptyTagValuePolicyKeyOnly: {
+			"":           nil,
+			"env":        {"env"},
+			"env,host:a": {"env", "host:a"},
+		},
+	} {
+		tch := &capturingHandler{}
+		eth := NewEmptyTagValueHandler(tch, policy)
+		mm := gostatsd.NewMetricMap()
+		for _, tags := range []gostatsd.Tags{nil, {"env"}, {"env:"}, {"env:", "host:a"}} {
+			mm.Receive(&gostatsd.Metric{Type: gostatsd.COUNTER, Name: "c", Value: 1, Rate: 1, Tags: tags})
+		}
+		eth.DispatchMetricMap(context.Background(), mm)
+		require.Len(t, tch.mm, 1, policy)
+		counters := tch.mm[0].Counters["c"]
+		require.Len(t, counters, len(expected), policy)
+		for tagsKey, tags := range expected {
+			require.Contains(t, counters, tagsKey, policy)
+			assert.ElementsMatch(t, tags, counters[tagsKey].Tags, "%s %s", policy, tagsKey)
+		}
+		// Every value is counted in one of the series
+		var total int64
+		for _, c := range counters {
+			total += c.Value
+		}
+		assert.EqualValues(t, 4, total, policy)
+
+		eth.DispatchEvent(context.Background(), &gostatsd.Event{Title: "e", Tags: gostatsd.Tags{"env:", "host:a"}})
+		require.Len(t, tch.e, 1, policy)
+		assert.ElementsMatch(t, expected[gostatsd.FormatTagsKey("", tch.e[0].Tags)], tch.e[0].Tags, policy)
+	}
+}
+
+func TestEmptyTagValueHandlerDefaultTags(t *testing.T) {
+	t.Parallel()
+	tch := &capturingHandler{}
+	// The tag handler adds the default tags before the policy is applied
+	th := NewTagHandler(NewEmptyTagValueHandler(tch, gostatsd.EmptyTagValuePolicyKeyOnly), gostatsd.Tags{"team:", "env:prod"}, nil)
+	mm := gostatsd.NewMetricMap()
+	mm.Receive(&gostatsd.Metric{Type: gostatsd.GAUGE, Name: "g", Value: 1, Tags: gostatsd.Tags{"host:"}})
+	th.DispatchMetricMap(context.Background(), mm)
+	require.Len(t, tch.mm, 1)
+	require.Len(t, tch.mm[0].Gauges["g"], 1)
+	for tagsKey, g := range tch.mm[0].Gauges["g"] {
+		assert.ElementsMatch(t, gostatsd.Tags{"host", "team", "env:prod"}, g.Tags)
+		assert.Equal(t, gostatsd.FormatTagsKey(g.Source, g.Tags), tagsKey)
+	}
+}
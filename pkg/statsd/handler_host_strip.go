@@ -0,0 +1,139 @@
+package statsd
+
+import (
+	"context"
+	"strings"
+
+	"github.com/atlassian/gostatsd"
+)
+
+// HostStripHandler removes the source and any host identifying tags from metrics, so the same metric from every host
+// is aggregated in to a single series.  The per-source metrics are also passed on unchanged, so they are aggregated
+// both in to a single series and per source.
+type HostStripHandler struct {
+	handler   gostatsd.PipelineHandler
+	keys      map[string]struct{}      // Keys of the tags to remove
+	perSource gostatsd.StringMatchList // Names of the metrics which are also kept per source
+}
+
+// NewHostStripHandler initialises a new handler which removes the source, and tags with any of the keys, from metrics
+// before passing them to the next handler.  Metrics whose name matches perSourceMetrics are passed on both with and
+// without their host.
+func NewHostStripHandler(handler gostatsd.PipelineHandler, keys []string, perSourceMetrics []string) *HostStripHandler {
+	keySet := make(map[string]struct{}, len(keys))
+	for _, key := range keys {
+		keySet[key] = present
+	}
+	return &HostStripHandler{
+		handler:   handler,
+		keys:      keySet,
+		perSource: toStringMatch(perSourceMetrics),
+	}
+}
+
+// EstimatedTags returns a guess for how many tags to pre-allocate
+func (hsh *HostStripHandler) EstimatedTags() int {
+	return hsh.handler.EstimatedTags()
+}
+
+// DispatchMetricMap strips the host from each metric in the map, merging the metrics which are now the same series,
+// and passes it to the next stage in the pipeline.
+func (hsh *HostStripHandler) DispatchMetricMap(ctx context.Context, mm *gostatsd.MetricMap) {
+	mmNew := gostatsd.NewMetricMap()
+
+	mm.Counters.Each(func(metricName, _ string, c gostatsd.Counter) {
+		stripped := c
+		stripped.Source, stripped.Tags = "", hsh.stripTags(c.Tags)
+		tagsKey := gostatsd.FormatTagsKey(stripped.Source, stripped.Tags)
+		mmNew.MergeCounter(metricName, tagsKey, stripped)
+		if sourceTagsKey, ok := hsh.perSourceTagsKey(metricName, tagsKey, c.Source, c.Tags); ok {
+			mmNew.MergeCounter(metricName, sourceTagsKey, c)
+		}
+	})
+	mm.Gauges.Each(func(metricName, _ string, g gostatsd.Gauge) {
+		stripped := g
+		stripped.Source, stripped.Tags = "", hsh.stripTags(g.Tags)
+		tagsKey := gostatsd.FormatTagsKey(stripped.Source, stripped.Tags)
+		mmNew.MergeGauge(metricName, tagsKey, stripped)
+		if sourceTagsKey, ok := hsh.perSourceTagsKey(metricName, tagsKey, g.Source, g.Tags); ok {
+			mmNew.MergeGauge(metricName, sourceTagsKey, g)
+		}
+	})
+	mm.Timers.Each(func(metricName, _ string, t gostatsd.Timer) {
+		stripped := t
+		stripped.Source, stripped.Tags = "", hsh.stripTags(t.Tags)
+		tagsKey := gostatsd.FormatTagsKey(stripped.Source, stripped.Tags)
+		mmNew.MergeTimer(metricName, tagsKey, stripped)
+		if sourceTagsKey, ok := hsh.perSourceTagsKey(metricName, tagsKey, t.Source, t.Tags); ok {
+			// The values are appended to when the series are merged, so each series needs its own
+			t.Values = append([]float64(nil), t.Values...)
+			mmNew.MergeTimer(metricName, sourceTagsKey, t)
+		}
+	})
+	mm.Sets.Each(func(metricName, _ string, s gostatsd.Set) {
+		stripped := s
+		stripped.Source, stripped.Tags = "", hsh.stripTags(s.Tags)
+		tagsKey := gostatsd.FormatTagsKey(stripped.Source, stripped.Tags)
+		mmNew.MergeSet(metricName, tagsKey, stripped)
+		if sourceTagsKey, ok := hsh.perSourceTagsKey(metricName, tagsKey, s.Source, s.Tags); ok {
+			// The values are added to when the series are merged, so each series needs its own
+			values := make(map[string]struct{}, len(s.Values))
+			for value := range s.Values {
+				values[value] = present
+			}
+			s.Values = values
+			mmNew.MergeSet(metricName, sourceTagsKey, s)
+		}
+	})
+
+	if !mmNew.IsEmpty() {
+		hsh.handler.DispatchMetricMap(ctx, mmNew)
+	}
+}
+
+// perSourceTagsKey returns the tags key of a metric before its host was stripped, if it is one of the per-source
+// metrics, and it had a host to strip, so it isn't counted twice in the same series.
+func (hsh *HostStripHandler) perSourceTagsKey(metricName, strippedTagsKey string, source gostatsd.Source, tags gostatsd.Tags) (string, bool) {
+	if len(hsh.perSource) == 0 || !hsh.perSource.MatchAny(metricName) {
+		return "", false
+	}
+	tagsKey := gostatsd.FormatTagsKey(source, tags)
+	return tagsKey, tagsKey != strippedTagsKey
+}
+
+// stripTags returns the tags without any whose key is one of the host identifying keys.  A tag without a value is
+// treated as its own key.  The tags are copied only if any are removed.
+func (hsh *HostStripHandler) stripTags(tags gostatsd.Tags) gostatsd.Tags {
+	for idx, tag := range tags {
+		if hsh.isHostTag(tag) {
+			stripped := make(gostatsd.Tags, idx, len(tags)-1)
+			copy(stripped, tags[:idx])
+			for _, tag := range tags[idx+1:] {
+				if !hsh.isHostTag(tag) {
+					stripped = append(stripped, tag)
+				}
+			}
+			return stripped
+		}
+	}
+	return tags
+}
+
+func (hsh *HostStripHandler) isHostTag(tag string) bool {
+	key := tag
+	if idx := strings.IndexByte(tag, ':'); idx >= 0 {
+		key = tag[:idx]
+	}
+	_, ok := hsh.keys[key]
+	return ok
+}
+
+// DispatchEvent passes the event to the next stage in the pipeline unchanged, as events are not aggregated.
+func (hsh *HostStripHandler) DispatchEvent(ctx context.Context, e *gostatsd.Event) {
+	hsh.handler.DispatchEvent(ctx, e)
+}
+
+// WaitForEvents waits for all event-dispatching goroutines to finish.
+func (hsh *HostStripHandler) WaitForEvents() {
+	hsh.handler.WaitForEvents()
+}
@@ -0,0 +1,152 @@
+package statsd
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/atlassian/gostatsd"
+)
+
+// hostMetrics returns the same metrics as if sent by each of the hosts.
+func hostMetrics(hosts ...string) *gostatsd.MetricMap {
+	mm := gostatsd.NewMetricMap()
+	for i, host := range hosts {
+		source := gostatsd.Source("10.0.0." + host)
+		tags := gostatsd.Tags{"service:web", "host:" + host, "instance:i-" + host}
+		ts := gostatsd.Nanotime(10 + i)
+		mm.Receive(&gostatsd.Metric{Type: gostatsd.COUNTER, Name: "c", Value: 1, Rate: 1, Tags: tags, Source: source, Timestamp: ts})
+		mm.Receive(&gostatsd.Metric{Type: gostatsd.GAUGE, Name: "g", Value: float64(i), Tags: tags, Source: source, Timestamp: ts})
+		mm.Receive(&gostatsd.Metric{Type: gostatsd.TIMER, Name: "t", Value: float64(i), Rate: 1, Tags: tags, Source: source, Timestamp: ts})
+		mm.Receive(&gostatsd.Metric{Type: gostatsd.SET, Name: "s", StringValue: host, Tags: tags, Source: source, Timestamp: ts})
+	}
+	return mm
+}
+
+func TestHostStripCollapsesHosts(t *testing.T) {
+	t.Parallel()
+	tch := &capturingHandler{}
+	hsh := NewHostStripHandler(tch, []string{"host", "instance"}, nil)
+
+	hsh.DispatchMetricMap(context.Background(), hostMetrics("1", "2", "3"))
+
+	require.Len(t, tch.mm, 1)
+	mm := tch.mm[0]
+	expectedTags := gostatsd.Tags{"service:web"}
+
+	require.Len(t, mm.Counters["c"], 1)
+	c := mm.Counters["c"]["service:web"]
+	assert.EqualValues(t, 3, c.Value)
+	assert.Equal(t, expectedTags, c.Tags)
+	assert.Empty(t, c.Source)
+	assert.EqualValues(t, 12, c.Timestamp)
+
+	require.Len(t, mm.Gauges["g"], 1)
+	g := mm.Gauges["g"]["service:web"]
+	assert.EqualValues(t, 2, g.Value) // From the latest host
+	assert.Equal(t, expectedTags, g.Tags)
+
+	require.Len(t, mm.Timers["t"], 1)
+	tm := mm.Timers["t"]["service:web"]
+	assert.ElementsMatch(t, []float64{0, 1, 2}, tm.Values)
+	assert.EqualValues(t, 3, tm.SampledCount)
+	assert.Equal(t, expectedTags, tm.Tags)
+
+	require.Len(t, mm.Sets["s"], 1)
+	s := mm.Sets["s"]["service:web"]
+	assert.Equal(t, map[string]struct{}{"1": {}, "2": {}, "3": {}}, s.Values)
+	assert.Equal(t, expectedTags, s.Tags)
+}
+
+func TestHostStripAggregatesAcrossHosts(t *testing.T) {
+	t.Parallel()
+	tch := &capturingHandler{}
+	hsh := NewHostStripHandler(tch, []string{"host", "instance"}, nil)
+	ma := NewMetricAggregator(nil, 0, 0, 0, 0, gostatsd.TimerSubtypes{}, math.MaxUint32)
+
+	// Each host's metrics arrive separately, as if from different parsers
+	for _, host := range []string{"1", "2", "3", "4"} {
+		hsh.DispatchMetricMap(context.Background(), hostMetrics(host))
+	}
+	require.Len(t, tch.mm, 4)
+	for _, mm := range tch.mm {
+		ma.ReceiveMap(mm)
+	}
+	ma.Flush(time.Second)
+
+	require.Len(t, ma.metricMap.Counters["c"], 1)
+	assert.EqualValues(t, 4, ma.metricMap.Counters["c"]["service:web"].Value)
+	require.Len(t, ma.metricMap.Timers["t"], 1)
+	assert.EqualValues(t, 4, ma.metricMap.Timers["t"]["service:web"].Count)
+	require.Len(t, ma.metricMap.Sets["s"], 1)
+	assert.Len(t, ma.metricMap.Sets["s"]["service:web"].Values, 4)
+	require.Len(t, ma.metricMap.Gauges["g"], 1)
+}
+
+func TestHostStripPerSourceMetrics(t *testing.T) {
+	t.Parallel()
+	tch := &capturingHandler{}
+	hsh := NewHostStripHandler(tch, []string{"host", "instance"}, []string{"c", "t*"})
+	ma := NewMetricAggregator(nil, 0, 0, 0, 0, gostatsd.TimerSubtypes{}, math.MaxUint32)
+
+	for _, host := range []string{"1", "2", "3"} {
+		hsh.DispatchMetricMap(context.Background(), hostMetrics(host))
+	}
+	// Without a host, the metric is already a single series, so isn't counted twice
+	mm := gostatsd.NewMetricMap()
+	mm.Receive(&gostatsd.Metric{Type: gostatsd.COUNTER, Name: "c", Value: 1, Rate: 1, Tags: gostatsd.Tags{"service:batch"}})
+	hsh.DispatchMetricMap(context.Background(), mm)
+	for _, mm := range tch.mm {
+		ma.ReceiveMap(mm)
+	}
+	ma.Flush(time.Second)
+
+	// The listed metrics have a series for every source, as well as the one across sources
+	require.Len(t, ma.metricMap.Counters["c"], 5)
+	assert.EqualValues(t, 3, ma.metricMap.Counters["c"]["service:web"].Value)
+	assert.EqualValues(t, 1, ma.metricMap.Counters["c"]["service:batch"].Value)
+	require.Len(t, ma.metricMap.Timers["t"], 4)
+	assert.EqualValues(t, 3, ma.metricMap.Timers["t"]["service:web"].Count)
+	for _, host := range []string{"1", "2", "3"} {
+		tagsKey := gostatsd.FormatTagsKey(gostatsd.Source("10.0.0."+host), gostatsd.Tags{"service:web", "host:" + host, "instance:i-" + host})
+		c := ma.metricMap.Counters["c"][tagsKey]
+		assert.EqualValues(t, 1, c.Value, host)
+		assert.EqualValues(t, "10.0.0."+host, c.Source, host)
+		assert.Contains(t, c.Tags, "host:"+host)
+		assert.EqualValues(t, 1, ma.metricMap.Timers["t"][tagsKey].Count, host)
+	}
+
+	// The rest are only aggregated across sources
+	require.Len(t, ma.metricMap.Gauges["g"], 1)
+	require.Len(t, ma.metricMap.Sets["s"], 1)
+	assert.Len(t, ma.metricMap.Sets["s"]["service:web"].Values, 3)
+}
+
+func TestHostStripTags(t *testing.T) {
+	t.Parallel()
+	hsh := NewHostStripHandler(&nopHandler{}, []string{"host", "pod"}, nil)
+	input := map[string]struct {
+		tags     gostatsd.Tags
+		expected gostatsd.Tags
+	}{
+		"none":     {gostatsd.Tags{"a:b", "c"}, gostatsd.Tags{"a:b", "c"}},
+		"first":    {gostatsd.Tags{"host:x", "a:b"}, gostatsd.Tags{"a:b"}},
+		"several":  {gostatsd.Tags{"a:b", "host:x", "c", "pod:y"}, gostatsd.Tags{"a:b", "c"}},
+		"no value": {gostatsd.Tags{"host", "a:b"}, gostatsd.Tags{"a:b"}},
+		"prefix":   {gostatsd.Tags{"hostname:x", "podname"}, gostatsd.Tags{"hostname:x", "podname"}},
+		"only":     {gostatsd.Tags{"host:x"}, gostatsd.Tags{}},
+	}
+	for name, inp := range input {
+		inp := inp
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			original := append(gostatsd.Tags(nil), inp.tags...)
+			assert.Equal(t, inp.expected, hsh.stripTags(inp.tags))
+			assert.Equal(t, original, inp.tags) // Not modified in place
+		})
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"io"
 	"io/ioutil"
 	"net/http"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -24,6 +25,7 @@ import (
 	"github.com/atlassian/gostatsd/internal/util"
 	"github.com/atlassian/gostatsd/pb"
 	"github.com/atlassian/gostatsd/pkg/stats"
+	"github.com/atlassian/gostatsd/pkg/tdigest"
 	"github.com/atlassian/gostatsd/pkg/transport"
 )
 
@@ -34,8 +36,13 @@ const (
 	defaultMaxRequestElapsedTime     = 30 * time.Second
 	defaultMaxRequests               = 1000
 	defaultTransport                 = "default"
+	defaultTimerDigestCompression    = 0
 )
 
+// defaultFatalStatusCodes also has the status codes another gostatsd rejects a request with the wrong method or
+// content type with.
+var defaultFatalStatusCodes = append([]int{http.StatusMethodNotAllowed, http.StatusUnsupportedMediaType}, transport.DefaultFatalStatusCodes...)
+
 // HttpForwarderHandlerV2 is a PipelineHandler which sends metrics to another gostatsd instance
 type HttpForwarderHandlerV2 struct {
 	postId          uint64 // atomic - used for an id in logs
@@ -48,12 +55,14 @@ type HttpForwarderHandlerV2 struct {
 	logger                logrus.FieldLogger
 	apiEndpoint           string
 	maxRequestElapsedTime time.Duration
+	retryClassifier       *transport.RetryClassifier
 	metricsSem            chan struct{}
 	client                *http.Client
 	eventWg               sync.WaitGroup
 	compress              bool
 	headers               map[string]string
 	dynHeaderNames        []string
+	digestCompression     float64 // Compression of timer digests, or 0 to forward raw timer values
 
 	done                chan struct{}
 	consolidator        *gostatsd.MetricConsolidator
@@ -70,6 +79,13 @@ func NewHttpForwarderHandlerV2FromViper(logger logrus.FieldLogger, v *viper.Vipe
 	subViper.SetDefault("max-request-elapsed-time", defaultMaxRequestElapsedTime)
 	subViper.SetDefault("consolidator-slots", v.GetInt(gostatsd.ParamMaxParsers))
 	subViper.SetDefault("flush-interval", defaultConsolidatorFlushInterval)
+	subViper.SetDefault("timer-digest-compression", defaultTimerDigestCompression)
+	subViper.SetDefault("fatal-status-codes", defaultFatalStatusCodes)
+
+	retryClassifier, err := transport.NewRetryClassifier(subViper.GetIntSlice("fatal-status-codes"))
+	if err != nil {
+		return nil, err
+	}
 
 	return NewHttpForwarderHandlerV2(
 		logger,
@@ -79,7 +95,9 @@ func NewHttpForwarderHandlerV2FromViper(logger logrus.FieldLogger, v *viper.Vipe
 		subViper.GetInt("max-requests"),
 		subViper.GetBool("compress"),
 		subViper.GetDuration("max-request-elapsed-time"),
+		retryClassifier,
 		subViper.GetDuration("flush-interval"),
+		subViper.GetFloat64("timer-digest-compression"),
 		subViper.GetStringMapString("custom-headers"),
 		subViper.GetStringSlice("dynamic-headers"),
 		pool,
@@ -95,7 +113,9 @@ func NewHttpForwarderHandlerV2(
 	maxRequests int,
 	compress bool,
 	maxRequestElapsedTime time.Duration,
+	retryClassifier *transport.RetryClassifier,
 	flushInterval time.Duration,
+	timerDigestCompression float64,
 	xheaders map[string]string,
 	dynHeaderNames []string,
 	pool *transport.TransportPool,
@@ -115,6 +135,12 @@ func NewHttpForwarderHandlerV2(
 	if flushInterval <= 0 {
 		return nil, fmt.Errorf("flush-interval must be positive")
 	}
+	if timerDigestCompression < 0 {
+		return nil, fmt.Errorf("timer-digest-compression must not be negative")
+	}
+	if timerDigestCompression > tdigest.MaxCompression {
+		return nil, fmt.Errorf("timer-digest-compression must not be more than %d", tdigest.MaxCompression)
+	}
 
 	httpClient, err := pool.Get(transport)
 	if err != nil {
@@ -129,6 +155,7 @@ func NewHttpForwarderHandlerV2(
 		"max-requests":             maxRequests,
 		"consolidator-slots":       consolidatorSlots,
 		"flush-interval":           flushInterval,
+		"timer-digest-compression": timerDigestCompression,
 	}).Info("created HttpForwarderHandler")
 
 	// Default set of headers used for the forwarder
@@ -168,6 +195,7 @@ func NewHttpForwarderHandlerV2(
 		logger:                logger.WithField("component", "http-forwarder-handler-v2"),
 		apiEndpoint:           apiEndpoint,
 		maxRequestElapsedTime: maxRequestElapsedTime,
+		retryClassifier:       retryClassifier,
 		metricsSem:            metricsSem,
 		compress:              compress,
 		consolidator:          gostatsd.NewMetricConsolidator(consolidatorSlots, flushInterval, ch),
@@ -175,6 +203,7 @@ func NewHttpForwarderHandlerV2(
 		client:                httpClient.Client,
 		headers:               headers,
 		dynHeaderNames:        dynHeaderNamesWithColon,
+		digestCompression:     timerDigestCompression,
 		done:                  make(chan struct{}),
 	}, nil
 }
@@ -278,7 +307,9 @@ func (hfh *HttpForwarderHandlerV2) releaseSem() {
 	hfh.metricsSem <- struct{}{} // will never block
 }
 
-func translateToProtobufV2(metricMap *gostatsd.MetricMap) *pb.RawMessageV2 {
+// translateToProtobufV2 converts a MetricMap to its protobuf form.  Timers are sent as a digest if digestCompression
+// is positive and the timer does not need a histogram, or if they were received as a digest.
+func translateToProtobufV2(metricMap *gostatsd.MetricMap, digestCompression float64) *pb.RawMessageV2 {
 	var pbMetricMap pb.RawMessageV2
 
 	pbMetricMap.Gauges = map[string]*pb.GaugeTagV2{}
@@ -325,20 +356,72 @@ func translateToProtobufV2(metricMap *gostatsd.MetricMap) *pb.RawMessageV2 {
 	for metricName, m := range metricMap.Timers {
 		pbMetricMap.Timers[metricName] = &pb.TimerTagV2{TagMap: map[string]*pb.RawTimerV2{}}
 		for tagsKey, metric := range m {
-			pbMetricMap.Timers[metricName].TagMap[tagsKey] = &pb.RawTimerV2{
+			pbTimer := &pb.RawTimerV2{
 				Tags:        metric.Tags,
 				Hostname:    string(metric.Source),
 				SampleCount: metric.SampledCount,
 				Values:      metric.Values,
 			}
+			if metric.Digest != nil || (digestCompression > 0 && !hasHistogramTag(metric)) {
+				pbTimer.Digest = translateDigestToProtobufV2(metric, digestCompression)
+				pbTimer.Values = nil
+			}
+			if metric.Buckets != nil {
+				pbTimer.BucketThresholds, pbTimer.BucketCounts = translateBucketsToProtobufV2(metric.Buckets)
+			}
+			pbMetricMap.Timers[metricName].TagMap[tagsKey] = pbTimer
 		}
 	}
 
 	return &pbMetricMap
 }
 
+// translateBucketsToProtobufV2 converts the buckets of a pre-aggregated histogram to their thresholds and counts,
+// sorted by threshold.
+func translateBucketsToProtobufV2(buckets map[gostatsd.HistogramThreshold]int) ([]float64, []int64) {
+	thresholds := make([]float64, 0, len(buckets))
+	for threshold := range buckets {
+		thresholds = append(thresholds, float64(threshold))
+	}
+	sort.Float64s(thresholds)
+	counts := make([]int64, len(thresholds))
+	for i, threshold := range thresholds {
+		counts[i] = int64(buckets[gostatsd.HistogramThreshold(threshold)])
+	}
+	return thresholds, counts
+}
+
+// translateDigestToProtobufV2 converts the values and digest of a timer to a single protobuf digest.
+func translateDigestToProtobufV2(timer gostatsd.Timer, digestCompression float64) *pb.TDigestV2 {
+	var td *tdigest.TDigest
+	if timer.Digest != nil {
+		td = timer.Digest.Clone()
+	} else {
+		td = tdigest.New(digestCompression)
+	}
+	for _, v := range timer.Values {
+		td.Add(v)
+	}
+
+	centroids := td.Centroids()
+	pbDigest := &pb.TDigestV2{
+		Compression: td.Compression(),
+		Min:         td.Min(),
+		Max:         td.Max(),
+		Sum:         td.Sum(),
+		SumSquares:  td.SumSquares(),
+		Means:       make([]float64, len(centroids)),
+		Weights:     make([]float64, len(centroids)),
+	}
+	for i, c := range centroids {
+		pbDigest.Means[i] = c.Mean
+		pbDigest.Weights[i] = c.Weight
+	}
+	return pbDigest
+}
+
 func (hfh *HttpForwarderHandlerV2) postMetrics(ctx context.Context, metricMap *gostatsd.MetricMap, dynHeaderTags string, batchId uint64) {
-	message := translateToProtobufV2(metricMap)
+	message := translateToProtobufV2(metricMap, hfh.digestCompression)
 	hfh.post(ctx, message, dynHeaderTags, batchId, "metrics", "/v2/raw")
 }
 
@@ -366,6 +449,12 @@ func (hfh *HttpForwarderHandlerV2) post(ctx context.Context, message proto.Messa
 			return
 		}
 
+		if hfh.retryClassifier.IsFatal(err) {
+			atomic.AddUint64(&hfh.messagesDropped, 1)
+			logger.WithError(err).Error("failed to send, not retrying")
+			return
+		}
+
 		next := b.NextBackOff()
 		if next == backoff.Stop {
 			atomic.AddUint64(&hfh.messagesDropped, 1)
@@ -474,7 +563,7 @@ func (hfh *HttpForwarderHandlerV2) constructPost(ctx context.Context, logger log
 				"status": resp.StatusCode,
 				"body":   string(bodyStart),
 			}).Info("failed request")
-			return fmt.Errorf("received bad status code %d", resp.StatusCode)
+			return &transport.StatusError{StatusCode: resp.StatusCode}
 		}
 		return nil
 	}, nil
@@ -3,6 +3,7 @@ package statsd
 import (
 	"context"
 	"io"
+	"math"
 	"net/http"
 	"net/http/httptest"
 	"sync/atomic"
@@ -98,7 +99,7 @@ func TestHttpForwarderV2Translation(t *testing.T) {
 		mm.Receive(metric)
 	}
 
-	pbMetrics := translateToProtobufV2(mm)
+	pbMetrics := translateToProtobufV2(mm, 0)
 
 	expected := &pb.RawMessageV2{
 		Gauges: map[string]*pb.GaugeTagV2{
@@ -213,7 +214,7 @@ func BenchmarkHttpForwarderV2TranslateAll(b *testing.B) {
 	b.ReportAllocs()
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		translateToProtobufV2(mm)
+		translateToProtobufV2(mm, 0)
 	}
 }
 
@@ -253,7 +254,9 @@ func TestForwardingData(t *testing.T) {
 		1,
 		false,
 		100*time.Millisecond, // maxRequestElapsedTime
+		nil,
 		100*time.Millisecond, // flushInterval
+		0,
 		map[string]string{},
 		[]string{},
 		pool,
@@ -294,6 +297,39 @@ func TestForwardingData(t *testing.T) {
 	assert.Equal(t, 0, mockClock.Len(), "Must have closed all event handlers")
 }
 
+func TestHttpForwarderV2RetryClassification(t *testing.T) {
+	t.Parallel()
+	retryClassifier, err := transport.NewRetryClassifier([]int{http.StatusUnauthorized})
+	require.NoError(t, err)
+
+	for _, testcase := range []struct {
+		statusCode       int
+		expectedRequests uint64
+	}{
+		{statusCode: http.StatusUnauthorized, expectedRequests: 1},
+		{statusCode: http.StatusServiceUnavailable, expectedRequests: 2},
+	} {
+		var called uint64
+		s := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			atomic.AddUint64(&called, 1)
+			rw.WriteHeader(testcase.statusCode)
+		}))
+
+		logger := logrus.New()
+		pool := transport.NewTransportPool(logger, viper.New())
+		h, err := NewHttpForwarderHandlerV2(logger, "default", s.URL, 1, 1, false, 100*time.Millisecond, retryClassifier,
+			time.Second, 0, nil, nil, pool)
+		require.NoError(t, err)
+
+		h.postMetrics(context.Background(), gostatsd.NewMetricMap(), "", 0)
+		s.Close()
+
+		assert.Equal(t, testcase.expectedRequests, atomic.LoadUint64(&called), testcase.statusCode)
+		assert.EqualValues(t, 1, atomic.LoadUint64(&h.messagesDropped), testcase.statusCode)
+		assert.EqualValues(t, testcase.expectedRequests-1, atomic.LoadUint64(&h.messagesRetried), testcase.statusCode)
+	}
+}
+
 func TestHttpForwarderV2New(t *testing.T) {
 	logger := logrus.New()
 	pool := transport.NewTransportPool(logger, viper.New())
@@ -312,9 +348,60 @@ func TestHttpForwarderV2New(t *testing.T) {
 			expected:   []string{"service:", "deploy:"},
 		},
 	} {
-		h, err := NewHttpForwarderHandlerV2(logger, "default", "endpoint", 1, 1, false, time.Second, time.Second,
+		h, err := NewHttpForwarderHandlerV2(logger, "default", "endpoint", 1, 1, false, time.Second, nil, time.Second, 0,
 			cusHeaders, testcase.dynHeaders, pool)
 		require.Nil(t, err)
 		require.Equal(t, h.dynHeaderNames, testcase.expected)
 	}
 }
+
+func TestHttpForwarderV2TranslationDigest(t *testing.T) {
+	t.Parallel()
+
+	mm := gostatsd.NewMetricMap()
+	for i := 1; i <= 1000; i++ {
+		mm.Receive(&gostatsd.Metric{Name: "timer", Value: float64(i), Rate: 1, Type: gostatsd.TIMER})
+		mm.Receive(&gostatsd.Metric{Name: "histogram", Value: float64(i), Rate: 1, Type: gostatsd.TIMER, Tags: gostatsd.Tags{"gsd_histogram:10_100"}})
+	}
+
+	pbMetrics := translateToProtobufV2(mm, 100)
+
+	timer := pbMetrics.Timers["timer"].TagMap[""]
+	require.NotNil(t, timer.Digest)
+	assert.Empty(t, timer.Values)
+	assert.EqualValues(t, 1000, timer.SampleCount)
+	assert.EqualValues(t, 1, timer.Digest.Min)
+	assert.EqualValues(t, 1000, timer.Digest.Max)
+	assert.EqualValues(t, 1000*1001/2, timer.Digest.Sum)
+	assert.Len(t, timer.Digest.Weights, len(timer.Digest.Means))
+	assert.Less(t, len(timer.Digest.Means), 200)
+	weight := 0.0
+	for _, w := range timer.Digest.Weights {
+		weight += w
+	}
+	assert.EqualValues(t, 1000, weight)
+
+	// Histograms need the raw values
+	histogram := pbMetrics.Timers["histogram"].TagMap["gsd_histogram:10_100"]
+	assert.Nil(t, histogram.Digest)
+	assert.Len(t, histogram.Values, 1000)
+
+	// Timers received as a digest are always forwarded as a digest
+	pbMetrics = translateToProtobufV2(newDigestMetricMap("timer", 1, 2, 3), 0)
+	require.NotNil(t, pbMetrics.Timers["timer"].TagMap[""].Digest)
+	assert.Len(t, pbMetrics.Timers["timer"].TagMap[""].Digest.Means, 3)
+}
+
+func TestHttpForwarderV2TranslationBuckets(t *testing.T) {
+	t.Parallel()
+
+	mm := gostatsd.NewMetricMap()
+	buckets := map[gostatsd.HistogramThreshold]int{0.5: 12, 0.1: 5, gostatsd.HistogramThreshold(math.Inf(1)): 20}
+	mm.Receive(&gostatsd.Metric{Name: "histogram", Buckets: buckets, Rate: 1, Type: gostatsd.TIMER})
+
+	for _, compression := range []float64{0, 100} {
+		timer := translateToProtobufV2(mm, compression).Timers["histogram"].TagMap[""]
+		assert.Equal(t, []float64{0.1, 0.5, math.Inf(1)}, timer.BucketThresholds)
+		assert.Equal(t, []int64{5, 12, 20}, timer.BucketCounts)
+	}
+}
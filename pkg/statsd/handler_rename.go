@@ -0,0 +1,232 @@
+package statsd
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"github.com/atlassian/gostatsd"
+)
+
+// RenameRule renames the metrics matching From to To.  From is either an exact name, a prefix ending in `*`, or a
+// regular expression prefixed with `regex:`.  For a prefix, if To also ends in `*` the prefix is replaced, otherwise
+// every matching metric is renamed to To.  For a regular expression, To may refer to its capture groups, such as `$1`.
+type RenameRule struct {
+	From string
+	To   string
+	// DualEmit also passes on the metric under its original name, so both names are emitted while dashboards and
+	// alerts are migrated.
+	DualEmit bool
+
+	regex *regexp.Regexp
+}
+
+// NewRenameRuleFromViper creates a new RenameRule given a *viper.Viper
+func NewRenameRuleFromViper(v *viper.Viper) (*RenameRule, error) {
+	v.SetDefault("dual-emit", false)
+	return NewRenameRule(v.GetString("from"), v.GetString("to"), v.GetBool("dual-emit"))
+}
+
+// NewRenameRulesFromViper creates a RenameRule for each name in the `renames` list, read from the `rename.<name>`
+// section.
+func NewRenameRulesFromViper(v *viper.Viper) ([]*RenameRule, error) {
+	var rules []*RenameRule
+	for _, name := range v.GetStringSlice("renames") {
+		vRule := v.Sub("rename." + name)
+		if vRule == nil {
+			logrus.Warnf("Rename doesn't exist: %v", name)
+			continue
+		}
+		rr, err := NewRenameRuleFromViper(vRule)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rename %s: %v", name, err)
+		}
+		rules = append(rules, rr)
+		logrus.Infof("Loaded rename %v", name)
+	}
+	return rules, nil
+}
+
+// NewRenameRule creates a RenameRule, compiling From if it is a regular expression.
+func NewRenameRule(from, to string, dualEmit bool) (*RenameRule, error) {
+	if from == "" || from == "*" || from == "regex:" {
+		return nil, fmt.Errorf("from must be set")
+	}
+	if to == "" || to == "*" {
+		return nil, fmt.Errorf("to must be set")
+	}
+	rr := &RenameRule{From: from, To: to, DualEmit: dualEmit}
+	if strings.HasPrefix(from, "regex:") {
+		regex, err := regexp.Compile(from[len("regex:"):])
+		if err != nil {
+			return nil, err
+		}
+		rr.regex = regex
+	}
+	return rr, nil
+}
+
+// rename returns the new name of metricName, and whether the rule matched it.
+func (rr *RenameRule) rename(metricName string) (string, bool) {
+	switch {
+	case rr.regex != nil:
+		match := rr.regex.FindStringSubmatchIndex(metricName)
+		if match == nil {
+			return metricName, false
+		}
+		return string(rr.regex.ExpandString(nil, rr.To, metricName, match)), true
+	case strings.HasSuffix(rr.From, "*"):
+		prefix := rr.From[:len(rr.From)-1]
+		if !strings.HasPrefix(metricName, prefix) {
+			return metricName, false
+		}
+		if strings.HasSuffix(rr.To, "*") {
+			return rr.To[:len(rr.To)-1] + metricName[len(prefix):], true
+		}
+		return rr.To, true
+	default:
+		if metricName != rr.From {
+			return metricName, false
+		}
+		return rr.To, true
+	}
+}
+
+// RenameHandler renames metrics before they are aggregated, so metrics received under the old and new names are
+// aggregated together under the new name.
+type RenameHandler struct {
+	handler gostatsd.PipelineHandler
+	rules   []*RenameRule
+}
+
+// NewRenameHandler initialises a new handler which renames metrics by the first of the rules they match, before
+// passing them to the next handler.
+func NewRenameHandler(handler gostatsd.PipelineHandler, rules []*RenameRule) *RenameHandler {
+	return &RenameHandler{
+		handler: handler,
+		rules:   rules,
+	}
+}
+
+// EstimatedTags returns a guess for how many tags to pre-allocate
+func (rh *RenameHandler) EstimatedTags() int {
+	return rh.handler.EstimatedTags()
+}
+
+// rename returns the new name of metricName, and whether it is also emitted under its original name.
+func (rh *RenameHandler) rename(metricName string) (string, bool) {
+	for _, rr := range rh.rules {
+		if newName, ok := rr.rename(metricName); ok {
+			return newName, rr.DualEmit && newName != metricName
+		}
+	}
+	return metricName, false
+}
+
+// renamed is the new name of a metric, and whether it is also emitted under its original name.
+type renamed struct {
+	name     string
+	dualEmit bool
+}
+
+// renames returns the metric names in the map which are renamed, keyed by their original name, so each name is only
+// matched against the rules once, rather than for every series.
+func (rh *RenameHandler) renames(mm *gostatsd.MetricMap) map[string]renamed {
+	var renames map[string]renamed
+	check := func(metricName string) {
+		if _, ok := renames[metricName]; ok {
+			return
+		}
+		newName, dualEmit := rh.rename(metricName)
+		if newName == metricName && !dualEmit {
+			return
+		}
+		if renames == nil {
+			renames = map[string]renamed{}
+		}
+		renames[metricName] = renamed{name: newName, dualEmit: dualEmit}
+	}
+	for metricName := range mm.Counters {
+		check(metricName)
+	}
+	for metricName := range mm.Gauges {
+		check(metricName)
+	}
+	for metricName := range mm.Timers {
+		check(metricName)
+	}
+	for metricName := range mm.Sets {
+		check(metricName)
+	}
+	return renames
+}
+
+// DispatchMetricMap renames the metrics in the map, merging the metrics which are now the same series, and passes it
+// to the next stage in the pipeline.  The map is passed on unchanged if no metric in it is renamed.
+func (rh *RenameHandler) DispatchMetricMap(ctx context.Context, mm *gostatsd.MetricMap) {
+	renames := rh.renames(mm)
+	if len(renames) == 0 {
+		rh.handler.DispatchMetricMap(ctx, mm)
+		return
+	}
+	rename := func(metricName string) (string, bool) {
+		if r, ok := renames[metricName]; ok {
+			return r.name, r.dualEmit
+		}
+		return metricName, false
+	}
+
+	mmNew := gostatsd.NewMetricMap()
+	mm.Counters.Each(func(metricName, tagsKey string, c gostatsd.Counter) {
+		newName, dualEmit := rename(metricName)
+		mmNew.MergeCounter(newName, tagsKey, c)
+		if dualEmit {
+			mmNew.MergeCounter(metricName, tagsKey, c)
+		}
+	})
+	mm.Gauges.Each(func(metricName, tagsKey string, g gostatsd.Gauge) {
+		newName, dualEmit := rename(metricName)
+		mmNew.MergeGauge(newName, tagsKey, g)
+		if dualEmit {
+			mmNew.MergeGauge(metricName, tagsKey, g)
+		}
+	})
+	mm.Timers.Each(func(metricName, tagsKey string, t gostatsd.Timer) {
+		newName, dualEmit := rename(metricName)
+		mmNew.MergeTimer(newName, tagsKey, t)
+		if dualEmit {
+			// The values are copied, as they are appended to when merged in to
+			t.Values = append([]float64(nil), t.Values...)
+			mmNew.MergeTimer(metricName, tagsKey, t)
+		}
+	})
+	mm.Sets.Each(func(metricName, tagsKey string, s gostatsd.Set) {
+		newName, dualEmit := rename(metricName)
+		mmNew.MergeSet(newName, tagsKey, s)
+		if dualEmit {
+			// The values are copied, as they are added to when merged in to
+			values := make(map[string]struct{}, len(s.Values))
+			for value := range s.Values {
+				values[value] = present
+			}
+			s.Values = values
+			mmNew.MergeSet(metricName, tagsKey, s)
+		}
+	})
+
+	rh.handler.DispatchMetricMap(ctx, mmNew)
+}
+
+// DispatchEvent passes the event to the next stage in the pipeline unchanged, as events have no metric name.
+func (rh *RenameHandler) DispatchEvent(ctx context.Context, e *gostatsd.Event) {
+	rh.handler.DispatchEvent(ctx, e)
+}
+
+// WaitForEvents waits for all event-dispatching goroutines to finish.
+func (rh *RenameHandler) WaitForEvents() {
+	rh.handler.WaitForEvents()
+}
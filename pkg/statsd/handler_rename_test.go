@@ -0,0 +1,132 @@
+package statsd
+
+import (
+	"context"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/atlassian/gostatsd"
+)
+
+func TestRenameRule(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		from, to string
+		name     string
+		expected string
+		matched  bool
+	}{
+		{from: "api.v1.latency", to: "api.latency", name: "api.v1.latency", expected: "api.latency", matched: true},
+		{from: "api.v1.latency", to: "api.latency", name: "api.v1.latency.p99", expected: "api.v1.latency.p99"},
+		{from: "legacy.*", to: "app.*", name: "legacy.requests", expected: "app.requests", matched: true},
+		{from: "legacy.*", to: "app.requests", name: "legacy.requests.total", expected: "app.requests", matched: true},
+		{from: "legacy.*", to: "app.*", name: "app.legacy.requests", expected: "app.legacy.requests"},
+		{from: `regex:^(\w+)\.v1\.(\w+)$`, to: "$1.$2", name: "api.v1.errors", expected: "api.errors", matched: true},
+		{from: `regex:^(\w+)\.v1\.(\w+)$`, to: "$1.$2", name: "api.v2.errors", expected: "api.v2.errors"},
+	}
+	for _, tc := range tests {
+		rr, err := NewRenameRule(tc.from, tc.to, false)
+		require.NoError(t, err)
+		name, matched := rr.rename(tc.name)
+		assert.Equal(t, tc.expected, name, "%s -> %s", tc.from, tc.name)
+		assert.Equal(t, tc.matched, matched, "%s -> %s", tc.from, tc.name)
+	}
+
+	for _, invalid := range [][2]string{{"", "a"}, {"a", ""}, {"*", "a"}, {"regex:(", "a"}} {
+		_, err := NewRenameRule(invalid[0], invalid[1], false)
+		assert.Error(t, err, "%v", invalid)
+	}
+}
+
+func TestRenameHandlerMergesNames(t *testing.T) {
+	t.Parallel()
+	rr, err := NewRenameRule("old.*", "new.*", false)
+	require.NoError(t, err)
+	tch := &capturingHandler{}
+	rh := NewRenameHandler(tch, []*RenameRule{rr})
+
+	mm := gostatsd.NewMetricMap()
+	for _, name := range []string{"old.c", "new.c"} {
+		mm.Receive(&gostatsd.Metric{Type: gostatsd.COUNTER, Name: name, Value: 1, Rate: 1, Tags: gostatsd.Tags{"a:b"}})
+		mm.Receive(&gostatsd.Metric{Type: gostatsd.TIMER, Name: "old.t", Value: 1, Rate: 1})
+		mm.Receive(&gostatsd.Metric{Type: gostatsd.SET, Name: name, StringValue: name})
+	}
+	mm.Receive(&gostatsd.Metric{Type: gostatsd.GAUGE, Name: "old.g", Value: 3})
+	rh.DispatchMetricMap(context.Background(), mm)
+
+	require.Len(t, tch.mm, 1)
+	renamed := tch.mm[0]
+	assert.Len(t, renamed.Counters, 1)
+	assert.EqualValues(t, 2, renamed.Counters["new.c"]["a:b"].Value)
+	assert.Equal(t, []float64{1, 1}, renamed.Timers["new.t"][""].Values)
+	assert.Len(t, renamed.Sets, 1)
+	assert.Len(t, renamed.Sets["new.c"][""].Values, 2)
+	assert.EqualValues(t, 3, renamed.Gauges["new.g"][""].Value)
+	assert.NotContains(t, renamed.Gauges, "old.g")
+
+	// Maps with nothing to rename are passed on as they are
+	unchanged := gostatsd.NewMetricMap()
+	unchanged.Receive(&gostatsd.Metric{Type: gostatsd.COUNTER, Name: "other", Value: 1, Rate: 1})
+	rh.DispatchMetricMap(context.Background(), unchanged)
+	require.Len(t, tch.mm, 2)
+	assert.Same(t, unchanged, tch.mm[1])
+}
+
+func TestRenameHandlerDualEmit(t *testing.T) {
+	t.Parallel()
+	v := viper.New()
+	v.Set("renames", []string{"latency", "missing"})
+	v.Set("rename.latency.from", "api.v1.latency")
+	v.Set("rename.latency.to", "api.latency")
+	v.Set("rename.latency.dual-emit", true)
+	rules, err := NewRenameRulesFromViper(v)
+	require.NoError(t, err)
+	require.Len(t, rules, 1)
+	tch := &capturingHandler{}
+	rh := NewRenameHandler(tch, rules)
+
+	mm := gostatsd.NewMetricMap()
+	mm.Receive(&gostatsd.Metric{Type: gostatsd.TIMER, Name: "api.v1.latency", Value: 5, Rate: 1})
+	mm.Receive(&gostatsd.Metric{Type: gostatsd.TIMER, Name: "api.latency", Value: 7, Rate: 1})
+	mm.Receive(&gostatsd.Metric{Type: gostatsd.COUNTER, Name: "api.v1.latency", Value: 1, Rate: 1})
+	rh.DispatchMetricMap(context.Background(), mm)
+
+	require.Len(t, tch.mm, 1)
+	renamed := tch.mm[0]
+	// The new name has the samples of both names, and the old name only its own
+	assert.ElementsMatch(t, []float64{5, 7}, renamed.Timers["api.latency"][""].Values)
+	assert.Equal(t, []float64{5}, renamed.Timers["api.v1.latency"][""].Values)
+	assert.EqualValues(t, 1, renamed.Counters["api.latency"][""].Value)
+	assert.EqualValues(t, 1, renamed.Counters["api.v1.latency"][""].Value)
+
+	// The old name's values are not shared with the new name's
+	renamed.Timers["api.v1.latency"][""].Values[0] = 0
+	assert.Contains(t, renamed.Timers["api.latency"][""].Values, 5.0)
+
+	v.Set("rename.latency.from", "regex:(")
+	_, err = NewRenameRulesFromViper(v)
+	require.Error(t, err)
+}
+
+func TestRenameHandlerRenames(t *testing.T) {
+	t.Parallel()
+	rr, err := NewRenameRule("old.*", "new.*", false)
+	require.NoError(t, err)
+	rh := NewRenameHandler(&nopHandler{}, []*RenameRule{rr})
+
+	mm := gostatsd.NewMetricMap()
+	mm.Receive(&gostatsd.Metric{Type: gostatsd.COUNTER, Name: "old.a", Value: 1, Rate: 1, Tags: gostatsd.Tags{"x:1"}})
+	mm.Receive(&gostatsd.Metric{Type: gostatsd.COUNTER, Name: "old.a", Value: 1, Rate: 1, Tags: gostatsd.Tags{"x:2"}})
+	mm.Receive(&gostatsd.Metric{Type: gostatsd.GAUGE, Name: "old.a", Value: 1})
+	mm.Receive(&gostatsd.Metric{Type: gostatsd.GAUGE, Name: "other", Value: 1})
+
+	// Only the renamed names are returned, once each
+	assert.Equal(t, map[string]renamed{"old.a": {name: "new.a"}}, rh.renames(mm))
+
+	unchanged := gostatsd.NewMetricMap()
+	unchanged.Receive(&gostatsd.Metric{Type: gostatsd.GAUGE, Name: "other", Value: 1})
+	assert.Empty(t, rh.renames(unchanged))
+}
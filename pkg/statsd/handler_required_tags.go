@@ -0,0 +1,155 @@
+package statsd
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/stats"
+)
+
+// missingRequiredTagsMarker is added to metrics which are annotated because they are missing required tags.
+const missingRequiredTagsMarker = "missing_required_tags:true"
+
+// RequiredTagsHandler checks that metrics have a tag with each of the required keys.  Metrics missing any of them are
+// either dropped, or annotated with a marker tag and a default value for each missing key.
+type RequiredTagsHandler struct {
+	handler      gostatsd.PipelineHandler
+	keys         []string // Keys of the required tags
+	annotate     bool     // Annotate non-compliant metrics, rather than dropping them
+	defaultValue string   // Value of the missing tags when annotating
+
+	dropped   uint64 // Accumulated number of metrics dropped, atomic
+	annotated uint64 // Accumulated number of metrics annotated, atomic
+}
+
+// NewRequiredTagsHandler initialises a new handler which checks metrics have tags with all of the keys before passing
+// them to the next handler.
+func NewRequiredTagsHandler(handler gostatsd.PipelineHandler, keys []string, annotate bool, defaultValue string) *RequiredTagsHandler {
+	return &RequiredTagsHandler{
+		handler:      handler,
+		keys:         keys,
+		annotate:     annotate,
+		defaultValue: defaultValue,
+	}
+}
+
+// EstimatedTags returns a guess for how many tags to pre-allocate
+func (rth *RequiredTagsHandler) EstimatedTags() int {
+	if rth.annotate {
+		return rth.handler.EstimatedTags() + len(rth.keys) + 1
+	}
+	return rth.handler.EstimatedTags()
+}
+
+// DispatchMetricMap drops or annotates the metrics in the map which are missing required tags, and passes the rest to
+// the next stage in the pipeline.
+func (rth *RequiredTagsHandler) DispatchMetricMap(ctx context.Context, mm *gostatsd.MetricMap) {
+	mmNew := gostatsd.NewMetricMap()
+
+	mm.Counters.Each(func(metricName, tagsKey string, c gostatsd.Counter) {
+		if tagsKey, tags, keep := rth.checkSeries(tagsKey, c.Source, c.Tags); keep {
+			c.Tags = tags
+			mmNew.MergeCounter(metricName, tagsKey, c)
+		}
+	})
+	mm.Gauges.Each(func(metricName, tagsKey string, g gostatsd.Gauge) {
+		if tagsKey, tags, keep := rth.checkSeries(tagsKey, g.Source, g.Tags); keep {
+			g.Tags = tags
+			mmNew.MergeGauge(metricName, tagsKey, g)
+		}
+	})
+	mm.Timers.Each(func(metricName, tagsKey string, t gostatsd.Timer) {
+		if tagsKey, tags, keep := rth.checkSeries(tagsKey, t.Source, t.Tags); keep {
+			t.Tags = tags
+			mmNew.MergeTimer(metricName, tagsKey, t)
+		}
+	})
+	mm.Sets.Each(func(metricName, tagsKey string, s gostatsd.Set) {
+		if tagsKey, tags, keep := rth.checkSeries(tagsKey, s.Source, s.Tags); keep {
+			s.Tags = tags
+			mmNew.MergeSet(metricName, tagsKey, s)
+		}
+	})
+
+	if !mmNew.IsEmpty() {
+		rth.handler.DispatchMetricMap(ctx, mmNew)
+	}
+}
+
+// checkSeries returns the tags key and tags to send a series with, and false if it should be dropped.
+func (rth *RequiredTagsHandler) checkSeries(tagsKey string, source gostatsd.Source, tags gostatsd.Tags) (string, gostatsd.Tags, bool) {
+	checked, keep := rth.check(tags)
+	if !keep {
+		return "", nil, false
+	}
+	if len(checked) != len(tags) {
+		// Annotated, so the series has changed
+		tagsKey = gostatsd.FormatTagsKey(source, checked)
+	}
+	return tagsKey, checked, true
+}
+
+// check returns the tags to send a metric with, and false if it should be dropped.  The tags are copied only if they
+// are annotated.
+func (rth *RequiredTagsHandler) check(tags gostatsd.Tags) (gostatsd.Tags, bool) {
+	var annotated gostatsd.Tags
+	for _, key := range rth.keys {
+		if hasTagKey(tags, key) {
+			continue
+		}
+		if !rth.annotate {
+			atomic.AddUint64(&rth.dropped, 1)
+			return nil, false
+		}
+		if annotated == nil {
+			annotated = make(gostatsd.Tags, len(tags), len(tags)+len(rth.keys)+1)
+			copy(annotated, tags)
+			annotated = append(annotated, missingRequiredTagsMarker)
+		}
+		annotated = append(annotated, key+":"+rth.defaultValue)
+	}
+	if annotated == nil {
+		return tags, true
+	}
+	atomic.AddUint64(&rth.annotated, 1)
+	return annotated, true
+}
+
+// hasTagKey returns true if any of the tags has the key.  A tag without a value is treated as its own key.
+func hasTagKey(tags gostatsd.Tags, key string) bool {
+	for _, tag := range tags {
+		if strings.HasPrefix(tag, key) && (len(tag) == len(key) || tag[len(key)] == ':') {
+			return true
+		}
+	}
+	return false
+}
+
+// DispatchEvent passes the event to the next stage in the pipeline unchanged, as only metrics are checked.
+func (rth *RequiredTagsHandler) DispatchEvent(ctx context.Context, e *gostatsd.Event) {
+	rth.handler.DispatchEvent(ctx, e)
+}
+
+// WaitForEvents waits for all event-dispatching goroutines to finish.
+func (rth *RequiredTagsHandler) WaitForEvents() {
+	rth.handler.WaitForEvents()
+}
+
+// RunMetricsContext emits the number of metrics dropped and annotated on every flush.
+func (rth *RequiredTagsHandler) RunMetricsContext(ctx context.Context) {
+	statser := stats.FromContext(ctx)
+	flushed, unregister := statser.RegisterFlush()
+	defer unregister()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-flushed:
+			statser.Gauge("required_tags.dropped", float64(atomic.LoadUint64(&rth.dropped)), nil)
+			statser.Gauge("required_tags.annotated", float64(atomic.LoadUint64(&rth.annotated)), nil)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package statsd
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/atlassian/gostatsd"
+)
+
+// requiredTagsMetrics returns a metric of each type with each set of tags.
+func requiredTagsMetrics(tagSets ...gostatsd.Tags) *gostatsd.MetricMap {
+	mm := gostatsd.NewMetricMap()
+	for _, tags := range tagSets {
+		mm.Receive(&gostatsd.Metric{Type: gostatsd.COUNTER, Name: "c", Value: 1, Rate: 1, Tags: tags})
+		mm.Receive(&gostatsd.Metric{Type: gostatsd.GAUGE, Name: "g", Value: 1, Tags: tags})
+		mm.Receive(&gostatsd.Metric{Type: gostatsd.TIMER, Name: "t", Value: 1, Rate: 1, Tags: tags})
+		mm.Receive(&gostatsd.Metric{Type: gostatsd.SET, Name: "s", StringValue: "a", Tags: tags})
+	}
+	return mm
+}
+
+func TestRequiredTagsDrop(t *testing.T) {
+	t.Parallel()
+	tch := &capturingHandler{}
+	rth := NewRequiredTagsHandler(tch, []string{"team", "service"}, false, "unknown")
+
+	rth.DispatchMetricMap(context.Background(), requiredTagsMetrics(
+		gostatsd.Tags{"team:billing", "service:api", "env:prod"},
+		gostatsd.Tags{"team:billing"},
+		gostatsd.Tags{"env:prod"},
+		gostatsd.Tags{"team", "service:web"}, // A tag without a value has the key
+	))
+
+	require.Len(t, tch.mm, 1)
+	mm := tch.mm[0]
+	for _, tagsKey := range []string{"env:prod,service:api,team:billing", "service:web,team"} {
+		assert.Contains(t, mm.Counters["c"], tagsKey)
+		assert.Contains(t, mm.Gauges["g"], tagsKey)
+		assert.Contains(t, mm.Timers["t"], tagsKey)
+		assert.Contains(t, mm.Sets["s"], tagsKey)
+	}
+	assert.Len(t, mm.Counters["c"], 2)
+	assert.Len(t, mm.Gauges["g"], 2)
+	assert.Len(t, mm.Timers["t"], 2)
+	assert.Len(t, mm.Sets["s"], 2)
+	assert.EqualValues(t, 8, atomic.LoadUint64(&rth.dropped))
+	assert.Zero(t, atomic.LoadUint64(&rth.annotated))
+
+	// Nothing is passed on if every metric is dropped
+	rth.DispatchMetricMap(context.Background(), requiredTagsMetrics(gostatsd.Tags{"teamname:x"}))
+	assert.Len(t, tch.mm, 1)
+}
+
+func TestRequiredTagsAnnotate(t *testing.T) {
+	t.Parallel()
+	tch := &capturingHandler{}
+	rth := NewRequiredTagsHandler(tch, []string{"team", "service"}, true, "unknown")
+
+	compliant := gostatsd.Tags{"team:billing", "service:api"}
+	partial := gostatsd.Tags{"service:api"}
+	rth.DispatchMetricMap(context.Background(), requiredTagsMetrics(compliant, partial, nil))
+
+	require.Len(t, tch.mm, 1)
+	mm := tch.mm[0]
+	require.Len(t, mm.Counters["c"], 3)
+	assert.Equal(t, compliant, mm.Counters["c"]["service:api,team:billing"].Tags)
+	assert.Equal(t,
+		gostatsd.Tags{"missing_required_tags:true", "service:api", "team:unknown"},
+		mm.Counters["c"]["missing_required_tags:true,service:api,team:unknown"].Tags)
+	assert.Equal(t,
+		gostatsd.Tags{"missing_required_tags:true", "service:unknown", "team:unknown"},
+		mm.Gauges["g"]["missing_required_tags:true,service:unknown,team:unknown"].Tags)
+	assert.Len(t, mm.Timers["t"], 3)
+	assert.Len(t, mm.Sets["s"], 3)
+	assert.Equal(t, gostatsd.Tags{"service:api"}, partial) // Not modified in place
+	assert.EqualValues(t, 8, atomic.LoadUint64(&rth.annotated))
+	assert.Zero(t, atomic.LoadUint64(&rth.dropped))
+}
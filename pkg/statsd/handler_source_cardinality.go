@@ -0,0 +1,121 @@
+package statsd
+
+import (
+	"context"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/stats"
+)
+
+// SourceCardinalityHandler estimates how many distinct sources send each metric name, and emits the estimate as an
+// internal metric every flush.  It must be placed before the CloudHandler, while the source is still the sending IP.
+type SourceCardinalityHandler struct {
+	matchMetrics   gostatsd.StringMatchList
+	excludeMetrics gostatsd.StringMatchList
+	handler        gostatsd.PipelineHandler
+	sketches       *sketchShards // Keyed by metric name, sharded so parsers don't contend on a single lock
+}
+
+// NewSourceCardinalityHandlerFromViper creates a new SourceCardinalityHandler from the `source-cardinality` section.
+// It returns nil if the section is not present, or has no match-metrics, as the feature is opt-in.
+func NewSourceCardinalityHandlerFromViper(v *viper.Viper, handler gostatsd.PipelineHandler) *SourceCardinalityHandler {
+	vSub := v.Sub("source-cardinality")
+	if vSub == nil {
+		return nil
+	}
+	vSub.SetDefault("match-metrics", []string{})
+	vSub.SetDefault("exclude-metrics", []string{})
+	vSub.SetDefault("max-metrics", 1000)
+
+	matchMetrics := vSub.GetStringSlice("match-metrics")
+	if len(matchMetrics) == 0 {
+		logrus.Warn("source-cardinality has no match-metrics, not enabled")
+		return nil
+	}
+	return NewSourceCardinalityHandler(
+		handler,
+		toStringMatch(matchMetrics),
+		toStringMatch(vSub.GetStringSlice("exclude-metrics")),
+		vSub.GetInt("max-metrics"),
+	)
+}
+
+// NewSourceCardinalityHandler initialises a new handler which tracks the distinct sources of metrics matching
+// matchMetrics, for up to maxMetrics metric names per flush, before passing them to the next handler.
+func NewSourceCardinalityHandler(handler gostatsd.PipelineHandler, matchMetrics, excludeMetrics gostatsd.StringMatchList, maxMetrics int) *SourceCardinalityHandler {
+	return &SourceCardinalityHandler{
+		matchMetrics:   matchMetrics,
+		excludeMetrics: excludeMetrics,
+		handler:        handler,
+		sketches:       newSketchShards(maxMetrics),
+	}
+}
+
+// EstimatedTags returns a guess for how many tags to pre-allocate
+func (sch *SourceCardinalityHandler) EstimatedTags() int {
+	return sch.handler.EstimatedTags()
+}
+
+// DispatchMetricMap records the source of each matching metric, and passes the MetricMap to the next handler.
+func (sch *SourceCardinalityHandler) DispatchMetricMap(ctx context.Context, mm *gostatsd.MetricMap) {
+	mm.Counters.Each(func(metricName, tagsKey string, c gostatsd.Counter) {
+		sch.observe(metricName, c.Source)
+	})
+	mm.Gauges.Each(func(metricName, tagsKey string, g gostatsd.Gauge) {
+		sch.observe(metricName, g.Source)
+	})
+	mm.Timers.Each(func(metricName, tagsKey string, t gostatsd.Timer) {
+		sch.observe(metricName, t.Source)
+	})
+	mm.Sets.Each(func(metricName, tagsKey string, s gostatsd.Set) {
+		sch.observe(metricName, s.Source)
+	})
+
+	sch.handler.DispatchMetricMap(ctx, mm)
+}
+
+func (sch *SourceCardinalityHandler) observe(metricName string, source gostatsd.Source) {
+	if !sch.matchMetrics.MatchAny(metricName) || sch.excludeMetrics.MatchAny(metricName) {
+		return
+	}
+	sch.sketches.Add(metricName, string(source))
+}
+
+// DispatchEvent passes the event to the next handler.
+func (sch *SourceCardinalityHandler) DispatchEvent(ctx context.Context, e *gostatsd.Event) {
+	sch.handler.DispatchEvent(ctx, e)
+}
+
+// WaitForEvents waits for all event-dispatching goroutines to finish.
+func (sch *SourceCardinalityHandler) WaitForEvents() {
+	sch.handler.WaitForEvents()
+}
+
+// RunMetricsContext emits the distinct source estimates, and starts tracking again from scratch, on every flush.
+func (sch *SourceCardinalityHandler) RunMetricsContext(ctx context.Context) {
+	statser := stats.FromContext(ctx)
+	flushed, unregister := statser.RegisterFlush()
+	defer unregister()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-flushed:
+			sch.emit(statser)
+		}
+	}
+}
+
+func (sch *SourceCardinalityHandler) emit(statser stats.Statser) {
+	sketches, valuesDiscarded := sch.sketches.Reset()
+
+	for metricName, sketch := range sketches {
+		statser.Gauge("source_cardinality.distinct_sources", sketch.Estimate(), gostatsd.Tags{"metric:" + metricName})
+	}
+	statser.Gauge("source_cardinality.metrics_tracked", float64(len(sketches)), nil)
+	statser.Gauge("source_cardinality.values_discarded", float64(valuesDiscarded), nil)
+}
@@ -0,0 +1,129 @@
+package statsd
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/stats"
+)
+
+func TestHyperLogLogEstimate(t *testing.T) {
+	t.Parallel()
+	for _, distinct := range []int{0, 1, 10, 100, 1000, 10000, 100000} {
+		h := &hyperLogLog{}
+		for i := 0; i < distinct; i++ {
+			ip := fmt.Sprintf("10.%d.%d.%d", i>>16&0xff, i>>8&0xff, i&0xff)
+			h.Add(ip)
+			h.Add(ip) // Duplicates must not be counted
+		}
+		assert.InEpsilon(t, float64(distinct)+1, h.Estimate()+1, 0.1, "distinct=%d", distinct)
+	}
+}
+
+func TestNewSourceCardinalityHandlerFromViper(t *testing.T) {
+	t.Parallel()
+	ch := &capturingHandler{}
+
+	assert.Nil(t, NewSourceCardinalityHandlerFromViper(viper.New(), ch))
+
+	v := viper.New()
+	v.Set("source-cardinality.exclude-metrics", []string{"x"})
+	assert.Nil(t, NewSourceCardinalityHandlerFromViper(v, ch))
+
+	v.Set("source-cardinality.match-metrics", []string{"web.*"})
+	v.Set("source-cardinality.max-metrics", 5)
+	sch := NewSourceCardinalityHandlerFromViper(v, ch)
+	require.NotNil(t, sch)
+	assert.Equal(t, gostatsd.StringMatchList{gostatsd.NewStringMatch("web.*")}, sch.matchMetrics)
+	assert.Equal(t, gostatsd.StringMatchList{gostatsd.NewStringMatch("x")}, sch.excludeMetrics)
+	assert.EqualValues(t, 5, sch.sketches.max)
+}
+
+func TestSourceCardinalityHandler(t *testing.T) {
+	t.Parallel()
+	ch := &capturingHandler{}
+	sch := NewSourceCardinalityHandler(ch, toStringMatch([]string{"web.*"}), toStringMatch([]string{"web.excluded"}), 10)
+
+	mm := gostatsd.NewMetricMap()
+	for i := 0; i < 50; i++ {
+		source := gostatsd.Source(fmt.Sprintf("10.0.0.%d", i))
+		mm.Receive(&gostatsd.Metric{Name: "web.requests", Value: 1, Rate: 1, Source: source, Type: gostatsd.COUNTER})
+		mm.Receive(&gostatsd.Metric{Name: "web.excluded", Value: 1, Rate: 1, Source: source, Type: gostatsd.COUNTER})
+		mm.Receive(&gostatsd.Metric{Name: "db.queries", Value: 1, Rate: 1, Source: source, Type: gostatsd.COUNTER})
+		if i < 5 {
+			mm.Receive(&gostatsd.Metric{Name: "web.latency", Value: 1, Rate: 1, Source: source, Type: gostatsd.TIMER})
+		}
+	}
+	ctx := context.Background()
+	sch.DispatchMetricMap(ctx, mm)
+	sch.DispatchMetricMap(ctx, mm) // Same sources again
+	require.Len(t, ch.mm, 2)
+	assert.Equal(t, mm, ch.mm[0])
+
+	internal := &capturingHandler{}
+	statser := stats.NewInternalStatser(nil, "", "", gostatsd.UnknownSource, internal)
+	sch.emit(statser)
+	statser.NotifyFlush(ctx, 0)
+	require.Len(t, internal.mm, 1)
+
+	gauges := internal.mm[0].Gauges
+	distinct := gauges["source_cardinality.distinct_sources"]
+	require.Len(t, distinct, 2)
+	assert.InDelta(t, 50, distinct["metric:web.requests"].Value, 2)
+	assert.InDelta(t, 5, distinct["metric:web.latency"].Value, 0.5)
+	assert.EqualValues(t, 2, gauges["source_cardinality.metrics_tracked"][""].Value)
+	assert.EqualValues(t, 0, gauges["source_cardinality.values_discarded"][""].Value)
+
+	// Tracking restarts every flush
+	assert.Zero(t, sch.sketches.Len())
+}
+
+func TestSourceCardinalityHandlerMaxMetrics(t *testing.T) {
+	t.Parallel()
+	sch := NewSourceCardinalityHandler(&nopHandler{}, toStringMatch([]string{"*"}), nil, 1)
+
+	mm := gostatsd.NewMetricMap()
+	mm.Receive(&gostatsd.Metric{Name: "a", Value: 1, Rate: 1, Source: "10.0.0.1", Type: gostatsd.GAUGE})
+	mm.Receive(&gostatsd.Metric{Name: "b", Value: 1, Rate: 1, Source: "10.0.0.1", Type: gostatsd.GAUGE})
+	sch.DispatchMetricMap(context.Background(), mm)
+
+	sketches, valuesDiscarded := sch.sketches.Reset()
+	assert.Len(t, sketches, 1)
+	assert.EqualValues(t, 1, valuesDiscarded)
+}
+
+func TestSourceCardinalityHandlerConcurrent(t *testing.T) {
+	t.Parallel()
+	sch := NewSourceCardinalityHandler(&nopHandler{}, toStringMatch([]string{"*"}), nil, 50)
+
+	var wg sync.WaitGroup
+	for p := 0; p < 8; p++ {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				mm := gostatsd.NewMetricMap()
+				source := gostatsd.Source(fmt.Sprintf("10.0.%d.%d", p, i))
+				mm.Receive(&gostatsd.Metric{Name: fmt.Sprintf("m%d", i), Value: 1, Rate: 1, Source: source, Type: gostatsd.COUNTER})
+				sch.DispatchMetricMap(context.Background(), mm)
+			}
+		}(p)
+	}
+	wg.Wait()
+
+	// The limit holds across every shard
+	sketches, valuesDiscarded := sch.sketches.Reset()
+	assert.Len(t, sketches, 50)
+	assert.EqualValues(t, 400, valuesDiscarded)
+	for name, sketch := range sketches {
+		assert.InDelta(t, 8, sketch.Estimate(), 2, name)
+	}
+	assert.Zero(t, sch.sketches.Len())
+}
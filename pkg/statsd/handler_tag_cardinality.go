@@ -0,0 +1,174 @@
+package statsd
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/tilinna/clock"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/stats"
+)
+
+// TagCardinalityHandler estimates how many distinct values each tag key has, and how many series each metric name
+// has, and emits the estimates as internal metrics every interval.  It should be placed just before the aggregators,
+// so it sees the tags the series are aggregated by.
+type TagCardinalityHandler struct {
+	interval   time.Duration
+	topMetrics int
+	maxTagKeys int
+	maxMetrics int
+	handler    gostatsd.PipelineHandler
+
+	tagKeys *sketchShards // Keyed by tag key, estimates the distinct values
+	metrics *sketchShards // Keyed by metric name, estimates the distinct series
+}
+
+// NewTagCardinalityHandlerFromViper creates a new TagCardinalityHandler from the `tag-cardinality` section.  It
+// returns nil if the section is not present, or has no interval, as the feature is opt-in.
+func NewTagCardinalityHandlerFromViper(v *viper.Viper, handler gostatsd.PipelineHandler) *TagCardinalityHandler {
+	vSub := v.Sub("tag-cardinality")
+	if vSub == nil {
+		return nil
+	}
+	vSub.SetDefault("interval", time.Duration(0))
+	vSub.SetDefault("top-metrics", 10)
+	vSub.SetDefault("max-tag-keys", 1000)
+	vSub.SetDefault("max-metrics", 1000)
+
+	interval := vSub.GetDuration("interval")
+	if interval <= 0 {
+		logrus.Warn("tag-cardinality has no interval, not enabled")
+		return nil
+	}
+	return NewTagCardinalityHandler(
+		handler,
+		interval,
+		vSub.GetInt("top-metrics"),
+		vSub.GetInt("max-tag-keys"),
+		vSub.GetInt("max-metrics"),
+	)
+}
+
+// NewTagCardinalityHandler initialises a new handler which tracks the distinct values of up to maxTagKeys tag keys,
+// and the distinct series of up to maxMetrics metric names, per interval, before passing metrics to the next handler.
+// The topMetrics metric names with the most series are reported.
+func NewTagCardinalityHandler(handler gostatsd.PipelineHandler, interval time.Duration, topMetrics, maxTagKeys, maxMetrics int) *TagCardinalityHandler {
+	return &TagCardinalityHandler{
+		interval:   interval,
+		topMetrics: topMetrics,
+		maxTagKeys: maxTagKeys,
+		maxMetrics: maxMetrics,
+		handler:    handler,
+		tagKeys:    newSketchShards(maxTagKeys),
+		metrics:    newSketchShards(maxMetrics),
+	}
+}
+
+// EstimatedTags returns a guess for how many tags to pre-allocate
+func (tch *TagCardinalityHandler) EstimatedTags() int {
+	return tch.handler.EstimatedTags()
+}
+
+// DispatchMetricMap records the tags and series of each metric, and passes the MetricMap to the next handler.
+func (tch *TagCardinalityHandler) DispatchMetricMap(ctx context.Context, mm *gostatsd.MetricMap) {
+	mm.Counters.Each(func(metricName, tagsKey string, c gostatsd.Counter) {
+		tch.observe(metricName, tagsKey, c.Tags)
+	})
+	mm.Gauges.Each(func(metricName, tagsKey string, g gostatsd.Gauge) {
+		tch.observe(metricName, tagsKey, g.Tags)
+	})
+	mm.Timers.Each(func(metricName, tagsKey string, t gostatsd.Timer) {
+		tch.observe(metricName, tagsKey, t.Tags)
+	})
+	mm.Sets.Each(func(metricName, tagsKey string, s gostatsd.Set) {
+		tch.observe(metricName, tagsKey, s.Tags)
+	})
+
+	tch.handler.DispatchMetricMap(ctx, mm)
+}
+
+func (tch *TagCardinalityHandler) observe(metricName, tagsKey string, tags gostatsd.Tags) {
+	tch.metrics.Add(metricName, tagsKey)
+	for _, tag := range tags {
+		// Tags without a value are counted as a key with an empty value
+		key, value := tag, ""
+		if idx := strings.IndexByte(tag, ':'); idx >= 0 {
+			key, value = tag[:idx], tag[idx+1:]
+		}
+		tch.tagKeys.Add(key, value)
+	}
+}
+
+// DispatchEvent passes the event to the next handler.
+func (tch *TagCardinalityHandler) DispatchEvent(ctx context.Context, e *gostatsd.Event) {
+	tch.handler.DispatchEvent(ctx, e)
+}
+
+// WaitForEvents waits for all event-dispatching goroutines to finish.
+func (tch *TagCardinalityHandler) WaitForEvents() {
+	tch.handler.WaitForEvents()
+}
+
+// RunMetricsContext emits the cardinality estimates, and starts tracking again from scratch, every interval.
+func (tch *TagCardinalityHandler) RunMetricsContext(ctx context.Context) {
+	statser := stats.FromContext(ctx)
+	ticker := clock.FromContext(ctx).NewTicker(tch.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			tch.emit(statser)
+		}
+	}
+}
+
+func (tch *TagCardinalityHandler) emit(statser stats.Statser) {
+	tagKeys, tagKeysDiscarded := tch.tagKeys.Reset()
+	metrics, metricsDiscarded := tch.metrics.Reset()
+
+	for key, sketch := range tagKeys {
+		statser.Gauge("tag_cardinality.distinct_values", sketch.Estimate(), gostatsd.Tags{"tag_key:" + key})
+	}
+	for _, m := range topMetricsBySeries(metrics, tch.topMetrics) {
+		statser.Gauge("tag_cardinality.series", m.series, gostatsd.Tags{"metric:" + m.name})
+	}
+	statser.Gauge("tag_cardinality.tag_keys_tracked", float64(len(tagKeys)), nil)
+	statser.Gauge("tag_cardinality.metrics_tracked", float64(len(metrics)), nil)
+	statser.Gauge("tag_cardinality.values_discarded", float64(tagKeysDiscarded+metricsDiscarded), nil)
+}
+
+type metricSeries struct {
+	name   string
+	series float64
+}
+
+// topMetricsBySeries returns up to n metric names with the most estimated series, most first.
+func topMetricsBySeries(metrics map[string]*hyperLogLog, n int) []metricSeries {
+	all := make([]metricSeries, 0, len(metrics))
+	for name, sketch := range metrics {
+		all = append(all, metricSeries{name: name, series: sketch.Estimate()})
+	}
+	return topMetricSeries(all, n)
+}
+
+// topMetricSeries sorts the metrics by series, most first, and returns up to n of them.
+func topMetricSeries(all []metricSeries, n int) []metricSeries {
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].series != all[j].series {
+			return all[i].series > all[j].series
+		}
+		return all[i].name < all[j].name
+	})
+	if len(all) > n {
+		all = all[:n]
+	}
+	return all
+}
@@ -0,0 +1,149 @@
+package statsd
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/stats"
+)
+
+func TestNewTagCardinalityHandlerFromViper(t *testing.T) {
+	t.Parallel()
+	ch := &capturingHandler{}
+
+	assert.Nil(t, NewTagCardinalityHandlerFromViper(viper.New(), ch))
+
+	v := viper.New()
+	v.Set("tag-cardinality.top-metrics", 3)
+	assert.Nil(t, NewTagCardinalityHandlerFromViper(v, ch))
+
+	v.Set("tag-cardinality.interval", "5m")
+	v.Set("tag-cardinality.max-tag-keys", 5)
+	tch := NewTagCardinalityHandlerFromViper(v, ch)
+	require.NotNil(t, tch)
+	assert.Equal(t, 5*time.Minute, tch.interval)
+	assert.Equal(t, 3, tch.topMetrics)
+	assert.Equal(t, 5, tch.maxTagKeys)
+	assert.Equal(t, 1000, tch.maxMetrics)
+}
+
+func TestTagCardinalityHandler(t *testing.T) {
+	t.Parallel()
+	ch := &capturingHandler{}
+	tch := NewTagCardinalityHandler(ch, time.Minute, 2, 10, 10)
+
+	mm := gostatsd.NewMetricMap()
+	for i := 0; i < 200; i++ {
+		tags := gostatsd.Tags{fmt.Sprintf("user:%d", i), fmt.Sprintf("shard:%d", i%20), "env:prod", "canary"}
+		mm.Receive(&gostatsd.Metric{Name: "web.requests", Value: 1, Rate: 1, Tags: tags, Type: gostatsd.COUNTER})
+		if i < 50 {
+			mm.Receive(&gostatsd.Metric{Name: "web.latency", Value: 1, Rate: 1, Tags: tags, Type: gostatsd.TIMER})
+		}
+		if i < 5 {
+			mm.Receive(&gostatsd.Metric{Name: "web.errors", Value: 1, Rate: 1, Tags: tags, Type: gostatsd.GAUGE})
+		}
+	}
+	ctx := context.Background()
+	tch.DispatchMetricMap(ctx, mm)
+	tch.DispatchMetricMap(ctx, mm) // Same series again
+	require.Len(t, ch.mm, 2)
+	assert.Equal(t, mm, ch.mm[0])
+
+	internal := &capturingHandler{}
+	statser := stats.NewInternalStatser(nil, "", "", gostatsd.UnknownSource, internal)
+	tch.emit(statser)
+	statser.NotifyFlush(ctx, 0)
+	require.Len(t, internal.mm, 1)
+
+	gauges := internal.mm[0].Gauges
+	values := gauges["tag_cardinality.distinct_values"]
+	require.Len(t, values, 4)
+	assert.InDelta(t, 200, values["tag_key:user"].Value, 10)
+	assert.InDelta(t, 20, values["tag_key:shard"].Value, 1)
+	assert.InDelta(t, 1, values["tag_key:env"].Value, 0.5)
+	assert.InDelta(t, 1, values["tag_key:canary"].Value, 0.5)
+
+	// Only the top metrics are reported
+	series := gauges["tag_cardinality.series"]
+	require.Len(t, series, 2)
+	assert.InDelta(t, 200, series["metric:web.requests"].Value, 10)
+	assert.InDelta(t, 50, series["metric:web.latency"].Value, 2)
+	assert.EqualValues(t, 4, gauges["tag_cardinality.tag_keys_tracked"][""].Value)
+	assert.EqualValues(t, 3, gauges["tag_cardinality.metrics_tracked"][""].Value)
+	assert.EqualValues(t, 0, gauges["tag_cardinality.values_discarded"][""].Value)
+
+	// Tracking restarts every interval
+	assert.Zero(t, tch.tagKeys.Len())
+	assert.Zero(t, tch.metrics.Len())
+}
+
+func TestTagCardinalityHandlerLimits(t *testing.T) {
+	t.Parallel()
+	tch := NewTagCardinalityHandler(&nopHandler{}, time.Minute, 10, 1, 1)
+
+	mm := gostatsd.NewMetricMap()
+	mm.Receive(&gostatsd.Metric{Name: "a", Value: 1, Rate: 1, Tags: gostatsd.Tags{"x:1", "y:1"}, Type: gostatsd.GAUGE})
+	mm.Receive(&gostatsd.Metric{Name: "b", Value: 1, Rate: 1, Tags: gostatsd.Tags{"x:2"}, Type: gostatsd.GAUGE})
+	tch.DispatchMetricMap(context.Background(), mm)
+
+	tagKeys, tagKeysDiscarded := tch.tagKeys.Reset()
+	metrics, metricsDiscarded := tch.metrics.Reset()
+	assert.Len(t, tagKeys, 1)
+	assert.Len(t, metrics, 1)
+	assert.EqualValues(t, 1, tagKeysDiscarded)
+	assert.EqualValues(t, 1, metricsDiscarded)
+}
+
+func TestTagCardinalityHandlerConcurrent(t *testing.T) {
+	t.Parallel()
+	tch := NewTagCardinalityHandler(&nopHandler{}, time.Minute, 10, 50, 1000)
+
+	var wg sync.WaitGroup
+	for p := 0; p < 8; p++ {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				mm := gostatsd.NewMetricMap()
+				tags := gostatsd.Tags{fmt.Sprintf("k%d:%d", i, p)}
+				mm.Receive(&gostatsd.Metric{Name: "m", Value: 1, Rate: 1, Tags: tags, Type: gostatsd.COUNTER})
+				tch.DispatchMetricMap(context.Background(), mm)
+			}
+		}(p)
+	}
+	wg.Wait()
+
+	// The limit holds across every shard
+	tagKeys, valuesDiscarded := tch.tagKeys.Reset()
+	assert.Len(t, tagKeys, 50)
+	assert.EqualValues(t, 400, valuesDiscarded)
+	for key, sketch := range tagKeys {
+		assert.InDelta(t, 8, sketch.Estimate(), 2, key)
+	}
+	metrics, _ := tch.metrics.Reset()
+	assert.InDelta(t, 800, metrics["m"].Estimate(), 40)
+}
+
+func TestTopMetricsBySeries(t *testing.T) {
+	t.Parallel()
+	metrics := map[string]*hyperLogLog{}
+	for name, series := range map[string]int{"a": 3, "b": 30, "c": 3, "d": 1} {
+		sketch := &hyperLogLog{}
+		for i := 0; i < series; i++ {
+			sketch.Add(fmt.Sprint(i))
+		}
+		metrics[name] = sketch
+	}
+	top := topMetricsBySeries(metrics, 3)
+	require.Len(t, top, 3)
+	assert.Equal(t, []string{"b", "a", "c"}, []string{top[0].name, top[1].name, top[2].name})
+	assert.Len(t, topMetricsBySeries(metrics, 10), 4)
+}
@@ -0,0 +1,160 @@
+package statsd
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"golang.org/x/text/unicode/norm"
+
+	"github.com/atlassian/gostatsd"
+)
+
+// tagNormalization is the set of normalizations applied to one part of a tag.
+type tagNormalization struct {
+	nfc       bool
+	trim      bool
+	lowercase bool
+}
+
+// newTagNormalization parses the names of the normalizations to apply.
+func newTagNormalization(names []string) (tagNormalization, error) {
+	var tn tagNormalization
+	for _, name := range names {
+		switch name {
+		case gostatsd.TagNormalizationLowercase:
+			tn.lowercase = true
+		case gostatsd.TagNormalizationTrim:
+			tn.trim = true
+		case gostatsd.TagNormalizationNFC:
+			tn.nfc = true
+		default:
+			return tagNormalization{}, fmt.Errorf("unknown tag normalization %q", name)
+		}
+	}
+	return tn, nil
+}
+
+// apply returns s normalized.  Unicode normalization is applied first, so the other normalizations see the composed
+// characters.
+func (tn tagNormalization) apply(s string) string {
+	if tn.nfc {
+		s = norm.NFC.String(s)
+	}
+	if tn.trim {
+		s = strings.TrimSpace(s)
+	}
+	if tn.lowercase {
+		s = strings.ToLower(s)
+	}
+	return s
+}
+
+// TagNormalizationHandler normalizes the keys and values of the tags of metrics and events, so tags which only differ
+// by case, surrounding whitespace, or Unicode representation are aggregated together.
+type TagNormalizationHandler struct {
+	handler gostatsd.PipelineHandler
+	keys    tagNormalization
+	values  tagNormalization
+}
+
+// NewTagNormalizationHandler initialises a new handler which normalizes tag keys and values with the named
+// normalizations, before passing metrics and events to the next handler.  A tag without a value is treated as a key.
+func NewTagNormalizationHandler(handler gostatsd.PipelineHandler, keys, values []string) (*TagNormalizationHandler, error) {
+	keyNormalization, err := newTagNormalization(keys)
+	if err != nil {
+		return nil, err
+	}
+	valueNormalization, err := newTagNormalization(values)
+	if err != nil {
+		return nil, err
+	}
+	return &TagNormalizationHandler{
+		handler: handler,
+		keys:    keyNormalization,
+		values:  valueNormalization,
+	}, nil
+}
+
+// EstimatedTags returns a guess for how many tags to pre-allocate
+func (tnh *TagNormalizationHandler) EstimatedTags() int {
+	return tnh.handler.EstimatedTags()
+}
+
+// DispatchMetricMap normalizes the tags of each metric in the map, merging the series which become the same, and
+// passes it to the next stage in the pipeline.
+func (tnh *TagNormalizationHandler) DispatchMetricMap(ctx context.Context, mm *gostatsd.MetricMap) {
+	mmNew := gostatsd.NewMetricMap()
+
+	mm.Counters.Each(func(metricName, tagsKey string, c gostatsd.Counter) {
+		tagsKey, c.Tags = tnh.normalizeSeries(tagsKey, c.Source, c.Tags)
+		mmNew.MergeCounter(metricName, tagsKey, c)
+	})
+	mm.Gauges.Each(func(metricName, tagsKey string, g gostatsd.Gauge) {
+		tagsKey, g.Tags = tnh.normalizeSeries(tagsKey, g.Source, g.Tags)
+		mmNew.MergeGauge(metricName, tagsKey, g)
+	})
+	mm.Timers.Each(func(metricName, tagsKey string, t gostatsd.Timer) {
+		tagsKey, t.Tags = tnh.normalizeSeries(tagsKey, t.Source, t.Tags)
+		mmNew.MergeTimer(metricName, tagsKey, t)
+	})
+	mm.Sets.Each(func(metricName, tagsKey string, s gostatsd.Set) {
+		tagsKey, s.Tags = tnh.normalizeSeries(tagsKey, s.Source, s.Tags)
+		mmNew.MergeSet(metricName, tagsKey, s)
+	})
+
+	if !mmNew.IsEmpty() {
+		tnh.handler.DispatchMetricMap(ctx, mmNew)
+	}
+}
+
+// normalizeSeries returns the tags key and tags to send a series with.
+func (tnh *TagNormalizationHandler) normalizeSeries(tagsKey string, source gostatsd.Source, tags gostatsd.Tags) (string, gostatsd.Tags) {
+	normalized, changed := tnh.normalize(tags)
+	if !changed {
+		return tagsKey, tags
+	}
+	return gostatsd.FormatTagsKey(source, normalized), normalized
+}
+
+// normalize returns the normalized tags, and true if any of them changed.  The tags are copied only if they change,
+// as they may be shared with other metrics.
+func (tnh *TagNormalizationHandler) normalize(tags gostatsd.Tags) (gostatsd.Tags, bool) {
+	var normalized gostatsd.Tags
+	for i, tag := range tags {
+		var n string
+		if idx := strings.IndexByte(tag, ':'); idx >= 0 {
+			n = tnh.keys.apply(tag[:idx]) + ":" + tnh.values.apply(tag[idx+1:])
+		} else {
+			n = tnh.keys.apply(tag)
+		}
+		if n == tag {
+			if normalized != nil {
+				normalized = append(normalized, tag)
+			}
+			continue
+		}
+		if normalized == nil {
+			normalized = make(gostatsd.Tags, i, len(tags))
+			copy(normalized, tags[:i])
+		}
+		normalized = append(normalized, n)
+	}
+	if normalized == nil {
+		return tags, false
+	}
+	return uniqueTags(normalized, gostatsd.Tags{}), true
+}
+
+// DispatchEvent normalizes the tags of the event and passes it to the next stage in the pipeline.
+func (tnh *TagNormalizationHandler) DispatchEvent(ctx context.Context, e *gostatsd.Event) {
+	if normalized, changed := tnh.normalize(e.Tags); changed {
+		e.Tags = normalized
+	}
+	tnh.handler.DispatchEvent(ctx, e)
+}
+
+// WaitForEvents waits for all event-dispatching goroutines to finish.
+func (tnh *TagNormalizationHandler) WaitForEvents() {
+	tnh.handler.WaitForEvents()
+}
@@ -0,0 +1,98 @@
+package statsd
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/atlassian/gostatsd"
+)
+
+func TestTagNormalizationCollapsesSeries(t *testing.T) {
+	t.Parallel()
+	tch := &capturingHandler{}
+	tnh, err := NewTagNormalizationHandler(tch, []string{"lowercase", "trim"}, []string{"lowercase", "trim", "nfc"})
+	require.NoError(t, err)
+
+	tnh.DispatchMetricMap(context.Background(), requiredTagsMetrics(
+		gostatsd.Tags{"env:prod", "dish:caf\u00e9"},
+		gostatsd.Tags{"Env:Prod", "DISH:CAF\u00c9"},
+		gostatsd.Tags{" env : PROD ", "dish:cafe\u0301"}, // A decomposed é
+		// Keys are not converted to NFC, so the decomposed é remains a separate series
+		gostatsd.Tags{"env:prod", "env:Prod", "dish:caf\u00e9", "cafe\u0301"},
+	))
+
+	require.Len(t, tch.mm, 1)
+	mm := tch.mm[0]
+	for _, tagsKey := range []string{"dish:caf\u00e9,env:prod", "cafe\u0301,dish:caf\u00e9,env:prod"} {
+		assert.Contains(t, mm.Counters["c"], tagsKey)
+		assert.Contains(t, mm.Gauges["g"], tagsKey)
+		assert.Contains(t, mm.Timers["t"], tagsKey)
+		assert.Contains(t, mm.Sets["s"], tagsKey)
+	}
+	assert.Len(t, mm.Counters["c"], 2)
+	assert.Len(t, mm.Gauges["g"], 2)
+	assert.Len(t, mm.Timers["t"], 2)
+	assert.Len(t, mm.Sets["s"], 2)
+	assert.EqualValues(t, 3, mm.Counters["c"]["dish:caf\u00e9,env:prod"].Value)
+	assert.Len(t, mm.Timers["t"]["dish:caf\u00e9,env:prod"].Values, 3)
+	assert.ElementsMatch(t, gostatsd.Tags{"cafe\u0301", "dish:caf\u00e9", "env:prod"}, mm.Counters["c"]["cafe\u0301,dish:caf\u00e9,env:prod"].Tags)
+}
+
+func TestTagNormalizationParts(t *testing.T) {
+	t.Parallel()
+	for name, tc := range map[string]struct {
+		keys, values []string
+		expected     string
+	}{
+		"keys":   {keys: []string{"lowercase"}, expected: "env:Prod,host"},
+		"values": {values: []string{"lowercase"}, expected: "Env:prod,HOST"},
+		"both":   {keys: []string{"lowercase"}, values: []string{"lowercase"}, expected: "env:prod,host"},
+		"none":   {expected: "Env:Prod,HOST"},
+	} {
+		tch := &capturingHandler{}
+		tnh, err := NewTagNormalizationHandler(tch, tc.keys, tc.values)
+		require.NoError(t, err, name)
+		mm := gostatsd.NewMetricMap()
+		mm.Receive(&gostatsd.Metric{Type: gostatsd.COUNTER, Name: "c", Value: 1, Rate: 1, Tags: gostatsd.Tags{"Env:Prod", "HOST"}})
+		tnh.DispatchMetricMap(context.Background(), mm)
+		require.Len(t, tch.mm, 1, name)
+		assert.Contains(t, tch.mm[0].Counters["c"], tc.expected, name)
+	}
+}
+
+func TestTagNormalizationUnchangedTagsAreNotCopied(t *testing.T) {
+	t.Parallel()
+	tnh, err := NewTagNormalizationHandler(&nopHandler{}, []string{"lowercase"}, []string{"lowercase"})
+	require.NoError(t, err)
+	tags := gostatsd.Tags{"env:prod", "host"}
+	normalized, changed := tnh.normalize(tags)
+	require.False(t, changed)
+	assert.Equal(t, &tags[0], &normalized[0])
+
+	tags = gostatsd.Tags{"env:prod", "Host"}
+	normalized, changed = tnh.normalize(tags)
+	require.True(t, changed)
+	assert.Equal(t, gostatsd.Tags{"env:prod", "host"}, normalized)
+	assert.Equal(t, gostatsd.Tags{"env:prod", "Host"}, tags)
+}
+
+func TestTagNormalizationEvent(t *testing.T) {
+	t.Parallel()
+	tch := &capturingHandler{}
+	tnh, err := NewTagNormalizationHandler(tch, []string{"lowercase"}, nil)
+	require.NoError(t, err)
+	tnh.DispatchEvent(context.Background(), &gostatsd.Event{Title: "e", Tags: gostatsd.Tags{"Env:Prod"}})
+	require.Len(t, tch.e, 1)
+	assert.Equal(t, gostatsd.Tags{"env:Prod"}, tch.e[0].Tags)
+}
+
+func TestTagNormalizationUnknown(t *testing.T) {
+	t.Parallel()
+	_, err := NewTagNormalizationHandler(&nopHandler{}, []string{"uppercase"}, nil)
+	require.Error(t, err)
+	_, err = NewTagNormalizationHandler(&nopHandler{}, nil, []string{"trim", "NFC"})
+	require.Error(t, err)
+}
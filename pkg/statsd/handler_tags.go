@@ -63,6 +63,7 @@ func (th *TagHandler) DispatchMetricMap(ctx context.Context, mm *gostatsd.Metric
 			newTagsKey := gostatsd.FormatTagsKey(cOriginal.Source, cOriginal.Tags)
 			if cs, ok := mmNew.Counters[metricName]; ok {
 				if cNew, ok := cs[newTagsKey]; ok {
+					cNew.MergeSampleRate(&cOriginal)
 					cNew.Value += cOriginal.Value
 					cNew.Timestamp = gostatsd.NanoMax(cNew.Timestamp, cOriginal.Timestamp)
 					cs[newTagsKey] = cNew
@@ -29,7 +29,7 @@ func TestTagStripMergesCounters(t *testing.T) {
 
 	expected := gostatsd.NewMetricMap()
 	expected.Counters["metric"] = map[string]gostatsd.Counter{
-		"key:value":             {Timestamp: 20, Value: 30, Tags: gostatsd.Tags{"key:value"}},
+		"key:value":             {Timestamp: 20, Value: 30, Tags: gostatsd.Tags{"key:value"}, SampleRate: 21.0 / 30},
 		"key3:value3,key:value": {Timestamp: 30, Value: 1, Tags: gostatsd.Tags{"key3:value3", "key:value"}},
 	}
 
@@ -0,0 +1,93 @@
+package statsd
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+)
+
+// TTLHandler removes the TTL tag from metrics, and sets the expiry interval of their series from it.  It runs before
+// metrics are split between the aggregators, so a series with and without the tag, or with different values, is
+// aggregated by the same aggregator as a single series.
+type TTLHandler struct {
+	handler      gostatsd.PipelineHandler
+	ttlTagPrefix string
+}
+
+// NewTTLHandler initialises a new handler which removes the tag named ttlTag from metrics, before passing them to the
+// next handler.
+func NewTTLHandler(handler gostatsd.PipelineHandler, ttlTag string) *TTLHandler {
+	return &TTLHandler{
+		handler:      handler,
+		ttlTagPrefix: ttlTag + ":",
+	}
+}
+
+// EstimatedTags returns a guess for how many tags to pre-allocate
+func (th *TTLHandler) EstimatedTags() int {
+	return th.handler.EstimatedTags()
+}
+
+// DispatchMetricMap removes the TTL tag from each metric in the map, merging the metrics which are now the same
+// series, and passes it to the next stage in the pipeline.
+func (th *TTLHandler) DispatchMetricMap(ctx context.Context, mm *gostatsd.MetricMap) {
+	mmNew := gostatsd.NewMetricMap()
+
+	mm.Counters.Each(func(metricName, tagsKey string, c gostatsd.Counter) {
+		tagsKey, c.Tags, c.Expiry = th.extractTTL(tagsKey, c.Source, c.Tags, c.Expiry)
+		mmNew.MergeCounter(metricName, tagsKey, c)
+	})
+	mm.Gauges.Each(func(metricName, tagsKey string, g gostatsd.Gauge) {
+		tagsKey, g.Tags, g.Expiry = th.extractTTL(tagsKey, g.Source, g.Tags, g.Expiry)
+		mmNew.MergeGauge(metricName, tagsKey, g)
+	})
+	mm.Timers.Each(func(metricName, tagsKey string, t gostatsd.Timer) {
+		tagsKey, t.Tags, t.Expiry = th.extractTTL(tagsKey, t.Source, t.Tags, t.Expiry)
+		mmNew.MergeTimer(metricName, tagsKey, t)
+	})
+	mm.Sets.Each(func(metricName, tagsKey string, s gostatsd.Set) {
+		tagsKey, s.Tags, s.Expiry = th.extractTTL(tagsKey, s.Source, s.Tags, s.Expiry)
+		mmNew.MergeSet(metricName, tagsKey, s)
+	})
+
+	if !mmNew.IsEmpty() {
+		th.handler.DispatchMetricMap(ctx, mmNew)
+	}
+}
+
+// extractTTL removes the TTL tag from a series, returning the tags key and tags without it, and the expiry interval
+// given by the tag.  If the tag is not a valid positive duration, the expiry is unchanged, so the series falls back to
+// the expiry interval for its type.  The tags are copied rather than modified, as they may be shared.
+func (th *TTLHandler) extractTTL(tagsKey string, source gostatsd.Source, tags gostatsd.Tags, expiry time.Duration) (string, gostatsd.Tags, time.Duration) {
+	if !strings.Contains(tagsKey, th.ttlTagPrefix) {
+		return tagsKey, tags, expiry
+	}
+	stripped := make(gostatsd.Tags, 0, len(tags))
+	found := false
+	for _, tag := range tags {
+		if !strings.HasPrefix(tag, th.ttlTagPrefix) {
+			stripped = append(stripped, tag)
+			continue
+		}
+		found = true
+		if ttl, err := time.ParseDuration(tag[len(th.ttlTagPrefix):]); err == nil && ttl > 0 {
+			expiry = ttl
+		}
+	}
+	if !found {
+		return tagsKey, tags, expiry
+	}
+	return gostatsd.FormatTagsKey(source, stripped), stripped, expiry
+}
+
+// DispatchEvent passes the event to the next stage in the pipeline unchanged.
+func (th *TTLHandler) DispatchEvent(ctx context.Context, e *gostatsd.Event) {
+	th.handler.DispatchEvent(ctx, e)
+}
+
+// WaitForEvents waits for all event-dispatching goroutines to finish.
+func (th *TTLHandler) WaitForEvents() {
+	th.handler.WaitForEvents()
+}
@@ -0,0 +1,147 @@
+package statsd
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ash2k/stager/wait"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/atlassian/gostatsd"
+)
+
+// receiveTTL passes the metrics through a TTLHandler for the _ttl tag to the aggregator.
+func receiveTTL(ma *MetricAggregator, mm *gostatsd.MetricMap) {
+	tch := &capturingHandler{}
+	NewTTLHandler(tch, "_ttl").DispatchMetricMap(context.Background(), mm)
+	for _, mm := range tch.mm {
+		ma.ReceiveMap(mm)
+	}
+}
+
+func newTTLAggregator() *MetricAggregator {
+	return NewMetricAggregator(nil, time.Minute, time.Minute, time.Minute, time.Minute, gostatsd.TimerSubtypes{}, math.MaxUint32)
+}
+
+func TestTTLHandlerTag(t *testing.T) {
+	t.Parallel()
+	ma := newTTLAggregator()
+	mm := gostatsd.NewMetricMap()
+	mm.Receive(&gostatsd.Metric{Name: "c", Value: 1, Rate: 1, Tags: gostatsd.Tags{"a:1", "_ttl:30s"}, Type: gostatsd.COUNTER})
+	mm.Receive(&gostatsd.Metric{Name: "c", Value: 2, Rate: 1, Tags: gostatsd.Tags{"a:1"}, Type: gostatsd.COUNTER})
+	mm.Receive(&gostatsd.Metric{Name: "g", Value: 1, Rate: 1, Tags: gostatsd.Tags{"_ttl:2m"}, Type: gostatsd.GAUGE})
+	mm.Receive(&gostatsd.Metric{Name: "s", StringValue: "x", Rate: 1, Tags: gostatsd.Tags{"_ttl:10s", "b"}, Type: gostatsd.SET})
+	mm.Receive(&gostatsd.Metric{Name: "t", Value: 1, Rate: 1, Tags: gostatsd.Tags{"_ttl:5s"}, Type: gostatsd.TIMER})
+	receiveTTL(ma, mm)
+
+	// The tag is stripped, and the series merged with the untagged series
+	require.Len(t, ma.metricMap.Counters["c"], 1)
+	counter := ma.metricMap.Counters["c"]["a:1"]
+	assert.EqualValues(t, 3, counter.Value)
+	assert.Equal(t, gostatsd.Tags{"a:1"}, counter.Tags)
+	assert.Equal(t, 30*time.Second, counter.Expiry)
+	assert.Equal(t, 2*time.Minute, ma.metricMap.Gauges["g"][""].Expiry)
+	assert.Equal(t, 10*time.Second, ma.metricMap.Sets["s"]["b"].Expiry)
+	assert.Equal(t, gostatsd.Tags{"b"}, ma.metricMap.Sets["s"]["b"].Tags)
+	assert.Equal(t, 5*time.Second, ma.metricMap.Timers["t"][""].Expiry)
+}
+
+func TestTTLHandlerTagFallback(t *testing.T) {
+	t.Parallel()
+	ma := newTTLAggregator()
+	mm := gostatsd.NewMetricMap()
+	mm.Receive(&gostatsd.Metric{Name: "invalid", Value: 1, Rate: 1, Tags: gostatsd.Tags{"_ttl:soon"}, Type: gostatsd.COUNTER})
+	mm.Receive(&gostatsd.Metric{Name: "negative", Value: 1, Rate: 1, Tags: gostatsd.Tags{"_ttl:-5s"}, Type: gostatsd.COUNTER})
+	mm.Receive(&gostatsd.Metric{Name: "similar", Value: 1, Rate: 1, Tags: gostatsd.Tags{"x_ttl:5s"}, Type: gostatsd.COUNTER})
+	receiveTTL(ma, mm)
+
+	assert.Contains(t, ma.metricMap.Counters["invalid"], "")
+	assert.Zero(t, ma.metricMap.Counters["invalid"][""].Expiry)
+	assert.Zero(t, ma.metricMap.Counters["negative"][""].Expiry)
+	assert.Equal(t, gostatsd.Tags{"x_ttl:5s"}, ma.metricMap.Counters["similar"]["x_ttl:5s"].Tags)
+	assert.Zero(t, ma.metricMap.Counters["similar"]["x_ttl:5s"].Expiry)
+}
+
+func TestResetTTLTag(t *testing.T) {
+	t.Parallel()
+	ma := newTTLAggregator()
+	now := time.Now()
+	ma.now = func() time.Time { return now }
+
+	mm := gostatsd.NewMetricMap()
+	for _, tags := range []gostatsd.Tags{{"_ttl:10s", "short"}, {"_ttl:5m", "long"}, {"_ttl:bad", "invalid"}, {"default"}} {
+		mm.Receive(&gostatsd.Metric{Name: "c", Value: 1, Rate: 1, Tags: tags, Type: gostatsd.COUNTER, Timestamp: gostatsd.Nanotime(now.UnixNano())})
+		mm.Receive(&gostatsd.Metric{Name: "t", Value: 1, Rate: 1, Tags: tags, Type: gostatsd.TIMER, Timestamp: gostatsd.Nanotime(now.UnixNano())})
+	}
+	receiveTTL(ma, mm)
+
+	now = now.Add(30 * time.Second)
+	ma.Reset()
+	assert.Len(t, ma.metricMap.Counters["c"], 3)
+	assert.NotContains(t, ma.metricMap.Counters["c"], "short")
+	assert.Len(t, ma.metricMap.Timers["t"], 3)
+	assert.NotContains(t, ma.metricMap.Timers["t"], "short")
+
+	// The override survives the reset, and the others fall back to the default of a minute
+	now = now.Add(time.Minute)
+	ma.Reset()
+	assert.Len(t, ma.metricMap.Counters["c"], 1)
+	assert.Equal(t, 5*time.Minute, ma.metricMap.Counters["c"]["long"].Expiry)
+	assert.Len(t, ma.metricMap.Timers["t"], 1)
+	assert.Contains(t, ma.metricMap.Timers["t"], "long")
+}
+
+func TestTTLHandlerSingleAggregatorPerSeries(t *testing.T) {
+	t.Parallel()
+	factory := &agrFactory{
+		expiryIntervalCounter: time.Minute,
+		expiryIntervalGauge:   time.Minute,
+		expiryIntervalSet:     time.Minute,
+		expiryIntervalTimer:   time.Minute,
+		histogramLimit:        math.MaxUint32,
+	}
+	bh := NewBackendHandler(nil, 0, 4, 0, factory)
+	var wgFinish wait.Group
+	defer wgFinish.Wait()
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	wgFinish.StartWithContext(ctx, bh.Run)
+
+	// Without the tag, with it, and with another value, which would each be split to a different aggregator by the
+	// tags key if the tag was still there
+	mm := gostatsd.NewMetricMap()
+	for i := 0; i < 20; i++ {
+		name := fmt.Sprintf("c.%d", i)
+		for _, tags := range []gostatsd.Tags{{"a:1"}, {"a:1", "_ttl:30s"}, {"a:1", "_ttl:1m"}} {
+			mm.Receive(&gostatsd.Metric{Name: name, Value: 1, Rate: 1, Tags: tags, Type: gostatsd.COUNTER})
+		}
+	}
+	NewTTLHandler(bh, "_ttl").DispatchMetricMap(ctx, mm)
+
+	var lock sync.Mutex
+	series := map[string]int{}
+	values := map[string]int64{}
+	bh.Process(ctx, func(workerId int, aggr Aggregator) {
+		aggr.Flush(time.Second)
+		aggr.Process(func(mm *gostatsd.MetricMap) {
+			lock.Lock()
+			defer lock.Unlock()
+			mm.Counters.Each(func(metricName, tagsKey string, c gostatsd.Counter) {
+				assert.Equal(t, "a:1", tagsKey)
+				series[metricName]++
+				values[metricName] += c.Value
+			})
+		})
+	})()
+
+	require.Len(t, series, 20)
+	for name, count := range series {
+		assert.Equal(t, 1, count, name)
+		assert.EqualValues(t, 3, values[name], name)
+	}
+}
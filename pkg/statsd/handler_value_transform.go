@@ -0,0 +1,241 @@
+package statsd
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"github.com/atlassian/gostatsd"
+)
+
+// ValueTransform converts the values of the metrics matching Match, such as from nanoseconds to milliseconds, by
+// multiplying them by Multiply, dividing them by Divide, and then adding Offset.  Match is either an exact name, a
+// prefix ending in `*`, or a regular expression prefixed with `regex:`.  Multiply and Divide must be positive, so the
+// order of values is kept, which the buckets of histograms rely on.
+type ValueTransform struct {
+	Match    string
+	Multiply float64
+	Divide   float64
+	Offset   float64
+
+	regex *regexp.Regexp
+}
+
+// NewValueTransformFromViper creates a new ValueTransform given a *viper.Viper
+func NewValueTransformFromViper(v *viper.Viper) (*ValueTransform, error) {
+	v.SetDefault("multiply", 1)
+	v.SetDefault("divide", 1)
+	v.SetDefault("offset", 0)
+	return NewValueTransform(v.GetString("match"), v.GetFloat64("multiply"), v.GetFloat64("divide"), v.GetFloat64("offset"))
+}
+
+// NewValueTransformsFromViper creates a ValueTransform for each name in the `value-transforms` list, read from the
+// `value-transform.<name>` section.
+func NewValueTransformsFromViper(v *viper.Viper) ([]*ValueTransform, error) {
+	var transforms []*ValueTransform
+	for _, name := range v.GetStringSlice("value-transforms") {
+		vTransform := v.Sub("value-transform." + name)
+		if vTransform == nil {
+			logrus.Warnf("Value transform doesn't exist: %v", name)
+			continue
+		}
+		vt, err := NewValueTransformFromViper(vTransform)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value transform %s: %v", name, err)
+		}
+		transforms = append(transforms, vt)
+		logrus.Infof("Loaded value transform %v", name)
+	}
+	return transforms, nil
+}
+
+// NewValueTransform creates a ValueTransform, compiling match if it is a regular expression.
+func NewValueTransform(match string, multiply, divide, offset float64) (*ValueTransform, error) {
+	if match == "" || match == "regex:" {
+		return nil, fmt.Errorf("match must be set")
+	}
+	if !(multiply > 0) {
+		return nil, fmt.Errorf("multiply must be positive")
+	}
+	if !(divide > 0) {
+		return nil, fmt.Errorf("divide must be positive")
+	}
+	vt := &ValueTransform{Match: match, Multiply: multiply, Divide: divide, Offset: offset}
+	if strings.HasPrefix(match, "regex:") {
+		regex, err := regexp.Compile(match[len("regex:"):])
+		if err != nil {
+			return nil, err
+		}
+		vt.regex = regex
+	}
+	return vt, nil
+}
+
+// matches returns whether the transform applies to metricName.
+func (vt *ValueTransform) matches(metricName string) bool {
+	switch {
+	case vt.regex != nil:
+		return vt.regex.MatchString(metricName)
+	case strings.HasSuffix(vt.Match, "*"):
+		return strings.HasPrefix(metricName, vt.Match[:len(vt.Match)-1])
+	default:
+		return metricName == vt.Match
+	}
+}
+
+// apply returns the transformed value.
+func (vt *ValueTransform) apply(value float64) float64 {
+	return value*vt.Multiply/vt.Divide + vt.Offset
+}
+
+// applyTimer returns the timer with its values, digest, and bucket thresholds transformed.  They are copied, as the
+// timer may be shared.
+func (vt *ValueTransform) applyTimer(t gostatsd.Timer) gostatsd.Timer {
+	if t.Values != nil {
+		values := make([]float64, len(t.Values))
+		for i, value := range t.Values {
+			values[i] = vt.apply(value)
+		}
+		t.Values = values
+	}
+	if t.Digest != nil {
+		t.Digest = t.Digest.Transform(vt.Multiply/vt.Divide, vt.Offset)
+	}
+	if t.Buckets != nil {
+		buckets := make(map[gostatsd.HistogramThreshold]int, len(t.Buckets))
+		for threshold, count := range t.Buckets {
+			// +Inf stays +Inf
+			buckets[gostatsd.HistogramThreshold(vt.apply(float64(threshold)))] = count
+		}
+		t.Buckets = buckets
+	}
+	return t
+}
+
+// ValueTransformHandler converts the values of gauges and timers before they are aggregated, so units are normalised
+// at ingest, without changing the clients.  Counters are not transformed, as they are summed in to integers as they
+// are received, so they can't be scaled accurately, and a warning is logged the first time a counter matches a
+// transform.  Sets are not transformed either, as they have no numeric value.  The thresholds of the buckets of
+// pre-aggregated histograms, and the digests of forwarded timers, are transformed as well.
+type ValueTransformHandler struct {
+	counterWarned uint32 // 1 once a counter which matches a transform has been warned about, accessed atomically
+
+	handler    gostatsd.PipelineHandler
+	transforms []*ValueTransform
+}
+
+// NewValueTransformHandler initialises a new handler which transforms the values of metrics by the first of the
+// transforms they match, before passing them to the next handler.
+func NewValueTransformHandler(handler gostatsd.PipelineHandler, transforms []*ValueTransform) *ValueTransformHandler {
+	return &ValueTransformHandler{
+		handler:    handler,
+		transforms: transforms,
+	}
+}
+
+// EstimatedTags returns a guess for how many tags to pre-allocate
+func (vth *ValueTransformHandler) EstimatedTags() int {
+	return vth.handler.EstimatedTags()
+}
+
+// transform returns the transform which applies to metricName, or nil if there is none.
+func (vth *ValueTransformHandler) transform(metricName string) *ValueTransform {
+	for _, vt := range vth.transforms {
+		if vt.matches(metricName) {
+			return vt
+		}
+	}
+	return nil
+}
+
+// warnCounters warns the first time one of counters matches a transform, as it is not transformed, which is otherwise
+// easy to miss when a transform matches metrics of every type.
+func (vth *ValueTransformHandler) warnCounters(counters gostatsd.Counters) {
+	for metricName := range counters {
+		vt := vth.transform(metricName)
+		if vt == nil {
+			continue
+		}
+		if atomic.CompareAndSwapUint32(&vth.counterWarned, 0, 1) {
+			logrus.WithFields(logrus.Fields{
+				"match":  vt.Match,
+				"metric": metricName,
+			}).Warn("value-transform matches a counter, which is not transformed")
+		}
+		return
+	}
+}
+
+// DispatchMetricMap transforms the values of the gauges and timers in the map, and passes it to the next stage in the
+// pipeline.  Only the metrics which are transformed are copied, the rest of the map is passed on as it is.
+func (vth *ValueTransformHandler) DispatchMetricMap(ctx context.Context, mm *gostatsd.MetricMap) {
+	if atomic.LoadUint32(&vth.counterWarned) == 0 {
+		vth.warnCounters(mm.Counters)
+	}
+
+	var mmNew *gostatsd.MetricMap
+	copyMap := func() {
+		if mmNew != nil {
+			return
+		}
+		mmNew = &gostatsd.MetricMap{
+			Counters: mm.Counters,
+			Timers:   make(gostatsd.Timers, len(mm.Timers)),
+			Gauges:   make(gostatsd.Gauges, len(mm.Gauges)),
+			Sets:     mm.Sets,
+		}
+		for metricName, timers := range mm.Timers {
+			mmNew.Timers[metricName] = timers
+		}
+		for metricName, gauges := range mm.Gauges {
+			mmNew.Gauges[metricName] = gauges
+		}
+	}
+
+	for metricName, gauges := range mm.Gauges {
+		vt := vth.transform(metricName)
+		if vt == nil {
+			continue
+		}
+		copyMap()
+		transformed := make(map[string]gostatsd.Gauge, len(gauges))
+		for tagsKey, g := range gauges {
+			g.Value = vt.apply(g.Value)
+			transformed[tagsKey] = g
+		}
+		mmNew.Gauges[metricName] = transformed
+	}
+	for metricName, timers := range mm.Timers {
+		vt := vth.transform(metricName)
+		if vt == nil {
+			continue
+		}
+		copyMap()
+		transformed := make(map[string]gostatsd.Timer, len(timers))
+		for tagsKey, t := range timers {
+			transformed[tagsKey] = vt.applyTimer(t)
+		}
+		mmNew.Timers[metricName] = transformed
+	}
+
+	if mmNew == nil {
+		vth.handler.DispatchMetricMap(ctx, mm)
+		return
+	}
+	vth.handler.DispatchMetricMap(ctx, mmNew)
+}
+
+// DispatchEvent passes the event to the next stage in the pipeline unchanged, as events have no value.
+func (vth *ValueTransformHandler) DispatchEvent(ctx context.Context, e *gostatsd.Event) {
+	vth.handler.DispatchEvent(ctx, e)
+}
+
+// WaitForEvents waits for all event-dispatching goroutines to finish.
+func (vth *ValueTransformHandler) WaitForEvents() {
+	vth.handler.WaitForEvents()
+}
@@ -0,0 +1,147 @@
+package statsd
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/tdigest"
+)
+
+func TestValueTransform(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		match    string
+		name     string
+		expected float64
+		matched  bool
+	}{
+		{match: "db.query_ns", name: "db.query_ns", expected: 1.5, matched: true},
+		{match: "db.query_ns", name: "db.query_ns.p99"},
+		{match: "db.*", name: "db.rows", expected: 1.5, matched: true},
+		{match: "db.*", name: "cache.db.rows"},
+		{match: `regex:_ns$`, name: "http.latency_ns", expected: 1.5, matched: true},
+		{match: `regex:_ns$`, name: "http.latency_ms"},
+	}
+	for _, tc := range tests {
+		vt, err := NewValueTransform(tc.match, 3, 2, 0)
+		require.NoError(t, err)
+		assert.Equal(t, tc.matched, vt.matches(tc.name), "%s -> %s", tc.match, tc.name)
+		if tc.matched {
+			assert.Equal(t, tc.expected, vt.apply(1), "%s -> %s", tc.match, tc.name)
+		}
+	}
+
+	vt, err := NewValueTransform("temperature_f", 5, 9, -160.0/9)
+	require.NoError(t, err)
+	assert.InDelta(t, 100, vt.apply(212), 1e-9)
+
+	for _, invalid := range []string{"", "regex:", "regex:("} {
+		_, err := NewValueTransform(invalid, 1, 1, 0)
+		assert.Error(t, err, invalid)
+	}
+	for _, scale := range [][2]float64{{1, 0}, {1, -1}, {0, 1}, {-1, 1}, {math.NaN(), 1}} {
+		_, err = NewValueTransform("a", scale[0], scale[1], 0)
+		assert.Error(t, err, "multiply %v, divide %v", scale[0], scale[1])
+	}
+}
+
+func TestValueTransformHandlerDigestsAndBuckets(t *testing.T) {
+	t.Parallel()
+	vt, err := NewValueTransform("latency_ns", 1, 1e6, 0)
+	require.NoError(t, err)
+	tch := &capturingHandler{}
+	vth := NewValueTransformHandler(tch, []*ValueTransform{vt})
+
+	digest := tdigest.New(tdigest.DefaultCompression)
+	for _, value := range []float64{2e6, 4e6, 9e6} {
+		digest.Add(value)
+	}
+	buckets := map[gostatsd.HistogramThreshold]int{5e6: 2, 10e6: 3, gostatsd.HistogramThreshold(math.Inf(1)): 3}
+	mm := gostatsd.NewMetricMap()
+	mm.Timers["latency_ns"] = map[string]gostatsd.Timer{
+		"digest":  {Digest: digest, SampledCount: 3},
+		"buckets": {Buckets: buckets, SampledCount: 3},
+	}
+	vth.DispatchMetricMap(context.Background(), mm)
+	require.Len(t, tch.mm, 1)
+
+	transformed := tch.mm[0].Timers["latency_ns"]["digest"].Digest
+	assert.EqualValues(t, 3, transformed.Count())
+	assert.InDelta(t, 2, transformed.Min(), 1e-9)
+	assert.InDelta(t, 9, transformed.Max(), 1e-9)
+	assert.InDelta(t, 15, transformed.Sum(), 1e-9)
+	assert.InDelta(t, 4+16+81, transformed.SumSquares(), 1e-9)
+	var means []float64
+	for _, c := range transformed.Centroids() {
+		means = append(means, c.Mean)
+	}
+	assert.InDeltaSlice(t, []float64{2, 4, 9}, means, 1e-9)
+	assert.Equal(t, map[gostatsd.HistogramThreshold]int{5: 2, 10: 3, gostatsd.HistogramThreshold(math.Inf(1)): 3},
+		tch.mm[0].Timers["latency_ns"]["buckets"].Buckets)
+
+	// The received map isn't changed
+	assert.EqualValues(t, 2e6, digest.Min())
+	assert.Equal(t, map[gostatsd.HistogramThreshold]int{5e6: 2, 10e6: 3, gostatsd.HistogramThreshold(math.Inf(1)): 3}, buckets)
+}
+
+func TestValueTransformHandlerAggregates(t *testing.T) {
+	t.Parallel()
+	v := viper.New()
+	v.Set("value-transforms", []string{"ns-to-ms", "bytes-to-mb"})
+	v.Set("value-transform.ns-to-ms.match", "regex:_ns$")
+	v.Set("value-transform.ns-to-ms.divide", 1e6)
+	v.Set("value-transform.bytes-to-mb.match", "memory.*")
+	v.Set("value-transform.bytes-to-mb.divide", 1024*1024)
+	transforms, err := NewValueTransformsFromViper(v)
+	require.NoError(t, err)
+	require.Len(t, transforms, 2)
+	tch := &capturingHandler{}
+	vth := NewValueTransformHandler(tch, transforms)
+
+	mm := gostatsd.NewMetricMap()
+	for _, value := range []float64{2e6, 4e6, 9e6} {
+		mm.Receive(&gostatsd.Metric{Type: gostatsd.TIMER, Name: "db.query_ns", Value: value, Rate: 1})
+	}
+	mm.Receive(&gostatsd.Metric{Type: gostatsd.GAUGE, Name: "memory.rss", Value: 512 * 1024 * 1024, Rate: 1})
+	mm.Receive(&gostatsd.Metric{Type: gostatsd.GAUGE, Name: "queue.depth", Value: 7, Rate: 1})
+	mm.Receive(&gostatsd.Metric{Type: gostatsd.COUNTER, Name: "memory.allocs", Value: 3, Rate: 1})
+	assert.EqualValues(t, 0, vth.counterWarned)
+	vth.DispatchMetricMap(context.Background(), mm)
+	require.Len(t, tch.mm, 1)
+	// The counter isn't transformed, which is warned about
+	assert.EqualValues(t, 1, vth.counterWarned)
+
+	// The received map isn't changed
+	assert.Equal(t, []float64{2e6, 4e6, 9e6}, mm.Timers["db.query_ns"][""].Values)
+	assert.EqualValues(t, 512*1024*1024, mm.Gauges["memory.rss"][""].Value)
+
+	ma := NewMetricAggregator([]float64{90}, 0, 0, 0, 0, gostatsd.TimerSubtypes{}, math.MaxUint32)
+	ma.ReceiveMap(tch.mm[0])
+	ma.Flush(time.Second)
+	var aggregated *gostatsd.MetricMap
+	ma.Process(func(m *gostatsd.MetricMap) {
+		aggregated = m
+	})
+	timer := aggregated.Timers["db.query_ns"][""]
+	assert.Equal(t, 2.0, timer.Min)
+	assert.Equal(t, 9.0, timer.Max)
+	assert.Equal(t, 5.0, timer.Mean)
+	assert.Equal(t, 15.0, timer.Sum)
+	assert.Equal(t, 512.0, aggregated.Gauges["memory.rss"][""].Value)
+	assert.Equal(t, 7.0, aggregated.Gauges["queue.depth"][""].Value)
+	assert.EqualValues(t, 3, aggregated.Counters["memory.allocs"][""].Value)
+
+	// Maps with nothing to transform are passed on as they are
+	unchanged := gostatsd.NewMetricMap()
+	unchanged.Receive(&gostatsd.Metric{Type: gostatsd.GAUGE, Name: "other", Value: 1, Rate: 1})
+	vth.DispatchMetricMap(context.Background(), unchanged)
+	require.Len(t, tch.mm, 2)
+	assert.Same(t, unchanged, tch.mm[1])
+}
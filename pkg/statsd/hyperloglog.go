@@ -0,0 +1,139 @@
+package statsd
+
+import (
+	"hash/fnv"
+	"math"
+	"math/bits"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	hllPrecision = 10
+	hllRegisters = 1 << hllPrecision
+
+	sketchShardCount = 16
+)
+
+// hyperLogLog is a fixed size sketch estimating the number of distinct values added to it.  With 1024 registers it
+// uses 1KB of memory, with a standard error of around 3%.
+type hyperLogLog struct {
+	registers [hllRegisters]uint8
+}
+
+// Add adds a value to the sketch.
+func (h *hyperLogLog) Add(value string) {
+	f := fnv.New64a()
+	_, _ = f.Write([]byte(value))
+	x := mix64(f.Sum64())
+
+	idx := x >> (64 - hllPrecision)
+	rank := uint8(bits.LeadingZeros64(x<<hllPrecision|1<<(hllPrecision-1)) + 1)
+	if rank > h.registers[idx] {
+		h.registers[idx] = rank
+	}
+}
+
+// Estimate returns the estimated number of distinct values added to the sketch.
+func (h *hyperLogLog) Estimate() float64 {
+	sum := 0.0
+	zeros := 0
+	for _, r := range h.registers {
+		sum += 1 / float64(uint64(1)<<r)
+		if r == 0 {
+			zeros++
+		}
+	}
+
+	m := float64(hllRegisters)
+	estimate := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if estimate <= 2.5*m && zeros > 0 {
+		// Small range correction, linear counting is more accurate
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return estimate
+}
+
+// mix64 is the splitmix64 finalizer, fnv on its own does not spread short inputs such as IP addresses well enough
+// across the high bits.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// sketchShards holds a hyperLogLog per name, for up to max names.  The names are sharded by their hash, each shard
+// with its own lock, so parsers adding values concurrently rarely contend.
+type sketchShards struct {
+	max       int64
+	tracked   int64  // atomic, the number of names with a sketch across every shard
+	discarded uint64 // atomic, the number of values not added because max was reached
+	shards    [sketchShardCount]sketchShard
+}
+
+type sketchShard struct {
+	mu       sync.Mutex
+	sketches map[string]*hyperLogLog
+}
+
+func newSketchShards(max int) *sketchShards {
+	ss := &sketchShards{max: int64(max)}
+	for i := range ss.shards {
+		ss.shards[i].sketches = map[string]*hyperLogLog{}
+	}
+	return ss
+}
+
+// Add adds value to the sketch for name, creating it if fewer than max names are tracked.
+func (ss *sketchShards) Add(name, value string) {
+	shard := &ss.shards[shardOf(name)]
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	sketch, ok := shard.sketches[name]
+	if !ok {
+		if atomic.AddInt64(&ss.tracked, 1) > ss.max {
+			atomic.AddInt64(&ss.tracked, -1)
+			atomic.AddUint64(&ss.discarded, 1)
+			return
+		}
+		sketch = &hyperLogLog{}
+		shard.sketches[name] = sketch
+	}
+	sketch.Add(value)
+}
+
+// Reset returns the sketches of every name, and the number of values discarded, and starts tracking from scratch.
+func (ss *sketchShards) Reset() (map[string]*hyperLogLog, uint64) {
+	sketches := map[string]*hyperLogLog{}
+	for i := range ss.shards {
+		shard := &ss.shards[i]
+		shard.mu.Lock()
+		old := shard.sketches
+		shard.sketches = make(map[string]*hyperLogLog, len(old))
+		shard.mu.Unlock()
+
+		atomic.AddInt64(&ss.tracked, -int64(len(old)))
+		for name, sketch := range old {
+			sketches[name] = sketch
+		}
+	}
+	return sketches, atomic.SwapUint64(&ss.discarded, 0)
+}
+
+// Len returns the number of names with a sketch.
+func (ss *sketchShards) Len() int {
+	return int(atomic.LoadInt64(&ss.tracked))
+}
+
+// shardOf returns the shard of name, using fnv-1a inline to avoid allocating.
+func shardOf(name string) int {
+	h := uint32(2166136261)
+	for i := 0; i < len(name); i++ {
+		h ^= uint32(name[i])
+		h *= 16777619
+	}
+	return int(h % sketchShardCount)
+}
@@ -2,6 +2,7 @@ package statsd
 
 import (
 	"math"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -34,6 +35,67 @@ func latencyHistogram(timer gostatsd.Timer, bucketLimit uint32) map[gostatsd.His
 	return result
 }
 
+// fixedHistogram returns a histogram of the timer with the given buckets, from its values and digest.  Buckets
+// counted from the digest are estimated.
+func fixedHistogram(timer gostatsd.Timer, thresholds []gostatsd.HistogramThreshold) map[gostatsd.HistogramThreshold]int {
+	result := make(map[gostatsd.HistogramThreshold]int, len(thresholds)+1)
+	var digestCount float64
+	if timer.Digest != nil {
+		digestCount = timer.Digest.Count()
+	}
+	for _, threshold := range thresholds {
+		count := 0
+		for _, value := range timer.Values {
+			if value <= float64(threshold) {
+				count++
+			}
+		}
+		if digestCount > 0 {
+			count += int(round(timer.Digest.CDF(float64(threshold)) * digestCount))
+		}
+		result[threshold] = count
+	}
+	result[gostatsd.HistogramThreshold(math.Inf(1))] = len(timer.Values) + int(round(digestCount))
+	return result
+}
+
+// preAggregatedHistogram returns a histogram of the timer's pre-aggregated buckets, with any values it was also sent
+// counted in to them.  Only the lowest bucketLimit thresholds are kept, which leaves the counts of the others exact, as
+// they are cumulative.
+func preAggregatedHistogram(timer gostatsd.Timer, bucketLimit uint32) map[gostatsd.HistogramThreshold]int {
+	infiniteThreshold := gostatsd.HistogramThreshold(math.Inf(1))
+	thresholds := make([]float64, 0, len(timer.Buckets))
+	for threshold := range timer.Buckets {
+		if threshold != infiniteThreshold {
+			thresholds = append(thresholds, float64(threshold))
+		}
+	}
+	sort.Float64s(thresholds)
+	thresholds = thresholds[:min(uint32(len(thresholds)), bucketLimit)]
+
+	result := make(map[gostatsd.HistogramThreshold]int, len(thresholds)+1)
+	for _, threshold := range thresholds {
+		count := timer.Buckets[gostatsd.HistogramThreshold(threshold)]
+		for _, value := range timer.Values {
+			if value <= threshold {
+				count++
+			}
+		}
+		result[gostatsd.HistogramThreshold(threshold)] = count
+	}
+	result[infiniteThreshold] = timer.Buckets[infiniteThreshold] + len(timer.Values)
+	return result
+}
+
+// emptyBuckets returns the thresholds of the buckets, with no values counted.
+func emptyBuckets(buckets map[gostatsd.HistogramThreshold]int) map[gostatsd.HistogramThreshold]int {
+	result := make(map[gostatsd.HistogramThreshold]int, len(buckets))
+	for threshold := range buckets {
+		result[threshold] = 0
+	}
+	return result
+}
+
 func emptyHistogram(timer gostatsd.Timer, bucketLimit uint32) map[gostatsd.HistogramThreshold]int {
 	result := make(map[gostatsd.HistogramThreshold]int)
 
@@ -3,6 +3,7 @@ package statsd
 import (
 	"math"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 
@@ -141,3 +142,27 @@ func thresholds(buckets map[gostatsd.HistogramThreshold]int) []gostatsd.Histogra
 	}
 	return keys
 }
+
+func TestPreAggregatedHistogramFlush(t *testing.T) {
+	t.Parallel()
+	infinity := gostatsd.HistogramThreshold(math.Inf(1))
+	ma := NewMetricAggregator(nil, 0, 0, 0, 0, gostatsd.TimerSubtypes{}, 2)
+	mm := gostatsd.NewMetricMap()
+	mm.Receive(&gostatsd.Metric{Name: "lat", Type: gostatsd.TIMER, Rate: 1, Buckets: map[gostatsd.HistogramThreshold]int{1: 1, 5: 3, 10: 4, infinity: 5}})
+	mm.Receive(&gostatsd.Metric{Name: "lat", Type: gostatsd.TIMER, Rate: 1, Buckets: map[gostatsd.HistogramThreshold]int{1: 0, 5: 2, 10: 2, infinity: 3}})
+	// Timings sent as values are counted in to the same buckets
+	mm.Receive(&gostatsd.Metric{Name: "lat", Type: gostatsd.TIMER, Rate: 1, Value: 4})
+	ma.ReceiveMap(mm)
+	ma.Flush(2 * time.Second)
+
+	timer := ma.metricMap.Timers["lat"][""]
+	// The highest threshold is beyond the histogram limit
+	assert.Equal(t, map[gostatsd.HistogramThreshold]int{1: 1, 5: 6, infinity: 9}, timer.Histogram)
+	assert.Equal(t, 9, timer.Count)
+	assert.EqualValues(t, 4.5, timer.PerSecond)
+
+	ma.Reset()
+	timer = ma.metricMap.Timers["lat"][""]
+	assert.Equal(t, map[gostatsd.HistogramThreshold]int{1: 0, 5: 0, 10: 0, infinity: 0}, timer.Buckets)
+	assert.Empty(t, timer.Values)
+}
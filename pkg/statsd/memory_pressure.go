@@ -0,0 +1,98 @@
+package statsd
+
+import (
+	"fmt"
+	"math"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+)
+
+// memoryPressureSampleInterval is how long a sample of the heap is used for, so the aggregators flushed together share
+// a sample, rather than each stopping the world to read it.
+const memoryPressureSampleInterval = time.Second
+
+// memoryPressure is a memory backstop for the aggregators.  While the heap in use is over the threshold, each
+// aggregator evicts a share of its least recently updated series every flush, and releases its timer sample buffers,
+// until the heap is back under the threshold.
+type memoryPressure struct {
+	threshold    uint64                  // Heap in use in bytes, above which series are evicted
+	ratio        float64                 // The share of the series of each aggregator evicted every flush
+	readMemStats func(*runtime.MemStats) // Replaced in tests
+
+	mu      sync.Mutex
+	sampled time.Time
+	over    bool
+}
+
+// newMemoryPressure returns a memoryPressure which evicts ratio of the series while the heap in use is over threshold.
+// The ratio must be more than 0, and at most 1.
+func newMemoryPressure(threshold uint64, ratio float64) (*memoryPressure, error) {
+	if !(ratio > 0 && ratio <= 1) {
+		return nil, fmt.Errorf("invalid %s %v, must be more than 0 and at most 1", gostatsd.ParamMemoryEvictionRatio, ratio)
+	}
+	return &memoryPressure{
+		threshold:    threshold,
+		ratio:        ratio,
+		readMemStats: runtime.ReadMemStats,
+	}, nil
+}
+
+// isOver returns whether the heap in use is over the threshold, sampling it if the last sample is too old.
+func (mp *memoryPressure) isOver(now time.Time) bool {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	if now.Sub(mp.sampled) >= memoryPressureSampleInterval {
+		var ms runtime.MemStats
+		mp.readMemStats(&ms)
+		mp.over = ms.HeapInuse > mp.threshold
+		mp.sampled = now
+	}
+	return mp.over
+}
+
+// evictionCount returns how many of total series to evict, which is at least 1 if there are any.
+func (mp *memoryPressure) evictionCount(total int) int {
+	n := int(math.Ceil(float64(total) * mp.ratio))
+	if n > total {
+		return total
+	}
+	return n
+}
+
+// aggregatedSeries identifies a series held by an aggregator, and when it was last updated.
+type aggregatedSeries struct {
+	metrics   gostatsd.AggregatedMetrics
+	key       string
+	tagsKey   string
+	timestamp gostatsd.Nanotime
+}
+
+// evictLeastRecentlyUpdated removes the given share of the series held by the aggregator, least recently updated
+// first, and returns how many were removed.
+func (a *MetricAggregator) evictLeastRecentlyUpdated() int {
+	var series []aggregatedSeries
+	a.metricMap.Counters.Each(func(key, tagsKey string, counter gostatsd.Counter) {
+		series = append(series, aggregatedSeries{a.metricMap.Counters, key, tagsKey, counter.Timestamp})
+	})
+	a.metricMap.Timers.Each(func(key, tagsKey string, timer gostatsd.Timer) {
+		series = append(series, aggregatedSeries{a.metricMap.Timers, key, tagsKey, timer.Timestamp})
+	})
+	a.metricMap.Gauges.Each(func(key, tagsKey string, gauge gostatsd.Gauge) {
+		series = append(series, aggregatedSeries{a.metricMap.Gauges, key, tagsKey, gauge.Timestamp})
+	})
+	a.metricMap.Sets.Each(func(key, tagsKey string, set gostatsd.Set) {
+		series = append(series, aggregatedSeries{a.metricMap.Sets, key, tagsKey, set.Timestamp})
+	})
+	sort.Slice(series, func(i, j int) bool {
+		return series[i].timestamp < series[j].timestamp
+	})
+	n := a.memoryPressure.evictionCount(len(series))
+	for _, s := range series[:n] {
+		deleteMetric(s.key, s.tagsKey, s.metrics)
+	}
+	return n
+}
@@ -0,0 +1,39 @@
+package statsd
+
+import (
+	"github.com/atlassian/gostatsd"
+)
+
+// addMetricTypeTags returns a copy of mm with a `<tagKey>:<type>` tag added to every metric, so backends which don't
+// keep metric types separate can distinguish a counter and a gauge with the same name.
+func addMetricTypeTags(mm *gostatsd.MetricMap, tagKey string) *gostatsd.MetricMap {
+	mmNew := gostatsd.NewMetricMap()
+	counterTag := tagKey + ":" + gostatsd.COUNTER.String()
+	gaugeTag := tagKey + ":" + gostatsd.GAUGE.String()
+	setTag := tagKey + ":" + gostatsd.SET.String()
+	timerTag := tagKey + ":" + gostatsd.TIMER.String()
+
+	mm.Counters.Each(func(metricName, tagsKey string, c gostatsd.Counter) {
+		c.Tags = withTag(c.Tags, counterTag)
+		mmNew.MergeCounter(metricName, tagsKey, c)
+	})
+	mm.Gauges.Each(func(metricName, tagsKey string, g gostatsd.Gauge) {
+		g.Tags = withTag(g.Tags, gaugeTag)
+		mmNew.MergeGauge(metricName, tagsKey, g)
+	})
+	mm.Sets.Each(func(metricName, tagsKey string, s gostatsd.Set) {
+		s.Tags = withTag(s.Tags, setTag)
+		mmNew.MergeSet(metricName, tagsKey, s)
+	})
+	mm.Timers.Each(func(metricName, tagsKey string, t gostatsd.Timer) {
+		t.Tags = withTag(t.Tags, timerTag)
+		mmNew.MergeTimer(metricName, tagsKey, t)
+	})
+	return mmNew
+}
+
+// withTag returns a copy of tags with tag appended, leaving the original unmodified.
+func withTag(tags gostatsd.Tags, tag string) gostatsd.Tags {
+	newTags := make(gostatsd.Tags, 0, len(tags)+1)
+	return append(append(newTags, tags...), tag)
+}
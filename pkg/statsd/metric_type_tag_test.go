@@ -0,0 +1,66 @@
+package statsd
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/atlassian/gostatsd"
+)
+
+func TestAddMetricTypeTags(t *testing.T) {
+	t.Parallel()
+	tags := gostatsd.Tags{"env:prod"}
+	mm := gostatsd.NewMetricMap()
+	mm.Counters["requests"] = map[string]gostatsd.Counter{"env:prod": gostatsd.NewCounter(1, 5, "", tags)}
+	mm.Gauges["requests"] = map[string]gostatsd.Gauge{"env:prod": gostatsd.NewGauge(1, 3, "", tags)}
+	mm.Sets["users"] = map[string]gostatsd.Set{"": gostatsd.NewSet(1, map[string]struct{}{"a": {}}, "", nil)}
+	mm.Timers["latency"] = map[string]gostatsd.Timer{"": gostatsd.NewTimer(1, []float64{1}, "", nil)}
+
+	tagged := addMetricTypeTags(mm, "metric_type")
+	assert.Equal(t, gostatsd.Tags{"env:prod", "metric_type:counter"}, tagged.Counters["requests"]["env:prod"].Tags)
+	assert.Equal(t, gostatsd.Tags{"env:prod", "metric_type:gauge"}, tagged.Gauges["requests"]["env:prod"].Tags)
+	assert.Equal(t, gostatsd.Tags{"metric_type:set"}, tagged.Sets["users"][""].Tags)
+	assert.Equal(t, gostatsd.Tags{"metric_type:timer"}, tagged.Timers["latency"][""].Tags)
+	assert.EqualValues(t, 5, tagged.Counters["requests"]["env:prod"].Value)
+	assert.EqualValues(t, 3, tagged.Gauges["requests"]["env:prod"].Value)
+
+	// The aggregator's map is reused, so it must not be modified
+	assert.Equal(t, gostatsd.Tags{"env:prod"}, tags)
+	assert.Equal(t, gostatsd.Tags{"env:prod"}, mm.Counters["requests"]["env:prod"].Tags)
+	assert.Equal(t, gostatsd.Tags{"env:prod"}, mm.Gauges["requests"]["env:prod"].Tags)
+}
+
+func TestFlusherMetricTypeTag(t *testing.T) {
+	t.Parallel()
+	mm := gostatsd.NewMetricMap()
+	mm.Counters["requests"] = map[string]gostatsd.Counter{"": gostatsd.NewCounter(1, 5, "", nil)}
+	mm.Gauges["requests"] = map[string]gostatsd.Gauge{"": gostatsd.NewGauge(1, 3, "", nil)}
+
+	for _, tagKey := range []string{"", "metric_type"} {
+		backend := &namedCapturingBackend{name: "backend"}
+		fl := NewMetricFlusher(0, 0, false, nil, []gostatsd.Backend{backend}, nil)
+		fl.metricTypeTag = tagKey
+
+		var wg sync.WaitGroup
+		fl.sendMetricsAsync(context.Background(), &wg, mm, nil)
+		wg.Wait()
+
+		require.Len(t, backend.maps, 1)
+		var names []string
+		for _, m := range backend.maps[0].AsMetrics() {
+			names = append(names, m.FormatTagsKey())
+		}
+		if tagKey == "" {
+			assert.Equal(t, mm, backend.maps[0])
+			assert.Equal(t, names[0], names[1], "counter and gauge are indistinguishable")
+		} else {
+			assert.Equal(t, gostatsd.Tags{"metric_type:counter"}, backend.maps[0].Counters["requests"][""].Tags)
+			assert.Equal(t, gostatsd.Tags{"metric_type:gauge"}, backend.maps[0].Gauges["requests"][""].Tags)
+			assert.NotEqual(t, names[0], names[1], "counter and gauge are distinguishable")
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package statsd
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/stats"
+)
+
+const (
+	// NameCaseLower is the name used to indicate metric names are lowercased.
+	NameCaseLower = "lower"
+	// NameCaseUpper is the name used to indicate metric names are uppercased.
+	NameCaseUpper = "upper"
+)
+
+// nameTransformer renames the metrics flushed to a single backend, so the same aggregate can be named in the style
+// each backend expects.  The namespace separator is changed first, then characters are replaced, then the case is
+// changed, then the prefix and suffix are added unchanged.
+type nameTransformer struct {
+	dropped uint64 // Series dropped since the last emit because another series was renamed the same, accessed atomically
+
+	backendName        string
+	warnOnce           sync.Once         // Warns the first time series are dropped
+	namespaceSeparator string            // Replaces the separator after the namespace, empty to leave it unchanged
+	namespaceFrom      string            // The namespace and its separator, as the metrics are named
+	namespaceTo        string            // The namespace and namespaceSeparator, as the metrics are sent
+	replacer           *strings.Replacer // Replaces each of the configured characters, may be nil
+	nameCase           string            // One of the NameCase* values, or empty to leave the case unchanged
+	prefix             string
+	suffix             string
+}
+
+// newNameTransformerFromViper creates a nameTransformer given a *viper.Viper
+func newNameTransformerFromViper(v *viper.Viper) (*nameTransformer, error) {
+	v.SetDefault("replace-chars", "")
+	v.SetDefault("replace-with", "_")
+	v.SetDefault("case", "")
+	v.SetDefault("prefix", "")
+	v.SetDefault("suffix", "")
+	v.SetDefault("namespace-separator", "")
+	nt := &nameTransformer{
+		namespaceSeparator: v.GetString("namespace-separator"),
+		nameCase:           v.GetString("case"),
+		prefix:             v.GetString("prefix"),
+		suffix:             v.GetString("suffix"),
+	}
+	switch nt.nameCase {
+	case "", NameCaseLower, NameCaseUpper:
+	default:
+		return nil, fmt.Errorf("invalid case %q, must be %s or %s", nt.nameCase, NameCaseLower, NameCaseUpper)
+	}
+	if chars := v.GetString("replace-chars"); chars != "" {
+		replaceWith := v.GetString("replace-with")
+		oldnew := make([]string, 0, 2*len(chars))
+		for _, c := range chars {
+			oldnew = append(oldnew, string(c), replaceWith)
+		}
+		nt.replacer = strings.NewReplacer(oldnew...)
+	}
+	return nt, nil
+}
+
+// setNamespace sets the namespace of the metrics, and the separator they are named with, so the separator can be
+// changed for the backend.  A namespace which ends with separator is sent without it.
+func (nt *nameTransformer) setNamespace(namespace, separator string) {
+	if nt.namespaceSeparator == "" || namespace == "" {
+		return
+	}
+	nt.namespaceFrom = gostatsd.NamespacePrefix(namespace, separator)
+	nt.namespaceTo = gostatsd.NamespacePrefix(strings.TrimSuffix(namespace, separator), nt.namespaceSeparator)
+}
+
+// newNameTransformersFromViper creates a nameTransformer for each backend which has a `name-transform.<backend name>`
+// section, keyed by the backend name.  The namespace and separator are those the metrics are named with.
+func newNameTransformersFromViper(v *viper.Viper, backends []gostatsd.Backend, namespace, separator string) (map[string]*nameTransformer, error) {
+	transformers := map[string]*nameTransformer{}
+	for _, backend := range backends {
+		vTransform := v.Sub("name-transform." + backend.Name())
+		if vTransform == nil {
+			continue
+		}
+		transformer, err := newNameTransformerFromViper(vTransform)
+		if err != nil {
+			return nil, fmt.Errorf("name-transform.%s: %v", backend.Name(), err)
+		}
+		transformer.backendName = backend.Name()
+		transformer.setNamespace(namespace, separator)
+		transformers[backend.Name()] = transformer
+	}
+	return transformers, nil
+}
+
+// name returns the name metricName is sent to the backend as.
+func (nt *nameTransformer) name(metricName string) string {
+	if nt.namespaceFrom != "" && strings.HasPrefix(metricName, nt.namespaceFrom) {
+		metricName = nt.namespaceTo + metricName[len(nt.namespaceFrom):]
+	}
+	if nt.replacer != nil {
+		metricName = nt.replacer.Replace(metricName)
+	}
+	switch nt.nameCase {
+	case NameCaseLower:
+		metricName = strings.ToLower(metricName)
+	case NameCaseUpper:
+		metricName = strings.ToUpper(metricName)
+	}
+	return nt.prefix + metricName + nt.suffix
+}
+
+// apply returns a new MetricMap with every metric renamed.  The values are not copied, so the result must be treated
+// as read only, the same as the input.  If two series of the same type are renamed to the same name, only one of
+// them is kept, as their aggregates can't be combined, and the other is counted as dropped.
+func (nt *nameTransformer) apply(mm *gostatsd.MetricMap) *gostatsd.MetricMap {
+	mmNew := gostatsd.NewMetricMap()
+	for metricName, series := range mm.Counters {
+		newName := nt.name(metricName)
+		if mmNew.Counters[newName] == nil {
+			mmNew.Counters[newName] = make(map[string]gostatsd.Counter, len(series))
+		}
+		for tagsKey, c := range series {
+			if _, ok := mmNew.Counters[newName][tagsKey]; ok {
+				nt.drop(newName)
+				continue
+			}
+			mmNew.Counters[newName][tagsKey] = c
+		}
+	}
+	for metricName, series := range mm.Gauges {
+		newName := nt.name(metricName)
+		if mmNew.Gauges[newName] == nil {
+			mmNew.Gauges[newName] = make(map[string]gostatsd.Gauge, len(series))
+		}
+		for tagsKey, g := range series {
+			if _, ok := mmNew.Gauges[newName][tagsKey]; ok {
+				nt.drop(newName)
+				continue
+			}
+			mmNew.Gauges[newName][tagsKey] = g
+		}
+	}
+	for metricName, series := range mm.Timers {
+		newName := nt.name(metricName)
+		if mmNew.Timers[newName] == nil {
+			mmNew.Timers[newName] = make(map[string]gostatsd.Timer, len(series))
+		}
+		for tagsKey, t := range series {
+			if _, ok := mmNew.Timers[newName][tagsKey]; ok {
+				nt.drop(newName)
+				continue
+			}
+			mmNew.Timers[newName][tagsKey] = t
+		}
+	}
+	for metricName, series := range mm.Sets {
+		newName := nt.name(metricName)
+		if mmNew.Sets[newName] == nil {
+			mmNew.Sets[newName] = make(map[string]gostatsd.Set, len(series))
+		}
+		for tagsKey, s := range series {
+			if _, ok := mmNew.Sets[newName][tagsKey]; ok {
+				nt.drop(newName)
+				continue
+			}
+			mmNew.Sets[newName][tagsKey] = s
+		}
+	}
+	return mmNew
+}
+
+// drop counts a series which wasn't sent because another series was renamed to newName, and warns the first time it
+// happens, as it means the name-transform of the backend loses data.
+func (nt *nameTransformer) drop(newName string) {
+	atomic.AddUint64(&nt.dropped, 1)
+	nt.warnOnce.Do(func() {
+		logrus.WithFields(logrus.Fields{
+			"backend": nt.backendName,
+			"metric":  newName,
+		}).Warn("name-transform renamed different metrics to the same name, only one of them is sent")
+	})
+}
+
+// emit emits the number of series dropped since the last emit.
+func (nt *nameTransformer) emit(statser stats.Statser) {
+	statser.Count("backend.name_transform.dropped", float64(atomic.SwapUint64(&nt.dropped, 0)), gostatsd.Tags{"backend:" + nt.backendName})
+}
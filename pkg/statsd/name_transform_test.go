@@ -0,0 +1,149 @@
+package statsd
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/stats"
+)
+
+func TestNameTransformer(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		config   map[string]string
+		expected string
+	}{
+		{config: map[string]string{}, expected: "api.Request-Count"},
+		{config: map[string]string{"replace-chars": ".-"}, expected: "api_Request_Count"},
+		{config: map[string]string{"replace-chars": ".", "replace-with": "/"}, expected: "api/Request-Count"},
+		{config: map[string]string{"case": "lower"}, expected: "api.request-count"},
+		// The prefix and suffix are not transformed
+		{config: map[string]string{"case": "upper", "prefix": "app.", "suffix": ".v1"}, expected: "app.API.REQUEST-COUNT.v1"},
+		{config: map[string]string{"replace-chars": ".-", "case": "lower", "prefix": "app_"}, expected: "app_api_request_count"},
+	}
+	for _, tc := range tests {
+		v := viper.New()
+		for key, value := range tc.config {
+			v.Set(key, value)
+		}
+		nt, err := newNameTransformerFromViper(v)
+		require.NoError(t, err)
+		assert.Equal(t, tc.expected, nt.name("api.Request-Count"), "%v", tc.config)
+	}
+
+	v := viper.New()
+	v.Set("case", "title")
+	_, err := newNameTransformerFromViper(v)
+	require.Error(t, err)
+}
+
+func TestNameTransformerCountsCollisions(t *testing.T) {
+	t.Parallel()
+	v := viper.New()
+	v.Set("case", "lower")
+	nt, err := newNameTransformerFromViper(v)
+	require.NoError(t, err)
+	nt.backendName = "lowered"
+
+	mm := gostatsd.NewMetricMap()
+	mm.Counters["Requests"] = map[string]gostatsd.Counter{"a:1": {Value: 1}, "a:2": {Value: 2}}
+	mm.Counters["requests"] = map[string]gostatsd.Counter{"a:1": {Value: 3}}
+	mm.Gauges["Requests"] = map[string]gostatsd.Gauge{"a:1": {Value: 4}}
+	transformed := nt.apply(mm)
+
+	// One of the colliding series is kept, and the others are unaffected
+	assert.Len(t, transformed.Counters["requests"], 2)
+	assert.EqualValues(t, 2, transformed.Counters["requests"]["a:2"].Value)
+	assert.Contains(t, []int64{1, 3}, transformed.Counters["requests"]["a:1"].Value)
+	assert.EqualValues(t, 4, transformed.Gauges["requests"]["a:1"].Value)
+
+	internal := &capturingHandler{}
+	statser := stats.NewInternalStatser(nil, "", "", gostatsd.UnknownSource, internal)
+	nt.emit(statser)
+	statser.NotifyFlush(context.Background(), 0)
+	require.Len(t, internal.mm, 1)
+	assert.EqualValues(t, 1, internal.mm[0].Counters["backend.name_transform.dropped"]["backend:lowered"].Value)
+}
+
+func TestNameTransformerNamespaceSeparator(t *testing.T) {
+	t.Parallel()
+	backends := []gostatsd.Backend{&namedCapturingBackend{name: "b"}}
+	for _, tc := range []struct {
+		namespace, separator, backendSeparator string
+		replaceChars                           string
+		metricName, expected                   string
+	}{
+		{namespace: "app", separator: ".", backendSeparator: "/", metricName: "app.api.count", expected: "app/api.count"},
+		{namespace: "app", separator: "/", backendSeparator: "_", metricName: "app/api.count", expected: "app_api.count"},
+		// A namespace which ends with the separator is only separated once
+		{namespace: "app.", separator: ".", backendSeparator: "/", metricName: "app.api.count", expected: "app/api.count"},
+		// Metrics outside the namespace, and metrics without one, are unchanged
+		{namespace: "app", separator: ".", backendSeparator: "/", metricName: "other.count", expected: "other.count"},
+		{namespace: "", separator: ".", backendSeparator: "/", metricName: "api.count", expected: "api.count"},
+		// The separator is changed before characters are replaced
+		{namespace: "app", separator: ".", backendSeparator: "/", replaceChars: ".", metricName: "app.api.count", expected: "app/api_count"},
+	} {
+		v := viper.New()
+		v.Set("name-transform.b.namespace-separator", tc.backendSeparator)
+		v.Set("name-transform.b.replace-chars", tc.replaceChars)
+		transformers, err := newNameTransformersFromViper(v, backends, tc.namespace, tc.separator)
+		require.NoError(t, err)
+		assert.Equal(t, tc.expected, transformers["b"].name(tc.metricName), "%+v", tc)
+	}
+}
+
+func TestFlusherAppliesNameTransformers(t *testing.T) {
+	t.Parallel()
+	graphite := &namedCapturingBackend{name: "graphite"}
+	prometheus := &namedCapturingBackend{name: "prometheus"}
+	unchanged := &namedCapturingBackend{name: "unchanged"}
+	backends := []gostatsd.Backend{graphite, prometheus, unchanged}
+
+	v := viper.New()
+	v.Set("name-transform.graphite.prefix", "stats.")
+	v.Set("name-transform.prometheus.replace-chars", ".-")
+	v.Set("name-transform.prometheus.case", "lower")
+	v.Set("name-transform.prometheus.suffix", "_total")
+	transformers, err := newNameTransformersFromViper(v, backends, "", ".")
+	require.NoError(t, err)
+	require.Len(t, transformers, 2)
+
+	fl := NewMetricFlusher(0, 0, false, nil, backends, nil)
+	fl.nameTransformers = transformers
+	input := gostatsd.NewMetricMap()
+	input.Receive(&gostatsd.Metric{Name: "api.Request-Count", Value: 3, Rate: 1, Tags: gostatsd.Tags{"env:prod"}, Type: gostatsd.COUNTER})
+	input.Receive(&gostatsd.Metric{Name: "api.latency", Value: 5, Rate: 1, Type: gostatsd.TIMER})
+	input.Receive(&gostatsd.Metric{Name: "api.temp", Value: 20, Type: gostatsd.GAUGE})
+	input.Receive(&gostatsd.Metric{Name: "api.users", StringValue: "a", Rate: 1, Type: gostatsd.SET})
+
+	var wg sync.WaitGroup
+	fl.sendMetricsAsync(context.Background(), &wg, input, nil)
+	wg.Wait()
+
+	// The same aggregate is named differently for each backend
+	tagsKey := gostatsd.FormatTagsKey("", gostatsd.Tags{"env:prod"})
+	require.Len(t, graphite.maps, 1)
+	assert.EqualValues(t, 3, graphite.maps[0].Counters["stats.api.Request-Count"][tagsKey].Value)
+	assert.Contains(t, graphite.maps[0].Timers, "stats.api.latency")
+	assert.Contains(t, graphite.maps[0].Gauges, "stats.api.temp")
+	assert.Contains(t, graphite.maps[0].Sets, "stats.api.users")
+
+	require.Len(t, prometheus.maps, 1)
+	assert.EqualValues(t, 3, prometheus.maps[0].Counters["api_request_count_total"][tagsKey].Value)
+	assert.Contains(t, prometheus.maps[0].Timers, "api_latency_total")
+	assert.Len(t, prometheus.maps[0].Counters, 1)
+
+	require.Len(t, unchanged.maps, 1)
+	assert.Equal(t, input, unchanged.maps[0])
+	assert.Contains(t, input.Counters, "api.Request-Count") // The input is not modified
+
+	v.Set("name-transform.unchanged.case", "title")
+	_, err = newNameTransformersFromViper(v, backends, "", ".")
+	require.Error(t, err)
+}
@@ -3,6 +3,8 @@ package statsd
 import (
 	"bytes"
 	"context"
+	"errors"
+	"math"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -20,6 +22,13 @@ import (
 // Default buffer size for debug channel
 const logRawMetricChannelBufferSize = 1000
 
+var (
+	// errSurroundingWhitespace is the error for a line with leading or trailing whitespace in strict mode.
+	errSurroundingWhitespace = errors.New("leading or trailing whitespace")
+	// errInfinite is the error for a metric with an infinite value, unless the non-finite policy allows it.
+	errInfinite = errors.New("infinite value")
+)
+
 // DatagramParser receives datagrams and parses them into Metrics/Events
 // For each Metric/Event it calls Handler.HandleMetric/Event()
 type DatagramParser struct {
@@ -29,12 +38,24 @@ type DatagramParser struct {
 	badLines        stats.ChangeGauge
 	metricsReceived uint64
 	eventsReceived  uint64
+	namesTruncated  uint64
+	namesDropped    uint64
+	nonFinite       uint64 // NaN or infinite values received
+	// Metrics received since the last flush, indexed by gostatsd.MetricType
+	metricsReceivedByType [gostatsd.SET + 1]uint64
 
 	logger logrus.FieldLogger
 
 	ignoreHost bool
+	sourceTag  string // Key of a tag which overrides the source IP, removed from the metric or event, if not empty
 	handler    gostatsd.PipelineHandler
-	namespace  string // Namespace to prefix all metrics
+	namespace  string // Prefixed to the names of all metrics, including the namespace separator
+
+	maxNameLength int  // Maximum length of a metric name, including the namespace, 0 for unlimited
+	truncateNames bool // Truncate names longer than maxNameLength, rather than dropping the metric
+	strict        bool // Reject lines with surrounding whitespace, and empty lines, rather than trimming or skipping them
+
+	nonFinitePolicy string // How gauges and timers with infinite values are handled, one of the NonFinitePolicy* values
 
 	metricPool *pool.MetricPool
 
@@ -47,7 +68,24 @@ type DatagramParser struct {
 	logRawMetricChan     chan []*gostatsd.Metric
 }
 
-// NewDatagramParser initialises a new DatagramParser.
+// DatagramParserOptions holds the configuration of a DatagramParser beyond its core settings.
+type DatagramParserOptions struct {
+	// NamespaceSeparator joins the namespace to the name of every metric, `.` if it is empty.
+	NamespaceSeparator string
+	// MaxNameLength is the maximum length of a metric name, including the namespace, 0 for unlimited.
+	MaxNameLength int
+	// TruncateNames truncates names longer than MaxNameLength, rather than dropping the metric.
+	TruncateNames bool
+	// Strict rejects lines with surrounding whitespace, and empty lines, rather than trimming or skipping them.
+	Strict bool
+	// SourceTag is the key of a tag which overrides the source IP, removed from the metric or event, if not empty.
+	SourceTag string
+	// NonFinitePolicy is how gauges and timers with infinite values are handled, one of the NonFinitePolicy* values.
+	NonFinitePolicy string
+}
+
+// NewDatagramParser initialises a new DatagramParser.  The namespace, if not empty, is joined to the name of every
+// metric with options.NamespaceSeparator.
 func NewDatagramParser(
 	in <-chan []*Datagram,
 	ns string,
@@ -56,22 +94,32 @@ func NewDatagramParser(
 	handler gostatsd.PipelineHandler,
 	badLineRateLimitPerSecond rate.Limit,
 	logRawMetric bool,
+	options DatagramParserOptions,
 	logger logrus.FieldLogger,
 ) *DatagramParser {
 	limiter := &rate.Limiter{}
 	if badLineRateLimitPerSecond > 0 {
 		limiter = rate.NewLimiter(badLineRateLimitPerSecond, 1)
 	}
+	separator := options.NamespaceSeparator
+	if separator == "" {
+		separator = gostatsd.DefaultNamespaceSeparator
+	}
 
 	return &DatagramParser{
-		logger:         logger,
-		in:             in,
-		ignoreHost:     ignoreHost,
-		handler:        handler,
-		namespace:      ns,
-		metricPool:     pool.NewMetricPool(estimatedTags + handler.EstimatedTags()),
-		badLineLimiter: limiter,
-		logRawMetric:   logRawMetric,
+		logger:          logger,
+		in:              in,
+		ignoreHost:      ignoreHost,
+		sourceTag:       options.SourceTag,
+		handler:         handler,
+		namespace:       gostatsd.NamespacePrefix(ns, separator),
+		metricPool:      pool.NewMetricPool(estimatedTags + handler.EstimatedTags()),
+		badLineLimiter:  limiter,
+		logRawMetric:    logRawMetric,
+		maxNameLength:   options.MaxNameLength,
+		truncateNames:   options.TruncateNames,
+		strict:          options.Strict,
+		nonFinitePolicy: options.NonFinitePolicy,
 	}
 }
 
@@ -80,13 +128,26 @@ func (dp *DatagramParser) RunMetricsContext(ctx context.Context) {
 	flushed, unregister := statser.RegisterFlush()
 	defer unregister()
 
+	var lastEventsReceived uint64
 	for {
 		select {
 		case <-ctx.Done():
 			return
 		case <-flushed:
+			eventsReceived := atomic.LoadUint64(&dp.eventsReceived)
 			statser.Gauge("parser.metrics_received", float64(atomic.LoadUint64(&dp.metricsReceived)), nil)
-			statser.Gauge("parser.events_received", float64(atomic.LoadUint64(&dp.eventsReceived)), nil)
+			statser.Gauge("parser.events_received", float64(eventsReceived), nil)
+			for _, metricType := range []gostatsd.MetricType{gostatsd.COUNTER, gostatsd.GAUGE, gostatsd.TIMER, gostatsd.SET} {
+				received := atomic.SwapUint64(&dp.metricsReceivedByType[metricType], 0)
+				statser.Count("parser.received_by_type", float64(received), gostatsd.Tags{"type:" + metricType.String()})
+			}
+			statser.Count("parser.received_by_type", float64(eventsReceived-lastEventsReceived), gostatsd.Tags{"type:event"})
+			lastEventsReceived = eventsReceived
+			if dp.maxNameLength > 0 {
+				statser.Gauge("parser.names_truncated", float64(atomic.LoadUint64(&dp.namesTruncated)), nil)
+				statser.Gauge("parser.names_dropped", float64(atomic.LoadUint64(&dp.namesDropped)), nil)
+			}
+			statser.Gauge("parser.non_finite_values", float64(atomic.LoadUint64(&dp.nonFinite)), nil)
 			dp.badLines.SendIfChanged(statser, "parser.bad_lines_seen", nil)
 		}
 	}
@@ -116,8 +177,10 @@ func (dp *DatagramParser) Run(ctx context.Context) {
 				accumB += badLineCount
 			}
 			// TODO: Refactor this to use a MetricConsolidator
+			var receivedByType [gostatsd.SET + 1]uint64
 			mm := gostatsd.NewMetricMap()
 			for _, m := range metrics {
+				receivedByType[m.Type]++
 				mm.Receive(m)
 			}
 			if len(metrics) > 0 {
@@ -125,6 +188,11 @@ func (dp *DatagramParser) Run(ctx context.Context) {
 				dp.doLogRawMetric(metrics)
 			}
 			atomic.AddUint64(&dp.metricsReceived, uint64(len(metrics)))
+			for metricType, received := range receivedByType {
+				if received > 0 {
+					atomic.AddUint64(&dp.metricsReceivedByType[metricType], received)
+				}
+			}
 			atomic.AddUint64(&dp.eventsReceived, accumE)
 			atomic.AddUint64(&dp.badLines.Cur, accumB)
 		}
@@ -142,6 +210,34 @@ func (dp *DatagramParser) logBadLineRateLimited(line []byte, ip gostatsd.Source,
 	}
 }
 
+// source returns the source IP of a metric or event, which is from the sourceTag, if it is configured and present,
+// and otherwise the IP the datagram was received from.  The sourceTag is removed from the tags.
+func (dp *DatagramParser) source(tags *gostatsd.Tags, ip gostatsd.Source) gostatsd.Source {
+	if dp.sourceTag == "" {
+		return ip
+	}
+	if source, ok := removeTag(tags, dp.sourceTag); ok && source != "" {
+		return gostatsd.Source(source)
+	}
+	return ip
+}
+
+// removeTag removes the first tag with the key from tags, returning its value, and if it was found.
+func removeTag(tags *gostatsd.Tags, key string) (string, bool) {
+	prefix := key + ":"
+	for idx, tag := range *tags {
+		if strings.HasPrefix(tag, prefix) {
+			if len(*tags) > 1 {
+				*tags = append((*tags)[:idx], (*tags)[idx+1:]...)
+			} else {
+				*tags = nil
+			}
+			return tag[len(prefix):], true
+		}
+	}
+	return "", false
+}
+
 // handleDatagram handles the contents of a datagram and parsers it in to Metrics (which are returned), or
 // Events (which are sent to the pipeline via DispatchEvent).
 func (dp *DatagramParser) handleDatagram(ctx context.Context, l *lexer.Lexer, now gostatsd.Nanotime, ip gostatsd.Source, msg []byte) (metrics []*gostatsd.Metric, eventCount uint64, badLineCount uint64) {
@@ -160,7 +256,22 @@ func (dp *DatagramParser) handleDatagram(ctx context.Context, l *lexer.Lexer, no
 			line = msg[:idx]
 			msg = msg[idx+1:]
 		}
-		metric, event, err := dp.parseLine(l, line)
+		var metric *gostatsd.Metric
+		var event *gostatsd.Event
+		var err error
+		if trimmed := bytes.TrimSpace(line); len(trimmed) != len(line) && dp.strict {
+			err = errSurroundingWhitespace
+		} else if !dp.strict && len(trimmed) == 0 {
+			continue // Tolerate blank lines, along with CRLF line endings and surrounding whitespace
+		} else {
+			metric, event, err = dp.parseLine(l, trimmed)
+			if err == lexer.ErrNaN {
+				atomic.AddUint64(&dp.nonFinite, 1)
+			} else if metric != nil && !dp.applyNonFinitePolicy(metric) {
+				metric.Done()
+				metric, err = nil, errInfinite
+			}
+		}
 		if err != nil {
 			// logging as debug to avoid spamming logs when a bad actor sends
 			// badly formatted messages
@@ -169,26 +280,25 @@ func (dp *DatagramParser) handleDatagram(ctx context.Context, l *lexer.Lexer, no
 			continue
 		}
 		if metric != nil {
+			if !dp.limitNameLength(metric) {
+				metric.Done()
+				continue
+			}
 			if dp.ignoreHost {
-				for idx, tag := range metric.Tags {
-					if strings.HasPrefix(tag, "host:") {
-						metric.Source = gostatsd.Source(tag[5:])
-						if len(metric.Tags) > 1 {
-							metric.Tags = append(metric.Tags[:idx], metric.Tags[idx+1:]...)
-						} else {
-							metric.Tags = nil
-						}
-						break
-					}
+				if dp.sourceTag != "" {
+					removeTag(&metric.Tags, dp.sourceTag) // The host tag is the source instead
+				}
+				if host, ok := removeTag(&metric.Tags, "host"); ok {
+					metric.Source = gostatsd.Source(host)
 				}
 			} else {
-				metric.Source = ip
+				metric.Source = dp.source(&metric.Tags, ip)
 			}
 			metric.Timestamp = now
 			metrics = append(metrics, metric)
 		} else if event != nil {
 			numEvents++
-			event.Source = ip // Always keep the source ip for events
+			event.Source = dp.source(&event.Tags, ip) // Always keep the source ip for events
 			if event.DateHappened == 0 {
 				event.DateHappened = time.Now().Unix()
 			}
@@ -201,6 +311,42 @@ func (dp *DatagramParser) handleDatagram(ctx context.Context, l *lexer.Lexer, no
 	return metrics, numEvents, numBad
 }
 
+// limitNameLength applies the maximum name length to the metric, returning false if it should be dropped.
+func (dp *DatagramParser) limitNameLength(metric *gostatsd.Metric) bool {
+	if dp.maxNameLength <= 0 || len(metric.Name) <= dp.maxNameLength {
+		return true
+	}
+	if !dp.truncateNames {
+		atomic.AddUint64(&dp.namesDropped, 1)
+		return false
+	}
+	// The lexer only allows ASCII in names, so this won't split a character
+	metric.Name = metric.Name[:dp.maxNameLength]
+	atomic.AddUint64(&dp.namesTruncated, 1)
+	return true
+}
+
+// applyNonFinitePolicy applies the non-finite policy to a metric with an infinite value, returning false if it should
+// be rejected.  Counters are integers, so they are always rejected.  NaN values are always rejected by the lexer.
+func (dp *DatagramParser) applyNonFinitePolicy(metric *gostatsd.Metric) bool {
+	if metric.Type == gostatsd.SET || !math.IsInf(metric.Value, 0) {
+		return true
+	}
+	atomic.AddUint64(&dp.nonFinite, 1)
+	if metric.Type == gostatsd.COUNTER {
+		return false
+	}
+	switch dp.nonFinitePolicy {
+	case gostatsd.NonFinitePolicyClamp:
+		metric.Value = math.Copysign(math.MaxFloat64, metric.Value)
+		return true
+	case gostatsd.NonFinitePolicyPass:
+		return true
+	default:
+		return false
+	}
+}
+
 // parseLine with lexer.
 func (dp *DatagramParser) parseLine(l *lexer.Lexer, line []byte) (*gostatsd.Metric, *gostatsd.Event, error) {
 	return l.Run(line, dp.namespace)
@@ -2,18 +2,24 @@ package statsd
 
 import (
 	"context"
+	"math"
 	"sort"
 	"strconv"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/ash2k/stager/wait"
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"golang.org/x/time/rate"
 
 	"github.com/atlassian/gostatsd"
 	"github.com/atlassian/gostatsd/internal/fixtures"
 	"github.com/atlassian/gostatsd/internal/lexer"
 	"github.com/atlassian/gostatsd/internal/pool"
+	"github.com/atlassian/gostatsd/pkg/stats"
 )
 
 type metricAndEvent struct {
@@ -31,7 +37,7 @@ func lex() *lexer.Lexer {
 
 func newTestParser(ignoreHost bool) (*DatagramParser, *countingHandler) {
 	ch := &countingHandler{}
-	return NewDatagramParser(nil, "", ignoreHost, 0, ch, rate.Limit(0), false, logrus.New()), ch
+	return NewDatagramParser(nil, "", ignoreHost, 0, ch, rate.Limit(0), false, DatagramParserOptions{}, logrus.New()), ch
 }
 
 func TestParseEmptyDatagram(t *testing.T) {
@@ -209,3 +215,192 @@ func TestParseDatagramIgnoreHost(t *testing.T) {
 		})
 	}
 }
+
+func TestParseDatagramIgnoreHostSourceTag(t *testing.T) {
+	t.Parallel()
+	dp := NewDatagramParser(nil, "", true, 0, &countingHandler{}, rate.Limit(0), false, DatagramParserOptions{SourceTag: "_host_ip"}, logrus.New())
+	metrics, _, badLines := dp.handleDatagram(context.Background(), lex(), 0, fakeIP, []byte("f:2|c|#_host_ip:10.0.0.5,host:h,a:b\ng:1|c|#_host_ip:10.0.0.6"))
+	require.Zero(t, badLines)
+	require.Len(t, metrics, 2)
+	// The source tag is removed, and the host tag is the source
+	assert.Equal(t, gostatsd.Source("h"), metrics[0].Source)
+	assert.Equal(t, gostatsd.Tags{"a:b"}, metrics[0].Tags)
+	assert.Empty(t, metrics[1].Source)
+	assert.Empty(t, metrics[1].Tags)
+}
+
+func TestParseDatagramNameLengthDrop(t *testing.T) {
+	t.Parallel()
+	ch := &countingHandler{}
+	mr := NewDatagramParser(nil, "ns", false, 0, ch, rate.Limit(0), false, DatagramParserOptions{MaxNameLength: 7}, logrus.New())
+	metrics, _, badLines := mr.handleDatagram(context.Background(), lex(), 0, fakeIP, []byte("abcd:1|c\nabcde:1|c\nabcdefgh:1|c"))
+	assert.Zero(t, badLines)
+	assert.Len(t, metrics, 1)
+	assert.Equal(t, "ns.abcd", metrics[0].Name)
+	assert.EqualValues(t, 2, mr.namesDropped)
+	assert.Zero(t, mr.namesTruncated)
+}
+
+func TestParseDatagramNameLengthTruncate(t *testing.T) {
+	t.Parallel()
+	ch := &countingHandler{}
+	mr := NewDatagramParser(nil, "", false, 0, ch, rate.Limit(0), false, DatagramParserOptions{MaxNameLength: 4, TruncateNames: true}, logrus.New())
+	metrics, _, badLines := mr.handleDatagram(context.Background(), lex(), 0, fakeIP, []byte("abc:1|c\nabcd:1|c\nabcdef:1|c\nabcdefgh:1|c"))
+	assert.Zero(t, badLines)
+	names := make([]string, 0, len(metrics))
+	for _, m := range metrics {
+		names = append(names, m.Name)
+	}
+	assert.Equal(t, []string{"abc", "abcd", "abcd", "abcd"}, names)
+	assert.EqualValues(t, 2, mr.namesTruncated)
+	assert.Zero(t, mr.namesDropped)
+}
+
+// typeCountingStatser sums the parser.received_by_type counts by their tags.
+type typeCountingStatser struct {
+	*stats.NullStatser
+
+	mu     sync.Mutex
+	counts map[string]float64
+}
+
+func (tcs *typeCountingStatser) Count(name string, amount float64, tags gostatsd.Tags) {
+	if name != "parser.received_by_type" {
+		return
+	}
+	tcs.mu.Lock()
+	defer tcs.mu.Unlock()
+	tcs.counts[tags[0]] += amount
+}
+
+func (tcs *typeCountingStatser) get() map[string]float64 {
+	tcs.mu.Lock()
+	defer tcs.mu.Unlock()
+	counts := make(map[string]float64, len(tcs.counts))
+	for tag, count := range tcs.counts {
+		counts[tag] = count
+	}
+	return counts
+}
+
+func TestParseDatagramWhitespace(t *testing.T) {
+	t.Parallel()
+	type result struct {
+		names    []string
+		badLines uint64
+	}
+	input := map[string]struct {
+		lenient result
+		strict  result
+	}{
+		"a:1|c\r\nb:1|c\r\n":  {result{[]string{"a", "b"}, 0}, result{[]string{}, 2}},
+		"a:1|c \nb:1|c\t\n":   {result{[]string{"a", "b"}, 0}, result{[]string{}, 2}},
+		" a:1|c\n\tb:1|c":     {result{[]string{"a", "b"}, 0}, result{[]string{}, 2}},
+		"a:1|c\n\n\nb:1|c\n":  {result{[]string{"a", "b"}, 0}, result{[]string{"a", "b"}, 2}},
+		"a:1|c\n \r\nb:1|c\n": {result{[]string{"a", "b"}, 0}, result{[]string{"a", "b"}, 1}},
+		"a:1|c\r\nb:x|c\r\n":  {result{[]string{"a"}, 1}, result{[]string{}, 2}},
+		"a:1 |c\r\n":          {result{[]string{}, 1}, result{[]string{}, 1}},
+	}
+	for datagram, expected := range input {
+		datagram := datagram
+		expected := expected
+		t.Run(strconv.Quote(datagram), func(t *testing.T) {
+			t.Parallel()
+			for strict, exp := range map[bool]result{false: expected.lenient, true: expected.strict} {
+				mr := NewDatagramParser(nil, "", false, 0, &countingHandler{}, rate.Limit(0), false, DatagramParserOptions{Strict: strict}, logrus.New())
+				metrics, _, badLines := mr.handleDatagram(context.Background(), lex(), 0, fakeIP, []byte(datagram))
+				names := make([]string, 0, len(metrics))
+				for _, m := range metrics {
+					names = append(names, m.Name)
+				}
+				assert.Equal(t, exp.names, names, "strict=%v", strict)
+				assert.Equal(t, exp.badLines, badLines, "strict=%v", strict)
+			}
+		})
+	}
+}
+
+func TestParseReceivedByType(t *testing.T) {
+	t.Parallel()
+	in := make(chan []*Datagram)
+	ch := &countingHandler{}
+	dp := NewDatagramParser(in, "", false, 0, ch, rate.Limit(0), false, DatagramParserOptions{}, logrus.New())
+	statser := &typeCountingStatser{
+		NullStatser: stats.NewNullStatser().(*stats.NullStatser),
+		counts:      map[string]float64{},
+	}
+
+	ctx, cancel := context.WithCancel(stats.NewContext(context.Background(), statser))
+	var wg wait.Group
+	defer wg.Wait()
+	defer cancel()
+	wg.StartWithContext(ctx, dp.Run)
+	wg.StartWithContext(ctx, dp.RunMetricsContext)
+
+	msgs := []string{
+		"a:1|c\nb:2|c\nc:3|g",
+		"d:4|ms\ne:5|ms\nf:6|ms\ng:x|s",
+		"_e{1,1}:t|x\nbad line\nh:7|c",
+	}
+	dgs := make([]*Datagram, 0, len(msgs))
+	for _, msg := range msgs {
+		dgs = append(dgs, &Datagram{IP: fakeIP, Msg: []byte(msg), DoneFunc: func() {}})
+	}
+	in <- dgs
+	in <- nil // Wait for the first batch to be processed
+
+	expected := map[string]float64{
+		"type:counter": 3,
+		"type:gauge":   1,
+		"type:timer":   3,
+		"type:set":     1,
+		"type:event":   1,
+	}
+	require.Eventually(t, func() bool {
+		statser.NotifyFlush(ctx, time.Second)
+		return assert.ObjectsAreEqual(expected, statser.get())
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Counts are reset every flush
+	for i := 0; i < 3; i++ {
+		statser.NotifyFlush(ctx, time.Second)
+	}
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, expected, statser.get())
+}
+
+func TestParseDatagramNonFinite(t *testing.T) {
+	t.Parallel()
+	datagram := []byte("g:+Inf|g\nt:-inf|ms\nc:Inf|c\nn:NaN|g\nok:1|g\nok:2|ms")
+	for policy, expected := range map[string]struct {
+		values   map[string]float64
+		badLines uint64
+	}{
+		"": {
+			values:   map[string]float64{"ok": 2},
+			badLines: 4,
+		},
+		gostatsd.NonFinitePolicyReject: {
+			values:   map[string]float64{"ok": 2},
+			badLines: 4,
+		},
+		gostatsd.NonFinitePolicyClamp: {
+			values:   map[string]float64{"g": math.MaxFloat64, "t": -math.MaxFloat64, "ok": 2},
+			badLines: 2,
+		},
+		gostatsd.NonFinitePolicyPass: {
+			values:   map[string]float64{"g": math.Inf(1), "t": math.Inf(-1), "ok": 2},
+			badLines: 2,
+		},
+	} {
+		dp := NewDatagramParser(nil, "", false, 0, &countingHandler{}, rate.Limit(0), false, DatagramParserOptions{NonFinitePolicy: policy}, logrus.New())
+		metrics, _, badLines := dp.handleDatagram(context.Background(), lex(), 0, fakeIP, append([]byte(nil), datagram...))
+		values := map[string]float64{}
+		for _, m := range metrics {
+			values[m.Name] = m.Value
+		}
+		assert.Equal(t, expected.values, values, policy)
+		assert.Equal(t, expected.badLines, badLines, policy)
+		assert.EqualValues(t, 4, dp.nonFinite, policy) // Counted whatever the policy
+	}
+}
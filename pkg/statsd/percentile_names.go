@@ -0,0 +1,121 @@
+package statsd
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"github.com/atlassian/gostatsd"
+)
+
+// percentileNamer renames timer percentile sub-metrics for a single backend.  The aggregator names each one
+// `<stat>_<pct>`, such as `upper_90`, which is rendered with a template containing `{stat}` and `{pct}`.
+type percentileNamer struct {
+	template string
+	names    atomic.Value // map[string]string of the names of the configured percentiles, keyed by the aggregator name
+}
+
+// newPercentileNamer creates a percentileNamer for the template, or returns nil if the template gives the names the
+// aggregator already uses.
+func newPercentileNamer(template string) (*percentileNamer, error) {
+	if !strings.Contains(template, "{stat}") || !strings.Contains(template, "{pct}") {
+		return nil, fmt.Errorf("percentile name template %q must contain {stat} and {pct}", template)
+	}
+	if template == gostatsd.DefaultPercentileNameTemplate {
+		return nil, nil
+	}
+	return &percentileNamer{
+		template: template,
+	}, nil
+}
+
+// newPercentileNamers creates a percentileNamer for each backend whose percentiles are not named the way the
+// aggregator names them, keyed by the backend name.  Each backend uses the template in overrides, if it has one, or
+// the default template.
+func newPercentileNamers(defaultTemplate string, overrides map[string]string, backends []gostatsd.Backend) (map[string]*percentileNamer, error) {
+	namers := map[string]*percentileNamer{}
+	for _, backend := range backends {
+		template := defaultTemplate
+		if override, ok := overrides[backend.Name()]; ok {
+			template = override
+		}
+		namer, err := newPercentileNamer(template)
+		if err != nil {
+			return nil, fmt.Errorf("backend %s: %v", backend.Name(), err)
+		}
+		if namer != nil {
+			namers[backend.Name()] = namer
+		}
+	}
+	return namers, nil
+}
+
+// setPercentiles renders the names of the sub-metrics of every percentile in percentThresholds and timerOverrides, so
+// they are looked up without rendering or locking when every aggregator flushes at once.
+func (pn *percentileNamer) setPercentiles(percentThresholds []float64, timerOverrides []*TimerOverride) {
+	names := map[string]string{}
+	add := func(ps percentStruct) {
+		for _, aggregatorName := range []string{ps.count, ps.mean, ps.sum, ps.sumSquares, ps.upper, ps.lower} {
+			names[aggregatorName] = pn.render(aggregatorName)
+		}
+	}
+	for _, ps := range newPercentThresholds(percentThresholds) {
+		add(ps)
+	}
+	for _, to := range timerOverrides {
+		for _, ps := range to.percentThresholds {
+			add(ps)
+		}
+	}
+	pn.names.Store(names)
+}
+
+// name returns the name of the percentile sub-metric named aggregatorName by the aggregator.  Names which aren't of
+// the form `<stat>_<pct>` are unchanged.  It is safe for concurrent use.
+func (pn *percentileNamer) name(aggregatorName string) string {
+	if names, ok := pn.names.Load().(map[string]string); ok {
+		if name, ok := names[aggregatorName]; ok {
+			return name
+		}
+	}
+	return pn.render(aggregatorName)
+}
+
+func (pn *percentileNamer) render(aggregatorName string) string {
+	if idx := percentileIndex(aggregatorName); idx > 0 {
+		return strings.NewReplacer("{stat}", aggregatorName[:idx-1], "{pct}", aggregatorName[idx:]).Replace(pn.template)
+	}
+	return aggregatorName
+}
+
+// apply returns a new MetricMap with the timer percentiles renamed.  The other values are not copied, so the result
+// must be treated as read only, the same as the input.
+func (pn *percentileNamer) apply(mm *gostatsd.MetricMap) *gostatsd.MetricMap {
+	mmNew := gostatsd.NewMetricMap()
+	mm.Counters.Each(mmNew.MergeCounter)
+	mm.Gauges.Each(mmNew.MergeGauge)
+	mm.Sets.Each(mmNew.MergeSet)
+	mm.Timers.Each(func(metricName, tagsKey string, t gostatsd.Timer) {
+		if len(t.Percentiles) > 0 {
+			percentiles := make(gostatsd.Percentiles, len(t.Percentiles))
+			for i, pct := range t.Percentiles {
+				percentiles[i] = gostatsd.Percentile{Float: pct.Float, Str: pn.name(pct.Str)}
+			}
+			t.Percentiles = percentiles
+		}
+		mmNew.MergeTimer(metricName, tagsKey, t)
+	})
+	return mmNew
+}
+
+// percentileIndex returns the index of the percentile in a name of the form `<stat>_<pct>`, or -1 if there is none.
+// The percentile is after the first `_` followed by a digit or `-`, as stats such as `sum_squares` contain `_`, and
+// fractional percentiles such as `99_9` do as well.
+func percentileIndex(aggregatorName string) int {
+	for i := 1; i < len(aggregatorName)-1; i++ {
+		if c := aggregatorName[i+1]; aggregatorName[i] == '_' && (c == '-' || (c >= '0' && c <= '9')) {
+			return i + 1
+		}
+	}
+	return -1
+}
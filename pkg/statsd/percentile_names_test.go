@@ -0,0 +1,172 @@
+package statsd
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/atlassian/gostatsd"
+)
+
+func TestPercentileNamerTemplates(t *testing.T) {
+	t.Parallel()
+	input := map[string]map[string]string{
+		"{stat}.p{pct}":           {"upper_95": "upper.p95", "sum_squares_90": "sum_squares.p90", "lower_-10": "lower.p-10", "upper_99_9": "upper.p99_9", "sum_squares_-99_9": "sum_squares.p-99_9"},
+		"{pct}percentile":         nil, // Missing {stat}
+		"p{pct}_{stat}":           {"upper_95": "p95_upper", "count_99": "p99_count"},
+		"{stat}_percentile_{pct}": {"upper_95": "upper_percentile_95", "mean_50": "mean_percentile_50"},
+	}
+	for template, expected := range input {
+		template := template
+		expected := expected
+		t.Run(template, func(t *testing.T) {
+			t.Parallel()
+			pn, err := newPercentileNamer(template)
+			if expected == nil {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			for aggregatorName, name := range expected {
+				assert.Equal(t, name, pn.name(aggregatorName))
+			}
+			pn.setPercentiles([]float64{95, 99.9, -10}, nil)
+			for aggregatorName, name := range expected {
+				assert.Equal(t, name, pn.name(aggregatorName)) // Precomputed, or rendered if the percentile isn't set
+			}
+			assert.Equal(t, "unknown", pn.name("unknown"))
+		})
+	}
+}
+
+func TestPercentileNamerConcurrent(t *testing.T) {
+	t.Parallel()
+	pn, err := newPercentileNamer("{stat}.p{pct}")
+	require.NoError(t, err)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, pct := range []string{"90", "95", "99"} {
+				assert.Equal(t, "upper.p"+pct, pn.name("upper_"+pct))
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestPercentileNamerSetPercentiles(t *testing.T) {
+	t.Parallel()
+	pn, err := newPercentileNamer("{stat}.p{pct}")
+	require.NoError(t, err)
+	to, err := newPercentileOverride([]string{"50"})
+	require.NoError(t, err)
+	pn.setPercentiles([]float64{90, 0}, []*TimerOverride{to})
+
+	names := pn.names.Load().(map[string]string)
+	assert.Len(t, names, 12)
+	assert.Equal(t, "sum_squares.p90", names["sum_squares_90"])
+	assert.Equal(t, "upper.p50", names["upper_50"])
+	assert.NotContains(t, names, "upper_0")
+
+	// Percentiles which are reloaded replace the previous ones
+	pn.setPercentiles([]float64{99}, nil)
+	names = pn.names.Load().(map[string]string)
+	assert.Len(t, names, 6)
+	assert.Equal(t, "upper.p99", names["upper_99"])
+	assert.Equal(t, "upper.p90", pn.name("upper_90"))
+}
+
+func TestFlusherAppliesPercentileNamersConcurrently(t *testing.T) {
+	t.Parallel()
+	datadog := &namedCapturingBackend{name: "datadog"}
+	fl := NewMetricFlusher(0, 0, false, nil, []gostatsd.Backend{datadog}, nil)
+	var err error
+	fl.percentileNamers, err = newPercentileNamers("{stat}.p{pct}", nil, fl.backends)
+	require.NoError(t, err)
+
+	// Each aggregator sends its metrics from its own goroutine, at the same time
+	var wg, sendWg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		input := gostatsd.NewMetricMap()
+		timer := gostatsd.Timer{Count: 1}
+		timer.Percentiles.Set("upper_90", 1)
+		timer.Percentiles.Set("count_90", 1)
+		input.Timers["t"] = map[string]gostatsd.Timer{"": timer}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			fl.sendMetricsAsync(context.Background(), &sendWg, input, nil)
+		}()
+	}
+	wg.Wait()
+	sendWg.Wait()
+
+	maps := datadog.maps
+	require.Len(t, maps, 4)
+	for _, mm := range maps {
+		assert.Equal(t, gostatsd.Percentiles{{Float: 1, Str: "upper.p90"}, {Float: 1, Str: "count.p90"}}, mm.Timers["t"][""].Percentiles)
+	}
+}
+
+func TestPercentileNamerDefault(t *testing.T) {
+	t.Parallel()
+	pn, err := newPercentileNamer(gostatsd.DefaultPercentileNameTemplate)
+	require.NoError(t, err)
+	assert.Nil(t, pn)
+
+	_, err = newPercentileNamer("{stat}")
+	require.Error(t, err)
+}
+
+func TestNewPercentileNamers(t *testing.T) {
+	t.Parallel()
+	backends := []gostatsd.Backend{
+		&namedCapturingBackend{name: "datadog"},
+		&namedCapturingBackend{name: "graphite"},
+		&namedCapturingBackend{name: "stdout"},
+	}
+	namers, err := newPercentileNamers("{stat}.p{pct}", map[string]string{"graphite": gostatsd.DefaultPercentileNameTemplate}, backends)
+	require.NoError(t, err)
+	require.Len(t, namers, 2)
+	assert.Equal(t, "upper.p90", namers["datadog"].name("upper_90"))
+	assert.Equal(t, "upper.p90", namers["stdout"].name("upper_90"))
+	assert.NotContains(t, namers, "graphite")
+
+	_, err = newPercentileNamers(gostatsd.DefaultPercentileNameTemplate, map[string]string{"stdout": "{pct}"}, backends)
+	require.Error(t, err)
+}
+
+func TestFlusherAppliesPercentileNamers(t *testing.T) {
+	t.Parallel()
+	datadog := &namedCapturingBackend{name: "datadog"}
+	graphite := &namedCapturingBackend{name: "graphite"}
+	fl := NewMetricFlusher(0, 0, false, nil, []gostatsd.Backend{datadog, graphite}, nil)
+	var err error
+	fl.percentileNamers, err = newPercentileNamers(gostatsd.DefaultPercentileNameTemplate, map[string]string{"datadog": "{stat}.p{pct}"}, fl.backends)
+	require.NoError(t, err)
+
+	input := newBackendFilterTestMap()
+	timer := input.Timers["paid.latency"][""]
+	timer.Percentiles.Set("upper_90", 1)
+	timer.Percentiles.Set("count_90", 1)
+	input.Timers["paid.latency"][""] = timer
+
+	var wg sync.WaitGroup
+	fl.sendMetricsAsync(context.Background(), &wg, input, nil)
+	wg.Wait()
+
+	require.Len(t, graphite.maps, 1)
+	assert.Equal(t, input, graphite.maps[0])
+	require.Len(t, datadog.maps, 1)
+	assert.Equal(t, gostatsd.Percentiles{{Float: 1, Str: "upper.p90"}, {Float: 1, Str: "count.p90"}}, datadog.maps[0].Timers["paid.latency"][""].Percentiles)
+	assert.Equal(t, input.Counters, datadog.maps[0].Counters)
+	assert.Equal(t, input.Gauges, datadog.maps[0].Gauges)
+	assert.Equal(t, input.Sets, datadog.maps[0].Sets)
+	// The input is not modified
+	assert.Equal(t, gostatsd.Percentiles{{Float: 1, Str: "upper_90"}, {Float: 1, Str: "count_90"}}, input.Timers["paid.latency"][""].Percentiles)
+}
@@ -0,0 +1,176 @@
+package statsd
+
+import (
+	"math"
+	"math/bits"
+	"sort"
+
+	"github.com/atlassian/gostatsd"
+)
+
+// flushSelect calculates the timer statistics in the same way as the sort based calculation in Flush, but only
+// partially orders the values, using a selection algorithm to find the values at the percentile boundaries and the
+// median.  Sums may differ from the sort based calculation due to floating point rounding, as values are added in a
+// different order.
+func flushSelect(timer *gostatsd.Timer, percentThresholds map[float64]percentStruct, disabledSubtypes gostatsd.TimerSubtypes, flushInSeconds float64) {
+	values := timer.Values
+	n := len(values)
+	count := float64(n)
+
+	numsInThreshold := make(map[float64]int, len(percentThresholds))
+	indexes := make([]int, 0, len(percentThresholds)+2)
+	for pct := range percentThresholds {
+		numInThreshold := n
+		if n > 1 {
+			numInThreshold = int(round(math.Abs(pct) / 100 * count))
+			if numInThreshold == 0 {
+				continue
+			}
+		}
+		numsInThreshold[pct] = numInThreshold
+		if pct > 0 {
+			indexes = append(indexes, numInThreshold-1)
+		} else {
+			indexes = append(indexes, n-numInThreshold)
+		}
+	}
+	mid := n / 2
+	if n%2 == 0 {
+		indexes = append(indexes, mid-1)
+	}
+	indexes = append(indexes, mid)
+	multiSelect(values, indexes)
+
+	timer.Min, timer.Max = values[0], values[0]
+	var sum, sumSquares float64
+	for _, v := range values {
+		if floatLess(v, timer.Min) {
+			timer.Min = v
+		}
+		if floatLess(timer.Max, v) {
+			timer.Max = v
+		}
+		sum += v
+		sumSquares += v * v
+	}
+
+	for pct, pctStruct := range percentThresholds {
+		numInThreshold, ok := numsInThreshold[pct]
+		if !ok {
+			continue
+		}
+		var inThreshold []float64
+		var thresholdBoundary float64
+		if pct > 0 {
+			inThreshold = values[:numInThreshold]
+			thresholdBoundary = values[numInThreshold-1]
+		} else {
+			inThreshold = values[n-numInThreshold:]
+			thresholdBoundary = values[n-numInThreshold]
+		}
+		var pctSum, pctSumSquares float64
+		for _, v := range inThreshold {
+			pctSum += v
+			pctSumSquares += v * v
+		}
+		setPercentiles(timer, pct, pctStruct, disabledSubtypes, float64(numInThreshold), pctSum/float64(numInThreshold), pctSum, pctSumSquares, thresholdBoundary)
+	}
+
+	mean := sum / count
+	var sumOfDiffs float64
+	for _, v := range values {
+		sumOfDiffs += (v - mean) * (v - mean)
+	}
+
+	if n%2 == 0 {
+		timer.Median = (values[mid-1] + values[mid]) / 2
+	} else {
+		timer.Median = values[mid]
+	}
+
+	timer.Mean = mean
+	timer.StdDev = math.Sqrt(sumOfDiffs / count)
+	timer.Sum = sum
+	timer.SumSquares = sumSquares
+
+	timer.Count = int(round(timer.SampledCount))
+	timer.PerSecond = timer.SampledCount / flushInSeconds
+}
+
+// floatLess orders values the same as sort.Float64s, with NaN before all other values.
+func floatLess(a, b float64) bool {
+	return a < b || (math.IsNaN(a) && !math.IsNaN(b))
+}
+
+// multiSelect partially orders values, so that the value at each of the indexes is the value that would be there if
+// values were sorted, and every value before it is no greater, and every value after it is no less.
+func multiSelect(values []float64, indexes []int) {
+	sort.Ints(indexes)
+	lo := 0
+	for _, idx := range indexes {
+		if idx < lo {
+			continue // Duplicate, already in place
+		}
+		// Each selection only partitions the values after the previous index, which are already no less than it
+		quickselect(values[lo:], idx-lo)
+		lo = idx + 1
+	}
+}
+
+// quickselect partially orders values so that values[k] is the k-th smallest value, using the median of three as
+// the pivot.  If partitioning is not converging quickly it falls back to sorting the remaining range, which bounds
+// the worst case to O(n log n), as in introselect.
+func quickselect(values []float64, k int) {
+	lo, hi := 0, len(values)-1
+	budget := 2 * bits.Len(uint(len(values)))
+	for hi > lo {
+		if budget == 0 {
+			sort.Float64s(values[lo : hi+1])
+			return
+		}
+		budget--
+
+		lt, gt := partition(values, lo, hi)
+		switch {
+		case k < lt:
+			hi = lt - 1
+		case k > gt:
+			lo = gt + 1
+		default:
+			return
+		}
+	}
+}
+
+// partition partitions values[lo:hi+1] in to values less than, equal to, and greater than a median of three pivot,
+// returning the range of values equal to the pivot.  Grouping equal values keeps timers with many repeated values
+// from degrading to the worst case.
+func partition(values []float64, lo, hi int) (lt, gt int) {
+	mid := lo + (hi-lo)/2
+	if floatLess(values[mid], values[lo]) {
+		values[mid], values[lo] = values[lo], values[mid]
+	}
+	if floatLess(values[hi], values[lo]) {
+		values[hi], values[lo] = values[lo], values[hi]
+	}
+	if floatLess(values[hi], values[mid]) {
+		values[hi], values[mid] = values[mid], values[hi]
+	}
+	pivot := values[mid]
+
+	lt, gt = lo, hi
+	for i := lo; i <= gt; {
+		switch {
+		case floatLess(values[i], pivot):
+			values[i], values[lt] = values[lt], values[i]
+			lt++
+			i++
+		case floatLess(pivot, values[i]):
+			values[i], values[gt] = values[gt], values[i]
+			gt--
+		default:
+			i++
+		}
+	}
+	return lt, gt
+}
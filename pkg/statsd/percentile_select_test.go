@@ -0,0 +1,202 @@
+package statsd
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/atlassian/gostatsd"
+)
+
+func newPercentileAggregator(pcts []float64, selectPercentiles bool) *MetricAggregator {
+	ma := NewMetricAggregator(pcts, 0, 0, 0, 0, gostatsd.TimerSubtypes{}, math.MaxUint32)
+	ma.selectPercentiles = selectPercentiles
+	return ma
+}
+
+// flushTimer flushes a single timer with the given values, which are not modified.
+func flushTimer(ma *MetricAggregator, values []float64) gostatsd.Timer {
+	ma.metricMap.Timers["t"] = map[string]gostatsd.Timer{
+		"": gostatsd.NewTimerValues(append([]float64(nil), values...)),
+	}
+	ma.Flush(time.Second)
+	return ma.metricMap.Timers["t"][""]
+}
+
+func TestMultiSelect(t *testing.T) {
+	t.Parallel()
+	r := rand.New(rand.NewSource(1))
+	for _, n := range []int{1, 2, 3, 10, 100, 1001} {
+		for _, distinct := range []int{1, 3, n} {
+			values := make([]float64, n)
+			for i := range values {
+				values[i] = float64(r.Intn(distinct))
+			}
+			sorted := append([]float64(nil), values...)
+			sort.Float64s(sorted)
+
+			indexes := []int{r.Intn(n), r.Intn(n), 0, n - 1}
+			multiSelect(values, append([]int(nil), indexes...))
+			for _, idx := range indexes {
+				require.Equal(t, sorted[idx], values[idx], "n=%d distinct=%d idx=%d", n, distinct, idx)
+				for i := 0; i < idx; i++ {
+					require.LessOrEqual(t, values[i], values[idx])
+				}
+				for i := idx + 1; i < n; i++ {
+					require.GreaterOrEqual(t, values[i], values[idx])
+				}
+			}
+		}
+	}
+}
+
+func TestFlushSelectMatchesSort(t *testing.T) {
+	t.Parallel()
+	r := rand.New(rand.NewSource(2))
+	pcts := []float64{1, 50, 90, 95, 99, 99.99, 100, -10, -50, -99.99, -100}
+	sorter := newPercentileAggregator(pcts, false)
+	selector := newPercentileAggregator(pcts, true)
+
+	for _, n := range []int{1, 2, 3, 4, 5, 10, 99, 100, 1000, 12345} {
+		for name, sample := range map[string]func() float64{
+			"uniform":   func() float64 { return r.Float64() * 1000 },
+			"repeated":  func() float64 { return float64(r.Intn(5)) },
+			"negative":  func() float64 { return r.NormFloat64() * 100 },
+			"heavytail": func() float64 { return math.Exp(r.NormFloat64() * 3) },
+		} {
+			values := make([]float64, n)
+			for i := range values {
+				values[i] = sample()
+			}
+			expected := flushTimer(sorter, values)
+			actual := flushTimer(selector, values)
+			msg := fmt.Sprintf("n=%d %s", n, name)
+
+			assert.Equal(t, expected.Count, actual.Count, msg)
+			assert.Equal(t, expected.PerSecond, actual.PerSecond, msg)
+			assert.Equal(t, expected.Min, actual.Min, msg)
+			assert.Equal(t, expected.Max, actual.Max, msg)
+			assert.Equal(t, expected.Median, actual.Median, msg)
+			assertFloatsEqual(t, expected.Mean, actual.Mean, msg)
+			assertFloatsEqual(t, expected.StdDev, actual.StdDev, msg)
+			assertFloatsEqual(t, expected.Sum, actual.Sum, msg)
+			assertFloatsEqual(t, expected.SumSquares, actual.SumSquares, msg)
+
+			expectedPcts := map[string]float64{}
+			for _, pct := range expected.Percentiles {
+				expectedPcts[pct.Str] = pct.Float
+			}
+			require.Len(t, actual.Percentiles, len(expectedPcts), msg)
+			for _, pct := range actual.Percentiles {
+				expectedPct, ok := expectedPcts[pct.Str]
+				require.True(t, ok, "%s %s", msg, pct.Str)
+				assertFloatsEqual(t, expectedPct, pct.Float, "%s %s", msg, pct.Str)
+			}
+		}
+	}
+}
+
+func TestFlushPercentileBoundaries(t *testing.T) {
+	t.Parallel()
+	pcts := []float64{0, 99, 99.99, 100, -99.99, -100}
+	many := make([]float64, 20000)
+	for i := range many {
+		many[i] = float64(len(many) - i)
+	}
+	for _, selectPercentiles := range []bool{false, true} {
+		ma := newPercentileAggregator(pcts, selectPercentiles)
+		msg := fmt.Sprintf("select=%t", selectPercentiles)
+
+		pctValues := percentileValues(flushTimer(ma, many))
+		assert.Equal(t, 19800.0, pctValues["upper_99"], msg)
+		assert.Equal(t, 19998.0, pctValues["upper_99_99"], msg)
+		assert.Equal(t, 19998.0, pctValues["count_99_99"], msg)
+		assert.Equal(t, 20000.0, pctValues["upper_100"], msg)
+		assert.Equal(t, 20000.0, pctValues["count_100"], msg)
+		assert.Equal(t, 200010000.0, pctValues["sum_100"], msg)
+		assert.Equal(t, 3.0, pctValues["lower_-99_99"], msg)
+		assert.Equal(t, 1.0, pctValues["lower_-100"], msg)
+		assert.Equal(t, 200010000.0, pctValues["sum_-100"], msg)
+		assert.Equal(t, 10000.5, pctValues["mean_-100"], msg)
+		assert.NotContains(t, pctValues, "count_0", msg)
+
+		pctValues = percentileValues(flushTimer(ma, []float64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}))
+		// 99.99% of 10 values rounds to all of them
+		assert.Equal(t, 10.0, pctValues["upper_99_99"], msg)
+		assert.Equal(t, 1.0, pctValues["lower_-99_99"], msg)
+		assert.Equal(t, 55.0, pctValues["sum_-99_99"], msg)
+		assert.Equal(t, 385.0, pctValues["sum_squares_-100"], msg)
+
+		pctValues = percentileValues(flushTimer(ma, []float64{42}))
+		assert.Len(t, pctValues, 25, msg) // 4 shared sub-metrics and a boundary for each percentile except 0
+		for _, pct := range []string{"99", "99_99", "100"} {
+			assert.Equal(t, 42.0, pctValues["upper_"+pct], "%s %s", msg, pct)
+			assert.Equal(t, 1.0, pctValues["count_"+pct], "%s %s", msg, pct)
+		}
+		for _, pct := range []string{"-99_99", "-100"} {
+			assert.Equal(t, 42.0, pctValues["lower_"+pct], "%s %s", msg, pct)
+		}
+
+		timer := flushTimer(ma, nil)
+		assert.Empty(t, timer.Percentiles, msg)
+		assert.Zero(t, timer.Count, msg)
+	}
+}
+
+func percentileValues(timer gostatsd.Timer) map[string]float64 {
+	values := map[string]float64{}
+	for _, pct := range timer.Percentiles {
+		values[pct.Str] = pct.Float
+	}
+	return values
+}
+
+// assertFloatsEqual allows for the rounding differences caused by summing values in a different order.
+func assertFloatsEqual(t *testing.T, expected, actual float64, msgAndArgs ...interface{}) {
+	if math.Abs(expected) < 1e-9 {
+		assert.InDelta(t, expected, actual, 1e-9, msgAndArgs...)
+	} else {
+		assert.InEpsilon(t, expected, actual, 1e-9, msgAndArgs...)
+	}
+}
+
+func TestFlushSelectNaN(t *testing.T) {
+	t.Parallel()
+	values := []float64{3, math.NaN(), 1, 2}
+	expected := flushTimer(newPercentileAggregator([]float64{50}, false), values)
+	actual := flushTimer(newPercentileAggregator([]float64{50}, true), values)
+	assert.True(t, math.IsNaN(actual.Min))
+	assert.Equal(t, expected.Max, actual.Max)
+	assert.Equal(t, expected.Median, actual.Median)
+}
+
+func BenchmarkFlushPercentiles(b *testing.B) {
+	r := rand.New(rand.NewSource(1))
+	for _, n := range []int{100, 10000, 1000000} {
+		values := make([]float64, n)
+		for i := range values {
+			values[i] = r.ExpFloat64() * 100
+		}
+		for _, pcts := range [][]float64{{90}, {50, 90, 95, 99}, {10, 20, 30, 40, 50, 60, 70, 80, 90, 95, 99, -10}} {
+			for _, algorithm := range []string{gostatsd.PercentileAlgorithmSort, gostatsd.PercentileAlgorithmSelect} {
+				b.Run(fmt.Sprintf("%s/values=%d/percentiles=%d", algorithm, n, len(pcts)), func(b *testing.B) {
+					ma := newPercentileAggregator(pcts, algorithm == gostatsd.PercentileAlgorithmSelect)
+					timerValues := make([]float64, n)
+					b.ReportAllocs()
+					b.ResetTimer()
+					for i := 0; i < b.N; i++ {
+						copy(timerValues, values)
+						ma.metricMap.Timers["t"] = map[string]gostatsd.Timer{"": gostatsd.NewTimerValues(timerValues)}
+						ma.Flush(time.Second)
+					}
+				})
+			}
+		}
+	}
+}
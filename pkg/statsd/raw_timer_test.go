@@ -0,0 +1,97 @@
+package statsd
+
+import (
+	"context"
+	"math"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/atlassian/gostatsd"
+)
+
+// rawTimerBackend captures the raw timer samples it is sent, copying them synchronously as backends must.
+type rawTimerBackend struct {
+	namedCapturingBackend
+	raw bool
+
+	samples map[string][]float64
+}
+
+func (rtb *rawTimerBackend) RawTimers() bool {
+	return rtb.raw
+}
+
+func (rtb *rawTimerBackend) SendMetricsAsync(ctx context.Context, mm *gostatsd.MetricMap, cb gostatsd.SendCallback) {
+	rtb.mu.Lock()
+	rtb.samples = map[string][]float64{}
+	mm.Timers.Each(func(key, tagsKey string, timer gostatsd.Timer) {
+		rtb.samples[key] = append(rtb.samples[key], timer.Values...)
+	})
+	rtb.mu.Unlock()
+	rtb.namedCapturingBackend.SendMetricsAsync(ctx, mm, cb)
+}
+
+func TestRawTimersOnly(t *testing.T) {
+	t.Parallel()
+	raw := &rawTimerBackend{raw: true}
+	notRaw := &rawTimerBackend{raw: false}
+	other := &namedCapturingBackend{}
+
+	assert.False(t, gostatsd.RawTimersOnly(nil))
+	assert.True(t, gostatsd.RawTimersOnly([]gostatsd.Backend{raw}))
+	assert.True(t, gostatsd.RawTimersOnly([]gostatsd.Backend{raw, raw}))
+	assert.False(t, gostatsd.RawTimersOnly([]gostatsd.Backend{raw, notRaw}))
+	assert.False(t, gostatsd.RawTimersOnly([]gostatsd.Backend{raw, other}))
+}
+
+func TestFlushRawTimers(t *testing.T) {
+	t.Parallel()
+	backend := &rawTimerBackend{raw: true}
+	backends := []gostatsd.Backend{backend}
+	ma := NewMetricAggregator([]float64{90}, 0, 0, 0, 0, gostatsd.TimerSubtypes{}, math.MaxUint32)
+	ma.rawTimersOnly = gostatsd.RawTimersOnly(backends)
+	fl := NewMetricFlusher(0, 0, false, nil, backends, nil)
+
+	values := []float64{5, 3, 9, 1, 7, 3}
+	mm := gostatsd.NewMetricMap()
+	for _, v := range values {
+		mm.Receive(&gostatsd.Metric{Name: "t", Value: v, Rate: 0.5, Type: gostatsd.TIMER})
+	}
+	ma.ReceiveMap(mm)
+	ma.Flush(2 * time.Second)
+
+	timer := ma.metricMap.Timers["t"][""]
+	assert.Equal(t, values, timer.Values) // Not sorted
+	assert.EqualValues(t, 12, timer.SampledCount)
+	assert.Equal(t, 12, timer.Count)
+	assert.EqualValues(t, 6, timer.PerSecond)
+	assert.Empty(t, timer.Percentiles)
+	assert.Zero(t, timer.Max)
+
+	var wg sync.WaitGroup
+	ma.Process(func(m *gostatsd.MetricMap) {
+		fl.sendMetricsAsync(context.Background(), &wg, m, nil)
+	})
+	wg.Wait()
+	ma.Reset()
+
+	require.Len(t, backend.maps, 1)
+	assert.Equal(t, map[string][]float64{"t": values}, backend.samples)
+}
+
+func TestFlushRawTimersMixedBackends(t *testing.T) {
+	t.Parallel()
+	backends := []gostatsd.Backend{&rawTimerBackend{raw: true}, &namedCapturingBackend{}}
+	ma := NewMetricAggregator([]float64{90}, 0, 0, 0, 0, gostatsd.TimerSubtypes{}, math.MaxUint32)
+	ma.rawTimersOnly = gostatsd.RawTimersOnly(backends)
+
+	timer := flushTimer(ma, []float64{5, 3, 9, 1})
+	assert.Len(t, timer.Values, 4)
+	assert.EqualValues(t, 9, timer.Max)
+	assert.EqualValues(t, 1, timer.Min)
+	assert.Len(t, timer.Percentiles, 5)
+}
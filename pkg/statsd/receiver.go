@@ -28,23 +28,27 @@ type DatagramReceiver struct {
 	datagramsReceived      uint64
 	batchesRead            uint64
 	cumulDatagramsReceived uint64
+	duplicateDone          uint64 // Datagrams which were released more than once
 
 	bufPool *pool.DatagramBufferPool
 
 	receiveBatchSize int // The number of datagrams to read in each batch
 	numReaders       int
 	socketFactory    SocketFactory
+	backpressure     *ReaderBackpressure // Pauses reading while downstream is saturated, may be nil
 
 	out chan<- []*Datagram // Output chan of read datagram batches
 }
 
-// NewDatagramReceiver initialises a new DatagramReceiver.
-func NewDatagramReceiver(out chan<- []*Datagram, sf SocketFactory, numReaders, receiveBatchSize int) *DatagramReceiver {
+// NewDatagramReceiver initialises a new DatagramReceiver.  If backpressure is not nil, readers will pause while
+// downstream is saturated.
+func NewDatagramReceiver(out chan<- []*Datagram, sf SocketFactory, numReaders, receiveBatchSize int, backpressure *ReaderBackpressure) *DatagramReceiver {
 	return &DatagramReceiver{
 		out:              out,
 		receiveBatchSize: receiveBatchSize,
 		numReaders:       numReaders,
 		socketFactory:    sf,
+		backpressure:     backpressure,
 		bufPool:          pool.NewDatagramBufferPool(packetSizeUDP),
 	}
 }
@@ -70,6 +74,11 @@ func (dr *DatagramReceiver) RunMetricsContext(ctx context.Context) {
 			}
 			statser.Gauge("receiver.datagrams_received", float64(dr.cumulDatagramsReceived), nil)
 			statser.Gauge("receiver.avg_datagrams_in_batch", avgDatagramsInBatch, nil)
+			statser.Gauge("receiver.duplicate_datagram_releases", float64(atomic.LoadUint64(&dr.duplicateDone)), nil)
+			if dr.backpressure != nil {
+				statser.Gauge("receiver.reader_pauses", float64(atomic.LoadUint64(&dr.backpressure.pauses)), nil)
+				statser.Gauge("receiver.readers_paused", float64(atomic.LoadInt64(&dr.backpressure.pausedReaders)), nil)
+			}
 		}
 	}
 }
@@ -89,6 +98,8 @@ func (dr *DatagramReceiver) Run(ctx context.Context) {
 		})
 	}
 
+	wg.StartWithContext(ctx, newSocketStatsCollector(connections).RunMetricsContext)
+
 	// Work until done
 	<-ctx.Done()
 
@@ -110,7 +121,13 @@ func (dr *DatagramReceiver) Run(ctx context.Context) {
 	wg.Wait()
 }
 
-// Receive accepts incoming datagrams on c, and passes them off to be parsed
+// Receive accepts incoming datagrams on c, and passes them off to be parsed.
+//
+// Each datagram is processed at most once, regardless of the number of readers.  Every read from a socket, whether
+// shared between readers or one per reader with SO_REUSEPORT, returns a datagram to exactly one reader, and each
+// datagram is read in to a buffer owned by that reader until the datagram is released by its DoneFunc.  Releasing a
+// datagram more than once would return its buffer to the pool twice, allowing two reads to share a buffer, so any
+// further release is ignored and counted in receiver.duplicate_datagram_releases.
 func (dr *DatagramReceiver) Receive(ctx context.Context, c net.PacketConn) {
 	br := NewBatchReader(c)
 	messages := make([]Message, dr.receiveBatchSize)
@@ -121,6 +138,9 @@ func (dr *DatagramReceiver) Receive(ctx context.Context, c net.PacketConn) {
 		messages[i].Buffers = *retBuffers[i]
 	}
 	for {
+		if dr.backpressure != nil && !dr.backpressure.wait(ctx) {
+			return
+		}
 
 		datagramCount, err := br.ReadBatch(messages)
 		now := gostatsd.NanoNow()
@@ -146,7 +166,12 @@ func (dr *DatagramReceiver) Receive(ctx context.Context, c net.PacketConn) {
 			buf := messages[i].Buffers[0][:nbytes]
 
 			retBuf := retBuffers[i]
+			var released uint32
 			doneFn := func() {
+				if !atomic.CompareAndSwapUint32(&released, 0, 1) {
+					atomic.AddUint64(&dr.duplicateDone, 1)
+					return
+				}
 				dr.bufPool.Put(retBuf)
 			}
 
@@ -0,0 +1,55 @@
+package statsd
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// ReaderBackpressure pauses socket readers while a downstream queue is too full, so bursts are absorbed by the
+// kernel socket buffer, and any drops are visible in the kernel socket statistics.  Reading pauses when the queue
+// length reaches the high watermark, and resumes once it is at or below the low watermark.
+type ReaderBackpressure struct {
+	// Counter fields below must be read/written only using atomic instructions.
+	// 64-bit fields must be the first fields in the struct to guarantee proper memory alignment.
+	// See https://golang.org/pkg/sync/atomic/#pkg-note-BUG
+	pauses        uint64 // Cumulative number of times a reader has paused
+	pausedReaders int64  // Absolute number of readers currently paused
+
+	queueLen      func() int
+	highWatermark int
+	lowWatermark  int
+	pollInterval  time.Duration
+}
+
+// NewReaderBackpressure creates a new ReaderBackpressure which monitors the length of a queue via queueLen.
+func NewReaderBackpressure(queueLen func() int, highWatermark, lowWatermark int) *ReaderBackpressure {
+	return &ReaderBackpressure{
+		queueLen:      queueLen,
+		highWatermark: highWatermark,
+		lowWatermark:  lowWatermark,
+		pollInterval:  5 * time.Millisecond,
+	}
+}
+
+// wait blocks while the queue is too full, returning false if the context is done.
+func (rb *ReaderBackpressure) wait(ctx context.Context) bool {
+	if rb.queueLen() < rb.highWatermark {
+		return true
+	}
+
+	atomic.AddUint64(&rb.pauses, 1)
+	atomic.AddInt64(&rb.pausedReaders, 1)
+	defer atomic.AddInt64(&rb.pausedReaders, -1)
+
+	ticker := time.NewTicker(rb.pollInterval)
+	defer ticker.Stop()
+	for rb.queueLen() > rb.lowWatermark {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-ticker.C:
+		}
+	}
+	return true
+}
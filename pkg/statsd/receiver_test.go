@@ -2,10 +2,14 @@ package statsd
 
 import (
 	"context"
+	"fmt"
 	"net"
 	"os"
 	"runtime"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -28,7 +32,7 @@ func BenchmarkReceive(b *testing.B) {
 	//
 	// ... so this is pretty arbitrary.
 	ch := make(chan []*Datagram, 5000)
-	mr := NewDatagramReceiver(ch, nil, 0, gostatsd.DefaultReceiveBatchSize)
+	mr := NewDatagramReceiver(ch, nil, 0, gostatsd.DefaultReceiveBatchSize, nil)
 	c, done := fakesocket.NewCountedFakePacketConn(uint64(b.N))
 
 	var wg sync.WaitGroup
@@ -74,7 +78,7 @@ func BenchmarkReceive(b *testing.B) {
 
 func TestDatagramReceiver_Receive(t *testing.T) {
 	ch := make(chan []*Datagram, 1)
-	mr := NewDatagramReceiver(ch, nil, 0, 2)
+	mr := NewDatagramReceiver(ch, nil, 0, 2, nil)
 	c := fakesocket.NewFakePacketConn()
 
 	ctx, cancel := context.WithCancel(context.Background())
@@ -103,7 +107,7 @@ func TestDatagramReceiver_UnixSocketConnection(t *testing.T) {
 
 	// Datagram receiver listening in Unix Domain Socket
 	socketPath := os.TempDir() + "/gostatsd_receiver_test_receive_uds.sock"
-	mr := NewDatagramReceiver(ch, socketFactory(socketPath, false), 1, 2)
+	mr := NewDatagramReceiver(ch, socketFactory(socketPath, false), 1, 2, nil)
 	ctx, cancel := context.WithCancel(context.Background())
 
 	var wg sync.WaitGroup
@@ -137,7 +141,7 @@ func TestDatagramReceiver_UnixSocketIsRemovedOnContextCancellation(t *testing.T)
 	ch := make(chan []*Datagram, 1)
 
 	socketPath := os.TempDir() + "/gostatsd_receiver_test_receive_uds.sock"
-	mr := NewDatagramReceiver(ch, socketFactory(socketPath, false), 1, 2)
+	mr := NewDatagramReceiver(ch, socketFactory(socketPath, false), 1, 2, nil)
 	ctx, cancel := context.WithCancel(context.Background())
 
 	var wg sync.WaitGroup
@@ -165,3 +169,133 @@ func sendDataToSocket(socketPath string, data string) error {
 	_, err = c.Write([]byte(data))
 	return err
 }
+
+func TestDatagramReceiver_Backpressure(t *testing.T) {
+	t.Parallel()
+	var queueLen int64 = 10 // Downstream is stalled
+	bp := NewReaderBackpressure(func() int { return int(atomic.LoadInt64(&queueLen)) }, 10, 2)
+	bp.pollInterval = time.Millisecond
+
+	ch := make(chan []*Datagram)
+	mr := NewDatagramReceiver(ch, nil, 0, 2, bp)
+	c := fakesocket.NewFakePacketConn()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		mr.Receive(ctx, c)
+		close(done)
+	}()
+
+	// Reader pauses at the high watermark
+	require.Eventually(t, func() bool { return atomic.LoadInt64(&bp.pausedReaders) == 1 }, time.Second, time.Millisecond)
+	select {
+	case <-ch:
+		t.Fatal("read while paused")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Still paused between the watermarks
+	atomic.StoreInt64(&queueLen, 5)
+	select {
+	case <-ch:
+		t.Fatal("resumed above the low watermark")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Resumes at the low watermark
+	atomic.StoreInt64(&queueLen, 2)
+	select {
+	case dgs := <-ch:
+		require.Len(t, dgs, 1)
+	case <-time.After(time.Second):
+		t.Fatal("did not resume")
+	}
+	tassert.EqualValues(t, 1, atomic.LoadUint64(&bp.pauses))
+	tassert.EqualValues(t, 0, atomic.LoadInt64(&bp.pausedReaders))
+
+	// Pauses again, and stops while paused
+	atomic.StoreInt64(&queueLen, 20)
+	require.Eventually(t, func() bool {
+		select {
+		case <-ch: // Drain whatever was read before the queue grew, the reader may have paused without reading
+		default:
+		}
+		return atomic.LoadInt64(&bp.pausedReaders) == 1
+	}, time.Second, time.Millisecond)
+	tassert.EqualValues(t, 2, atomic.LoadUint64(&bp.pauses))
+	cancel()
+	<-done
+}
+
+// sequencePacketConn is a net.PacketConn which returns a uniquely numbered counter in each datagram, up to limit.
+type sequencePacketConn struct {
+	net.PacketConn
+	next  uint64
+	limit uint64
+}
+
+func (spc *sequencePacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	seq := atomic.AddUint64(&spc.next, 1)
+	if seq > spc.limit {
+		_ = spc.PacketConn.Close()
+		return 0, nil, fakesocket.ErrClosedConnection
+	}
+	return copy(b, fmt.Sprintf("seq.%d:1|c", seq)), fakesocket.FakeAddr, nil
+}
+
+func TestDatagramReceiver_MultipleReadersProcessOnce(t *testing.T) {
+	t.Parallel()
+	const numReaders = 8
+	const numDatagrams = 100000
+	c := &sequencePacketConn{PacketConn: fakesocket.NewFakePacketConn(), limit: numDatagrams}
+
+	ch := make(chan []*Datagram, numReaders)
+	mr := NewDatagramReceiver(ch, func() (net.PacketConn, error) { return c, nil }, numReaders, 16, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		mr.Run(ctx)
+		close(done)
+	}()
+
+	seen := make([]int, numDatagrams+1)
+	for received := 0; received < numDatagrams; {
+		select {
+		case dgs := <-ch:
+			for _, dg := range dgs {
+				// Buffers are recycled after DoneFunc, so any double processing would appear as a repeated sequence
+				seq, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(string(dg.Msg), "seq."), ":1|c"))
+				require.NoError(t, err)
+				seen[seq]++
+				dg.DoneFunc()
+				received++
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout after %d datagrams", received)
+		}
+	}
+	cancel()
+	<-done
+
+	for seq := 1; seq <= numDatagrams; seq++ {
+		require.Equal(t, 1, seen[seq], "datagram %d", seq)
+	}
+	tassert.Zero(t, atomic.LoadUint64(&mr.duplicateDone))
+}
+
+func TestDatagramReceiver_DuplicateRelease(t *testing.T) {
+	t.Parallel()
+	ch := make(chan []*Datagram, 1)
+	mr := NewDatagramReceiver(ch, nil, 0, 1, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go mr.Receive(ctx, fakesocket.NewFakePacketConn())
+
+	dg := (<-ch)[0]
+	dg.DoneFunc()
+	dg.DoneFunc()
+	dg.DoneFunc()
+	tassert.EqualValues(t, 2, atomic.LoadUint64(&mr.duplicateDone))
+}
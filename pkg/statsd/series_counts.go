@@ -0,0 +1,61 @@
+package statsd
+
+import (
+	"sync"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/stats"
+)
+
+// seriesCounter counts the series held by the aggregators for each metric name every flush, which is the number of
+// distinct tag combinations of the metric, and so what it costs in most backends.  The series of a metric are spread
+// over every aggregator, so they are added up before they are emitted.
+type seriesCounter struct {
+	top int // Only the metrics with the most series are emitted, if greater than 0
+
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+// add counts the series of each metric in mm, which is flushed by one aggregator.
+func (sc *seriesCounter) add(mm *gostatsd.MetricMap) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if sc.counts == nil {
+		sc.counts = map[string]int{}
+	}
+	for metricName, series := range mm.Counters {
+		sc.counts[metricName] += len(series)
+	}
+	for metricName, series := range mm.Gauges {
+		sc.counts[metricName] += len(series)
+	}
+	for metricName, series := range mm.Timers {
+		sc.counts[metricName] += len(series)
+	}
+	for metricName, series := range mm.Sets {
+		sc.counts[metricName] += len(series)
+	}
+}
+
+// emit emits the series counted since the last emit, and starts counting again.
+func (sc *seriesCounter) emit(statser stats.Statser) {
+	sc.mu.Lock()
+	counts := sc.counts
+	sc.counts = nil
+	sc.mu.Unlock()
+
+	all := make([]metricSeries, 0, len(counts))
+	total := 0
+	for metricName, count := range counts {
+		all = append(all, metricSeries{name: metricName, series: float64(count)})
+		total += count
+	}
+	if sc.top > 0 {
+		all = topMetricSeries(all, sc.top)
+	}
+	for _, m := range all {
+		statser.Gauge("aggregator.series", m.series, gostatsd.Tags{"metric:" + m.name})
+	}
+	statser.Gauge("aggregator.series_total", float64(total), nil)
+}
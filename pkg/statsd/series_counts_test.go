@@ -0,0 +1,99 @@
+package statsd
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ash2k/stager/wait"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/stats"
+)
+
+func TestSeriesCountsMatchAggregators(t *testing.T) {
+	t.Parallel()
+	// The queues are unbuffered, so each map is received by its aggregator before it processes anything else
+	bh := NewBackendHandler(nil, 0, 4, 0, AggregatorFactoryFunc(func() Aggregator {
+		return NewMetricAggregator(nil, 0, 0, 0, 0, gostatsd.TimerSubtypes{}, math.MaxUint32)
+	}))
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg wait.Group
+	defer wg.Wait()
+	defer cancel()
+	wg.StartWithContext(ctx, bh.Run)
+
+	mm := gostatsd.NewMetricMap()
+	for i := 0; i < 50; i++ {
+		tags := gostatsd.Tags{fmt.Sprintf("user:%d", i)}
+		mm.Receive(&gostatsd.Metric{Name: "requests", Value: 1, Rate: 1, Tags: tags, Type: gostatsd.COUNTER})
+		if i < 20 {
+			mm.Receive(&gostatsd.Metric{Name: "latency", Value: 1, Rate: 1, Tags: tags, Type: gostatsd.TIMER})
+			// The same name as a different type is counted as the same metric
+			mm.Receive(&gostatsd.Metric{Name: "requests", Value: 1, Rate: 1, Tags: tags, Type: gostatsd.GAUGE})
+		}
+		if i < 3 {
+			mm.Receive(&gostatsd.Metric{Name: "users", StringValue: "a", Rate: 1, Tags: tags, Type: gostatsd.SET})
+		}
+	}
+	bh.DispatchMetricMap(ctx, mm)
+
+	f := NewMetricFlusher(0, 0, false, bh, nil, nil)
+	f.seriesCounter = &seriesCounter{}
+	internal := &capturingHandler{}
+	statser := stats.NewInternalStatser(nil, "", "", gostatsd.UnknownSource, internal)
+	f.flushData(ctx, time.Second, statser)
+	statser.NotifyFlush(ctx, 0)
+	require.Len(t, internal.mm, 1)
+
+	var mu sync.Mutex
+	actual := map[string]int{}
+	bh.Process(ctx, func(_ int, aggr Aggregator) {
+		mu.Lock()
+		defer mu.Unlock()
+		aggr.Process(func(m *gostatsd.MetricMap) {
+			m.Counters.Each(func(name, _ string, _ gostatsd.Counter) { actual[name]++ })
+			m.Gauges.Each(func(name, _ string, _ gostatsd.Gauge) { actual[name]++ })
+			m.Timers.Each(func(name, _ string, _ gostatsd.Timer) { actual[name]++ })
+			m.Sets.Each(func(name, _ string, _ gostatsd.Set) { actual[name]++ })
+		})
+	})()
+	assert.Equal(t, map[string]int{"requests": 70, "latency": 20, "users": 3}, actual)
+
+	gauges := internal.mm[0].Gauges
+	series := gauges["aggregator.series"]
+	require.Len(t, series, len(actual))
+	for name, count := range actual {
+		assert.EqualValues(t, count, series["metric:"+name].Value, name)
+	}
+	assert.EqualValues(t, 93, gauges["aggregator.series_total"][""].Value)
+}
+
+func TestSeriesCountsTop(t *testing.T) {
+	t.Parallel()
+	sc := &seriesCounter{top: 1}
+	mm := gostatsd.NewMetricMap()
+	mm.Receive(&gostatsd.Metric{Name: "a", Value: 1, Rate: 1, Tags: gostatsd.Tags{"x:1"}, Type: gostatsd.COUNTER})
+	mm.Receive(&gostatsd.Metric{Name: "a", Value: 1, Rate: 1, Tags: gostatsd.Tags{"x:2"}, Type: gostatsd.COUNTER})
+	mm.Receive(&gostatsd.Metric{Name: "b", Value: 1, Rate: 1, Type: gostatsd.GAUGE})
+	sc.add(mm)
+	sc.add(mm) // Another aggregator
+
+	internal := &capturingHandler{}
+	statser := stats.NewInternalStatser(nil, "", "", gostatsd.UnknownSource, internal)
+	sc.emit(statser)
+	statser.NotifyFlush(context.Background(), 0)
+	require.Len(t, internal.mm, 1)
+	gauges := internal.mm[0].Gauges
+	require.Len(t, gauges["aggregator.series"], 1)
+	assert.EqualValues(t, 4, gauges["aggregator.series"]["metric:a"].Value)
+	assert.EqualValues(t, 6, gauges["aggregator.series_total"][""].Value)
+
+	// Counting restarts every flush
+	assert.Nil(t, sc.counts)
+}
@@ -0,0 +1,69 @@
+package statsd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// udpSocketStats are the kernel statistics for a single UDP socket, as reported by /proc/net/udp.
+type udpSocketStats struct {
+	inode   uint64
+	rxQueue uint64 // Bytes waiting to be read by the application
+	drops   uint64 // Datagrams dropped by the kernel before they were read, usually because the buffer was full
+}
+
+// parseProcNetUDP parses the contents of /proc/net/udp or /proc/net/udp6, returning the stats for each socket keyed
+// by inode.
+func parseProcNetUDP(r io.Reader) (map[uint64]udpSocketStats, error) {
+	sockets := map[uint64]udpSocketStats{}
+	scanner := bufio.NewScanner(r)
+	scanner.Scan() // Skip the header
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		s, err := parseProcNetUDPLine(line)
+		if err != nil {
+			return nil, err
+		}
+		sockets[s.inode] = s
+	}
+	return sockets, scanner.Err()
+}
+
+// parseProcNetUDPLine parses a single socket line, in the format:
+//
+//	 sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode ref pointer drops
+//	123: 00000000:1FBD 00000000:0000 07 00000000:00000000 00:00000000 00000000     0        0 31337 2 0000000000000000 42
+func parseProcNetUDPLine(line string) (udpSocketStats, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 13 {
+		return udpSocketStats{}, fmt.Errorf("expected at least 13 fields, got %d", len(fields))
+	}
+
+	queues := strings.SplitN(fields[4], ":", 2)
+	if len(queues) != 2 {
+		return udpSocketStats{}, fmt.Errorf("invalid queue field %q", fields[4])
+	}
+	rxQueue, err := strconv.ParseUint(queues[1], 16, 64)
+	if err != nil {
+		return udpSocketStats{}, fmt.Errorf("invalid rx_queue %q: %v", queues[1], err)
+	}
+	inode, err := strconv.ParseUint(fields[9], 10, 64)
+	if err != nil {
+		return udpSocketStats{}, fmt.Errorf("invalid inode %q: %v", fields[9], err)
+	}
+	drops, err := strconv.ParseUint(fields[12], 10, 64)
+	if err != nil {
+		return udpSocketStats{}, fmt.Errorf("invalid drops %q: %v", fields[12], err)
+	}
+	return udpSocketStats{
+		inode:   inode,
+		rxQueue: rxQueue,
+		drops:   drops,
+	}, nil
+}
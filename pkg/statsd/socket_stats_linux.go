@@ -0,0 +1,107 @@
+//go:build linux
+
+package statsd
+
+import (
+	"context"
+	"net"
+	"os"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/atlassian/gostatsd/pkg/stats"
+)
+
+var procNetUDPPaths = []string{"/proc/net/udp", "/proc/net/udp6"}
+
+// socketStatsCollector emits the kernel statistics for the receiver sockets, so drops by the kernel can be told
+// apart from drops by the application.
+type socketStatsCollector struct {
+	inodes []uint64
+}
+
+// newSocketStatsCollector creates a collector for the sockets of the conns.  Readers share a single conn unless each
+// has its own, so each socket is only counted once.
+func newSocketStatsCollector(conns []net.PacketConn) *socketStatsCollector {
+	ssc := &socketStatsCollector{}
+	seen := make(map[uint64]struct{}, len(conns))
+	for _, c := range conns {
+		inode, ok := socketInode(c)
+		if !ok {
+			continue
+		}
+		if _, ok := seen[inode]; ok {
+			continue
+		}
+		seen[inode] = present
+		ssc.inodes = append(ssc.inodes, inode)
+	}
+	return ssc
+}
+
+// socketInode returns the inode of the socket, which identifies it in /proc/net/udp.
+func socketInode(c net.PacketConn) (uint64, bool) {
+	sc, ok := c.(syscall.Conn)
+	if !ok {
+		return 0, false
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return 0, false
+	}
+	var st syscall.Stat_t
+	var statErr error
+	if err := rc.Control(func(fd uintptr) {
+		statErr = syscall.Fstat(int(fd), &st)
+	}); err != nil || statErr != nil {
+		return 0, false
+	}
+	return st.Ino, true
+}
+
+func (ssc *socketStatsCollector) RunMetricsContext(ctx context.Context) {
+	if len(ssc.inodes) == 0 {
+		return
+	}
+	statser := stats.FromContext(ctx)
+	flushed, unregister := statser.RegisterFlush()
+	defer unregister()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-flushed:
+			ssc.emit(statser)
+		}
+	}
+}
+
+func (ssc *socketStatsCollector) emit(statser stats.Statser) {
+	var drops, rxQueue uint64
+	for _, path := range procNetUDPPaths {
+		sockets, err := readProcNetUDP(path)
+		if err != nil {
+			logrus.WithError(err).WithField("path", path).Debug("failed to read socket stats")
+			continue
+		}
+		for _, inode := range ssc.inodes {
+			if s, ok := sockets[inode]; ok {
+				drops += s.drops
+				rxQueue += s.rxQueue
+			}
+		}
+	}
+	statser.Gauge("receiver.kernel_drops", float64(drops), nil)
+	statser.Gauge("receiver.kernel_rx_queue_bytes", float64(rxQueue), nil)
+}
+
+func readProcNetUDP(path string) (map[uint64]udpSocketStats, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseProcNetUDP(f)
+}
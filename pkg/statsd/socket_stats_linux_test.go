@@ -0,0 +1,28 @@
+//go:build linux
+
+package statsd
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewSocketStatsCollectorSharedConn(t *testing.T) {
+	t.Parallel()
+	shared, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer shared.Close()
+	other, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer other.Close()
+
+	// Every reader uses the same conn unless conn-per-reader is set
+	ssc := newSocketStatsCollector([]net.PacketConn{shared, shared, shared})
+	assert.Len(t, ssc.inodes, 1)
+
+	ssc = newSocketStatsCollector([]net.PacketConn{shared, other, shared, other})
+	assert.Len(t, ssc.inodes, 2)
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+
+package statsd
+
+import (
+	"context"
+	"net"
+)
+
+// socketStatsCollector is a no-op outside of Linux, as the kernel socket statistics are read from /proc.
+type socketStatsCollector struct{}
+
+func newSocketStatsCollector(conns []net.PacketConn) *socketStatsCollector {
+	return &socketStatsCollector{}
+}
+
+func (ssc *socketStatsCollector) RunMetricsContext(ctx context.Context) {
+}
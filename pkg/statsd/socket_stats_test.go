@@ -0,0 +1,40 @@
+package statsd
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseProcNetUDPLine(t *testing.T) {
+	t.Parallel()
+	s, err := parseProcNetUDPLine(" 1277: 00000000:1FBD 00000000:0000 07 00000000:0001A2B0 00:00000000 00000000     0        0 31337 2 0000000000000000 42")
+	require.NoError(t, err)
+	assert.Equal(t, udpSocketStats{inode: 31337, rxQueue: 0x1A2B0, drops: 42}, s)
+
+	for _, line := range []string{
+		" 1277: 00000000:1FBD 00000000:0000 07",
+		" 1277: 00000000:1FBD 00000000:0000 07 0000000000000000 00:00000000 00000000     0        0 31337 2 0000000000000000 42",
+		" 1277: 00000000:1FBD 00000000:0000 07 00000000:zzzz 00:00000000 00000000     0        0 31337 2 0000000000000000 42",
+		" 1277: 00000000:1FBD 00000000:0000 07 00000000:00000000 00:00000000 00000000     0        0 inode 2 0000000000000000 42",
+		" 1277: 00000000:1FBD 00000000:0000 07 00000000:00000000 00:00000000 00000000     0        0 31337 2 0000000000000000 -1",
+	} {
+		_, err := parseProcNetUDPLine(line)
+		assert.Error(t, err, line)
+	}
+}
+
+func TestParseProcNetUDP(t *testing.T) {
+	t.Parallel()
+	input := "   sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode ref pointer drops\n" +
+		" 1277: 00000000:1FBD 00000000:0000 07 00000000:00000000 00:00000000 00000000     0        0 31337 2 0000000000000000 42\n" +
+		" 1278: 0100007F:0035 00000000:0000 07 00000000:00000100 00:00000000 00000000   101        0 31338 2 0000000000000000 0\n"
+	sockets, err := parseProcNetUDP(strings.NewReader(input))
+	require.NoError(t, err)
+	assert.Equal(t, map[uint64]udpSocketStats{
+		31337: {inode: 31337, drops: 42},
+		31338: {inode: 31338, rxQueue: 256},
+	}, sockets)
+}
@@ -3,8 +3,11 @@ package statsd
 import (
 	"context"
 	"errors"
+	"expvar"
 	"fmt"
 	"net"
+	"os"
+	"sync"
 	"time"
 
 	"github.com/ash2k/stager"
@@ -32,9 +35,11 @@ type Server struct {
 	ExpiryIntervalGauge       time.Duration
 	ExpiryIntervalSet         time.Duration
 	ExpiryIntervalTimer       time.Duration
+	ExpiryMinLifetime         time.Duration
 	FlushInterval             time.Duration
 	FlushOffset               time.Duration
 	FlushAligned              bool
+	FlushOffsetFromHostname   bool
 	MaxReaders                int
 	MaxParsers                int
 	MaxWorkers                int
@@ -44,6 +49,7 @@ type Server struct {
 	EstimatedTags             int
 	MetricsAddr               string
 	Namespace                 string
+	NamespaceSeparator        string
 	StatserType               string
 	PercentThreshold          []float64
 	IgnoreHost                bool
@@ -51,16 +57,75 @@ type Server struct {
 	HeartbeatEnabled          bool
 	HeartbeatTags             gostatsd.Tags
 	ReceiveBatchSize          int
+	ReaderPauseHighWatermark  int
+	ReaderPauseLowWatermark   int
 	DisabledSubTypes          gostatsd.TimerSubtypes
 	HistogramLimit            uint32
 	BadLineRateLimitPerSecond rate.Limit
 	ServerMode                string
 	Hostname                  gostatsd.Source
+	HostnameFallback          string
+	HostnameFallbackValue     string
 	LogRawMetric              bool
+	MaxNameLength             int
+	NameLengthPolicy          string
+	PercentileAlgorithm       string
+	InternalFlushInterval     time.Duration
+	TTLTag                    string
+	MetricTypeTag             string
+	CounterSplit              bool
+	CounterTotalSuffix        string
+	CounterRateSuffix         string
+	TimerMinMaxGauges         bool
+	TimerMinGaugeSuffix       string
+	TimerMaxGaugeSuffix       string
+	Handlers                  []HandlerFactory
+	StrictParsing             bool
+	AggregateAcrossHosts      bool
+	HostTagKeys               []string
+	PerSourceMetrics          []string
+	PercentileNameTemplate    string
+	SourceIPStrategy          string
+	SourceIPTag               string
+	InternalBackends          []string
+	FlushSequenceEnabled      bool
+	RequiredTagKeys           []string
+	RequiredTagsPolicy        string
+	RequiredTagsDefaultValue  string
+	NonFinitePolicy           string
+	EmptyTagValuePolicy       string
+	TagKeyNormalizations      []string
+	TagValueNormalizations    []string
+	ExpvarInternalMetrics     bool
+	PrometheusInternalMetrics bool
+	BuildInfo                 gostatsd.BuildInfo
+	BuildInfoEnabled          bool
+	StateFile                 string
+	MaintenanceBackends       []string
+	MaintenanceBufferFlushes  int
+	WriteAheadLogMaxSize      int64
+	DropUnresolvedSources     bool
+	CloudDrainTimeout         time.Duration
+	SeriesCounts              bool
+	SeriesCountsTop           int
+	FlushEvents               bool
+	FlushEventsNamespace      string
+	MemoryEvictionThreshold   uint64
+	MemoryEvictionRatio       float64
 	Viper                     *viper.Viper
 	TransportPool             *transport.TransportPool
+
+	backendHandlersLock sync.Mutex
+	backendHandlers     []*BackendHandler              // The handlers which aggregate metrics, for ReloadPercentiles
+	percentileNamers    []*percentileNamer             // The namers of the percentiles of every flusher, for ReloadPercentiles
+	maintenance         *backendMaintenance            // The backends in maintenance mode, for SetMaintenanceBackends
+	eventFilters        map[string]*BackendEventFilter // Shared by every backend handler, keyed by backend name
 }
 
+// HandlerFactory creates a custom handler, which must pass the metrics and events it keeps on to next.  If the handler
+// implements gostatsd.Runner or gostatsd.MetricsRunner it is run along with the server.
+type HandlerFactory func(next gostatsd.PipelineHandler) gostatsd.PipelineHandler
+
 // Run runs the server until context signals done.
 func (s *Server) Run(ctx context.Context) error {
 	return s.RunWithCustomSocket(ctx, socketFactory(s.MetricsAddr, s.ConnPerReader))
@@ -99,11 +164,27 @@ func networkFromAddress(addr string) string {
 	return "udp"
 }
 
-func (s *Server) createStandaloneSink() (gostatsd.PipelineHandler, []gostatsd.Runnable, error) {
-	var runnables []gostatsd.Runnable
+func (s *Server) createAggregatorFactory(backends []gostatsd.Backend) (*agrFactory, error) {
+	timerOverrides, err := NewTimerOverridesFromViper(s.Viper)
+	if err != nil {
+		return nil, err
+	}
+
+	var selectPercentiles bool
+	switch s.PercentileAlgorithm {
+	case "", gostatsd.PercentileAlgorithmSort:
+	case gostatsd.PercentileAlgorithmSelect:
+		selectPercentiles = true
+	default:
+		return nil, fmt.Errorf("unknown percentile algorithm %q", s.PercentileAlgorithm)
+	}
+
+	memoryPressure, err := s.createMemoryPressure()
+	if err != nil {
+		return nil, err
+	}
 
-	// Create the backend handler
-	factory := agrFactory{
+	return &agrFactory{
 		percentThresholds:     s.PercentThreshold,
 		expiryIntervalCounter: s.ExpiryIntervalCounter,
 		expiryIntervalGauge:   s.ExpiryIntervalGauge,
@@ -111,16 +192,290 @@ func (s *Server) createStandaloneSink() (gostatsd.PipelineHandler, []gostatsd.Ru
 		expiryIntervalTimer:   s.ExpiryIntervalTimer,
 		disabledSubtypes:      s.DisabledSubTypes,
 		histogramLimit:        s.HistogramLimit,
+		timerOverrides:        timerOverrides,
+		selectPercentiles:     selectPercentiles,
+		rawTimersOnly:         gostatsd.RawTimersOnly(backends),
+		minLifetime:           s.ExpiryMinLifetime,
+		memoryPressure:        memoryPressure,
+	}, nil
+}
+
+// flushOffset returns the offset for an aligned flusher with the given interval.
+func (s *Server) flushOffset(flushInterval time.Duration) time.Duration {
+	if s.FlushOffsetFromHostname {
+		hostname, _ := s.hostname() // Validated when the server starts
+		return hostnameFlushOffset(string(hostname), flushInterval)
+	}
+	return s.FlushOffset
+}
+
+func (s *Server) createStandaloneSink() (gostatsd.PipelineHandler, []gostatsd.Runnable, error) {
+	var runnables []gostatsd.Runnable
+
+	backends, _, err := s.splitBackends()
+	if err != nil {
+		return nil, nil, err
+	}
+	groups, err := newBackendGroupsFromViper(s.Viper, backends, s.FlushInterval)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Create the maintenance mode of the backends, which is shared with the internal sink
+	maintenance, err := s.createBackendMaintenance()
+	if err != nil {
+		return nil, nil, err
+	}
+	runnables = append(runnables, maintenance.RunMetricsContext)
+
+	// Create the event filters of every backend, which are shared with the internal sink, so the rate limits are not
+	// doubled by it
+	if eventFilters := s.createBackendEventFilters(); len(eventFilters) > 0 {
+		runnables = append(runnables, func(ctx context.Context) {
+			runBackendEventFilterMetrics(ctx, stats.FromContext(ctx), eventFilters)
+		})
 	}
 
-	backendHandler := NewBackendHandler(s.Backends, uint(s.MaxConcurrentEvents), s.MaxWorkers, s.MaxQueueSize, &factory)
-	runnables = append(runnables, backendHandler.Run, backendHandler.RunMetricsContext)
+	writeAheadLogs, err := newWriteAheadLogsFromViper(s.Viper, backends, s.WriteAheadLogMaxSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	stages, err := s.createBackendStages(backends)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Each group of backends with the same flush interval has its own aggregators and flusher
+	sinks := make([]gostatsd.PipelineHandler, 0, len(groups))
+	for _, group := range groups {
+		backendHandler, err := s.createBackendHandler(group.backends, s.MaxWorkers)
+		if err != nil {
+			return nil, nil, err
+		}
+		backendHandler.stateFile = groupStateFile(s.StateFile, group.flushInterval, s.FlushInterval)
+		runnables = append(runnables, backendHandler.Run, backendHandler.RunMetricsContext)
+		sinks = append(sinks, backendHandler)
+
+		flusher := s.createFlusher(group.flushInterval, backendHandler, group.backends, stages)
+		// The internal sink's flusher notifies the Statser instead
+		flusher.skipNotify = s.hasInternalSink() || group.flushInterval != s.FlushInterval
+		// The aggregator timings would overwrite those of the flusher for FlushInterval
+		flusher.skipFlushStats = group.flushInterval != s.FlushInterval
+		if !flusher.skipFlushStats {
+			flusher.seriesCounter = s.createSeriesCounter()
+		}
+		flusher.flushEventer = s.createFlushEventer()
+		flusher.writeAheadLogs = writeAheadLogs
+		runnables = append(runnables, flusher.Run)
+	}
 
-	// Create the Flusher
-	flusher := NewMetricFlusher(s.FlushInterval, s.FlushOffset, s.FlushAligned, backendHandler, s.Backends)
-	runnables = append(runnables, flusher.Run)
+	if groups[0].flushInterval != s.FlushInterval && !s.hasInternalSink() {
+		// Every backend has its own flush interval, but the Statser is still notified every FlushInterval
+		flusher := NewMetricFlusher(s.FlushInterval, 0, false, nil, nil, nil)
+		runnables = append(runnables, flusher.Run)
+	}
+
+	if len(sinks) == 1 {
+		return sinks[0], runnables, nil
+	}
+	return &multiSinkHandler{sinks: sinks}, runnables, nil
+}
 
-	return backendHandler, runnables, nil
+func (s *Server) addBackendHandler(bh *BackendHandler) {
+	s.backendHandlersLock.Lock()
+	defer s.backendHandlersLock.Unlock()
+	s.backendHandlers = append(s.backendHandlers, bh)
+}
+
+// ReloadPercentiles replaces the percentiles and timer overrides of a running server, without losing the timer values
+// it has already received.  They are used from the next flush, by the aggregators for both the metrics from clients
+// and internal metrics.  It does nothing in forwarder mode, as percentiles are not calculated.
+func (s *Server) ReloadPercentiles(ctx context.Context, percentThresholds []float64, timerOverrides []*TimerOverride) error {
+	s.backendHandlersLock.Lock()
+	backendHandlers := s.backendHandlers
+	percentileNamers := s.percentileNamers
+	s.backendHandlersLock.Unlock()
+	for _, pn := range percentileNamers {
+		pn.setPercentiles(percentThresholds, timerOverrides)
+	}
+	for _, bh := range backendHandlers {
+		if err := bh.SetPercentiles(ctx, percentThresholds, timerOverrides); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createBackendMaintenance creates the maintenance mode of the backends, with MaintenanceBackends in maintenance.
+func (s *Server) createBackendMaintenance() (*backendMaintenance, error) {
+	bm := newBackendMaintenance(s.Backends, s.MaintenanceBufferFlushes)
+	if err := bm.setBackends(s.MaintenanceBackends); err != nil {
+		return nil, err
+	}
+	s.backendHandlersLock.Lock()
+	defer s.backendHandlersLock.Unlock()
+	s.maintenance = bm
+	return bm, nil
+}
+
+// createBackendEventFilters creates the event filters of every backend.
+func (s *Server) createBackendEventFilters() map[string]*BackendEventFilter {
+	eventFilters := NewBackendEventFiltersFromViper(s.Viper, s.Backends)
+	s.backendHandlersLock.Lock()
+	defer s.backendHandlersLock.Unlock()
+	s.eventFilters = eventFilters
+	return eventFilters
+}
+
+func (s *Server) backendEventFilters() map[string]*BackendEventFilter {
+	s.backendHandlersLock.Lock()
+	defer s.backendHandlersLock.Unlock()
+	return s.eventFilters
+}
+
+func (s *Server) backendMaintenance() *backendMaintenance {
+	s.backendHandlersLock.Lock()
+	defer s.backendHandlersLock.Unlock()
+	return s.maintenance
+}
+
+// SetMaintenanceBackends puts the named backends of a running server in maintenance mode, and takes every other
+// backend out of it, from the next flush.  Flushes are not sent to a backend in maintenance mode, but buffered, up to
+// MaintenanceBufferFlushes, and sent when it leaves maintenance mode.  It does nothing in forwarder mode.
+func (s *Server) SetMaintenanceBackends(names []string) error {
+	bm := s.backendMaintenance()
+	if bm == nil {
+		return nil
+	}
+	return bm.setBackends(names)
+}
+
+// hasInternalSink returns true if internal metrics have their own pipeline, because they have their own flush interval
+// or backends.
+func (s *Server) hasInternalSink() bool {
+	return s.ServerMode == "standalone" && (s.InternalFlushInterval > 0 || len(s.InternalBackends) > 0)
+}
+
+// splitBackends returns the backends which receive metrics from clients, and the backends which receive internal
+// metrics.  Every backend receives both, unless InternalBackends is set, in which case the backends it names only
+// receive internal metrics, and the others only receive metrics from clients.
+func (s *Server) splitBackends() ([]gostatsd.Backend, []gostatsd.Backend, error) {
+	if len(s.InternalBackends) == 0 {
+		return s.Backends, s.Backends, nil
+	}
+	found := make(map[string]bool, len(s.InternalBackends))
+	for _, name := range s.InternalBackends {
+		found[name] = false
+	}
+	var backends, internalBackends []gostatsd.Backend
+	for _, backend := range s.Backends {
+		if _, ok := found[backend.Name()]; ok {
+			found[backend.Name()] = true
+			internalBackends = append(internalBackends, backend)
+		} else {
+			backends = append(backends, backend)
+		}
+	}
+	for _, name := range s.InternalBackends {
+		if !found[name] {
+			return nil, nil, fmt.Errorf("internal backend %q is not a configured backend", name)
+		}
+	}
+	if len(backends) == 0 {
+		return nil, nil, errors.New("every backend is an internal backend, metrics from clients would be discarded")
+	}
+	return backends, internalBackends, nil
+}
+
+// createInternalSink creates a separate pipeline for internal metrics, so they are flushed every
+// InternalFlushInterval, independently of FlushInterval, and only to the InternalBackends if they are set.  Internal
+// metrics are aggregated by a single aggregator, and have tags applied, but are not enriched by the cloud provider.
+func (s *Server) createInternalSink() (gostatsd.PipelineHandler, []gostatsd.Runnable, error) {
+	_, backends, err := s.splitBackends()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	backendHandler, err := s.createBackendHandler(backends, 1)
+	if err != nil {
+		return nil, nil, err
+	}
+	stages, err := s.createBackendStages(backends)
+	if err != nil {
+		return nil, nil, err
+	}
+	flushInterval := s.InternalFlushInterval
+	if flushInterval == 0 {
+		flushInterval = s.FlushInterval
+	}
+	flusher := s.createFlusher(flushInterval, backendHandler, backends, stages)
+	// The aggregator timings would overwrite those of the main flusher
+	flusher.skipFlushStats = true
+
+	handler := NewTagHandlerFromViper(s.Viper, backendHandler, s.DefaultTags)
+	return handler, []gostatsd.Runnable{backendHandler.Run, flusher.Run}, nil
+}
+
+// createBackendHandler creates the aggregators of the metrics sent to backends, with numWorkers workers.
+func (s *Server) createBackendHandler(backends []gostatsd.Backend, numWorkers int) (*BackendHandler, error) {
+	factory, err := s.createAggregatorFactory(backends)
+	if err != nil {
+		return nil, err
+	}
+	backendHandler := NewBackendHandler(backends, uint(s.MaxConcurrentEvents), numWorkers, s.MaxQueueSize, factory)
+	backendHandler.eventFilters = s.backendEventFilters()
+	s.addBackendHandler(backendHandler)
+	return backendHandler, nil
+}
+
+// backendStages are the stages of a flush which are configured for each backend, keyed by backend name.
+type backendStages struct {
+	filters          map[string]*BackendFilter
+	percentileNamers map[string]*percentileNamer
+	valueRounders    map[string]*valueRounder
+	nameTransformers map[string]*nameTransformer
+	emptyTagValues   map[string]*emptyTagValues
+	tagLimiters      map[string]*tagLimiter
+}
+
+func (s *Server) createBackendStages(backends []gostatsd.Backend) (*backendStages, error) {
+	var stages backendStages
+	var err error
+	if stages.filters, err = NewBackendFiltersFromViper(s.Viper, backends); err != nil {
+		return nil, err
+	}
+	if stages.percentileNamers, err = s.createPercentileNamers(backends); err != nil {
+		return nil, err
+	}
+	if stages.valueRounders, err = newValueRoundersFromViper(s.Viper, backends); err != nil {
+		return nil, err
+	}
+	if stages.nameTransformers, err = newNameTransformersFromViper(s.Viper, backends, s.Namespace, s.namespaceSeparator()); err != nil {
+		return nil, err
+	}
+	if stages.emptyTagValues, err = newEmptyTagValuesFromViper(s.Viper, backends); err != nil {
+		return nil, err
+	}
+	if stages.tagLimiters, err = newTagLimitersFromViper(s.Viper, backends); err != nil {
+		return nil, err
+	}
+	return &stages, nil
+}
+
+// createFlusher creates a flusher of the metrics aggregated by backendHandler to backends, with the stages which are
+// common to the metrics from clients and internal metrics.
+func (s *Server) createFlusher(flushInterval time.Duration, backendHandler *BackendHandler, backends []gostatsd.Backend, stages *backendStages) *MetricFlusher {
+	flusher := NewMetricFlusher(flushInterval, s.flushOffset(flushInterval), s.FlushAligned, backendHandler, backends, stages.filters)
+	flusher.metricTypeTag = s.MetricTypeTag
+	flusher.counterSplitter = s.createCounterSplitter()
+	flusher.timerGauges = s.createTimerGauges()
+	flusher.maintenance = s.backendMaintenance()
+	flusher.percentileNamers = stages.percentileNamers
+	flusher.valueRounders = stages.valueRounders
+	flusher.nameTransformers = stages.nameTransformers
+	flusher.emptyTagValues = stages.emptyTagValues
+	flusher.tagLimiters = stages.tagLimiters
+	return flusher
 }
 
 func (s *Server) createForwarderSink(logger logrus.FieldLogger) (gostatsd.PipelineHandler, []gostatsd.Runnable, error) {
@@ -134,7 +489,11 @@ func (s *Server) createForwarderSink(logger logrus.FieldLogger) (gostatsd.Pipeli
 	}
 
 	// Create a Flusher, this is primarily for all the periodic metrics which are emitted.
-	flusher := NewMetricFlusher(s.FlushInterval, 0, false, nil, s.Backends)
+	flushInterval := s.FlushInterval
+	if s.InternalFlushInterval > 0 {
+		flushInterval = s.InternalFlushInterval
+	}
+	flusher := NewMetricFlusher(flushInterval, 0, false, nil, s.Backends, nil)
 
 	return forwarderHandler, []gostatsd.Runnable{forwarderHandler.Run, forwarderHandler.RunMetricsContext, flusher.Run}, nil
 }
@@ -153,50 +512,185 @@ func (s *Server) createFinalSink(logger logrus.FieldLogger) (gostatsd.PipelineHa
 func (s *Server) RunWithCustomSocket(ctx context.Context, sf SocketFactory) error {
 	logger := logrus.StandardLogger()
 
+	hostname, err := s.hostname()
+	if err != nil {
+		return err
+	}
+
 	handler, runnables, err := s.createFinalSink(logger)
 	if err != nil {
 		return err
 	}
 
+	// Internal metrics go through the same pipeline as the metrics from clients, unless they have their own flush
+	// interval or backends, in which case they're sent to their own sink directly
+	var statserHandler gostatsd.PipelineHandler
+	if s.hasInternalSink() {
+		internalHandler, internalRunnables, err := s.createInternalSink()
+		if err != nil {
+			return err
+		}
+		statserHandler = internalHandler
+		runnables = append(runnables, internalRunnables...)
+	}
+
+	backpressure, err := s.createReaderBackpressure(handler, logger)
+	if err != nil {
+		return err
+	}
+
 	runnables = append(append(make([]gostatsd.Runnable, 0, len(s.Runnables)), s.Runnables...), runnables...)
 
+	// Create the tag cardinality tracker, it must see the tags the series are aggregated by
+	if tch := NewTagCardinalityHandlerFromViper(s.Viper, handler); tch != nil {
+		runnables = gostatsd.MaybeAppendRunnable(runnables, tch)
+		handler = tch
+	}
+
+	// Extract the TTL before the metrics are split between the aggregators, so each series is in a single aggregator
+	if s.TTLTag != "" && s.ServerMode == "standalone" {
+		handler = NewTTLHandler(handler, s.TTLTag)
+	}
+
+	// Strip the hosts after tags are applied, so host tags added by the pipeline are removed too
+	if s.AggregateAcrossHosts {
+		handler = NewHostStripHandler(handler, s.HostTagKeys, s.PerSourceMetrics)
+	}
+
+	// Check the required tags after tags are applied, so default tags can provide them
+	if len(s.RequiredTagKeys) > 0 {
+		annotate, err := s.annotateMissingRequiredTags()
+		if err != nil {
+			return err
+		}
+		defaultValue := s.RequiredTagsDefaultValue
+		if defaultValue == "" {
+			defaultValue = gostatsd.DefaultRequiredTagsDefaultValue
+		}
+		rth := NewRequiredTagsHandler(handler, s.RequiredTagKeys, annotate, defaultValue)
+		runnables = gostatsd.MaybeAppendRunnable(runnables, rth)
+		handler = rth
+	}
+
+	// Apply the empty tag value policy after tags are applied, so default tags with an empty value are handled too,
+	// and after tags are normalized, so a value of only whitespace is empty once it's trimmed
+	emptyTagValuePolicy, err := s.emptyTagValuePolicy()
+	if err != nil {
+		return err
+	}
+	if emptyTagValuePolicy != gostatsd.EmptyTagValuePolicyKeep {
+		handler = NewEmptyTagValueHandler(handler, emptyTagValuePolicy)
+	}
+
 	// Create the tag processor
 	handler = NewTagHandlerFromViper(s.Viper, handler, s.DefaultTags)
 
+	// Transform values after renames, so transforms match the new names
+	valueTransforms, err := NewValueTransformsFromViper(s.Viper)
+	if err != nil {
+		return err
+	}
+	if len(valueTransforms) > 0 {
+		handler = NewValueTransformHandler(handler, valueTransforms)
+	}
+
+	// Rename metrics before the tag processor, so filters match the new names
+	renameRules, err := NewRenameRulesFromViper(s.Viper)
+	if err != nil {
+		return err
+	}
+	if len(renameRules) > 0 {
+		handler = NewRenameHandler(handler, renameRules)
+	}
+
+	// Insert the custom handlers, so they see metrics after cloud enrichment, and before tags are applied
+	handler, runnables = s.insertHandlers(handler, runnables)
+
+	// Normalize the tags after cloud enrichment, so the tags of the cloud provider are normalized too
+	if len(s.TagKeyNormalizations) > 0 || len(s.TagValueNormalizations) > 0 {
+		tnh, err := NewTagNormalizationHandler(handler, s.TagKeyNormalizations, s.TagValueNormalizations)
+		if err != nil {
+			return err
+		}
+		handler = tnh
+	}
+
 	// Create the cloud handler
 	if s.CachedInstances != nil {
-		cloudHandler := NewCloudHandler(s.CachedInstances, handler)
+		cloudHandler := NewCloudHandler(s.CachedInstances, handler, s.MaxConcurrentEvents)
+		cloudHandler.dropUnresolved = s.DropUnresolvedSources
+		cloudHandler.drainTimeout = s.CloudDrainTimeout
 		runnables = gostatsd.MaybeAppendRunnable(runnables, cloudHandler)
 		handler = cloudHandler
 	}
 
+	// Create the source cardinality tracker, it must see the source before the cloud handler replaces it
+	if sch := NewSourceCardinalityHandlerFromViper(s.Viper, handler); sch != nil {
+		runnables = gostatsd.MaybeAppendRunnable(runnables, sch)
+		handler = sch
+	}
+
 	// Create the heartbeater
 	if s.HeartbeatEnabled {
 		hb := stats.NewHeartBeater("heartbeat", s.HeartbeatTags)
 		runnables = gostatsd.MaybeAppendRunnable(runnables, hb)
 	}
 
+	// Create the build info emitter
+	if s.BuildInfoEnabled {
+		bi := stats.NewHeartBeater("gostatsd.build_info", s.BuildInfo.Tags())
+		runnables = gostatsd.MaybeAppendRunnable(runnables, bi)
+	}
+
+	// Create the flush sequencer
+	if s.FlushSequenceEnabled {
+		fs := stats.NewFlushSequencer("flusher.sequence", nil)
+		runnables = gostatsd.MaybeAppendRunnable(runnables, fs)
+	}
+
 	// Open receiver <-> parser chan
 	datagrams := make(chan []*Datagram)
 
 	// Create the Parser
-	parser := NewDatagramParser(datagrams, s.Namespace, s.IgnoreHost, s.EstimatedTags, handler, s.BadLineRateLimitPerSecond, s.LogRawMetric, logger)
+	truncateNames, err := s.truncateMetricNames()
+	if err != nil {
+		return err
+	}
+	sourceTag, err := s.sourceIPTag()
+	if err != nil {
+		return err
+	}
+	nonFinitePolicy, err := s.nonFinitePolicy()
+	if err != nil {
+		return err
+	}
+	parserOptions := DatagramParserOptions{
+		NamespaceSeparator: s.namespaceSeparator(),
+		MaxNameLength:      s.MaxNameLength,
+		TruncateNames:      truncateNames,
+		Strict:             s.StrictParsing,
+		SourceTag:          sourceTag,
+		NonFinitePolicy:    nonFinitePolicy,
+	}
+	parser := NewDatagramParser(datagrams, s.Namespace, s.IgnoreHost, s.EstimatedTags, handler, s.BadLineRateLimitPerSecond, s.LogRawMetric, parserOptions, logger)
 	runnables = append(runnables, parser.RunMetricsContext)
 	for i := 0; i < s.MaxParsers; i++ {
 		runnables = append(runnables, parser.Run)
 	}
 
 	// Create the Receiver
-	receiver := NewDatagramReceiver(datagrams, sf, s.MaxReaders, s.ReceiveBatchSize)
+	receiver := NewDatagramReceiver(datagrams, sf, s.MaxReaders, s.ReceiveBatchSize, backpressure)
 	runnables = gostatsd.MaybeAppendRunnable(runnables, receiver)
 
 	// Create the Statser
-	hostname := s.Hostname
-	statser := s.createStatser(hostname, handler, logger)
+	if statserHandler == nil {
+		statserHandler = handler
+	}
+	statser := s.createStatser(hostname, statserHandler, logger)
 	runnables = gostatsd.MaybeAppendRunnable(runnables, statser)
 
 	// Create any http servers
-	httpServers, err := web.NewHttpServersFromViper(s.Viper, logger, handler)
+	httpServers, err := web.NewHttpServersFromViper(s.Viper, logger, handler, s.BuildInfo)
 	if err != nil {
 		return err
 	}
@@ -221,7 +715,246 @@ func (s *Server) RunWithCustomSocket(ctx context.Context, sf SocketFactory) erro
 	return ctx.Err()
 }
 
+// queueLengthReporter is implemented by sinks which can report how saturated they are.
+type queueLengthReporter interface {
+	QueueLength() int
+}
+
+// insertHandlers inserts the custom Handlers in front of handler, so the first factory's handler receives metrics
+// first, and the last passes them on to handler.
+func (s *Server) insertHandlers(handler gostatsd.PipelineHandler, runnables []gostatsd.Runnable) (gostatsd.PipelineHandler, []gostatsd.Runnable) {
+	for i := len(s.Handlers) - 1; i >= 0; i-- {
+		handler = s.Handlers[i](handler)
+		runnables = gostatsd.MaybeAppendRunnable(runnables, handler)
+	}
+	return handler, runnables
+}
+
+// createPercentileNamers returns the percentileNamers for a flusher of the backends.  Each backend's percentiles are
+// named with its template in the `percentile-names` section, if it has one, or PercentileNameTemplate.
+func (s *Server) createPercentileNamers(backends []gostatsd.Backend) (map[string]*percentileNamer, error) {
+	template := s.PercentileNameTemplate
+	if template == "" {
+		template = gostatsd.DefaultPercentileNameTemplate
+	}
+	namers, err := newPercentileNamers(template, s.Viper.GetStringMapString("percentile-names"), backends)
+	if err != nil {
+		return nil, err
+	}
+	timerOverrides, err := NewTimerOverridesFromViper(s.Viper)
+	if err != nil {
+		return nil, err
+	}
+	s.backendHandlersLock.Lock()
+	defer s.backendHandlersLock.Unlock()
+	for _, pn := range namers {
+		pn.setPercentiles(s.PercentThreshold, timerOverrides)
+		s.percentileNamers = append(s.percentileNamers, pn)
+	}
+	return namers, nil
+}
+
+// createCounterSplitter returns the counterSplitter for the flushers, or nil if counters are not split.
+func (s *Server) createCounterSplitter() *counterSplitter {
+	if !s.CounterSplit {
+		return nil
+	}
+	return &counterSplitter{
+		totalSuffix:  s.CounterTotalSuffix,
+		rateSuffix:   s.CounterRateSuffix,
+		disableTotal: s.DisabledSubTypes.CounterTotal,
+		disableRate:  s.DisabledSubTypes.CounterRate,
+	}
+}
+
+// createTimerGauges returns the timerGauges for the flushers, or nil if timer min and max are not emitted as gauges.
+func (s *Server) createTimerGauges() *timerGauges {
+	if !s.TimerMinMaxGauges {
+		return nil
+	}
+	return &timerGauges{
+		minSuffix:        s.TimerMinGaugeSuffix,
+		maxSuffix:        s.TimerMaxGaugeSuffix,
+		disabledSubtypes: s.DisabledSubTypes,
+	}
+}
+
+// createSeriesCounter returns the seriesCounter for the flusher, or nil if the series of each metric are not counted.
+func (s *Server) createSeriesCounter() *seriesCounter {
+	if !s.SeriesCounts {
+		return nil
+	}
+	return &seriesCounter{top: s.SeriesCountsTop}
+}
+
+// createFlushEventer returns the flushEventer for the flusher, or nil if flushes are not summarised in events.
+func (s *Server) createFlushEventer() *flushEventer {
+	if !s.FlushEvents {
+		return nil
+	}
+	hostname, _ := s.hostname() // Validated when the server starts
+	return newFlushEventer(s.FlushEventsNamespace, hostname)
+}
+
+// createMemoryPressure returns the memoryPressure shared by the aggregators, or nil if series are not evicted under
+// memory pressure.
+func (s *Server) createMemoryPressure() (*memoryPressure, error) {
+	if s.MemoryEvictionThreshold == 0 {
+		return nil, nil
+	}
+	return newMemoryPressure(s.MemoryEvictionThreshold, s.MemoryEvictionRatio)
+}
+
+// hostname returns the hostname used as the source of internal metrics and events.  If Hostname is empty,
+// HostnameFallback chooses between the OS hostname, HostnameFallbackValue, and no hostname.
+func (s *Server) hostname() (gostatsd.Source, error) {
+	return resolveHostname(s.Hostname, s.HostnameFallback, s.HostnameFallbackValue, os.Hostname)
+}
+
+func resolveHostname(hostname gostatsd.Source, fallback, fallbackValue string, osHostname func() (string, error)) (gostatsd.Source, error) {
+	switch fallback {
+	case "", gostatsd.HostnameFallbackOS, gostatsd.HostnameFallbackOmit:
+	case gostatsd.HostnameFallbackFixed:
+		if fallbackValue == "" {
+			return "", fmt.Errorf("hostname fallback %q requires a value", fallback)
+		}
+	default:
+		return "", fmt.Errorf("unknown hostname fallback %q", fallback)
+	}
+	if hostname != "" {
+		return hostname, nil
+	}
+
+	switch fallback {
+	case gostatsd.HostnameFallbackFixed:
+		return gostatsd.Source(fallbackValue), nil
+	case gostatsd.HostnameFallbackOmit:
+		return gostatsd.UnknownSource, nil
+	default:
+		host, err := osHostname()
+		if err != nil {
+			logrus.WithError(err).Warn("Cannot get hostname, internal metrics and events will have no hostname")
+			return gostatsd.UnknownSource, nil
+		}
+		return gostatsd.Source(host), nil
+	}
+}
+
+// truncateMetricNames indicates if metric names longer than MaxNameLength are truncated, rather than dropped.
+func (s *Server) truncateMetricNames() (bool, error) {
+	switch s.NameLengthPolicy {
+	case "", gostatsd.NameLengthPolicyDrop:
+		return false, nil
+	case gostatsd.NameLengthPolicyTruncate:
+		return true, nil
+	default:
+		return false, fmt.Errorf("unknown metric name length policy %q", s.NameLengthPolicy)
+	}
+}
+
+// sourceIPTag returns the key of the tag which overrides the source IP of metrics and events, or an empty string if
+// the source IP is always the address datagrams are received from.
+func (s *Server) sourceIPTag() (string, error) {
+	switch s.SourceIPStrategy {
+	case "", gostatsd.SourceIPStrategyPeer:
+		return "", nil
+	case gostatsd.SourceIPStrategyTag:
+		if s.SourceIPTag == "" {
+			return "", errors.New("source-ip-tag is required when source-ip-strategy is tag")
+		}
+		return s.SourceIPTag, nil
+	default:
+		return "", fmt.Errorf("unknown source IP strategy %q", s.SourceIPStrategy)
+	}
+}
+
+// annotateMissingRequiredTags returns true if metrics missing required tags are annotated, rather than dropped.
+func (s *Server) annotateMissingRequiredTags() (bool, error) {
+	switch s.RequiredTagsPolicy {
+	case "", gostatsd.RequiredTagsPolicyDrop:
+		return false, nil
+	case gostatsd.RequiredTagsPolicyAnnotate:
+		return true, nil
+	default:
+		return false, fmt.Errorf("unknown required tags policy %q", s.RequiredTagsPolicy)
+	}
+}
+
+// namespaceSeparator returns the separator between the namespace and the metric name, which is `.` if it is not set.
+func (s *Server) namespaceSeparator() string {
+	if s.NamespaceSeparator == "" {
+		return gostatsd.DefaultNamespaceSeparator
+	}
+	return s.NamespaceSeparator
+}
+
+// emptyTagValuePolicy returns the policy for tags with an empty value, which keeps them if it is not set.
+func (s *Server) emptyTagValuePolicy() (string, error) {
+	switch s.EmptyTagValuePolicy {
+	case "":
+		return gostatsd.EmptyTagValuePolicyKeep, nil
+	default:
+		return s.EmptyTagValuePolicy, validateEmptyTagValuePolicy(s.EmptyTagValuePolicy)
+	}
+}
+
+// nonFinitePolicy returns the policy for metrics with infinite values, which rejects them if it is not set.
+func (s *Server) nonFinitePolicy() (string, error) {
+	switch s.NonFinitePolicy {
+	case "":
+		return gostatsd.NonFinitePolicyReject, nil
+	case gostatsd.NonFinitePolicyReject, gostatsd.NonFinitePolicyClamp, gostatsd.NonFinitePolicyPass:
+		return s.NonFinitePolicy, nil
+	default:
+		return "", fmt.Errorf("unknown non-finite policy %q", s.NonFinitePolicy)
+	}
+}
+
+func (s *Server) createReaderBackpressure(sink gostatsd.PipelineHandler, logger logrus.FieldLogger) (*ReaderBackpressure, error) {
+	if s.ReaderPauseHighWatermark <= 0 {
+		return nil, nil
+	}
+	if s.ReaderPauseLowWatermark < 0 || s.ReaderPauseLowWatermark >= s.ReaderPauseHighWatermark {
+		return nil, errors.New("reader-pause-low-watermark must be between 0 and reader-pause-high-watermark")
+	}
+	qlr, ok := sink.(queueLengthReporter)
+	if !ok {
+		logger.WithField("server-mode", s.ServerMode).Warn("Receiver pausing is not supported in this server mode")
+		return nil, nil
+	}
+	return NewReaderBackpressure(qlr.QueueLength, s.ReaderPauseHighWatermark, s.ReaderPauseLowWatermark), nil
+}
+
+// expvarInternalMetrics is the expvar variable internal metrics are published under, if ExpvarInternalMetrics is set.
+// It is shared by every Server in the process, so they must have different InternalTags to be told apart.
+var expvarInternalMetrics struct {
+	once sync.Once
+	vars *expvar.Map
+}
+
+// prometheusSeriesFlushes is how many internal flush intervals a series is published in the Prometheus format for
+// without being updated, so series which are no longer emitted, such as for a removed tag value, are dropped.
+const prometheusSeriesFlushes = 3
+
 func (s *Server) createStatser(hostname gostatsd.Source, handler gostatsd.PipelineHandler, logger logrus.FieldLogger) stats.Statser {
+	statser := s.createBaseStatser(hostname, handler, logger)
+	if s.ExpvarInternalMetrics {
+		expvarInternalMetrics.once.Do(func() {
+			expvarInternalMetrics.vars = expvar.NewMap("gostatsd")
+		})
+		statser = stats.NewExpvarStatser(statser, s.InternalTags, expvarInternalMetrics.vars)
+	}
+	if s.PrometheusInternalMetrics {
+		flushInterval := s.FlushInterval
+		if s.InternalFlushInterval > 0 {
+			flushInterval = s.InternalFlushInterval
+		}
+		statser = stats.NewPrometheusStatser(statser, s.InternalTags, stats.DefaultPrometheusRegistry, prometheusSeriesFlushes*flushInterval)
+	}
+	return statser
+}
+
+func (s *Server) createBaseStatser(hostname gostatsd.Source, handler gostatsd.PipelineHandler, logger logrus.FieldLogger) stats.Statser {
 	switch s.StatserType {
 	case gostatsd.StatserNull:
 		return stats.NewNullStatser()
@@ -230,13 +963,9 @@ func (s *Server) createStatser(hostname gostatsd.Source, handler gostatsd.Pipeli
 	default:
 		namespace := s.Namespace
 		if s.InternalNamespace != "" {
-			if namespace != "" {
-				namespace = namespace + "." + s.InternalNamespace
-			} else {
-				namespace = s.InternalNamespace
-			}
+			namespace = gostatsd.NamespacePrefix(namespace, s.namespaceSeparator()) + s.InternalNamespace
 		}
-		return stats.NewInternalStatser(s.InternalTags, namespace, hostname, handler)
+		return stats.NewInternalStatser(s.InternalTags, namespace, s.namespaceSeparator(), hostname, handler)
 	}
 }
 
@@ -271,10 +1000,15 @@ type agrFactory struct {
 	expiryIntervalTimer   time.Duration
 	disabledSubtypes      gostatsd.TimerSubtypes
 	histogramLimit        uint32
+	timerOverrides        []*TimerOverride
+	selectPercentiles     bool
+	rawTimersOnly         bool
+	minLifetime           time.Duration
+	memoryPressure        *memoryPressure
 }
 
 func (af *agrFactory) Create() Aggregator {
-	return NewMetricAggregator(
+	a := NewMetricAggregator(
 		af.percentThresholds,
 		af.expiryIntervalCounter,
 		af.expiryIntervalGauge,
@@ -283,4 +1017,10 @@ func (af *agrFactory) Create() Aggregator {
 		af.disabledSubtypes,
 		af.histogramLimit,
 	)
+	a.setTimerOverrides(af.timerOverrides)
+	a.selectPercentiles = af.selectPercentiles
+	a.rawTimersOnly = af.rawTimersOnly
+	a.minLifetime = af.minLifetime
+	a.memoryPressure = af.memoryPressure
+	return a
 }
@@ -2,9 +2,14 @@ package statsd
 
 import (
 	"context"
+	"errors"
+	"expvar"
 	"math/rand"
+	"net"
 	"runtime"
 	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -147,6 +152,410 @@ func TestStatsdThroughput(t *testing.T) {
 		memStatsFinish.GCCPUFraction)
 }
 
+// internalFlushBackend counts the flushes which contain internal metrics, and any other metrics it is sent.
+type internalFlushBackend struct {
+	countingBackend
+	name            string
+	internalFlushes uint64
+	userMetrics     uint64
+}
+
+func (ifb *internalFlushBackend) Name() string {
+	if ifb.name != "" {
+		return ifb.name
+	}
+	return ifb.countingBackend.Name()
+}
+
+func (ifb *internalFlushBackend) SendMetricsAsync(ctx context.Context, m *gostatsd.MetricMap, callback gostatsd.SendCallback) {
+	var internal, user uint64
+	m.Gauges.Each(func(name, tagset string, g gostatsd.Gauge) {
+		if strings.HasPrefix(name, "statsd.") {
+			internal++
+		} else {
+			user++
+		}
+	})
+	m.Counters.Each(func(name, tagset string, c gostatsd.Counter) {
+		if !strings.HasPrefix(name, "statsd.") {
+			user++
+		}
+	})
+	if internal > 0 {
+		atomic.AddUint64(&ifb.internalFlushes, 1)
+	}
+	atomic.AddUint64(&ifb.userMetrics, user)
+	callback(nil)
+}
+
+func TestStatsdInternalFlushInterval(t *testing.T) {
+	t.Parallel()
+	backend := &internalFlushBackend{}
+	s := Server{
+		Backends:              []gostatsd.Backend{backend},
+		DefaultTags:           gostatsd.DefaultTags,
+		InternalNamespace:     gostatsd.DefaultInternalNamespace,
+		FlushInterval:         time.Hour,
+		InternalFlushInterval: 20 * time.Millisecond,
+		MaxReaders:            1,
+		MaxParsers:            1,
+		MaxWorkers:            1,
+		MaxQueueSize:          gostatsd.DefaultMaxQueueSize,
+		MaxConcurrentEvents:   2,
+		EstimatedTags:         1,
+		ReceiveBatchSize:      gostatsd.DefaultReceiveBatchSize,
+		ServerMode:            "standalone",
+		Viper:                 viper.New(),
+	}
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg wait.Group
+	wg.Start(func() {
+		_ = s.RunWithCustomSocket(ctx, func() (net.PacketConn, error) { return conn, nil })
+	})
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	require.NoError(t, err)
+	defer client.Close()
+	_, err = client.Write([]byte("user.counter:1|c"))
+	require.NoError(t, err)
+
+	// Internal metrics are emitted every internal flush, while the user metric is held until the main flush
+	require.Eventually(t, func() bool {
+		return atomic.LoadUint64(&backend.internalFlushes) >= 5
+	}, 5*time.Second, 10*time.Millisecond)
+	cancel()
+	wg.Wait()
+	assert.Zero(t, atomic.LoadUint64(&backend.userMetrics))
+}
+
+func TestStatsdInternalBackends(t *testing.T) {
+	t.Parallel()
+	internal := &internalFlushBackend{name: "internal"}
+	user := &internalFlushBackend{name: "user"}
+	s := Server{
+		Backends:            []gostatsd.Backend{internal, user},
+		InternalBackends:    []string{"internal"},
+		DefaultTags:         gostatsd.DefaultTags,
+		InternalNamespace:   gostatsd.DefaultInternalNamespace,
+		FlushInterval:       20 * time.Millisecond,
+		MaxReaders:          1,
+		MaxParsers:          1,
+		MaxWorkers:          1,
+		MaxQueueSize:        gostatsd.DefaultMaxQueueSize,
+		MaxConcurrentEvents: 2,
+		EstimatedTags:       1,
+		ReceiveBatchSize:    gostatsd.DefaultReceiveBatchSize,
+		ServerMode:          "standalone",
+		Viper:               viper.New(),
+	}
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg wait.Group
+	wg.Start(func() {
+		_ = s.RunWithCustomSocket(ctx, func() (net.PacketConn, error) { return conn, nil })
+	})
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	require.NoError(t, err)
+	defer client.Close()
+	_, err = client.Write([]byte("user.counter:1|c"))
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		return atomic.LoadUint64(&internal.internalFlushes) >= 3 && atomic.LoadUint64(&user.userMetrics) > 0
+	}, 5*time.Second, 10*time.Millisecond)
+	cancel()
+	wg.Wait()
+	assert.Zero(t, atomic.LoadUint64(&internal.userMetrics))
+	assert.Zero(t, atomic.LoadUint64(&user.internalFlushes))
+}
+
+func TestStatsdInternalMetricsPipeline(t *testing.T) {
+	t.Parallel()
+	backend := &namedCapturingBackend{name: "capturing"}
+	cloudProvider := &fakeProvider{
+		instance: &gostatsd.Instance{ID: "i-1", Tags: gostatsd.Tags{"region:us-east-1"}},
+	}
+	cachedInstances := cloudprovider.NewCachedCloudProvider(
+		logrus.StandardLogger(),
+		rate.NewLimiter(gostatsd.DefaultMaxCloudRequests, gostatsd.DefaultBurstCloudRequests),
+		cloudProvider,
+		gostatsd.CacheOptions{
+			CacheRefreshPeriod:        gostatsd.DefaultCacheRefreshPeriod,
+			CacheEvictAfterIdlePeriod: gostatsd.DefaultCacheEvictAfterIdlePeriod,
+			CacheTTL:                  gostatsd.DefaultCacheTTL,
+			CacheNegativeTTL:          gostatsd.DefaultCacheNegativeTTL,
+		},
+	)
+	s := Server{
+		Backends:            []gostatsd.Backend{backend},
+		CachedInstances:     cachedInstances,
+		DefaultTags:         gostatsd.Tags{"env:test"},
+		Hostname:            "internal-host",
+		InternalNamespace:   gostatsd.DefaultInternalNamespace,
+		FlushInterval:       20 * time.Millisecond,
+		MaxReaders:          1,
+		MaxParsers:          1,
+		MaxWorkers:          1,
+		MaxQueueSize:        gostatsd.DefaultMaxQueueSize,
+		MaxConcurrentEvents: 2,
+		EstimatedTags:       1,
+		ReceiveBatchSize:    gostatsd.DefaultReceiveBatchSize,
+		ServerMode:          "standalone",
+		Viper:               viper.New(),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg wait.Group
+	wg.StartWithContext(ctx, cachedInstances.Run)
+	wg.Start(func() {
+		_ = s.RunWithCustomSocket(ctx, fakesocket.Factory)
+	})
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
+	// Internal metrics have the default tags, and the tags of the instance of the hostname from the cloud provider
+	hasTags := func() bool {
+		backend.mu.Lock()
+		defer backend.mu.Unlock()
+		for _, mm := range backend.maps {
+			for _, c := range mm.Counters["statsd.parser.received_by_type"] {
+				tags := c.Tags.SortedString()
+				if strings.Contains(tags, "env:test") && strings.Contains(tags, "region:us-east-1") && c.Source == "i-1" {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	require.Eventually(t, hasTags, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestServerSharesEventFiltersWithInternalSink(t *testing.T) {
+	t.Parallel()
+	v := viper.New()
+	v.Set("backend-event-filter.user.rate-limit", 1)
+	s := Server{
+		Backends:              []gostatsd.Backend{&internalFlushBackend{name: "user"}},
+		FlushInterval:         time.Second,
+		InternalFlushInterval: time.Second,
+		MaxWorkers:            2,
+		MaxQueueSize:          gostatsd.DefaultMaxQueueSize,
+		MaxConcurrentEvents:   2,
+		ServerMode:            "standalone",
+		Viper:                 v,
+	}
+	_, _, err := s.createStandaloneSink()
+	require.NoError(t, err)
+	_, _, err = s.createInternalSink()
+	require.NoError(t, err)
+
+	require.Len(t, s.backendHandlers, 2)
+	filter := s.backendHandlers[0].eventFilters["user"]
+	require.NotNil(t, filter)
+	assert.Same(t, filter, s.backendHandlers[1].eventFilters["user"])
+}
+
+func TestStatsdExpvarInternalMetrics(t *testing.T) {
+	t.Parallel()
+	s := Server{
+		Backends:              []gostatsd.Backend{&internalFlushBackend{}},
+		DefaultTags:           gostatsd.DefaultTags,
+		InternalTags:          gostatsd.Tags{"test:expvar"}, // Tells this server's variables apart from other tests'
+		ExpvarInternalMetrics: true,
+		FlushInterval:         20 * time.Millisecond,
+		MaxReaders:            1,
+		MaxParsers:            1,
+		MaxWorkers:            1,
+		MaxQueueSize:          gostatsd.DefaultMaxQueueSize,
+		MaxConcurrentEvents:   2,
+		EstimatedTags:         1,
+		ReceiveBatchSize:      gostatsd.DefaultReceiveBatchSize,
+		ServerMode:            "standalone",
+		Viper:                 viper.New(),
+	}
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg wait.Group
+	wg.Start(func() {
+		_ = s.RunWithCustomSocket(ctx, func() (net.PacketConn, error) { return conn, nil })
+	})
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	require.NoError(t, err)
+	defer client.Close()
+	_, err = client.Write([]byte("user.counter:1|c\nuser.gauge:1|g\nbad"))
+	require.NoError(t, err)
+
+	value := func(key string) float64 {
+		if v, ok := expvar.Get("gostatsd").(*expvar.Map).Get(key).(*expvar.Float); ok {
+			return v.Value()
+		}
+		return 0
+	}
+	require.Eventually(t, func() bool {
+		return value("parser.metrics_received{test:expvar}") == 2 &&
+			value("parser.bad_lines_seen{test:expvar}") == 1 &&
+			value("aggregator.metricmaps_received{aggregator_id:0,test:expvar}") >= 1
+	}, 5*time.Second, 10*time.Millisecond)
+	cancel()
+	wg.Wait()
+}
+
+// buildInfoBackend records the tags of the build info metric.
+type buildInfoBackend struct {
+	mu   sync.Mutex
+	tags gostatsd.Tags
+}
+
+func (bib *buildInfoBackend) Name() string {
+	return "buildinfo"
+}
+
+func (bib *buildInfoBackend) SendMetricsAsync(ctx context.Context, mm *gostatsd.MetricMap, cb gostatsd.SendCallback) {
+	bib.mu.Lock()
+	for _, g := range mm.Gauges["statsd.gostatsd.build_info"] {
+		if g.Value == 1 {
+			bib.tags = g.Tags.Copy()
+		}
+	}
+	bib.mu.Unlock()
+	cb(nil)
+}
+
+func (bib *buildInfoBackend) SendEvent(ctx context.Context, e *gostatsd.Event) error {
+	return nil
+}
+
+func (bib *buildInfoBackend) get() gostatsd.Tags {
+	bib.mu.Lock()
+	defer bib.mu.Unlock()
+	return bib.tags
+}
+
+func TestStatsdBuildInfo(t *testing.T) {
+	t.Parallel()
+	backend := &buildInfoBackend{}
+	s := Server{
+		Backends:            []gostatsd.Backend{backend},
+		DefaultTags:         gostatsd.DefaultTags,
+		InternalNamespace:   gostatsd.DefaultInternalNamespace,
+		BuildInfo:           gostatsd.BuildInfo{Version: "1.2.3", GitCommit: "abc123", BuildDate: "2024-01-02"},
+		BuildInfoEnabled:    true,
+		FlushInterval:       20 * time.Millisecond,
+		MaxReaders:          1,
+		MaxParsers:          1,
+		MaxWorkers:          1,
+		MaxQueueSize:        gostatsd.DefaultMaxQueueSize,
+		MaxConcurrentEvents: 2,
+		EstimatedTags:       1,
+		ReceiveBatchSize:    gostatsd.DefaultReceiveBatchSize,
+		ServerMode:          "standalone",
+		Viper:               viper.New(),
+	}
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg wait.Group
+	wg.Start(func() {
+		_ = s.RunWithCustomSocket(ctx, func() (net.PacketConn, error) { return conn, nil })
+	})
+
+	require.Eventually(t, func() bool {
+		return backend.get() != nil
+	}, 5*time.Second, 10*time.Millisecond)
+	cancel()
+	wg.Wait()
+	assert.Subset(t, backend.get(), gostatsd.Tags{"version:1.2.3", "commit:abc123", "build_date:2024-01-02"})
+}
+
+func TestServerSplitBackends(t *testing.T) {
+	t.Parallel()
+	a := &internalFlushBackend{name: "a"}
+	b := &internalFlushBackend{name: "b"}
+	c := &internalFlushBackend{name: "c"}
+	s := Server{Backends: []gostatsd.Backend{a, b, c}}
+
+	backends, internalBackends, err := s.splitBackends()
+	require.NoError(t, err)
+	assert.Equal(t, s.Backends, backends)
+	assert.Equal(t, s.Backends, internalBackends)
+
+	s.InternalBackends = []string{"c", "a"}
+	backends, internalBackends, err = s.splitBackends()
+	require.NoError(t, err)
+	assert.Equal(t, []gostatsd.Backend{b}, backends)
+	assert.Equal(t, []gostatsd.Backend{a, c}, internalBackends)
+
+	s.InternalBackends = []string{"a", "d"}
+	_, _, err = s.splitBackends()
+	assert.Error(t, err)
+
+	s.InternalBackends = []string{"a", "b", "c"}
+	_, _, err = s.splitBackends()
+	assert.Error(t, err)
+}
+
+func TestServerNamespaceSeparator(t *testing.T) {
+	t.Parallel()
+	for _, tc := range []struct {
+		namespace, separator, internalNamespace string
+		expectedParsed, expectedInternal        string
+	}{
+		{namespace: "", expectedParsed: "m", expectedInternal: "statsd.m"},
+		{namespace: "", separator: "/", expectedParsed: "m", expectedInternal: "statsd/m"},
+		{namespace: "app", expectedParsed: "app.m", expectedInternal: "app.statsd.m"},
+		{namespace: "app", separator: "/", expectedParsed: "app/m", expectedInternal: "app/statsd/m"},
+		{namespace: "app/", separator: "/", expectedParsed: "app/m", expectedInternal: "app/statsd/m"},
+		{namespace: "app", separator: "_", internalNamespace: "-", expectedParsed: "app_m", expectedInternal: "app_m"},
+	} {
+		s := &Server{Namespace: tc.namespace, NamespaceSeparator: tc.separator, InternalNamespace: "statsd"}
+		if tc.internalNamespace == "-" {
+			s.InternalNamespace = ""
+		}
+
+		dp := NewDatagramParser(nil, s.Namespace, false, 0, &countingHandler{}, rate.Limit(0), false, DatagramParserOptions{NamespaceSeparator: s.namespaceSeparator()}, logrus.New())
+		metric, _, err := dp.parseLine(lex(), []byte("m:1|g"))
+		require.NoError(t, err)
+		assert.Equal(t, tc.expectedParsed, metric.Name, "%+v", tc)
+
+		ch := &capturingHandler{}
+		statser := s.createBaseStatser(gostatsd.UnknownSource, ch, logrus.New())
+		statser.Gauge("m", 1, nil)
+		statser.NotifyFlush(context.Background(), time.Second)
+		require.Len(t, ch.mm, 1)
+		assert.Contains(t, ch.mm[0].Gauges, tc.expectedInternal, "%+v", tc)
+	}
+}
+
+func TestServerMemoryEvictionRatio(t *testing.T) {
+	t.Parallel()
+	s := &Server{Viper: viper.New(), MemoryEvictionThreshold: 1 << 30, MemoryEvictionRatio: -0.5}
+	_, err := s.createAggregatorFactory(nil)
+	require.Error(t, err)
+
+	// The ratio isn't used without a threshold
+	s.MemoryEvictionThreshold = 0
+	factory, err := s.createAggregatorFactory(nil)
+	require.NoError(t, err)
+	assert.Nil(t, factory.memoryPressure)
+
+	s.MemoryEvictionThreshold = 1 << 30
+	s.MemoryEvictionRatio = gostatsd.DefaultMemoryEvictionRatio
+	factory, err = s.createAggregatorFactory(nil)
+	require.NoError(t, err)
+	assert.NotNil(t, factory.memoryPressure)
+}
+
 func TestNetworkFromAddress(t *testing.T) {
 	t.Parallel()
 	input := []struct {
@@ -231,3 +640,121 @@ func (fp *fakeProvider) Instance(ctx context.Context, ips ...gostatsd.Source) (m
 	}
 	return instances, nil
 }
+
+func TestResolveHostname(t *testing.T) {
+	t.Parallel()
+	osHostname := func() (string, error) { return "os-host", nil }
+	failingHostname := func() (string, error) { return "", errors.New("no hostname") }
+
+	for _, tc := range []struct {
+		hostname gostatsd.Source
+		fallback string
+		value    string
+		os       func() (string, error)
+		expected gostatsd.Source
+	}{
+		{"configured", gostatsd.HostnameFallbackOS, "", osHostname, "configured"},
+		{"configured", gostatsd.HostnameFallbackFixed, "fixed-host", osHostname, "configured"},
+		{"configured", gostatsd.HostnameFallbackOmit, "", osHostname, "configured"},
+		{"", "", "", osHostname, "os-host"},
+		{"", gostatsd.HostnameFallbackOS, "", osHostname, "os-host"},
+		{"", gostatsd.HostnameFallbackOS, "", failingHostname, gostatsd.UnknownSource},
+		{"", gostatsd.HostnameFallbackFixed, "fixed-host", osHostname, "fixed-host"},
+		{"", gostatsd.HostnameFallbackOmit, "", osHostname, gostatsd.UnknownSource},
+	} {
+		hostname, err := resolveHostname(tc.hostname, tc.fallback, tc.value, tc.os)
+		require.NoError(t, err, tc.fallback)
+		assert.Equal(t, tc.expected, hostname, "%q %s", tc.hostname, tc.fallback)
+	}
+
+	_, err := resolveHostname("configured", "unknown", "", osHostname)
+	require.Error(t, err)
+	_, err = resolveHostname("", gostatsd.HostnameFallbackFixed, "", osHostname)
+	require.Error(t, err)
+}
+
+// orderHandler records the order handlers see a metric map in, and tags the counters so the backend can check they
+// were passed on.
+type orderHandler struct {
+	gostatsd.PipelineHandler
+	name  string
+	mu    *sync.Mutex
+	order *[]string
+}
+
+func (oh *orderHandler) DispatchMetricMap(ctx context.Context, mm *gostatsd.MetricMap) {
+	if len(mm.Counters) > 0 {
+		oh.mu.Lock()
+		*oh.order = append(*oh.order, oh.name)
+		oh.mu.Unlock()
+	}
+	mm.Counters.Each(func(name, tagsKey string, c gostatsd.Counter) {
+		c.Tags = c.Tags.Concat(gostatsd.Tags{"handler:" + oh.name})
+		mm.Counters[name][tagsKey] = c
+	})
+	oh.PipelineHandler.DispatchMetricMap(ctx, mm)
+}
+
+func TestStatsdHandlers(t *testing.T) {
+	t.Parallel()
+	var mu sync.Mutex
+	var order []string
+	factory := func(name string) HandlerFactory {
+		return func(next gostatsd.PipelineHandler) gostatsd.PipelineHandler {
+			return &orderHandler{PipelineHandler: next, name: name, mu: &mu, order: &order}
+		}
+	}
+
+	backend := &namedCapturingBackend{name: "capturing"}
+	s := Server{
+		Backends:            []gostatsd.Backend{backend},
+		DefaultTags:         gostatsd.Tags{"default:tag"},
+		FlushInterval:       10 * time.Millisecond,
+		MaxReaders:          1,
+		MaxParsers:          1,
+		MaxWorkers:          1,
+		MaxQueueSize:        gostatsd.DefaultMaxQueueSize,
+		MaxConcurrentEvents: 2,
+		EstimatedTags:       1,
+		ReceiveBatchSize:    gostatsd.DefaultReceiveBatchSize,
+		ServerMode:          "standalone",
+		StatserType:         gostatsd.StatserNull,
+		Handlers:            []HandlerFactory{factory("first"), factory("second")},
+		Viper:               viper.New(),
+	}
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg wait.Group
+	wg.Start(func() {
+		_ = s.RunWithCustomSocket(ctx, func() (net.PacketConn, error) { return conn, nil })
+	})
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	require.NoError(t, err)
+	defer client.Close()
+	_, err = client.Write([]byte("user.counter:1|c"))
+	require.NoError(t, err)
+
+	var counter gostatsd.Counter
+	require.Eventually(t, func() bool {
+		backend.mu.Lock()
+		defer backend.mu.Unlock()
+		for _, mm := range backend.maps {
+			for _, c := range mm.Counters["user.counter"] {
+				counter = c
+				return true
+			}
+		}
+		return false
+	}, 5*time.Second, 10*time.Millisecond)
+	cancel()
+	wg.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{"first", "second"}, order)
+	// The tag handler runs after the custom handlers
+	assert.ElementsMatch(t, gostatsd.Tags{"handler:first", "handler:second", "default:tag"}, counter.Tags)
+}
@@ -0,0 +1,174 @@
+package statsd
+
+import (
+	"fmt"
+	"sort"
+	"sync/atomic"
+
+	"github.com/spf13/viper"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/stats"
+)
+
+const (
+	// TagLimitPolicyTruncate is the name of the policy which removes the tags over the limit.
+	TagLimitPolicyTruncate = "truncate"
+	// TagLimitPolicyDrop is the name of the policy which drops series with more tags than the limit.
+	TagLimitPolicyDrop = "drop"
+)
+
+// tagLimiter limits the number of tags of the series flushed to a single backend, so a backend which rejects metrics
+// with too many tags doesn't reject the whole payload.  Series over the limit are either truncated to the first tags
+// in sorted order, so the same tags are kept every flush, or dropped.
+type tagLimiter struct {
+	truncated uint64 // Series truncated since the last emit, accessed atomically
+	dropped   uint64 // Series dropped since the last emit, accessed atomically
+
+	maxTags int
+	drop    bool
+}
+
+// newTagLimitersFromViper creates a tagLimiter for each backend which has a `max-tags` in its `tag-limit.<backend
+// name>` section, or implements gostatsd.TagLimitBackend, keyed by the backend name.  A `max-tags` of 0 disables the
+// limit of a backend.
+func newTagLimitersFromViper(v *viper.Viper, backends []gostatsd.Backend) (map[string]*tagLimiter, error) {
+	limiters := map[string]*tagLimiter{}
+	for _, backend := range backends {
+		maxTags := 0
+		if tlb, ok := backend.(gostatsd.TagLimitBackend); ok {
+			maxTags = tlb.MaxTags()
+		}
+		policy := TagLimitPolicyTruncate
+		if vLimit := v.Sub("tag-limit." + backend.Name()); vLimit != nil {
+			vLimit.SetDefault("max-tags", maxTags)
+			vLimit.SetDefault("policy", TagLimitPolicyTruncate)
+			maxTags = vLimit.GetInt("max-tags")
+			policy = vLimit.GetString("policy")
+		}
+		if maxTags < 0 {
+			return nil, fmt.Errorf("tag-limit.%s: max-tags must not be negative, got %d", backend.Name(), maxTags)
+		}
+		if policy != TagLimitPolicyTruncate && policy != TagLimitPolicyDrop {
+			return nil, fmt.Errorf("tag-limit.%s: invalid policy %q, must be %s or %s", backend.Name(), policy, TagLimitPolicyTruncate, TagLimitPolicyDrop)
+		}
+		if maxTags == 0 {
+			continue
+		}
+		limiters[backend.Name()] = &tagLimiter{
+			maxTags: maxTags,
+			drop:    policy == TagLimitPolicyDrop,
+		}
+	}
+	return limiters, nil
+}
+
+// limit returns the tags of a series over the limit truncated, and their tags key, or false if the series should be
+// dropped, either by the policy, or because exists reports the metric already has a series with the truncated tags.
+func (tl *tagLimiter) limit(source gostatsd.Source, tags gostatsd.Tags, exists func(tagsKey string) bool) (string, gostatsd.Tags, bool) {
+	if tl.drop {
+		atomic.AddUint64(&tl.dropped, 1)
+		return "", nil, false
+	}
+	sorted := tags.Copy()
+	sort.Strings(sorted)
+	sorted = sorted[:tl.maxTags]
+	tagsKey := gostatsd.FormatTagsKey(source, sorted)
+	if exists(tagsKey) {
+		// The aggregates of two series can't be combined, so only one of them is sent
+		atomic.AddUint64(&tl.dropped, 1)
+		return "", nil, false
+	}
+	atomic.AddUint64(&tl.truncated, 1)
+	return tagsKey, sorted, true
+}
+
+// exceeded returns true if any series in mm has more tags than the limit.
+func (tl *tagLimiter) exceeded(mm *gostatsd.MetricMap) bool {
+	exceeded := false
+	mm.Counters.Each(func(_, _ string, c gostatsd.Counter) { exceeded = exceeded || len(c.Tags) > tl.maxTags })
+	mm.Gauges.Each(func(_, _ string, g gostatsd.Gauge) { exceeded = exceeded || len(g.Tags) > tl.maxTags })
+	mm.Timers.Each(func(_, _ string, t gostatsd.Timer) { exceeded = exceeded || len(t.Tags) > tl.maxTags })
+	mm.Sets.Each(func(_, _ string, s gostatsd.Set) { exceeded = exceeded || len(s.Tags) > tl.maxTags })
+	return exceeded
+}
+
+// apply returns mm with the tags of every series limited.  If no series is over the limit, mm is returned as is,
+// otherwise a new MetricMap is returned.  The values are not copied, so the result must be treated as read only, the
+// same as the input.  Truncated series are keyed by their remaining tags, and the series within the limit are added
+// first, so a truncated series which has the same tags as another series of the metric is dropped rather than sent
+// twice.
+func (tl *tagLimiter) apply(mm *gostatsd.MetricMap) *gostatsd.MetricMap {
+	if !tl.exceeded(mm) {
+		return mm
+	}
+	mmNew := gostatsd.NewMetricMap()
+	mm.Counters.Each(func(metricName, tagsKey string, c gostatsd.Counter) {
+		if len(c.Tags) <= tl.maxTags {
+			mmNew.MergeCounter(metricName, tagsKey, c)
+		}
+	})
+	mm.Counters.Each(func(metricName, tagsKey string, c gostatsd.Counter) {
+		if len(c.Tags) <= tl.maxTags {
+			return
+		}
+		var ok bool
+		exists := func(tagsKey string) bool { _, ok := mmNew.Counters[metricName][tagsKey]; return ok }
+		if tagsKey, c.Tags, ok = tl.limit(c.Source, c.Tags, exists); ok {
+			mmNew.MergeCounter(metricName, tagsKey, c)
+		}
+	})
+	mm.Gauges.Each(func(metricName, tagsKey string, g gostatsd.Gauge) {
+		if len(g.Tags) <= tl.maxTags {
+			mmNew.MergeGauge(metricName, tagsKey, g)
+		}
+	})
+	mm.Gauges.Each(func(metricName, tagsKey string, g gostatsd.Gauge) {
+		if len(g.Tags) <= tl.maxTags {
+			return
+		}
+		var ok bool
+		exists := func(tagsKey string) bool { _, ok := mmNew.Gauges[metricName][tagsKey]; return ok }
+		if tagsKey, g.Tags, ok = tl.limit(g.Source, g.Tags, exists); ok {
+			mmNew.MergeGauge(metricName, tagsKey, g)
+		}
+	})
+	mm.Timers.Each(func(metricName, tagsKey string, t gostatsd.Timer) {
+		if len(t.Tags) <= tl.maxTags {
+			mmNew.MergeTimer(metricName, tagsKey, t)
+		}
+	})
+	mm.Timers.Each(func(metricName, tagsKey string, t gostatsd.Timer) {
+		if len(t.Tags) <= tl.maxTags {
+			return
+		}
+		var ok bool
+		exists := func(tagsKey string) bool { _, ok := mmNew.Timers[metricName][tagsKey]; return ok }
+		if tagsKey, t.Tags, ok = tl.limit(t.Source, t.Tags, exists); ok {
+			mmNew.MergeTimer(metricName, tagsKey, t)
+		}
+	})
+	mm.Sets.Each(func(metricName, tagsKey string, s gostatsd.Set) {
+		if len(s.Tags) <= tl.maxTags {
+			mmNew.MergeSet(metricName, tagsKey, s)
+		}
+	})
+	mm.Sets.Each(func(metricName, tagsKey string, s gostatsd.Set) {
+		if len(s.Tags) <= tl.maxTags {
+			return
+		}
+		var ok bool
+		exists := func(tagsKey string) bool { _, ok := mmNew.Sets[metricName][tagsKey]; return ok }
+		if tagsKey, s.Tags, ok = tl.limit(s.Source, s.Tags, exists); ok {
+			mmNew.MergeSet(metricName, tagsKey, s)
+		}
+	})
+	return mmNew
+}
+
+// emit emits the number of series truncated and dropped since the last emit.
+func (tl *tagLimiter) emit(statser stats.Statser, backendName string) {
+	tags := gostatsd.Tags{"backend:" + backendName}
+	statser.Count("backend.tag_limit.truncated", float64(atomic.SwapUint64(&tl.truncated, 0)), tags)
+	statser.Count("backend.tag_limit.dropped", float64(atomic.SwapUint64(&tl.dropped, 0)), tags)
+}
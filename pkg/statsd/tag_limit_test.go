@@ -0,0 +1,162 @@
+package statsd
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/stats"
+)
+
+// tagLimitedBackend is a namedCapturingBackend with a default tag limit.
+type tagLimitedBackend struct {
+	namedCapturingBackend
+	maxTags int
+}
+
+func (tlb *tagLimitedBackend) MaxTags() int {
+	return tlb.maxTags
+}
+
+func TestTagLimitersFromViper(t *testing.T) {
+	t.Parallel()
+	backends := []gostatsd.Backend{
+		&tagLimitedBackend{namedCapturingBackend: namedCapturingBackend{name: "limited"}, maxTags: 3},
+		&namedCapturingBackend{name: "graphite"},
+		&namedCapturingBackend{name: "stdout"},
+	}
+
+	limiters, err := newTagLimitersFromViper(viper.New(), backends)
+	require.NoError(t, err)
+	require.Len(t, limiters, 1)
+	assert.Equal(t, &tagLimiter{maxTags: 3}, limiters["limited"])
+
+	v := viper.New()
+	v.Set("tag-limit.limited.policy", TagLimitPolicyDrop)
+	v.Set("tag-limit.graphite.max-tags", 5)
+	v.Set("tag-limit.stdout.max-tags", 0)
+	limiters, err = newTagLimitersFromViper(v, backends)
+	require.NoError(t, err)
+	require.Len(t, limiters, 2)
+	assert.Equal(t, &tagLimiter{maxTags: 3, drop: true}, limiters["limited"])
+	assert.Equal(t, &tagLimiter{maxTags: 5}, limiters["graphite"])
+
+	// The default limit can be disabled
+	v.Set("tag-limit.limited.max-tags", 0)
+	limiters, err = newTagLimitersFromViper(v, backends)
+	require.NoError(t, err)
+	assert.NotContains(t, limiters, "limited")
+
+	v.Set("tag-limit.stdout.policy", "sample")
+	_, err = newTagLimitersFromViper(v, backends)
+	require.Error(t, err)
+
+	v = viper.New()
+	v.Set("tag-limit.stdout.max-tags", -1)
+	_, err = newTagLimitersFromViper(v, backends)
+	require.Error(t, err)
+}
+
+func tagLimitInput() *gostatsd.MetricMap {
+	mm := gostatsd.NewMetricMap()
+	mm.Receive(&gostatsd.Metric{Type: gostatsd.COUNTER, Name: "c", Value: 1, Rate: 1, Tags: gostatsd.Tags{"d:4", "c:3", "b:2", "a:1"}})
+	mm.Receive(&gostatsd.Metric{Type: gostatsd.COUNTER, Name: "c", Value: 1, Rate: 1, Tags: gostatsd.Tags{"a:1"}})
+	mm.Receive(&gostatsd.Metric{Type: gostatsd.GAUGE, Name: "g", Value: 1, Rate: 1, Tags: gostatsd.Tags{"z", "y", "x"}})
+	mm.Receive(&gostatsd.Metric{Type: gostatsd.TIMER, Name: "t", Value: 1, Rate: 1, Tags: gostatsd.Tags{"a:1", "b:2"}})
+	mm.Receive(&gostatsd.Metric{Type: gostatsd.SET, Name: "s", StringValue: "v", Rate: 1, Tags: gostatsd.Tags{"c", "b", "a"}})
+	return mm
+}
+
+func TestTagLimiterTruncate(t *testing.T) {
+	t.Parallel()
+	tl := &tagLimiter{maxTags: 2}
+	input := tagLimitInput()
+	mm := tl.apply(input)
+
+	// Truncated series are keyed by their remaining tags
+	assert.Len(t, mm.Counters["c"], 2)
+	assert.Equal(t, gostatsd.Tags{"a:1", "b:2"}, mm.Counters["c"]["a:1,b:2"].Tags)
+	assert.Equal(t, gostatsd.Tags{"a:1"}, mm.Counters["c"]["a:1"].Tags)
+	assert.Equal(t, gostatsd.Tags{"x", "y"}, mm.Gauges["g"]["x,y"].Tags)
+	assert.Equal(t, gostatsd.Tags{"a:1", "b:2"}, mm.Timers["t"]["a:1,b:2"].Tags)
+	assert.Equal(t, gostatsd.Tags{"a", "b"}, mm.Sets["s"]["a,b"].Tags)
+	// The input is not modified
+	assert.Len(t, input.Counters["c"]["a:1,b:2,c:3,d:4"].Tags, 4)
+
+	internal := &capturingHandler{}
+	statser := stats.NewInternalStatser(nil, "", "", gostatsd.UnknownSource, internal)
+	tl.emit(statser, "limited")
+	statser.NotifyFlush(context.Background(), 0)
+	require.Len(t, internal.mm, 1)
+	counters := internal.mm[0].Counters
+	assert.EqualValues(t, 3, counters["backend.tag_limit.truncated"]["backend:limited"].Value)
+	assert.EqualValues(t, 0, counters["backend.tag_limit.dropped"]["backend:limited"].Value)
+}
+
+func TestTagLimiterTruncateCollision(t *testing.T) {
+	t.Parallel()
+	tl := &tagLimiter{maxTags: 1}
+	input := gostatsd.NewMetricMap()
+	input.Receive(&gostatsd.Metric{Type: gostatsd.COUNTER, Name: "c", Value: 1, Rate: 1, Tags: gostatsd.Tags{"a:1", "b:1"}})
+	input.Receive(&gostatsd.Metric{Type: gostatsd.COUNTER, Name: "c", Value: 2, Rate: 1, Tags: gostatsd.Tags{"a:1", "b:2"}})
+	input.Receive(&gostatsd.Metric{Type: gostatsd.COUNTER, Name: "c", Value: 4, Rate: 1, Tags: gostatsd.Tags{"a:1"}})
+	input.Receive(&gostatsd.Metric{Type: gostatsd.GAUGE, Name: "g", Value: 1, Tags: gostatsd.Tags{"a:1", "b:1"}})
+	input.Receive(&gostatsd.Metric{Type: gostatsd.GAUGE, Name: "g", Value: 2, Tags: gostatsd.Tags{"a:1", "b:2"}})
+	mm := tl.apply(input)
+
+	// The series within the limit is kept, rather than a truncated series with the same tags
+	require.Len(t, mm.Counters["c"], 1)
+	assert.EqualValues(t, 4, mm.Counters["c"]["a:1"].Value)
+	// Only one of the truncated series with the same tags is kept
+	require.Len(t, mm.Gauges["g"], 1)
+	assert.Equal(t, gostatsd.Tags{"a:1"}, mm.Gauges["g"]["a:1"].Tags)
+	assert.EqualValues(t, 3, tl.dropped)
+	assert.EqualValues(t, 1, tl.truncated)
+}
+
+func TestTagLimiterDrop(t *testing.T) {
+	t.Parallel()
+	tl := &tagLimiter{maxTags: 2, drop: true}
+	mm := tl.apply(tagLimitInput())
+
+	require.Len(t, mm.Counters["c"], 1)
+	assert.Equal(t, gostatsd.Tags{"a:1"}, mm.Counters["c"]["a:1"].Tags)
+	assert.Empty(t, mm.Gauges)
+	assert.Equal(t, gostatsd.Tags{"a:1", "b:2"}, mm.Timers["t"]["a:1,b:2"].Tags)
+	assert.Empty(t, mm.Sets)
+	assert.EqualValues(t, 3, tl.dropped)
+	assert.EqualValues(t, 0, tl.truncated)
+}
+
+func TestTagLimiterUnderLimit(t *testing.T) {
+	t.Parallel()
+	tl := &tagLimiter{maxTags: 4}
+	input := tagLimitInput()
+	assert.Same(t, input, tl.apply(input))
+}
+
+func TestFlusherAppliesTagLimiters(t *testing.T) {
+	t.Parallel()
+	limited := &namedCapturingBackend{name: "limited"}
+	unlimited := &namedCapturingBackend{name: "unlimited"}
+	fl := NewMetricFlusher(0, 0, false, nil, []gostatsd.Backend{limited, unlimited}, nil)
+	fl.tagLimiters = map[string]*tagLimiter{"limited": {maxTags: 1, drop: true}}
+
+	input := tagLimitInput()
+	var wg sync.WaitGroup
+	fl.sendMetricsAsync(context.Background(), &wg, input, nil)
+	wg.Wait()
+
+	require.Len(t, unlimited.maps, 1)
+	assert.Same(t, input, unlimited.maps[0])
+	require.Len(t, limited.maps, 1)
+	assert.Len(t, limited.maps[0].Counters["c"], 1)
+	assert.Empty(t, limited.maps[0].Gauges)
+	assert.Empty(t, limited.maps[0].Timers)
+	assert.Empty(t, limited.maps[0].Sets)
+}
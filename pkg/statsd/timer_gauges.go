@@ -0,0 +1,53 @@
+package statsd
+
+import (
+	"github.com/atlassian/gostatsd"
+)
+
+// timerGauges adds a gauge of the min of each timer, named `<name>.<minSuffix>`, and a gauge of its max, named
+// `<name>.<maxSuffix>`, so dashboards can use them under their own names, regardless of how the backend names the
+// lower and upper sub-metrics.  The timers themselves are still sent.
+type timerGauges struct {
+	minSuffix        string
+	maxSuffix        string
+	disabledSubtypes gostatsd.TimerSubtypes
+}
+
+// add returns a copy of mm with the min and max gauges added, leaving mm unmodified.
+func (tg *timerGauges) add(mm *gostatsd.MetricMap) *gostatsd.MetricMap {
+	mmNew := gostatsd.NewMetricMap()
+	mm.Counters.Each(func(metricName, tagsKey string, c gostatsd.Counter) {
+		mmNew.MergeCounter(metricName, tagsKey, c)
+	})
+	mm.Gauges.Each(func(metricName, tagsKey string, g gostatsd.Gauge) {
+		mmNew.MergeGauge(metricName, tagsKey, g)
+	})
+	mm.Sets.Each(func(metricName, tagsKey string, s gostatsd.Set) {
+		mmNew.MergeSet(metricName, tagsKey, s)
+	})
+	mm.Timers.Each(func(metricName, tagsKey string, t gostatsd.Timer) {
+		mmNew.MergeTimer(metricName, tagsKey, t)
+		// The min and max are only calculated for timers with values, which are not reduced to a histogram
+		if t.Count == 0 || t.Histogram != nil {
+			return
+		}
+		disabled := t.EffectiveDisabledSubtypes(tg.disabledSubtypes)
+		if !disabled.MinGauge {
+			mmNew.MergeGauge(metricName+"."+tg.minSuffix, tagsKey, timerGauge(t, t.Min))
+		}
+		if !disabled.MaxGauge {
+			mmNew.MergeGauge(metricName+"."+tg.maxSuffix, tagsKey, timerGauge(t, t.Max))
+		}
+	})
+	return mmNew
+}
+
+// timerGauge returns a gauge of the given value, for the same series as the timer.
+func timerGauge(t gostatsd.Timer, value float64) gostatsd.Gauge {
+	return gostatsd.Gauge{
+		Value:     value,
+		Timestamp: t.Timestamp,
+		Source:    t.Source,
+		Tags:      t.Tags,
+	}
+}
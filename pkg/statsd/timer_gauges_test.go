@@ -0,0 +1,93 @@
+package statsd
+
+import (
+	"context"
+	"math"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/atlassian/gostatsd"
+)
+
+func TestTimerGaugesFlush(t *testing.T) {
+	t.Parallel()
+	ma := NewMetricAggregator(nil, 0, 0, 0, 0, gostatsd.TimerSubtypes{}, math.MaxUint32)
+	mm := gostatsd.NewMetricMap()
+	for _, value := range []float64{5, 1, 9} {
+		mm.Receive(&gostatsd.Metric{Name: "latency", Value: value, Type: gostatsd.TIMER, Rate: 1, Tags: gostatsd.Tags{"env:prod"}, Source: "host"})
+	}
+	mm.Receive(&gostatsd.Metric{Name: "requests", Value: 1, Type: gostatsd.COUNTER, Rate: 1})
+	ma.ReceiveMap(mm)
+	ma.Flush(time.Second)
+
+	backend := &namedCapturingBackend{name: "backend"}
+	fl := NewMetricFlusher(0, 0, false, nil, []gostatsd.Backend{backend}, nil)
+	fl.timerGauges = &timerGauges{minSuffix: "fastest", maxSuffix: "slowest"}
+	var wg sync.WaitGroup
+	ma.Process(func(m *gostatsd.MetricMap) {
+		fl.sendMetricsAsync(context.Background(), &wg, m, nil)
+	})
+	wg.Wait()
+
+	require.Len(t, backend.maps, 1)
+	sent := backend.maps[0]
+	require.Len(t, sent.Gauges, 2)
+	tagsKey := gostatsd.FormatTagsKey("host", gostatsd.Tags{"env:prod"})
+	min := sent.Gauges["latency.fastest"][tagsKey]
+	assert.EqualValues(t, 1, min.Value)
+	assert.Equal(t, gostatsd.Tags{"env:prod"}, min.Tags)
+	assert.EqualValues(t, "host", min.Source)
+	assert.EqualValues(t, 9, sent.Gauges["latency.slowest"][tagsKey].Value)
+
+	// The timer and other metrics are still sent
+	assert.EqualValues(t, 3, sent.Timers["latency"][tagsKey].Count)
+	assert.Contains(t, sent.Counters, "requests")
+	assert.Empty(t, ma.metricMap.Gauges)
+}
+
+func TestTimerGaugesDisabled(t *testing.T) {
+	t.Parallel()
+	mm := gostatsd.NewMetricMap()
+	timer := gostatsd.NewTimer(1, []float64{2, 4}, "", nil)
+	timer.Count, timer.Min, timer.Max = 2, 2, 4
+	mm.Timers["latency"] = map[string]gostatsd.Timer{"": timer}
+	overridden := timer
+	overridden.DisabledSubtypes = &gostatsd.TimerSubtypes{MaxGauge: true}
+	mm.Timers["overridden"] = map[string]gostatsd.Timer{"": overridden}
+	empty := gostatsd.NewTimer(1, nil, "", nil)
+	mm.Timers["empty"] = map[string]gostatsd.Timer{"": empty}
+
+	tg := &timerGauges{minSuffix: "min", maxSuffix: "max", disabledSubtypes: gostatsd.TimerSubtypes{MinGauge: true}}
+	added := tg.add(mm)
+	assert.Len(t, added.Timers, 3)
+	// Only the configured series appear, and a timer override replaces the disabled sub-metrics
+	assert.Len(t, added.Gauges, 2)
+	assert.EqualValues(t, 4, added.Gauges["latency.max"][""].Value)
+	assert.EqualValues(t, 2, added.Gauges["overridden.min"][""].Value)
+
+	// Histogram timers have no min or max
+	histogram := timer
+	histogram.Histogram = map[gostatsd.HistogramThreshold]int{10: 2}
+	mm.Timers["latency"] = map[string]gostatsd.Timer{"": histogram}
+	delete(mm.Timers, "overridden")
+	assert.Empty(t, (&timerGauges{minSuffix: "min", maxSuffix: "max"}).add(mm).Gauges)
+}
+
+func TestTimerOverrideSummaryGauge(t *testing.T) {
+	t.Parallel()
+	to, err := newTimerOverride("max-gauge")
+	require.NoError(t, err)
+	expected := allTimerSubtypes
+	expected.MaxGauge = false
+	assert.Equal(t, expected, to.DisabledSubtypes)
+
+	// Other summaries suppress the gauges too
+	to, err = newTimerOverride("upper")
+	require.NoError(t, err)
+	assert.True(t, to.DisabledSubtypes.MinGauge)
+	assert.True(t, to.DisabledSubtypes.MaxGauge)
+}
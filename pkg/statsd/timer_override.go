@@ -0,0 +1,222 @@
+package statsd
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/tdigest"
+)
+
+// allTimerSubtypes has every timer sub-metric disabled.
+var allTimerSubtypes = gostatsd.TimerSubtypes{
+	Lower:          true,
+	LowerPct:       true,
+	Upper:          true,
+	UpperPct:       true,
+	Count:          true,
+	CountPct:       true,
+	CountPerSecond: true,
+	Mean:           true,
+	MeanPct:        true,
+	Median:         true,
+	StdDev:         true,
+	Sum:            true,
+	SumPct:         true,
+	SumSquares:     true,
+	SumSquaresPct:  true,
+	MinGauge:       true,
+	MaxGauge:       true,
+}
+
+// TimerOverride either reduces the output of the timers it matches to a single sub-metric, regardless of the
+// sub-metrics disabled globally, replaces the global set of percentiles calculated for them, or replaces all their
+// sub-metrics with a histogram of fixed buckets.  It can also fold their values in to a t-digest as they are received.
+type TimerOverride struct {
+	MatchMetrics     gostatsd.StringMatchList // Name must match, if the list is not empty
+	ExcludeMetrics   gostatsd.StringMatchList // Name must not match
+	DisabledSubtypes gostatsd.TimerSubtypes   // Sub-metrics which are not emitted, unless percentilesOnly is set
+
+	percentThresholds   map[float64]percentStruct     // Percentiles which are calculated
+	percentilesOnly     bool                          // Only the percentiles are overridden, the global sub-metrics apply
+	histogramThresholds []gostatsd.HistogramThreshold // Upper bounds of the histogram buckets, if not nil
+	digestCompression   float64                       // Compression of the digest values are folded in to, or 0 to keep them
+}
+
+// NewTimerOverrideFromViper creates a new TimerOverride given a *viper.Viper
+func NewTimerOverrideFromViper(v *viper.Viper) (*TimerOverride, error) {
+	v.SetDefault("match-metrics", []string{})
+	v.SetDefault("exclude-metrics", []string{})
+	v.SetDefault("summary", "")
+	v.SetDefault("digest-compression", 0)
+
+	var to *TimerOverride
+	var err error
+	switch {
+	case v.IsSet("histogram-buckets"):
+		if v.GetString("summary") != "" || v.IsSet("percent-threshold") {
+			return nil, fmt.Errorf("histogram-buckets, summary, and percent-threshold are mutually exclusive")
+		}
+		to, err = newHistogramOverride(v.GetStringSlice("histogram-buckets"))
+	case v.IsSet("percent-threshold"):
+		if v.GetString("summary") != "" {
+			return nil, fmt.Errorf("summary and percent-threshold are mutually exclusive")
+		}
+		to, err = newPercentileOverride(v.GetStringSlice("percent-threshold"))
+	default:
+		to, err = newTimerOverride(v.GetString("summary"))
+	}
+	if err != nil {
+		return nil, err
+	}
+	to.digestCompression = v.GetFloat64("digest-compression")
+	if to.digestCompression < 0 || math.IsNaN(to.digestCompression) {
+		return nil, fmt.Errorf("digest-compression must not be negative")
+	}
+	if to.digestCompression > tdigest.MaxCompression {
+		return nil, fmt.Errorf("digest-compression must not be more than %d", tdigest.MaxCompression)
+	}
+	to.MatchMetrics = toStringMatch(v.GetStringSlice("match-metrics"))
+	to.ExcludeMetrics = toStringMatch(v.GetStringSlice("exclude-metrics"))
+	return to, nil
+}
+
+// NewTimerOverridesFromViper creates a TimerOverride for each name in the `timer-overrides` list, read from the
+// `timer-override.<name>` section.
+func NewTimerOverridesFromViper(v *viper.Viper) ([]*TimerOverride, error) {
+	var overrides []*TimerOverride
+	for _, name := range v.GetStringSlice("timer-overrides") {
+		vOverride := v.Sub("timer-override." + name)
+		if vOverride == nil {
+			logrus.Warnf("Timer override doesn't exist: %v", name)
+			continue
+		}
+		to, err := NewTimerOverrideFromViper(vOverride)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timer override %s: %v", name, err)
+		}
+		overrides = append(overrides, to)
+		logrus.Infof("Loaded timer override %v", name)
+	}
+	return overrides, nil
+}
+
+// newTimerOverride creates a TimerOverride which emits only the named sub-metric.  The name is either a regular
+// sub-metric as used in the `disabled-sub-metrics` section, or a percentile sub-metric as emitted, such as `upper_95`.
+func newTimerOverride(summary string) (*TimerOverride, error) {
+	to := &TimerOverride{
+		DisabledSubtypes:  allTimerSubtypes,
+		percentThresholds: map[float64]percentStruct{},
+	}
+	d := &to.DisabledSubtypes
+
+	switch summary {
+	case "lower":
+		d.Lower = false
+	case "upper":
+		d.Upper = false
+	case "count":
+		d.Count = false
+	case "count-per-second":
+		d.CountPerSecond = false
+	case "mean":
+		d.Mean = false
+	case "median":
+		d.Median = false
+	case "stddev":
+		d.StdDev = false
+	case "sum":
+		d.Sum = false
+	case "sum-squares":
+		d.SumSquares = false
+	case "min-gauge":
+		d.MinGauge = false
+	case "max-gauge":
+		d.MaxGauge = false
+	default:
+		idx := strings.LastIndex(summary, "_")
+		if idx == -1 {
+			return nil, fmt.Errorf("unknown summary %q", summary)
+		}
+		pct, err := strconv.Atoi(summary[idx+1:])
+		if err != nil || pct == 0 || pct > 100 || pct < -100 {
+			return nil, fmt.Errorf("invalid percentile in summary %q", summary)
+		}
+		switch summary[:idx] {
+		case "count":
+			d.CountPct = false
+		case "mean":
+			d.MeanPct = false
+		case "sum":
+			d.SumPct = false
+		case "sum_squares":
+			d.SumSquaresPct = false
+		case "upper":
+			if pct < 0 {
+				return nil, fmt.Errorf("upper percentile in summary %q must be positive", summary)
+			}
+			d.UpperPct = false
+		case "lower":
+			if pct > 0 {
+				return nil, fmt.Errorf("lower percentile in summary %q must be negative", summary)
+			}
+			d.LowerPct = false
+		default:
+			return nil, fmt.Errorf("unknown summary %q", summary)
+		}
+		to.percentThresholds[float64(pct)] = newPercentStruct(float64(pct))
+	}
+	return to, nil
+}
+
+// newPercentileOverride creates a TimerOverride which calculates only the given percentiles, instead of the global
+// `percent-threshold` list.  An empty list suppresses all percentile sub-metrics.
+func newPercentileOverride(percentThresholds []string) (*TimerOverride, error) {
+	to := &TimerOverride{
+		percentThresholds: make(map[float64]percentStruct, len(percentThresholds)),
+		percentilesOnly:   true,
+	}
+	for _, s := range percentThresholds {
+		pct, err := strconv.ParseFloat(s, 64)
+		if err != nil || pct == 0 || math.IsNaN(pct) || math.Abs(pct) > 100 {
+			return nil, fmt.Errorf("invalid percent-threshold %q", s)
+		}
+		to.percentThresholds[pct] = newPercentStruct(pct)
+	}
+	return to, nil
+}
+
+// newHistogramOverride creates a TimerOverride which emits a histogram with fixed buckets, instead of the other
+// sub-metrics, the same as a timer with a `gsd_histogram` tag.  The buckets are the upper bounds, and a `+Inf` bucket
+// is always added.
+func newHistogramOverride(buckets []string) (*TimerOverride, error) {
+	to := &TimerOverride{
+		histogramThresholds: make([]gostatsd.HistogramThreshold, 0, len(buckets)),
+	}
+	seen := make(map[float64]struct{}, len(buckets))
+	for _, s := range buckets {
+		bucket, err := strconv.ParseFloat(s, 64)
+		if err != nil || math.IsNaN(bucket) {
+			return nil, fmt.Errorf("invalid histogram-buckets %q", s)
+		}
+		if _, ok := seen[bucket]; ok || math.IsInf(bucket, 1) {
+			continue
+		}
+		seen[bucket] = present
+		to.histogramThresholds = append(to.histogramThresholds, gostatsd.HistogramThreshold(bucket))
+	}
+	return to, nil
+}
+
+// matches indicates if the override applies to the named timer.
+func (to *TimerOverride) matches(metricName string) bool {
+	if len(to.MatchMetrics) > 0 && !to.MatchMetrics.MatchAny(metricName) {
+		return false
+	}
+	return !to.ExcludeMetrics.MatchAny(metricName)
+}
@@ -0,0 +1,374 @@
+package statsd
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/tdigest"
+)
+
+func TestNewTimerOverridesFromViper(t *testing.T) {
+	t.Parallel()
+	v := viper.New()
+	v.Set("timer-overrides", []string{"bulk", "missing"})
+	v.Set("timer-override.bulk.match-metrics", []string{"bulk.*"})
+	v.Set("timer-override.bulk.exclude-metrics", []string{"bulk.important"})
+	v.Set("timer-override.bulk.summary", "upper_95")
+
+	overrides, err := NewTimerOverridesFromViper(v)
+	require.NoError(t, err)
+	require.Len(t, overrides, 1)
+	to := overrides[0]
+	assert.Equal(t, gostatsd.StringMatchList{gostatsd.NewStringMatch("bulk.*")}, to.MatchMetrics)
+	assert.Equal(t, gostatsd.StringMatchList{gostatsd.NewStringMatch("bulk.important")}, to.ExcludeMetrics)
+	assert.True(t, to.matches("bulk.x"))
+	assert.False(t, to.matches("bulk.important"))
+	assert.False(t, to.matches("other"))
+}
+
+func TestNewTimerOverridesFromViperInvalid(t *testing.T) {
+	t.Parallel()
+	for _, summary := range []string{"", "p95", "upper_x", "upper_-95", "lower_95", "median_95", "count_0", "upper_150", "lower_-101", "mean_101"} {
+		v := viper.New()
+		v.Set("timer-overrides", []string{"bad"})
+		v.Set("timer-override.bad.summary", summary)
+		_, err := NewTimerOverridesFromViper(v)
+		assert.Error(t, err, summary)
+	}
+}
+
+func TestNewTimerOverride(t *testing.T) {
+	t.Parallel()
+	to, err := newTimerOverride("median")
+	require.NoError(t, err)
+	expected := allTimerSubtypes
+	expected.Median = false
+	assert.Equal(t, expected, to.DisabledSubtypes)
+	assert.Empty(t, to.percentThresholds)
+
+	to, err = newTimerOverride("sum_squares_99")
+	require.NoError(t, err)
+	expected = allTimerSubtypes
+	expected.SumSquaresPct = false
+	assert.Equal(t, expected, to.DisabledSubtypes)
+	assert.Equal(t, map[float64]percentStruct{99: newPercentStruct(99)}, to.percentThresholds)
+}
+
+func TestAggregatorTimerOverride(t *testing.T) {
+	t.Parallel()
+	override, err := newTimerOverride("upper_95")
+	require.NoError(t, err)
+	override.MatchMetrics = toStringMatch([]string{"bulk.*"})
+
+	ma := NewMetricAggregator(
+		[]float64{90},
+		5*time.Minute,
+		5*time.Minute,
+		5*time.Minute,
+		5*time.Minute,
+		gostatsd.TimerSubtypes{},
+		math.MaxUint32,
+	)
+	ma.setTimerOverrides([]*TimerOverride{override})
+	mm := gostatsd.NewMetricMap()
+	for i := 1; i <= 100; i++ {
+		mm.Receive(&gostatsd.Metric{Name: "bulk.latency", Value: float64(i), Type: gostatsd.TIMER, Rate: 1})
+		mm.Receive(&gostatsd.Metric{Name: "other.latency", Value: float64(i), Type: gostatsd.TIMER, Rate: 1})
+	}
+	ma.ReceiveMap(mm)
+	ma.Flush(1 * time.Second)
+
+	bulk := ma.metricMap.Timers["bulk.latency"][""]
+	assert.Equal(t, gostatsd.Percentiles{gostatsd.Percentile{Float: 95, Str: "upper_95"}}, bulk.Percentiles)
+	require.NotNil(t, bulk.DisabledSubtypes)
+	assert.Equal(t, override.DisabledSubtypes, bulk.EffectiveDisabledSubtypes(gostatsd.TimerSubtypes{}))
+
+	other := ma.metricMap.Timers["other.latency"][""]
+	assert.Nil(t, other.DisabledSubtypes)
+	assert.Len(t, other.Percentiles, 5)
+}
+
+func TestNewTimerOverridesFromViperPercentThreshold(t *testing.T) {
+	t.Parallel()
+	v := viper.New()
+	v.Set("timer-overrides", []string{"compact", "none"})
+	v.Set("timer-override.compact.match-metrics", []string{"api.*"})
+	v.Set("timer-override.compact.percent-threshold", []string{"50", "99", "-10"})
+	v.Set("timer-override.none.match-metrics", []string{"bulk.*"})
+	v.Set("timer-override.none.percent-threshold", []string{})
+
+	overrides, err := NewTimerOverridesFromViper(v)
+	require.NoError(t, err)
+	require.Len(t, overrides, 2)
+	assert.True(t, overrides[0].percentilesOnly)
+	assert.Equal(t, map[float64]percentStruct{
+		50:  newPercentStruct(50),
+		99:  newPercentStruct(99),
+		-10: newPercentStruct(-10),
+	}, overrides[0].percentThresholds)
+	assert.True(t, overrides[1].percentilesOnly)
+	assert.Empty(t, overrides[1].percentThresholds)
+}
+
+func TestNewTimerOverridesFromViperPercentThresholdInvalid(t *testing.T) {
+	t.Parallel()
+	for _, pct := range []string{"0", "x", "101", "NaN"} {
+		v := viper.New()
+		v.Set("timer-overrides", []string{"bad"})
+		v.Set("timer-override.bad.percent-threshold", []string{"90", pct})
+		_, err := NewTimerOverridesFromViper(v)
+		assert.Error(t, err, pct)
+	}
+
+	v := viper.New()
+	v.Set("timer-overrides", []string{"bad"})
+	v.Set("timer-override.bad.summary", "upper_95")
+	v.Set("timer-override.bad.percent-threshold", []string{"95"})
+	_, err := NewTimerOverridesFromViper(v)
+	assert.Error(t, err)
+}
+
+func TestAggregatorPercentileOverride(t *testing.T) {
+	t.Parallel()
+	compact, err := newPercentileOverride([]string{"99"})
+	require.NoError(t, err)
+	compact.MatchMetrics = toStringMatch([]string{"api.*"})
+	none, err := newPercentileOverride(nil)
+	require.NoError(t, err)
+	none.MatchMetrics = toStringMatch([]string{"bulk.*"})
+
+	disabled := gostatsd.TimerSubtypes{CountPct: true, MeanPct: true, SumPct: true, SumSquaresPct: true}
+	ma := NewMetricAggregator(
+		[]float64{50, 90, 95},
+		5*time.Minute,
+		5*time.Minute,
+		5*time.Minute,
+		5*time.Minute,
+		disabled,
+		math.MaxUint32,
+	)
+	ma.setTimerOverrides([]*TimerOverride{compact, none})
+	mm := gostatsd.NewMetricMap()
+	for i := 1; i <= 100; i++ {
+		for _, name := range []string{"api.latency", "bulk.latency", "other.latency"} {
+			mm.Receive(&gostatsd.Metric{Name: name, Value: float64(i), Type: gostatsd.TIMER, Rate: 1})
+		}
+	}
+	ma.ReceiveMap(mm)
+	ma.Flush(1 * time.Second)
+
+	names := func(timer gostatsd.Timer) []string {
+		var result []string
+		for _, pct := range timer.Percentiles {
+			result = append(result, pct.Str)
+		}
+		return result
+	}
+
+	api := ma.metricMap.Timers["api.latency"][""]
+	assert.Nil(t, api.DisabledSubtypes)
+	assert.Equal(t, []string{"upper_99"}, names(api))
+	assert.Equal(t, gostatsd.Percentiles{gostatsd.Percentile{Float: 99, Str: "upper_99"}}, api.Percentiles)
+
+	bulk := ma.metricMap.Timers["bulk.latency"][""]
+	assert.Nil(t, bulk.DisabledSubtypes)
+	assert.Empty(t, bulk.Percentiles)
+	assert.EqualValues(t, 100, bulk.Count)
+
+	other := ma.metricMap.Timers["other.latency"][""]
+	assert.ElementsMatch(t, []string{"upper_50", "upper_90", "upper_95"}, names(other))
+}
+
+func TestNewTimerOverridesFromViperHistogramBuckets(t *testing.T) {
+	t.Parallel()
+	v := viper.New()
+	v.Set("timer-overrides", []string{"latency"})
+	v.Set("timer-override.latency.match-metrics", []string{"api.*"})
+	v.Set("timer-override.latency.histogram-buckets", []string{"10", "2.5", "-1", "10", "+Inf"})
+
+	overrides, err := NewTimerOverridesFromViper(v)
+	require.NoError(t, err)
+	require.Len(t, overrides, 1)
+	assert.Equal(t, []gostatsd.HistogramThreshold{10, 2.5, -1}, overrides[0].histogramThresholds)
+
+	for _, conflict := range []string{"summary", "percent-threshold"} {
+		v := viper.New()
+		v.Set("timer-overrides", []string{"bad"})
+		v.Set("timer-override.bad.histogram-buckets", []string{"10"})
+		v.Set("timer-override.bad."+conflict, "upper_95")
+		_, err := NewTimerOverridesFromViper(v)
+		assert.Error(t, err, conflict)
+	}
+
+	v = viper.New()
+	v.Set("timer-overrides", []string{"bad"})
+	v.Set("timer-override.bad.histogram-buckets", []string{"10", "x"})
+	_, err = NewTimerOverridesFromViper(v)
+	assert.Error(t, err)
+}
+
+func TestAggregatorHistogramOverride(t *testing.T) {
+	t.Parallel()
+	to, err := newHistogramOverride([]string{"0", "10", "50", "99.5"})
+	require.NoError(t, err)
+	to.MatchMetrics = toStringMatch([]string{"api.*"})
+	ma := NewMetricAggregator([]float64{90}, 5*time.Minute, 5*time.Minute, 5*time.Minute, 5*time.Minute, gostatsd.TimerSubtypes{}, math.MaxUint32)
+	ma.setTimerOverrides([]*TimerOverride{to})
+
+	mm := gostatsd.NewMetricMap()
+	now := gostatsd.Nanotime(time.Now().UnixNano())
+	for i := 1; i <= 100; i++ {
+		for _, name := range []string{"api.latency", "other.latency"} {
+			mm.Receive(&gostatsd.Metric{Name: name, Value: float64(i), Type: gostatsd.TIMER, Rate: 1, Timestamp: now})
+		}
+	}
+	ma.ReceiveMap(mm)
+	ma.Flush(time.Second)
+
+	api := ma.metricMap.Timers["api.latency"][""]
+	assert.Equal(t, map[gostatsd.HistogramThreshold]int{
+		0:                                        0,
+		10:                                       10,
+		50:                                       50,
+		99.5:                                     99,
+		gostatsd.HistogramThreshold(math.Inf(1)): 100,
+	}, api.Histogram)
+	assert.Empty(t, api.Percentiles)
+
+	other := ma.metricMap.Timers["other.latency"][""]
+	assert.Nil(t, other.Histogram)
+	assert.Len(t, other.Percentiles, 5)
+
+	// The buckets are emitted empty after a reset, so the series persists until it expires
+	ma.Reset()
+	ma.Flush(time.Second)
+	api = ma.metricMap.Timers["api.latency"][""]
+	assert.Len(t, api.Histogram, 5)
+	for threshold, count := range api.Histogram {
+		assert.Zero(t, count, threshold)
+	}
+}
+
+func TestAggregatorHistogramOverrideDigest(t *testing.T) {
+	t.Parallel()
+	to, err := newHistogramOverride([]string{"250", "500", "750"})
+	require.NoError(t, err)
+	ma := NewMetricAggregator(nil, 5*time.Minute, 5*time.Minute, 5*time.Minute, 5*time.Minute, gostatsd.TimerSubtypes{}, math.MaxUint32)
+	ma.setTimerOverrides([]*TimerOverride{to})
+
+	// Values forwarded as a digest, along with some received directly
+	td := tdigest.New(tdigest.DefaultCompression)
+	for i := 1; i <= 1000; i++ {
+		td.Add(float64(i))
+	}
+	timer := gostatsd.NewTimerValues([]float64{100, 600})
+	timer.Digest = td
+	ma.metricMap.Timers["latency"] = map[string]gostatsd.Timer{"": timer}
+	ma.Flush(time.Second)
+
+	histogram := ma.metricMap.Timers["latency"][""].Histogram
+	assert.InDelta(t, 251, histogram[250], 10)
+	assert.InDelta(t, 501, histogram[500], 10)
+	assert.InDelta(t, 752, histogram[750], 10)
+	assert.Equal(t, 1002, histogram[gostatsd.HistogramThreshold(math.Inf(1))])
+}
+
+func TestNewTimerOverridesFromViperDigestCompression(t *testing.T) {
+	t.Parallel()
+	v := viper.New()
+	v.Set("timer-overrides", []string{"hot", "cold"})
+	v.Set("timer-override.hot.digest-compression", 100)
+	v.Set("timer-override.hot.percent-threshold", []string{"99"})
+	v.Set("timer-override.cold.summary", "upper")
+
+	overrides, err := NewTimerOverridesFromViper(v)
+	require.NoError(t, err)
+	require.Len(t, overrides, 2)
+	assert.EqualValues(t, 100, overrides[0].digestCompression)
+	assert.True(t, overrides[0].percentilesOnly)
+	assert.Zero(t, overrides[1].digestCompression)
+	assert.True(t, hasDigestOverride(overrides))
+	assert.False(t, hasDigestOverride(overrides[1:]))
+
+	v = viper.New()
+	v.Set("timer-overrides", []string{"bad"})
+	v.Set("timer-override.bad.digest-compression", -1)
+	_, err = NewTimerOverridesFromViper(v)
+	assert.Error(t, err)
+
+	v.Set("timer-override.bad.digest-compression", tdigest.MaxCompression+1)
+	_, err = NewTimerOverridesFromViper(v)
+	assert.Error(t, err)
+}
+
+func TestAggregatorDigestOverride(t *testing.T) {
+	t.Parallel()
+	const n = 10000
+	distributions := map[string]func(i int) float64{
+		// Every value from 1 to n, out of order
+		"uniform": func(i int) float64 {
+			return float64(i*7919%n + 1)
+		},
+		// Evenly spaced quantiles of an exponential distribution with a mean of 100
+		"exponential": func(i int) float64 {
+			return -100 * math.Log(1-(float64(i*7919%n)+0.5)/n)
+		},
+	}
+	for name, value := range distributions {
+		name, value := name, value
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			to, err := newPercentileOverride([]string{"50", "90", "99", "-10"})
+			require.NoError(t, err)
+			to.MatchMetrics = toStringMatch([]string{"digested.*"})
+			to.digestCompression = tdigest.DefaultCompression
+			ma := NewMetricAggregator([]float64{50, 90, 99, -10}, 5*time.Minute, 5*time.Minute, 5*time.Minute, 5*time.Minute, gostatsd.TimerSubtypes{}, math.MaxUint32)
+			ma.setTimerOverrides([]*TimerOverride{to})
+
+			// The values are received in batches, and folded in to the digest as they arrive
+			for batch := 0; batch < n; batch += 100 {
+				mm := gostatsd.NewMetricMap()
+				for i := batch; i < batch+100; i++ {
+					for _, name := range []string{"digested.latency", "exact.latency"} {
+						mm.Receive(&gostatsd.Metric{Name: name, Value: value(i), Type: gostatsd.TIMER, Rate: 1})
+					}
+				}
+				ma.ReceiveMap(mm)
+				digested := ma.metricMap.Timers["digested.latency"][""]
+				require.Empty(t, digested.Values)
+				require.NotNil(t, digested.Digest)
+				require.Len(t, ma.metricMap.Timers["exact.latency"][""].Values, batch+100)
+			}
+			ma.Flush(time.Second)
+
+			digested := ma.metricMap.Timers["digested.latency"][""]
+			exact := ma.metricMap.Timers["exact.latency"][""]
+			assert.Equal(t, exact.Count, digested.Count)
+			assert.Equal(t, exact.Min, digested.Min)
+			assert.Equal(t, exact.Max, digested.Max)
+			assert.InEpsilon(t, exact.Sum, digested.Sum, 1e-9)
+			assert.InEpsilon(t, exact.Mean, digested.Mean, 1e-9)
+			assert.InEpsilon(t, exact.Median, digested.Median, 0.01)
+
+			percentiles := func(timer gostatsd.Timer) map[string]float64 {
+				result := map[string]float64{}
+				for _, pct := range timer.Percentiles {
+					result[pct.Str] = pct.Float
+				}
+				return result
+			}
+			exactPercentiles := percentiles(exact)
+			digestedPercentiles := percentiles(digested)
+			require.Len(t, digestedPercentiles, len(exactPercentiles))
+			for pct, expected := range exactPercentiles {
+				assert.InEpsilon(t, expected, digestedPercentiles[pct], 0.02, pct)
+			}
+		})
+	}
+}
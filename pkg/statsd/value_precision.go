@@ -0,0 +1,87 @@
+package statsd
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/spf13/viper"
+
+	"github.com/atlassian/gostatsd"
+)
+
+// valueRounder rounds the values calculated at flush to a number of decimal places for a single backend, so they
+// serialize to shorter representations.  Values are rounded half to even, so rounding many values doesn't bias
+// their sum up or down.  Aggregation is always done at full precision, only the flushed values are rounded.
+type valueRounder struct {
+	scale float64 // 10 to the power of the number of decimal places
+}
+
+// newValueRoundersFromViper creates a valueRounder for each backend which has a number of decimal places in the
+// `value-precision` section, keyed by the backend name.
+func newValueRoundersFromViper(v *viper.Viper, backends []gostatsd.Backend) (map[string]*valueRounder, error) {
+	rounders := map[string]*valueRounder{}
+	vPrecision := v.Sub("value-precision")
+	if vPrecision == nil {
+		return rounders, nil
+	}
+	for _, backend := range backends {
+		if !vPrecision.IsSet(backend.Name()) {
+			continue
+		}
+		places := vPrecision.GetInt(backend.Name())
+		if places < 0 || places > 15 {
+			return nil, fmt.Errorf("backend %s: value precision must be between 0 and 15, got %d", backend.Name(), places)
+		}
+		rounders[backend.Name()] = &valueRounder{
+			scale: math.Pow10(places),
+		}
+	}
+	return rounders, nil
+}
+
+// round rounds v half to even.  NaN and infinite values are unchanged.
+func (vr *valueRounder) round(v float64) float64 {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return v
+	}
+	scaled := v * vr.scale
+	if math.IsInf(scaled, 0) {
+		return v // Too large to have any decimal places
+	}
+	return math.RoundToEven(scaled) / vr.scale
+}
+
+// apply returns a new MetricMap with the counter rates, gauges, and timer statistics and percentiles rounded.  Raw
+// timer values are not rounded.  The other values are not copied, so the result must be treated as read only, the
+// same as the input.
+func (vr *valueRounder) apply(mm *gostatsd.MetricMap) *gostatsd.MetricMap {
+	mmNew := gostatsd.NewMetricMap()
+	mm.Counters.Each(func(metricName, tagsKey string, c gostatsd.Counter) {
+		c.PerSecond = vr.round(c.PerSecond)
+		mmNew.MergeCounter(metricName, tagsKey, c)
+	})
+	mm.Gauges.Each(func(metricName, tagsKey string, g gostatsd.Gauge) {
+		g.Value = vr.round(g.Value)
+		mmNew.MergeGauge(metricName, tagsKey, g)
+	})
+	mm.Sets.Each(mmNew.MergeSet)
+	mm.Timers.Each(func(metricName, tagsKey string, t gostatsd.Timer) {
+		t.PerSecond = vr.round(t.PerSecond)
+		t.Mean = vr.round(t.Mean)
+		t.Median = vr.round(t.Median)
+		t.Min = vr.round(t.Min)
+		t.Max = vr.round(t.Max)
+		t.StdDev = vr.round(t.StdDev)
+		t.Sum = vr.round(t.Sum)
+		t.SumSquares = vr.round(t.SumSquares)
+		if len(t.Percentiles) > 0 {
+			percentiles := make(gostatsd.Percentiles, len(t.Percentiles))
+			for i, pct := range t.Percentiles {
+				percentiles[i] = gostatsd.Percentile{Float: vr.round(pct.Float), Str: pct.Str}
+			}
+			t.Percentiles = percentiles
+		}
+		mmNew.MergeTimer(metricName, tagsKey, t)
+	})
+	return mmNew
+}
@@ -0,0 +1,118 @@
+package statsd
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/atlassian/gostatsd"
+)
+
+func TestValueRoundersFromViper(t *testing.T) {
+	t.Parallel()
+	backends := []gostatsd.Backend{
+		&namedCapturingBackend{name: "datadog"},
+		&namedCapturingBackend{name: "graphite"},
+		&namedCapturingBackend{name: "stdout"},
+	}
+
+	rounders, err := newValueRoundersFromViper(viper.New(), backends)
+	require.NoError(t, err)
+	assert.Empty(t, rounders)
+
+	v := viper.New()
+	v.Set("value-precision.datadog", 2)
+	v.Set("value-precision.graphite", 0)
+	rounders, err = newValueRoundersFromViper(v, backends)
+	require.NoError(t, err)
+	require.Len(t, rounders, 2)
+	assert.EqualValues(t, 100, rounders["datadog"].scale)
+	assert.EqualValues(t, 1, rounders["graphite"].scale)
+
+	v.Set("value-precision.stdout", -1)
+	_, err = newValueRoundersFromViper(v, backends)
+	require.Error(t, err)
+}
+
+func TestValueRounderRound(t *testing.T) {
+	t.Parallel()
+	vr := &valueRounder{scale: 100}
+	for value, expected := range map[float64]string{
+		1.23456:        "1.23",
+		-1.23956:       "-1.24",
+		0.125:          "0.12", // Half to even
+		0.375:          "0.38",
+		100:            "100",
+		1e300:          "1e+300",
+		0.001:          "0",
+		123456789.1234: "1.2345678912e+08",
+	} {
+		assert.Equal(t, expected, strconv.FormatFloat(vr.round(value), 'g', -1, 64), "%v", value)
+	}
+	assert.True(t, math.IsNaN(vr.round(math.NaN())))
+	assert.True(t, math.IsInf(vr.round(math.Inf(-1)), -1))
+}
+
+func TestValueRounderUnbiased(t *testing.T) {
+	t.Parallel()
+	vr := &valueRounder{scale: 1}
+	var sum, roundedSum float64
+	for i := 0; i < 1000; i++ {
+		v := float64(i) + 0.5
+		sum += v
+		roundedSum += vr.round(v)
+	}
+	assert.Equal(t, sum, roundedSum)
+}
+
+func TestFlusherAppliesValueRounders(t *testing.T) {
+	t.Parallel()
+	rounded := &namedCapturingBackend{name: "rounded"}
+	full := &namedCapturingBackend{name: "full"}
+	fl := NewMetricFlusher(0, 0, false, nil, []gostatsd.Backend{rounded, full}, nil)
+	fl.valueRounders = map[string]*valueRounder{"rounded": {scale: 1000}}
+
+	input := gostatsd.NewMetricMap()
+	input.Counters["c"] = map[string]gostatsd.Counter{"": {Value: 1, PerSecond: 0.1234567}}
+	input.Gauges["g"] = map[string]gostatsd.Gauge{"": {Value: 2.7182818}}
+	timer := gostatsd.Timer{
+		Count: 3, Mean: 3.1415926, Median: 1.4142135, Min: 0.5772156, Max: 6.2831853, StdDev: 1.6180339,
+		Sum: 9.4247779, SumSquares: 12.3456789, PerSecond: 0.3333333, Values: []float64{0.5772156, 1.4142135, 6.2831853},
+	}
+	timer.Percentiles.Set("upper_90", 6.2831853)
+	input.Timers["t"] = map[string]gostatsd.Timer{"": timer}
+	input.Sets["s"] = map[string]gostatsd.Set{"": {Values: map[string]struct{}{"a": {}}}}
+
+	var wg sync.WaitGroup
+	fl.sendMetricsAsync(context.Background(), &wg, input, nil)
+	wg.Wait()
+
+	require.Len(t, full.maps, 1)
+	assert.Equal(t, input, full.maps[0])
+	assert.EqualValues(t, 0.5772156, input.Timers["t"][""].Min) // The input is not modified
+
+	require.Len(t, rounded.maps, 1)
+	mm := rounded.maps[0]
+	c := mm.Counters["c"][""]
+	g := mm.Gauges["g"][""]
+	tr := mm.Timers["t"][""]
+	// Serialized the same as a JSON backend would
+	serialized, err := json.Marshal([]float64{
+		c.PerSecond, g.Value,
+		tr.Mean, tr.Median, tr.Min, tr.Max, tr.StdDev, tr.Sum, tr.SumSquares, tr.PerSecond, tr.Percentiles[0].Float,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "[0.123,2.718,3.142,1.414,0.577,6.283,1.618,9.425,12.346,0.333,6.283]", string(serialized))
+	assert.EqualValues(t, 1, c.Value)
+	assert.Equal(t, 3, tr.Count)
+	assert.Equal(t, timer.Values, tr.Values) // Raw values are not rounded
+	assert.Equal(t, "upper_90", tr.Percentiles[0].Str)
+	assert.Equal(t, input.Sets, mm.Sets)
+}
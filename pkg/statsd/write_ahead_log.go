@@ -0,0 +1,446 @@
+package statsd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"github.com/atlassian/gostatsd"
+)
+
+const (
+	walRecordFlush     = byte(1) // A flushed MetricMap, which has not been delivered yet
+	walRecordDelivered = byte(2) // Marks the flush with the same sequence as delivered
+
+	// walHeaderSize is the size of the header of each record, the kind, sequence, payload length, and payload CRC.
+	walHeaderSize = 1 + 8 + 4 + 4
+)
+
+// writeAheadLog records the flushes sent to a single backend before they are sent, and marks them as delivered once
+// the backend has sent them, so flushes which were not delivered before a crash can be sent again on restart.  The
+// log is truncated whenever every flush has been delivered, and the oldest undelivered flushes are dropped if it
+// would grow larger than maxSize.  It is safe for concurrent use.
+type writeAheadLog struct {
+	path    string
+	maxSize int64
+
+	lock    sync.Mutex
+	file    *os.File
+	size    int64
+	nextSeq uint64
+	pending map[uint64][]byte // Encoded flushes which have not been delivered, keyed by sequence
+	dropped uint64            // Number of flushes which were dropped to bound the size of the log
+}
+
+// walEntry is an undelivered flush read from a writeAheadLog.
+type walEntry struct {
+	seq uint64
+	mm  *gostatsd.MetricMap
+}
+
+// walMetricMap is how a flushed MetricMap is encoded in the log.  T-digests are not encoded, as timers have been
+// aggregated by the time they are flushed.
+type walMetricMap struct {
+	Counters map[string]map[string]gostatsd.Counter
+	Gauges   map[string]map[string]gostatsd.Gauge
+	Timers   map[string]map[string]walTimer
+	Sets     map[string]map[string]walSet
+}
+
+type walTimer struct {
+	Count            int
+	SampledCount     float64
+	PerSecond        float64
+	Mean             float64
+	Median           float64
+	Min              float64
+	Max              float64
+	StdDev           float64
+	Sum              float64
+	SumSquares       float64
+	Values           []float64
+	Percentiles      gostatsd.Percentiles
+	Timestamp        gostatsd.Nanotime
+	Source           gostatsd.Source
+	Tags             gostatsd.Tags
+	DisabledSubtypes *gostatsd.TimerSubtypes
+	Histogram        map[gostatsd.HistogramThreshold]int
+	Buckets          map[gostatsd.HistogramThreshold]int
+}
+
+type walSet struct {
+	Values    []string
+	Timestamp gostatsd.Nanotime
+	Source    gostatsd.Source
+	Tags      gostatsd.Tags
+}
+
+// newWriteAheadLogsFromViper opens a writeAheadLog for each backend which has a file in the `write-ahead-log`
+// section, keyed by the backend name.
+func newWriteAheadLogsFromViper(v *viper.Viper, backends []gostatsd.Backend, maxSize int64) (map[string]*writeAheadLog, error) {
+	logs := map[string]*writeAheadLog{}
+	vLogs := v.Sub("write-ahead-log")
+	if vLogs == nil {
+		return logs, nil
+	}
+	if maxSize <= 0 {
+		return nil, fmt.Errorf("write-ahead log max size must be positive, got %d", maxSize)
+	}
+	paths := map[string]string{}
+	for _, backend := range backends {
+		path := vLogs.GetString(backend.Name())
+		if path == "" {
+			continue
+		}
+		if other, ok := paths[path]; ok {
+			return nil, fmt.Errorf("backends %s and %s both use the write-ahead log %s", other, backend.Name(), path)
+		}
+		paths[path] = backend.Name()
+		wal, err := openWriteAheadLog(path, maxSize)
+		if err != nil {
+			return nil, fmt.Errorf("backend %s: %v", backend.Name(), err)
+		}
+		logs[backend.Name()] = wal
+	}
+	return logs, nil
+}
+
+// openWriteAheadLog opens the log at path, creating it if it doesn't exist.  The log is rewritten with only the
+// undelivered flushes, and a partially written record at the end, from a crash while it was written, is discarded.
+func openWriteAheadLog(path string, maxSize int64) (*writeAheadLog, error) {
+	wal := &writeAheadLog{
+		path:    path,
+		maxSize: maxSize,
+		pending: map[uint64][]byte{},
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for len(b) >= walHeaderSize {
+		kind := b[0]
+		seq := binary.BigEndian.Uint64(b[1:9])
+		length := binary.BigEndian.Uint32(b[9:13])
+		if uint64(len(b)-walHeaderSize) < uint64(length) {
+			break
+		}
+		payload := b[walHeaderSize : walHeaderSize+int(length)]
+		if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(b[13:17]) {
+			break
+		}
+		switch kind {
+		case walRecordFlush:
+			wal.pending[seq] = payload
+		case walRecordDelivered:
+			delete(wal.pending, seq)
+		}
+		if seq >= wal.nextSeq {
+			wal.nextSeq = seq + 1
+		}
+		b = b[walHeaderSize+int(length):]
+	}
+	if len(b) > 0 {
+		logrus.WithField("write-ahead-log", path).Warn("Discarding partially written record at the end of the write-ahead log")
+	}
+	if err := wal.rewrite(); err != nil {
+		return nil, err
+	}
+	return wal, nil
+}
+
+// pendingSeqs returns the sequences of the undelivered flushes, oldest first.
+func (wal *writeAheadLog) pendingSeqs() []uint64 {
+	seqs := make([]uint64, 0, len(wal.pending))
+	for seq := range wal.pending {
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	return seqs
+}
+
+// rewrite replaces the log with one containing only the undelivered flushes.  It must be called with the lock held.
+func (wal *writeAheadLog) rewrite() error {
+	if wal.file != nil {
+		_ = wal.file.Close()
+		wal.file = nil
+	}
+	tmpPath := wal.path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	var size int64
+	for _, seq := range wal.pendingSeqs() {
+		n, err := writeWALRecord(w, walRecordFlush, seq, wal.pending[seq])
+		if err != nil {
+			_ = f.Close()
+			return err
+		}
+		size += int64(n)
+	}
+	if err := w.Flush(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, wal.path); err != nil {
+		return err
+	}
+	if wal.file, err = os.OpenFile(wal.path, os.O_APPEND|os.O_WRONLY, 0600); err != nil {
+		return err
+	}
+	wal.size = size
+	return nil
+}
+
+func writeWALRecord(w io.Writer, kind byte, seq uint64, payload []byte) (int, error) {
+	var header [walHeaderSize]byte
+	header[0] = kind
+	binary.BigEndian.PutUint64(header[1:9], seq)
+	binary.BigEndian.PutUint32(header[9:13], uint32(len(payload)))
+	binary.BigEndian.PutUint32(header[13:17], crc32.ChecksumIEEE(payload))
+	n, err := w.Write(header[:])
+	if err != nil {
+		return n, err
+	}
+	m, err := w.Write(payload)
+	return n + m, err
+}
+
+// append records a flush before it is sent, and returns its sequence, which is passed to delivered once it has been
+// sent.  If the log would be larger than maxSize, the oldest undelivered flushes are dropped.
+func (wal *writeAheadLog) append(mm *gostatsd.MetricMap) (uint64, error) {
+	payload, err := encodeWALMetricMap(mm)
+	if err != nil {
+		return 0, err
+	}
+	recordSize := int64(walHeaderSize + len(payload))
+	if recordSize > wal.maxSize {
+		return 0, fmt.Errorf("flush of %d bytes is larger than the write-ahead log", recordSize)
+	}
+
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+	if wal.file == nil {
+		return 0, os.ErrClosed
+	}
+	if wal.size+recordSize > wal.maxSize {
+		// Compact the log, dropping the oldest flushes until the new flush fits
+		pendingSize := int64(0)
+		for _, p := range wal.pending {
+			pendingSize += int64(walHeaderSize + len(p))
+		}
+		for _, seq := range wal.pendingSeqs() {
+			if pendingSize+recordSize <= wal.maxSize {
+				break
+			}
+			pendingSize -= int64(walHeaderSize + len(wal.pending[seq]))
+			delete(wal.pending, seq)
+			wal.dropped++
+		}
+		if err := wal.rewrite(); err != nil {
+			return 0, err
+		}
+	}
+
+	seq := wal.nextSeq
+	wal.nextSeq++
+	n, err := writeWALRecord(wal.file, walRecordFlush, seq, payload)
+	wal.size += int64(n)
+	if err != nil {
+		return 0, err
+	}
+	if err := wal.file.Sync(); err != nil {
+		return 0, err
+	}
+	wal.pending[seq] = payload
+	return seq, nil
+}
+
+// delivered marks the flush with the sequence as delivered.  The log is truncated if every flush has been delivered.
+func (wal *writeAheadLog) delivered(seq uint64) {
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+	if _, ok := wal.pending[seq]; !ok || wal.file == nil {
+		return // Dropped, or closed
+	}
+	delete(wal.pending, seq)
+	var err error
+	if len(wal.pending) == 0 {
+		if err = wal.file.Truncate(0); err == nil {
+			wal.size = 0
+		}
+	} else {
+		var n int
+		n, err = writeWALRecord(wal.file, walRecordDelivered, seq, nil)
+		wal.size += int64(n)
+	}
+	if err != nil {
+		logrus.WithError(err).WithField("write-ahead-log", wal.path).Error("Failed to mark flush as delivered")
+	}
+}
+
+// undelivered returns the flushes which have not been delivered, oldest first.  Flushes which can't be decoded are
+// dropped.
+func (wal *writeAheadLog) undelivered() []walEntry {
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+	entries := make([]walEntry, 0, len(wal.pending))
+	for _, seq := range wal.pendingSeqs() {
+		mm, err := decodeWALMetricMap(wal.pending[seq])
+		if err != nil {
+			logrus.WithError(err).WithField("write-ahead-log", wal.path).Warn("Dropping flush which can't be decoded")
+			delete(wal.pending, seq)
+			wal.dropped++
+			continue
+		}
+		entries = append(entries, walEntry{seq: seq, mm: mm})
+	}
+	return entries
+}
+
+// stats returns the number of undelivered flushes, and the number of flushes which were dropped.
+func (wal *writeAheadLog) stats() (pending int, dropped uint64) {
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+	return len(wal.pending), wal.dropped
+}
+
+// close closes the log.  Flushes delivered after it is closed are sent again when the log is next opened.
+func (wal *writeAheadLog) close() {
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+	if wal.file != nil {
+		_ = wal.file.Close()
+		wal.file = nil
+	}
+}
+
+func encodeWALMetricMap(mm *gostatsd.MetricMap) ([]byte, error) {
+	wmm := walMetricMap{
+		Counters: mm.Counters,
+		Gauges:   mm.Gauges,
+		Timers:   make(map[string]map[string]walTimer, len(mm.Timers)),
+		Sets:     make(map[string]map[string]walSet, len(mm.Sets)),
+	}
+	mm.Timers.Each(func(metricName, tagsKey string, t gostatsd.Timer) {
+		if wmm.Timers[metricName] == nil {
+			wmm.Timers[metricName] = map[string]walTimer{}
+		}
+		wmm.Timers[metricName][tagsKey] = walTimer{
+			Count:            t.Count,
+			SampledCount:     t.SampledCount,
+			PerSecond:        t.PerSecond,
+			Mean:             t.Mean,
+			Median:           t.Median,
+			Min:              t.Min,
+			Max:              t.Max,
+			StdDev:           t.StdDev,
+			Sum:              t.Sum,
+			SumSquares:       t.SumSquares,
+			Values:           t.Values,
+			Percentiles:      t.Percentiles,
+			Timestamp:        t.Timestamp,
+			Source:           t.Source,
+			Tags:             t.Tags,
+			DisabledSubtypes: t.DisabledSubtypes,
+			Histogram:        t.Histogram,
+			Buckets:          t.Buckets,
+		}
+	})
+	mm.Sets.Each(func(metricName, tagsKey string, s gostatsd.Set) {
+		if wmm.Sets[metricName] == nil {
+			wmm.Sets[metricName] = map[string]walSet{}
+		}
+		values := make([]string, 0, len(s.Values))
+		for value := range s.Values {
+			values = append(values, value)
+		}
+		wmm.Sets[metricName][tagsKey] = walSet{
+			Values:    values,
+			Timestamp: s.Timestamp,
+			Source:    s.Source,
+			Tags:      s.Tags,
+		}
+	})
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&wmm); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeWALMetricMap(b []byte) (*gostatsd.MetricMap, error) {
+	var wmm walMetricMap
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(&wmm); err != nil {
+		return nil, err
+	}
+	mm := gostatsd.NewMetricMap()
+	for metricName, tagMap := range wmm.Counters {
+		for tagsKey, c := range tagMap {
+			mm.MergeCounter(metricName, tagsKey, c)
+		}
+	}
+	for metricName, tagMap := range wmm.Gauges {
+		for tagsKey, g := range tagMap {
+			mm.MergeGauge(metricName, tagsKey, g)
+		}
+	}
+	for metricName, tagMap := range wmm.Timers {
+		for tagsKey, t := range tagMap {
+			mm.MergeTimer(metricName, tagsKey, gostatsd.Timer{
+				Count:            t.Count,
+				SampledCount:     t.SampledCount,
+				PerSecond:        t.PerSecond,
+				Mean:             t.Mean,
+				Median:           t.Median,
+				Min:              t.Min,
+				Max:              t.Max,
+				StdDev:           t.StdDev,
+				Sum:              t.Sum,
+				SumSquares:       t.SumSquares,
+				Values:           t.Values,
+				Percentiles:      t.Percentiles,
+				Timestamp:        t.Timestamp,
+				Source:           t.Source,
+				Tags:             t.Tags,
+				DisabledSubtypes: t.DisabledSubtypes,
+				Histogram:        t.Histogram,
+				Buckets:          t.Buckets,
+			})
+		}
+	}
+	for metricName, tagMap := range wmm.Sets {
+		for tagsKey, s := range tagMap {
+			values := make(map[string]struct{}, len(s.Values))
+			for _, value := range s.Values {
+				values[value] = struct{}{}
+			}
+			mm.MergeSet(metricName, tagsKey, gostatsd.Set{
+				Values:    values,
+				Timestamp: s.Timestamp,
+				Source:    s.Source,
+				Tags:      s.Tags,
+			})
+		}
+	}
+	return mm, nil
+}
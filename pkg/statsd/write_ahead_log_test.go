@@ -0,0 +1,186 @@
+package statsd
+
+import (
+	"context"
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/stats"
+)
+
+// failingBackend fails to send every flush.
+type failingBackend struct {
+	namedCapturingBackend
+}
+
+func (fb *failingBackend) SendMetricsAsync(ctx context.Context, mm *gostatsd.MetricMap, cb gostatsd.SendCallback) {
+	cb([]error{errors.New("unavailable")})
+}
+
+func newWALTestMap(value int64) *gostatsd.MetricMap {
+	mm := gostatsd.NewMetricMap()
+	mm.Counters["c"] = map[string]gostatsd.Counter{"a:b": {Value: value, PerSecond: float64(value) / 10, Tags: gostatsd.Tags{"a:b"}, Source: "host"}}
+	mm.Gauges["g"] = map[string]gostatsd.Gauge{"": {Value: math.Inf(1), Timestamp: 10}}
+	mm.Timers["t"] = map[string]gostatsd.Timer{"": {
+		Count:       2,
+		Mean:        1.5,
+		Values:      []float64{1, 2},
+		Percentiles: gostatsd.Percentiles{{Float: 2, Str: "upper_90"}},
+		Histogram:   map[gostatsd.HistogramThreshold]int{1: 1, gostatsd.HistogramThreshold(math.Inf(1)): 2},
+		Buckets:     map[gostatsd.HistogramThreshold]int{1: 1, gostatsd.HistogramThreshold(math.Inf(1)): 2},
+	}}
+	mm.Sets["s"] = map[string]gostatsd.Set{"": {Values: map[string]struct{}{"x": {}, "y": {}}}}
+	return mm
+}
+
+func TestWriteAheadLogReplaysUndelivered(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "wal")
+	wal, err := openWriteAheadLog(path, 1024*1024)
+	require.NoError(t, err)
+
+	seqs := make([]uint64, 3)
+	for i := range seqs {
+		seqs[i], err = wal.append(newWALTestMap(int64(i)))
+		require.NoError(t, err)
+	}
+	wal.delivered(seqs[1])
+
+	// Reopen the log without closing it, as if the process crashed
+	wal, err = openWriteAheadLog(path, 1024*1024)
+	require.NoError(t, err)
+	entries := wal.undelivered()
+	require.Len(t, entries, 2)
+	assert.Equal(t, seqs[0], entries[0].seq)
+	assert.Equal(t, seqs[2], entries[1].seq)
+	assert.Equal(t, newWALTestMap(0), entries[0].mm)
+	assert.Equal(t, newWALTestMap(2), entries[1].mm)
+
+	// New flushes continue the sequence
+	seq, err := wal.append(newWALTestMap(3))
+	require.NoError(t, err)
+	assert.Greater(t, seq, seqs[2])
+}
+
+func TestWriteAheadLogTruncatesWhenDelivered(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "wal")
+	wal, err := openWriteAheadLog(path, 1024*1024)
+	require.NoError(t, err)
+
+	seq1, err := wal.append(newWALTestMap(1))
+	require.NoError(t, err)
+	seq2, err := wal.append(newWALTestMap(2))
+	require.NoError(t, err)
+	wal.delivered(seq2)
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.NotZero(t, info.Size())
+
+	wal.delivered(seq1)
+	info, err = os.Stat(path)
+	require.NoError(t, err)
+	assert.Zero(t, info.Size())
+	pending, dropped := wal.stats()
+	assert.Zero(t, pending)
+	assert.Zero(t, dropped)
+}
+
+func TestWriteAheadLogDiscardsPartialRecord(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "wal")
+	wal, err := openWriteAheadLog(path, 1024*1024)
+	require.NoError(t, err)
+	_, err = wal.append(newWALTestMap(1))
+	require.NoError(t, err)
+	wal.close()
+
+	// A crash while the next flush was written leaves part of a record
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{walRecordFlush, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 1})
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	wal, err = openWriteAheadLog(path, 1024*1024)
+	require.NoError(t, err)
+	entries := wal.undelivered()
+	require.Len(t, entries, 1)
+	assert.Equal(t, newWALTestMap(1), entries[0].mm)
+}
+
+func TestWriteAheadLogDropsOldestBeyondMaxSize(t *testing.T) {
+	t.Parallel()
+	payload, err := encodeWALMetricMap(newWALTestMap(0))
+	require.NoError(t, err)
+	recordSize := int64(walHeaderSize + len(payload))
+
+	path := filepath.Join(t.TempDir(), "wal")
+	wal, err := openWriteAheadLog(path, 2*recordSize+recordSize/2)
+	require.NoError(t, err)
+	for i := int64(0); i < 4; i++ {
+		_, err = wal.append(newWALTestMap(i))
+		require.NoError(t, err)
+	}
+	pending, dropped := wal.stats()
+	assert.Equal(t, 2, pending)
+	assert.EqualValues(t, 2, dropped)
+	entries := wal.undelivered()
+	require.Len(t, entries, 2)
+	assert.EqualValues(t, 2, entries[0].mm.Counters["c"]["a:b"].Value)
+	assert.EqualValues(t, 3, entries[1].mm.Counters["c"]["a:b"].Value)
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.LessOrEqual(t, info.Size(), wal.maxSize)
+
+	wal, err = openWriteAheadLog(path, recordSize-1)
+	require.NoError(t, err)
+	_, err = wal.append(newWALTestMap(4))
+	assert.Error(t, err)
+}
+
+func TestFlusherReplaysWriteAheadLog(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "wal")
+	aggr := newFakeAggregator()
+	mm := gostatsd.NewMetricMap()
+	mm.Receive(&gostatsd.Metric{Name: "c", Type: gostatsd.COUNTER, Value: 5, Rate: 1})
+	aggr.ReceiveMap(mm)
+
+	// The backend fails to send the flush before the server crashes
+	failing := &failingBackend{namedCapturingBackend{name: "critical"}}
+	wal, err := openWriteAheadLog(path, 1024*1024)
+	require.NoError(t, err)
+	f := NewMetricFlusher(time.Second, 0, false, &singleAggregator{aggr: aggr}, []gostatsd.Backend{failing}, nil)
+	f.writeAheadLogs = map[string]*writeAheadLog{"critical": wal}
+	f.flushData(context.Background(), time.Second, stats.NewNullStatser())
+	pending, _ := wal.stats()
+	require.Equal(t, 1, pending)
+
+	// The flush is replayed when the flusher restarts
+	capturing := &namedCapturingBackend{name: "critical"}
+	wal, err = openWriteAheadLog(path, 1024*1024)
+	require.NoError(t, err)
+	f = NewMetricFlusher(time.Second, 0, false, &singleAggregator{aggr: newFakeAggregator()}, []gostatsd.Backend{capturing}, nil)
+	f.writeAheadLogs = map[string]*writeAheadLog{"critical": wal}
+	f.replayWriteAheadLogs(context.Background())
+
+	require.Len(t, capturing.maps, 1)
+	assert.EqualValues(t, 5, capturing.maps[0].Counters["c"][""].Value)
+	pending, _ = wal.stats()
+	assert.Zero(t, pending)
+
+	// Flushes which are delivered are not replayed again
+	wal, err = openWriteAheadLog(path, 1024*1024)
+	require.NoError(t, err)
+	assert.Empty(t, wal.undelivered())
+}
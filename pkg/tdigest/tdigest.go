@@ -0,0 +1,362 @@
+// Package tdigest implements a merging t-digest, a compact sketch of a distribution which can estimate quantiles
+// accurately, particularly at the tails, and which can be merged with other t-digests.  This allows percentiles to
+// be calculated over timers which were received by multiple servers.
+//
+// See "Computing Extremely Accurate Quantiles Using t-Digests" by Ted Dunning and Otmar Ertl.
+package tdigest
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// DefaultCompression is the default compression, which bounds the number of centroids to roughly 100, giving
+// quantile estimates with an error of well under 1% of the rank.
+const DefaultCompression = 100
+
+// MaxCompression is the highest compression accepted, far beyond the point where more accuracy is useful.
+const MaxCompression = 10000
+
+// maxCentroids is the most centroids accepted by FromCentroids.  A compressed TDigest has fewer than 2 centroids per
+// unit of compression.
+const maxCentroids = 2 * MaxCompression
+
+// Centroid is a group of samples, represented by their mean and the number of samples.
+type Centroid struct {
+	Mean   float64
+	Weight float64
+}
+
+// TDigest is a merging t-digest.  The number of centroids is bounded by the compression, with samples buffered until
+// they are compressed in to the centroids.  It is not safe for concurrent use.
+type TDigest struct {
+	compression float64
+	centroids   []Centroid // Compressed centroids, sorted by mean
+	unmerged    []Centroid // Buffered centroids, not yet compressed
+	count       float64    // Total weight of centroids and unmerged
+	min         float64
+	max         float64
+	sum         float64
+	sumSquares  float64
+}
+
+// New creates a new empty TDigest.  Higher compression is more accurate, at the cost of more centroids.
+func New(compression float64) *TDigest {
+	if compression <= 0 {
+		compression = DefaultCompression
+	}
+	return &TDigest{
+		compression: compression,
+		min:         math.Inf(1),
+		max:         math.Inf(-1),
+	}
+}
+
+// FromCentroids recreates a TDigest from its serialized form.  As the serialized form may come from another server,
+// it is validated, and an error is returned if the compression is out of range, there are too many centroids, or any
+// of the values are not finite.
+func FromCentroids(compression, min, max, sum, sumSquares float64, centroids []Centroid) (*TDigest, error) {
+	if !(compression > 0 && compression <= MaxCompression) {
+		return nil, fmt.Errorf("compression %v is not between 0 and %d", compression, MaxCompression)
+	}
+	if len(centroids) > maxCentroids {
+		return nil, fmt.Errorf("%d centroids is more than the maximum of %d", len(centroids), maxCentroids)
+	}
+	td := New(compression)
+	for _, c := range centroids {
+		if !isFinite(c.Mean) || !isFinite(c.Weight) || c.Weight < 0 {
+			return nil, fmt.Errorf("invalid centroid with mean %v and weight %v", c.Mean, c.Weight)
+		}
+		if c.Weight > 0 {
+			td.unmerged = append(td.unmerged, c)
+			td.count += c.Weight
+		}
+	}
+	if td.count > 0 {
+		if !isFinite(min) || !isFinite(max) || !isFinite(sum) || !isFinite(sumSquares) {
+			return nil, fmt.Errorf("invalid min %v, max %v, sum %v or sum of squares %v", min, max, sum, sumSquares)
+		}
+		td.min = min
+		td.max = max
+		td.sum = sum
+		td.sumSquares = sumSquares
+	}
+	td.compress()
+	return td, nil
+}
+
+func isFinite(f float64) bool {
+	return !math.IsNaN(f) && !math.IsInf(f, 0)
+}
+
+// Compression returns the compression the TDigest was created with.
+func (td *TDigest) Compression() float64 {
+	return td.compression
+}
+
+// Count returns the number of samples in the TDigest.
+func (td *TDigest) Count() float64 {
+	return td.count
+}
+
+// Min returns the smallest sample, or NaN if the TDigest is empty.
+func (td *TDigest) Min() float64 {
+	if td.count == 0 {
+		return math.NaN()
+	}
+	return td.min
+}
+
+// Max returns the largest sample, or NaN if the TDigest is empty.
+func (td *TDigest) Max() float64 {
+	if td.count == 0 {
+		return math.NaN()
+	}
+	return td.max
+}
+
+// Sum returns the exact sum of the samples.
+func (td *TDigest) Sum() float64 {
+	return td.sum
+}
+
+// SumSquares returns the exact sum of the squares of the samples.
+func (td *TDigest) SumSquares() float64 {
+	return td.sumSquares
+}
+
+// Add adds a sample to the TDigest.
+func (td *TDigest) Add(value float64) {
+	td.add(Centroid{Mean: value, Weight: 1})
+	td.sum += value
+	td.sumSquares += value * value
+	if value < td.min {
+		td.min = value
+	}
+	if value > td.max {
+		td.max = value
+	}
+}
+
+// Merge adds all the samples in other to the TDigest.
+func (td *TDigest) Merge(other *TDigest) {
+	if other == nil || other.count == 0 {
+		return
+	}
+	for _, c := range other.centroids {
+		td.add(c)
+	}
+	for _, c := range other.unmerged {
+		td.add(c)
+	}
+	td.sum += other.sum
+	td.sumSquares += other.sumSquares
+	if other.min < td.min {
+		td.min = other.min
+	}
+	if other.max > td.max {
+		td.max = other.max
+	}
+}
+
+// Clone returns an independent copy of the TDigest.
+func (td *TDigest) Clone() *TDigest {
+	clone := *td
+	clone.centroids = append([]Centroid(nil), td.centroids...)
+	clone.unmerged = append([]Centroid(nil), td.unmerged...)
+	return &clone
+}
+
+// Transform returns a copy of the TDigest with every sample v replaced by v*multiply+offset.  multiply must be
+// positive, so the centroids stay in the same order.
+func (td *TDigest) Transform(multiply, offset float64) *TDigest {
+	transformed := td.Clone()
+	for i := range transformed.centroids {
+		transformed.centroids[i].Mean = transformed.centroids[i].Mean*multiply + offset
+	}
+	for i := range transformed.unmerged {
+		transformed.unmerged[i].Mean = transformed.unmerged[i].Mean*multiply + offset
+	}
+	if td.count > 0 {
+		transformed.min = td.min*multiply + offset
+		transformed.max = td.max*multiply + offset
+	}
+	// The sum of (v*multiply+offset)^2 expanded in terms of the sums of v^2 and v
+	transformed.sumSquares = multiply*multiply*td.sumSquares + 2*multiply*offset*td.sum + offset*offset*td.count
+	transformed.sum = multiply*td.sum + offset*td.count
+	return transformed
+}
+
+// Centroids returns a copy of the compressed centroids, sorted by mean.
+func (td *TDigest) Centroids() []Centroid {
+	td.compress()
+	return append([]Centroid(nil), td.centroids...)
+}
+
+func (td *TDigest) add(c Centroid) {
+	td.unmerged = append(td.unmerged, c)
+	td.count += c.Weight
+	if len(td.unmerged) >= int(5*td.compression) {
+		td.compress()
+	}
+}
+
+// compress merges the buffered centroids in to the compressed centroids.  The size of each centroid is limited by
+// the k1 scale function, which allows smaller centroids near the tails, where accuracy matters most.
+func (td *TDigest) compress() {
+	if len(td.unmerged) == 0 {
+		return
+	}
+	all := append(td.centroids, td.unmerged...)
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].Mean < all[j].Mean
+	})
+
+	merged := make([]Centroid, 0, len(td.centroids)+1)
+	cur := all[0]
+	weightSoFar := 0.0
+	weightLimit := td.count * td.q(td.k(0)+1)
+	for _, c := range all[1:] {
+		if weightSoFar+cur.Weight+c.Weight <= weightLimit {
+			cur.Weight += c.Weight
+			cur.Mean += (c.Mean - cur.Mean) * c.Weight / cur.Weight
+			continue
+		}
+		merged = append(merged, cur)
+		weightSoFar += cur.Weight
+		weightLimit = td.count * td.q(td.k(weightSoFar/td.count)+1)
+		cur = c
+	}
+	td.centroids = append(merged, cur)
+	td.unmerged = td.unmerged[:0]
+}
+
+// k is the k1 scale function, mapping a quantile to a centroid index.
+func (td *TDigest) k(q float64) float64 {
+	return td.compression / (2 * math.Pi) * math.Asin(2*q-1)
+}
+
+// q is the inverse of k.
+func (td *TDigest) q(k float64) float64 {
+	if k >= td.compression/4 {
+		return 1
+	}
+	return (math.Sin(k*2*math.Pi/td.compression) + 1) / 2
+}
+
+// Quantile returns the estimated value at quantile q, which must be between 0 and 1.  It returns NaN if the TDigest
+// is empty.
+func (td *TDigest) Quantile(q float64) float64 {
+	td.compress()
+	if td.count == 0 {
+		return math.NaN()
+	}
+	if q <= 0 {
+		return td.min
+	}
+	if q >= 1 {
+		return td.max
+	}
+	cs := td.centroids
+	if len(cs) == 1 {
+		return cs[0].Mean
+	}
+
+	index := q * td.count
+	// Between the minimum and the center of the first centroid
+	if index < cs[0].Weight/2 {
+		return td.min + (cs[0].Mean-td.min)*index/(cs[0].Weight/2)
+	}
+
+	weightSoFar := cs[0].Weight / 2 // The weight up to the center of centroid i
+	for i := 0; i < len(cs)-1; i++ {
+		delta := (cs[i].Weight + cs[i+1].Weight) / 2
+		if weightSoFar+delta > index {
+			return cs[i].Mean + (cs[i+1].Mean-cs[i].Mean)*(index-weightSoFar)/delta
+		}
+		weightSoFar += delta
+	}
+
+	// Between the center of the last centroid and the maximum
+	last := cs[len(cs)-1]
+	return last.Mean + (td.max-last.Mean)*(index-weightSoFar)/(last.Weight/2)
+}
+
+// CDF returns the estimated fraction of the samples which are less than or equal to x, or NaN if the TDigest is empty.
+// It is the inverse of Quantile.
+func (td *TDigest) CDF(x float64) float64 {
+	td.compress()
+	if td.count == 0 {
+		return math.NaN()
+	}
+	if x < td.min {
+		return 0
+	}
+	if x >= td.max {
+		return 1
+	}
+	cs := td.centroids
+	if len(cs) == 1 {
+		return (x - td.min) / (td.max - td.min)
+	}
+
+	// Between the minimum and the center of the first centroid
+	if x < cs[0].Mean {
+		return cs[0].Weight / 2 * (x - td.min) / (cs[0].Mean - td.min) / td.count
+	}
+
+	weightSoFar := cs[0].Weight / 2 // The weight up to the center of centroid i
+	for i := 0; i < len(cs)-1; i++ {
+		delta := (cs[i].Weight + cs[i+1].Weight) / 2
+		if x < cs[i+1].Mean {
+			return (weightSoFar + delta*(x-cs[i].Mean)/(cs[i+1].Mean-cs[i].Mean)) / td.count
+		}
+		weightSoFar += delta
+	}
+
+	// Between the center of the last centroid and the maximum
+	last := cs[len(cs)-1]
+	return (weightSoFar + last.Weight/2*(x-last.Mean)/(td.max-last.Mean)) / td.count
+}
+
+// Lowest returns the estimated count, sum, and sum of squares of the lowest fraction q of the samples.  Centroids
+// which straddle the boundary are counted proportionally.  The sum of squares does not include the spread of values
+// within each centroid, so it is an underestimate.
+func (td *TDigest) Lowest(q float64) (count, sum, sumSquares float64) {
+	td.compress()
+	limit := q * td.count
+	for _, c := range td.centroids {
+		w := c.Weight
+		if count+w > limit {
+			w = limit - count
+		}
+		if w <= 0 {
+			break
+		}
+		count += w
+		sum += w * c.Mean
+		sumSquares += w * c.Mean * c.Mean
+	}
+	return count, sum, sumSquares
+}
+
+// Highest returns the estimated count, sum, and sum of squares of the highest fraction q of the samples.
+func (td *TDigest) Highest(q float64) (count, sum, sumSquares float64) {
+	td.compress()
+	limit := q * td.count
+	for i := len(td.centroids) - 1; i >= 0; i-- {
+		c := td.centroids[i]
+		w := c.Weight
+		if count+w > limit {
+			w = limit - count
+		}
+		if w <= 0 {
+			break
+		}
+		count += w
+		sum += w * c.Mean
+		sumSquares += w * c.Mean * c.Mean
+	}
+	return count, sum, sumSquares
+}
@@ -0,0 +1,234 @@
+package tdigest
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var quantiles = []float64{0.01, 0.1, 0.25, 0.5, 0.75, 0.9, 0.95, 0.99, 0.999}
+
+// rankError returns how far the estimate is from q, as a fraction of the samples, which must be sorted.
+func rankError(sorted []float64, q, estimate float64) float64 {
+	rank := sort.SearchFloat64s(sorted, estimate)
+	return math.Abs(float64(rank)/float64(len(sorted)) - q)
+}
+
+func sampleSets(r *rand.Rand) map[string]func() float64 {
+	return map[string]func() float64{
+		"uniform":     func() float64 { return r.Float64() * 1000 },
+		"normal":      func() float64 { return r.NormFloat64()*50 + 200 },
+		"exponential": func() float64 { return r.ExpFloat64() * 100 },
+		"lognormal":   func() float64 { return math.Exp(r.NormFloat64()*2 + 3) },
+	}
+}
+
+func TestQuantileAccuracy(t *testing.T) {
+	t.Parallel()
+	r := rand.New(rand.NewSource(1))
+	for name, sample := range sampleSets(r) {
+		td := New(DefaultCompression)
+		values := make([]float64, 100000)
+		for i := range values {
+			values[i] = sample()
+			td.Add(values[i])
+		}
+		sort.Float64s(values)
+
+		for _, q := range quantiles {
+			assert.Less(t, rankError(values, q, td.Quantile(q)), 0.005, "%s q=%v", name, q)
+		}
+		assert.LessOrEqual(t, len(td.Centroids()), 2*DefaultCompression, name)
+	}
+}
+
+func TestMergedQuantileAccuracy(t *testing.T) {
+	t.Parallel()
+	r := rand.New(rand.NewSource(2))
+	for name, sample := range sampleSets(r) {
+		// Each edge node sees a different share of the samples, and the central node merges their digests
+		var all []float64
+		central := New(DefaultCompression)
+		for node := 0; node < 20; node++ {
+			edge := New(DefaultCompression)
+			for i := 0; i < 1000*(node+1); i++ {
+				v := sample()
+				all = append(all, v)
+				edge.Add(v)
+			}
+			// Round trip through the serialized form, as if forwarded
+			forwarded, err := FromCentroids(edge.Compression(), edge.Min(), edge.Max(), edge.Sum(), edge.SumSquares(), edge.Centroids())
+			require.NoError(t, err, name)
+			central.Merge(forwarded)
+		}
+		sort.Float64s(all)
+
+		require.EqualValues(t, len(all), central.Count(), name)
+		assert.Equal(t, all[0], central.Min(), name)
+		assert.Equal(t, all[len(all)-1], central.Max(), name)
+		for _, q := range quantiles {
+			assert.Less(t, rankError(all, q, central.Quantile(q)), 0.01, "%s q=%v", name, q)
+		}
+	}
+}
+
+func TestExactStatistics(t *testing.T) {
+	t.Parallel()
+	td := New(DefaultCompression)
+	other := New(DefaultCompression)
+	for i := 1; i <= 1000; i++ {
+		td.Add(float64(i))
+		other.Add(float64(-i))
+	}
+	td.Merge(other)
+	assert.EqualValues(t, 2000, td.Count())
+	assert.EqualValues(t, 0, td.Sum())
+	assert.EqualValues(t, 2*1000*1001*2001/6, td.SumSquares())
+	assert.EqualValues(t, -1000, td.Min())
+	assert.EqualValues(t, 1000, td.Max())
+}
+
+func TestLowestHighest(t *testing.T) {
+	t.Parallel()
+	td := New(DefaultCompression)
+	for i := 1; i <= 10000; i++ {
+		td.Add(float64(i))
+	}
+
+	count, sum, _ := td.Lowest(0.9)
+	assert.InDelta(t, 9000, count, 1e-6)
+	assert.InEpsilon(t, 9000*9001/2, sum, 0.001)
+
+	count, sum, _ = td.Highest(0.1)
+	assert.InDelta(t, 1000, count, 1e-6)
+	assert.InEpsilon(t, 10000*10001/2-9000*9001/2, sum, 0.001)
+}
+
+func TestSmallAndEmpty(t *testing.T) {
+	t.Parallel()
+	td := New(DefaultCompression)
+	assert.True(t, math.IsNaN(td.Quantile(0.5)))
+	assert.True(t, math.IsNaN(td.Min()))
+
+	td.Add(5)
+	assert.EqualValues(t, 5, td.Quantile(0.5))
+	assert.EqualValues(t, 5, td.Quantile(0))
+	assert.EqualValues(t, 5, td.Quantile(1))
+
+	td.Add(7)
+	assert.EqualValues(t, 5, td.Quantile(0))
+	assert.EqualValues(t, 7, td.Quantile(1))
+	assert.EqualValues(t, 6, td.Quantile(0.5))
+}
+
+func TestClone(t *testing.T) {
+	t.Parallel()
+	td := New(DefaultCompression)
+	td.Add(1)
+	clone := td.Clone()
+	clone.Add(2)
+	assert.EqualValues(t, 1, td.Count())
+	assert.EqualValues(t, 2, clone.Count())
+}
+
+func TestTransform(t *testing.T) {
+	t.Parallel()
+	td := New(DefaultCompression)
+	expected := New(DefaultCompression)
+	for i := 1; i <= 1000; i++ {
+		td.Add(float64(i))
+		expected.Add(float64(i)*0.5 + 10)
+	}
+	transformed := td.Transform(0.5, 10)
+	assert.EqualValues(t, 1000, transformed.Count())
+	assert.EqualValues(t, 10.5, transformed.Min())
+	assert.EqualValues(t, 510, transformed.Max())
+	assert.InDelta(t, expected.Sum(), transformed.Sum(), 1e-6)
+	assert.InDelta(t, expected.SumSquares(), transformed.SumSquares(), 1e-3)
+	for _, q := range quantiles {
+		assert.InDelta(t, td.Quantile(q)*0.5+10, transformed.Quantile(q), 1e-9, "q=%v", q)
+	}
+
+	// The original is unchanged
+	assert.EqualValues(t, 1, td.Min())
+	assert.EqualValues(t, 1000*1001/2, td.Sum())
+
+	// An empty TDigest stays empty
+	assert.True(t, math.IsNaN(New(DefaultCompression).Transform(2, 1).Min()))
+}
+
+func TestFromCentroidsInvalid(t *testing.T) {
+	t.Parallel()
+	valid := []Centroid{{Mean: 1, Weight: 1}, {Mean: 2, Weight: 2}}
+	_, err := FromCentroids(DefaultCompression, 1, 2, 5, 9, valid)
+	require.NoError(t, err)
+
+	for name, compression := range map[string]float64{"zero": 0, "negative": -1, "too high": MaxCompression + 1, "nan": math.NaN()} {
+		_, err := FromCentroids(compression, 1, 2, 5, 9, valid)
+		assert.Error(t, err, name)
+	}
+	for name, c := range map[string]Centroid{
+		"nan mean":        {Mean: math.NaN(), Weight: 1},
+		"inf mean":        {Mean: math.Inf(1), Weight: 1},
+		"nan weight":      {Mean: 1, Weight: math.NaN()},
+		"inf weight":      {Mean: 1, Weight: math.Inf(1)},
+		"negative weight": {Mean: 1, Weight: -1},
+	} {
+		_, err := FromCentroids(DefaultCompression, 1, 2, 5, 9, append([]Centroid{c}, valid...))
+		assert.Error(t, err, name)
+	}
+	_, err = FromCentroids(DefaultCompression, math.NaN(), 2, 5, 9, valid)
+	assert.Error(t, err)
+	_, err = FromCentroids(DefaultCompression, 1, 2, math.Inf(-1), 9, valid)
+	assert.Error(t, err)
+	_, err = FromCentroids(DefaultCompression, 1, 2, 5, 9, make([]Centroid, maxCentroids+1))
+	assert.Error(t, err)
+}
+
+func TestCentroidsCopy(t *testing.T) {
+	t.Parallel()
+	td := New(DefaultCompression)
+	td.Add(1)
+	td.Centroids()[0].Mean = 100
+	assert.EqualValues(t, 1, td.Centroids()[0].Mean)
+	assert.EqualValues(t, 1, td.Quantile(0.5))
+}
+
+func TestCDFAccuracy(t *testing.T) {
+	t.Parallel()
+	r := rand.New(rand.NewSource(3))
+	for name, sample := range sampleSets(r) {
+		td := New(DefaultCompression)
+		values := make([]float64, 100000)
+		for i := range values {
+			values[i] = sample()
+			td.Add(values[i])
+		}
+		sort.Float64s(values)
+
+		for _, q := range quantiles {
+			x := values[int(q*float64(len(values)))]
+			assert.InDelta(t, q, td.CDF(x), 0.005, "%s q=%v", name, q)
+		}
+		assert.EqualValues(t, 0, td.CDF(values[0]-1), name)
+		assert.EqualValues(t, 1, td.CDF(values[len(values)-1]), name)
+	}
+}
+
+func TestCDFSmallAndEmpty(t *testing.T) {
+	t.Parallel()
+	td := New(DefaultCompression)
+	assert.True(t, math.IsNaN(td.CDF(0)))
+
+	td.Add(5)
+	assert.EqualValues(t, 0, td.CDF(4))
+	assert.EqualValues(t, 1, td.CDF(5))
+
+	td.Add(7)
+	assert.EqualValues(t, 0.5, td.CDF(6))
+	assert.EqualValues(t, 1, td.CDF(7))
+}
@@ -0,0 +1,63 @@
+package transport
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// StatusError is returned by a request which received a response with an unsuccessful status code.
+type StatusError struct {
+	StatusCode int
+}
+
+// Error returns the error message
+func (se *StatusError) Error() string {
+	return fmt.Sprintf("received bad status code %d", se.StatusCode)
+}
+
+// DefaultFatalStatusCodes are the status codes of responses which won't succeed if they are retried, because the
+// request or its credentials are rejected.  It's the default of the `fatal-status-codes` of the backends, some of which
+// add the other status codes their API rejects requests with.
+var DefaultFatalStatusCodes = []int{
+	http.StatusBadRequest,
+	http.StatusUnauthorized,
+	http.StatusForbidden,
+	http.StatusNotFound,
+	http.StatusRequestEntityTooLarge,
+}
+
+// RetryClassifier classifies the errors of requests as retryable or fatal.  A response with one of the fatal status
+// codes, such as an authentication or validation failure, won't succeed if it is retried.  Every other error, such
+// as another status code, a timeout, or a connection error, is retryable.
+type RetryClassifier struct {
+	fatalStatusCodes map[int]struct{}
+}
+
+// NewRetryClassifier returns a RetryClassifier which treats responses with any of fatalStatusCodes as fatal.
+func NewRetryClassifier(fatalStatusCodes []int) (*RetryClassifier, error) {
+	rc := &RetryClassifier{
+		fatalStatusCodes: make(map[int]struct{}, len(fatalStatusCodes)),
+	}
+	for _, statusCode := range fatalStatusCodes {
+		if statusCode < http.StatusContinue || statusCode > 599 {
+			return nil, fmt.Errorf("invalid fatal status code %d", statusCode)
+		}
+		rc.fatalStatusCodes[statusCode] = struct{}{}
+	}
+	return rc, nil
+}
+
+// IsFatal returns true if the request which returned err should not be retried.  A nil RetryClassifier retries every
+// error.
+func (rc *RetryClassifier) IsFatal(err error) bool {
+	if rc == nil {
+		return false
+	}
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) {
+		return false
+	}
+	_, fatal := rc.fatalStatusCodes[statusErr.StatusCode]
+	return fatal
+}
@@ -0,0 +1,46 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetryClassifier(t *testing.T) {
+	t.Parallel()
+
+	rc, err := NewRetryClassifier([]int{400, 401, 403})
+	require.NoError(t, err)
+
+	// Fatal
+	assert.True(t, rc.IsFatal(&StatusError{StatusCode: 401}))
+	assert.True(t, rc.IsFatal(fmt.Errorf("[backend] %w", &StatusError{StatusCode: 400})))
+
+	// Retryable
+	assert.False(t, rc.IsFatal(&StatusError{StatusCode: 500}))
+	assert.False(t, rc.IsFatal(&StatusError{StatusCode: 503}))
+	assert.False(t, rc.IsFatal(&StatusError{StatusCode: 429}))
+	assert.False(t, rc.IsFatal(context.DeadlineExceeded))
+	assert.False(t, rc.IsFatal(errors.New("error POSTing: connection refused")))
+}
+
+func TestRetryClassifierEmpty(t *testing.T) {
+	t.Parallel()
+
+	rc, err := NewRetryClassifier(nil)
+	require.NoError(t, err)
+	assert.False(t, rc.IsFatal(&StatusError{StatusCode: 401}))
+}
+
+func TestRetryClassifierInvalid(t *testing.T) {
+	t.Parallel()
+
+	_, err := NewRetryClassifier([]int{401, 4})
+	require.Error(t, err)
+	_, err = NewRetryClassifier([]int{600})
+	require.Error(t, err)
+}
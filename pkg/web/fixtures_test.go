@@ -7,7 +7,8 @@ import (
 )
 
 type channeledHandler struct {
-	chMaps chan *gostatsd.MetricMap
+	chMaps   chan *gostatsd.MetricMap
+	chEvents chan *gostatsd.Event // Events panic if nil
 }
 
 func (ch *channeledHandler) EstimatedTags() int {
@@ -22,7 +23,13 @@ func (ch *channeledHandler) DispatchMetricMap(ctx context.Context, mm *gostatsd.
 }
 
 func (ch *channeledHandler) DispatchEvent(ctx context.Context, e *gostatsd.Event) {
-	panic("events are not supported")
+	if ch.chEvents == nil {
+		panic("events are not supported")
+	}
+	select {
+	case <-ctx.Done():
+	case ch.chEvents <- e:
+	}
 }
 
 func (ch *channeledHandler) WaitForEvents() {
@@ -1,13 +1,17 @@
 package web
 
 import (
+	"encoding/json"
 	"net/http"
 
 	"github.com/sirupsen/logrus"
+
+	"github.com/atlassian/gostatsd"
 )
 
 type healthChecker struct {
-	logger logrus.FieldLogger
+	logger    logrus.FieldLogger
+	buildInfo gostatsd.BuildInfo
 }
 
 // healthCheck reports if the server is ready to process traffic.  It does not validate downstream dependencies.
@@ -22,3 +26,9 @@ func (hc *healthChecker) deepCheck(w http.ResponseWriter, req *http.Request) {
 	hc.logger.Info("deepCheck")
 	_, _ = w.Write([]byte("OK"))
 }
+
+// version reports the version, commit, and build date of the server as JSON, so deployed versions can be audited.
+func (hc *healthChecker) version(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(hc.buildInfo)
+}
@@ -0,0 +1,344 @@
+package web
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/atlassian/gostatsd"
+)
+
+// injectRequest is the body of a request to the inject endpoint.
+type injectRequest struct {
+	Metrics []injectMetric `json:"metrics"`
+	Events  []injectEvent  `json:"events"`
+}
+
+type injectMetric struct {
+	Name        string   `json:"name"`
+	Type        string   `json:"type"` // c, g, ms, h, or s, as in the statsd line protocol
+	Value       float64  `json:"value"`
+	StringValue string   `json:"string_value"` // Only used by sets
+	Rate        float64  `json:"rate"`
+	Tags        []string `json:"tags"`
+	Host        string   `json:"host"`
+}
+
+// injectResponse is the body of the response from the inject endpoint.  Invalid metrics are rejected, and listed in
+// Errors by their index in the request, while the rest of the request is still accepted.
+type injectResponse struct {
+	MetricsAccepted int           `json:"metrics_accepted"`
+	EventsAccepted  int           `json:"events_accepted"`
+	Errors          []injectError `json:"errors,omitempty"`
+}
+
+type injectError struct {
+	Metric int    `json:"metric"`
+	Error  string `json:"error"`
+}
+
+type injectEvent struct {
+	Title     string   `json:"title"`
+	Text      string   `json:"text"`
+	Tags      []string `json:"tags"`
+	Host      string   `json:"host"`
+	AlertType string   `json:"alert_type"`
+}
+
+// injectHandler accepts synthetic metrics and events, and dispatches them to the pipeline as if they had been
+// received from a client.  It is intended for smoke testing a deployment end to end.
+type injectHandler struct {
+	logger       logrus.FieldLogger
+	handler      gostatsd.PipelineHandler
+	token        []byte
+	sourceHeader string        // Header with the source IP, such as X-Forwarded-For when behind a proxy, if not empty
+	maxBatchSize int           // The most metrics and events in a request, if greater than 0
+	batchWindow  time.Duration // How long the metrics of requests are merged for before they are dispatched, if greater than 0
+	maxBodySize  int64         // The most bytes in the body of a request, if greater than 0
+
+	mu      sync.Mutex
+	pending *gostatsd.MetricMap // Metrics waiting for the batch window to end
+}
+
+func newInjectHandler(logger logrus.FieldLogger, handler gostatsd.PipelineHandler, token, sourceHeader string, maxBatchSize int, batchWindow time.Duration, maxBodySize int64) *injectHandler {
+	return &injectHandler{
+		logger:       logger,
+		handler:      handler,
+		token:        []byte(token),
+		sourceHeader: sourceHeader,
+		maxBatchSize: maxBatchSize,
+		batchWindow:  batchWindow,
+		maxBodySize:  maxBodySize,
+	}
+}
+
+func (ih *injectHandler) authorized(req *http.Request) bool {
+	auth := req.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), ih.token) == 1
+}
+
+func (ih *injectHandler) InjectHandler(w http.ResponseWriter, req *http.Request) {
+	if !ih.authorized(req) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if ih.maxBodySize > 0 {
+		req.Body = limitBody(req.Body, ih.maxBodySize)
+	}
+
+	msg, err := decodeInjectRequest(req.Body, ih.maxBatchSize)
+	if err != nil {
+		switch {
+		case err == errInjectBatchTooLarge:
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			_, _ = fmt.Fprintf(w, "more than the maximum of %d metrics and events", ih.maxBatchSize)
+		case err == errRequestBodyTooLarge:
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			_, _ = fmt.Fprintf(w, "request body is more than the maximum of %d bytes", ih.maxBodySize)
+		default:
+			ih.logger.WithError(err).Info("failed to decode inject request")
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		return
+	}
+
+	source := ih.source(req)
+
+	var resp injectResponse
+	now := gostatsd.Nanotime(time.Now().UnixNano())
+	mm := gostatsd.NewMetricMap()
+	for idx, im := range msg.Metrics {
+		m, err := im.toMetric(gostatsd.Source(source), now)
+		if err != nil {
+			resp.Errors = append(resp.Errors, injectError{Metric: idx, Error: err.Error()})
+			continue
+		}
+		mm.Receive(m)
+		resp.MetricsAccepted++
+	}
+
+	if !mm.IsEmpty() {
+		ih.dispatchMetricMap(req.Context(), mm)
+	}
+	for _, ie := range msg.Events {
+		ih.handler.DispatchEvent(req.Context(), ie.toEvent(gostatsd.Source(source), now))
+		resp.EventsAccepted++
+	}
+
+	ih.logger.WithFields(logrus.Fields{
+		"metrics":  resp.MetricsAccepted,
+		"events":   resp.EventsAccepted,
+		"rejected": len(resp.Errors),
+	}).Info("injected synthetic data")
+
+	// Only fail the request if nothing in it was valid, so the caller doesn't retry the metrics which were accepted
+	status := http.StatusAccepted
+	switch {
+	case len(resp.Errors) == 0:
+	case resp.MetricsAccepted == 0 && resp.EventsAccepted == 0:
+		status = http.StatusBadRequest
+	default:
+		status = http.StatusMultiStatus
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(&resp)
+}
+
+var errInjectBatchTooLarge = errors.New("too many metrics and events")
+
+// decodeInjectRequest decodes an injectRequest one metric or event at a time, so a request with more than maxBatchSize
+// metrics and events is rejected with errInjectBatchTooLarge as soon as the limit is passed, rather than after all of it
+// has been decoded.  A maxBatchSize of 0 or less is unlimited.
+func decodeInjectRequest(r io.Reader, maxBatchSize int) (injectRequest, error) {
+	var msg injectRequest
+	dec := json.NewDecoder(r)
+	if err := expectDelim(dec, '{'); err != nil {
+		return msg, err
+	}
+	count := 0
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return msg, err
+		}
+		key, _ := tok.(string)
+		var decodeItem func() error
+		switch {
+		case strings.EqualFold(key, "metrics"):
+			decodeItem = func() error {
+				var im injectMetric
+				err := dec.Decode(&im)
+				msg.Metrics = append(msg.Metrics, im)
+				return err
+			}
+		case strings.EqualFold(key, "events"):
+			decodeItem = func() error {
+				var ie injectEvent
+				err := dec.Decode(&ie)
+				msg.Events = append(msg.Events, ie)
+				return err
+			}
+		default:
+			var skip json.RawMessage
+			if err := dec.Decode(&skip); err != nil {
+				return msg, err
+			}
+			continue
+		}
+
+		tok, err = dec.Token()
+		if err != nil {
+			return msg, err
+		}
+		if tok == nil {
+			continue
+		}
+		if tok != json.Delim('[') {
+			return msg, fmt.Errorf("expected an array for %s, got %v", key, tok)
+		}
+		for dec.More() {
+			if count++; maxBatchSize > 0 && count > maxBatchSize {
+				return msg, errInjectBatchTooLarge
+			}
+			if err := decodeItem(); err != nil {
+				return msg, err
+			}
+		}
+		if err := expectDelim(dec, ']'); err != nil {
+			return msg, err
+		}
+	}
+	return msg, expectDelim(dec, '}')
+}
+
+func expectDelim(dec *json.Decoder, delim json.Delim) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok != delim {
+		return fmt.Errorf("expected %v, got %v", delim, tok)
+	}
+	return nil
+}
+
+// dispatchMetricMap dispatches the metrics of a request, or merges them with the metrics of other requests until the
+// batch window ends, so the pipeline handles fewer, larger maps.
+func (ih *injectHandler) dispatchMetricMap(ctx context.Context, mm *gostatsd.MetricMap) {
+	if ih.batchWindow <= 0 {
+		ih.handler.DispatchMetricMap(ctx, mm)
+		return
+	}
+	ih.mu.Lock()
+	defer ih.mu.Unlock()
+	if ih.pending == nil {
+		ih.pending = mm
+		time.AfterFunc(ih.batchWindow, ih.flush)
+		return
+	}
+	ih.pending.Merge(mm)
+}
+
+// flush dispatches the metrics waiting for the batch window to end.  The requests they were received in have already
+// completed, so they are dispatched without their contexts.
+func (ih *injectHandler) flush() {
+	ih.mu.Lock()
+	mm := ih.pending
+	ih.pending = nil
+	ih.mu.Unlock()
+	if mm != nil {
+		ih.handler.DispatchMetricMap(context.Background(), mm)
+	}
+}
+
+// source returns the default source of the request, which is the caller, the same as a datagram.  If there is a source
+// header, the first address in it is used instead, as the caller is a proxy.
+func (ih *injectHandler) source(req *http.Request) string {
+	if ih.sourceHeader != "" {
+		header := req.Header.Get(ih.sourceHeader)
+		if idx := strings.IndexByte(header, ','); idx >= 0 {
+			header = header[:idx]
+		}
+		if header = strings.TrimSpace(header); header != "" {
+			return header
+		}
+	}
+	source, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return source
+}
+
+func (im *injectMetric) toMetric(source gostatsd.Source, now gostatsd.Nanotime) (*gostatsd.Metric, error) {
+	if im.Name == "" {
+		return nil, fmt.Errorf("metric name is required")
+	}
+	m := &gostatsd.Metric{
+		Name:        im.Name,
+		Value:       im.Value,
+		StringValue: im.StringValue,
+		Rate:        im.Rate,
+		Tags:        im.Tags,
+		Source:      source,
+		Timestamp:   now,
+	}
+	if im.Host != "" {
+		m.Source = gostatsd.Source(im.Host)
+	}
+	if m.Rate <= 0 {
+		m.Rate = 1
+	}
+	switch im.Type {
+	case "c":
+		m.Type = gostatsd.COUNTER
+	case "g":
+		m.Type = gostatsd.GAUGE
+	case "ms", "h":
+		m.Type = gostatsd.TIMER
+	case "s":
+		m.Type = gostatsd.SET
+	default:
+		return nil, fmt.Errorf("invalid type %q for metric %s", im.Type, im.Name)
+	}
+	return m, nil
+}
+
+func (ie *injectEvent) toEvent(source gostatsd.Source, now gostatsd.Nanotime) *gostatsd.Event {
+	e := &gostatsd.Event{
+		Title:        ie.Title,
+		Text:         ie.Text,
+		DateHappened: int64(now) / int64(time.Second),
+		Tags:         ie.Tags,
+		Source:       source,
+		Priority:     gostatsd.PriNormal,
+		AlertType:    gostatsd.AlertInfo,
+	}
+	if ie.Host != "" {
+		e.Source = gostatsd.Source(ie.Host)
+	}
+	switch ie.AlertType {
+	case "warning":
+		e.AlertType = gostatsd.AlertWarning
+	case "error":
+		e.AlertType = gostatsd.AlertError
+	case "success":
+		e.AlertType = gostatsd.AlertSuccess
+	}
+	return e
+}
@@ -0,0 +1,331 @@
+package web_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ash2k/stager/wait"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/time/rate"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/cachedinstances/cloudprovider"
+	"github.com/atlassian/gostatsd/pkg/cloudproviders/fakeprovider"
+	"github.com/atlassian/gostatsd/pkg/statsd"
+	"github.com/atlassian/gostatsd/pkg/web"
+)
+
+type capturingBackend struct {
+	mu     sync.Mutex
+	maps   []*gostatsd.MetricMap
+	events []*gostatsd.Event
+}
+
+func (cb *capturingBackend) Name() string {
+	return "capturing"
+}
+
+func (cb *capturingBackend) SendMetricsAsync(ctx context.Context, mm *gostatsd.MetricMap, callback gostatsd.SendCallback) {
+	cb.mu.Lock()
+	if !mm.IsEmpty() {
+		// The aggregator resets the map after the flush, so keep a copy
+		cb.maps = append(cb.maps, gostatsd.MergeMaps([]*gostatsd.MetricMap{mm}))
+	}
+	cb.mu.Unlock()
+	callback(nil)
+}
+
+func (cb *capturingBackend) SendEvent(ctx context.Context, e *gostatsd.Event) error {
+	cb.mu.Lock()
+	cb.events = append(cb.events, e)
+	cb.mu.Unlock()
+	return nil
+}
+
+func (cb *capturingBackend) received() ([]*gostatsd.MetricMap, []*gostatsd.Event) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return cb.maps, cb.events
+}
+
+func newInjectServer(t *testing.T, handler gostatsd.PipelineHandler, sourceHeader string) *httptest.Server {
+	return newBatchingInjectServer(t, handler, sourceHeader, 0, 0, 0)
+}
+
+func newBatchingInjectServer(t *testing.T, handler gostatsd.PipelineHandler, sourceHeader string, maxBatchSize int, batchWindow time.Duration, maxBodySize int64) *httptest.Server {
+	hs, err := web.NewHttpServer(
+		logrus.StandardLogger(),
+		handler,
+		"TestInject",
+		"",
+		false,
+		false,
+		false,
+		false,
+		web.HttpServerOptions{
+			EnableInject:       true,
+			InjectToken:        "secret",
+			InjectSourceHeader: sourceHeader,
+			InjectMaxBatchSize: maxBatchSize,
+			InjectBatchWindow:  batchWindow,
+			InjectMaxBodySize:  maxBodySize,
+		},
+	)
+	require.NoError(t, err)
+	return httptest.NewServer(hs.Router)
+}
+
+func inject(t *testing.T, url, token, body string) int {
+	status, _ := injectWithResponse(t, url, token, body)
+	return status
+}
+
+func injectWithResponse(t *testing.T, url, token, body string) (int, []byte) {
+	req, err := http.NewRequest("POST", url+"/admin/inject", bytes.NewBufferString(body))
+	require.NoError(t, err)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	respBody, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	return resp.StatusCode, respBody
+}
+
+func TestInjectRequiresToken(t *testing.T) {
+	t.Parallel()
+	_, err := web.NewHttpServer(logrus.StandardLogger(), nil, "TestInjectRequiresToken", "", false, false, false, false, web.HttpServerOptions{EnableInject: true})
+	require.Error(t, err)
+}
+
+func TestInjectUnauthorized(t *testing.T) {
+	t.Parallel()
+	c := newInjectServer(t, nil, "")
+	defer c.Close()
+
+	assert.Equal(t, http.StatusUnauthorized, inject(t, c.URL, "", `{}`))
+	assert.Equal(t, http.StatusUnauthorized, inject(t, c.URL, "wrong", `{}`))
+}
+
+func TestInjectInvalid(t *testing.T) {
+	t.Parallel()
+	c := newInjectServer(t, nil, "")
+	defer c.Close()
+
+	assert.Equal(t, http.StatusBadRequest, inject(t, c.URL, "secret", `not json`))
+	assert.Equal(t, http.StatusBadRequest, inject(t, c.URL, "secret", `{"metrics":[{"name":"x","type":"bad"}]}`))
+	assert.Equal(t, http.StatusBadRequest, inject(t, c.URL, "secret", `{"metrics":[{"type":"c"}]}`))
+}
+
+func TestInjectFlowsToBackend(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	backend := &capturingBackend{}
+	backends := []gostatsd.Backend{backend}
+	bh := statsd.NewBackendHandler(backends, 1, 1, 10, statsd.AggregatorFactoryFunc(func() statsd.Aggregator {
+		return statsd.NewMetricAggregator(nil, 0, 0, 0, 0, gostatsd.TimerSubtypes{}, math.MaxUint32)
+	}))
+	flusher := statsd.NewMetricFlusher(10*time.Millisecond, 0, false, bh, backends, nil)
+
+	var wg wait.Group
+	defer wg.Wait()
+	defer cancel()
+	wg.StartWithContext(ctx, bh.Run)
+	wg.StartWithContext(ctx, flusher.Run)
+
+	c := newInjectServer(t, bh, "")
+	defer c.Close()
+
+	status := inject(t, c.URL, "secret", `{
+		"metrics": [{"name": "smoke.test", "type": "c", "value": 3, "tags": ["check:deploy"], "host": "smoker"}],
+		"events": [{"title": "smoke test", "text": "injected", "alert_type": "success"}]
+	}`)
+	require.Equal(t, http.StatusAccepted, status)
+	bh.WaitForEvents()
+
+	var maps []*gostatsd.MetricMap
+	var events []*gostatsd.Event
+	for ctx.Err() == nil {
+		if maps, events = backend.received(); len(maps) > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.NotEmpty(t, maps)
+	counters := maps[0].Counters["smoke.test"]
+	require.Len(t, counters, 1)
+	for _, counter := range counters {
+		assert.EqualValues(t, 3, counter.Value)
+		assert.Equal(t, gostatsd.Tags{"check:deploy"}, counter.Tags)
+		assert.Equal(t, gostatsd.Source("smoker"), counter.Source)
+	}
+
+	require.Len(t, events, 1)
+	assert.Equal(t, "smoke test", events[0].Title)
+	assert.Equal(t, gostatsd.AlertSuccess, events[0].AlertType)
+	assert.Equal(t, gostatsd.Source("127.0.0.1"), events[0].Source)
+}
+
+func TestInjectSourceHeader(t *testing.T) {
+	t.Parallel()
+	for header, expected := range map[string]gostatsd.Source{
+		"":                    "i-127.0.0.1", // The caller
+		"10.0.0.1":            "i-10.0.0.1",
+		" 10.0.0.2, 10.0.0.3": "i-10.0.0.2", // The original client, not the chain of proxies
+	} {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		ch := &channeledHandler{chMaps: make(chan *gostatsd.MetricMap, 1)}
+		ci := cloudprovider.NewCachedCloudProvider(logrus.StandardLogger(), rate.NewLimiter(100, 120), &fakeprovider.IP{}, gostatsd.CacheOptions{
+			CacheRefreshPeriod:        gostatsd.DefaultCacheRefreshPeriod,
+			CacheEvictAfterIdlePeriod: gostatsd.DefaultCacheEvictAfterIdlePeriod,
+			CacheTTL:                  gostatsd.DefaultCacheTTL,
+			CacheNegativeTTL:          gostatsd.DefaultCacheNegativeTTL,
+		})
+		cloudHandler := statsd.NewCloudHandler(ci, ch, gostatsd.DefaultMaxConcurrentEvents)
+		var wg wait.Group
+		wg.StartWithContext(ctx, ci.Run)
+		wg.StartWithContext(ctx, cloudHandler.Run)
+
+		c := newInjectServer(t, cloudHandler, "X-Forwarded-For")
+		req, err := http.NewRequest("POST", c.URL+"/admin/inject", bytes.NewBufferString(`{"metrics": [{"name": "m", "type": "c", "value": 1}]}`))
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer secret")
+		if header != "" {
+			req.Header.Set("X-Forwarded-For", header)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		require.Equal(t, http.StatusAccepted, resp.StatusCode)
+
+		select {
+		case mm := <-ch.chMaps:
+			for _, counter := range mm.Counters["m"] {
+				assert.Equal(t, expected, counter.Source, header)
+			}
+		case <-ctx.Done():
+			t.Errorf("timed out waiting for metrics, header %q", header)
+		}
+		c.Close()
+		cancel()
+		wg.Wait()
+	}
+}
+
+func TestInjectPartialSuccess(t *testing.T) {
+	t.Parallel()
+	ch := &channeledHandler{chMaps: make(chan *gostatsd.MetricMap, 1)}
+	c := newBatchingInjectServer(t, ch, "", 1000, 0, 0)
+	defer c.Close()
+
+	metrics := make([]string, 0, 1000)
+	for i := 0; i < 1000; i++ {
+		metricType := "c"
+		if i%100 == 7 {
+			metricType = "bad"
+		}
+		metrics = append(metrics, fmt.Sprintf(`{"name": "batch.%d", "type": "%s", "value": 1}`, i, metricType))
+	}
+	status, body := injectWithResponse(t, c.URL, "secret", `{"metrics": [`+strings.Join(metrics, ",")+`]}`)
+	require.Equal(t, http.StatusMultiStatus, status)
+
+	var resp struct {
+		MetricsAccepted int `json:"metrics_accepted"`
+		Errors          []struct {
+			Metric int    `json:"metric"`
+			Error  string `json:"error"`
+		} `json:"errors"`
+	}
+	require.NoError(t, json.Unmarshal(body, &resp))
+	assert.Equal(t, 990, resp.MetricsAccepted)
+	require.Len(t, resp.Errors, 10)
+	assert.Equal(t, 7, resp.Errors[0].Metric)
+	assert.Equal(t, 907, resp.Errors[9].Metric)
+	assert.Contains(t, resp.Errors[0].Error, "batch.7")
+
+	// The valid metrics are dispatched together
+	mm := <-ch.chMaps
+	assert.Len(t, mm.Counters, 990)
+	assert.NotContains(t, mm.Counters, "batch.7")
+
+	// A batch over the maximum is rejected whole
+	metrics = append(metrics, `{"name": "batch.1000", "type": "c", "value": 1}`)
+	status = inject(t, c.URL, "secret", `{"metrics": [`+strings.Join(metrics, ",")+`]}`)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, status)
+}
+
+func TestInjectMaxBatchSize(t *testing.T) {
+	t.Parallel()
+	ch := &channeledHandler{chMaps: make(chan *gostatsd.MetricMap, 1)}
+	c := newBatchingInjectServer(t, ch, "", 2, 0, 0)
+	defer c.Close()
+
+	// Unknown fields and null arrays are allowed as before
+	assert.Equal(t, http.StatusAccepted, inject(t, c.URL, "secret", `{"extra": {"a": [1]}, "events": null, "metrics": [{"name": "ok", "type": "c", "value": 1}]}`))
+	<-ch.chMaps
+
+	// Metrics and events both count towards the limit
+	status, body := injectWithResponse(t, c.URL, "secret", `{"metrics": [{"name": "a", "type": "c", "value": 1}], "events": [{"title": "b"}, {"title": "c"}]}`)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, status)
+	assert.Contains(t, string(body), "maximum of 2")
+
+	// Decoding stops at the limit, so the rest of the request is never read
+	status = inject(t, c.URL, "secret", `{"metrics": [{"name": "a", "type": "c", "value": 1}, {"name": "b", "type": "c", "value": 1}, not json`)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, status)
+
+	assert.Equal(t, http.StatusBadRequest, inject(t, c.URL, "secret", `{"metrics": {}}`))
+	assert.Equal(t, http.StatusBadRequest, inject(t, c.URL, "secret", `[]`))
+}
+
+func TestInjectMaxBodySize(t *testing.T) {
+	t.Parallel()
+	ch := &channeledHandler{chMaps: make(chan *gostatsd.MetricMap, 1)}
+	c := newBatchingInjectServer(t, ch, "", 0, 0, 100)
+	defer c.Close()
+
+	assert.Equal(t, http.StatusAccepted, inject(t, c.URL, "secret", `{"metrics": [{"name": "small", "type": "c", "value": 1}]}`))
+	<-ch.chMaps
+
+	status, body := injectWithResponse(t, c.URL, "secret", `{"metrics": [{"name": "`+strings.Repeat("x", 100)+`", "type": "c", "value": 1}]}`)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, status)
+	assert.Contains(t, string(body), "100 bytes")
+}
+
+func TestInjectBatchWindow(t *testing.T) {
+	t.Parallel()
+	ch := &channeledHandler{chMaps: make(chan *gostatsd.MetricMap, 2)}
+	c := newBatchingInjectServer(t, ch, "", 0, 100*time.Millisecond, 0)
+	defer c.Close()
+
+	require.Equal(t, http.StatusAccepted, inject(t, c.URL, "secret", `{"metrics": [{"name": "a", "type": "c", "value": 1, "host": "h"}]}`))
+	require.Equal(t, http.StatusAccepted, inject(t, c.URL, "secret", `{"metrics": [{"name": "a", "type": "c", "value": 2, "host": "h"}, {"name": "b", "type": "g", "value": 3}]}`))
+
+	// Both requests are merged in to one map
+	select {
+	case mm := <-ch.chMaps:
+		require.Len(t, mm.Counters["a"], 1)
+		for _, counter := range mm.Counters["a"] {
+			assert.EqualValues(t, 3, counter.Value)
+		}
+		assert.Contains(t, mm.Gauges, "b")
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for metrics")
+	}
+	assert.Empty(t, ch.chMaps)
+}
@@ -2,8 +2,13 @@ package web
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"io/ioutil"
+	"math"
 	"net/http"
+	"sort"
+	"strings"
 	"sync/atomic"
 	"time"
 
@@ -13,6 +18,7 @@ import (
 	"github.com/atlassian/gostatsd"
 	"github.com/atlassian/gostatsd/pb"
 	"github.com/atlassian/gostatsd/pkg/stats"
+	"github.com/atlassian/gostatsd/pkg/tdigest"
 )
 
 type rawHttpHandlerV2 struct {
@@ -22,19 +28,36 @@ type rawHttpHandlerV2 struct {
 	requestFailureEncoding   uint64 // atomic
 	requestFailureUnmarshal  uint64 // atomic
 	metricsProcessed         uint64 // atomic
+	nanValuesDropped         uint64 // atomic
 	eventsProcessed          uint64 // atomic
 
-	logger     logrus.FieldLogger
-	handler    gostatsd.PipelineHandler
-	serverName string
+	logger      logrus.FieldLogger
+	handler     gostatsd.PipelineHandler
+	serverName  string
+	headerTags  []headerTag // Tags added to everything in a request from its headers, sorted by header
+	maxBodySize int64       // The most bytes in the body of a request before it is decompressed, 0 or less is unlimited
 }
 
-func newRawHttpHandlerV2(logger logrus.FieldLogger, serverName string, handler gostatsd.PipelineHandler) *rawHttpHandlerV2 {
-	return &rawHttpHandlerV2{
-		logger:     logger,
-		handler:    handler,
-		serverName: serverName,
+// headerTag maps the value of a request header to a tag.
+type headerTag struct {
+	header string // Canonical header name
+	key    string // Tag key
+}
+
+func newRawHttpHandlerV2(logger logrus.FieldLogger, serverName string, handler gostatsd.PipelineHandler, headerTags map[string]string, maxBodySize int64) *rawHttpHandlerV2 {
+	rhh := &rawHttpHandlerV2{
+		logger:      logger,
+		handler:     handler,
+		serverName:  serverName,
+		maxBodySize: maxBodySize,
+	}
+	for header, key := range headerTags {
+		rhh.headerTags = append(rhh.headerTags, headerTag{header: http.CanonicalHeaderKey(header), key: key})
 	}
+	sort.Slice(rhh.headerTags, func(i, j int) bool {
+		return rhh.headerTags[i].header < rhh.headerTags[j].header
+	})
+	return rhh
 }
 
 func (rhh *rawHttpHandlerV2) RunMetricsContext(ctx context.Context) {
@@ -61,6 +84,7 @@ func (rhh *rawHttpHandlerV2) emitMetrics(statser stats.Statser) {
 	requestFailureUnmarshal := atomic.SwapUint64(&rhh.requestFailureUnmarshal, 0)
 	metricsProcessed := atomic.SwapUint64(&rhh.metricsProcessed, 0)
 	eventsProcessed := atomic.SwapUint64(&rhh.eventsProcessed, 0)
+	nanValuesDropped := atomic.SwapUint64(&rhh.nanValuesDropped, 0)
 
 	statser.Count("http.incoming", float64(requestSuccess), []string{"result:success"})
 	statser.Count("http.incoming", float64(requestFailureRead), []string{"result:failure", "failure:read"})
@@ -69,13 +93,20 @@ func (rhh *rawHttpHandlerV2) emitMetrics(statser stats.Statser) {
 	statser.Count("http.incoming", float64(requestFailureUnmarshal), []string{"result:failure", "failure:unmarshal"})
 	statser.Count("http.incoming.metrics", float64(metricsProcessed), nil)
 	statser.Count("http.incoming.events", float64(eventsProcessed), nil)
+	statser.Count("http.incoming.nan_values_dropped", float64(nanValuesDropped), nil)
 }
 
 func (rhh *rawHttpHandlerV2) readBody(req *http.Request) ([]byte, int) {
+	if rhh.maxBodySize > 0 {
+		req.Body = limitBody(req.Body, rhh.maxBodySize)
+	}
 	b, err := ioutil.ReadAll(req.Body)
 	if err != nil {
 		atomic.AddUint64(&rhh.requestFailureRead, 1)
 		rhh.logger.WithError(err).Info("failed reading body")
+		if err == errRequestBodyTooLarge {
+			return nil, http.StatusRequestEntityTooLarge
+		}
 		return nil, http.StatusInternalServerError
 	}
 	req.Body.Close()
@@ -120,7 +151,19 @@ func (rhh *rawHttpHandlerV2) MetricHandler(w http.ResponseWriter, req *http.Requ
 		return
 	}
 
-	mm := translateFromProtobufV2(&msg)
+	mm, err := translateFromProtobufV2(&msg)
+	if err != nil {
+		atomic.AddUint64(&rhh.requestFailureUnmarshal, 1)
+		rhh.logger.WithError(err).Error("invalid metrics")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if dropped := mm.DropNaN(); dropped > 0 {
+		atomic.AddUint64(&rhh.nanValuesDropped, uint64(dropped))
+	}
+	if tags := rhh.requestTags(req); len(tags) > 0 {
+		mm = withTags(mm, tags)
+	}
 	rhh.handler.DispatchMetricMap(req.Context(), mm)
 
 	atomic.AddUint64(&rhh.requestSuccess, 1)
@@ -153,6 +196,9 @@ func (rhh *rawHttpHandlerV2) EventHandler(w http.ResponseWriter, req *http.Reque
 		SourceTypeName: msg.SourceTypeName,
 		Tags:           msg.Tags,
 	}
+	if tags := rhh.requestTags(req); len(tags) > 0 {
+		event.Tags = replaceTags(event.Tags, tags)
+	}
 
 	switch msg.Priority {
 	case pb.EventV2_Normal:
@@ -183,7 +229,66 @@ func (rhh *rawHttpHandlerV2) EventHandler(w http.ResponseWriter, req *http.Reque
 	w.WriteHeader(http.StatusAccepted)
 }
 
-func translateFromProtobufV2(pbMetricMap *pb.RawMessageV2) *gostatsd.MetricMap {
+// requestTags returns the tags of the mapped headers of req, skipping any which are not present.
+func (rhh *rawHttpHandlerV2) requestTags(req *http.Request) gostatsd.Tags {
+	var tags gostatsd.Tags
+	for _, ht := range rhh.headerTags {
+		if value := strings.TrimSpace(req.Header.Get(ht.header)); value != "" {
+			tags = append(tags, ht.key+":"+value)
+		}
+	}
+	return tags
+}
+
+// replaceTags returns tags with every tag which has the key of one of the additional tags removed, followed by the
+// additional tags, so a client can't set the value of a tag which comes from a header.
+func replaceTags(tags, additional gostatsd.Tags) gostatsd.Tags {
+	result := make(gostatsd.Tags, 0, len(tags)+len(additional))
+	for _, tag := range tags {
+		key := tag
+		if idx := strings.IndexByte(tag, ':'); idx >= 0 {
+			key = tag[:idx]
+		}
+		replaced := false
+		for _, a := range additional {
+			if strings.HasPrefix(a, key+":") {
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			result = append(result, tag)
+		}
+	}
+	return append(result, additional...)
+}
+
+// withTags returns a MetricMap with the tags of every metric in mm replaced by the additional tags, merging the metrics
+// which end up with the same tags.
+func withTags(mm *gostatsd.MetricMap, additional gostatsd.Tags) *gostatsd.MetricMap {
+	mmNew := gostatsd.NewMetricMap()
+	mm.Counters.Each(func(metricName, _ string, c gostatsd.Counter) {
+		c.Tags = replaceTags(c.Tags, additional)
+		mmNew.MergeCounter(metricName, gostatsd.FormatTagsKey(c.Source, c.Tags), c)
+	})
+	mm.Gauges.Each(func(metricName, _ string, g gostatsd.Gauge) {
+		g.Tags = replaceTags(g.Tags, additional)
+		mmNew.MergeGauge(metricName, gostatsd.FormatTagsKey(g.Source, g.Tags), g)
+	})
+	mm.Timers.Each(func(metricName, _ string, t gostatsd.Timer) {
+		t.Tags = replaceTags(t.Tags, additional)
+		mmNew.MergeTimer(metricName, gostatsd.FormatTagsKey(t.Source, t.Tags), t)
+	})
+	mm.Sets.Each(func(metricName, _ string, s gostatsd.Set) {
+		s.Tags = replaceTags(s.Tags, additional)
+		mmNew.MergeSet(metricName, gostatsd.FormatTagsKey(s.Source, s.Tags), s)
+	})
+	return mmNew
+}
+
+// translateFromProtobufV2 converts a message from another server to a MetricMap, or returns an error if the message
+// is invalid.
+func translateFromProtobufV2(pbMetricMap *pb.RawMessageV2) (*gostatsd.MetricMap, error) {
 	now := gostatsd.Nanotime(time.Now().UnixNano())
 	mm := gostatsd.NewMetricMap()
 
@@ -214,8 +319,18 @@ func translateFromProtobufV2(pbMetricMap *pb.RawMessageV2) *gostatsd.MetricMap {
 	for metricName, tagMap := range pbMetricMap.Timers {
 		mm.Timers[metricName] = map[string]gostatsd.Timer{}
 		for tagsKey, timer := range tagMap.TagMap {
+			digest, err := translateDigestFromProtobufV2(timer.Digest)
+			if err != nil {
+				return nil, fmt.Errorf("timer %s: %v", metricName, err)
+			}
+			buckets, err := translateBucketsFromProtobufV2(timer.BucketThresholds, timer.BucketCounts)
+			if err != nil {
+				return nil, fmt.Errorf("timer %s: %v", metricName, err)
+			}
 			mm.Timers[metricName][tagsKey] = gostatsd.Timer{
 				Values:       timer.Values,
+				Digest:       digest,
+				Buckets:      buckets,
 				Timestamp:    now,
 				Tags:         timer.Tags,
 				Source:       gostatsd.Source(timer.Hostname),
@@ -239,5 +354,39 @@ func translateFromProtobufV2(pbMetricMap *pb.RawMessageV2) *gostatsd.MetricMap {
 		}
 	}
 
-	return mm
+	return mm, nil
+}
+
+func translateDigestFromProtobufV2(pbDigest *pb.TDigestV2) (*tdigest.TDigest, error) {
+	if pbDigest == nil {
+		return nil, nil
+	}
+	if len(pbDigest.Means) != len(pbDigest.Weights) {
+		return nil, fmt.Errorf("digest has %d means and %d weights", len(pbDigest.Means), len(pbDigest.Weights))
+	}
+	centroids := make([]tdigest.Centroid, len(pbDigest.Means))
+	for i := range pbDigest.Means {
+		centroids[i] = tdigest.Centroid{Mean: pbDigest.Means[i], Weight: pbDigest.Weights[i]}
+	}
+	return tdigest.FromCentroids(pbDigest.Compression, pbDigest.Min, pbDigest.Max, pbDigest.Sum, pbDigest.SumSquares, centroids)
+}
+
+func translateBucketsFromProtobufV2(thresholds []float64, counts []int64) (map[gostatsd.HistogramThreshold]int, error) {
+	if len(thresholds) == 0 && len(counts) == 0 {
+		return nil, nil
+	}
+	if len(thresholds) != len(counts) {
+		return nil, fmt.Errorf("histogram has %d thresholds and %d counts", len(thresholds), len(counts))
+	}
+	buckets := make(map[gostatsd.HistogramThreshold]int, len(thresholds))
+	for i, threshold := range thresholds {
+		if math.IsNaN(threshold) || counts[i] < 0 {
+			return nil, fmt.Errorf("histogram has an invalid bucket %v=%d", threshold, counts[i])
+		}
+		buckets[gostatsd.HistogramThreshold(threshold)] = int(counts[i])
+	}
+	if _, ok := buckets[gostatsd.HistogramThreshold(math.Inf(1))]; !ok {
+		return nil, errors.New("histogram has no +Inf bucket")
+	}
+	return buckets, nil
 }
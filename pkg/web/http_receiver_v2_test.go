@@ -1,7 +1,10 @@
 package web_test
 
 import (
+	"bytes"
 	"context"
+	"math"
+	"net/http"
 	"net/http/httptest"
 	"sort"
 	"testing"
@@ -13,9 +16,11 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/tilinna/clock"
+	"google.golang.org/protobuf/proto"
 
 	"github.com/atlassian/gostatsd"
 	"github.com/atlassian/gostatsd/internal/fixtures"
+	"github.com/atlassian/gostatsd/pb"
 	"github.com/atlassian/gostatsd/pkg/statsd"
 	"github.com/atlassian/gostatsd/pkg/transport"
 	"github.com/atlassian/gostatsd/pkg/web"
@@ -41,6 +46,7 @@ func TestForwardingEndToEndV2(t *testing.T) {
 		false,
 		true,
 		false,
+		web.HttpServerOptions{},
 	)
 	require.NoError(t, err)
 
@@ -56,7 +62,9 @@ func TestForwardingEndToEndV2(t *testing.T) {
 		10,
 		false,
 		10*time.Second,
+		nil,
 		10*time.Millisecond,
+		0,
 		nil,
 		nil,
 		p,
@@ -174,3 +182,247 @@ func TestForwardingEndToEndV2(t *testing.T) {
 		// Test on next loop iteration
 	}
 }
+
+func TestForwardingDigestsEndToEndV2(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	mockClock := clock.NewMock(time.Unix(0, 0))
+	ctx = clock.Context(ctx, mockClock)
+
+	ch := &channeledHandler{
+		chMaps: make(chan *gostatsd.MetricMap),
+	}
+
+	hs, err := web.NewHttpServer(
+		logrus.StandardLogger(),
+		ch,
+		"TestForwardingDigestsEndToEndV2",
+		"",
+		false,
+		false,
+		true,
+		false,
+		web.HttpServerOptions{},
+	)
+	require.NoError(t, err)
+
+	c := httptest.NewServer(hs.Router)
+	defer c.Close()
+
+	p := transport.NewTransportPool(logrus.New(), viper.New())
+	hfh, err := statsd.NewHttpForwarderHandlerV2(
+		logrus.StandardLogger(),
+		"default",
+		c.URL,
+		1,
+		10,
+		false,
+		10*time.Second,
+		nil,
+		10*time.Millisecond,
+		50, // timer digest compression
+		nil,
+		nil,
+		p,
+	)
+	require.NoError(t, err)
+
+	var wg wait.Group
+	wg.StartWithContext(ctx, hfh.Run)
+	defer wg.Wait()
+	defer cancel() // cancel must occur before waiting for the wg
+
+	mm := gostatsd.NewMetricMap()
+	for i := 1; i <= 1000; i++ {
+		mm.Receive(&gostatsd.Metric{Name: "timer", Type: gostatsd.TIMER, Value: float64(i), Rate: 1})
+	}
+	buckets := map[gostatsd.HistogramThreshold]int{0.1: 5, 0.5: 12, gostatsd.HistogramThreshold(math.Inf(1)): 20}
+	mm.Receive(&gostatsd.Metric{Name: "histogram", Type: gostatsd.TIMER, Buckets: buckets, Rate: 1})
+	hfh.DispatchMetricMap(ctx, mm)
+
+	fixtures.NextStep(ctx, mockClock)
+	mockClock.Add(1 * time.Second) // Make sure everything gets scheduled
+
+	var received *gostatsd.MetricMap
+	select {
+	case <-ctx.Done():
+		t.FailNow()
+	case received = <-ch.chMaps:
+	}
+
+	timer := received.Timers["timer"][""]
+	require.NotNil(t, timer.Digest)
+	assert.Empty(t, timer.Values)
+	assert.EqualValues(t, 1000, timer.SampledCount)
+	assert.EqualValues(t, 1000, timer.Digest.Count())
+	assert.EqualValues(t, 1, timer.Digest.Min())
+	assert.EqualValues(t, 1000, timer.Digest.Max())
+	assert.EqualValues(t, 1000*1001/2, timer.Digest.Sum())
+	assert.InDelta(t, 900, timer.Digest.Quantile(0.9), 10)
+
+	// Pre-aggregated histograms keep their buckets
+	assert.Equal(t, buckets, received.Timers["histogram"][""].Buckets)
+}
+
+func TestIngestionHeaderTags(t *testing.T) {
+	t.Parallel()
+	ch := &channeledHandler{
+		chMaps:   make(chan *gostatsd.MetricMap, 1),
+		chEvents: make(chan *gostatsd.Event, 1),
+	}
+	hs, err := web.NewHttpServer(
+		logrus.StandardLogger(),
+		ch,
+		"TestIngestionHeaderTags",
+		"",
+		false,
+		false,
+		true,
+		false,
+		web.HttpServerOptions{
+			IngestHeaderTags: map[string]string{"x-tenant-id": "tenant", "X-Region": "region"},
+		},
+	)
+	require.NoError(t, err)
+	c := httptest.NewServer(hs.Router)
+	defer c.Close()
+
+	post := func(path string, msg proto.Message) {
+		body, err := proto.Marshal(msg)
+		require.NoError(t, err)
+		req, err := http.NewRequest(http.MethodPost, c.URL+path, bytes.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set("X-Tenant-ID", "acme")
+		req.Header.Set("X-Unmapped", "ignored")
+		resp, err := c.Client().Do(req)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		require.Equal(t, http.StatusAccepted, resp.StatusCode)
+	}
+
+	// The tenant tag claimed by the client is replaced, so both counters end up as the same series
+	post("/v2/raw", &pb.RawMessageV2{
+		Counters: map[string]*pb.CounterTagV2{
+			"requests": {TagMap: map[string]*pb.RawCounterV2{
+				"env:prod":               {Tags: []string{"env:prod"}, Value: 5},
+				"env:prod,tenant:globex": {Tags: []string{"env:prod", "tenant:globex"}, Value: 3},
+			}},
+		},
+		Gauges: map[string]*pb.GaugeTagV2{
+			"queue": {TagMap: map[string]*pb.RawGaugeV2{
+				"": {Value: 2, Hostname: "web-1"},
+			}},
+		},
+	})
+	mm := <-ch.chMaps
+	require.Len(t, mm.Counters["requests"], 1)
+	counter := mm.Counters["requests"]["env:prod,tenant:acme"]
+	assert.EqualValues(t, 8, counter.Value)
+	assert.Equal(t, gostatsd.Tags{"env:prod", "tenant:acme"}, counter.Tags)
+	gauge, ok := mm.Gauges["queue"]["tenant:acme,"+gostatsd.StatsdSourceID+":web-1"]
+	require.True(t, ok)
+	assert.Equal(t, gostatsd.Tags{"tenant:acme"}, gauge.Tags)
+
+	post("/v2/event", &pb.EventV2{Title: "deploy", Tags: []string{"tenant:globex", "service:api"}})
+	e := <-ch.chEvents
+	assert.Equal(t, gostatsd.Tags{"service:api", "tenant:acme"}, e.Tags)
+}
+
+func TestIngestionRejectsInvalidDigests(t *testing.T) {
+	t.Parallel()
+	ch := &channeledHandler{chMaps: make(chan *gostatsd.MetricMap, 1)}
+	hs, err := web.NewHttpServer(
+		logrus.StandardLogger(),
+		ch,
+		"TestIngestionRejectsInvalidDigests",
+		"",
+		false,
+		false,
+		true,
+		false,
+		web.HttpServerOptions{},
+	)
+	require.NoError(t, err)
+	c := httptest.NewServer(hs.Router)
+	defer c.Close()
+
+	post := func(digest *pb.TDigestV2) int {
+		body, err := proto.Marshal(&pb.RawMessageV2{
+			Timers: map[string]*pb.TimerTagV2{
+				"latency": {TagMap: map[string]*pb.RawTimerV2{"": {Digest: digest}}},
+			},
+		})
+		require.NoError(t, err)
+		resp, err := c.Client().Post(c.URL+"/v2/raw", "application/x-protobuf", bytes.NewReader(body))
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		return resp.StatusCode
+	}
+
+	require.Equal(t, http.StatusAccepted, post(&pb.TDigestV2{Compression: 100, Min: 1, Max: 1, Sum: 1, SumSquares: 1, Means: []float64{1}, Weights: []float64{1}}))
+	<-ch.chMaps
+
+	for name, digest := range map[string]*pb.TDigestV2{
+		"nan mean":             {Compression: 100, Means: []float64{math.NaN()}, Weights: []float64{1}},
+		"inf weight":           {Compression: 100, Means: []float64{1}, Weights: []float64{math.Inf(1)}},
+		"compression too high": {Compression: 1e9, Means: []float64{1}, Weights: []float64{1}},
+		"mismatched":           {Compression: 100, Means: []float64{1, 2}, Weights: []float64{1}},
+	} {
+		assert.Equal(t, http.StatusBadRequest, post(digest), name)
+	}
+}
+
+func TestIngestionDropsNaN(t *testing.T) {
+	t.Parallel()
+	ch := &channeledHandler{chMaps: make(chan *gostatsd.MetricMap, 1)}
+	hs, err := web.NewHttpServer(logrus.StandardLogger(), ch, "TestIngestionDropsNaN", "", false, false, true, false, web.HttpServerOptions{})
+	require.NoError(t, err)
+	c := httptest.NewServer(hs.Router)
+	defer c.Close()
+
+	body, err := proto.Marshal(&pb.RawMessageV2{
+		Gauges: map[string]*pb.GaugeTagV2{
+			"nan": {TagMap: map[string]*pb.RawGaugeV2{"": {Value: math.NaN()}}},
+		},
+		Timers: map[string]*pb.TimerTagV2{
+			"latency": {TagMap: map[string]*pb.RawTimerV2{"": {Values: []float64{1, math.NaN(), 3}, SampleCount: 3}}},
+		},
+	})
+	require.NoError(t, err)
+	resp, err := c.Client().Post(c.URL+"/v2/raw", "application/x-protobuf", bytes.NewReader(body))
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, http.StatusAccepted, resp.StatusCode)
+
+	mm := <-ch.chMaps
+	assert.Empty(t, mm.Gauges)
+	assert.Equal(t, []float64{1, 3}, mm.Timers["latency"][""].Values)
+	assert.EqualValues(t, 2, mm.Timers["latency"][""].SampledCount)
+}
+
+func TestIngestionMaxBodySize(t *testing.T) {
+	t.Parallel()
+	ch := &channeledHandler{chMaps: make(chan *gostatsd.MetricMap, 1)}
+	body, err := proto.Marshal(&pb.RawMessageV2{
+		Gauges: map[string]*pb.GaugeTagV2{
+			"gauge": {TagMap: map[string]*pb.RawGaugeV2{"": {Value: 1}}},
+		},
+	})
+	require.NoError(t, err)
+	post := func(maxBodySize int64) int {
+		hs, err := web.NewHttpServer(logrus.StandardLogger(), ch, "TestIngestionMaxBodySize", "", false, false, true, false, web.HttpServerOptions{IngestMaxBodySize: maxBodySize})
+		require.NoError(t, err)
+		c := httptest.NewServer(hs.Router)
+		defer c.Close()
+		resp, err := c.Client().Post(c.URL+"/v2/raw", "application/x-protobuf", bytes.NewReader(body))
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		return resp.StatusCode
+	}
+
+	assert.Equal(t, http.StatusRequestEntityTooLarge, post(int64(len(body)-1)))
+	assert.Equal(t, http.StatusAccepted, post(int64(len(body))))
+	mm := <-ch.chMaps
+	assert.Equal(t, 1.0, mm.Gauges["gauge"][""].Value)
+}
@@ -16,6 +16,7 @@ import (
 
 	"github.com/atlassian/gostatsd"
 	"github.com/atlassian/gostatsd/internal/util"
+	"github.com/atlassian/gostatsd/pkg/stats"
 )
 
 type httpServer struct {
@@ -23,6 +24,7 @@ type httpServer struct {
 	address      string
 	Router       *mux.Router // should be private, but project layout is not great.
 	rawMetricsV2 *rawHttpHandlerV2
+	inject       *injectHandler
 }
 
 type route struct {
@@ -34,11 +36,11 @@ type route struct {
 
 var done = struct{}{}
 
-func NewHttpServersFromViper(v *viper.Viper, logger logrus.FieldLogger, handler gostatsd.PipelineHandler) ([]*httpServer, error) {
+func NewHttpServersFromViper(v *viper.Viper, logger logrus.FieldLogger, handler gostatsd.PipelineHandler, buildInfo gostatsd.BuildInfo) ([]*httpServer, error) {
 	httpServerNames := v.GetStringSlice("http-servers")
 	servers := make([]*httpServer, 0, len(httpServerNames))
 	for _, httpServerName := range httpServerNames {
-		server, err := newHttpServerFromViper(logger, v, httpServerName, handler)
+		server, err := newHttpServerFromViper(logger, v, httpServerName, handler, buildInfo)
 		if err != nil {
 			return nil, fmt.Errorf("failed to make http-server %s: %v", httpServerName, err)
 		}
@@ -52,6 +54,7 @@ func newHttpServerFromViper(
 	vMain *viper.Viper,
 	serverName string,
 	handler gostatsd.PipelineHandler,
+	buildInfo gostatsd.BuildInfo,
 ) (*httpServer, error) {
 	vSub := util.GetSubViper(vMain, "http."+serverName)
 	vSub.SetDefault("address", "127.0.0.1:8080")
@@ -59,6 +62,20 @@ func newHttpServerFromViper(
 	vSub.SetDefault("enable-expvar", false)
 	vSub.SetDefault("enable-ingestion", false)
 	vSub.SetDefault("enable-healthcheck", true)
+	vSub.SetDefault("enable-inject", false)
+	vSub.SetDefault("inject-token", "")
+	vSub.SetDefault("inject-source-header", "")
+	vSub.SetDefault("inject-max-batch-size", 10000)
+	vSub.SetDefault("inject-batch-window", time.Duration(0))
+	vSub.SetDefault("inject-max-body-size", int64(10*1024*1024))
+	vSub.SetDefault("ingest-header-tags", map[string]string{})
+	vSub.SetDefault("ingest-max-body-size", int64(0))
+
+	var prometheusRegistry *stats.PrometheusRegistry
+	if vMain.GetBool(gostatsd.ParamPrometheusInternalMetrics) {
+		// The registry the internal metrics of the Server are published in
+		prometheusRegistry = stats.DefaultPrometheusRegistry
+	}
 
 	return NewHttpServer(
 		logger.WithField("http-server", serverName),
@@ -69,9 +86,48 @@ func newHttpServerFromViper(
 		vSub.GetBool("enable-expvar"),
 		vSub.GetBool("enable-ingestion"),
 		vSub.GetBool("enable-healthcheck"),
+		HttpServerOptions{
+			EnableInject:       vSub.GetBool("enable-inject"),
+			PrometheusRegistry: prometheusRegistry,
+			InjectToken:        vSub.GetString("inject-token"),
+			InjectSourceHeader: vSub.GetString("inject-source-header"),
+			InjectMaxBatchSize: vSub.GetInt("inject-max-batch-size"),
+			InjectBatchWindow:  vSub.GetDuration("inject-batch-window"),
+			InjectMaxBodySize:  vSub.GetInt64("inject-max-body-size"),
+			IngestHeaderTags:   vSub.GetStringMapString("ingest-header-tags"),
+			IngestMaxBodySize:  vSub.GetInt64("ingest-max-body-size"),
+			BuildInfo:          buildInfo,
+		},
 	)
 }
 
+// HttpServerOptions holds the configuration of an HTTP server beyond which of its core endpoints are enabled.
+type HttpServerOptions struct {
+	// EnableInject enables the /admin/inject endpoint, which requires InjectToken.
+	EnableInject bool
+	// PrometheusRegistry is the registry served by the /internal/metrics endpoint, or nil to disable it.
+	PrometheusRegistry *stats.PrometheusRegistry
+	// InjectToken is the bearer token requests to /admin/inject must have.
+	InjectToken string
+	// InjectSourceHeader is the header the source IP of injected metrics is taken from, such as X-Forwarded-For when
+	// behind a proxy, if not empty.
+	InjectSourceHeader string
+	// InjectMaxBatchSize is the most metrics and events accepted in a single inject request.
+	InjectMaxBatchSize int
+	// InjectBatchWindow is how long injected metrics are batched for before they're dispatched, or 0 to dispatch them
+	// immediately.
+	InjectBatchWindow time.Duration
+	// InjectMaxBodySize is the largest request body accepted by /admin/inject.
+	InjectMaxBodySize int64
+	// IngestHeaderTags maps the headers of ingestion requests to the tag keys their values are added as.
+	IngestHeaderTags map[string]string
+	// IngestMaxBodySize is the largest request body accepted by the ingestion endpoints, before it is decompressed, or
+	// 0 for unlimited.
+	IngestMaxBodySize int64
+	// BuildInfo is reported by the /version endpoint.
+	BuildInfo gostatsd.BuildInfo
+}
+
 func NewHttpServer(
 	logger logrus.FieldLogger,
 	handler gostatsd.PipelineHandler,
@@ -80,6 +136,7 @@ func NewHttpServer(
 	enableExpVar,
 	enableIngestion,
 	enableHealthcheck bool,
+	options HttpServerOptions,
 ) (*httpServer, error) {
 	var routes []route
 
@@ -105,7 +162,7 @@ func NewHttpServer(
 	}
 
 	if enableIngestion {
-		server.rawMetricsV2 = newRawHttpHandlerV2(logger, serverName, handler)
+		server.rawMetricsV2 = newRawHttpHandlerV2(logger, serverName, handler, options.IngestHeaderTags, options.IngestMaxBodySize)
 		routes = append(routes,
 			route{path: "/v2/raw", handler: server.rawMetricsV2.MetricHandler, methods: []string{"POST"}, name: "metricsv2_post"},
 			route{path: "/v2/event", handler: server.rawMetricsV2.EventHandler, methods: []string{"POST"}, name: "eventsv2_post"},
@@ -113,15 +170,32 @@ func NewHttpServer(
 	}
 
 	if enableHealthcheck {
-		hc := &healthChecker{logger}
+		hc := &healthChecker{logger, options.BuildInfo}
 		routes = append(routes,
 			route{path: "/healthcheck", handler: hc.healthCheck, methods: []string{"GET"}, name: "healthcheck_get"},
 			route{path: "/deepcheck", handler: hc.deepCheck, methods: []string{"GET"}, name: "deepcheck_get"},
+			route{path: "/version", handler: hc.version, methods: []string{"GET"}, name: "version_get"},
+		)
+	}
+
+	if options.EnableInject {
+		if options.InjectToken == "" {
+			return nil, fmt.Errorf("inject-token is required when inject is enabled")
+		}
+		server.inject = newInjectHandler(logger, handler, options.InjectToken, options.InjectSourceHeader, options.InjectMaxBatchSize, options.InjectBatchWindow, options.InjectMaxBodySize)
+		routes = append(routes,
+			route{path: "/admin/inject", handler: server.inject.InjectHandler, methods: []string{"POST"}, name: "inject_post"},
 		)
 	}
 
 	if len(routes) == 0 {
-		return nil, fmt.Errorf("must enable at least one of prof, expvar, ingestion, or healthcheck")
+		return nil, fmt.Errorf("must enable at least one of prof, expvar, ingestion, healthcheck, or inject")
+	}
+
+	if options.PrometheusRegistry != nil {
+		routes = append(routes,
+			route{path: "/internal/metrics", handler: options.PrometheusRegistry.ServeHTTP, methods: []string{"GET"}, name: "internal_metrics_get"},
+		)
 	}
 
 	router, err := createRoutes(routes)
@@ -133,11 +207,13 @@ func NewHttpServer(
 	server.Router = router
 
 	logger.WithFields(logrus.Fields{
-		"address":            address,
-		"enable-pprof":       enableProf,
-		"enable-expvar":      enableExpVar,
-		"enable-ingestion":   enableIngestion,
-		"enable-healthcheck": enableHealthcheck,
+		"address":                     address,
+		"enable-pprof":                enableProf,
+		"enable-expvar":               enableExpVar,
+		"enable-ingestion":            enableIngestion,
+		"enable-healthcheck":          enableHealthcheck,
+		"enable-inject":               options.EnableInject,
+		"prometheus-internal-metrics": options.PrometheusRegistry != nil,
 	}).Info("Created server")
 
 	return server, nil
@@ -221,6 +297,11 @@ func (hs *httpServer) Run(ctx context.Context) {
 	case <-time.After(6 * time.Second):
 		hs.logger.Info("timeout waiting for webserver to stop")
 	}
+
+	if hs.inject != nil {
+		// Don't lose the injected metrics waiting for the batch window to end
+		hs.inject.flush()
+	}
 }
 
 // waitAndStop will gracefully shut down the Server when the Context passed is cancelled.  It signals
@@ -3,8 +3,45 @@ package web
 import (
 	"bytes"
 	"compress/zlib"
+	"errors"
+	"io"
 )
 
+// errRequestBodyTooLarge is returned when reading a request body limited by limitBody past its limit.
+var errRequestBodyTooLarge = errors.New("request body too large")
+
+// limitBody returns body limited to maxSize bytes.  It's the same as http.MaxBytesReader, except the error returned by
+// reading past the limit is errRequestBodyTooLarge, as http.MaxBytesError is only available from go 1.19.
+func limitBody(body io.ReadCloser, maxSize int64) io.ReadCloser {
+	return &limitedBody{
+		ReadCloser: body,
+		remaining:  maxSize,
+	}
+}
+
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64 // -1 once the limit has been passed
+}
+
+func (lb *limitedBody) Read(p []byte) (int, error) {
+	if lb.remaining < 0 {
+		return 0, errRequestBodyTooLarge
+	}
+	// Read one more byte than remains, to tell a body of exactly the limit from a larger one
+	if int64(len(p)) > lb.remaining+1 {
+		p = p[:lb.remaining+1]
+	}
+	n, err := lb.ReadCloser.Read(p)
+	if int64(n) <= lb.remaining {
+		lb.remaining -= int64(n)
+		return n, err
+	}
+	n = int(lb.remaining)
+	lb.remaining = -1
+	return n, errRequestBodyTooLarge
+}
+
 func decompress(input []byte) ([]byte, error) {
 	decompressor, err := zlib.NewReader(bytes.NewReader(input))
 	if err != nil {
@@ -2,12 +2,21 @@ package web_test
 
 import (
 	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/stats"
 	"github.com/atlassian/gostatsd/pkg/web"
 )
 
@@ -24,6 +33,7 @@ func TestHttpServerShutsdown(t *testing.T) {
 		false,
 		false,
 		true,
+		web.HttpServerOptions{},
 	)
 	require.NoError(t, err)
 
@@ -44,3 +54,82 @@ func TestHttpServerShutsdown(t *testing.T) {
 	case <-chDone:
 	}
 }
+
+var (
+	prometheusTypeLine   = regexp.MustCompile(`^# TYPE [a-zA-Z_:][a-zA-Z0-9_:]* (counter|gauge)$`)
+	prometheusSampleLine = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*(\{[a-zA-Z_][a-zA-Z0-9_]*="([^"\\]|\\.)*"(,[a-zA-Z_][a-zA-Z0-9_]*="([^"\\]|\\.)*")*\})? (NaN|[+-]Inf|[-+0-9.e]+)$`)
+)
+
+func TestInternalMetricsEndpoint(t *testing.T) {
+	t.Parallel()
+	registry := stats.NewPrometheusRegistry()
+	statser := stats.NewPrometheusStatser(stats.NewNullStatser(), gostatsd.Tags{"pipeline:TestInternalMetricsEndpoint"}, registry, 0)
+	statser.Gauge("aggregator.metrics_received", 5, gostatsd.Tags{"aggregator_id:1"})
+	statser.Count("parser.bad_lines_seen", 2, nil)
+
+	hs, err := web.NewHttpServer(
+		logrus.StandardLogger(),
+		nil,
+		"TestInternalMetricsEndpoint",
+		"",
+		false,
+		false,
+		false,
+		true,
+		web.HttpServerOptions{
+			PrometheusRegistry: registry,
+		},
+	)
+	require.NoError(t, err)
+	c := httptest.NewServer(hs.Router)
+	defer c.Close()
+
+	resp, err := http.Get(c.URL + "/internal/metrics")
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, resp.Header.Get("Content-Type"), "version=0.0.4")
+
+	exposition := string(body)
+	require.True(t, strings.HasSuffix(exposition, "\n"))
+	for _, line := range strings.Split(strings.TrimSuffix(exposition, "\n"), "\n") {
+		assert.True(t, prometheusTypeLine.MatchString(line) || prometheusSampleLine.MatchString(line), "invalid line %q", line)
+	}
+	assert.Contains(t, exposition, "# TYPE aggregator_metrics_received gauge\n")
+	assert.Contains(t, exposition, `aggregator_metrics_received{aggregator_id="1",pipeline="TestInternalMetricsEndpoint"} 5`)
+	assert.Contains(t, exposition, "# TYPE parser_bad_lines_seen counter\n")
+	assert.Contains(t, exposition, `parser_bad_lines_seen{pipeline="TestInternalMetricsEndpoint"} 2`)
+}
+
+func TestVersionEndpoint(t *testing.T) {
+	t.Parallel()
+	buildInfo := gostatsd.BuildInfo{Version: "1.2.3", GitCommit: "abc123", BuildDate: "2024-01-02"}
+	hs, err := web.NewHttpServer(
+		logrus.StandardLogger(),
+		nil,
+		"TestVersionEndpoint",
+		"",
+		false,
+		false,
+		false,
+		true,
+		web.HttpServerOptions{
+			BuildInfo: buildInfo,
+		},
+	)
+	require.NoError(t, err)
+	c := httptest.NewServer(hs.Router)
+	defer c.Close()
+
+	resp, err := http.Get(c.URL + "/version")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+
+	var actual gostatsd.BuildInfo
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&actual))
+	assert.Equal(t, buildInfo, actual)
+}
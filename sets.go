@@ -1,11 +1,15 @@
 package gostatsd
 
+import "time"
+
 // Set is used for storing aggregated values for sets.
 type Set struct {
 	Values    map[string]struct{}
-	Timestamp Nanotime // Last time value was updated
-	Source    Source   // Hostname of the source of the metric
-	Tags      Tags     // The tags for the set
+	Timestamp Nanotime      // Last time value was updated
+	Source    Source        // Hostname of the source of the metric
+	Tags      Tags          // The tags for the set
+	Expiry    time.Duration // Overrides the expiry interval for sets, if not 0
+	FirstSeen Nanotime      // When the series was first aggregated, set by the aggregator
 }
 
 // NewSet initialises a new set.
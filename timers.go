@@ -1,7 +1,12 @@
 package gostatsd
 
 import (
+	"math"
+	"time"
+
 	"github.com/spf13/viper"
+
+	"github.com/atlassian/gostatsd/pkg/tdigest"
 )
 
 // Timer is used for storing aggregated values for timers.
@@ -22,9 +27,26 @@ type Timer struct {
 	Source       Source      // Hostname of the source of the metric
 	Tags         Tags        // The tags for the timer
 
+	// Expiry overrides the expiry interval for timers, if not 0.
+	Expiry time.Duration
+	// FirstSeen is when the series was first aggregated, set by the aggregator.
+	FirstSeen Nanotime
+
+	// Digest summarises values which were forwarded as a t-digest, rather than as raw values.
+	// Values and Digest are combined when the timer is aggregated.
+	Digest *tdigest.TDigest
+
+	// DisabledSubtypes overrides the sub-metrics disabled by the backend, if set.
+	// It is populated by the aggregator when a timer override matches the timer.
+	DisabledSubtypes *TimerSubtypes
+
 	// Map bounds to count of measures seen in that bucket.
 	// This map only non-empty if the metric specifies histogram aggregation in its tags.
 	Histogram map[HistogramThreshold]int
+
+	// Buckets is the cumulative count of each bucket of histograms which were received pre-aggregated, rather than as
+	// values.  The aggregator combines them with any Values in to the Histogram.
+	Buckets map[HistogramThreshold]int
 }
 
 type HistogramThreshold float64
@@ -44,6 +66,35 @@ func (t *Timer) AddTagsSetSource(additionalTags Tags, newSource Source) {
 	t.Source = newSource
 }
 
+// EffectiveDisabledSubtypes returns the sub-metrics which should not be emitted for the timer, given the
+// sub-metrics disabled by the backend.
+func (t *Timer) EffectiveDisabledSubtypes(defaults TimerSubtypes) TimerSubtypes {
+	if t.DisabledSubtypes != nil {
+		return *t.DisabledSubtypes
+	}
+	return defaults
+}
+
+// mergeBuckets returns the bucket counts of both into and from, without modifying either, as either may be shared
+// with another MetricMap.  If they have different thresholds, only the thresholds they share are kept, as the count
+// of the others is not known for both.  Bucket counts without any values are replaced.
+func mergeBuckets(into, from map[HistogramThreshold]int) map[HistogramThreshold]int {
+	infiniteThreshold := HistogramThreshold(math.Inf(1))
+	if into[infiniteThreshold] == 0 {
+		return from
+	}
+	if from[infiniteThreshold] == 0 {
+		return into
+	}
+	merged := make(map[HistogramThreshold]int, len(into))
+	for threshold, count := range into {
+		if fromCount, ok := from[threshold]; ok {
+			merged[threshold] = count + fromCount
+		}
+	}
+	return merged
+}
+
 // Timers stores a map of timers by tags.
 type Timers map[string]map[string]Timer
 
@@ -97,6 +148,10 @@ func DisabledSubMetrics(viper *viper.Viper) TimerSubtypes {
 	subViper.SetDefault("sum-pct", false)
 	subViper.SetDefault("sum-squares", false)
 	subViper.SetDefault("sum-squares-pct", false)
+	subViper.SetDefault("counter-total", false)
+	subViper.SetDefault("counter-rate", false)
+	subViper.SetDefault("min-gauge", false)
+	subViper.SetDefault("max-gauge", false)
 
 	return TimerSubtypes{
 		Lower:          subViper.GetBool("lower"),
@@ -114,5 +169,9 @@ func DisabledSubMetrics(viper *viper.Viper) TimerSubtypes {
 		SumPct:         subViper.GetBool("sum-pct"),
 		SumSquares:     subViper.GetBool("sum-squares"),
 		SumSquaresPct:  subViper.GetBool("sum-squares-pct"),
+		CounterTotal:   subViper.GetBool("counter-total"),
+		CounterRate:    subViper.GetBool("counter-rate"),
+		MinGauge:       subViper.GetBool("min-gauge"),
+		MaxGauge:       subViper.GetBool("max-gauge"),
 	}
 }
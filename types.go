@@ -45,6 +45,10 @@ type TimerSubtypes struct {
 	SumPct         bool // pct
 	SumSquares     bool
 	SumSquaresPct  bool // pct
+	CounterTotal   bool // counter, when split in to a total and a rate
+	CounterRate    bool // counter, when split in to a total and a rate
+	MinGauge       bool // timer min, when emitted as a gauge
+	MaxGauge       bool // timer max, when emitted as a gauge
 }
 
 // Runnable is a long running function intended to be launched in a goroutine.
@@ -76,6 +80,8 @@ type RawMetricHandler interface {
 }
 
 // PipelineHandler can be used to handle metrics and events, it provides an estimate of how many tags it may add.
+// Custom handlers can implement it to be inserted in to the pipeline with statsd.Server.Handlers, and it will only be
+// changed in a new major version.
 type PipelineHandler interface {
 	RawMetricHandler
 	// EstimatedTags returns a guess for how many tags to pre-allocate
@@ -85,3 +91,19 @@ type PipelineHandler interface {
 	// WaitForEvents waits for all event-dispatching goroutines to finish.
 	WaitForEvents()
 }
+
+// BuildInfo describes the build of the running binary.
+type BuildInfo struct {
+	Version   string `json:"version"`
+	GitCommit string `json:"commit"`
+	BuildDate string `json:"build_date"`
+}
+
+// Tags returns the build info as the tags of the build info metric.
+func (bi BuildInfo) Tags() Tags {
+	return Tags{
+		"version:" + bi.Version,
+		"commit:" + bi.GitCommit,
+		"build_date:" + bi.BuildDate,
+	}
+}